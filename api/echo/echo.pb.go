@@ -1,6 +1,6 @@
 // Code generated by protoc-gen-go. DO NOT EDIT.
 // versions:
-// 	protoc-gen-go v1.36.4
+// 	protoc-gen-go v1.36.11
 // 	protoc        v5.29.3
 // source: api/echo/echo.proto
 
@@ -22,8 +22,10 @@ const (
 )
 
 type EchoRequest struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Message       string                 `protobuf:"bytes,1,opt,name=message,proto3" json:"message,omitempty"`
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	Message string                 `protobuf:"bytes,1,opt,name=message,proto3" json:"message,omitempty"`
+	// How many responses ServerStreamingEcho sends back (at least one)
+	Repeat        int32 `protobuf:"varint,2,opt,name=repeat,proto3" json:"repeat,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -65,6 +67,13 @@ func (x *EchoRequest) GetMessage() string {
 	return ""
 }
 
+func (x *EchoRequest) GetRepeat() int32 {
+	if x != nil {
+		return x.Repeat
+	}
+	return 0
+}
+
 type EchoResponse struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Message       string                 `protobuf:"bytes,1,opt,name=message,proto3" json:"message,omitempty"`
@@ -117,6 +126,8 @@ type SecureEnvelope struct {
 	Payload         []byte                 `protobuf:"bytes,3,opt,name=payload,proto3" json:"payload,omitempty"`
 	ClientSignature []byte                 `protobuf:"bytes,4,opt,name=client_signature,json=clientSignature,proto3" json:"client_signature,omitempty"`
 	ProxySignature  []byte                 `protobuf:"bytes,5,opt,name=proxy_signature,json=proxySignature,proto3" json:"proxy_signature,omitempty"`
+	// One entry per proxy hop, in the order they signed (proxy_sig_list_field)
+	ProxySignatures []*ProxySignature `protobuf:"bytes,6,rep,name=proxy_signatures,json=proxySignatures,proto3" json:"proxy_signatures,omitempty"`
 	unknownFields   protoimpl.UnknownFields
 	sizeCache       protoimpl.SizeCache
 }
@@ -186,64 +197,514 @@ func (x *SecureEnvelope) GetProxySignature() []byte {
 	return nil
 }
 
+func (x *SecureEnvelope) GetProxySignatures() []*ProxySignature {
+	if x != nil {
+		return x.ProxySignatures
+	}
+	return nil
+}
+
+// ProxySignature is one proxy's signature over the payload
+type ProxySignature struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	KeyId         string                 `protobuf:"bytes,1,opt,name=key_id,json=keyId,proto3" json:"key_id,omitempty"`
+	Algorithm     string                 `protobuf:"bytes,2,opt,name=algorithm,proto3" json:"algorithm,omitempty"`
+	Signature     []byte                 `protobuf:"bytes,3,opt,name=signature,proto3" json:"signature,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ProxySignature) Reset() {
+	*x = ProxySignature{}
+	mi := &file_api_echo_echo_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ProxySignature) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProxySignature) ProtoMessage() {}
+
+func (x *ProxySignature) ProtoReflect() protoreflect.Message {
+	mi := &file_api_echo_echo_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProxySignature.ProtoReflect.Descriptor instead.
+func (*ProxySignature) Descriptor() ([]byte, []int) {
+	return file_api_echo_echo_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ProxySignature) GetKeyId() string {
+	if x != nil {
+		return x.KeyId
+	}
+	return ""
+}
+
+func (x *ProxySignature) GetAlgorithm() string {
+	if x != nil {
+		return x.Algorithm
+	}
+	return ""
+}
+
+func (x *ProxySignature) GetSignature() []byte {
+	if x != nil {
+		return x.Signature
+	}
+	return nil
+}
+
+// StressEnvelope is a SecureEnvelope with nested, repeated and map-heavy
+// fields around the payload, to stress dynamic decoding on the proxy
+type StressEnvelope struct {
+	state           protoimpl.MessageState   `protogen:"open.v1"`
+	Metadata        map[string]string        `protobuf:"bytes,1,rep,name=metadata,proto3" json:"metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	TypeUrl         string                   `protobuf:"bytes,2,opt,name=type_url,json=typeUrl,proto3" json:"type_url,omitempty"`
+	Payload         []byte                   `protobuf:"bytes,3,opt,name=payload,proto3" json:"payload,omitempty"`
+	ClientSignature []byte                   `protobuf:"bytes,4,opt,name=client_signature,json=clientSignature,proto3" json:"client_signature,omitempty"`
+	ProxySignature  []byte                   `protobuf:"bytes,5,opt,name=proxy_signature,json=proxySignature,proto3" json:"proxy_signature,omitempty"`
+	Chunks          [][]byte                 `protobuf:"bytes,6,rep,name=chunks,proto3" json:"chunks,omitempty"`
+	Records         []*StressRecord          `protobuf:"bytes,7,rep,name=records,proto3" json:"records,omitempty"`
+	Index           map[string]*StressRecord `protobuf:"bytes,8,rep,name=index,proto3" json:"index,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Blobs           map[int64][]byte         `protobuf:"bytes,9,rep,name=blobs,proto3" json:"blobs,omitempty" protobuf_key:"varint,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *StressEnvelope) Reset() {
+	*x = StressEnvelope{}
+	mi := &file_api_echo_echo_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StressEnvelope) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StressEnvelope) ProtoMessage() {}
+
+func (x *StressEnvelope) ProtoReflect() protoreflect.Message {
+	mi := &file_api_echo_echo_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StressEnvelope.ProtoReflect.Descriptor instead.
+func (*StressEnvelope) Descriptor() ([]byte, []int) {
+	return file_api_echo_echo_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *StressEnvelope) GetMetadata() map[string]string {
+	if x != nil {
+		return x.Metadata
+	}
+	return nil
+}
+
+func (x *StressEnvelope) GetTypeUrl() string {
+	if x != nil {
+		return x.TypeUrl
+	}
+	return ""
+}
+
+func (x *StressEnvelope) GetPayload() []byte {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
+}
+
+func (x *StressEnvelope) GetClientSignature() []byte {
+	if x != nil {
+		return x.ClientSignature
+	}
+	return nil
+}
+
+func (x *StressEnvelope) GetProxySignature() []byte {
+	if x != nil {
+		return x.ProxySignature
+	}
+	return nil
+}
+
+func (x *StressEnvelope) GetChunks() [][]byte {
+	if x != nil {
+		return x.Chunks
+	}
+	return nil
+}
+
+func (x *StressEnvelope) GetRecords() []*StressRecord {
+	if x != nil {
+		return x.Records
+	}
+	return nil
+}
+
+func (x *StressEnvelope) GetIndex() map[string]*StressRecord {
+	if x != nil {
+		return x.Index
+	}
+	return nil
+}
+
+func (x *StressEnvelope) GetBlobs() map[int64][]byte {
+	if x != nil {
+		return x.Blobs
+	}
+	return nil
+}
+
+type StressRecord struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Id       string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Values   []int64                `protobuf:"varint,2,rep,packed,name=values,proto3" json:"values,omitempty"`
+	Labels   map[string]string      `protobuf:"bytes,3,rep,name=labels,proto3" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Children []*StressRecord        `protobuf:"bytes,4,rep,name=children,proto3" json:"children,omitempty"`
+	// Types that are valid to be assigned to Body:
+	//
+	//	*StressRecord_Text
+	//	*StressRecord_Data
+	Body          isStressRecord_Body `protobuf_oneof:"body"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StressRecord) Reset() {
+	*x = StressRecord{}
+	mi := &file_api_echo_echo_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StressRecord) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StressRecord) ProtoMessage() {}
+
+func (x *StressRecord) ProtoReflect() protoreflect.Message {
+	mi := &file_api_echo_echo_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StressRecord.ProtoReflect.Descriptor instead.
+func (*StressRecord) Descriptor() ([]byte, []int) {
+	return file_api_echo_echo_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *StressRecord) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *StressRecord) GetValues() []int64 {
+	if x != nil {
+		return x.Values
+	}
+	return nil
+}
+
+func (x *StressRecord) GetLabels() map[string]string {
+	if x != nil {
+		return x.Labels
+	}
+	return nil
+}
+
+func (x *StressRecord) GetChildren() []*StressRecord {
+	if x != nil {
+		return x.Children
+	}
+	return nil
+}
+
+func (x *StressRecord) GetBody() isStressRecord_Body {
+	if x != nil {
+		return x.Body
+	}
+	return nil
+}
+
+func (x *StressRecord) GetText() string {
+	if x != nil {
+		if x, ok := x.Body.(*StressRecord_Text); ok {
+			return x.Text
+		}
+	}
+	return ""
+}
+
+func (x *StressRecord) GetData() []byte {
+	if x != nil {
+		if x, ok := x.Body.(*StressRecord_Data); ok {
+			return x.Data
+		}
+	}
+	return nil
+}
+
+type isStressRecord_Body interface {
+	isStressRecord_Body()
+}
+
+type StressRecord_Text struct {
+	Text string `protobuf:"bytes,5,opt,name=text,proto3,oneof"`
+}
+
+type StressRecord_Data struct {
+	Data []byte `protobuf:"bytes,6,opt,name=data,proto3,oneof"`
+}
+
+func (*StressRecord_Text) isStressRecord_Body() {}
+
+func (*StressRecord_Data) isStressRecord_Body() {}
+
+// BatchEnvelope carries several work items, each with its own payload and
+// signatures (items_field), rather than a single payload
+type BatchEnvelope struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Metadata map[string]string      `protobuf:"bytes,1,rep,name=metadata,proto3" json:"metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Items    []*BatchItem           `protobuf:"bytes,2,rep,name=items,proto3" json:"items,omitempty"`
+	// The proxy's signature over all the items (batch_signature: aggregate)
+	ProxySignature []byte `protobuf:"bytes,3,opt,name=proxy_signature,json=proxySignature,proto3" json:"proxy_signature,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *BatchEnvelope) Reset() {
+	*x = BatchEnvelope{}
+	mi := &file_api_echo_echo_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BatchEnvelope) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchEnvelope) ProtoMessage() {}
+
+func (x *BatchEnvelope) ProtoReflect() protoreflect.Message {
+	mi := &file_api_echo_echo_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchEnvelope.ProtoReflect.Descriptor instead.
+func (*BatchEnvelope) Descriptor() ([]byte, []int) {
+	return file_api_echo_echo_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *BatchEnvelope) GetMetadata() map[string]string {
+	if x != nil {
+		return x.Metadata
+	}
+	return nil
+}
+
+func (x *BatchEnvelope) GetItems() []*BatchItem {
+	if x != nil {
+		return x.Items
+	}
+	return nil
+}
+
+func (x *BatchEnvelope) GetProxySignature() []byte {
+	if x != nil {
+		return x.ProxySignature
+	}
+	return nil
+}
+
+type BatchItem struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	TypeUrl         string                 `protobuf:"bytes,1,opt,name=type_url,json=typeUrl,proto3" json:"type_url,omitempty"`
+	Payload         []byte                 `protobuf:"bytes,2,opt,name=payload,proto3" json:"payload,omitempty"`
+	ClientSignature []byte                 `protobuf:"bytes,3,opt,name=client_signature,json=clientSignature,proto3" json:"client_signature,omitempty"`
+	ProxySignature  []byte                 `protobuf:"bytes,4,opt,name=proxy_signature,json=proxySignature,proto3" json:"proxy_signature,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *BatchItem) Reset() {
+	*x = BatchItem{}
+	mi := &file_api_echo_echo_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BatchItem) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchItem) ProtoMessage() {}
+
+func (x *BatchItem) ProtoReflect() protoreflect.Message {
+	mi := &file_api_echo_echo_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchItem.ProtoReflect.Descriptor instead.
+func (*BatchItem) Descriptor() ([]byte, []int) {
+	return file_api_echo_echo_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *BatchItem) GetTypeUrl() string {
+	if x != nil {
+		return x.TypeUrl
+	}
+	return ""
+}
+
+func (x *BatchItem) GetPayload() []byte {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
+}
+
+func (x *BatchItem) GetClientSignature() []byte {
+	if x != nil {
+		return x.ClientSignature
+	}
+	return nil
+}
+
+func (x *BatchItem) GetProxySignature() []byte {
+	if x != nil {
+		return x.ProxySignature
+	}
+	return nil
+}
+
 var File_api_echo_echo_proto protoreflect.FileDescriptor
 
-var file_api_echo_echo_proto_rawDesc = string([]byte{
-	0x0a, 0x13, 0x61, 0x70, 0x69, 0x2f, 0x65, 0x63, 0x68, 0x6f, 0x2f, 0x65, 0x63, 0x68, 0x6f, 0x2e,
-	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x04, 0x65, 0x63, 0x68, 0x6f, 0x22, 0x27, 0x0a, 0x0b, 0x45,
-	0x63, 0x68, 0x6f, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x18, 0x0a, 0x07, 0x6d, 0x65,
-	0x73, 0x73, 0x61, 0x67, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x6d, 0x65, 0x73,
-	0x73, 0x61, 0x67, 0x65, 0x22, 0x28, 0x0a, 0x0c, 0x45, 0x63, 0x68, 0x6f, 0x52, 0x65, 0x73, 0x70,
-	0x6f, 0x6e, 0x73, 0x65, 0x12, 0x18, 0x0a, 0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x18,
-	0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x22, 0x96,
-	0x02, 0x0a, 0x0e, 0x53, 0x65, 0x63, 0x75, 0x72, 0x65, 0x45, 0x6e, 0x76, 0x65, 0x6c, 0x6f, 0x70,
-	0x65, 0x12, 0x3e, 0x0a, 0x08, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x18, 0x01, 0x20,
-	0x03, 0x28, 0x0b, 0x32, 0x22, 0x2e, 0x65, 0x63, 0x68, 0x6f, 0x2e, 0x53, 0x65, 0x63, 0x75, 0x72,
-	0x65, 0x45, 0x6e, 0x76, 0x65, 0x6c, 0x6f, 0x70, 0x65, 0x2e, 0x4d, 0x65, 0x74, 0x61, 0x64, 0x61,
-	0x74, 0x61, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x08, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74,
-	0x61, 0x12, 0x19, 0x0a, 0x08, 0x74, 0x79, 0x70, 0x65, 0x5f, 0x75, 0x72, 0x6c, 0x18, 0x02, 0x20,
-	0x01, 0x28, 0x09, 0x52, 0x07, 0x74, 0x79, 0x70, 0x65, 0x55, 0x72, 0x6c, 0x12, 0x18, 0x0a, 0x07,
-	0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x07, 0x70,
-	0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x12, 0x29, 0x0a, 0x10, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74,
-	0x5f, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0c,
-	0x52, 0x0f, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x53, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72,
-	0x65, 0x12, 0x27, 0x0a, 0x0f, 0x70, 0x72, 0x6f, 0x78, 0x79, 0x5f, 0x73, 0x69, 0x67, 0x6e, 0x61,
-	0x74, 0x75, 0x72, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0e, 0x70, 0x72, 0x6f, 0x78,
-	0x79, 0x53, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x1a, 0x3b, 0x0a, 0x0d, 0x4d, 0x65,
-	0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b,
-	0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x14, 0x0a,
-	0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x76, 0x61,
-	0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x32, 0x8a, 0x01, 0x0a, 0x0b, 0x45, 0x63, 0x68, 0x6f,
-	0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x12, 0x32, 0x0a, 0x09, 0x55, 0x6e, 0x61, 0x72, 0x79,
-	0x45, 0x63, 0x68, 0x6f, 0x12, 0x11, 0x2e, 0x65, 0x63, 0x68, 0x6f, 0x2e, 0x45, 0x63, 0x68, 0x6f,
-	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x12, 0x2e, 0x65, 0x63, 0x68, 0x6f, 0x2e, 0x45,
-	0x63, 0x68, 0x6f, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x47, 0x0a, 0x1a, 0x42,
-	0x69, 0x64, 0x69, 0x72, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x61, 0x6c, 0x53, 0x74, 0x72, 0x65,
-	0x61, 0x6d, 0x69, 0x6e, 0x67, 0x45, 0x63, 0x68, 0x6f, 0x12, 0x11, 0x2e, 0x65, 0x63, 0x68, 0x6f,
-	0x2e, 0x45, 0x63, 0x68, 0x6f, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x12, 0x2e, 0x65,
-	0x63, 0x68, 0x6f, 0x2e, 0x45, 0x63, 0x68, 0x6f, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65,
-	0x28, 0x01, 0x30, 0x01, 0x32, 0x8c, 0x02, 0x0a, 0x0d, 0x53, 0x65, 0x63, 0x75, 0x72, 0x65, 0x53,
-	0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x12, 0x38, 0x0a, 0x0a, 0x53, 0x65, 0x63, 0x75, 0x72, 0x65,
-	0x45, 0x63, 0x68, 0x6f, 0x12, 0x14, 0x2e, 0x65, 0x63, 0x68, 0x6f, 0x2e, 0x53, 0x65, 0x63, 0x75,
-	0x72, 0x65, 0x45, 0x6e, 0x76, 0x65, 0x6c, 0x6f, 0x70, 0x65, 0x1a, 0x14, 0x2e, 0x65, 0x63, 0x68,
-	0x6f, 0x2e, 0x53, 0x65, 0x63, 0x75, 0x72, 0x65, 0x45, 0x6e, 0x76, 0x65, 0x6c, 0x6f, 0x70, 0x65,
-	0x12, 0x40, 0x0a, 0x0e, 0x53, 0x65, 0x63, 0x75, 0x72, 0x65, 0x42, 0x69, 0x64, 0x69, 0x45, 0x63,
-	0x68, 0x6f, 0x12, 0x14, 0x2e, 0x65, 0x63, 0x68, 0x6f, 0x2e, 0x53, 0x65, 0x63, 0x75, 0x72, 0x65,
-	0x45, 0x6e, 0x76, 0x65, 0x6c, 0x6f, 0x70, 0x65, 0x1a, 0x14, 0x2e, 0x65, 0x63, 0x68, 0x6f, 0x2e,
-	0x53, 0x65, 0x63, 0x75, 0x72, 0x65, 0x45, 0x6e, 0x76, 0x65, 0x6c, 0x6f, 0x70, 0x65, 0x28, 0x01,
-	0x30, 0x01, 0x12, 0x43, 0x0a, 0x11, 0x55, 0x6e, 0x6f, 0x72, 0x64, 0x65, 0x72, 0x65, 0x64, 0x42,
-	0x69, 0x64, 0x69, 0x45, 0x63, 0x68, 0x6f, 0x12, 0x14, 0x2e, 0x65, 0x63, 0x68, 0x6f, 0x2e, 0x53,
-	0x65, 0x63, 0x75, 0x72, 0x65, 0x45, 0x6e, 0x76, 0x65, 0x6c, 0x6f, 0x70, 0x65, 0x1a, 0x14, 0x2e,
-	0x65, 0x63, 0x68, 0x6f, 0x2e, 0x53, 0x65, 0x63, 0x75, 0x72, 0x65, 0x45, 0x6e, 0x76, 0x65, 0x6c,
-	0x6f, 0x70, 0x65, 0x28, 0x01, 0x30, 0x01, 0x12, 0x3a, 0x0a, 0x0c, 0x49, 0x6e, 0x73, 0x70, 0x65,
-	0x63, 0x74, 0x4f, 0x75, 0x74, 0x65, 0x72, 0x12, 0x14, 0x2e, 0x65, 0x63, 0x68, 0x6f, 0x2e, 0x53,
-	0x65, 0x63, 0x75, 0x72, 0x65, 0x45, 0x6e, 0x76, 0x65, 0x6c, 0x6f, 0x70, 0x65, 0x1a, 0x14, 0x2e,
-	0x65, 0x63, 0x68, 0x6f, 0x2e, 0x53, 0x65, 0x63, 0x75, 0x72, 0x65, 0x45, 0x6e, 0x76, 0x65, 0x6c,
-	0x6f, 0x70, 0x65, 0x42, 0x28, 0x5a, 0x26, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f,
-	0x6d, 0x2f, 0x61, 0x6e, 0x74, 0x68, 0x6f, 0x6e, 0x79, 0x2f, 0x67, 0x72, 0x70, 0x63, 0x2d, 0x70,
-	0x72, 0x6f, 0x78, 0x79, 0x2f, 0x61, 0x70, 0x69, 0x2f, 0x65, 0x63, 0x68, 0x6f, 0x62, 0x06, 0x70,
-	0x72, 0x6f, 0x74, 0x6f, 0x33,
-})
+const file_api_echo_echo_proto_rawDesc = "" +
+	"\n" +
+	"\x13api/echo/echo.proto\x12\x04echo\"?\n" +
+	"\vEchoRequest\x12\x18\n" +
+	"\amessage\x18\x01 \x01(\tR\amessage\x12\x16\n" +
+	"\x06repeat\x18\x02 \x01(\x05R\x06repeat\"(\n" +
+	"\fEchoResponse\x12\x18\n" +
+	"\amessage\x18\x01 \x01(\tR\amessage\"\xd7\x02\n" +
+	"\x0eSecureEnvelope\x12>\n" +
+	"\bmetadata\x18\x01 \x03(\v2\".echo.SecureEnvelope.MetadataEntryR\bmetadata\x12\x19\n" +
+	"\btype_url\x18\x02 \x01(\tR\atypeUrl\x12\x18\n" +
+	"\apayload\x18\x03 \x01(\fR\apayload\x12)\n" +
+	"\x10client_signature\x18\x04 \x01(\fR\x0fclientSignature\x12'\n" +
+	"\x0fproxy_signature\x18\x05 \x01(\fR\x0eproxySignature\x12?\n" +
+	"\x10proxy_signatures\x18\x06 \x03(\v2\x14.echo.ProxySignatureR\x0fproxySignatures\x1a;\n" +
+	"\rMetadataEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"c\n" +
+	"\x0eProxySignature\x12\x15\n" +
+	"\x06key_id\x18\x01 \x01(\tR\x05keyId\x12\x1c\n" +
+	"\talgorithm\x18\x02 \x01(\tR\talgorithm\x12\x1c\n" +
+	"\tsignature\x18\x03 \x01(\fR\tsignature\"\xd2\x04\n" +
+	"\x0eStressEnvelope\x12>\n" +
+	"\bmetadata\x18\x01 \x03(\v2\".echo.StressEnvelope.MetadataEntryR\bmetadata\x12\x19\n" +
+	"\btype_url\x18\x02 \x01(\tR\atypeUrl\x12\x18\n" +
+	"\apayload\x18\x03 \x01(\fR\apayload\x12)\n" +
+	"\x10client_signature\x18\x04 \x01(\fR\x0fclientSignature\x12'\n" +
+	"\x0fproxy_signature\x18\x05 \x01(\fR\x0eproxySignature\x12\x16\n" +
+	"\x06chunks\x18\x06 \x03(\fR\x06chunks\x12,\n" +
+	"\arecords\x18\a \x03(\v2\x12.echo.StressRecordR\arecords\x125\n" +
+	"\x05index\x18\b \x03(\v2\x1f.echo.StressEnvelope.IndexEntryR\x05index\x125\n" +
+	"\x05blobs\x18\t \x03(\v2\x1f.echo.StressEnvelope.BlobsEntryR\x05blobs\x1a;\n" +
+	"\rMetadataEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\x1aL\n" +
+	"\n" +
+	"IndexEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12(\n" +
+	"\x05value\x18\x02 \x01(\v2\x12.echo.StressRecordR\x05value:\x028\x01\x1a8\n" +
+	"\n" +
+	"BlobsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\x03R\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\fR\x05value:\x028\x01\"\x8d\x02\n" +
+	"\fStressRecord\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x16\n" +
+	"\x06values\x18\x02 \x03(\x03R\x06values\x126\n" +
+	"\x06labels\x18\x03 \x03(\v2\x1e.echo.StressRecord.LabelsEntryR\x06labels\x12.\n" +
+	"\bchildren\x18\x04 \x03(\v2\x12.echo.StressRecordR\bchildren\x12\x14\n" +
+	"\x04text\x18\x05 \x01(\tH\x00R\x04text\x12\x14\n" +
+	"\x04data\x18\x06 \x01(\fH\x00R\x04data\x1a9\n" +
+	"\vLabelsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01B\x06\n" +
+	"\x04body\"\xdb\x01\n" +
+	"\rBatchEnvelope\x12=\n" +
+	"\bmetadata\x18\x01 \x03(\v2!.echo.BatchEnvelope.MetadataEntryR\bmetadata\x12%\n" +
+	"\x05items\x18\x02 \x03(\v2\x0f.echo.BatchItemR\x05items\x12'\n" +
+	"\x0fproxy_signature\x18\x03 \x01(\fR\x0eproxySignature\x1a;\n" +
+	"\rMetadataEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\x94\x01\n" +
+	"\tBatchItem\x12\x19\n" +
+	"\btype_url\x18\x01 \x01(\tR\atypeUrl\x12\x18\n" +
+	"\apayload\x18\x02 \x01(\fR\apayload\x12)\n" +
+	"\x10client_signature\x18\x03 \x01(\fR\x0fclientSignature\x12'\n" +
+	"\x0fproxy_signature\x18\x04 \x01(\fR\x0eproxySignature2\x8a\x02\n" +
+	"\vEchoService\x122\n" +
+	"\tUnaryEcho\x12\x11.echo.EchoRequest\x1a\x12.echo.EchoResponse\x12G\n" +
+	"\x1aBidirectionalStreamingEcho\x12\x11.echo.EchoRequest\x1a\x12.echo.EchoResponse(\x010\x01\x12>\n" +
+	"\x13ServerStreamingEcho\x12\x11.echo.EchoRequest\x1a\x12.echo.EchoResponse0\x01\x12>\n" +
+	"\x13ClientStreamingEcho\x12\x11.echo.EchoRequest\x1a\x12.echo.EchoResponse(\x012\x8c\x02\n" +
+	"\rSecureService\x128\n" +
+	"\n" +
+	"SecureEcho\x12\x14.echo.SecureEnvelope\x1a\x14.echo.SecureEnvelope\x12@\n" +
+	"\x0eSecureBidiEcho\x12\x14.echo.SecureEnvelope\x1a\x14.echo.SecureEnvelope(\x010\x01\x12C\n" +
+	"\x11UnorderedBidiEcho\x12\x14.echo.SecureEnvelope\x1a\x14.echo.SecureEnvelope(\x010\x01\x12:\n" +
+	"\fInspectOuter\x12\x14.echo.SecureEnvelope\x1a\x14.echo.SecureEnvelope2\x8b\x01\n" +
+	"\rStressService\x128\n" +
+	"\n" +
+	"StressEcho\x12\x14.echo.StressEnvelope\x1a\x14.echo.StressEnvelope\x12@\n" +
+	"\x0eStressBidiEcho\x12\x14.echo.StressEnvelope\x1a\x14.echo.StressEnvelope(\x010\x012E\n" +
+	"\fBatchService\x125\n" +
+	"\tBatchEcho\x12\x13.echo.BatchEnvelope\x1a\x13.echo.BatchEnvelopeB(Z&github.com/anthony/grpc-proxy/api/echob\x06proto3"
 
 var (
 	file_api_echo_echo_proto_rawDescOnce sync.Once
@@ -257,32 +718,62 @@ func file_api_echo_echo_proto_rawDescGZIP() []byte {
 	return file_api_echo_echo_proto_rawDescData
 }
 
-var file_api_echo_echo_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_api_echo_echo_proto_msgTypes = make([]protoimpl.MessageInfo, 14)
 var file_api_echo_echo_proto_goTypes = []any{
 	(*EchoRequest)(nil),    // 0: echo.EchoRequest
 	(*EchoResponse)(nil),   // 1: echo.EchoResponse
 	(*SecureEnvelope)(nil), // 2: echo.SecureEnvelope
-	nil,                    // 3: echo.SecureEnvelope.MetadataEntry
+	(*ProxySignature)(nil), // 3: echo.ProxySignature
+	(*StressEnvelope)(nil), // 4: echo.StressEnvelope
+	(*StressRecord)(nil),   // 5: echo.StressRecord
+	(*BatchEnvelope)(nil),  // 6: echo.BatchEnvelope
+	(*BatchItem)(nil),      // 7: echo.BatchItem
+	nil,                    // 8: echo.SecureEnvelope.MetadataEntry
+	nil,                    // 9: echo.StressEnvelope.MetadataEntry
+	nil,                    // 10: echo.StressEnvelope.IndexEntry
+	nil,                    // 11: echo.StressEnvelope.BlobsEntry
+	nil,                    // 12: echo.StressRecord.LabelsEntry
+	nil,                    // 13: echo.BatchEnvelope.MetadataEntry
 }
 var file_api_echo_echo_proto_depIdxs = []int32{
-	3, // 0: echo.SecureEnvelope.metadata:type_name -> echo.SecureEnvelope.MetadataEntry
-	0, // 1: echo.EchoService.UnaryEcho:input_type -> echo.EchoRequest
-	0, // 2: echo.EchoService.BidirectionalStreamingEcho:input_type -> echo.EchoRequest
-	2, // 3: echo.SecureService.SecureEcho:input_type -> echo.SecureEnvelope
-	2, // 4: echo.SecureService.SecureBidiEcho:input_type -> echo.SecureEnvelope
-	2, // 5: echo.SecureService.UnorderedBidiEcho:input_type -> echo.SecureEnvelope
-	2, // 6: echo.SecureService.InspectOuter:input_type -> echo.SecureEnvelope
-	1, // 7: echo.EchoService.UnaryEcho:output_type -> echo.EchoResponse
-	1, // 8: echo.EchoService.BidirectionalStreamingEcho:output_type -> echo.EchoResponse
-	2, // 9: echo.SecureService.SecureEcho:output_type -> echo.SecureEnvelope
-	2, // 10: echo.SecureService.SecureBidiEcho:output_type -> echo.SecureEnvelope
-	2, // 11: echo.SecureService.UnorderedBidiEcho:output_type -> echo.SecureEnvelope
-	2, // 12: echo.SecureService.InspectOuter:output_type -> echo.SecureEnvelope
-	7, // [7:13] is the sub-list for method output_type
-	1, // [1:7] is the sub-list for method input_type
-	1, // [1:1] is the sub-list for extension type_name
-	1, // [1:1] is the sub-list for extension extendee
-	0, // [0:1] is the sub-list for field type_name
+	8,  // 0: echo.SecureEnvelope.metadata:type_name -> echo.SecureEnvelope.MetadataEntry
+	3,  // 1: echo.SecureEnvelope.proxy_signatures:type_name -> echo.ProxySignature
+	9,  // 2: echo.StressEnvelope.metadata:type_name -> echo.StressEnvelope.MetadataEntry
+	5,  // 3: echo.StressEnvelope.records:type_name -> echo.StressRecord
+	10, // 4: echo.StressEnvelope.index:type_name -> echo.StressEnvelope.IndexEntry
+	11, // 5: echo.StressEnvelope.blobs:type_name -> echo.StressEnvelope.BlobsEntry
+	12, // 6: echo.StressRecord.labels:type_name -> echo.StressRecord.LabelsEntry
+	5,  // 7: echo.StressRecord.children:type_name -> echo.StressRecord
+	13, // 8: echo.BatchEnvelope.metadata:type_name -> echo.BatchEnvelope.MetadataEntry
+	7,  // 9: echo.BatchEnvelope.items:type_name -> echo.BatchItem
+	5,  // 10: echo.StressEnvelope.IndexEntry.value:type_name -> echo.StressRecord
+	0,  // 11: echo.EchoService.UnaryEcho:input_type -> echo.EchoRequest
+	0,  // 12: echo.EchoService.BidirectionalStreamingEcho:input_type -> echo.EchoRequest
+	0,  // 13: echo.EchoService.ServerStreamingEcho:input_type -> echo.EchoRequest
+	0,  // 14: echo.EchoService.ClientStreamingEcho:input_type -> echo.EchoRequest
+	2,  // 15: echo.SecureService.SecureEcho:input_type -> echo.SecureEnvelope
+	2,  // 16: echo.SecureService.SecureBidiEcho:input_type -> echo.SecureEnvelope
+	2,  // 17: echo.SecureService.UnorderedBidiEcho:input_type -> echo.SecureEnvelope
+	2,  // 18: echo.SecureService.InspectOuter:input_type -> echo.SecureEnvelope
+	4,  // 19: echo.StressService.StressEcho:input_type -> echo.StressEnvelope
+	4,  // 20: echo.StressService.StressBidiEcho:input_type -> echo.StressEnvelope
+	6,  // 21: echo.BatchService.BatchEcho:input_type -> echo.BatchEnvelope
+	1,  // 22: echo.EchoService.UnaryEcho:output_type -> echo.EchoResponse
+	1,  // 23: echo.EchoService.BidirectionalStreamingEcho:output_type -> echo.EchoResponse
+	1,  // 24: echo.EchoService.ServerStreamingEcho:output_type -> echo.EchoResponse
+	1,  // 25: echo.EchoService.ClientStreamingEcho:output_type -> echo.EchoResponse
+	2,  // 26: echo.SecureService.SecureEcho:output_type -> echo.SecureEnvelope
+	2,  // 27: echo.SecureService.SecureBidiEcho:output_type -> echo.SecureEnvelope
+	2,  // 28: echo.SecureService.UnorderedBidiEcho:output_type -> echo.SecureEnvelope
+	2,  // 29: echo.SecureService.InspectOuter:output_type -> echo.SecureEnvelope
+	4,  // 30: echo.StressService.StressEcho:output_type -> echo.StressEnvelope
+	4,  // 31: echo.StressService.StressBidiEcho:output_type -> echo.StressEnvelope
+	6,  // 32: echo.BatchService.BatchEcho:output_type -> echo.BatchEnvelope
+	22, // [22:33] is the sub-list for method output_type
+	11, // [11:22] is the sub-list for method input_type
+	11, // [11:11] is the sub-list for extension type_name
+	11, // [11:11] is the sub-list for extension extendee
+	0,  // [0:11] is the sub-list for field type_name
 }
 
 func init() { file_api_echo_echo_proto_init() }
@@ -290,15 +781,19 @@ func file_api_echo_echo_proto_init() {
 	if File_api_echo_echo_proto != nil {
 		return
 	}
+	file_api_echo_echo_proto_msgTypes[5].OneofWrappers = []any{
+		(*StressRecord_Text)(nil),
+		(*StressRecord_Data)(nil),
+	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_api_echo_echo_proto_rawDesc), len(file_api_echo_echo_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   4,
+			NumMessages:   14,
 			NumExtensions: 0,
-			NumServices:   2,
+			NumServices:   4,
 		},
 		GoTypes:           file_api_echo_echo_proto_goTypes,
 		DependencyIndexes: file_api_echo_echo_proto_depIdxs,
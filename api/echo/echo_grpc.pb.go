@@ -21,6 +21,8 @@ const _ = grpc.SupportPackageIsVersion9
 const (
 	EchoService_UnaryEcho_FullMethodName                  = "/echo.EchoService/UnaryEcho"
 	EchoService_BidirectionalStreamingEcho_FullMethodName = "/echo.EchoService/BidirectionalStreamingEcho"
+	EchoService_ServerStreamingEcho_FullMethodName        = "/echo.EchoService/ServerStreamingEcho"
+	EchoService_ClientStreamingEcho_FullMethodName        = "/echo.EchoService/ClientStreamingEcho"
 )
 
 // EchoServiceClient is the client API for EchoService service.
@@ -29,6 +31,10 @@ const (
 type EchoServiceClient interface {
 	UnaryEcho(ctx context.Context, in *EchoRequest, opts ...grpc.CallOption) (*EchoResponse, error)
 	BidirectionalStreamingEcho(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[EchoRequest, EchoResponse], error)
+	// ServerStreamingEcho answers one request with repeat responses
+	ServerStreamingEcho(ctx context.Context, in *EchoRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[EchoResponse], error)
+	// ClientStreamingEcho answers a whole stream with one response
+	ClientStreamingEcho(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[EchoRequest, EchoResponse], error)
 }
 
 type echoServiceClient struct {
@@ -62,12 +68,48 @@ func (c *echoServiceClient) BidirectionalStreamingEcho(ctx context.Context, opts
 // This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
 type EchoService_BidirectionalStreamingEchoClient = grpc.BidiStreamingClient[EchoRequest, EchoResponse]
 
+func (c *echoServiceClient) ServerStreamingEcho(ctx context.Context, in *EchoRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[EchoResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &EchoService_ServiceDesc.Streams[1], EchoService_ServerStreamingEcho_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[EchoRequest, EchoResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type EchoService_ServerStreamingEchoClient = grpc.ServerStreamingClient[EchoResponse]
+
+func (c *echoServiceClient) ClientStreamingEcho(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[EchoRequest, EchoResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &EchoService_ServiceDesc.Streams[2], EchoService_ClientStreamingEcho_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[EchoRequest, EchoResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type EchoService_ClientStreamingEchoClient = grpc.ClientStreamingClient[EchoRequest, EchoResponse]
+
 // EchoServiceServer is the server API for EchoService service.
 // All implementations must embed UnimplementedEchoServiceServer
 // for forward compatibility.
 type EchoServiceServer interface {
 	UnaryEcho(context.Context, *EchoRequest) (*EchoResponse, error)
 	BidirectionalStreamingEcho(grpc.BidiStreamingServer[EchoRequest, EchoResponse]) error
+	// ServerStreamingEcho answers one request with repeat responses
+	ServerStreamingEcho(*EchoRequest, grpc.ServerStreamingServer[EchoResponse]) error
+	// ClientStreamingEcho answers a whole stream with one response
+	ClientStreamingEcho(grpc.ClientStreamingServer[EchoRequest, EchoResponse]) error
 	mustEmbedUnimplementedEchoServiceServer()
 }
 
@@ -84,6 +126,12 @@ func (UnimplementedEchoServiceServer) UnaryEcho(context.Context, *EchoRequest) (
 func (UnimplementedEchoServiceServer) BidirectionalStreamingEcho(grpc.BidiStreamingServer[EchoRequest, EchoResponse]) error {
 	return status.Errorf(codes.Unimplemented, "method BidirectionalStreamingEcho not implemented")
 }
+func (UnimplementedEchoServiceServer) ServerStreamingEcho(*EchoRequest, grpc.ServerStreamingServer[EchoResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method ServerStreamingEcho not implemented")
+}
+func (UnimplementedEchoServiceServer) ClientStreamingEcho(grpc.ClientStreamingServer[EchoRequest, EchoResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method ClientStreamingEcho not implemented")
+}
 func (UnimplementedEchoServiceServer) mustEmbedUnimplementedEchoServiceServer() {}
 func (UnimplementedEchoServiceServer) testEmbeddedByValue()                     {}
 
@@ -130,6 +178,24 @@ func _EchoService_BidirectionalStreamingEcho_Handler(srv interface{}, stream grp
 // This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
 type EchoService_BidirectionalStreamingEchoServer = grpc.BidiStreamingServer[EchoRequest, EchoResponse]
 
+func _EchoService_ServerStreamingEcho_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(EchoRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(EchoServiceServer).ServerStreamingEcho(m, &grpc.GenericServerStream[EchoRequest, EchoResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type EchoService_ServerStreamingEchoServer = grpc.ServerStreamingServer[EchoResponse]
+
+func _EchoService_ClientStreamingEcho_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(EchoServiceServer).ClientStreamingEcho(&grpc.GenericServerStream[EchoRequest, EchoResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type EchoService_ClientStreamingEchoServer = grpc.ClientStreamingServer[EchoRequest, EchoResponse]
+
 // EchoService_ServiceDesc is the grpc.ServiceDesc for EchoService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -149,6 +215,16 @@ var EchoService_ServiceDesc = grpc.ServiceDesc{
 			ServerStreams: true,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "ServerStreamingEcho",
+			Handler:       _EchoService_ServerStreamingEcho_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "ClientStreamingEcho",
+			Handler:       _EchoService_ClientStreamingEcho_Handler,
+			ClientStreams: true,
+		},
 	},
 	Metadata: "api/echo/echo.proto",
 }
@@ -361,3 +437,248 @@ var SecureService_ServiceDesc = grpc.ServiceDesc{
 	},
 	Metadata: "api/echo/echo.proto",
 }
+
+const (
+	StressService_StressEcho_FullMethodName     = "/echo.StressService/StressEcho"
+	StressService_StressBidiEcho_FullMethodName = "/echo.StressService/StressBidiEcho"
+)
+
+// StressServiceClient is the client API for StressService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// StressService echoes StressEnvelopes
+type StressServiceClient interface {
+	StressEcho(ctx context.Context, in *StressEnvelope, opts ...grpc.CallOption) (*StressEnvelope, error)
+	StressBidiEcho(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[StressEnvelope, StressEnvelope], error)
+}
+
+type stressServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewStressServiceClient(cc grpc.ClientConnInterface) StressServiceClient {
+	return &stressServiceClient{cc}
+}
+
+func (c *stressServiceClient) StressEcho(ctx context.Context, in *StressEnvelope, opts ...grpc.CallOption) (*StressEnvelope, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(StressEnvelope)
+	err := c.cc.Invoke(ctx, StressService_StressEcho_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *stressServiceClient) StressBidiEcho(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[StressEnvelope, StressEnvelope], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &StressService_ServiceDesc.Streams[0], StressService_StressBidiEcho_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[StressEnvelope, StressEnvelope]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type StressService_StressBidiEchoClient = grpc.BidiStreamingClient[StressEnvelope, StressEnvelope]
+
+// StressServiceServer is the server API for StressService service.
+// All implementations must embed UnimplementedStressServiceServer
+// for forward compatibility.
+//
+// StressService echoes StressEnvelopes
+type StressServiceServer interface {
+	StressEcho(context.Context, *StressEnvelope) (*StressEnvelope, error)
+	StressBidiEcho(grpc.BidiStreamingServer[StressEnvelope, StressEnvelope]) error
+	mustEmbedUnimplementedStressServiceServer()
+}
+
+// UnimplementedStressServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedStressServiceServer struct{}
+
+func (UnimplementedStressServiceServer) StressEcho(context.Context, *StressEnvelope) (*StressEnvelope, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StressEcho not implemented")
+}
+func (UnimplementedStressServiceServer) StressBidiEcho(grpc.BidiStreamingServer[StressEnvelope, StressEnvelope]) error {
+	return status.Errorf(codes.Unimplemented, "method StressBidiEcho not implemented")
+}
+func (UnimplementedStressServiceServer) mustEmbedUnimplementedStressServiceServer() {}
+func (UnimplementedStressServiceServer) testEmbeddedByValue()                       {}
+
+// UnsafeStressServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to StressServiceServer will
+// result in compilation errors.
+type UnsafeStressServiceServer interface {
+	mustEmbedUnimplementedStressServiceServer()
+}
+
+func RegisterStressServiceServer(s grpc.ServiceRegistrar, srv StressServiceServer) {
+	// If the following call pancis, it indicates UnimplementedStressServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&StressService_ServiceDesc, srv)
+}
+
+func _StressService_StressEcho_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StressEnvelope)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StressServiceServer).StressEcho(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: StressService_StressEcho_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StressServiceServer).StressEcho(ctx, req.(*StressEnvelope))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _StressService_StressBidiEcho_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(StressServiceServer).StressBidiEcho(&grpc.GenericServerStream[StressEnvelope, StressEnvelope]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type StressService_StressBidiEchoServer = grpc.BidiStreamingServer[StressEnvelope, StressEnvelope]
+
+// StressService_ServiceDesc is the grpc.ServiceDesc for StressService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var StressService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "echo.StressService",
+	HandlerType: (*StressServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "StressEcho",
+			Handler:    _StressService_StressEcho_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StressBidiEcho",
+			Handler:       _StressService_StressBidiEcho_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "api/echo/echo.proto",
+}
+
+const (
+	BatchService_BatchEcho_FullMethodName = "/echo.BatchService/BatchEcho"
+)
+
+// BatchServiceClient is the client API for BatchService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// BatchService echoes BatchEnvelopes
+type BatchServiceClient interface {
+	BatchEcho(ctx context.Context, in *BatchEnvelope, opts ...grpc.CallOption) (*BatchEnvelope, error)
+}
+
+type batchServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewBatchServiceClient(cc grpc.ClientConnInterface) BatchServiceClient {
+	return &batchServiceClient{cc}
+}
+
+func (c *batchServiceClient) BatchEcho(ctx context.Context, in *BatchEnvelope, opts ...grpc.CallOption) (*BatchEnvelope, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BatchEnvelope)
+	err := c.cc.Invoke(ctx, BatchService_BatchEcho_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// BatchServiceServer is the server API for BatchService service.
+// All implementations must embed UnimplementedBatchServiceServer
+// for forward compatibility.
+//
+// BatchService echoes BatchEnvelopes
+type BatchServiceServer interface {
+	BatchEcho(context.Context, *BatchEnvelope) (*BatchEnvelope, error)
+	mustEmbedUnimplementedBatchServiceServer()
+}
+
+// UnimplementedBatchServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedBatchServiceServer struct{}
+
+func (UnimplementedBatchServiceServer) BatchEcho(context.Context, *BatchEnvelope) (*BatchEnvelope, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchEcho not implemented")
+}
+func (UnimplementedBatchServiceServer) mustEmbedUnimplementedBatchServiceServer() {}
+func (UnimplementedBatchServiceServer) testEmbeddedByValue()                      {}
+
+// UnsafeBatchServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to BatchServiceServer will
+// result in compilation errors.
+type UnsafeBatchServiceServer interface {
+	mustEmbedUnimplementedBatchServiceServer()
+}
+
+func RegisterBatchServiceServer(s grpc.ServiceRegistrar, srv BatchServiceServer) {
+	// If the following call pancis, it indicates UnimplementedBatchServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&BatchService_ServiceDesc, srv)
+}
+
+func _BatchService_BatchEcho_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchEnvelope)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BatchServiceServer).BatchEcho(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BatchService_BatchEcho_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BatchServiceServer).BatchEcho(ctx, req.(*BatchEnvelope))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// BatchService_ServiceDesc is the grpc.ServiceDesc for BatchService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var BatchService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "echo.BatchService",
+	HandlerType: (*BatchServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "BatchEcho",
+			Handler:    _BatchService_BatchEcho_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "api/echo/echo.proto",
+}
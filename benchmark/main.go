@@ -1,125 +1,472 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/rsa"
+	"encoding/csv"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/anthony/grpc-proxy/api/echo"
+	"github.com/anthony/grpc-proxy/go-proxy/envelope"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
-func main() {
-	mode := flag.String("mode", "legacy", "legacy or secure")
-	count := flag.Int("count", 1000, "number of requests to fire")
-	flag.Parse()
+// sample is a single measured request
+type sample struct {
+	worker  int
+	at      time.Duration // offset from the start of the measured window
+	latency time.Duration
+	err     error
+}
 
-	conn, err := grpc.Dial("localhost:8080", grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		log.Fatalf("failed to connect: %v", err)
-	}
-	defer conn.Close()
+// worker issues requests until it has done n of them (n < 0 means no limit)
+// or the deadline passes, reporting each completed request through record.
+type worker interface {
+	Run(n int, deadline time.Time, record func(latency time.Duration, err error))
+	Close()
+}
 
-	if *mode == "legacy" {
-		client := echo.NewEchoServiceClient(conn)
-		log.Printf("Starting benchmark of %d requests on Legacy Service (Pass-Thru)", *count)
+// benchMode describes one benchmark scenario; new modes only need an entry in
+// the modes table below.
+type benchMode struct {
+	desc      string
+	newWorker func(conn *grpc.ClientConn, gen *payloadGen) (worker, error)
+}
 
-		start := time.Now()
-		for i := 0; i < *count; i++ {
-			_, err := client.UnaryEcho(context.Background(), &echo.EchoRequest{Message: "Bench"})
+var modes = map[string]benchMode{
+	"legacy": {
+		desc: "Legacy Service (Pass-Thru)",
+		newWorker: func(conn *grpc.ClientConn, gen *payloadGen) (worker, error) {
+			client := echo.NewEchoServiceClient(conn)
+			return unaryWorker(func() error {
+				_, err := client.UnaryEcho(context.Background(), &echo.EchoRequest{Message: string(gen.next())})
+				return err
+			}), nil
+		},
+	},
+	"inspect": {
+		desc: "Secure Service (Inspect Outer Only)",
+		newWorker: func(conn *grpc.ClientConn, gen *payloadGen) (worker, error) {
+			client := echo.NewSecureServiceClient(conn)
+			return unaryWorker(func() error {
+				env, err := gen.unsigned()
+				if err == nil {
+					_, err = client.InspectOuter(context.Background(), env)
+				}
+				return err
+			}), nil
+		},
+	},
+	"secure": {
+		desc: "Secure Service (Envelope with Crypto)",
+		newWorker: func(conn *grpc.ClientConn, gen *payloadGen) (worker, error) {
+			client := echo.NewSecureServiceClient(conn)
+			return unaryWorker(func() error {
+				env, err := gen.envelope()
+				if err == nil {
+					_, err = client.SecureEcho(context.Background(), env)
+				}
+				return err
+			}), nil
+		},
+	},
+	// A second secure route, so that two route configurations (e.g. one per
+	// crypto_engine, see benchmark/engines.yaml) compare in one run
+	"secure-alt": {
+		desc: "Secure Service, second route (InspectOuter with Crypto)",
+		newWorker: func(conn *grpc.ClientConn, gen *payloadGen) (worker, error) {
+			client := echo.NewSecureServiceClient(conn)
+			return unaryWorker(func() error {
+				env, err := gen.envelope()
+				if err == nil {
+					_, err = client.InspectOuter(context.Background(), env)
+				}
+				return err
+			}), nil
+		},
+	},
+	// The streaming shapes the echo API has besides bidi; each sample is one
+	// whole call of -messages responses or requests
+	"server-stream": {
+		desc: "Legacy Service (Server Streaming)",
+		newWorker: func(conn *grpc.ClientConn, gen *payloadGen) (worker, error) {
+			client := echo.NewEchoServiceClient(conn)
+			return unaryWorker(func() error {
+				stream, err := client.ServerStreamingEcho(context.Background(), &echo.EchoRequest{Message: string(gen.next()), Repeat: int32(streamMessages)})
+				if err != nil {
+					return err
+				}
+				for {
+					if _, err := stream.Recv(); err != nil {
+						if err == io.EOF {
+							return nil
+						}
+						return err
+					}
+				}
+			}), nil
+		},
+	},
+	"client-stream": {
+		desc: "Legacy Service (Client Streaming)",
+		newWorker: func(conn *grpc.ClientConn, gen *payloadGen) (worker, error) {
+			client := echo.NewEchoServiceClient(conn)
+			return unaryWorker(func() error {
+				stream, err := client.ClientStreamingEcho(context.Background())
+				if err != nil {
+					return err
+				}
+				for range streamMessages {
+					if err := stream.Send(&echo.EchoRequest{Message: string(gen.next())}); err != nil {
+						return err
+					}
+				}
+				_, err = stream.CloseAndRecv()
+				return err
+			}), nil
+		},
+	},
+	// Large envelopes with nested, repeated and map fields, for the cost of
+	// dynamic decoding rather than of the crypto
+	"stress": {
+		desc: "Stress Service (Large Nested Envelope with Crypto)",
+		newWorker: func(conn *grpc.ClientConn, gen *payloadGen) (worker, error) {
+			client := echo.NewStressServiceClient(conn)
+			return unaryWorker(func() error {
+				env, err := gen.stress()
+				if err == nil {
+					_, err = client.StressEcho(context.Background(), env)
+				}
+				return err
+			}), nil
+		},
+	},
+	"secure-unordered": {
+		desc: "Secure Service (UNORDERED CONCURRENT STREAM)",
+		newWorker: func(conn *grpc.ClientConn, gen *payloadGen) (worker, error) {
+			stream, err := echo.NewSecureServiceClient(conn).UnorderedBidiEcho(context.Background())
 			if err != nil {
-				log.Fatalf("Req err: %v", err)
+				return nil, err
 			}
-		}
-		dur := time.Since(start)
-		log.Printf("[RESULT] Legacy Pass-Thru Mode: %d reqs in %v (Avg: %v/req)", *count, dur, dur/time.Duration(*count))
-	} else if *mode == "inspect" {
-		client := echo.NewSecureServiceClient(conn)
-		log.Printf("Starting benchmark of %d requests on Secure Service (Inspect Outer Only)", *count)
-
-		req := &echo.SecureEnvelope{
-			Payload:  []byte("Bench Payload Bytes"),
-			TypeUrl:  "type.googleapis.com/target.Benchmark",
-			Metadata: map[string]string{"bench": "true"},
-		}
+			return newStreamWorker(stream, gen), nil
+		},
+	},
+}
+
+// streamMessages is how many messages a server-stream or client-stream call
+// carries
+var streamMessages = 10
+
+type unaryWorker func() error
 
+func (f unaryWorker) Run(n int, deadline time.Time, record func(time.Duration, error)) {
+	for done := 0; n < 0 || done < n; done++ {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return
+		}
 		start := time.Now()
-		for i := 0; i < *count; i++ {
-			_, err := client.InspectOuter(context.Background(), req)
+		err := f()
+		record(time.Since(start), err)
+	}
+}
+
+func (unaryWorker) Close() {}
+
+// streamWorker pipelines sends on a bidi stream while a receiver drains
+// responses. Responses may arrive out of order, so each one is attributed to
+// the oldest outstanding send.
+type streamWorker struct {
+	stream echo.SecureService_UnorderedBidiEchoClient
+	gen    *payloadGen
+}
+
+func newStreamWorker(stream echo.SecureService_UnorderedBidiEchoClient, gen *payloadGen) *streamWorker {
+	return &streamWorker{stream: stream, gen: gen}
+}
+
+func (w *streamWorker) Run(n int, deadline time.Time, record func(time.Duration, error)) {
+	pending := make(chan time.Time, 4096) // bounds the number of in-flight messages
+	go func() {
+		defer close(pending)
+		for sent := 0; n < 0 || sent < n; sent++ {
+			if !deadline.IsZero() && time.Now().After(deadline) {
+				return
+			}
+			env, err := w.gen.envelope()
 			if err != nil {
-				log.Fatalf("Req err: %v", err)
+				record(0, err)
+				return
+			}
+			pending <- time.Now()
+			if err := w.stream.Send(env); err != nil {
+				record(0, err)
+				return
 			}
 		}
-		dur := time.Since(start)
-		log.Printf("[RESULT] Inspect Outer Mode: %d reqs in %v (Avg: %v/req)", *count, dur, dur/time.Duration(*count))
-	} else if *mode == "secure-unordered" {
-		client := echo.NewSecureServiceClient(conn)
-		log.Printf("Starting benchmark of %d requests on Secure Service (UNORDERED CONCURRENT STREAM)", *count)
-
-		req := &echo.SecureEnvelope{
-			Payload:         []byte("Bench Payload Bytes"),
-			TypeUrl:         "type.googleapis.com/target.Benchmark",
-			ClientSignature: []byte("mock_client_signature_bytes_for_verification"),
-			Metadata:        map[string]string{"bench": "true"},
+	}()
+
+	for start := range pending {
+		if _, err := w.stream.Recv(); err != nil {
+			record(0, err)
+			for range pending {
+			}
+			return
 		}
+		record(time.Since(start), nil)
+	}
+}
 
-		stream, err := client.UnorderedBidiEcho(context.Background())
-		if err != nil {
-			log.Fatalf("Stream start err: %v", err)
+func (w *streamWorker) Close() {
+	w.stream.CloseSend()
+	for {
+		if _, err := w.stream.Recv(); err != nil {
+			return
 		}
+	}
+}
 
-		start := time.Now()
+func modeNames() string {
+	names := make([]string, 0, len(modes))
+	for name := range modes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
 
-		// Sender Goroutine
-		go func() {
-			for i := 0; i < *count; i++ {
-				if err := stream.Send(req); err != nil {
-					log.Fatalf("Send error: %v", err)
-				}
-			}
-			stream.CloseSend()
-		}()
+// benchOptions are the per-run settings shared by the proxied and direct runs
+type benchOptions struct {
+	mode        string
+	count       int
+	duration    time.Duration
+	concurrency int
+	warmup      time.Duration
+	gen         *payloadGen
+}
 
-		// Receiver Routine (Main Thread)
-		received := 0
-		for {
-			_, err := stream.Recv()
-			if err != nil {
-				if err.Error() == "EOF" {
-					break
-				}
-				log.Fatalf("Recv error: %v", err)
+// summary is the headline result of one run, used for the direct-vs-proxy delta
+type summary struct {
+	avg, p50, p99 time.Duration
+	throughput    float64
+}
+
+func main() {
+	mode := flag.String("mode", "legacy", "benchmark mode, or several comma-separated to run in turn and compare: "+modeNames())
+	addr := flag.String("addr", "localhost:8080", "target address (proxy or backend)")
+	direct := flag.String("direct", "", "optional backend address to benchmark directly and report the proxy-added overhead")
+	count := flag.Int("count", 1000, "number of requests to fire (ignored when -duration is set)")
+	duration := flag.Duration("duration", 0, "run for this long instead of a fixed -count")
+	concurrency := flag.Int("concurrency", 1, "parallel workers, each with its own connection/stream")
+	warmup := flag.Duration("warmup", 0, "warmup period excluded from the results")
+	payloadSize := flag.Int("payload-size", 0, "payload size in bytes (0 uses a short fixed payload)")
+	clientKey := flag.String("client-key", "", "PEM RSA private key used to sign each payload (default sends no client signature)")
+	rotate := flag.Bool("rotate-payload", false, "vary the payload on every request so signing cannot be cached")
+	csvPath := flag.String("csv", "", "optional file to write per-request samples as CSV")
+	flag.IntVar(&streamMessages, "messages", streamMessages, "messages per call in the server-stream and client-stream modes")
+	flag.Parse()
+
+	runModes := strings.Split(*mode, ",")
+	for _, m := range runModes {
+		if _, ok := modes[m]; !ok {
+			log.Fatalf("unknown mode %q (available: %s)", m, modeNames())
+		}
+	}
+	if *concurrency < 1 {
+		log.Fatalf("-concurrency must be at least 1")
+	}
+
+	payload := []byte("Bench Payload Bytes")
+	if *payloadSize > 0 {
+		payload = bytes.Repeat([]byte("x"), *payloadSize)
+	}
+	var key *rsa.PrivateKey
+	if *clientKey != "" {
+		var err error
+		if key, err = envelope.LoadPrivateKey(*clientKey); err != nil {
+			log.Fatalf("failed to load client key: %v", err)
+		}
+		log.Printf("Signing payloads with %s", *clientKey)
+	}
+	gen, err := newPayloadGen(payload, key, *rotate)
+	if err != nil {
+		log.Fatalf("failed to sign payload: %v", err)
+	}
+
+	var first summary
+	for i, m := range runModes {
+		opts := benchOptions{mode: m, count: *count, duration: *duration, concurrency: *concurrency, warmup: *warmup, gen: gen}
+		proxied, samples := runBenchmark(*addr, opts)
+		if *csvPath != "" {
+			path := *csvPath
+			if len(runModes) > 1 {
+				path = strings.TrimSuffix(path, ".csv") + "-" + m + ".csv"
 			}
-			received++
-			if received == *count {
-				break
+			if err := writeCSV(path, samples); err != nil {
+				log.Fatalf("failed writing csv: %v", err)
 			}
+			log.Printf("Wrote %d samples to %s", len(samples), path)
 		}
 
-		dur := time.Since(start)
-		log.Printf("[RESULT] Unordered Secure Mode: %d reqs in %v (Avg: %v/req)", received, dur, dur/time.Duration(received))
+		if *direct != "" {
+			log.Printf("Benchmarking backend directly at %s for comparison", *direct)
+			baseline, _ := runBenchmark(*direct, opts)
+			log.Printf("[RESULT] proxy overhead: avg=%+v p50=%+v p99=%+v throughput=%+.1f req/s",
+				proxied.avg-baseline.avg, proxied.p50-baseline.p50, proxied.p99-baseline.p99, proxied.throughput-baseline.throughput)
+		}
 
-	} else {
-		client := echo.NewSecureServiceClient(conn)
-		log.Printf("Starting benchmark of %d requests on Secure Service (Envelope with Crypto)", *count)
-
-		req := &echo.SecureEnvelope{
-			Payload:         []byte("Bench Payload Bytes"),
-			TypeUrl:         "type.googleapis.com/target.Benchmark",
-			ClientSignature: []byte("mock_client_signature_bytes_for_verification"),
-			Metadata:        map[string]string{"bench": "true"},
+		if i == 0 {
+			first = proxied
+			continue
+		}
+		log.Printf("[RESULT] %s vs %s: avg=%+v p50=%+v p99=%+v throughput=%+.1f req/s",
+			m, runModes[0], proxied.avg-first.avg, proxied.p50-first.p50, proxied.p99-first.p99, proxied.throughput-first.throughput)
+	}
+}
+
+func runBenchmark(addr string, opts benchOptions) (summary, []sample) {
+	bm := modes[opts.mode]
+	workers := make([]worker, opts.concurrency)
+	for i := range workers {
+		conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			log.Fatalf("failed to connect: %v", err)
 		}
+		defer conn.Close()
+		w, err := bm.newWorker(conn, opts.gen)
+		if err != nil {
+			log.Fatalf("worker %d setup err: %v", i, err)
+		}
+		workers[i] = w
+	}
 
-		start := time.Now()
-		for i := 0; i < *count; i++ {
-			_, err := client.SecureEcho(context.Background(), req)
-			if err != nil {
-				log.Fatalf("Req err: %v", err)
+	if opts.warmup > 0 {
+		log.Printf("Warming up for %v", opts.warmup)
+		run(workers, 0, time.Now().Add(opts.warmup), nil)
+	}
+
+	if opts.duration > 0 {
+		log.Printf("Starting %v benchmark on %s with %d workers (%s)", opts.duration, bm.desc, opts.concurrency, addr)
+	} else {
+		log.Printf("Starting benchmark of %d requests on %s with %d workers (%s)", opts.count, bm.desc, opts.concurrency, addr)
+	}
+
+	var samples []sample
+	var deadline time.Time
+	if opts.duration > 0 {
+		deadline = time.Now().Add(opts.duration)
+	}
+	start := time.Now()
+	run(workers, opts.count, deadline, &samples)
+	elapsed := time.Since(start)
+
+	for _, w := range workers {
+		w.Close()
+	}
+	return report(opts.mode, samples, elapsed), samples
+}
+
+// run drives all workers until count requests are done or the deadline passes.
+// Samples are only collected when out is non-nil (i.e. not during warmup).
+func run(workers []worker, count int, deadline time.Time, out *[]sample) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	start := time.Now()
+
+	for i, w := range workers {
+		n := -1
+		if deadline.IsZero() {
+			n = count / len(workers)
+			if i < count%len(workers) {
+				n++
 			}
 		}
-		dur := time.Since(start)
-		log.Printf("[RESULT] Secure Envelope Mode: %d reqs in %v (Avg: %v/req)", *count, dur, dur/time.Duration(*count))
+		wg.Add(1)
+		go func(id int, w worker, n int) {
+			defer wg.Done()
+			w.Run(n, deadline, func(lat time.Duration, err error) {
+				if out == nil {
+					return
+				}
+				mu.Lock()
+				*out = append(*out, sample{worker: id, at: time.Since(start) - lat, latency: lat, err: err})
+				mu.Unlock()
+			})
+		}(i, w, n)
+	}
+	wg.Wait()
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(float64(len(sorted)-1) * p)
+	return sorted[idx]
+}
+
+func report(mode string, samples []sample, elapsed time.Duration) summary {
+	var lats []time.Duration
+	errs := 0
+	for _, s := range samples {
+		if s.err != nil {
+			errs++
+			continue
+		}
+		lats = append(lats, s.latency)
+	}
+	sort.Slice(lats, func(i, j int) bool { return lats[i] < lats[j] })
+
+	var total time.Duration
+	for _, l := range lats {
+		total += l
+	}
+	avg := time.Duration(0)
+	if len(lats) > 0 {
+		avg = total / time.Duration(len(lats))
+	}
+	throughput := float64(len(lats)) / elapsed.Seconds()
+
+	log.Printf("[RESULT] %s: %d reqs (%d errors) in %v | %.1f req/s", mode, len(samples), errs, elapsed, throughput)
+	log.Printf("[RESULT] latency avg=%v p50=%v p90=%v p99=%v p999=%v max=%v",
+		avg, percentile(lats, 0.50), percentile(lats, 0.90), percentile(lats, 0.99), percentile(lats, 0.999), percentile(lats, 1))
+	return summary{avg: avg, p50: percentile(lats, 0.50), p99: percentile(lats, 0.99), throughput: throughput}
+}
+
+func writeCSV(path string, samples []sample) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"worker", "offset_us", "latency_us", "error"})
+	for _, s := range samples {
+		errStr := ""
+		if s.err != nil {
+			errStr = s.err.Error()
+		}
+		w.Write([]string{
+			strconv.Itoa(s.worker),
+			strconv.FormatInt(s.at.Microseconds(), 10),
+			strconv.FormatInt(s.latency.Microseconds(), 10),
+			errStr,
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("csv: %w", err)
 	}
+	return nil
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/anthony/grpc-proxy/api/echo"
+	"github.com/anthony/grpc-proxy/go-proxy/envelope"
+)
+
+// benchMetadata marks the benchmark's envelopes
+var benchMetadata = map[string]string{"bench": "true"}
+
+// payloadGen produces the payload, and the envelope carrying it, for each
+// request. Envelopes hold the payload as an echo.EchoRequest and are built
+// and signed with the envelope package, exactly as a client of the proxy
+// would, so a run against a verifying route also checks that client signing
+// and proxy verification agree.
+type payloadGen struct {
+	base   []byte
+	key    *rsa.PrivateKey // nil sends no client signature
+	rotate bool
+	seq    atomic.Uint64
+
+	// The fixed payload's envelope when not rotating, signed once
+	fixed *echo.SecureEnvelope
+}
+
+func newPayloadGen(base []byte, key *rsa.PrivateKey, rotate bool) (*payloadGen, error) {
+	g := &payloadGen{base: base, key: key, rotate: rotate}
+	if !rotate {
+		env, err := g.build(base, true)
+		if err != nil {
+			return nil, err
+		}
+		g.fixed = env
+	}
+	return g, nil
+}
+
+// next returns the next payload
+func (g *payloadGen) next() []byte {
+	if !g.rotate {
+		return g.base
+	}
+	// Vary a suffix so neither the proxy nor the engines can cache work
+	suffix := strconv.FormatUint(g.seq.Add(1), 10)
+	payload := make([]byte, 0, len(g.base)+len(suffix)+1)
+	return append(append(append(payload, g.base...), '#'), suffix...)
+}
+
+// envelope returns the next payload's envelope, signed when the generator
+// has a key
+func (g *payloadGen) envelope() (*echo.SecureEnvelope, error) {
+	if f := g.fixed; f != nil {
+		return &echo.SecureEnvelope{TypeUrl: f.TypeUrl, Payload: f.Payload, ClientSignature: f.ClientSignature, Metadata: benchMetadata}, nil
+	}
+	return g.build(g.next(), true)
+}
+
+// unsigned returns the next payload's envelope without a client signature
+func (g *payloadGen) unsigned() (*echo.SecureEnvelope, error) {
+	return g.build(g.next(), false)
+}
+
+// stress returns the next payload's envelope, signed when the generator has
+// a key, inside a StressEnvelope whose other fields are a fixed ~200 KiB of
+// nested, repeated and map data
+func (g *payloadGen) stress() (*echo.StressEnvelope, error) {
+	env, err := g.envelope()
+	if err != nil {
+		return nil, err
+	}
+	stressOnce.Do(buildStressFields)
+	return &echo.StressEnvelope{
+		Metadata:        env.Metadata,
+		TypeUrl:         env.TypeUrl,
+		Payload:         env.Payload,
+		ClientSignature: env.ClientSignature,
+		Chunks:          stressFields.Chunks,
+		Records:         stressFields.Records,
+		Index:           stressFields.Index,
+		Blobs:           stressFields.Blobs,
+	}, nil
+}
+
+var (
+	stressOnce   sync.Once
+	stressFields *echo.StressEnvelope
+)
+
+func buildStressFields() {
+	stressFields = &echo.StressEnvelope{Index: map[string]*echo.StressRecord{}, Blobs: map[int64][]byte{}}
+	chunk := bytes.Repeat([]byte("x"), 4<<10)
+	for i := range 32 {
+		stressFields.Chunks = append(stressFields.Chunks, chunk)
+		stressFields.Blobs[int64(i)] = chunk[:i*128]
+	}
+	for i := range 64 {
+		rec := &echo.StressRecord{
+			Id:       "record-" + strconv.Itoa(i),
+			Values:   []int64{int64(i), int64(i) * 1000, -1},
+			Labels:   map[string]string{"n": strconv.Itoa(i), "bench": "true"},
+			Body:     &echo.StressRecord_Text{Text: "record body"},
+			Children: []*echo.StressRecord{{Id: "child", Body: &echo.StressRecord_Data{Data: chunk[:256]}}},
+		}
+		stressFields.Records = append(stressFields.Records, rec)
+		stressFields.Index[rec.Id] = rec
+	}
+}
+
+func (g *payloadGen) build(payload []byte, sign bool) (*echo.SecureEnvelope, error) {
+	env, err := envelope.NewEnvelope(&echo.EchoRequest{Message: string(payload)})
+	if err != nil {
+		return nil, err
+	}
+	env.Metadata = benchMetadata
+	if sign && g.key != nil {
+		if err := envelope.Sign(env, g.key, envelope.RSASHA256); err != nil {
+			return nil, err
+		}
+	}
+	return env, nil
+}
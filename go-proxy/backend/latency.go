@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// latencyListener wraps accepted connections so every write is delivered after
+// a fixed one-way delay, simulating a long-haul link without limiting bandwidth.
+type latencyListener struct {
+	net.Listener
+	delay time.Duration
+}
+
+func (l *latencyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	lc := &latencyConn{Conn: conn, delay: l.delay, pending: make(chan delayedWrite, 4096), done: make(chan struct{})}
+	go lc.deliver()
+	return lc, nil
+}
+
+type delayedWrite struct {
+	at   time.Time
+	data []byte
+}
+
+type latencyConn struct {
+	net.Conn
+	delay   time.Duration
+	pending chan delayedWrite
+
+	once sync.Once
+	done chan struct{}
+}
+
+func (c *latencyConn) Write(b []byte) (int, error) {
+	select {
+	case c.pending <- delayedWrite{at: time.Now().Add(c.delay), data: append([]byte(nil), b...)}:
+		return len(b), nil
+	case <-c.done:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *latencyConn) deliver() {
+	defer c.Conn.Close()
+	for {
+		select {
+		case w := <-c.pending:
+			time.Sleep(time.Until(w.at))
+			if _, err := c.Conn.Write(w.data); err != nil {
+				c.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *latencyConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
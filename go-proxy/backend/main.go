@@ -2,22 +2,53 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"strings"
 
 	"github.com/anthony/grpc-proxy/api/echo"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip" // accept gzip from the proxy
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 )
 
 type server struct {
 	echo.UnimplementedEchoServiceServer
 	echo.UnimplementedSecureServiceServer
+	echo.UnimplementedStressServiceServer
 }
 
+// UnaryEcho answers with a header and a trailer, so `proxy conformance` can
+// compare them. "bad-request" fails the call with a BadRequest detail, and
+// "fail:<Code>", e.g. fail:NotFound, with that status code.
 func (s *server) UnaryEcho(ctx context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error) {
-	log.Printf("Backend received UnaryEcho: %s", req.GetMessage())
+	log.Printf("Backend received UnaryEcho: %.80s", req.GetMessage())
+	grpc.SetHeader(ctx, metadata.Pairs("x-backend-header", "unary"))
+	grpc.SetTrailer(ctx, metadata.Pairs("x-backend-trailer", "unary"))
+	if req.GetMessage() == "bad-request" {
+		st, err := status.New(codes.InvalidArgument, "bad request").WithDetails(&errdetails.BadRequest{
+			FieldViolations: []*errdetails.BadRequest_FieldViolation{{Field: "message", Description: "must not be \"bad-request\""}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return nil, st.Err()
+	}
+	if name, ok := strings.CutPrefix(req.GetMessage(), "fail:"); ok {
+		for c := codes.OK; c <= codes.Unauthenticated; c++ {
+			if c.String() == name {
+				return nil, status.Errorf(c, "backend failed %s as asked", name)
+			}
+		}
+		return nil, status.Errorf(codes.InvalidArgument, "unknown code %s", name)
+	}
 	return &echo.EchoResponse{Message: "Backend says: " + req.GetMessage()}, nil
 }
 
@@ -31,13 +62,39 @@ func (s *server) BidirectionalStreamingEcho(stream echo.EchoService_Bidirectiona
 		if err != nil {
 			return err
 		}
-		log.Printf("Backend received BidiEcho: %s", req.GetMessage())
+		log.Printf("Backend received BidiEcho: %.80s", req.GetMessage())
 		if err := stream.Send(&echo.EchoResponse{Message: "Backend streams: " + req.GetMessage()}); err != nil {
 			return err
 		}
 	}
 }
 
+func (s *server) ServerStreamingEcho(req *echo.EchoRequest, stream echo.EchoService_ServerStreamingEchoServer) error {
+	n := max(int(req.GetRepeat()), 1)
+	log.Printf("Backend received ServerStreamingEcho: %s (x%d)", req.GetMessage(), n)
+	for i := 1; i <= n; i++ {
+		if err := stream.Send(&echo.EchoResponse{Message: fmt.Sprintf("Backend streams %d/%d: %s", i, n, req.GetMessage())}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *server) ClientStreamingEcho(stream echo.EchoService_ClientStreamingEchoServer) error {
+	var msgs []string
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			log.Printf("Backend received ClientStreamingEcho: %d messages", len(msgs))
+			return stream.SendAndClose(&echo.EchoResponse{Message: fmt.Sprintf("Backend collected %d: %s", len(msgs), strings.Join(msgs, ", "))})
+		}
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, req.GetMessage())
+	}
+}
+
 func (s *server) SecureEcho(ctx context.Context, req *echo.SecureEnvelope) (*echo.SecureEnvelope, error) {
 	log.Printf("Backend received SecureEcho Envelope, Payload: %s", string(req.GetPayload()))
 	return &echo.SecureEnvelope{
@@ -97,14 +154,54 @@ func (s *server) UnorderedBidiEcho(stream echo.SecureService_UnorderedBidiEchoSe
 	}
 }
 
+// StressEcho returns the envelope as it came, with the payload processed,
+// so a client can check every nested, repeated and map field survived
+func (s *server) StressEcho(ctx context.Context, req *echo.StressEnvelope) (*echo.StressEnvelope, error) {
+	log.Printf("Backend received StressEcho Envelope: %d chunks, %d records, %d index entries, %d blobs", len(req.GetChunks()), len(req.GetRecords()), len(req.GetIndex()), len(req.GetBlobs()))
+	req.Payload = []byte("Backend Processed: " + string(req.GetPayload()))
+	req.ClientSignature = nil
+	return req, nil
+}
+
+func (s *server) StressBidiEcho(stream echo.StressService_StressBidiEchoServer) error {
+	log.Printf("Backend Stress Bidi stream opened")
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		req.Payload = []byte("Backend Streaming Processed: " + string(req.GetPayload()))
+		req.ClientSignature = nil
+		if err := stream.Send(req); err != nil {
+			return err
+		}
+	}
+}
+
 func main() {
-	lis, err := net.Listen("tcp", ":9090")
+	addr := flag.String("addr", ":9090", "listen address, or unix:///path/to.sock (run several on different ports to exercise proxy load balancing)")
+	latency := flag.Duration("latency", 0, "artificial one-way delay added to every response write (e.g. 20ms for a 40ms RTT)")
+	flag.Parse()
+
+	network, address := "tcp", *addr
+	if path, ok := strings.CutPrefix(*addr, "unix://"); ok {
+		network, address = "unix", path
+	}
+	lis, err := net.Listen(network, address)
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
+	if *latency > 0 {
+		log.Printf("Injecting %v of write latency on every connection", *latency)
+		lis = &latencyListener{Listener: lis, delay: *latency}
+	}
 	s := grpc.NewServer()
 	echo.RegisterEchoServiceServer(s, &server{})
 	echo.RegisterSecureServiceServer(s, &server{})
+	echo.RegisterStressServiceServer(s, &server{})
 
 	// Enable server reflection to test the alternative approach
 	reflection.Register(s)
@@ -1,17 +1,36 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/rsa"
+	"flag"
+	"fmt"
 	"io"
 	"log"
 	"time"
 
 	"github.com/anthony/grpc-proxy/api/echo"
+	"github.com/anthony/grpc-proxy/go-proxy/envelope"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/proto"
 )
 
 func main() {
+	clientKeyPath := flag.String("client-key", "certs/client.key", "PEM RSA private key the client signs payloads with")
+	proxyCertPath := flag.String("proxy-cert", "certs/proxy.crt", "the proxy's certificate, to check its signatures on responses")
+	flag.Parse()
+
+	clientKey, err := envelope.LoadPrivateKey(*clientKeyPath)
+	if err != nil {
+		log.Fatalf("failed to load client key: %v", err)
+	}
+	proxyKey, err := envelope.LoadPublicKey(*proxyCertPath)
+	if err != nil {
+		log.Fatalf("failed to load proxy certificate: %v", err)
+	}
+
 	conn, err := grpc.Dial("localhost:8080", grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
 		log.Fatalf("failed to connect: %v", err)
@@ -28,21 +47,49 @@ func main() {
 	}
 	log.Printf("Legacy UnaryResponse: %s", lRes.GetMessage())
 
+	// Legacy Server Streaming: one request, several responses
+	down, err := legacyClient.ServerStreamingEcho(context.Background(), &echo.EchoRequest{Message: "Legacy Server Stream", Repeat: 3})
+	if err != nil {
+		log.Fatalf("Legacy Server Streaming error: %v", err)
+	}
+	for {
+		res, err := down.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("Legacy Server Streaming error: %v", err)
+		}
+		log.Printf("Legacy ServerStreamResponse: %s", res.GetMessage())
+	}
+
+	// Legacy Client Streaming: several requests, one response
+	up, err := legacyClient.ClientStreamingEcho(context.Background())
+	if err != nil {
+		log.Fatalf("Legacy Client Streaming error: %v", err)
+	}
+	for _, msg := range []string{"one", "two", "three"} {
+		if err := up.Send(&echo.EchoRequest{Message: msg}); err != nil {
+			log.Fatalf("Failed to send: %v", err)
+		}
+	}
+	cRes, err := up.CloseAndRecv()
+	if err != nil {
+		log.Fatalf("Legacy Client Streaming error: %v", err)
+	}
+	log.Printf("Legacy ClientStreamResponse: %s", cRes.GetMessage())
+
 	log.Println("\n=== Testing Secure Service (Envelope + Signature) ===")
 	secureClient := echo.NewSecureServiceClient(conn)
 
 	// Secure Unary (Envelope)
-	envReq := &echo.SecureEnvelope{
-		Payload:         []byte(`{"user_id": "123", "action": "login"}`),
-		TypeUrl:         "type.googleapis.com/target.LoginRequest",
-		ClientSignature: []byte("client_signed_bytes"),
-		Metadata:        map[string]string{"trace_id": "req-999"},
-	}
+	envReq := signedEnvelope(clientKey, "login user 123")
+	envReq.Metadata = map[string]string{"trace_id": "req-999"}
 	sRes, err := secureClient.SecureEcho(context.Background(), envReq)
 	if err != nil {
 		log.Fatalf("Secure Unary error: %v", err)
 	}
-	log.Printf("Secure UnaryResponse: %s", string(sRes.GetPayload()))
+	log.Printf("Secure UnaryResponse: %s (proxy signature: %s)", string(sRes.GetPayload()), checkProxySignature(sRes, proxyKey))
 
 	// Secure Bidi (Envelope)
 	log.Println("\n=== Testing Secure Bidi Stream ===")
@@ -51,7 +98,7 @@ func main() {
 		log.Fatalf("Secure Bidi stream error: %v", err)
 	}
 
-	msgs := []string{`{"cmd":"start"}`, `{"cmd":"stop"}`}
+	msgs := []string{"start", "stop"}
 	waitc := make(chan struct{})
 
 	go func() {
@@ -64,17 +111,13 @@ func main() {
 			if err != nil {
 				log.Fatalf("Failed to receive secure stream: %v", err)
 			}
-			log.Printf("Got Secure BidiResponse Payload: %s, ProxySig: %s", string(in.GetPayload()), string(in.GetProxySignature()))
+			log.Printf("Got Secure BidiResponse Payload: %s, proxy signature: %s", string(in.GetPayload()), checkProxySignature(in, proxyKey))
 		}
 	}()
 
 	for _, msg := range msgs {
 		log.Printf("Sending Secure BidiRequest Envelope with payload: %s", msg)
-		if err := stream.Send(&echo.SecureEnvelope{
-			Payload:         []byte(msg),
-			TypeUrl:         "type.googleapis.com/target.Command",
-			ClientSignature: []byte("client_sig_" + msg),
-		}); err != nil {
+		if err := stream.Send(signedEnvelope(clientKey, msg)); err != nil {
 			log.Fatalf("Failed to send: %v", err)
 		}
 		time.Sleep(500 * time.Millisecond)
@@ -82,5 +125,65 @@ func main() {
 
 	stream.CloseSend()
 	<-waitc
+
+	// Stress Envelope: nested, repeated and map fields around the payload
+	log.Println("\n=== Testing Stress Service (Large Envelope) ===")
+	stressReq := stressEnvelope(signedEnvelope(clientKey, "stress payload"))
+	stRes, err := echo.NewStressServiceClient(conn).StressEcho(context.Background(), stressReq)
+	if err != nil {
+		log.Fatalf("Stress Unary error: %v", err)
+	}
+	log.Printf("Stress UnaryResponse: %s (%d chunks, %d records, %d blobs; %d bytes sent)",
+		string(stRes.GetPayload()), len(stRes.GetChunks()), len(stRes.GetRecords()), len(stRes.GetBlobs()), proto.Size(stressReq))
 	log.Println("Client finished successfully.")
 }
+
+// signedEnvelope wraps an EchoRequest carrying msg and signs it
+func signedEnvelope(key *rsa.PrivateKey, msg string) *echo.SecureEnvelope {
+	env, err := envelope.NewEnvelope(&echo.EchoRequest{Message: msg})
+	if err != nil {
+		log.Fatalf("failed to build envelope: %v", err)
+	}
+	if err := envelope.Sign(env, key, envelope.RSASHA256); err != nil {
+		log.Fatalf("failed to sign envelope: %v", err)
+	}
+	return env
+}
+
+// stressEnvelope carries env's signed payload in a StressEnvelope with about
+// 200 KiB of nested, repeated and map fields around it
+func stressEnvelope(env *echo.SecureEnvelope) *echo.StressEnvelope {
+	stress := &echo.StressEnvelope{
+		Metadata:        map[string]string{"trace_id": "stress-1"},
+		TypeUrl:         env.GetTypeUrl(),
+		Payload:         env.GetPayload(),
+		ClientSignature: env.GetClientSignature(),
+		Index:           map[string]*echo.StressRecord{},
+		Blobs:           map[int64][]byte{},
+	}
+	chunk := bytes.Repeat([]byte("x"), 4<<10)
+	for i := range 32 {
+		stress.Chunks = append(stress.Chunks, chunk)
+		stress.Blobs[int64(i)] = chunk[:i*128]
+	}
+	for i := range 16 {
+		rec := &echo.StressRecord{
+			Id:       fmt.Sprintf("record-%d", i),
+			Values:   []int64{int64(i), int64(i) * 1000},
+			Labels:   map[string]string{"n": fmt.Sprint(i)},
+			Body:     &echo.StressRecord_Text{Text: "record body"},
+			Children: []*echo.StressRecord{{Id: fmt.Sprintf("record-%d.child", i), Body: &echo.StressRecord_Data{Data: chunk[:256]}}},
+		}
+		stress.Records = append(stress.Records, rec)
+		stress.Index[rec.Id] = rec
+	}
+	return stress
+}
+
+// checkProxySignature describes whether the proxy signed env
+func checkProxySignature(env *echo.SecureEnvelope, proxyKey *rsa.PublicKey) string {
+	if err := envelope.Verify(env, proxyKey); err != nil {
+		return err.Error()
+	}
+	return "verified"
+}
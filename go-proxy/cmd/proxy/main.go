@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/anthony/grpc-proxy/go-proxy/proxy"
+)
+
+func main() {
+	if len(os.Args) > 1 {
+		// Subcommands; anything else is the proxy's own flags
+		var run func([]string) int
+		switch os.Args[1] {
+		case "replay":
+			run = proxy.Replay
+		case "audit-verify":
+			run = proxy.AuditVerify
+		case "decode":
+			run = proxy.Decode
+		case "conformance":
+			run = proxy.Conformance
+		case "config-schema":
+			run = proxy.ConfigSchema
+		case "config-check":
+			run = proxy.ConfigCheck
+		case "crypto-bench":
+			run = proxy.CryptoBench
+		}
+		if run != nil {
+			os.Exit(run(os.Args[2:]))
+		}
+	}
+
+	configPath := flag.String("config", "config.yaml", "path to yaml config file")
+	engineFlag := flag.String("crypto", "go", "crypto engine to use: "+strings.Join(proxy.CryptoEngines(), " or "))
+	diagJSON := flag.Bool("diagnostics-json", false, "print startup diagnostics as JSON on stdout")
+	validateOnly := flag.Bool("validate-only", false, "check the config and exit without listening")
+	preflightTimeout := flag.Duration("preflight-timeout", 0, "before listening, health-check the backends, resolve envelopes and self-test the crypto keys, failing if that takes longer; 0 skips preflight")
+	version := flag.Bool("version", false, "print the build's commit and crypto engines and exit")
+	enableFaults := flag.Bool("enable-faults", false, "honour the routes' fault_injection blocks, which delay, abort and damage calls on purpose; never in production")
+	schemaMethod := flag.String("schema", "", "override schema.method: pb, reflect, url, or both to reconcile pb_path with backend reflection")
+	flag.Parse()
+
+	if *version {
+		fmt.Println(proxy.ReadBuildInfo())
+		return
+	}
+
+	// Config, descriptors, and cryptographic material. Every phase reports
+	// into diag so that all problems surface in a single run.
+	diag := &proxy.Diagnostics{}
+	var px *proxy.Proxy
+	var err error
+	cfg, ok := proxy.LoadConfig(*configPath, diag)
+	if *schemaMethod != "" {
+		cfg.Schema.Method = *schemaMethod
+	}
+	if ok {
+		opts := []proxy.Option{proxy.WithCryptoEngine(*engineFlag), proxy.WithDiagnostics(diag), proxy.WithPreflight(*preflightTimeout)}
+		if *enableFaults {
+			opts = append(opts, proxy.WithFaultInjection())
+		}
+		px, err = proxy.NewProxy(cfg, opts...)
+	}
+
+	if *diagJSON {
+		js, _ := diag.JSON()
+		fmt.Println(string(js))
+	} else {
+		diag.Report(os.Stderr)
+	}
+	if diag.HasErrors() {
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatalf("failed to start: %v", err)
+	}
+	if *validateOnly {
+		px.Shutdown(context.Background())
+		return
+	}
+
+	if err := px.ListenAndServe(); err != nil {
+		var failed *proxy.DiagnosticsError
+		if errors.As(err, &failed) {
+			// Preflight findings, reported like the startup ones
+			if *diagJSON {
+				js, _ := failed.Diagnostics.JSON()
+				fmt.Println(string(js))
+			} else {
+				failed.Diagnostics.Report(os.Stderr)
+			}
+			os.Exit(1)
+		}
+		log.Fatalf("failed to serve: %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+// Package envelope builds, signs and checks SecureEnvelope messages for
+// clients of the proxy.
+//
+// The signed content is the envelope's payload field exactly as it travels:
+// RSA PKCS#1 v1.5 over the SHA-256 of the payload bytes, with nothing else
+// of the envelope (type_url, metadata) covered. The proxy verifies
+// client_signature and makes proxy_signature with that construction, so an
+// envelope signed here verifies at the proxy, and a response the proxy signed
+// verifies here:
+//
+//	env, err := envelope.NewEnvelope(&echo.EchoRequest{Message: "hello"})
+//	if err != nil { ... }
+//	if err := envelope.Sign(env, clientKey, envelope.RSASHA256); err != nil { ... }
+//	resp, err := client.SecureEcho(ctx, env)
+//	if err != nil { ... }
+//	if err := envelope.Verify(resp, proxyCert.PublicKey.(*rsa.PublicKey)); err != nil { ... }
+package envelope
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/anthony/grpc-proxy/api/echo"
+	"google.golang.org/protobuf/proto"
+)
+
+// TypeURLPrefix is what NewEnvelope puts before the payload's message name
+const TypeURLPrefix = "type.googleapis.com/"
+
+// Algorithm names a signature construction
+type Algorithm string
+
+// RSASHA256 is RSA PKCS#1 v1.5 over the SHA-256 of the payload, the one the
+// proxy verifies and signs with
+const RSASHA256 Algorithm = "RSA-SHA256"
+
+// ErrNoSignature is returned by Verify for an envelope without a proxy
+// signature
+var ErrNoSignature = errors.New("envelope: no proxy signature")
+
+// NewEnvelope marshals payload into a new envelope's payload field and sets
+// type_url to its message name. Marshalling is deterministic, so the same
+// message always gives the same payload bytes and signature.
+func NewEnvelope(payload proto.Message) (*echo.SecureEnvelope, error) {
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("envelope: marshal payload: %w", err)
+	}
+	return &echo.SecureEnvelope{
+		TypeUrl: TypeURLPrefix + string(payload.ProtoReflect().Descriptor().FullName()),
+		Payload: b,
+	}, nil
+}
+
+// Sign sets env's client_signature to key's signature over its payload.
+// key must hold an RSA key; a crypto.Signer lets it live in an HSM.
+func Sign(env *echo.SecureEnvelope, key crypto.Signer, algo Algorithm) error {
+	if algo != RSASHA256 {
+		return fmt.Errorf("envelope: unsupported algorithm %q", algo)
+	}
+	if _, ok := key.Public().(*rsa.PublicKey); !ok {
+		return fmt.Errorf("envelope: %s needs an RSA key, not %T", algo, key.Public())
+	}
+	hashed := sha256.Sum256(env.GetPayload())
+	sig, err := key.Sign(rand.Reader, hashed[:], crypto.SHA256)
+	if err != nil {
+		return fmt.Errorf("envelope: sign: %w", err)
+	}
+	env.ClientSignature = sig
+	return nil
+}
+
+// Verify checks env's proxy_signature over its payload against the proxy's
+// public key
+func Verify(env *echo.SecureEnvelope, proxyKey *rsa.PublicKey) error {
+	sig := env.GetProxySignature()
+	if len(sig) == 0 {
+		return ErrNoSignature
+	}
+	hashed := sha256.Sum256(env.GetPayload())
+	if err := rsa.VerifyPKCS1v15(proxyKey, crypto.SHA256, hashed[:], sig); err != nil {
+		return fmt.Errorf("envelope: proxy signature: %w", err)
+	}
+	return nil
+}
+
+// LoadPrivateKey reads an RSA private key from a PKCS#8 or PKCS#1 PEM file
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if key, err1 := x509.ParsePKCS1PrivateKey(block.Bytes); err1 == nil {
+			return key, nil
+		}
+		return nil, fmt.Errorf("envelope: parse private key in %s: %w", path, err)
+	}
+	key, ok := priv.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("envelope: %s does not hold an RSA key", path)
+	}
+	return key, nil
+}
+
+// LoadPublicKey reads the RSA public key of the first certificate in a PEM
+// file, such as the proxy's cms.proxy_certificate
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("envelope: parse certificate in %s: %w", path, err)
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("envelope: the certificate in %s does not hold an RSA key", path)
+	}
+	return key, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("envelope: %w", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("envelope: no PEM block in %s", path)
+	}
+	return block, nil
+}
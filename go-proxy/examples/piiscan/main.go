@@ -0,0 +1,76 @@
+// Command piiscan is the proxy with two compile-time message processors, as
+// an example of extending it without forking processMsg. Routes opt in with
+//
+//	processors: ["pii-scan", "stamp-identity"]
+//
+// pii-scan rejects requests whose payload carries something shaped like a US
+// social security number and masks them in responses; stamp-identity records
+// the resolved client identity in the envelope's metadata map.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"regexp"
+
+	"github.com/anthony/grpc-proxy/go-proxy/proxy"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var ssn = regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`)
+
+type piiScanner struct{}
+
+func (piiScanner) Process(ctx context.Context, info proxy.MethodInfo, dir proxy.Direction, msg *dynamic.Message) (proxy.Action, error) {
+	field := info.Route.Envelope.PayloadField
+	v, err := msg.TryGetFieldByName(field)
+	if err != nil {
+		return proxy.Continue(), nil
+	}
+	payload, _ := v.([]byte)
+	if !ssn.Match(payload) {
+		return proxy.Continue(), nil
+	}
+	if dir == proxy.ClientToBackend {
+		return proxy.Reject(status.New(codes.InvalidArgument, "payload contains a social security number")), nil
+	}
+	// Masked before the proxy signs the response, so the signature covers it
+	return proxy.Continue(), msg.TrySetFieldByName(field, ssn.ReplaceAll(payload, []byte("XXX-XX-XXXX")))
+}
+
+// stampIdentity shows a processor written as a plain function
+var stampIdentity = proxy.ProcessorFunc(func(ctx context.Context, info proxy.MethodInfo, dir proxy.Direction, msg *dynamic.Message) (proxy.Action, error) {
+	field := info.Route.Envelope.MetadataField
+	if dir != proxy.ClientToBackend || field == "" || info.Identity == "" {
+		return proxy.Continue(), nil
+	}
+	return proxy.Continue(), msg.TryPutMapFieldByName(field, "x-client-identity", info.Identity)
+})
+
+func main() {
+	configPath := flag.String("config", "config.yaml", "path to yaml config file")
+	flag.Parse()
+
+	diag := &proxy.Diagnostics{}
+	cfg, ok := proxy.LoadConfig(*configPath, diag)
+	var px *proxy.Proxy
+	if ok {
+		px, _ = proxy.NewProxy(cfg,
+			proxy.WithDiagnostics(diag),
+			proxy.WithProcessor("pii-scan", piiScanner{}),
+			proxy.WithProcessor("stamp-identity", stampIdentity),
+		)
+	}
+	diag.Report(os.Stderr)
+	if diag.HasErrors() {
+		os.Exit(1)
+	}
+
+	if err := px.ListenAndServe(); err != nil {
+		log.Fatalf("failed to serve: %v", err)
+	}
+}
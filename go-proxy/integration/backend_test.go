@@ -0,0 +1,351 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anthony/grpc-proxy/api/echo"
+	"github.com/anthony/grpc-proxy/go-proxy/sessiontoken"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+// --- Echo Backend ---
+
+const (
+	backendHeader  = "x-backend-header"
+	backendTrailer = "x-backend-trailer"
+	// collectMessage opens a bidi stream that is answered once, after half-close
+	collectMessage = "collect"
+	// badRequestMessage fails the call with badRequest as its status detail
+	badRequestMessage = "bad-request"
+	// floodMessage has the backend answer with 32 KiB responses until the
+	// stream ends
+	floodMessage = "flood"
+	// sleepPrefix, followed by a duration, has UnaryEcho wait that long, or
+	// until the call ends, before answering
+	sleepPrefix = "sleep:"
+)
+
+var badRequest = &errdetails.BadRequest{FieldViolations: []*errdetails.BadRequest_FieldViolation{
+	{Field: "message", Description: "must not be \"bad-request\""},
+}}
+
+// badRequestErr is the backend's answer to badRequestMessage
+func badRequestErr() error {
+	st, err := status.New(codes.InvalidArgument, "bad request").WithDetails(badRequest)
+	if err != nil {
+		return err
+	}
+	return st.Err()
+}
+
+// echoBackend behaves like go-proxy/backend, plus error and half-close
+// scenarios, and keeps the raw bytes of the last request it decoded
+type echoBackend struct {
+	echo.UnimplementedEchoServiceServer
+	echo.UnimplementedSecureServiceServer
+	echo.UnimplementedStressServiceServer
+	echo.UnimplementedBatchServiceServer
+
+	mu        sync.Mutex
+	last      []byte
+	unordered int            // requests UnorderedBidiEcho has received
+	tokens    []string       // the x-proxy-attestation of each SecureBidiEcho call
+	flood     error          // how the last flood ended
+	unary     map[string]int // UnaryEcho calls by request message
+	secure    int            // SecureBidiEcho calls
+	sigHeader []string       // the proxySigHeader values of the last SecureEcho or SecureBidiEcho call
+}
+
+func (b *echoBackend) unaryCalls(message string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.unary[message]
+}
+
+func (b *echoBackend) lastRequest() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.last
+}
+
+func (b *echoBackend) UnaryEcho(ctx context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	b.mu.Lock()
+	if b.unary == nil {
+		b.unary = make(map[string]int)
+	}
+	b.unary[req.GetMessage()]++
+	b.mu.Unlock()
+	grpc.SetHeader(ctx, metadata.Pairs(backendHeader, "unary"))
+	grpc.SetTrailer(ctx, metadata.Pairs(backendTrailer, "unary:"+req.GetMessage()))
+	if req.GetMessage() == badRequestMessage {
+		return nil, badRequestErr()
+	}
+	if d, ok := strings.CutPrefix(req.GetMessage(), sleepPrefix); ok {
+		wait, err := time.ParseDuration(d)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	if name, ok := strings.CutPrefix(req.GetMessage(), "fail:"); ok {
+		for c := codes.OK; c <= codes.Unauthenticated; c++ {
+			if c.String() == name {
+				return nil, status.Errorf(c, "backend failed %s as asked", name)
+			}
+		}
+		return nil, errors.New("unknown code " + name)
+	}
+	return &echo.EchoResponse{Message: "Backend says: " + req.GetMessage()}, nil
+}
+
+func (b *echoBackend) BidirectionalStreamingEcho(stream echo.EchoService_BidirectionalStreamingEchoServer) error {
+	stream.SetTrailer(metadata.Pairs(backendTrailer, "bidi"))
+	collect, n := false, 0
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			if collect {
+				return stream.Send(&echo.EchoResponse{Message: fmt.Sprintf("collected %d", n)})
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case req.GetMessage() == badRequestMessage:
+			return badRequestErr()
+		case req.GetMessage() == collectMessage && n == 0 && !collect:
+			collect = true
+		case req.GetMessage() == floodMessage:
+			big := strings.Repeat("x", 32<<10)
+			var err error
+			for err == nil {
+				err = stream.Send(&echo.EchoResponse{Message: big})
+			}
+			b.mu.Lock()
+			b.flood = err
+			b.mu.Unlock()
+			return err
+		case collect:
+			n++
+		default:
+			if err := stream.Send(&echo.EchoResponse{Message: "Backend streams: " + req.GetMessage()}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (b *echoBackend) ServerStreamingEcho(req *echo.EchoRequest, stream echo.EchoService_ServerStreamingEchoServer) error {
+	n := max(int(req.GetRepeat()), 1)
+	for i := 1; i <= n; i++ {
+		if err := stream.Send(&echo.EchoResponse{Message: fmt.Sprintf("%d/%d: %s", i, n, req.GetMessage())}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *echoBackend) ClientStreamingEcho(stream echo.EchoService_ClientStreamingEchoServer) error {
+	var msgs []string
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&echo.EchoResponse{Message: strings.Join(msgs, ",")})
+		}
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, req.GetMessage())
+	}
+}
+
+func (b *echoBackend) UnorderedBidiEcho(stream echo.SecureService_UnorderedBidiEchoServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		b.mu.Lock()
+		b.unordered++
+		b.mu.Unlock()
+		if err := stream.Send(req); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *echoBackend) SecureBidiEcho(stream echo.SecureService_SecureBidiEchoServer) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	b.mu.Lock()
+	b.tokens = append(b.tokens, md.Get(sessiontoken.DefaultHeader)...)
+	b.secure++
+	b.sigHeader = md.Get(proxySigHeader)
+	b.mu.Unlock()
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(req); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *echoBackend) SecureEcho(ctx context.Context, req *echo.SecureEnvelope) (*echo.SecureEnvelope, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	b.mu.Lock()
+	b.sigHeader = md.Get(proxySigHeader)
+	b.mu.Unlock()
+	return &echo.SecureEnvelope{
+		Payload:         []byte("Backend Processed: " + string(req.GetPayload())),
+		TypeUrl:         req.GetTypeUrl(),
+		ProxySignature:  req.GetProxySignature(),
+		ClientSignature: req.GetClientSignature(),
+		Metadata:        req.GetMetadata(),
+	}, nil
+}
+
+func (b *echoBackend) InspectOuter(ctx context.Context, req *echo.SecureEnvelope) (*echo.SecureEnvelope, error) {
+	return &echo.SecureEnvelope{
+		Payload: []byte("Backend Processed (Inspect): " + string(req.GetPayload())),
+		TypeUrl: req.GetTypeUrl(),
+	}, nil
+}
+
+func (b *echoBackend) BatchEcho(ctx context.Context, req *echo.BatchEnvelope) (*echo.BatchEnvelope, error) {
+	return req, nil
+}
+
+func (b *echoBackend) StressEcho(ctx context.Context, req *echo.StressEnvelope) (*echo.StressEnvelope, error) {
+	req.Payload = []byte("Backend Processed: " + string(req.GetPayload()))
+	return req, nil
+}
+
+func (b *echoBackend) StressBidiEcho(stream echo.StressService_StressBidiEchoServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(req); err != nil {
+			return err
+		}
+	}
+}
+
+// envelopeOnlyBackend serves echo.EchoService as upgraded backends do,
+// taking and returning SecureEnvelopes around EchoRequest and EchoResponse.
+// A request of "garbage" is answered with a payload that is no EchoResponse.
+func envelopeOnlyBackend() (*grpc.Server, *bufconn.Listener, chan *echo.SecureEnvelope) {
+	received := make(chan *echo.SecureEnvelope, 16)
+	srv := grpc.NewServer(grpc.UnknownServiceHandler(func(_ interface{}, stream grpc.ServerStream) error {
+		for {
+			env := &echo.SecureEnvelope{}
+			if err := stream.RecvMsg(env); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			received <- env
+			req := &echo.EchoRequest{}
+			if err := proto.Unmarshal(env.GetPayload(), req); err != nil {
+				return status.Errorf(codes.InvalidArgument, "payload is no EchoRequest: %v", err)
+			}
+			payload, _ := proto.Marshal(&echo.EchoResponse{Message: "Enveloped: " + req.GetMessage()})
+			if req.GetMessage() == "garbage" {
+				payload = []byte{0xff, 0xff, 0xff}
+			}
+			if err := stream.SendMsg(&echo.SecureEnvelope{Payload: payload, TypeUrl: "type.googleapis.com/echo.EchoResponse"}); err != nil {
+				return err
+			}
+		}
+	}))
+	lis := bufconn.Listen(bufSize)
+	go srv.Serve(lis)
+	return srv, lis, received
+}
+
+// restartingBackend is the echo backend as one generation of a backend that
+// restarts: the first holds "slow" unary calls until they are cut off
+type restartingBackend struct {
+	*echoBackend
+	generation int
+	slow       chan struct{} // closed once the first generation holds a slow call
+}
+
+func (b *restartingBackend) UnaryEcho(ctx context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	if req.GetMessage() == "slow" && b.generation == 1 {
+		close(b.slow)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return b.echoBackend.UnaryEcho(ctx, req)
+}
+
+// droppingBackend is the echo backend behind a connection it drops: a "drop"
+// unary call reaches it and the proxy's connection is closed under it, so the
+// proxy never gets an answer
+type droppingBackend struct {
+	*echoBackend
+	mu    sync.Mutex
+	conns []net.Conn
+	drops int
+}
+
+// track records a connection the proxy dialed to the backend
+func (b *droppingBackend) track(c net.Conn) net.Conn {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conns = append(b.conns, c)
+	return c
+}
+
+func (b *droppingBackend) dropped() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.drops
+}
+
+func (b *droppingBackend) UnaryEcho(ctx context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	if req.GetMessage() != "drop" {
+		return b.echoBackend.UnaryEcho(ctx, req)
+	}
+	b.mu.Lock()
+	b.drops++
+	for _, c := range b.conns {
+		c.Close()
+	}
+	b.conns = nil
+	b.mu.Unlock()
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
@@ -0,0 +1,1976 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anthony/grpc-proxy/api/echo"
+	"github.com/anthony/grpc-proxy/go-proxy/proxy"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// --- Calls ---
+
+func checkUnaryParity(ctx context.Context, h *harness) error {
+	req := &echo.EchoRequest{Message: "parity"}
+	var directHdr, proxiedHdr metadata.MD
+	want, err := echo.NewEchoServiceClient(h.direct).UnaryEcho(ctx, req, grpc.Header(&directHdr))
+	if err != nil {
+		return fmt.Errorf("direct: %v", err)
+	}
+	got, err := echo.NewEchoServiceClient(h.proxied).UnaryEcho(ctx, req, grpc.Header(&proxiedHdr))
+	if err != nil {
+		return fmt.Errorf("proxied: %v", err)
+	}
+	if !proto.Equal(got, want) {
+		return fmt.Errorf("response %v, direct call got %v", got, want)
+	}
+	if g, w := proxiedHdr.Get(backendHeader), directHdr.Get(backendHeader); len(g) != 1 || len(w) != 1 || g[0] != w[0] {
+		return fmt.Errorf("header %s = %v, direct call got %v", backendHeader, g, w)
+	}
+	return nil
+}
+
+// checkPassThruBytes sends a hand-encoded EchoRequest that no proto library
+// would produce: fields out of order, a repeated message field, a non-minimal
+// varint and an unknown field. A pass-thru route must hand the backend those
+// exact bytes
+func checkPassThruBytes(ctx context.Context, h *harness) error {
+	sent := protowire.AppendTag(nil, 2, protowire.VarintType)
+	sent = append(sent, 0x83, 0x80, 0x00) // repeat=3 in three bytes
+	sent = protowire.AppendString(protowire.AppendTag(sent, 1, protowire.BytesType), "overwritten")
+	sent = protowire.AppendBytes(protowire.AppendTag(sent, 77, protowire.BytesType), []byte("unknown \x00\xff"))
+	sent = protowire.AppendString(protowire.AppendTag(sent, 1, protowire.BytesType), "pass-thru bytes")
+	var resp []byte
+	if err := h.proxied.Invoke(ctx, "/echo.EchoService/UnaryEcho", &sent, &resp, grpc.ForceCodec(rawCodec{})); err != nil {
+		return err
+	}
+	if got := h.backend.lastRequest(); !bytes.Equal(got, sent) {
+		return fmt.Errorf("backend received %x, client sent %x", got, sent)
+	}
+	return nil
+}
+
+// checkRouteDeadlines ends calls on a route's timeouts: default_timeout when
+// the client sent no deadline, max_timeout when its deadline is later, and
+// idle_timeout when a stream goes quiet. Each must reach the client as the
+// proxy's DEADLINE_EXCEEDED, well before the client's own deadline.
+func checkRouteDeadlines(ctx context.Context, h *harness) error {
+	cfg := h.config()
+	cfg.Routes = []proxy.RouteConfig{
+		{Name: "deadlines", Match: "/echo.EchoService/UnaryEcho", Mode: "pass-thru", DefaultTimeout: "100ms", MaxTimeout: "200ms"},
+		{Name: "idle", Match: "/echo.EchoService/BidirectionalStreamingEcho", Mode: "pass-thru", IdleTimeout: "100ms"},
+	}
+	px, lis, err := h.startProxy(cfg)
+	if err != nil {
+		return err
+	}
+	defer px.Shutdown(ctx)
+	conn, err := dialBufconn(lis)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := echo.NewEchoServiceClient(conn)
+
+	proxyTimeout := func(err error, kind string, elapsed time.Duration) error {
+		info := errorInfo(err)
+		if status.Code(err) != codes.DeadlineExceeded || info.GetReason() != "TIMEOUT" || info.GetMetadata()["timeout"] != kind {
+			return fmt.Errorf("got %v (%v), want the proxy's DEADLINE_EXCEEDED on its %s timeout", err, info, kind)
+		}
+		if elapsed > time.Second {
+			return fmt.Errorf("the %s timeout took %v", kind, elapsed)
+		}
+		return nil
+	}
+
+	// No client deadline: default_timeout applies. The harness context has a
+	// deadline, so this call starts from one without.
+	start := time.Now()
+	_, err = client.UnaryEcho(context.WithoutCancel(ctx), &echo.EchoRequest{Message: sleepPrefix + "5s"})
+	if err := proxyTimeout(err, "default", time.Since(start)); err != nil {
+		return fmt.Errorf("no client deadline: %v", err)
+	}
+
+	// A client deadline past max_timeout is clamped to it
+	callCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	start = time.Now()
+	_, err = client.UnaryEcho(callCtx, &echo.EchoRequest{Message: sleepPrefix + "5s"})
+	if err := proxyTimeout(err, "max", time.Since(start)); err != nil {
+		return fmt.Errorf("5s client deadline: %v", err)
+	}
+	// and a call the backend answers within it succeeds
+	if _, err := client.UnaryEcho(callCtx, &echo.EchoRequest{Message: sleepPrefix + "10ms"}); err != nil {
+		return fmt.Errorf("a call within max_timeout: %v", err)
+	}
+
+	// A stream that goes quiet after its first exchange
+	stream, err := client.BidirectionalStreamingEcho(callCtx)
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(&echo.EchoRequest{Message: "then silence"}); err != nil {
+		return err
+	}
+	if _, err := stream.Recv(); err != nil {
+		return fmt.Errorf("idle stream's first reply: %v", err)
+	}
+	start = time.Now()
+	_, err = stream.Recv()
+	if err := proxyTimeout(err, "idle", time.Since(start)); err != nil {
+		return fmt.Errorf("quiet stream: %v", err)
+	}
+	return nil
+}
+
+// checkGRPCWeb makes gRPC-Web calls on the browser listener. A successful
+// call answers with its message frame and then a trailer frame, flagged 0x80,
+// whose length prefix covers exactly the trailer lines; a failed one answers
+// with the trailer frame alone, carrying the backend's status.
+func checkGRPCWeb(ctx context.Context, h *harness) error {
+	addr, err := freeAddr()
+	if err != nil {
+		return err
+	}
+	cfg := h.config()
+	cfg.Web.ListenAddress = addr
+	px, _, err := h.startProxy(cfg)
+	if err != nil {
+		return err
+	}
+	defer px.Shutdown(ctx)
+
+	// call returns the message frames of the response and its trailer lines
+	call := func(method string, req proto.Message) ([][]byte, []string, error) {
+		msg, err := proto.Marshal(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		body := append(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg))), msg...)
+		post := func() (*http.Response, error) {
+			return http.Post("http://"+addr+method, "application/grpc-web+proto", bytes.NewReader(body))
+		}
+		resp, err := post()
+		for i := 0; err != nil && i < 20; i++ {
+			time.Sleep(50 * time.Millisecond)
+			resp, err = post()
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != "application/grpc-web+proto" {
+			return nil, nil, fmt.Errorf("HTTP %d, content type %q", resp.StatusCode, ct)
+		}
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, nil, err
+		}
+		var messages [][]byte
+		for len(b) > 0 {
+			if len(b) < 5 || uint64(len(b)-5) < uint64(binary.BigEndian.Uint32(b[1:5])) {
+				return nil, nil, fmt.Errorf("truncated frame %x", b)
+			}
+			flag, n := b[0], 5+int(binary.BigEndian.Uint32(b[1:5]))
+			frame := b[5:n]
+			b = b[n:]
+			if flag&0x80 == 0 {
+				messages = append(messages, frame)
+				continue
+			}
+			if len(b) > 0 {
+				return nil, nil, fmt.Errorf("%d bytes after the trailer frame", len(b))
+			}
+			lines := strings.Split(strings.TrimSuffix(string(frame), "\r\n"), "\r\n")
+			return messages, lines, nil
+		}
+		return nil, nil, fmt.Errorf("no trailer frame")
+	}
+
+	messages, trailer, err := call("/echo.EchoService/UnaryEcho", &echo.EchoRequest{Message: "from a browser"})
+	if err != nil {
+		return fmt.Errorf("UnaryEcho: %v", err)
+	}
+	var resp echo.EchoResponse
+	if len(messages) != 1 || proto.Unmarshal(messages[0], &resp) != nil || resp.Message != "Backend says: from a browser" {
+		return fmt.Errorf("UnaryEcho: message frames %q, want the backend's one reply", messages)
+	}
+	if !slices.Contains(trailer, "grpc-status: 0") {
+		return fmt.Errorf("UnaryEcho: trailer %q, want grpc-status: 0", trailer)
+	}
+
+	messages, trailer, err = call("/echo.EchoService/NoSuchMethod", &echo.EchoRequest{})
+	if err != nil {
+		return fmt.Errorf("NoSuchMethod: %v", err)
+	}
+	if want := fmt.Sprintf("grpc-status: %d", codes.Unimplemented); len(messages) != 0 || !slices.Contains(trailer, want) {
+		return fmt.Errorf("NoSuchMethod: %d message frames and trailer %q, want the trailer alone with %s", len(messages), trailer, want)
+	}
+	return nil
+}
+
+func checkBidiParity(ctx context.Context, h *harness) error {
+	msgs := []string{"one", "two", "three", "four", "five"}
+	want, err := bidiExchange(ctx, h.direct, msgs)
+	if err != nil {
+		return fmt.Errorf("direct: %v", err)
+	}
+	got, err := bidiExchange(ctx, h.proxied, msgs)
+	if err != nil {
+		return fmt.Errorf("proxied: %v", err)
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		return fmt.Errorf("responses %q, direct call got %q", got, want)
+	}
+	return nil
+}
+
+// bidiExchange sends each message and waits for its echo before the next
+func bidiExchange(ctx context.Context, conn *grpc.ClientConn, msgs []string) ([]string, error) {
+	stream, err := echo.NewEchoServiceClient(conn).BidirectionalStreamingEcho(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, m := range msgs {
+		if err := stream.Send(&echo.EchoRequest{Message: m}); err != nil {
+			return nil, err
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, resp.GetMessage())
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		return nil, fmt.Errorf("stream ended with %v, want EOF", err)
+	}
+	return out, nil
+}
+
+func checkErrorPropagation(ctx context.Context, h *harness) error {
+	for _, code := range []codes.Code{codes.InvalidArgument, codes.NotFound, codes.PermissionDenied, codes.Unavailable} {
+		req := &echo.EchoRequest{Message: "fail:" + code.String()}
+		var directTr, proxiedTr metadata.MD
+		_, want := echo.NewEchoServiceClient(h.direct).UnaryEcho(ctx, req, grpc.Trailer(&directTr))
+		_, got := echo.NewEchoServiceClient(h.proxied).UnaryEcho(ctx, req, grpc.Trailer(&proxiedTr))
+		ws, gs := status.Convert(want), status.Convert(got)
+		if ws.Code() != code {
+			return fmt.Errorf("direct call returned %v, want %v", want, code)
+		}
+		if gs.Code() != ws.Code() || gs.Message() != ws.Message() {
+			return fmt.Errorf("proxied call returned %v, direct call %v", got, want)
+		}
+		if g, w := proxiedTr.Get(backendTrailer), directTr.Get(backendTrailer); len(g) != 1 || len(w) != 1 || g[0] != w[0] {
+			return fmt.Errorf("%v: trailer %s = %v, direct call got %v", code, backendTrailer, g, w)
+		}
+	}
+	return nil
+}
+
+func checkErrorDetails(ctx context.Context, h *harness) error {
+	want := status.Convert(badRequestErr()).Proto()
+	unary := func(conn *grpc.ClientConn) error {
+		_, err := echo.NewEchoServiceClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: badRequestMessage})
+		return err
+	}
+	bidi := func(conn *grpc.ClientConn) error {
+		stream, err := echo.NewEchoServiceClient(conn).BidirectionalStreamingEcho(ctx)
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&echo.EchoRequest{Message: badRequestMessage}); err != nil {
+			return err
+		}
+		_, err = stream.Recv()
+		return err
+	}
+	for name, call := range map[string]func(*grpc.ClientConn) error{"unary": unary, "bidi": bidi} {
+		for _, conn := range []*grpc.ClientConn{h.direct, h.proxied} {
+			got := status.Convert(call(conn)).Proto()
+			if !proto.Equal(got, want) {
+				return fmt.Errorf("%s call returned %v, want %v", name, got, want)
+			}
+			for i, d := range got.GetDetails() {
+				if w := want.GetDetails()[i]; d.GetTypeUrl() != w.GetTypeUrl() || !bytes.Equal(d.GetValue(), w.GetValue()) {
+					return fmt.Errorf("%s call detail %d is %s %x, backend sent %s %x", name, i, d.GetTypeUrl(), d.GetValue(), w.GetTypeUrl(), w.GetValue())
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func checkRejectionDetails(ctx context.Context, h *harness) error {
+	req := &echo.SecureEnvelope{TypeUrl: "type.googleapis.com/echo.EchoResponse", Payload: []byte("not allowed")}
+	var hdr metadata.MD
+	_, err := echo.NewSecureServiceClient(h.proxied).SecureEcho(ctx, req, grpc.Header(&hdr))
+	if status.Code(err) != codes.InvalidArgument {
+		return fmt.Errorf("disallowed type returned %v, want InvalidArgument", err)
+	}
+	info := errorInfo(err)
+	if info == nil || info.GetDomain() != "grpc-proxy" || info.GetReason() != "TYPE_NOT_ALLOWED" {
+		return fmt.Errorf("disallowed type carries ErrorInfo %v, want grpc-proxy TYPE_NOT_ALLOWED", info)
+	}
+	if m := info.GetMetadata(); m["route"] != "secure" || m["method"] != "/echo.SecureService/SecureEcho" {
+		return fmt.Errorf("ErrorInfo metadata %v does not name the route and method", m)
+	}
+	if got := hdr.Get("x-proxy-rejected"); len(got) != 1 || got[0] != "true" {
+		return fmt.Errorf("x-proxy-rejected header = %v, want true", got)
+	}
+
+	// Backend errors are forwarded untouched
+	hdr = nil
+	_, err = echo.NewEchoServiceClient(h.proxied).UnaryEcho(ctx, &echo.EchoRequest{Message: "fail:NotFound"}, grpc.Header(&hdr))
+	if status.Code(err) != codes.NotFound {
+		return fmt.Errorf("backend error returned %v, want NotFound", err)
+	}
+	if info := errorInfo(err); info != nil {
+		return fmt.Errorf("backend error carries a proxy ErrorInfo %v", info)
+	}
+	if got := hdr.Get("x-proxy-rejected"); len(got) != 0 {
+		return fmt.Errorf("backend error has x-proxy-rejected = %v", got)
+	}
+	return nil
+}
+
+func checkHalfClose(ctx context.Context, h *harness) error {
+	for _, conn := range []*grpc.ClientConn{h.direct, h.proxied} {
+		stream, err := echo.NewEchoServiceClient(conn).BidirectionalStreamingEcho(ctx)
+		if err != nil {
+			return err
+		}
+		for _, m := range []string{collectMessage, "a", "b", "c"} {
+			if err := stream.Send(&echo.EchoRequest{Message: m}); err != nil {
+				return err
+			}
+		}
+		// The backend only answers once it sees the half-close
+		if err := stream.CloseSend(); err != nil {
+			return err
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			return fmt.Errorf("after CloseSend: %v", err)
+		}
+		if want := "collected 3"; resp.GetMessage() != want {
+			return fmt.Errorf("backend answered %q, want %q", resp.GetMessage(), want)
+		}
+		if _, err := stream.Recv(); err != io.EOF {
+			return fmt.Errorf("stream ended with %v, want EOF", err)
+		}
+		if tr := stream.Trailer().Get(backendTrailer); len(tr) != 1 {
+			return fmt.Errorf("trailer %s missing after half-close", backendTrailer)
+		}
+	}
+	return nil
+}
+
+func checkStrictOrdering(ctx context.Context, h *harness) error {
+	stream, err := echo.NewSecureServiceClient(h.proxied).UnorderedBidiEcho(ctx)
+	if err != nil {
+		return err
+	}
+	const n = 40
+	for i := 0; i < n; i++ {
+		req := &echo.SecureEnvelope{TypeUrl: "type.googleapis.com/echo.EchoRequest", Payload: []byte(fmt.Sprint(i))}
+		if err := stream.Send(req); err != nil {
+			return err
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		resp, err := stream.Recv()
+		if err != nil {
+			return fmt.Errorf("message %d: %v", i, err)
+		}
+		if got, want := string(resp.GetPayload()), fmt.Sprint(i); got != want {
+			return fmt.Errorf("message %d arrived as %q", i, got)
+		}
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		return fmt.Errorf("stream ended with %v, want EOF", err)
+	}
+	return nil
+}
+
+// jitter delays each message by up to 3ms, earlier ones longest, so that
+// concurrently processed messages finish out of order
+func jitter(ctx context.Context, info proxy.MethodInfo, dir proxy.Direction, msg *dynamic.Message) (proxy.Action, error) {
+	payload, _ := msg.TryGetFieldByName("payload")
+	b, _ := payload.([]byte)
+	var i int
+	fmt.Sscan(string(b), &i)
+	time.Sleep(time.Duration(3-i%4) * time.Millisecond)
+	return proxy.Continue(), nil
+}
+
+func checkCancelledStream(ctx context.Context, h *harness) error {
+	addr, err := freeAddr()
+	if err != nil {
+		return err
+	}
+	cfg := h.config()
+	cfg.Admin.ListenAddress = addr
+	cfg.Routes = []proxy.RouteConfig{{Name: "cancelled", Match: "/echo.SecureService/UnorderedBidiEcho", Mode: "inspect-verify-sign", Unordered: true,
+		Processors: []string{"gate"}, Envelope: secureEnvelope}}
+	g := &gate{entered: make(chan struct{}, 8), open: make(chan struct{})}
+	px, lis, err := h.startProxy(cfg, proxy.WithProcessor("gate", g))
+	if err != nil {
+		return err
+	}
+	defer px.Shutdown(ctx)
+	conn, err := dialBufconn(lis)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	h.backend.mu.Lock()
+	before := h.backend.unordered
+	h.backend.mu.Unlock()
+	streamCtx, cancel := context.WithCancel(ctx)
+	stream, err := echo.NewSecureServiceClient(conn).UnorderedBidiEcho(streamCtx)
+	if err != nil {
+		cancel()
+		return err
+	}
+	const n = 4
+	for i := 0; i < n; i++ {
+		if err := stream.Send(&echo.SecureEnvelope{TypeUrl: "type.googleapis.com/echo.EchoRequest", Payload: []byte(fmt.Sprint(i))}); err != nil {
+			cancel()
+			return err
+		}
+	}
+	// Every message is held by a worker when the client goes away
+	for i := 0; i < n; i++ {
+		select {
+		case <-g.entered:
+		case <-ctx.Done():
+			cancel()
+			return fmt.Errorf("%d of %d messages reached the gate", i, n)
+		}
+	}
+	cancel()
+	time.Sleep(50 * time.Millisecond) // for the proxy to see the cancellation
+	close(g.open)
+	time.Sleep(100 * time.Millisecond)
+
+	h.backend.mu.Lock()
+	got := h.backend.unordered - before
+	h.backend.mu.Unlock()
+	if got != 0 {
+		return fmt.Errorf("the backend received %d messages of a cancelled stream, want none", got)
+	}
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(string(body), `proxy_processing_skipped_total{direction="client_to_backend",route="cancelled",shadow="false",stage="sign"}`) {
+		return fmt.Errorf("/metrics counts no messages skipped at sign on the cancelled route")
+	}
+	return nil
+}
+
+// checkSlowConsumer floods a client that never reads, once per trigger: a
+// response blocked past slow_consumer_timeout, and more responses waiting
+// than max_unsent_responses. The client must get UNAVAILABLE with reason
+// SLOW_CONSUMER once it reads again, and the backend must see its call
+// cancelled.
+func checkSlowConsumer(ctx context.Context, h *harness) error {
+	for _, c := range []struct {
+		trigger string
+		limits  proxy.LimitsConfig
+	}{
+		{"send_timeout", proxy.LimitsConfig{SlowConsumerTimeout: "200ms"}},
+		{"unsent_limit", proxy.LimitsConfig{MaxUnsentResponses: 8}},
+	} {
+		cfg := h.config()
+		cfg.Routes = []proxy.RouteConfig{
+			{Name: "slow", Match: "/echo.EchoService/BidirectionalStreamingEcho", Mode: "pass-thru", Limits: c.limits},
+		}
+		px, lis, err := h.startProxy(cfg)
+		if err != nil {
+			return err
+		}
+		err = floodUnread(ctx, h, lis, c.trigger)
+		px.Shutdown(ctx)
+		if err != nil {
+			return fmt.Errorf("%s: %v", c.trigger, err)
+		}
+	}
+	return nil
+}
+
+// floodUnread asks the backend for a flood through lis, stops reading until
+// the proxy gives up on the client, and checks how both ends were told
+func floodUnread(ctx context.Context, h *harness, lis *bufconn.Listener, trigger string) error {
+	h.backend.mu.Lock()
+	h.backend.flood = nil
+	h.backend.mu.Unlock()
+	// Fixed windows, so flow control stops the proxy after 64 KiB
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithInitialWindowSize(64<<10),
+		grpc.WithInitialConnWindowSize(64<<10),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stream, err := echo.NewEchoServiceClient(conn).BidirectionalStreamingEcho(ctx)
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(&echo.EchoRequest{Message: floodMessage}); err != nil {
+		return err
+	}
+
+	// The backend's call ends once the proxy cancels it
+	var flood error
+	for deadline := time.Now().Add(5 * time.Second); flood == nil; time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			return errors.New("the backend was still sending after 5s")
+		}
+		h.backend.mu.Lock()
+		flood = h.backend.flood
+		h.backend.mu.Unlock()
+	}
+	if status.Code(flood) != codes.Canceled {
+		return fmt.Errorf("the backend's flood ended with %v, want Canceled", flood)
+	}
+
+	for {
+		if _, err = stream.Recv(); err != nil {
+			break
+		}
+	}
+	info := errorInfo(err)
+	if status.Code(err) != codes.Unavailable || info.GetReason() != "SLOW_CONSUMER" || info.GetMetadata()["trigger"] != trigger {
+		return fmt.Errorf("the client got %v (ErrorInfo %v), want UNAVAILABLE SLOW_CONSUMER by %s", err, info, trigger)
+	}
+	return nil
+}
+
+// gate holds every message it processes until open is closed, ignoring the
+// call's context as CPU-bound work would
+type gate struct {
+	entered chan struct{}
+	open    chan struct{}
+}
+
+func (g *gate) Process(ctx context.Context, info proxy.MethodInfo, dir proxy.Direction, msg *dynamic.Message) (proxy.Action, error) {
+	g.entered <- struct{}{}
+	<-g.open
+	return proxy.Continue(), nil
+}
+
+// checkUnaryPath makes unary calls through a pass-thru route with a retry
+// policy. A successful call must bring the backend's header and trailer; a
+// backend answering UNAVAILABLE must see the request once, since it may have
+// acted on it, unless the route sets buffer_unary, when every attempt replays
+// it.
+func checkUnaryPath(ctx context.Context, h *harness) error {
+	for _, buffer := range []bool{false, true} {
+		cfg := h.config()
+		cfg.Routes = []proxy.RouteConfig{{Name: "unary", Match: "/echo.EchoService/*", Mode: "pass-thru", Retry: &proxy.RetryConfig{
+			MaxAttempts: 3, InitialBackoff: "1ms", MaxBackoff: "1ms", BufferUnary: buffer,
+		}}}
+		px, lis, err := h.startProxy(cfg)
+		if err != nil {
+			return err
+		}
+		conn, err := dialBufconn(lis)
+		if err != nil {
+			px.Shutdown(ctx)
+			return err
+		}
+		err = func() error {
+			client := echo.NewEchoServiceClient(conn)
+			var header, trailer metadata.MD
+			resp, err := client.UnaryEcho(ctx, &echo.EchoRequest{Message: "unary path"}, grpc.Header(&header), grpc.Trailer(&trailer))
+			if err != nil {
+				return err
+			}
+			if resp.GetMessage() != "Backend says: unary path" {
+				return fmt.Errorf("response %q", resp.GetMessage())
+			}
+			if got := header.Get(backendHeader); len(got) != 1 || got[0] != "unary" {
+				return fmt.Errorf("header %s = %v", backendHeader, got)
+			}
+			if got := trailer.Get(backendTrailer); len(got) != 1 || got[0] != "unary:unary path" {
+				return fmt.Errorf("trailer %s = %v", backendTrailer, got)
+			}
+
+			fail := fmt.Sprintf("fail:%s", codes.Unavailable)
+			before := h.backend.unaryCalls(fail)
+			if _, err := client.UnaryEcho(ctx, &echo.EchoRequest{Message: fail}); status.Code(err) != codes.Unavailable {
+				return fmt.Errorf("failing call returned %v, want UNAVAILABLE", err)
+			}
+			want := 1
+			if buffer {
+				want = 3
+			}
+			if got := h.backend.unaryCalls(fail) - before; got != want {
+				return fmt.Errorf("buffer_unary %v: backend saw the failing request %d times, want %d", buffer, got, want)
+			}
+			return nil
+		}()
+		conn.Close()
+		if shutErr := px.Shutdown(ctx); err == nil {
+			err = shutErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkUnaryReplaySafety makes unary calls through a retrying route to a
+// backend that loses the proxy's connection. A request the backend received
+// before the connection dropped must not be sent again unless the route sets
+// buffer_unary; one whose connection failed before it was sent is retried
+// either way.
+func checkUnaryReplaySafety(ctx context.Context, h *harness) error {
+	for _, buffer := range []bool{false, true} {
+		b := &droppingBackend{echoBackend: &echoBackend{}}
+		srv := grpc.NewServer()
+		echo.RegisterEchoServiceServer(srv, b)
+		backendLis := bufconn.Listen(bufSize)
+		go srv.Serve(backendLis)
+
+		var failDial atomic.Bool
+		cfg := h.config()
+		cfg.Routes = []proxy.RouteConfig{{Name: "unary", Match: "/echo.EchoService/*", Mode: "pass-thru", Retry: &proxy.RetryConfig{
+			MaxAttempts: 3, InitialBackoff: "1ms", MaxBackoff: "1ms", BufferUnary: buffer,
+		}}}
+		px, lis, err := h.startProxy(cfg, proxy.WithBackendDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			if failDial.CompareAndSwap(true, false) {
+				return nil, errors.New("refused once")
+			}
+			c, err := backendLis.DialContext(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return b.track(c), nil
+		}))
+		if err != nil {
+			srv.Stop()
+			return err
+		}
+		conn, err := dialBufconn(lis)
+		if err != nil {
+			px.Shutdown(ctx)
+			srv.Stop()
+			return err
+		}
+		err = func() error {
+			client := echo.NewEchoServiceClient(conn)
+			callCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+			defer cancel()
+			_, err := client.UnaryEcho(callCtx, &echo.EchoRequest{Message: "drop"})
+			want := 1
+			if buffer {
+				want = 3
+			}
+			if got := b.dropped(); got != want {
+				return fmt.Errorf("buffer_unary %v: backend received the dropped request %d times (last error %v), want %d", buffer, got, err, want)
+			}
+			if err == nil {
+				return errors.New("a dropped call succeeded")
+			}
+
+			// A connection that never came up held no request
+			if _, err := client.UnaryEcho(ctx, &echo.EchoRequest{Message: "warm"}); err != nil {
+				return fmt.Errorf("buffer_unary %v: call after the drop: %v", buffer, err)
+			}
+			b.mu.Lock()
+			for _, c := range b.conns {
+				c.Close()
+			}
+			b.conns = nil
+			b.mu.Unlock()
+			failDial.Store(true)
+			if _, err := client.UnaryEcho(ctx, &echo.EchoRequest{Message: "unsent"}); err != nil {
+				return fmt.Errorf("buffer_unary %v: call whose first dial failed: %v", buffer, err)
+			}
+			if got := b.unaryCalls("unsent"); got != 1 {
+				return fmt.Errorf("buffer_unary %v: backend saw the retried request %d times, want 1", buffer, got)
+			}
+			return nil
+		}()
+		conn.Close()
+		if shutErr := px.Shutdown(ctx); err == nil {
+			err = shutErr
+		}
+		srv.Stop()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCompression sends gzip and zstd compressed calls through each route
+// mode with the upstream encoding passed through (client), recompressed
+// (gzip, at a gzip_level of its own) and decompressed (identity). Every mode
+// must see the plain message, and the backend the encoding chosen.
+func checkCompression(ctx context.Context, h *harness) error {
+	b := &echoBackend{}
+	var mu sync.Mutex
+	var received string
+	srv := grpc.NewServer(grpc.ForceServerCodec(recordingCodec{b}), grpc.UnaryInterceptor(
+		func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			enc := ""
+			if s, ok := grpc.ServerTransportStreamFromContext(ctx).(interface{ RecvCompress() string }); ok {
+				enc = s.RecvCompress()
+			}
+			mu.Lock()
+			received = enc
+			mu.Unlock()
+			return handler(ctx, req)
+		}))
+	echo.RegisterEchoServiceServer(srv, b)
+	echo.RegisterSecureServiceServer(srv, b)
+	backendLis := bufconn.Listen(bufSize)
+	go srv.Serve(backendLis)
+	defer srv.Stop()
+
+	level := 1
+	for _, up := range []struct {
+		upstream string
+		level    *int
+	}{
+		{upstream: "client"},
+		{upstream: "gzip", level: &level},
+		{upstream: "identity"},
+		{upstream: "identity", level: &level},
+	} {
+		cfg := h.config()
+		cfg.Backend.Compression = proxy.CompressionConfig{Upstream: up.upstream, GzipLevel: up.level}
+		px, lis, err := h.startProxy(cfg, proxy.WithBackendDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return backendLis.DialContext(ctx)
+		}))
+		if err != nil {
+			return err
+		}
+		conn, err := dialBufconn(lis)
+		if err != nil {
+			px.Shutdown(ctx)
+			return err
+		}
+		err = func() error {
+			for _, enc := range []string{"gzip", "zstd"} {
+				want := enc
+				switch up.upstream {
+				case "gzip":
+					want = "gzip"
+				case "identity":
+					want = ""
+				}
+				message := strings.Repeat(enc+" ", 512)
+				calls := []struct {
+					mode string
+					call func() error
+				}{
+					{"pass-thru", func() error {
+						resp, err := echo.NewEchoServiceClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: message}, grpc.UseCompressor(enc))
+						if err == nil && resp.GetMessage() != "Backend says: "+message {
+							err = fmt.Errorf("response %.20q... does not echo the request", resp.GetMessage())
+						}
+						return err
+					}},
+					{"inspect-outer", func() error {
+						req := &echo.SecureEnvelope{TypeUrl: "type.googleapis.com/echo.EchoRequest", Payload: []byte(message)}
+						resp, err := echo.NewSecureServiceClient(conn).InspectOuter(ctx, req, grpc.UseCompressor(enc))
+						if err == nil && string(resp.GetPayload()) != "Backend Processed (Inspect): "+message {
+							err = fmt.Errorf("response payload %.20q... does not echo the request", resp.GetPayload())
+						}
+						return err
+					}},
+					{"inspect-verify-sign", func() error {
+						req := &echo.SecureEnvelope{TypeUrl: "type.googleapis.com/echo.EchoRequest", Payload: []byte(message)}
+						resp, err := echo.NewSecureServiceClient(conn).SecureEcho(ctx, req, grpc.UseCompressor(enc))
+						if err != nil {
+							return err
+						}
+						var sent echo.SecureEnvelope
+						if err := proto.Unmarshal(b.lastRequest(), &sent); err != nil {
+							return fmt.Errorf("decode request seen by the backend: %v", err)
+						}
+						if err := h.verify(sent.GetPayload(), sent.GetProxySignature()); err != nil {
+							return fmt.Errorf("request proxy signature: %v", err)
+						}
+						return h.verify(resp.GetPayload(), resp.GetProxySignature())
+					}},
+				}
+				for _, c := range calls {
+					if err := c.call(); err != nil {
+						return fmt.Errorf("upstream %s, %s client, %s route: %v", up.upstream, enc, c.mode, err)
+					}
+					mu.Lock()
+					got := received
+					mu.Unlock()
+					if got == "identity" {
+						got = ""
+					}
+					if got != want {
+						return fmt.Errorf("upstream %s, %s client, %s route: backend received grpc-encoding %q, want %q", up.upstream, enc, c.mode, got, want)
+					}
+				}
+			}
+			return nil
+		}()
+		conn.Close()
+		if shutErr := px.Shutdown(ctx); err == nil {
+			err = shutErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkStreamShapes runs the server- and client-streaming echo methods
+// through the pass-thru route, and StressEnvelopes through an
+// inspect-verify-sign route, which has to decode and re-marshal every
+// nested, repeated and map field around the payload it signs
+func checkStreamShapes(ctx context.Context, h *harness) error {
+	legacy := echo.NewEchoServiceClient(h.proxied)
+	down, err := legacy.ServerStreamingEcho(ctx, &echo.EchoRequest{Message: "fan out", Repeat: 5})
+	if err != nil {
+		return err
+	}
+	for i := 1; ; i++ {
+		resp, err := down.Recv()
+		if err == io.EOF {
+			if i != 6 {
+				return fmt.Errorf("server stream ended after %d responses, want 5", i-1)
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if want := fmt.Sprintf("%d/5: fan out", i); resp.GetMessage() != want {
+			return fmt.Errorf("server stream response %d is %q, want %q", i, resp.GetMessage(), want)
+		}
+	}
+
+	up, err := legacy.ClientStreamingEcho(ctx)
+	if err != nil {
+		return err
+	}
+	for _, msg := range []string{"a", "b", "c"} {
+		if err := up.Send(&echo.EchoRequest{Message: msg}); err != nil {
+			return err
+		}
+	}
+	resp, err := up.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	if resp.GetMessage() != "a,b,c" {
+		return fmt.Errorf("client stream collected %q, want \"a,b,c\"", resp.GetMessage())
+	}
+
+	stress := echo.NewStressServiceClient(h.proxied)
+	req := stressEnvelope([]byte("stress payload"), 256<<10)
+	got, err := stress.StressEcho(ctx, req)
+	if err != nil {
+		return err
+	}
+	if string(got.GetPayload()) != "Backend Processed: stress payload" || len(got.GetProxySignature()) == 0 {
+		return fmt.Errorf("stress echo returned %q with a %d byte proxy signature", got.GetPayload(), len(got.GetProxySignature()))
+	}
+	sent := proto.Clone(req).(*echo.StressEnvelope)
+	sent.Payload, sent.ProxySignature = nil, nil
+	got.Payload, got.ProxySignature = nil, nil
+	if !proto.Equal(sent, got) {
+		return fmt.Errorf("stress envelope fields changed through the proxy")
+	}
+
+	bidi, err := stress.StressBidiEcho(ctx)
+	if err != nil {
+		return err
+	}
+	for i := range 3 {
+		req := stressEnvelope([]byte(fmt.Sprintf("stress %d", i)), 64<<10)
+		if err := bidi.Send(req); err != nil {
+			return err
+		}
+		got, err := bidi.Recv()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got.GetPayload(), req.GetPayload()) || len(got.GetRecords()) != len(req.GetRecords()) || len(got.GetBlobs()) != len(req.GetBlobs()) {
+			return fmt.Errorf("stress stream message %d came back as %q with %d records and %d blobs", i, got.GetPayload(), len(got.GetRecords()), len(got.GetBlobs()))
+		}
+	}
+	bidi.CloseSend()
+	if _, err := bidi.Recv(); err != io.EOF {
+		return fmt.Errorf("stress stream ended with %v", err)
+	}
+	return nil
+}
+
+// checkLoadShedding holds two requests in a processor so that more messages
+// are pending than load_shedding allows. A new call on the signing route must
+// then be shed with LOAD_SHED while a pass-thru call goes through; once the
+// held requests finish, calls are admitted again.
+func checkLoadShedding(ctx context.Context, h *harness) error {
+	addr, err := freeAddr()
+	if err != nil {
+		return err
+	}
+	cfg := h.config()
+	cfg.Admin.ListenAddress = addr
+	cfg.LoadShedding = proxy.LoadSheddingConfig{Enabled: true, MaxPending: 1, MaxLatency: "10s"}
+	cfg.Routes = []proxy.RouteConfig{
+		{Name: "echo", Match: "/echo.EchoService/*", Mode: "pass-thru"},
+		{Name: "shed", Match: "/echo.SecureService/SecureEcho", Mode: "inspect-verify-sign", Processors: []string{"gate"}, Envelope: secureEnvelope},
+	}
+	g := &gate{entered: make(chan struct{}, 8), open: make(chan struct{})}
+	px, lis, err := h.startProxy(cfg, proxy.WithProcessor("gate", g))
+	if err != nil {
+		return err
+	}
+	defer px.Shutdown(ctx)
+	conn, err := dialBufconn(lis)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := echo.NewSecureServiceClient(conn)
+	req := &echo.SecureEnvelope{TypeUrl: "type.googleapis.com/echo.EchoRequest", Payload: []byte("pressure")}
+
+	held := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := client.SecureEcho(ctx, req)
+			held <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-g.entered:
+		case <-ctx.Done():
+			close(g.open)
+			return fmt.Errorf("%d of 2 requests reached the gate", i)
+		}
+	}
+	_, err = client.SecureEcho(ctx, req)
+	if info := errorInfo(err); status.Code(err) != codes.ResourceExhausted || info.GetReason() != "LOAD_SHED" || info.GetMetadata()["trigger"] != "pending" {
+		close(g.open)
+		return fmt.Errorf("call under pressure: %v (ErrorInfo %v), want RESOURCE_EXHAUSTED LOAD_SHED triggered by pending", err, info)
+	}
+	if _, err := echo.NewEchoServiceClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: "unshed"}); err != nil {
+		close(g.open)
+		return fmt.Errorf("pass-thru call while shedding: %v", err)
+	}
+	close(g.open)
+	for i := 0; i < 2; i++ {
+		if err := <-held; err != nil {
+			return fmt.Errorf("held request: %v", err)
+		}
+	}
+	if _, err := client.SecureEcho(ctx, req); err != nil {
+		return fmt.Errorf("call once pressure dropped: %v", err)
+	}
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	for _, series := range []string{`proxy_load_shed_total{route="shed",trigger="pending"} 1`, "proxy_load_shedding 0"} {
+		if !strings.Contains(string(body), series) {
+			return fmt.Errorf("/metrics has no %s", series)
+		}
+	}
+
+	cfg.Admin.ListenAddress = ""
+	cfg.LoadShedding.RecoverAt = 1.5
+	if px, err := h.newProxy(cfg); err == nil || !strings.Contains(err.Error(), "LOAD_SHEDDING") {
+		if err == nil {
+			px.Shutdown(ctx)
+		}
+		return fmt.Errorf("recover_at 1.5 gave %v, want LOAD_SHEDDING", err)
+	}
+	return nil
+}
+
+// checkByteAccounting sends a request through a signing route, a pass-thru
+// route and a route whose decode limit rejects it. The signing route's
+// forwarded bytes must exceed the original by its overhead, a signature's
+// worth; pass-thru bytes must be forwarded unchanged; the rejected request
+// must count as original bytes only.
+func checkByteAccounting(ctx context.Context, h *harness) error {
+	addr, err := freeAddr()
+	if err != nil {
+		return err
+	}
+	cfg := h.config()
+	cfg.Admin.ListenAddress = addr
+	cfg.Routes = []proxy.RouteConfig{
+		{Name: "echo", Match: "/echo.EchoService/*", Mode: "pass-thru"},
+		{Name: "signed", Match: "/echo.SecureService/SecureEcho", Mode: "inspect-verify-sign", Envelope: secureEnvelope,
+			Request: &proxy.DirectionCryptoConfig{Verify: "none"}},
+		{Name: "limited", Match: "/echo.SecureService/InspectOuter", Mode: "inspect-outer", Envelope: secureEnvelope,
+			DecodeLimits: proxy.DecodeLimitsConfig{MaxMessageBytes: 16}},
+	}
+	px, lis, err := h.startProxy(cfg)
+	if err != nil {
+		return err
+	}
+	defer px.Shutdown(ctx)
+	conn, err := dialBufconn(lis)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := echo.NewSecureServiceClient(conn)
+
+	// Series are shared by every proxy in the process, so compare to before
+	before, err := scrapeMetrics(addr)
+	if err != nil {
+		return err
+	}
+	req := &echo.SecureEnvelope{TypeUrl: "type.googleapis.com/echo.EchoRequest", Payload: []byte("counted")}
+	if _, err := client.SecureEcho(ctx, req); err != nil {
+		return err
+	}
+	if _, err := echo.NewEchoServiceClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: "counted"}); err != nil {
+		return err
+	}
+	if _, err := client.InspectOuter(ctx, req); status.Code(err) != codes.InvalidArgument {
+		return fmt.Errorf("request over the decode limit: %v, want INVALID_ARGUMENT", err)
+	}
+
+	after, err := scrapeMetrics(addr)
+	if err != nil {
+		return err
+	}
+	series := func(name, method, stage string) float64 {
+		key := fmt.Sprintf(`%s{direction="c2s",method="%s",stage="%s"}`, name, method, stage)
+		if stage == "" {
+			key = fmt.Sprintf(`%s{direction="c2s",method="%s"}`, name, method)
+		}
+		return after[key] - before[key]
+	}
+	size := float64(proto.Size(req))
+	signed := "/echo.SecureService/SecureEcho"
+	original, forwarded := series("proxy_message_bytes_total", signed, "original"), series("proxy_message_bytes_total", signed, "forwarded")
+	overhead := series("proxy_message_overhead_bytes_sum", signed, "")
+	if original != size || forwarded-original != overhead || overhead < 256 {
+		return fmt.Errorf("signed request: %v bytes original, %v forwarded, %v overhead; want %v original and a signature's overhead", original, forwarded, overhead, size)
+	}
+	passed := "/echo.EchoService/UnaryEcho"
+	if o, f := series("proxy_message_bytes_total", passed, "original"), series("proxy_message_bytes_total", passed, "forwarded"); o == 0 || o != f {
+		return fmt.Errorf("pass-thru request: %v bytes original, %v forwarded; want them equal", o, f)
+	}
+	limited := "/echo.SecureService/InspectOuter"
+	if o, f := series("proxy_message_bytes_total", limited, "original"), series("proxy_message_bytes_total", limited, "forwarded"); o != size || f != 0 {
+		return fmt.Errorf("rejected request: %v bytes original, %v forwarded; want %v and none", o, f, size)
+	}
+	return nil
+}
+
+func checkConformance(ctx context.Context, h *harness) error {
+	for _, r := range proxy.RunConformance(ctx, h.direct, h.proxied, proxy.ConformanceOptions{}) {
+		if !r.Passed {
+			return fmt.Errorf("%s: %s", r.Scenario, strings.Join(r.Differences, "; "))
+		}
+	}
+
+	// A local reply answers UnaryEcho with the backend's bytes but none of
+	// its metadata
+	cfg := h.config()
+	cfg.Routes = append([]proxy.RouteConfig{{Name: "canned", Match: "/echo.EchoService/UnaryEcho", Mode: "local-reply",
+		LocalReply: &proxy.LocalReplyConfig{Response: `{"message": "Backend says: conformance"}`}}}, cfg.Routes...)
+	px, lis, err := h.startProxy(cfg)
+	if err != nil {
+		return err
+	}
+	defer px.Shutdown(context.Background())
+	conn, err := dialBufconn(lis)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	results := proxy.RunConformance(ctx, h.direct, conn, proxy.ConformanceOptions{Scenarios: []string{"unary", "server-streaming"}})
+	if len(results) != 2 {
+		return fmt.Errorf("ran %d scenarios, want 2", len(results))
+	}
+	unary, streaming := results[0], results[1]
+	if unary.Passed || !strings.Contains(strings.Join(unary.Differences, "; "), "x-backend-header") {
+		return fmt.Errorf("local reply: unary passed %v with differences %q, want the missing backend header", unary.Passed, unary.Differences)
+	}
+	if !streaming.Passed {
+		return fmt.Errorf("local reply: server-streaming failed: %q", streaming.Differences)
+	}
+	return nil
+}
+
+// checkPeerInfo makes two calls over one TCP connection with
+// logging.peer_info on. The calls' Intercepted and access lines and audit
+// records must name the client's address, proxy_rpcs_by_peer_total must
+// count them under its /24, and closing the connection must log it with both
+// calls.
+func checkPeerInfo(ctx context.Context, h *harness) error {
+	addr, err := freeAddr()
+	if err != nil {
+		return err
+	}
+	auditPath := filepath.Join(h.dir, "peer-audit.log")
+	cfg := h.config()
+	cfg.Admin.ListenAddress = addr
+	cfg.Audit = proxy.AuditConfig{Path: auditPath}
+	cfg.Logging = proxy.LoggingConfig{PeerInfo: true}
+	cfg.Routes = []proxy.RouteConfig{
+		{Name: "echo", Match: "/echo.EchoService/*", Mode: "pass-thru"},
+		{Name: "signed", Match: "/echo.SecureService/SecureEcho", Mode: "inspect-verify-sign", Envelope: secureEnvelope,
+			Request: &proxy.DirectionCryptoConfig{Verify: "none"}},
+	}
+
+	logs := &lockedBuffer{}
+	prev := log.Writer()
+	log.SetOutput(io.MultiWriter(prev, logs))
+	defer log.SetOutput(prev)
+
+	px, err := h.newProxy(cfg)
+	if err != nil {
+		return err
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	go px.Serve(lis)
+	before, err := scrapeMetrics(addr)
+	if err != nil {
+		px.Shutdown(ctx)
+		return err
+	}
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		px.Shutdown(ctx)
+		return err
+	}
+	_, err = echo.NewEchoServiceClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: "who is calling"})
+	if err == nil {
+		_, err = echo.NewSecureServiceClient(conn).SecureEcho(ctx, &echo.SecureEnvelope{TypeUrl: "type.googleapis.com/echo.EchoRequest", Payload: []byte("signed")})
+	}
+	conn.Close()
+	if err != nil {
+		px.Shutdown(ctx)
+		return err
+	}
+	closed := regexp.MustCompile(`\[Peer\] Connection from 127\.0\.0\.1:\d+ closed after \S+, 2 call\(s\)`)
+	for i := 0; i < 100 && !closed.MatchString(logs.String()); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	after, err := scrapeMetrics(addr)
+	if shutErr := px.Shutdown(ctx); err == nil {
+		err = shutErr
+	}
+	if err != nil {
+		return err
+	}
+
+	out := logs.String()
+	for _, want := range []*regexp.Regexp{
+		regexp.MustCompile(`\[Peer\] Connection from 127\.0\.0\.1:\d+ established on 127\.0\.0\.1:\d+`),
+		regexp.MustCompile(`Intercepted /echo\.EchoService/UnaryEcho \| Route: echo \| Mode: pass-thru \| Peer: 127\.0\.0\.1:\d+`),
+		regexp.MustCompile(`"method":"/echo\.SecureService/SecureEcho".*"peer":"127\.0\.0\.1:\d+"`),
+		closed,
+	} {
+		if !want.MatchString(out) {
+			return fmt.Errorf("no log line matching %s", want)
+		}
+	}
+	for _, route := range []string{"echo", "signed"} {
+		key := fmt.Sprintf(`proxy_rpcs_by_peer_total{code="OK",peer="127.0.0.0/24",route="%s"}`, route)
+		if got := after[key] - before[key]; got != 1 {
+			return fmt.Errorf("%s rose by %v, want 1", key, got)
+		}
+	}
+
+	b, err := os.ReadFile(auditPath)
+	if err != nil {
+		return err
+	}
+	lines := bytes.Split(bytes.TrimSpace(b), []byte("\n"))
+	for _, line := range lines {
+		var rec struct{ Peer string }
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("audit line %q: %v", line, err)
+		}
+		if !strings.HasPrefix(rec.Peer, "127.0.0.1:") {
+			return fmt.Errorf("audit record %s does not name the client", line)
+		}
+	}
+	if len(lines) == 0 {
+		return errors.New("the signing call left no audit records")
+	}
+
+	// The label must be one the proxy knows
+	cfg.Logging.PeerMetricLabel = "port"
+	if _, err := h.newProxy(cfg); err == nil || !strings.Contains(err.Error(), "LOGGING_PEER_INFO") {
+		return fmt.Errorf("peer_metric_label port started with %v", err)
+	}
+	return nil
+}
+
+// checkStreamJanitor keeps a bidi stream busy past max_stream_idle, which
+// must leave it alone and listed at /streams, then lets it sit, which must
+// end it with DEADLINE_EXCEEDED (stream_idle) and take it off the list. A
+// stream kept busy past max_stream_age must end too (stream_age).
+func checkStreamJanitor(ctx context.Context, h *harness) error {
+	for _, limit := range []struct {
+		kind    string
+		janitor proxy.JanitorConfig
+	}{
+		{"stream_idle", proxy.JanitorConfig{MaxStreamIdle: "300ms", Interval: "50ms"}},
+		{"stream_age", proxy.JanitorConfig{MaxStreamAge: "1200ms", Interval: "50ms"}},
+	} {
+		if err := janitorCall(ctx, h, limit.kind, limit.janitor); err != nil {
+			return fmt.Errorf("%s: %v", limit.kind, err)
+		}
+	}
+	cfg := h.config()
+	cfg.Janitor = proxy.JanitorConfig{MaxStreamIdle: "soon"}
+	if _, err := h.newProxy(cfg); err == nil || !strings.Contains(err.Error(), "JANITOR_DURATION") {
+		return fmt.Errorf("max_stream_idle soon started with %v", err)
+	}
+	return nil
+}
+
+func janitorCall(ctx context.Context, h *harness, kind string, limits proxy.JanitorConfig) error {
+	addr, err := freeAddr()
+	if err != nil {
+		return err
+	}
+	cfg := h.config()
+	cfg.Admin.ListenAddress = addr
+	cfg.Janitor = limits
+	px, lis, err := h.startProxy(cfg)
+	if err != nil {
+		return err
+	}
+	defer px.Shutdown(ctx)
+	conn, err := dialBufconn(lis)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	listed := func() ([]map[string]any, error) {
+		resp, err := http.Get("http://" + addr + "/streams")
+		for i := 0; err != nil && i < 20; i++ {
+			time.Sleep(50 * time.Millisecond)
+			resp, err = http.Get("http://" + addr + "/streams")
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		var streams []map[string]any
+		return streams, json.NewDecoder(resp.Body).Decode(&streams)
+	}
+
+	stream, err := echo.NewEchoServiceClient(conn).BidirectionalStreamingEcho(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.CloseSend()
+	// Busy for 600ms, twice the idle limit
+	for i := 0; i < 6; i++ {
+		if err := stream.Send(&echo.EchoRequest{Message: "busy"}); err != nil {
+			return err
+		}
+		if _, err := stream.Recv(); err != nil {
+			return fmt.Errorf("message %d of a busy stream: %v", i, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	streams, err := listed()
+	if err != nil {
+		return err
+	}
+	if len(streams) != 1 || streams[0]["method"] != "/echo.EchoService/BidirectionalStreamingEcho" || streams[0]["shape"] != "stream" || streams[0]["age"] == "" {
+		return fmt.Errorf("/streams listed %v, want the open stream", streams)
+	}
+
+	// Idle now, or still busy until it is too old
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			if kind == "stream_age" {
+				time.Sleep(100 * time.Millisecond)
+				if err := stream.Send(&echo.EchoRequest{Message: "busy"}); err != nil {
+					_, err = stream.Recv()
+					errs <- err
+					return
+				}
+			}
+			if _, err := stream.Recv(); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	select {
+	case err = <-errs:
+	case <-time.After(3 * time.Second):
+		return errors.New("the janitor did not end the stream")
+	}
+	if status.Code(err) != codes.DeadlineExceeded || errorInfo(err).GetMetadata()["timeout"] != kind {
+		return fmt.Errorf("the stream ended with %v, want DEADLINE_EXCEEDED (%s)", err, kind)
+	}
+	if streams, err = listed(); err != nil || len(streams) != 0 {
+		return fmt.Errorf("/streams lists %v (%v) once the stream ended", streams, err)
+	}
+	return nil
+}
+
+// checkFaultInjection checks that a route's faults are only injected when
+// the proxy enables them, and that a seed makes them repeat run to run
+func checkFaultInjection(ctx context.Context, h *harness) error {
+	withFaults := func(faults proxy.FaultInjectionConfig, opts ...proxy.Option) (*proxy.Proxy, echo.EchoServiceClient, func(), error) {
+		cfg := h.config()
+		cfg.Routes = []proxy.RouteConfig{{Name: "faulty", Match: "/echo.EchoService/*", Mode: "pass-thru", FaultInjection: &faults}}
+		px, lis, err := h.startProxy(cfg, opts...)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		conn, err := dialBufconn(lis)
+		if err != nil {
+			px.Shutdown(ctx)
+			return nil, nil, nil, err
+		}
+		return px, echo.NewEchoServiceClient(conn), func() { conn.Close(); px.Shutdown(ctx) }, nil
+	}
+	abort := proxy.FaultInjectionConfig{Abort: &proxy.FaultAbortConfig{Probability: 1, Code: "RESOURCE_EXHAUSTED"}}
+
+	// Without faults enabled the block is a warning and nothing happens
+	var diag proxy.Diagnostics
+	_, client, done, err := withFaults(abort, proxy.WithDiagnostics(&diag))
+	if err != nil {
+		return err
+	}
+	_, err = client.UnaryEcho(ctx, &echo.EchoRequest{Message: "calm"})
+	done()
+	if err != nil {
+		return fmt.Errorf("a call with faults disabled failed: %v", err)
+	}
+	if !strings.Contains(fmt.Sprint(diag.Items), "FAULT_INJECTION_DISABLED") {
+		return fmt.Errorf("startup reported %v, want FAULT_INJECTION_DISABLED", diag.Items)
+	}
+
+	_, client, done, err = withFaults(abort, proxy.WithFaultInjection())
+	if err != nil {
+		return err
+	}
+	_, err = client.UnaryEcho(ctx, &echo.EchoRequest{Message: "abort"})
+	done()
+	if status.Code(err) != codes.ResourceExhausted || errorInfo(err).GetReason() != "FAULT_INJECTED" {
+		return fmt.Errorf("aborted call got %v, want RESOURCE_EXHAUSTED FAULT_INJECTED", err)
+	}
+
+	// The same seed damages the same calls on every run
+	damage := proxy.FaultInjectionConfig{Seed: 7, Corrupt: &proxy.FaultBytesConfig{Probability: 0.5, Bytes: 3, Direction: "responses"}}
+	outcomes := func() ([]string, error) {
+		_, client, done, err := withFaults(damage, proxy.WithFaultInjection())
+		if err != nil {
+			return nil, err
+		}
+		defer done()
+		var out []string
+		for i := range 16 {
+			msg := fmt.Sprintf("message %02d", i)
+			resp, err := client.UnaryEcho(ctx, &echo.EchoRequest{Message: msg})
+			switch {
+			case err != nil:
+				out = append(out, status.Code(err).String())
+			case resp.GetMessage() != "Backend says: "+msg:
+				out = append(out, fmt.Sprintf("%q", resp.GetMessage()))
+			default:
+				out = append(out, "ok")
+			}
+		}
+		return out, nil
+	}
+	first, err := outcomes()
+	if err != nil {
+		return err
+	}
+	second, err := outcomes()
+	if err != nil {
+		return err
+	}
+	if !slices.Equal(first, second) {
+		return fmt.Errorf("seed 7 damaged %v, then %v", first, second)
+	}
+	if !slices.Contains(first, "ok") || !slices.ContainsFunc(first, func(o string) bool { return o != "ok" }) {
+		return fmt.Errorf("seed 7 at 50%% damaged %v, want some calls and not others", first)
+	}
+
+	// Delays hold requests back; dropped responses never reach the client
+	_, client, done, err = withFaults(proxy.FaultInjectionConfig{
+		Delay:         &proxy.FaultDelayConfig{Probability: 1, Duration: "150ms", Direction: "requests"},
+		DropResponses: &proxy.FaultChanceConfig{Probability: 1},
+	}, proxy.WithFaultInjection())
+	if err != nil {
+		return err
+	}
+	defer done()
+	start := time.Now()
+	if _, err := client.UnaryEcho(ctx, &echo.EchoRequest{Message: "slow"}); err != nil {
+		return err
+	}
+	if took := time.Since(start); took < 150*time.Millisecond {
+		return fmt.Errorf("delayed call took %s, want at least 150ms", took)
+	}
+	stream, err := client.BidirectionalStreamingEcho(ctx)
+	if err != nil {
+		return err
+	}
+	for i := range 3 {
+		if err := stream.Send(&echo.EchoRequest{Message: fmt.Sprint(i)}); err != nil {
+			return err
+		}
+	}
+	stream.CloseSend()
+	if resp, err := stream.Recv(); err != io.EOF {
+		return fmt.Errorf("stream dropping every response got %v, %v, want io.EOF", resp, err)
+	}
+
+	// A bad block fails startup whether or not faults are enabled
+	cfg := h.config()
+	cfg.Routes = []proxy.RouteConfig{{Name: "faulty", Match: "/echo.EchoService/*", Mode: "pass-thru", FaultInjection: &proxy.FaultInjectionConfig{
+		Abort: &proxy.FaultAbortConfig{Probability: 2, Code: "OK"},
+	}}}
+	if _, err := h.newProxy(cfg); err == nil || !strings.Contains(err.Error(), "ROUTE_FAULT_INJECTION") {
+		return fmt.Errorf("NewProxy with abort probability 2 and code OK: %v", err)
+	}
+	return nil
+}
+
+// mirrorCall is what the mirror backend of checkMirroring received in one call
+type mirrorCall struct {
+	method   string
+	mirrored []string // x-mirrored
+	messages [][]byte
+}
+
+// checkMirroring mirrors calls to a second backend, which records them. A
+// stream's messages must reach it one by one, and a signed request as the
+// primary got it; unary calls must be answered while the mirror still holds
+// one, a call over max_concurrent skipped, a mirror that cannot be reached
+// counted without failing the call, and streams left alone by a route
+// mirroring requests only.
+func checkMirroring(ctx context.Context, h *harness) error {
+	got := make(chan mirrorCall, 16)
+	release := make(chan struct{})
+	defer close(release)
+	mirrorLis := bufconn.Listen(bufSize)
+	srv := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}), grpc.UnknownServiceHandler(func(_ interface{}, stream grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(stream)
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		call := mirrorCall{method: method, mirrored: md.Get("x-mirrored")}
+		for {
+			var b []byte
+			if err := stream.RecvMsg(&b); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			call.messages = append(call.messages, b)
+		}
+		if len(call.messages) > 0 && bytes.Contains(call.messages[0], []byte("hold")) {
+			<-release
+		}
+		got <- call
+		return stream.SendMsg(&[]byte{})
+	}))
+	go srv.Serve(mirrorLis)
+	defer srv.Stop()
+
+	addr, err := freeAddr()
+	if err != nil {
+		return err
+	}
+	cfg := h.config()
+	cfg.Admin.ListenAddress = addr
+	cfg.Routes = []proxy.RouteConfig{
+		{Name: "unary", Match: "/echo.EchoService/UnaryEcho", Mode: "pass-thru", Mirror: &proxy.MirrorConfig{Address: "mirror", Percent: 100, MaxConcurrent: 1}},
+		{Name: "bidi", Match: "/echo.EchoService/BidirectionalStreamingEcho", Mode: "pass-thru", Mirror: &proxy.MirrorConfig{Address: "mirror", Percent: 100, Scope: "streams"}},
+		{Name: "requests-only", Match: "/echo.EchoService/ServerStreamingEcho", Mode: "pass-thru", Mirror: &proxy.MirrorConfig{Address: "mirror", Percent: 100}},
+		{Name: "down", Match: "/echo.EchoService/ClientStreamingEcho", Mode: "pass-thru", Mirror: &proxy.MirrorConfig{Address: "down", Percent: 100, Scope: "streams", Timeout: "1s"}},
+		{Name: "secure", Match: "/echo.SecureService/SecureEcho", Mode: "inspect-verify-sign", Envelope: secureEnvelope, Mirror: &proxy.MirrorConfig{Address: "mirror", Percent: 100}},
+	}
+	px, lis, err := h.startProxy(cfg, proxy.WithBackendDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		switch addr {
+		case "mirror":
+			return mirrorLis.DialContext(ctx)
+		case "down":
+			return nil, errors.New("mirror is down")
+		}
+		return h.backendLis.DialContext(ctx)
+	}))
+	if err != nil {
+		return err
+	}
+	defer px.Shutdown(ctx)
+	conn, err := dialBufconn(lis)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	legacy := echo.NewEchoServiceClient(conn)
+	before, err := scrapeMetrics(addr)
+	if err != nil {
+		return err
+	}
+	next := func(method string) (mirrorCall, error) {
+		select {
+		case call := <-got:
+			if call.method != method {
+				return call, fmt.Errorf("mirror received %s, want %s", call.method, method)
+			}
+			if len(call.mirrored) != 1 || call.mirrored[0] != "true" {
+				return call, fmt.Errorf("%s reached the mirror with x-mirrored %q, want true", method, call.mirrored)
+			}
+			return call, nil
+		case <-time.After(5 * time.Second):
+			return mirrorCall{}, fmt.Errorf("%s never reached the mirror", method)
+		}
+	}
+
+	// Not mirrored: the route's scope is requests
+	server, err := legacy.ServerStreamingEcho(ctx, &echo.EchoRequest{Message: "unmirrored", Repeat: 2})
+	if err != nil {
+		return err
+	}
+	for err == nil {
+		_, err = server.Recv()
+	}
+	if err != io.EOF {
+		return fmt.Errorf("server stream: %v", err)
+	}
+
+	bidi, err := legacy.BidirectionalStreamingEcho(ctx)
+	if err != nil {
+		return err
+	}
+	sent := []string{"one", "two", "three"}
+	for _, msg := range sent {
+		if err := bidi.Send(&echo.EchoRequest{Message: msg}); err != nil {
+			return err
+		}
+		if _, err := bidi.Recv(); err != nil {
+			return fmt.Errorf("bidi: %v", err)
+		}
+	}
+	bidi.CloseSend()
+	if _, err := bidi.Recv(); err != io.EOF {
+		return fmt.Errorf("bidi ended with %v, want EOF", err)
+	}
+	call, err := next("/echo.EchoService/BidirectionalStreamingEcho")
+	if err != nil {
+		return err
+	}
+	var mirrored []string
+	for _, b := range call.messages {
+		var req echo.EchoRequest
+		if err := proto.Unmarshal(b, &req); err != nil {
+			return err
+		}
+		mirrored = append(mirrored, req.GetMessage())
+	}
+	if !slices.Equal(mirrored, sent) {
+		return fmt.Errorf("mirror received the stream's messages %q, want %q", mirrored, sent)
+	}
+
+	// The mirror gets the request the route signed
+	payload := []byte("mirrored payload")
+	if _, err := echo.NewSecureServiceClient(conn).SecureEcho(ctx, &echo.SecureEnvelope{TypeUrl: "type.googleapis.com/echo.EchoRequest", Payload: payload}); err != nil {
+		return fmt.Errorf("secure: %v", err)
+	}
+	if call, err = next("/echo.SecureService/SecureEcho"); err != nil {
+		return err
+	}
+	var env echo.SecureEnvelope
+	if len(call.messages) != 1 {
+		return fmt.Errorf("mirror received %d SecureEcho requests, want 1", len(call.messages))
+	} else if err := proto.Unmarshal(call.messages[0], &env); err != nil {
+		return err
+	} else if err := h.verify(payload, env.GetProxySignature()); err != nil {
+		return fmt.Errorf("mirrored request's proxy signature: %v", err)
+	}
+
+	// The mirror holds the first call; the client has its answer regardless,
+	// and the second finds the route at max_concurrent
+	start := time.Now()
+	for _, msg := range []string{"hold", "skipped"} {
+		if _, err := legacy.UnaryEcho(ctx, &echo.EchoRequest{Message: msg}); err != nil {
+			return fmt.Errorf("unary %s: %v", msg, err)
+		}
+	}
+	if waited := time.Since(start); waited > time.Second {
+		return fmt.Errorf("unary calls took %s with the mirror holding one", waited)
+	}
+	release <- struct{}{}
+	if call, err = next("/echo.EchoService/UnaryEcho"); err != nil {
+		return err
+	}
+
+	client, err := legacy.ClientStreamingEcho(ctx)
+	if err != nil {
+		return err
+	}
+	if err := client.Send(&echo.EchoRequest{Message: "to nowhere"}); err != nil {
+		return err
+	}
+	if resp, err := client.CloseAndRecv(); err != nil || resp.GetMessage() != "to nowhere" {
+		return fmt.Errorf("client stream with its mirror down: %v, %v", resp, err)
+	}
+
+	var after map[string]float64
+	for i := 0; i < 50; i++ {
+		if after, err = scrapeMetrics(addr); err != nil {
+			return err
+		}
+		if after[`proxy_mirror_errors_total{reason="Unavailable",route="down"}`] > before[`proxy_mirror_errors_total{reason="Unavailable",route="down"}`] {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	for series, want := range map[string]float64{
+		`proxy_mirror_rpcs_total{route="bidi"}`:                        1,
+		`proxy_mirror_rpcs_total{route="unary"}`:                       1,
+		`proxy_mirror_skipped_total{route="unary"}`:                    1,
+		`proxy_mirror_rpcs_total{route="requests-only"}`:               0,
+		`proxy_mirror_errors_total{reason="Unavailable",route="down"}`: 1,
+		`proxy_mirror_lag_seconds_count{route="bidi"}`:                 3,
+	} {
+		if d := after[series] - before[series]; d != want {
+			return fmt.Errorf("%s went up by %v, want %v", series, d, want)
+		}
+	}
+	select {
+	case call := <-got:
+		return fmt.Errorf("mirror received an unexpected %s", call.method)
+	default:
+	}
+
+	cfg.Routes[1].Mirror.Scope = "everything"
+	if px, err := h.newProxy(cfg); err == nil {
+		px.Shutdown(ctx)
+		return errors.New("started with mirror scope everything")
+	} else if !strings.Contains(err.Error(), "ROUTE_MIRROR") {
+		return fmt.Errorf("mirror scope everything failed with %v, want ROUTE_MIRROR", err)
+	}
+	return nil
+}
+
+// checkBackendRestart restarts the backend under a stream of unary calls:
+// the first generation is stopped gracefully (GOAWAY) and, with a stream
+// still open on it, stopped for good. No unary call may fail, the one held
+// across the stop included, which is replayed on the second generation; a
+// stream opened after the GOAWAY must go to the second generation too, and
+// the stream left on the first must end BACKEND_RESTARTING with a pushback.
+func checkBackendRestart(ctx context.Context, h *harness) error {
+	var mu sync.Mutex
+	serve := func(generation int) (*grpc.Server, *bufconn.Listener, *restartingBackend) {
+		b := &restartingBackend{echoBackend: &echoBackend{}, generation: generation, slow: make(chan struct{})}
+		srv := grpc.NewServer()
+		echo.RegisterEchoServiceServer(srv, b)
+		lis := bufconn.Listen(bufSize)
+		go srv.Serve(lis)
+		return srv, lis, b
+	}
+	first, current, gen1 := serve(1)
+	defer first.Stop()
+
+	addr, err := freeAddr()
+	if err != nil {
+		return err
+	}
+	cfg := h.config()
+	cfg.Admin.ListenAddress = addr
+	cfg.Backend.Restart = &proxy.BackendRestartConfig{Pushback: "250ms"}
+	cfg.Routes = []proxy.RouteConfig{{Name: "echo", Match: "/echo.EchoService/*", Mode: "pass-thru"}}
+	px, lis, err := h.startProxy(cfg, proxy.WithBackendDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return current.DialContext(ctx)
+	}))
+	if err != nil {
+		return err
+	}
+	defer px.Shutdown(ctx)
+	conn, err := dialBufconn(lis)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := echo.NewEchoServiceClient(conn)
+	before, err := scrapeMetrics(addr)
+	if err != nil {
+		return err
+	}
+	roundTrip := func(stream echo.EchoService_BidirectionalStreamingEchoClient, msg string) error {
+		if err := stream.Send(&echo.EchoRequest{Message: msg}); err != nil {
+			return err
+		}
+		_, err := stream.Recv()
+		return err
+	}
+
+	// The benchmark runs throughout
+	stop := make(chan struct{})
+	benchErr := make(chan error, 4)
+	var calls atomic.Int64
+	for range 4 {
+		go func() {
+			for {
+				select {
+				case <-stop:
+					benchErr <- nil
+					return
+				default:
+				}
+				if _, err := client.UnaryEcho(ctx, &echo.EchoRequest{Message: "bench"}); err != nil {
+					benchErr <- fmt.Errorf("unary call during the restart: %v", err)
+					return
+				}
+				calls.Add(1)
+			}
+		}()
+	}
+	stopBench := sync.OnceFunc(func() { close(stop) })
+	defer stopBench()
+
+	old, err := client.BidirectionalStreamingEcho(ctx)
+	if err != nil {
+		return err
+	}
+	if err := roundTrip(old, "before"); err != nil {
+		return fmt.Errorf("stream before the restart: %v", err)
+	}
+	slowErr := make(chan error, 1)
+	go func() {
+		resp, err := client.UnaryEcho(ctx, &echo.EchoRequest{Message: "slow"})
+		if err == nil && resp.GetMessage() != "Backend says: slow" {
+			err = fmt.Errorf("answered %q", resp.GetMessage())
+		}
+		slowErr <- err
+	}()
+	select {
+	case <-gen1.slow:
+	case <-time.After(5 * time.Second):
+		return errors.New("the slow call never reached the first generation")
+	}
+
+	second, next, gen2 := serve(2)
+	defer second.Stop()
+	mu.Lock()
+	current = next
+	mu.Unlock()
+	go first.GracefulStop()
+	time.Sleep(200 * time.Millisecond)
+
+	fresh, err := client.BidirectionalStreamingEcho(ctx)
+	if err != nil {
+		return err
+	}
+	if err := roundTrip(fresh, "after"); err != nil {
+		return fmt.Errorf("stream opened after the GOAWAY: %v", err)
+	}
+	first.Stop()
+
+	_, err = old.Recv()
+	if status.Code(err) != codes.Unavailable || errorInfo(err).GetReason() != "BACKEND_RESTARTING" {
+		return fmt.Errorf("stream left on the stopped backend ended with %v, want UNAVAILABLE BACKEND_RESTARTING", err)
+	}
+	if pushback := old.Trailer().Get("grpc-retry-pushback-ms"); len(pushback) != 1 || pushback[0] != "250" {
+		return fmt.Errorf("stream left on the stopped backend had grpc-retry-pushback-ms %q, want 250", pushback)
+	}
+	select {
+	case err := <-slowErr:
+		if err != nil {
+			return fmt.Errorf("unary call held across the stop: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		return errors.New("unary call held across the stop never finished")
+	}
+	if err := roundTrip(fresh, "still"); err != nil {
+		return fmt.Errorf("stream opened after the GOAWAY, once the first generation stopped: %v", err)
+	}
+	if n := gen2.unaryCalls("slow"); n != 1 {
+		return fmt.Errorf("second generation received the slow call %d times, want 1", n)
+	}
+
+	stopBench()
+	for range 4 {
+		if err := <-benchErr; err != nil {
+			return err
+		}
+	}
+	if calls.Load() == 0 {
+		return errors.New("no unary calls ran during the restart")
+	}
+	after, err := scrapeMetrics(addr)
+	if err != nil {
+		return err
+	}
+	for _, series := range []string{
+		`proxy_backend_restart_replays_total{method="/echo.EchoService/UnaryEcho"}`,
+		`proxy_upstream_connections_closed_total{endpoint="bufnet",reason="closed"}`,
+	} {
+		if after[series] <= before[series] {
+			return fmt.Errorf("%s did not go up", series)
+		}
+	}
+	return nil
+}
+
+// streamLimited starts a proxy whose pass-thru route on the echo service
+// allows three messages each way per stream
+func streamLimited(ctx context.Context, h *harness) (echo.EchoServiceClient, func(), error) {
+	cfg := h.config()
+	cfg.Routes = []proxy.RouteConfig{
+		{Name: "limited-streams", Match: "/echo.EchoService/*", Mode: "pass-thru", Limits: proxy.LimitsConfig{MaxMessagesPerStream: 3}},
+	}
+	px, lis, err := h.startProxy(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := dialBufconn(lis)
+	if err != nil {
+		px.Shutdown(ctx)
+		return nil, nil, err
+	}
+	return echo.NewEchoServiceClient(conn), func() { conn.Close(); px.Shutdown(ctx) }, nil
+}
+
+// streamLimitErr checks that err ended a stream at max_messages_per_stream
+func streamLimitErr(err error, trailer metadata.MD) error {
+	if info := errorInfo(err); status.Code(err) != codes.ResourceExhausted || info.GetReason() != "STREAM_LIMIT_EXCEEDED" || info.GetMetadata()["limit"] != "max_messages_per_stream" {
+		return fmt.Errorf("got %v, want RESOURCE_EXHAUSTED STREAM_LIMIT_EXCEEDED for max_messages_per_stream", err)
+	}
+	if got := trailer.Get("x-proxy-stream-limit"); len(got) != 1 || got[0] != "max_messages_per_stream" {
+		return fmt.Errorf("x-proxy-stream-limit trailer %v", got)
+	}
+	return nil
+}
+
+// checkStreamLimitRequests sends a fourth request on a bidi stream limited to
+// three per direction: the three before it are echoed, and the fourth ends
+// the stream RESOURCE_EXHAUSTED without reaching the backend
+func checkStreamLimitRequests(ctx context.Context, h *harness) error {
+	client, stop, err := streamLimited(ctx, h)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	stream, err := client.BidirectionalStreamingEcho(ctx)
+	if err != nil {
+		return err
+	}
+	for i := 1; i <= 3; i++ {
+		msg := fmt.Sprintf("request %d", i)
+		if err := stream.Send(&echo.EchoRequest{Message: msg}); err != nil {
+			return err
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			return fmt.Errorf("request %d of 3: %v", i, err)
+		}
+		if resp.GetMessage() != "Backend streams: "+msg {
+			return fmt.Errorf("request %d echoed as %q", i, resp.GetMessage())
+		}
+	}
+	if err := stream.Send(&echo.EchoRequest{Message: "request 4"}); err != nil && err != io.EOF {
+		return err
+	}
+	resp, err := stream.Recv()
+	if err == nil {
+		return fmt.Errorf("the fourth request was answered with %q", resp.GetMessage())
+	}
+	return streamLimitErr(err, stream.Trailer())
+}
+
+// checkStreamLimitResponses asks the backend for ten responses on a
+// server stream limited to three per direction: the client gets three, then
+// RESOURCE_EXHAUSTED
+func checkStreamLimitResponses(ctx context.Context, h *harness) error {
+	client, stop, err := streamLimited(ctx, h)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	stream, err := client.ServerStreamingEcho(ctx, &echo.EchoRequest{Message: "many", Repeat: 10})
+	if err != nil {
+		return err
+	}
+	var got []string
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			if len(got) != 3 {
+				return fmt.Errorf("received %d responses before %v, want 3", len(got), err)
+			}
+			return streamLimitErr(err, stream.Trailer())
+		}
+		got = append(got, resp.GetMessage())
+		if len(got) > 3 {
+			return fmt.Errorf("received %v, past the limit of 3", got)
+		}
+	}
+}
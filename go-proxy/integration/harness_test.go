@@ -0,0 +1,324 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anthony/grpc-proxy/api/echo"
+	"github.com/anthony/grpc-proxy/go-proxy/proxy"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// --- Harness ---
+
+// harness owns the in-process backend and proxy
+type harness struct {
+	dir     string
+	key     *rsa.PrivateKey
+	backend *echoBackend
+
+	backendLis *bufconn.Listener
+	proxyLis   *bufconn.Listener
+	backendSrv *grpc.Server
+	health     *health.Server // the backend's grpc.health.v1 service
+	px         *proxy.Proxy
+
+	direct  *grpc.ClientConn // straight to the backend
+	proxied *grpc.ClientConn // through the proxy
+}
+
+func newHarness() (*harness, error) {
+	dir, err := os.MkdirTemp("", "proxy-integration")
+	if err != nil {
+		return nil, err
+	}
+	h := &harness{dir: dir, backend: &echoBackend{}}
+	if err := h.writeMaterial(); err != nil {
+		h.close()
+		return nil, err
+	}
+
+	h.backendLis = bufconn.Listen(bufSize)
+	h.backendSrv = grpc.NewServer(grpc.ForceServerCodec(recordingCodec{h.backend}))
+	echo.RegisterEchoServiceServer(h.backendSrv, h.backend)
+	echo.RegisterSecureServiceServer(h.backendSrv, h.backend)
+	echo.RegisterStressServiceServer(h.backendSrv, h.backend)
+	echo.RegisterBatchServiceServer(h.backendSrv, h.backend)
+	h.health = health.NewServer()
+	healthpb.RegisterHealthServer(h.backendSrv, h.health)
+	reflection.Register(h.backendSrv)
+	go h.backendSrv.Serve(h.backendLis)
+
+	h.px, h.proxyLis, err = h.startProxy(h.config())
+	if err != nil {
+		h.close()
+		return nil, err
+	}
+
+	if h.direct, err = dialBufconn(h.backendLis); err == nil {
+		h.proxied, err = dialBufconn(h.proxyLis)
+	}
+	if err != nil {
+		h.close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// startProxy serves a proxy with cfg in front of the harness backend
+func (h *harness) startProxy(cfg proxy.Config, opts ...proxy.Option) (*proxy.Proxy, *bufconn.Listener, error) {
+	px, err := h.newProxy(cfg, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	lis := bufconn.Listen(bufSize)
+	go px.Serve(lis)
+	return px, lis, nil
+}
+
+// newProxy builds a proxy with cfg in front of the harness backend
+func (h *harness) newProxy(cfg proxy.Config, opts ...proxy.Option) (*proxy.Proxy, error) {
+	opts = append([]proxy.Option{proxy.WithBackendDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return h.backendLis.DialContext(ctx)
+	}), proxy.WithProcessor("jitter", proxy.ProcessorFunc(jitter))}, opts...)
+	px, err := proxy.NewProxy(cfg, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("NewProxy: %w", err)
+	}
+	return px, nil
+}
+
+// writeMaterial puts the echo descriptor set and a fresh proxy signing key
+// where the config points
+func (h *harness) writeMaterial() error {
+	fds := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{
+		protodesc.ToFileDescriptorProto(echo.File_api_echo_echo_proto),
+	}}
+	b, err := proto.Marshal(fds)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(h.dir, "echo.pb"), b, 0o600); err != nil {
+		return err
+	}
+
+	if h.key, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(h.key)})
+	return os.WriteFile(filepath.Join(h.dir, "proxy.key"), keyPEM, 0o600)
+}
+
+// secureEnvelope is SecureEnvelope's layout
+var secureEnvelope = proxy.EnvelopeConfig{
+	PayloadField:   "payload",
+	TypeURLField:   "type_url",
+	ClientSigField: "client_signature",
+	ProxySigField:  "proxy_signature",
+	MetadataField:  "metadata",
+}
+
+func (h *harness) config() proxy.Config {
+	return proxy.Config{
+		Backend: proxy.BackendConfig{Address: "bufnet"},
+		Schema:  proxy.SchemaConfig{Method: "pb", PBPath: filepath.Join(h.dir, "echo.pb")},
+		Routes: []proxy.RouteConfig{
+			{Name: "echo", Match: "/echo.EchoService/*", Mode: "pass-thru"},
+			{Name: "inspect-outer", Match: "/echo.SecureService/InspectOuter", Mode: "inspect-outer", Envelope: proxy.EnvelopeConfig{
+				PayloadField:  "payload",
+				TypeURLField:  "type_url",
+				MetadataField: "metadata",
+			}},
+			{Name: "unordered", Match: "/echo.SecureService/UnorderedBidiEcho", Mode: "inspect-outer", Unordered: true, Ordering: "strict", Processors: []string{"jitter"}, Envelope: proxy.EnvelopeConfig{
+				PayloadField: "payload",
+				TypeURLField: "type_url",
+			}},
+			// v2 moves the proxy signature into field 4
+			{Name: "versioned", Match: "/echo.SecureService/SecureBidiEcho", Mode: "inspect-verify-sign", VersionField: "metadata[schema_version]", Envelopes: []proxy.VersionedEnvelope{
+				{Version: "1", EnvelopeConfig: secureEnvelope},
+				{Version: "2", EnvelopeConfig: proxy.EnvelopeConfig{PayloadField: "payload", TypeURLField: "type_url", ProxySigField: "client_signature", MetadataField: "metadata"}},
+			}},
+			{Name: "secure", Match: "/echo.SecureService/*", Mode: "inspect-verify-sign", Envelope: secureEnvelope, AllowedTypes: []string{"echo.EchoRequest"},
+				DecodeLimits: proxy.DecodeLimitsConfig{MaxMessageBytes: 1 << 20}},
+			{Name: "stress", Match: "/echo.StressService/*", Mode: "inspect-verify-sign", Envelope: secureEnvelope},
+		},
+		CMS: proxy.CMSConfig{ProxyPrivateKey: filepath.Join(h.dir, "proxy.key")},
+	}
+}
+
+func (h *harness) close() {
+	for _, conn := range []*grpc.ClientConn{h.direct, h.proxied} {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	if h.px != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		h.px.Shutdown(ctx)
+		cancel()
+	}
+	if h.backendSrv != nil {
+		h.backendSrv.Stop()
+	}
+	os.RemoveAll(h.dir)
+}
+
+func dialBufconn(lis *bufconn.Listener) (*grpc.ClientConn, error) {
+	return grpc.NewClient("passthrough:///bufnet",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}))
+}
+
+// verify checks an RSA-SHA256 proxy signature over payload
+func (h *harness) verify(payload, sig []byte) error {
+	hashed := sha256.Sum256(payload)
+	return rsa.VerifyPKCS1v15(&h.key.PublicKey, crypto.SHA256, hashed[:], sig)
+}
+
+func errorInfo(err error) *errdetails.ErrorInfo {
+	for _, d := range status.Convert(err).Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok {
+			return info
+		}
+	}
+	return nil
+}
+
+// writeCert writes a self-signed certificate for key
+func writeCert(path string, key *rsa.PrivateKey) error {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: filepath.Base(path)},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+}
+
+// lockedBuffer collects log output written from several goroutines
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (b *lockedBuffer) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+// freeAddr is a loopback address nothing listens on
+func freeAddr() (string, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer lis.Close()
+	return lis.Addr().String(), nil
+}
+
+// rawCodec sends and receives messages as the *[]byte it is given
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) { return *v.(*[]byte), nil }
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*[]byte) = bytes.Clone(data)
+	return nil
+}
+
+func (rawCodec) Name() string { return "proto" }
+
+// recordingCodec is the proto codec, keeping each decoded message's wire bytes
+type recordingCodec struct{ b *echoBackend }
+
+func (c recordingCodec) Marshal(v interface{}) ([]byte, error) {
+	return proto.Marshal(v.(proto.Message))
+}
+
+func (c recordingCodec) Unmarshal(data []byte, v interface{}) error {
+	c.b.mu.Lock()
+	c.b.last = bytes.Clone(data)
+	c.b.mu.Unlock()
+	return proto.Unmarshal(data, v.(proto.Message))
+}
+
+func (recordingCodec) Name() string { return "proto" }
+
+var _ encoding.Codec = recordingCodec{}
+
+// scrapeMetrics reads the admin listener's /metrics into values by series,
+// waiting a little for a listener that is still starting
+func scrapeMetrics(addr string) (map[string]float64, error) {
+	resp, err := http.Get("http://" + addr + "/metrics")
+	for i := 0; err != nil && i < 20; i++ {
+		time.Sleep(50 * time.Millisecond)
+		resp, err = http.Get("http://" + addr + "/metrics")
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]float64)
+	for _, line := range strings.Split(string(body), "\n") {
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if v, err := strconv.ParseFloat(line[i+1:], 64); err == nil {
+			values[line[:i]] = v
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,126 @@
+// Package integration runs the proxy end to end in one process: an echo
+// backend, the proxy and its clients all talk over bufconn listeners, so no
+// ports, external processes or checked-in keys are involved.
+//
+//	go test ./go-proxy/integration                         # from the repository root
+//	go test ./go-proxy/integration -run 'TestIntegration/mirror' -v
+//	go test ./go-proxy/integration -args -proxy-logs       # with the proxy's own logs
+//
+// Each check exercises one guarantee a change must not break, and runs as
+// one subtest of TestIntegration against a shared harness.
+package integration
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+const bufSize = 1 << 20
+
+// check is one end-to-end scenario; a returned error fails it
+type check struct {
+	name string
+	run  func(ctx context.Context, h *harness) error
+}
+
+var checks = []check{
+	{"pass-thru unary matches a direct call", checkUnaryParity},
+	{"pass-thru bidi stream matches a direct call", checkBidiParity},
+	{"pass-thru forwards the request bytes unchanged", checkPassThruBytes},
+	{"gRPC-Web calls end with a framed trailer", checkGRPCWeb},
+	{"route timeouts end calls DEADLINE_EXCEEDED from the proxy", checkRouteDeadlines},
+	{"inspect-outer forwards the request bytes unchanged", checkInspectOuterBytes},
+	{"inspect-verify-sign adds verifiable proxy signatures", checkProxySignature},
+	{"backend statuses and trailers reach the client", checkErrorPropagation},
+	{"backend status details survive byte for byte", checkErrorDetails},
+	{"proxy rejections carry an ErrorInfo and x-proxy-rejected", checkRejectionDetails},
+	{"half-close lets the backend finish the stream", checkHalfClose},
+	{"ordering: strict keeps unordered streams in order", checkStrictOrdering},
+	{"envelope versions interleave on one bidi stream", checkEnvelopeVersions},
+	{"stream attestation signs the rolling hash at half-close", checkStreamAttestation},
+	{"decode limits reject crafted requests before unmarshal", checkDecodeLimits},
+	{"egress verbs sign requests with a named key and check the partner", checkEgressVerbs},
+	{"empty payloads are signed, skipped or rejected, never mock-signed", checkEmptyPayloads},
+	{"route precedence: priority, then specificity, then config order", checkRoutePrecedence},
+	{"reflection and health pass through a wildcard route unless builtin_passthrough is off", checkBuiltinPassthrough},
+	{"envelope SDK signatures verify at the proxy and back", checkEnvelopeSDK},
+	{"trust_domain_from refuses unknown tenants before the backend", checkTenantTrustDomains},
+	{"preserve_wire_bytes forwards envelopes byte for byte but the proxy signature", checkWireBytes},
+	{"security refuses calls without a token or from outside allowed_cidrs", checkPerimeter},
+	{"an inner proxy admits only trusted upstreams and sees the original client identity", checkTrustedUpstreams},
+	{"a second TLS connection resumes the first one's session", checkTLSResumption},
+	{"selected headers are copied into envelope metadata and back", checkMetadataCopy},
+	{"preflight holds the listener and readiness until the backend is healthy", checkPreflight},
+	{"a cancelled stream's queued messages are dropped, never signed or sent", checkCancelledStream},
+	{"url schemas are verified, cached, and refreshed with If-None-Match", checkRemoteSchema},
+	{"undecodable messages are rejected on enforcing routes and passed byte for byte elsewhere", checkDecodeFailures},
+	{"session-token routes verify the first message and mint an expiring token", checkSessionTokens},
+	{"redact_fields hides values in logs and taps but not on the wire", checkRedaction},
+	{"a client that stops reading is ended as a slow consumer on both sides", checkSlowConsumer},
+	{"unary calls carry headers and trailers and replay only with buffer_unary", checkUnaryPath},
+	{"unary calls that reached the backend are replayed only with buffer_unary", checkUnaryReplaySafety},
+	{"gzip and zstd calls are decompressed for every mode and recompressed upstream as configured", checkCompression},
+	{"the rust engine reports why a key failed instead of crashing", checkRustErrors},
+	{"schema both keeps pb types and reflected methods and reports conflicts", checkSchemaBoth},
+	{"verify_before_connect opens the backend call only after the first message verifies", checkVerifyBeforeConnect},
+	{"server- and client-streaming calls and stress envelopes survive the proxy", checkStreamShapes},
+	{"max_messages_per_stream ends a bidi stream at the request past the limit", checkStreamLimitRequests},
+	{"max_messages_per_stream ends a server stream at the response past the limit", checkStreamLimitResponses},
+	{"proxy_sig_metadata_key sends the proxy signature in metadata and leaves the envelope alone", checkProxySigMetadata},
+	{"type_url_policy normalizes type URLs and rejects disallowed or malformed ones", checkTypeURLPolicy},
+	{"chained proxies each append a signature entry and the second verifies the first", checkProxyChain},
+	{"encrypt-payload round-trips through an echoing backend and rejects tampered responses", checkPayloadEncryption},
+	{"mistyped envelope fields fail startup unless allow_type_coercion reads them", checkFieldTypes},
+	{"load shedding rejects new crypto calls under pressure and recovers", checkLoadShedding},
+	{"message bytes are counted as received and as forwarded, with the signature overhead", checkByteAccounting},
+	{"batch envelopes verify and sign each item, or sign them all at once", checkBatchEnvelopes},
+	{"signing keys come from files, env and Vault, and rotate without a restart", checkSecretProviders},
+	{"the conformance matrix matches direct and proxied calls, and catches a proxy that differs", checkConformance},
+	{"wrap-envelope wraps bare requests for an envelope backend and unwraps its responses", checkWrapEnvelope},
+	{"peer_info logs each call's client and each connection, and labels metrics by subnet", checkPeerInfo},
+	{"sign_key_selector signs responses with the key a header or envelope field names", checkSignKeySelector},
+	{"the janitor lists active streams and ends idle and overage ones", checkStreamJanitor},
+	{"config-schema covers every key and config-check places problems at their lines", checkConfigTools},
+	{"reflection works against a v1-only backend and gives up on a silent one", checkReflectionV1},
+	{"type URL and client signature come from stream headers and are required up front", checkEnvelopeHeaders},
+	{"engines sign payload digests, matching signatures made over the whole payload", checkDigestSigning},
+	{"routes merge their defaults and envelope template, and include other files", checkConfigIncludes},
+	{"fault_injection delays, aborts, damages and drops reproducibly, only with faults enabled", checkFaultInjection},
+	{"debug_signature_mismatch reports what was hashed, rate-limited, with a capped dump", checkSignatureDebug},
+	{"a request that fails verification is rejected, and only forwarded and counted in shadow", checkShadowVerification},
+	{"edition 2023 and proto2 group envelopes re-marshal as their features say", checkEditions},
+	{"mirror copies sampled calls to a second backend without touching the primary", checkMirroring},
+	{"a backend restart replays cut-off unary calls and pushes back streams", checkBackendRestart},
+	{"nested envelopes are verified and signed level by level", checkNestedEnvelopes},
+	{"admin overrides force routes to pass-thru or reject until restored", checkRouteOverrides},
+}
+
+var proxyLogs = flag.Bool("proxy-logs", false, "show the proxy's logs")
+
+// TestIntegration runs every check, in order, against one harness
+func TestIntegration(t *testing.T) {
+	if !*proxyLogs {
+		log.SetOutput(io.Discard)
+		defer log.SetOutput(os.Stderr)
+	}
+	h, err := newHarness()
+	if err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	defer h.close()
+
+	for _, c := range checks {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := c.run(ctx, h); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,771 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anthony/grpc-proxy/api/echo"
+	"github.com/anthony/grpc-proxy/go-proxy/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	reflectionv1 "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	reflectionv1alpha "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+// --- Routes ---
+
+// precedenceRoutes are listed so that config order alone would pick the
+// wrong route for most of precedenceCases
+var precedenceRoutes = []proxy.RouteConfig{
+	{Name: "catch-all", Match: "/*"},
+	{Name: "service", Match: "/acme.orders.Orders/*"},
+	{Name: "exact", Match: "/acme.orders.Orders/Get"},
+	{Name: "exact-again", Match: "/acme.orders.Orders/Get"},
+	{Name: "boosted-prefix", Match: "/acme.billing.Invoices/*", Priority: 5},
+	{Name: "billing-exact", Match: "/acme.billing.Invoices/Pay"},
+	{Name: "demoted-exact", Match: "/acme.orders.Orders/List", Priority: -1},
+	{Name: "tie-first", Match: "/acme.tie.U/*"},
+	{Name: "tie-second", Match: "/acme.tie.T/*"},
+	{Name: "tie-third", Match: "/acme.tie.T/*", Priority: 1},
+	{Name: "health-explicit", Match: "/grpc.health.v1.Health/Watch"},
+}
+
+var precedenceCases = []struct{ method, route string }{
+	{"/acme.orders.Orders/Get", "exact"},             // exact beats prefixes listed before it, and its duplicate
+	{"/acme.orders.Orders/Put", "service"},           // longer prefix beats shorter
+	{"/acme.orders.OrdersArchive/Get", "catch-all"},  // "/acme.orders.Orders/*" covers that service alone
+	{"/other.Svc/Do", "catch-all"},                   // "/*" ranks last among prefixes
+	{"/acme.billing.Invoices/Pay", "boosted-prefix"}, // priority beats an exact match
+	{"/acme.orders.Orders/List", "service"},          // negative priority loses to any default
+	{"/acme.tie.T/M", "tie-third"},                   // priority among equal patterns
+	{"/acme.tie.U/M", "tie-first"},                   // only one prefix covers it
+	{"/grpc.health.v1.Health/Check", "builtin-pass-thru"},
+	{"/grpc.health.v1.Health/Watch", "health-explicit"},
+	{"/grpc.reflection.v1.ServerReflection/ServerReflectionInfo", "builtin-pass-thru"},      // ahead of "/*"
+	{"/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo", "builtin-pass-thru"}, // ahead of "/*"
+}
+
+func checkRoutePrecedence(ctx context.Context, h *harness) error {
+	cfg := h.config()
+	cfg.Routes = nil
+	for _, r := range precedenceRoutes {
+		r.Mode = "pass-thru"
+		cfg.Routes = append(cfg.Routes, r)
+	}
+	px, _, err := h.startProxy(cfg)
+	if err != nil {
+		return err
+	}
+	defer px.Shutdown(ctx)
+	for _, c := range precedenceCases {
+		if got := px.MatchRoute(c.method).Name; got != c.route {
+			return fmt.Errorf("%s took route %s, want %s", c.method, got, c.route)
+		}
+	}
+
+	cfg.Routes = cfg.Routes[1:] // without the catch-all
+	px, _, err = h.startProxy(cfg)
+	if err != nil {
+		return err
+	}
+	defer px.Shutdown(ctx)
+	if got := px.MatchRoute("/other.Svc/Do").Name; got != "default-pass-thru" {
+		return fmt.Errorf("an unmatched method took route %s", got)
+	}
+	return nil
+}
+
+// checkBuiltinPassthrough calls health and both reflection versions through
+// a proxy with a "/*" route, noting the route each message takes. The
+// built-in pass-thru must carry them ahead of the wildcard, a route naming a
+// health method must take it over, and with builtin_passthrough: false the
+// wildcard applies.
+func checkBuiltinPassthrough(ctx context.Context, h *harness) error {
+	var mu sync.Mutex
+	took := map[string]string{} // route by method
+	hooks := proxy.Hooks{ProcessMessage: func(ctx context.Context, msg *proxy.Message) ([]byte, error) {
+		mu.Lock()
+		took[msg.Method] = msg.Route.Name
+		mu.Unlock()
+		return msg.Payload, nil
+	}}
+	const (
+		health  = "/grpc.health.v1.Health/Check"
+		v1      = "/grpc.reflection.v1.ServerReflection/ServerReflectionInfo"
+		v1alpha = "/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo"
+	)
+	calls := func(conn *grpc.ClientConn) error {
+		if _, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+			return fmt.Errorf("health: %v", err)
+		}
+		stream, err := reflectionv1.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+		if err == nil {
+			err = stream.Send(&reflectionv1.ServerReflectionRequest{MessageRequest: &reflectionv1.ServerReflectionRequest_ListServices{}})
+		}
+		if err == nil {
+			_, err = stream.Recv()
+			stream.CloseSend()
+		}
+		if err != nil {
+			return fmt.Errorf("reflection v1: %v", err)
+		}
+		alpha, err := reflectionv1alpha.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+		if err == nil {
+			err = alpha.Send(&reflectionv1alpha.ServerReflectionRequest{MessageRequest: &reflectionv1alpha.ServerReflectionRequest_ListServices{}})
+		}
+		if err == nil {
+			_, err = alpha.Recv()
+			alpha.CloseSend()
+		}
+		if err != nil {
+			return fmt.Errorf("reflection v1alpha: %v", err)
+		}
+		return nil
+	}
+	expect := func(cfg proxy.Config, want map[string]string) error {
+		mu.Lock()
+		clear(took)
+		mu.Unlock()
+		px, lis, err := h.startProxy(cfg, proxy.WithHooks(hooks))
+		if err != nil {
+			return err
+		}
+		defer px.Shutdown(ctx)
+		conn, err := dialBufconn(lis)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if err := calls(conn); err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for method, route := range want {
+			if took[method] != route {
+				return fmt.Errorf("%s took route %q, want %s", method, took[method], route)
+			}
+		}
+		return nil
+	}
+
+	cfg := h.config()
+	cfg.Routes = []proxy.RouteConfig{{Name: "everything", Match: "/*", Mode: "pass-thru"}}
+	if err := expect(cfg, map[string]string{health: "builtin-pass-thru", v1: "builtin-pass-thru", v1alpha: "builtin-pass-thru"}); err != nil {
+		return fmt.Errorf("under a \"/*\" route: %v", err)
+	}
+	cfg.Routes = append(cfg.Routes, proxy.RouteConfig{Name: "health-explicit", Match: "/grpc.health.v1.Health/*", Mode: "pass-thru"})
+	if err := expect(cfg, map[string]string{health: "health-explicit", v1: "builtin-pass-thru", v1alpha: "builtin-pass-thru"}); err != nil {
+		return fmt.Errorf("with an explicit health route: %v", err)
+	}
+	off := false
+	cfg.BuiltinPassthrough = &off
+	if err := expect(cfg, map[string]string{health: "health-explicit", v1: "everything", v1alpha: "everything"}); err != nil {
+		return fmt.Errorf("builtin_passthrough: false: %v", err)
+	}
+	return nil
+}
+
+func checkPerimeter(ctx context.Context, h *harness) error {
+	// the address checks need a TCP peer, and the counters an admin listener
+	var addrs [2]string
+	for i := range addrs {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+		addrs[i] = lis.Addr().String()
+		lis.Close()
+	}
+	proxyAddr, adminAddr := addrs[0], addrs[1]
+	sum := sha256.Sum256([]byte("s3cret"))
+	cfg := h.config()
+	cfg.Admin.ListenAddress = adminAddr
+	cfg.Security = proxy.SecurityConfig{
+		RequireMetadataToken: &proxy.MetadataTokenConfig{Key: "x-api-key", SHA256: []string{strings.Repeat("00", 32), hex.EncodeToString(sum[:])}},
+		AllowedCIDRs:         []string{"127.0.0.0/8", "::1/128"},
+	}
+	public := false
+	cfg.Routes = []proxy.RouteConfig{
+		{Name: "public", Match: "/echo.EchoService/BidirectionalStreamingEcho", Mode: "pass-thru", Security: &proxy.RouteSecurityConfig{RequireToken: &public}},
+		{Name: "lan", Match: "/echo.SecureService/InspectOuter", Mode: "pass-thru", Security: &proxy.RouteSecurityConfig{AllowedCIDRs: []string{"10.0.0.0/8"}}},
+		{Name: "private", Match: "/echo.EchoService/*", Mode: "pass-thru"},
+	}
+	px, err := proxy.NewProxy(cfg, proxy.WithBackendDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return h.backendLis.DialContext(ctx)
+	}))
+	if err != nil {
+		return fmt.Errorf("NewProxy: %w", err)
+	}
+	defer px.Shutdown(ctx)
+	lis, err := net.Listen("tcp", proxyAddr)
+	if err != nil {
+		return err
+	}
+	go px.Serve(lis)
+	conn, err := grpc.NewClient(proxyAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := echo.NewEchoServiceClient(conn)
+	withToken := func(token string) context.Context {
+		return metadata.AppendToOutgoingContext(ctx, "x-api-key", token)
+	}
+
+	stream, err := client.BidirectionalStreamingEcho(ctx)
+	if err == nil {
+		stream.Send(&echo.EchoRequest{Message: "perimeter-public"})
+		stream.CloseSend()
+		_, err = stream.Recv()
+	}
+	if err != nil {
+		return fmt.Errorf("public route without a token: %v", err)
+	}
+	if _, err := client.UnaryEcho(withToken("s3cret"), &echo.EchoRequest{Message: "perimeter-private"}); err != nil {
+		return fmt.Errorf("private route with the token: %v", err)
+	}
+
+	refused := []struct {
+		name   string
+		call   func() error
+		code   codes.Code
+		reason string
+	}{
+		{"no token", func() error {
+			_, err := client.UnaryEcho(ctx, &echo.EchoRequest{Message: "perimeter-refused"})
+			return err
+		}, codes.Unauthenticated, "TOKEN_MISSING"},
+		{"wrong token", func() error {
+			_, err := client.UnaryEcho(withToken("s3cret2"), &echo.EchoRequest{Message: "perimeter-refused"})
+			return err
+		}, codes.Unauthenticated, "TOKEN_INVALID"},
+		{"outside the route's cidrs", func() error {
+			_, err := echo.NewSecureServiceClient(conn).InspectOuter(withToken("s3cret"), &echo.SecureEnvelope{})
+			return err
+		}, codes.PermissionDenied, "ADDRESS_NOT_ALLOWED"},
+	}
+	for _, r := range refused {
+		err := r.call()
+		if status.Code(err) != r.code {
+			return fmt.Errorf("%s: %v, want %s", r.name, err, r.code)
+		}
+		if info := errorInfo(err); info == nil || info.Reason != r.reason {
+			return fmt.Errorf("%s: ErrorInfo %v, want reason %s", r.name, info, r.reason)
+		}
+	}
+
+	resp, err := http.Get("http://" + adminAddr + "/metrics")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	for _, series := range []string{
+		`proxy_perimeter_rejections_total{reason="TOKEN_MISSING",route="private"} 1`,
+		`proxy_perimeter_rejections_total{reason="TOKEN_INVALID",route="private"} 1`,
+		`proxy_perimeter_rejections_total{reason="ADDRESS_NOT_ALLOWED",route="lan"} 1`,
+	} {
+		if !strings.Contains(string(body), series+"\n") {
+			return fmt.Errorf("/metrics has no %s", series)
+		}
+	}
+	return nil
+}
+
+// chainCA issues the TLS certificates of checkTrustedUpstreams
+type chainCA struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newChainCA(dir string) (*chainCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "chain-ca"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	ca := &chainCA{dir: dir, key: key, pool: x509.NewCertPool()}
+	if ca.cert, err = x509.ParseCertificate(der); err != nil {
+		return nil, err
+	}
+	ca.pool.AddCert(ca.cert)
+	return ca, os.WriteFile(filepath.Join(dir, "chain-ca.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+}
+
+// issue writes name.crt and name.key for a certificate naming dns as its
+// host, or uri as its URI SAN, and returns it
+func (ca *chainCA) issue(name, dns, uri string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if dns != "" {
+		tmpl.DNSNames = []string{dns}
+	}
+	if uri != "" {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		tmpl.URIs = []*url.URL{u}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(ca.dir, name+".crt"), certPEM, 0o600); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(filepath.Join(ca.dir, name+".key"), keyPEM, 0o600); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// tlsConfig is a client's TLS config for a proxy serving as host
+func (ca *chainCA) tlsConfig(host string, certs ...tls.Certificate) *tls.Config {
+	return &tls.Config{RootCAs: ca.pool, ServerName: host, Certificates: certs}
+}
+
+// checkTrustedUpstreams chains two proxies over mTLS. The inner one admits
+// only connections presenting a certificate trusted_upstreams.sans lists,
+// so a client dialling it directly is refused, with or without a
+// certificate of its own. Through the outer proxy, the call reaches the
+// backend as the original client's identity, which the outer proxy signed,
+// and not as the outer proxy's.
+func checkTrustedUpstreams(ctx context.Context, h *harness) error {
+	dir := filepath.Join(h.dir, "chain")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	ca, err := newChainCA(dir)
+	if err != nil {
+		return err
+	}
+	certs := map[string]tls.Certificate{}
+	for _, c := range []struct{ name, dns, uri string }{
+		{"outer", "outer.test", ""},
+		{"inner", "inner.test", ""},
+		{"outer-hop", "", "spiffe://test/outer-proxy"},
+		{"client", "", "spiffe://test/client"},
+	} {
+		if certs[c.name], err = ca.issue(c.name, c.dns, c.uri); err != nil {
+			return err
+		}
+	}
+	if err := writeCert(filepath.Join(dir, "outer-signer.crt"), h.key); err != nil {
+		return err
+	}
+	file := func(name string) string { return filepath.Join(dir, name) }
+
+	var mu sync.Mutex
+	var identities []string
+	backendSrv := grpc.NewServer(grpc.UnaryInterceptor(
+		func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			md, _ := metadata.FromIncomingContext(ctx)
+			mu.Lock()
+			identities = append(identities, md.Get("x-proxy-client-identity")...)
+			mu.Unlock()
+			return handler(ctx, req)
+		}))
+	echo.RegisterEchoServiceServer(backendSrv, &echoBackend{})
+	backendLis := bufconn.Listen(bufSize)
+	go backendSrv.Serve(backendLis)
+	defer backendSrv.Stop()
+
+	innerCfg := h.config()
+	innerCfg.Server.TLS = &proxy.TLSConfig{CertFile: file("inner.crt"), KeyFile: file("inner.key"), ClientCAFile: file("chain-ca.crt")}
+	innerCfg.Server.TrustedUpstreams = proxy.TrustedUpstreamsConfig{SANs: []string{"spiffe://test/outer-*"}}
+	innerCfg.Identity = proxy.IdentityConfig{Propagate: true, UpstreamTrustStore: file("outer-signer.crt")}
+	inner, innerLis, err := h.startProxy(innerCfg, proxy.WithBackendDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return backendLis.DialContext(ctx)
+	}))
+	if err != nil {
+		return err
+	}
+	defer inner.Shutdown(ctx)
+
+	outerCfg := h.config()
+	outerCfg.Server.TLS = &proxy.TLSConfig{CertFile: file("outer.crt"), KeyFile: file("outer.key"), ClientCAFile: file("chain-ca.crt")}
+	outerCfg.Backend.TLS = &proxy.BackendTLSConfig{CAFile: file("chain-ca.crt"), CertFile: file("outer-hop.crt"), KeyFile: file("outer-hop.key"), ServerName: "inner.test"}
+	outerCfg.Identity = proxy.IdentityConfig{Propagate: true}
+	outer, outerLis, err := h.startProxy(outerCfg, proxy.WithBackendDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return innerLis.DialContext(ctx)
+	}))
+	if err != nil {
+		return err
+	}
+	defer outer.Shutdown(ctx)
+
+	call := func(lis *bufconn.Listener, cfg *tls.Config) error {
+		conn, err := grpc.NewClient("passthrough:///bufnet",
+			grpc.WithTransportCredentials(credentials.NewTLS(cfg)),
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return lis.DialContext(ctx)
+			}))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		callCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		_, err = echo.NewEchoServiceClient(conn).UnaryEcho(callCtx, &echo.EchoRequest{Message: "chain"})
+		return err
+	}
+
+	if err := call(outerLis, ca.tlsConfig("outer.test", certs["client"])); err != nil {
+		return fmt.Errorf("call through both proxies: %v", err)
+	}
+	mu.Lock()
+	got := identities
+	identities = nil
+	mu.Unlock()
+	if len(got) != 1 || got[0] != "spiffe://test/client" {
+		return fmt.Errorf("backend saw identity %q through the chain, want the original client's", got)
+	}
+
+	for name, cfg := range map[string]*tls.Config{
+		"with a client certificate":    ca.tlsConfig("inner.test", certs["client"]),
+		"without a client certificate": ca.tlsConfig("inner.test"),
+	} {
+		err := call(innerLis, cfg)
+		if status.Code(err) != codes.Unavailable {
+			return fmt.Errorf("direct client %s: got %v, want the connection refused", name, err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(identities) != 0 {
+		return fmt.Errorf("a direct client reached the backend as %q", identities)
+	}
+	return nil
+}
+
+// checkTLSResumption connects to a TLS listener with ticket key rotation
+// twice with one client session cache. The second connection must resume the
+// first one's session, and the proxy must count the handshake as resumed.
+func checkTLSResumption(ctx context.Context, h *harness) error {
+	dir := filepath.Join(h.dir, "resume")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	ca, err := newChainCA(dir)
+	if err != nil {
+		return err
+	}
+	if _, err := ca.issue("resume", "resume.test", ""); err != nil {
+		return err
+	}
+	addr, err := freeAddr()
+	if err != nil {
+		return err
+	}
+	cfg := h.config()
+	cfg.Admin.ListenAddress = addr
+	cfg.Server.TLS = &proxy.TLSConfig{
+		CertFile:          filepath.Join(dir, "resume.crt"),
+		KeyFile:           filepath.Join(dir, "resume.key"),
+		TicketKeyRotation: "1h",
+	}
+	px, lis, err := h.startProxy(cfg)
+	if err != nil {
+		return err
+	}
+	defer px.Shutdown(ctx)
+
+	resumed := func() (float64, error) {
+		values, err := scrapeMetrics(addr)
+		var n float64
+		for series, v := range values {
+			if strings.HasPrefix(series, "proxy_tls_handshakes_total{") && strings.Contains(series, `result="resumed"`) {
+				n += v
+			}
+		}
+		return n, err
+	}
+	before, err := resumed()
+	if err != nil {
+		return err
+	}
+
+	tlsCfg := ca.tlsConfig("resume.test")
+	tlsCfg.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	connect := func() (bool, error) {
+		conn, err := grpc.NewClient("passthrough:///bufnet",
+			grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg)),
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return lis.DialContext(ctx)
+			}))
+		if err != nil {
+			return false, err
+		}
+		defer conn.Close()
+		var p peer.Peer
+		if _, err := echo.NewEchoServiceClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: "resume"}, grpc.Peer(&p)); err != nil {
+			return false, err
+		}
+		info, ok := p.AuthInfo.(credentials.TLSInfo)
+		return ok && info.State.DidResume, nil
+	}
+	if did, err := connect(); err != nil || did {
+		return fmt.Errorf("first connection: resumed %v, %v", did, err)
+	}
+	if did, err := connect(); err != nil || !did {
+		return fmt.Errorf("second connection: resumed %v, %v; want the first one's session resumed", did, err)
+	}
+	after, err := resumed()
+	if err != nil {
+		return err
+	}
+	if after != before+1 {
+		return fmt.Errorf("proxy_tls_handshakes_total{result=\"resumed\"} went from %v to %v, want one more", before, after)
+	}
+	return nil
+}
+
+// checkRouteOverrides flips a signing route to pass-thru and every route to
+// reject through the admin API, lets the global override expire, restores
+// the route, and reads each change back from /routes and the audit log
+func checkRouteOverrides(ctx context.Context, h *harness) error {
+	addr, err := freeAddr()
+	if err != nil {
+		return err
+	}
+	auditPath := filepath.Join(h.dir, "override-audit.log")
+	cfg := h.config()
+	cfg.Admin.ListenAddress = addr
+	tokenSum := func(token string) string {
+		sum := sha256.Sum256([]byte(token))
+		return hex.EncodeToString(sum[:])
+	}
+	cfg.Admin.RouteOverrides = proxy.RouteOverridesConfig{Enabled: true, Operators: map[string]string{
+		"alice": tokenSum("alice-token"),
+		"bob":   tokenSum("bob-token"),
+	}}
+	cfg.Audit = proxy.AuditConfig{Path: auditPath}
+	cfg.Routes = []proxy.RouteConfig{
+		{Name: "secure", Match: "/echo.SecureService/SecureEcho", Mode: "inspect-verify-sign", Envelope: secureEnvelope},
+		{Name: "legacy", Match: "/echo.EchoService/UnaryEcho", Mode: "pass-thru"},
+	}
+	px, lis, err := h.startProxy(cfg)
+	if err != nil {
+		return err
+	}
+	defer px.Shutdown(ctx)
+	conn, err := dialBufconn(lis)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	secure, legacy := echo.NewSecureServiceClient(conn), echo.NewEchoServiceClient(conn)
+
+	post := func(contentType, token, body string) (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodPost, "http://"+addr+"/routes/override", strings.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", contentType)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return http.DefaultClient.Do(req)
+	}
+	overrideAs := func(contentType, token, body string) (int, []byte, error) {
+		resp, err := post(contentType, token, body)
+		for i := 0; err != nil && i < 20; i++ {
+			time.Sleep(50 * time.Millisecond)
+			resp, err = post(contentType, token, body)
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		return resp.StatusCode, b, err
+	}
+	override := func(body string) (int, []byte, error) {
+		return overrideAs("application/json", "alice-token", body)
+	}
+	set := func(token, body string) error {
+		code, b, err := overrideAs("application/json", token, body)
+		if err == nil && code != http.StatusOK {
+			err = fmt.Errorf("POST %s: %d %s", body, code, b)
+		}
+		return err
+	}
+	signed := func() (bool, error) {
+		if _, err := secure.SecureEcho(ctx, &echo.SecureEnvelope{TypeUrl: "type.googleapis.com/echo.EchoRequest", Payload: []byte("override")}); err != nil {
+			return false, err
+		}
+		env := &echo.SecureEnvelope{}
+		if err := proto.Unmarshal(h.backend.lastRequest(), env); err != nil {
+			return false, err
+		}
+		return len(env.GetProxySignature()) > 0, nil
+	}
+
+	if ok, err := signed(); err != nil || !ok {
+		return fmt.Errorf("before any override: signed %v, %v", ok, err)
+	}
+	// Only an operator's token, on a JSON request, changes anything
+	refused := []struct {
+		contentType, token string
+		want               int
+	}{
+		{"application/json", "", http.StatusUnauthorized},
+		{"application/json", "mallory-token", http.StatusUnauthorized},
+		{"text/plain", "alice-token", http.StatusUnsupportedMediaType},
+		{"application/x-www-form-urlencoded", "alice-token", http.StatusUnsupportedMediaType},
+	}
+	for _, r := range refused {
+		code, _, err := overrideAs(r.contentType, r.token, `{"route": "secure", "action": "force-reject"}`)
+		if err != nil || code != r.want {
+			return fmt.Errorf("POST as %q with %q answered %d, %v; want %d", r.token, r.contentType, code, err, r.want)
+		}
+	}
+	if ok, err := signed(); err != nil || !ok {
+		return fmt.Errorf("after refused overrides: signed %v, %v", ok, err)
+	}
+	// The actor is the token's operator, whatever the body claims
+	if err := set("alice-token", `{"route": "secure", "action": "force-pass-thru", "by": "mallory", "reason": "INC-42"}`); err != nil {
+		return err
+	}
+	if ok, err := signed(); err != nil || ok {
+		return fmt.Errorf("forced to pass-thru: signed %v, %v", ok, err)
+	}
+	resp, err := http.Get("http://" + addr + "/routes")
+	if err != nil {
+		return err
+	}
+	var routes []struct {
+		Name     string
+		Override *struct{ Action, By string }
+	}
+	err = json.NewDecoder(resp.Body).Decode(&routes)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	for _, r := range routes {
+		if r.Name == "secure" && (r.Override == nil || r.Override.Action != "force-pass-thru" || r.Override.By != "alice") {
+			return fmt.Errorf("/routes shows secure with override %+v", r.Override)
+		}
+	}
+
+	// The global switch rejects every other route until it expires
+	if err := set("bob-token", `{"route": "*", "action": "force-reject", "ttl": "500ms"}`); err != nil {
+		return err
+	}
+	_, err = legacy.UnaryEcho(ctx, &echo.EchoRequest{Message: "rejected"})
+	if info := errorInfo(err); status.Code(err) != codes.Unavailable || info == nil || info.GetReason() != "ROUTE_DISABLED" || info.GetMetadata()["by"] != "bob" {
+		return fmt.Errorf("under the global force-reject: %v", err)
+	}
+	if ok, err := signed(); err != nil || ok {
+		return fmt.Errorf("secure's own override should win over the global one: signed %v, %v", ok, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err = legacy.UnaryEcho(ctx, &echo.EchoRequest{Message: "expired"})
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("after the global override's ttl: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err := set("alice-token", `{"route": "secure", "action": "restore-config"}`); err != nil {
+		return err
+	}
+	if ok, err := signed(); err != nil || !ok {
+		return fmt.Errorf("restored: signed %v, %v", ok, err)
+	}
+	for _, body := range []string{`{"route": "nobody", "action": "force-reject"}`, `{"route": "secure", "action": "off"}`, `{"route": "secure", "action": "force-reject", "ttl": "soon"}`} {
+		if code, _, err := override(body); err != nil || code != http.StatusBadRequest {
+			return fmt.Errorf("POST %s answered %d, %v; want 400", body, code, err)
+		}
+	}
+
+	if err := px.Shutdown(ctx); err != nil {
+		return err
+	}
+	b, err := os.ReadFile(auditPath)
+	if err != nil {
+		return err
+	}
+	var got []string
+	for _, line := range bytes.Split(bytes.TrimSpace(b), []byte("\n")) {
+		var rec struct{ Op, Route, Decision, Actor string }
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("audit line %q: %v", line, err)
+		}
+		if rec.Op == "override" {
+			got = append(got, rec.Route+" "+rec.Decision+" by "+rec.Actor)
+		}
+	}
+	want := []string{"secure force-pass-thru by alice", "* force-reject by bob", "* restore-config by expiry", "secure restore-config by alice"}
+	if strings.Join(got, "; ") != strings.Join(want, "; ") {
+		return fmt.Errorf("audited overrides %q, want %q", got, want)
+	}
+	return nil
+}
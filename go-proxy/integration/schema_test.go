@@ -0,0 +1,1015 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anthony/grpc-proxy/api/echo"
+	"github.com/anthony/grpc-proxy/go-proxy/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	reflectionv1 "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"gopkg.in/yaml.v3"
+)
+
+// --- Schema and Config ---
+
+// decodeCase is a crafted SecureEcho request: unknown fields appended to the
+// envelope and the inner EchoRequest payload
+type decodeCase struct {
+	name    string
+	unknown []byte
+	payload []byte
+	limit   string // the decode limit it breaks; empty when it must pass
+}
+
+// decodeCorpus holds the shapes that made dynamic unmarshal blow up, and
+// neighbours of them that must still be forwarded
+var decodeCorpus = []decodeCase{
+	{name: "nested groups", unknown: nestedGroups(15, 1000), limit: "max_depth"},
+	{name: "groups at the depth limit", unknown: nestedGroups(15, 100)},
+	{name: "unknown field flood", unknown: bytes.Repeat([]byte{0x78, 0x00}, 100001), limit: "max_fields"},
+	{name: "many unknown fields", unknown: bytes.Repeat([]byte{0x78, 0x00}, 1000)},
+	{name: "oversized envelope", payload: make([]byte, 1<<20), limit: "max_message_bytes"},
+	{name: "nested groups in the inner payload", payload: nestedGroups(2, 5000), limit: "max_depth"},
+}
+
+// nestedGroups opens depth groups numbered num and closes them again
+func nestedGroups(num protowire.Number, depth int) []byte {
+	var b []byte
+	for i := 0; i < depth; i++ {
+		b = protowire.AppendTag(b, num, protowire.StartGroupType)
+	}
+	for i := 0; i < depth; i++ {
+		b = protowire.AppendTag(b, num, protowire.EndGroupType)
+	}
+	return b
+}
+
+func checkDecodeLimits(ctx context.Context, h *harness) error {
+	for _, c := range decodeCorpus {
+		req := &echo.SecureEnvelope{TypeUrl: "type.googleapis.com/echo.EchoRequest", Payload: c.payload}
+		req.ProtoReflect().SetUnknown(c.unknown)
+		_, err := echo.NewSecureServiceClient(h.proxied).SecureEcho(ctx, req)
+		if c.limit == "" {
+			if err != nil {
+				return fmt.Errorf("%s: %v", c.name, err)
+			}
+			continue
+		}
+		if status.Code(err) != codes.InvalidArgument {
+			return fmt.Errorf("%s returned %v, want InvalidArgument", c.name, err)
+		}
+		if info := errorInfo(err); info.GetReason() != "DECODE_LIMIT_EXCEEDED" || info.GetMetadata()["limit"] != c.limit {
+			return fmt.Errorf("%s carries ErrorInfo %v, want DECODE_LIMIT_EXCEEDED for %s", c.name, info, c.limit)
+		}
+	}
+	return nil
+}
+
+// checkPreflight runs preflight against the backend's health service: a
+// backend that is not serving fails Serve before it accepts a call, naming
+// the backend, and /readyz says why; a serving one lets calls through
+func checkPreflight(ctx context.Context, h *harness) error {
+	addr, err := freeAddr()
+	if err != nil {
+		return err
+	}
+	cfg := h.config()
+	cfg.Admin.ListenAddress = addr
+	readyz := func() (int, string, error) {
+		resp, err := http.Get("http://" + addr + "/readyz")
+		for tries := 0; err != nil && tries < 50; tries++ {
+			time.Sleep(10 * time.Millisecond) // the admin listener starts in the background
+			resp, err = http.Get("http://" + addr + "/readyz")
+		}
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body), err
+	}
+
+	h.health.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	defer h.health.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	px, err := h.newProxy(cfg, proxy.WithPreflight(2*time.Second))
+	if err != nil {
+		return err
+	}
+	err = px.Serve(bufconn.Listen(bufSize))
+	var failed *proxy.DiagnosticsError
+	if !errors.As(err, &failed) || !strings.Contains(err.Error(), "PREFLIGHT_BACKEND") || !strings.Contains(err.Error(), "NOT_SERVING") {
+		px.Shutdown(ctx)
+		return fmt.Errorf("preflight against a NOT_SERVING backend: Serve returned %v, want PREFLIGHT_BACKEND diagnostics", err)
+	}
+	code, body, err := readyz()
+	px.Shutdown(ctx)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, "preflight") {
+		return fmt.Errorf("/readyz after a failed preflight answered %d %q, want 503 naming preflight", code, body)
+	}
+
+	h.health.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	if addr, err = freeAddr(); err != nil {
+		return err
+	}
+	cfg.Admin.ListenAddress = addr
+	px, lis, err := h.startProxy(cfg, proxy.WithPreflight(2*time.Second))
+	if err != nil {
+		return err
+	}
+	defer px.Shutdown(ctx)
+	conn, err := dialBufconn(lis)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := echo.NewEchoServiceClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: "after preflight"}); err != nil {
+		return fmt.Errorf("call after preflight: %v", err)
+	}
+	if code, body, err := readyz(); err != nil || code != http.StatusOK {
+		return fmt.Errorf("/readyz after preflight answered %d %q (%v), want 200", code, body, err)
+	}
+	return nil
+}
+
+func checkRemoteSchema(ctx context.Context, h *harness) error {
+	full, err := os.ReadFile(filepath.Join(h.dir, "echo.pb"))
+	if err != nil {
+		return err
+	}
+	// The registry first serves the set without SecureService
+	file := protodesc.ToFileDescriptorProto(echo.File_api_echo_echo_proto)
+	for i, svc := range file.Service {
+		if svc.GetName() == "EchoService" {
+			file.Service = file.Service[i : i+1]
+			break
+		}
+	}
+	partial, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}})
+	if err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	served, down, notModified := partial, false, 0
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer registry-token" {
+			http.Error(w, "no token", http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		etag := fmt.Sprintf(`"%x"`, sha256.Sum256(served))
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write(served)
+	}))
+	defer srv.Close()
+	caFile, tokenFile := filepath.Join(h.dir, "registry-ca.pem"), filepath.Join(h.dir, "registry-token")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(tokenFile, []byte("registry-token\n"), 0o600); err != nil {
+		return err
+	}
+	remote := proxy.RemoteSchemaConfig{URL: srv.URL + "/echo.pb", BearerTokenFile: tokenFile, CAFile: caFile,
+		CachePath: filepath.Join(h.dir, "schema-cache.pb"), RefreshInterval: "20ms"}
+	config := func(remote proxy.RemoteSchemaConfig) proxy.Config {
+		cfg := h.config()
+		cfg.Schema = proxy.SchemaConfig{Method: "url", Remote: remote}
+		cfg.Routes = []proxy.RouteConfig{{Name: "remote", Match: "/echo.SecureService/SecureEcho", Mode: "inspect-verify-sign", Envelope: secureEnvelope}}
+		return cfg
+	}
+
+	px, lis, err := h.startProxy(config(remote))
+	if err != nil {
+		return err
+	}
+	defer px.Shutdown(ctx)
+	conn, err := dialBufconn(lis)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// signed reports whether the proxy inspected and signed a SecureEcho call
+	signed := func() (bool, error) {
+		req := &echo.SecureEnvelope{TypeUrl: "type.googleapis.com/echo.EchoRequest", Payload: []byte("remote schema")}
+		if _, err := echo.NewSecureServiceClient(conn).SecureEcho(ctx, req); err != nil {
+			return false, err
+		}
+		var received echo.SecureEnvelope
+		if err := proto.Unmarshal(h.backend.lastRequest(), &received); err != nil {
+			return false, err
+		}
+		return h.verify(received.GetPayload(), received.GetProxySignature()) == nil, nil
+	}
+	if _, err := signed(); status.Code(err) != codes.InvalidArgument {
+		return fmt.Errorf("SecureEcho without its descriptor: %v, want rejected as undecodable", err)
+	}
+	for tries := 0; ; tries++ {
+		mu.Lock()
+		n := notModified
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if tries == 100 {
+			return errors.New("no refresh sent If-None-Match with the served ETag")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	served = full
+	mu.Unlock()
+	for tries := 0; ; tries++ {
+		ok, err := signed()
+		if err != nil && status.Code(err) != codes.InvalidArgument {
+			return err
+		}
+		if ok {
+			break
+		}
+		if tries == 100 {
+			return fmt.Errorf("SecureEcho is still not signed after the registry served its descriptor (%v)", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cached, err := os.ReadFile(remote.CachePath); err != nil || !bytes.Equal(cached, full) {
+		return fmt.Errorf("the cache does not hold the refreshed set (%v)", err)
+	}
+
+	// A registry that is down is stood in for by the cache, or fails startup
+	mu.Lock()
+	down = true
+	mu.Unlock()
+	var diag proxy.Diagnostics
+	cachedPx, err := h.newProxy(config(remote), proxy.WithDiagnostics(&diag))
+	if err != nil {
+		return fmt.Errorf("starting from the cache: %v", err)
+	}
+	cachedPx.Shutdown(ctx)
+	if !strings.Contains(fmt.Sprint(diag.Items), "SCHEMA_URL_CACHED") {
+		return fmt.Errorf("starting from the cache reported %v, want SCHEMA_URL_CACHED", diag.Items)
+	}
+	uncached := remote
+	uncached.CachePath = ""
+	mu.Lock()
+	down = false
+	mu.Unlock()
+
+	badDigest := remote
+	badDigest.SHA256 = strings.Repeat("0", 64)
+	plainHTTP := remote
+	plainHTTP.URL = strings.Replace(srv.URL, "https://", "http://", 1)
+	for _, c := range []struct {
+		name   string
+		remote proxy.RemoteSchemaConfig
+		down   bool
+		want   string
+	}{
+		{"a registry that is down and no cache", uncached, true, "SCHEMA_URL_FETCH"},
+		{"a checksum mismatch", badDigest, false, "checksum mismatch"},
+		{"an http:// URL", plainHTTP, false, "SCHEMA_URL"},
+	} {
+		mu.Lock()
+		down = c.down
+		mu.Unlock()
+		px, err := h.newProxy(config(c.remote))
+		if err == nil {
+			px.Shutdown(ctx)
+		}
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			return fmt.Errorf("%s: NewProxy returned %v, want %s", c.name, err, c.want)
+		}
+	}
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	return nil
+}
+
+func checkDecodeFailures(ctx context.Context, h *harness) error {
+	addr, err := freeAddr()
+	if err != nil {
+		return err
+	}
+	cfg := h.config()
+	cfg.Admin.ListenAddress = addr
+	cfg.Routes = []proxy.RouteConfig{
+		{Name: "enforcing", Match: "/echo.SecureService/SecureEcho", Mode: "inspect-verify-sign", Envelope: secureEnvelope},
+		{Name: "observing", Match: "/echo.SecureService/InspectOuter", Mode: "inspect-outer", Envelope: secureEnvelope},
+	}
+	px, lis, err := h.startProxy(cfg)
+	if err != nil {
+		return err
+	}
+	defer px.Shutdown(ctx)
+	conn, err := dialBufconn(lis)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Field 1 with wire type 7, which does not exist
+	garbage := []byte{0x0f, 0xde, 0xad, 0xbe, 0xef}
+	var out []byte
+	err = conn.Invoke(ctx, "/echo.SecureService/SecureEcho", &garbage, &out, grpc.ForceCodec(rawCodec{}))
+	if info := errorInfo(err); status.Code(err) != codes.InvalidArgument || info.GetReason() != "ENVELOPE_UNDECODABLE" {
+		return fmt.Errorf("undecodable request on an inspect-verify-sign route: %v (ErrorInfo %v), want ENVELOPE_UNDECODABLE", err, info)
+	}
+	// The backend fails to decode it too, but only after receiving it intact
+	conn.Invoke(ctx, "/echo.SecureService/InspectOuter", &garbage, &out, grpc.ForceCodec(rawCodec{}))
+	if got := h.backend.lastRequest(); !bytes.Equal(got, garbage) {
+		return fmt.Errorf("inspect-outer forwarded the undecodable request as %x, want %x", got, garbage)
+	}
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	for _, series := range []string{
+		`proxy_decode_failures_total{direction="client_to_backend",policy="reject",reason="unmarshal_error",route="enforcing",shadow="false"}`,
+		`proxy_decode_failures_total{direction="client_to_backend",policy="pass",reason="unmarshal_error",route="observing",shadow="false"}`,
+	} {
+		if !strings.Contains(string(body), series) {
+			return fmt.Errorf("/metrics has no %s", series)
+		}
+	}
+
+	cfg.Admin.ListenAddress = ""
+	cfg.Routes[1].OnDecodeFailure = "ignore"
+	if px, err := h.newProxy(cfg); err == nil || !strings.Contains(err.Error(), "ROUTE_DECODE_FAILURE") {
+		if err == nil {
+			px.Shutdown(ctx)
+		}
+		return fmt.Errorf("on_decode_failure: ignore gave %v, want ROUTE_DECODE_FAILURE", err)
+	}
+	return nil
+}
+
+// checkSchemaBoth starts a proxy with schema.method both on a pb that lags
+// the backend: it lacks SecureService and gives EchoRequest a renamed field 1
+// and a new field 7. The reflected SecureService methods must be reported and
+// still proxied with their descriptors, EchoRequest reported as conflicting
+// at fields 1 and 7, and pb methods keep working.
+func checkSchemaBoth(ctx context.Context, h *harness) error {
+	file := protodesc.ToFileDescriptorProto(echo.File_api_echo_echo_proto)
+	for i, svc := range file.Service {
+		if svc.GetName() == "EchoService" {
+			file.Service = file.Service[i : i+1]
+			break
+		}
+	}
+	for _, msg := range file.MessageType {
+		if msg.GetName() == "EchoRequest" {
+			msg.Field[0].Name = proto.String("text")
+			msg.Field[0].JsonName = proto.String("text")
+			msg.Field = append(msg.Field, &descriptorpb.FieldDescriptorProto{
+				Name: proto.String("trace"), JsonName: proto.String("trace"), Number: proto.Int32(7),
+				Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			})
+		}
+	}
+	b, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}})
+	if err != nil {
+		return err
+	}
+	pbPath := filepath.Join(h.dir, "lagging.pb")
+	if err := os.WriteFile(pbPath, b, 0o600); err != nil {
+		return err
+	}
+
+	cfg := h.config()
+	cfg.Schema = proxy.SchemaConfig{Method: "both", PBPath: pbPath, Required: true}
+	cfg.Routes = []proxy.RouteConfig{
+		{Name: "echo", Match: "/echo.EchoService/*", Mode: "pass-thru"},
+		{Name: "outer", Match: "/echo.SecureService/InspectOuter", Mode: "inspect-outer", OnDecodeFailure: "reject", Envelope: proxy.EnvelopeConfig{
+			PayloadField: "payload", TypeURLField: "type_url",
+		}},
+	}
+	var diag proxy.Diagnostics
+	px, err := h.newProxy(cfg, proxy.WithDiagnostics(&diag))
+	if err != nil {
+		return err
+	}
+	lis := bufconn.Listen(bufSize)
+	go px.Serve(lis)
+	defer px.Shutdown(ctx)
+
+	reported := fmt.Sprint(diag.Items)
+	for _, want := range []string{
+		"/echo.SecureService/InspectOuter is served by the backend but missing from the pb",
+		"message echo.EchoRequest differs between the pb and reflection at field numbers 1, 7",
+	} {
+		if !strings.Contains(reported, want) {
+			return fmt.Errorf("startup reported %v, want %q", diag.Items, want)
+		}
+	}
+	if strings.Contains(reported, "echo.SecureEnvelope differs") {
+		return fmt.Errorf("startup reported a conflict on the unchanged SecureEnvelope: %v", diag.Items)
+	}
+
+	conn, err := dialBufconn(lis)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := echo.NewEchoServiceClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: "pb method"}); err != nil {
+		return fmt.Errorf("pb method: %v", err)
+	}
+	// Rejected as undecodable if reflection had not supplied the method
+	env := &echo.SecureEnvelope{TypeUrl: "type.googleapis.com/echo.EchoRequest", Payload: []byte("inner")}
+	if _, err := echo.NewSecureServiceClient(conn).InspectOuter(ctx, env); err != nil {
+		return fmt.Errorf("reflected method: %v", err)
+	}
+	return nil
+}
+
+// checkFieldTypes points envelope fields at fields of the wrong scalar type.
+// Without allow_type_coercion that must fail startup, naming the option; with
+// it, a signature written into the string field type_url must arrive as the
+// base64 of a valid signature, and a request whose type_url is not base64 must
+// be rejected as undecodable.
+func checkFieldTypes(ctx context.Context, h *harness) error {
+	cfg := h.config()
+	env := proxy.EnvelopeConfig{PayloadField: "payload", ProxySigField: "type_url"}
+	cfg.Routes = []proxy.RouteConfig{{Name: "legacy", Match: "/echo.SecureService/SecureEcho", Mode: "inspect-verify-sign", Envelope: env,
+		Request: &proxy.DirectionCryptoConfig{Verify: "none"}}}
+	if px, err := h.newProxy(cfg); err == nil || !strings.Contains(err.Error(), "ROUTE_ENVELOPE") || !strings.Contains(err.Error(), "allow_type_coercion") {
+		if err == nil {
+			px.Shutdown(ctx)
+		}
+		return fmt.Errorf("proxy_sig_field on a string field gave %v, want ROUTE_ENVELOPE suggesting allow_type_coercion", err)
+	}
+
+	cfg.Routes[0].Envelope.AllowTypeCoercion = true
+	px, lis, err := h.startProxy(cfg)
+	if err != nil {
+		return err
+	}
+	defer px.Shutdown(ctx)
+	conn, err := dialBufconn(lis)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := echo.NewSecureServiceClient(conn)
+
+	if _, err := client.SecureEcho(ctx, &echo.SecureEnvelope{Payload: []byte("legacy")}); err != nil {
+		return err
+	}
+	var received echo.SecureEnvelope
+	if err := proto.Unmarshal(h.backend.lastRequest(), &received); err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(received.GetTypeUrl())
+	if err != nil {
+		return fmt.Errorf("backend received type_url %.40q, not base64: %v", received.GetTypeUrl(), err)
+	}
+	if err := h.verify(received.GetPayload(), sig); err != nil {
+		return fmt.Errorf("coerced proxy signature: %v", err)
+	}
+
+	_, err = client.SecureEcho(ctx, &echo.SecureEnvelope{TypeUrl: "not base64!", Payload: []byte("legacy")})
+	if info := errorInfo(err); status.Code(err) != codes.InvalidArgument || info.GetReason() != "ENVELOPE_UNDECODABLE" {
+		return fmt.Errorf("non-base64 type_url: %v (ErrorInfo %v), want ENVELOPE_UNDECODABLE", err, info)
+	}
+	return nil
+}
+
+// checkConfigTools checks that the config schema covers the keys the proxy
+// reads, that its commented example decodes strictly once uncommented, and
+// that config-check passes the harness's own config and places each problem
+// of a broken one at its line
+func checkConfigTools(ctx context.Context, h *harness) error {
+	schema := proxy.ConfigJSONSchema()
+	if !bytes.Equal(schema, proxy.ConfigJSONSchema()) || !bytes.Equal(proxy.ExampleConfig(), proxy.ExampleConfig()) {
+		return fmt.Errorf("config-schema output differs between runs")
+	}
+	var doc struct {
+		Ref  string `json:"$ref"`
+		Defs map[string]struct {
+			Properties           map[string]json.RawMessage `json:"properties"`
+			AdditionalProperties *bool                      `json:"additionalProperties"`
+		} `json:"$defs"`
+	}
+	if err := json.Unmarshal(schema, &doc); err != nil {
+		return fmt.Errorf("schema is not JSON: %v", err)
+	}
+	route := doc.Defs["RouteConfig"]
+	if doc.Ref != "#/$defs/Config" || route.AdditionalProperties == nil || *route.AdditionalProperties ||
+		!strings.Contains(string(route.Properties["mode"]), `"wrap-envelope"`) {
+		return fmt.Errorf("schema does not describe routes: %s", route.Properties["mode"])
+	}
+	for def, key := range map[string]string{"RouteConfig": "sign_key_selector", "Config": "janitor", "VersionedEnvelope": "payload_field", "JanitorConfig": "max_stream_idle"} {
+		if _, ok := doc.Defs[def].Properties[key]; !ok {
+			return fmt.Errorf("schema's %s has no %s", def, key)
+		}
+	}
+
+	// Every key of the example, uncommented, is one the strict decoder knows
+	var example []string
+	for _, line := range strings.Split(string(proxy.ExampleConfig()), "\n")[2:] { // after the header
+		line, _, _ = strings.Cut(strings.TrimPrefix(line, "# "), "  # ")
+		example = append(example, strings.TrimRight(line, " "))
+	}
+	examplePath := filepath.Join(h.dir, "example.yaml")
+	if err := os.WriteFile(examplePath, []byte(strings.Join(example, "\n")), 0o600); err != nil {
+		return err
+	}
+	for _, f := range proxy.CheckConfig(examplePath, "", "go") {
+		if f.Component == "config" && f.Severity == proxy.SeverityError {
+			return fmt.Errorf("example config: line %d: %s %s", f.Line, f.Code, f.Message)
+		}
+	}
+
+	// Processors are registered in code, which config-check does not run
+	cfg := h.config()
+	cfg.Routes = slices.DeleteFunc(cfg.Routes, func(r proxy.RouteConfig) bool { return len(r.Processors) > 0 })
+	good, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	goodPath := filepath.Join(h.dir, "good.yaml")
+	if err := os.WriteFile(goodPath, good, 0o600); err != nil {
+		return err
+	}
+	for _, f := range proxy.CheckConfig(goodPath, "", "go") {
+		if f.Severity == proxy.SeverityError {
+			return fmt.Errorf("harness config: line %d: %s %s", f.Line, f.Code, f.Message)
+		}
+	}
+
+	// The schema section names a file that is not there; -pb stands in for it
+	bad := `backend:
+  address: bufnet
+schema:
+  method: pb
+  pb_path: missing.pb
+routes:
+  - name: outer
+    match: /echo.SecureService/InspectOuter
+    mode: inspect-outer
+    envelope:
+      payload_feild: payload
+  - name: signed
+    match: /echo.SecureService/*
+    mode: inspect-verify-sign
+    envelope:
+      payload_field: payload
+      type_url_field: no_such_field
+janitor:
+  max_stream_idle: soon
+`
+	badPath := filepath.Join(h.dir, "bad.yaml")
+	if err := os.WriteFile(badPath, []byte(bad), 0o600); err != nil {
+		return err
+	}
+	found := proxy.CheckConfig(badPath, filepath.Join(h.dir, "echo.pb"), "go")
+	at := map[string]int{}
+	for _, f := range found {
+		if f.Severity == proxy.SeverityError {
+			at[f.Code] = f.Line
+		}
+	}
+	for code, line := range map[string]int{"CONFIG_UNKNOWN_FIELD": 11, "JANITOR_DURATION": 19} {
+		if at[code] != line {
+			return fmt.Errorf("%s at line %d, want %d: %+v", code, at[code], line, found)
+		}
+	}
+	if _, ok := at["SCHEMA_PB_READ"]; ok {
+		return fmt.Errorf("-pb did not replace the config's schema: %+v", found)
+	}
+	for _, f := range found {
+		if f.Path == "routes[1].envelope.type_url_field" && f.Line == 17 {
+			return nil
+		}
+	}
+	return fmt.Errorf("no finding for the mistyped envelope field at line 17: %+v", found)
+}
+
+// checkReflectionV1 reflects the schema from a backend that serves only
+// grpc.reflection.v1, and gives up on one that never answers within
+// reflect_attempts tries of reflect_timeout
+func checkReflectionV1(ctx context.Context, h *harness) error {
+	lis := bufconn.Listen(bufSize)
+	srv := grpc.NewServer(grpc.ForceServerCodec(recordingCodec{h.backend}))
+	echo.RegisterEchoServiceServer(srv, h.backend)
+	echo.RegisterSecureServiceServer(srv, h.backend)
+	reflectionv1.RegisterServerReflectionServer(srv, reflection.NewServerV1(reflection.ServerOptions{Services: srv}))
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	cfg := h.config()
+	cfg.Schema = proxy.SchemaConfig{Method: "reflect", Required: true}
+	cfg.Routes = []proxy.RouteConfig{
+		{Name: "outer", Match: "/echo.SecureService/InspectOuter", Mode: "inspect-outer", OnDecodeFailure: "reject", Envelope: proxy.EnvelopeConfig{
+			PayloadField: "payload", TypeURLField: "type_url",
+		}},
+	}
+	var diag proxy.Diagnostics
+	px, proxyLis, err := h.startProxy(cfg, proxy.WithDiagnostics(&diag), proxy.WithBackendDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	}))
+	if err != nil {
+		return err
+	}
+	defer px.Shutdown(ctx)
+	if len(diag.Items) > 0 {
+		return fmt.Errorf("startup reported %v", diag.Items)
+	}
+	conn, err := dialBufconn(proxyLis)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// Rejected as undecodable if reflection had not supplied the method
+	env := &echo.SecureEnvelope{TypeUrl: "type.googleapis.com/echo.EchoRequest", Payload: []byte("inner")}
+	if _, err := echo.NewSecureServiceClient(conn).InspectOuter(ctx, env); err != nil {
+		return fmt.Errorf("reflected method: %v", err)
+	}
+
+	// A backend that takes the connection and never speaks
+	cfg.Schema.ReflectTimeout, cfg.Schema.ReflectAttempts = "200ms", 2
+	var stuck proxy.Diagnostics
+	start := time.Now()
+	_, err = h.newProxy(cfg, proxy.WithDiagnostics(&stuck), proxy.WithBackendDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go io.Copy(io.Discard, server)
+		return client, nil
+	}))
+	if took := time.Since(start); err == nil || took > 3*time.Second {
+		return fmt.Errorf("silent backend: startup took %s and returned %v", took, err)
+	}
+	for _, item := range stuck.Items {
+		if item.Code == "SCHEMA_REFLECT_LIST" && strings.Contains(item.Message, "DeadlineExceeded") {
+			return nil
+		}
+	}
+	return fmt.Errorf("silent backend: startup reported %v", stuck.Items)
+}
+
+// checkConfigIncludes checks that routes are merged over their
+// route_defaults and envelope_templates entries, that included files add
+// routes with duplicates caught, that config-check places a route's problem
+// in its own file, and that /routes/config serves the routes as merged
+func checkConfigIncludes(ctx context.Context, h *harness) error {
+	dir := filepath.Join(h.dir, "includes")
+	if err := os.MkdirAll(filepath.Join(dir, "routes.d"), 0o700); err != nil {
+		return err
+	}
+	adminAddr, err := freeAddr()
+	if err != nil {
+		return err
+	}
+	// The harness's own settings, without its routes
+	cfg := h.config()
+	cfg.Admin.ListenAddress = adminAddr
+	var base map[string]any
+	b, err := yaml.Marshal(cfg)
+	if err == nil {
+		err = yaml.Unmarshal(b, &base)
+	}
+	if err != nil {
+		return err
+	}
+	for _, key := range []string{"routes", "include", "envelope_templates", "route_defaults"} {
+		delete(base, key)
+	}
+	head, err := yaml.Marshal(base)
+	if err != nil {
+		return err
+	}
+	write := func(name, body string) error {
+		return os.WriteFile(filepath.Join(dir, name), []byte(body), 0o600)
+	}
+	main := string(head) + `include:
+  - routes.d/*.yaml
+envelope_templates:
+  secure:
+    payload_field: payload
+    type_url_field: type_url
+    client_sig_field: client_signature
+    proxy_sig_field: proxy_signature
+    metadata_field: metadata
+route_defaults:
+  signed:
+    mode: inspect-verify-sign
+    envelope_template: secure
+    allowed_types: [echo.EchoRequest, echo.EchoResponse]
+    limits:
+      requests_per_second: 500
+      burst: 50
+routes:
+  - name: signed-echo
+    defaults: signed
+    match: /echo.SecureService/SecureEcho
+    allowed_types: [echo.EchoRequest]
+`
+	if err := write("main.yaml", main); err != nil {
+		return err
+	}
+	if err := write("routes.d/10-bidi.yaml", `routes:
+  - name: signed-bidi
+    defaults: signed
+    match: /echo.SecureService/SecureBidiEcho
+    limits:
+      burst: 10
+    envelope:
+      metadata_field: ~
+`); err != nil {
+		return err
+	}
+	if err := write("routes.d/20-outer.yaml", `routes:
+  - name: outer
+    match: /echo.SecureService/InspectOuter
+    mode: inspect-outer
+    envelope_template: secure
+`); err != nil {
+		return err
+	}
+
+	var diag proxy.Diagnostics
+	loaded, ok := proxy.LoadConfig(filepath.Join(dir, "main.yaml"), &diag)
+	if !ok || len(diag.Items) > 0 {
+		return fmt.Errorf("LoadConfig: %v", diag.Items)
+	}
+	if len(loaded.Routes) != 3 || loaded.Routes[1].Name != "signed-bidi" || loaded.Routes[2].Name != "outer" {
+		return fmt.Errorf("routes %+v, want the main file's then each included file's in order", loaded.Routes)
+	}
+	echoRoute, bidi, outer := loaded.Routes[0], loaded.Routes[1], loaded.Routes[2]
+	switch {
+	case echoRoute.Mode != "inspect-verify-sign" || echoRoute.Envelope != secureEnvelope || echoRoute.Defaults != "" || echoRoute.EnvelopeTemplate != "":
+		return fmt.Errorf("signed-echo not merged with its defaults and template: %+v", echoRoute)
+	case !slices.Equal(echoRoute.AllowedTypes, []string{"echo.EchoRequest"}):
+		return fmt.Errorf("signed-echo allowed_types %v, want its own list in place of the defaults'", echoRoute.AllowedTypes)
+	case bidi.Limits.RequestsPerSecond != 500 || bidi.Limits.Burst != 10:
+		return fmt.Errorf("signed-bidi limits %+v, want its own merged over the defaults'", bidi.Limits)
+	case bidi.Envelope.MetadataField != "" || bidi.Envelope.PayloadField != "payload":
+		return fmt.Errorf("signed-bidi envelope %+v, want the template's without metadata_field", bidi.Envelope)
+	case outer.Envelope != secureEnvelope:
+		return fmt.Errorf("outer envelope %+v, want the template", outer.Envelope)
+	}
+
+	// A name defined twice across files, and a template that is not there
+	if err := write("routes.d/30-dup.yaml", `routes:
+  - name: outer
+    match: /echo.SecureService/*
+    mode: inspect-outer
+    envelope_template: secrue
+`); err != nil {
+		return err
+	}
+	found := proxy.CheckConfig(filepath.Join(dir, "main.yaml"), "", "go")
+	at := map[string]proxy.ConfigFinding{}
+	for _, f := range found {
+		at[f.Code] = f
+	}
+	dup, unknown := at["CONFIG_DUPLICATE"], at["CONFIG_TEMPLATE_UNKNOWN"]
+	if !strings.Contains(dup.Message, "20-outer.yaml") || !strings.Contains(dup.Message, "30-dup.yaml") || !strings.HasSuffix(dup.File, "30-dup.yaml") || dup.Line != 2 {
+		return fmt.Errorf("duplicate route name: %+v", dup)
+	}
+	if !strings.HasSuffix(unknown.File, "30-dup.yaml") || unknown.Line != 5 || !strings.Contains(unknown.Message, `did you mean "secure"`) {
+		return fmt.Errorf("unknown template: %+v", unknown)
+	}
+	if err := os.Remove(filepath.Join(dir, "routes.d/30-dup.yaml")); err != nil {
+		return err
+	}
+
+	// The admin listener serves the routes as merged
+	px, _, err := h.startProxy(loaded)
+	if err != nil {
+		return err
+	}
+	defer px.Shutdown(ctx)
+	resp, err := http.Get("http://" + adminAddr + "/routes/config")
+	for i := 0; err != nil && i < 20; i++ {
+		time.Sleep(50 * time.Millisecond)
+		resp, err = http.Get("http://" + adminAddr + "/routes/config")
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var served []proxy.RouteConfig
+	if err := yaml.NewDecoder(resp.Body).Decode(&served); err != nil {
+		return fmt.Errorf("/routes/config: %v", err)
+	}
+	for _, r := range served {
+		if r.Name == "signed-bidi" && r.Envelope.PayloadField == "payload" && r.Limits.Burst == 10 && len(r.AllowedTypes) == 2 {
+			return nil
+		}
+	}
+	return fmt.Errorf("/routes/config has no merged signed-bidi route: %+v", served)
+}
+
+// editionsFixtures describes an edition 2023 envelope and a proto2 one with a
+// group, and an echo.SecureService taking them in place of SecureEnvelope
+// (same numbers for type_url, payload and the signatures, the rest past the
+// numbers SecureEnvelope uses)
+func editionsFixtures() *descriptorpb.FileDescriptorSet {
+	field := func(name string, num int32, typ descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name: proto.String(name), JsonName: proto.String(name), Number: proto.Int32(num),
+			Type: typ.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		}
+	}
+	envelopeFields := func() []*descriptorpb.FieldDescriptorProto {
+		return []*descriptorpb.FieldDescriptorProto{
+			field("type_url", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+			field("payload", 3, descriptorpb.FieldDescriptorProto_TYPE_BYTES),
+			field("client_signature", 4, descriptorpb.FieldDescriptorProto_TYPE_BYTES),
+			field("proxy_signature", 5, descriptorpb.FieldDescriptorProto_TYPE_BYTES),
+		}
+	}
+
+	// counts is packed and level has explicit presence by default; detail is
+	// written as a group, and flags has no presence
+	counts := field("counts", 10, descriptorpb.FieldDescriptorProto_TYPE_INT32)
+	counts.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	detail := field("detail", 11, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE)
+	detail.TypeName = proto.String(".echo.fixtures.Detail")
+	detail.Options = &descriptorpb.FieldOptions{Features: &descriptorpb.FeatureSet{
+		MessageEncoding: descriptorpb.FeatureSet_DELIMITED.Enum(),
+	}}
+	flags := field("flags", 12, descriptorpb.FieldDescriptorProto_TYPE_INT32)
+	flags.Options = &descriptorpb.FieldOptions{Features: &descriptorpb.FeatureSet{
+		FieldPresence: descriptorpb.FeatureSet_IMPLICIT.Enum(),
+	}}
+	editions := &descriptorpb.FileDescriptorProto{
+		Name: proto.String("fixtures/editions.proto"), Package: proto.String("echo.fixtures"),
+		Syntax: proto.String("editions"), Edition: descriptorpb.Edition_EDITION_2023.Enum(),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("Envelope"), Field: append(envelopeFields(), counts, detail, flags,
+				field("level", 13, descriptorpb.FieldDescriptorProto_TYPE_INT32))},
+			{Name: proto.String("Detail"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("note", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+			}},
+		},
+	}
+
+	block := field("block", 11, descriptorpb.FieldDescriptorProto_TYPE_GROUP)
+	block.JsonName = proto.String("Block")
+	block.TypeName = proto.String(".echo.fixtures.LegacyEnvelope.Block")
+	legacy := &descriptorpb.FileDescriptorProto{
+		Name: proto.String("fixtures/legacy.proto"), Package: proto.String("echo.fixtures"),
+		Syntax: proto.String("proto2"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("LegacyEnvelope"), Field: append(envelopeFields(), block),
+			NestedType: []*descriptorpb.DescriptorProto{{Name: proto.String("Block"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("note", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("id", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64),
+			}}},
+		}},
+	}
+
+	method := func(name, typ string) *descriptorpb.MethodDescriptorProto {
+		return &descriptorpb.MethodDescriptorProto{Name: proto.String(name), InputType: proto.String(typ), OutputType: proto.String(typ)}
+	}
+	service := &descriptorpb.FileDescriptorProto{
+		Name: proto.String("fixtures/service.proto"), Package: proto.String("echo"), Syntax: proto.String("proto3"),
+		Dependency: []string{"fixtures/editions.proto", "fixtures/legacy.proto"},
+		Service: []*descriptorpb.ServiceDescriptorProto{{Name: proto.String("SecureService"), Method: []*descriptorpb.MethodDescriptorProto{
+			method("SecureEcho", ".echo.fixtures.Envelope"),
+			method("InspectOuter", ".echo.fixtures.LegacyEnvelope"),
+		}}},
+	}
+	return &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{editions, legacy, service}}
+}
+
+// checkEditions loads a schema of edition 2023 and proto2 files, then signs
+// envelopes of each. Both re-marshal to the bytes sent, plus the proxy
+// signature: a proto2 group and a DELIMITED message keep the group encoding,
+// a packed repeated field stays packed, and an implicit-presence field sent
+// as zero is dropped as unset.
+func checkEditions(ctx context.Context, h *harness) error {
+	b, err := proto.Marshal(editionsFixtures())
+	if err != nil {
+		return err
+	}
+	pbPath := filepath.Join(h.dir, "editions.pb")
+	if err := os.WriteFile(pbPath, b, 0o600); err != nil {
+		return err
+	}
+	cfg := h.config()
+	cfg.Schema = proxy.SchemaConfig{Method: "pb", PBPath: pbPath, Required: true}
+	envelope := proxy.EnvelopeConfig{PayloadField: "payload", TypeURLField: "type_url", ClientSigField: "client_signature", ProxySigField: "proxy_signature"}
+	cfg.Routes = []proxy.RouteConfig{
+		{Name: "editions", Match: "/echo.SecureService/SecureEcho", Mode: "inspect-verify-sign", Envelope: envelope},
+		{Name: "proto2", Match: "/echo.SecureService/InspectOuter", Mode: "inspect-verify-sign", Envelope: envelope},
+	}
+	px, lis, err := h.startProxy(cfg)
+	if err != nil {
+		return fmt.Errorf("editions schema: %v", err)
+	}
+	defer px.Shutdown(ctx)
+	conn, err := dialBufconn(lis)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	payload := []byte("editions payload")
+	bytesField := func(b []byte, num protowire.Number, v []byte) []byte {
+		return protowire.AppendBytes(protowire.AppendTag(b, num, protowire.BytesType), v)
+	}
+	varintField := func(b []byte, num protowire.Number, v uint64) []byte {
+		return protowire.AppendVarint(protowire.AppendTag(b, num, protowire.VarintType), v)
+	}
+	group := func(b []byte, num protowire.Number, body []byte) []byte {
+		b = append(protowire.AppendTag(b, num, protowire.StartGroupType), body...)
+		return protowire.AppendTag(b, num, protowire.EndGroupType)
+	}
+	head := bytesField(nil, 2, []byte("type.googleapis.com/echo.EchoRequest"))
+	head = bytesField(head, 3, payload)
+	head = bytesField(head, 4, []byte("client sig"))
+	var packed []byte
+	for _, v := range []uint64{1, 2, 300} {
+		packed = protowire.AppendVarint(packed, v)
+	}
+	// Encoded as protoc-generated code would, except for flags
+	edWant := bytesField(nil, 10, packed)
+	edWant = group(edWant, 11, bytesField(nil, 1, []byte("delimited")))
+	edSent := varintField(edWant, 12, 0)
+	edWant = varintField(edWant, 13, 0)
+	edSent = varintField(edSent, 13, 0)
+	block := varintField(bytesField(nil, 1, []byte("legacy")), 2, 42)
+	legacyTail := varintField(group(nil, 11, block), 99, 7)
+
+	for _, c := range []struct {
+		method     string
+		tail, want []byte
+	}{
+		{"/echo.SecureService/SecureEcho", edSent, edWant},
+		{"/echo.SecureService/InspectOuter", legacyTail, legacyTail},
+	} {
+		sent := append(bytes.Clone(head), c.tail...)
+		var resp []byte
+		if err := conn.Invoke(ctx, c.method, &sent, &resp, grpc.ForceCodec(rawCodec{})); err != nil {
+			return fmt.Errorf("%s: %v", c.method, err)
+		}
+		got := h.backend.lastRequest()
+		// The proxy signature goes in at its field number, after the client's
+		sig, n := []byte(nil), len(head)
+		if len(got) > n {
+			num, typ, m := protowire.ConsumeTag(got[n:])
+			if num == 5 && typ == protowire.BytesType {
+				v, k := protowire.ConsumeBytes(got[n+m:])
+				if k > 0 {
+					sig, got = v, append(bytes.Clone(got[:n]), got[n+m+k:]...)
+				}
+			}
+		}
+		if sig == nil {
+			return fmt.Errorf("%s: backend received %x, want a proxy_signature after client_signature", c.method, got)
+		}
+		if err := h.verify(payload, sig); err != nil {
+			return fmt.Errorf("%s: proxy signature: %v", c.method, err)
+		}
+		if want := append(bytes.Clone(head), c.want...); !bytes.Equal(got, want) {
+			return fmt.Errorf("%s: backend received %x besides the proxy signature, want %x", c.method, got, want)
+		}
+	}
+	return nil
+}
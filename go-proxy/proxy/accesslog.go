@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/status"
+)
+
+// callTimings records the points in a proxied call that let us split its
+// duration into client upload, backend service, and client download segments.
+// The pump goroutines mark these concurrently, so each mark is set-once.
+type callTimings struct {
+	start        time.Time
+	firstReqSent atomic.Int64 // first request message written to the backend
+	reqComplete  atomic.Int64 // client half-closed and CloseSend issued upstream
+	firstResp    atomic.Int64 // first response message received from the backend
+
+	bytes callBytes // what the pumps received and forwarded; see bytecount.go
+}
+
+func newCallTimings() *callTimings {
+	return &callTimings{start: time.Now()}
+}
+
+func markOnce(v *atomic.Int64) {
+	v.CompareAndSwap(0, time.Now().UnixNano())
+}
+
+func (t *callTimings) markRequestSent()     { markOnce(&t.firstReqSent) }
+func (t *callTimings) markRequestComplete() { markOnce(&t.reqComplete) }
+func (t *callTimings) markFirstResponse()   { markOnce(&t.firstResp) }
+
+// between returns the elapsed time between two marks, or 0 if either is unset
+func between(from, to int64) time.Duration {
+	if from == 0 || to == 0 || to < from {
+		return 0
+	}
+	return time.Duration(to - from)
+}
+
+// accessRecord is the single summary line emitted per proxied RPC
+type accessRecord struct {
+	Method   string `json:"method"`
+	Route    string `json:"route"`
+	Mode     string `json:"mode"`
+	Identity string `json:"client_identity"`
+	Peer     string `json:"peer,omitempty"`     // with logging.peer_info
+	PeerTLS  string `json:"peer_tls,omitempty"` // and the client came over TLS
+	Shape    string `json:"shape"`
+	Code     string `json:"code"`
+	Duration string `json:"duration"`
+
+	// Unary segments: Upload + Backend + Download == Duration
+	Upload   string `json:"upload,omitempty"`
+	Backend  string `json:"backend,omitempty"`
+	Download string `json:"download,omitempty"`
+
+	// Streaming shapes: first request forwarded -> first response received
+	FirstResponse string `json:"first_response,omitempty"`
+
+	// Message and byte totals by direction
+	Requests  *byteTotals `json:"requests"`
+	Responses *byteTotals `json:"responses"`
+
+	// Set when tracing is enabled, to correlate with the exported spans
+	TraceID string `json:"trace_id,omitempty"`
+	SpanID  string `json:"span_id,omitempty"`
+}
+
+// finishCall emits the access log record and latency metrics for one RPC
+func finishCall(method string, route *RouteConfig, identity string, client peerInfo, unary bool, t *callTimings, sp *span, err error) {
+	end := time.Now()
+	code := status.Code(err).String()
+	start := t.start.UnixNano()
+
+	rec := accessRecord{
+		Method:    method,
+		Route:     route.Name,
+		Mode:      route.Mode,
+		Identity:  identity,
+		Peer:      client.addr,
+		PeerTLS:   client.tls,
+		Shape:     "stream",
+		Code:      code,
+		Duration:  end.Sub(t.start).String(),
+		Requests:  t.bytes.totals(0),
+		Responses: t.bytes.totals(1),
+	}
+	rec.TraceID, rec.SpanID = sp.ids()
+	lbls := Labels{"method": method}
+
+	metrics.Inc("proxy_rpcs_total", Labels{"method": method, "route": route.Name, "mode": route.Mode, "code": code})
+	if client.label != "" {
+		metrics.Inc("proxy_rpcs_by_peer_total", Labels{"peer": client.label, "route": route.Name, "code": code})
+	}
+	metrics.ObserveDuration("proxy_rpc_duration_seconds", lbls, end.Sub(t.start))
+
+	reqComplete, firstResp := t.reqComplete.Load(), t.firstResp.Load()
+	if unary {
+		rec.Shape = "unary"
+		if reqComplete != 0 && firstResp != 0 {
+			upload := between(start, reqComplete)
+			backend := between(reqComplete, firstResp)
+			download := between(firstResp, end.UnixNano())
+			rec.Upload, rec.Backend, rec.Download = upload.String(), backend.String(), download.String()
+
+			metrics.ObserveDuration("proxy_unary_upload_seconds", lbls, upload)
+			metrics.ObserveDuration("proxy_unary_backend_seconds", lbls, backend)
+			metrics.ObserveDuration("proxy_unary_download_seconds", lbls, download)
+		}
+	} else if ttfr := between(t.firstReqSent.Load(), firstResp); ttfr > 0 {
+		rec.FirstResponse = ttfr.String()
+		metrics.ObserveDuration("proxy_stream_first_response_seconds", lbls, ttfr)
+	}
+
+	js, _ := json.Marshal(rec)
+	log.Printf("[Access] %s", js)
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestUnarySegments times a unary call whose backend takes backendDelay to
+// answer and checks that the access record's segments add up to its duration,
+// with the delay in the backend segment
+func TestUnarySegments(t *testing.T) {
+	const backendDelay = 100 * time.Millisecond
+	var buf bytes.Buffer
+	out := log.Writer()
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(out) })
+
+	timings := newCallTimings()
+	time.Sleep(5 * time.Millisecond) // the client uploads the request
+	timings.markRequestSent()
+	timings.markRequestComplete()
+	time.Sleep(backendDelay)
+	timings.markFirstResponse()
+	time.Sleep(5 * time.Millisecond) // the response goes back to the client
+	route := &RouteConfig{Name: "segments", Mode: "pass-thru"}
+	finishCall("/echo.EchoService/UnaryEcho", route, "", peerInfo{}, true, timings, nil, nil)
+
+	_, js, ok := strings.Cut(buf.String(), "[Access] ")
+	if !ok {
+		t.Fatalf("no access record in %q", buf.String())
+	}
+	var rec accessRecord
+	if err := json.Unmarshal([]byte(js), &rec); err != nil {
+		t.Fatal(err)
+	}
+	parse := func(name, s string) time.Duration {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			t.Fatalf("%s %q: %v", name, s, err)
+		}
+		return d
+	}
+	duration := parse("duration", rec.Duration)
+	upload, backend, download := parse("upload", rec.Upload), parse("backend", rec.Backend), parse("download", rec.Download)
+
+	if sum := upload + backend + download; (duration - sum).Abs() > time.Millisecond {
+		t.Errorf("upload %v + backend %v + download %v = %v, want the duration %v", upload, backend, download, sum, duration)
+	}
+	if backend < backendDelay {
+		t.Errorf("backend segment %v, want the backend's %v delay", backend, backendDelay)
+	}
+	if upload >= backendDelay || download >= backendDelay {
+		t.Errorf("upload %v or download %v took the backend's delay", upload, download)
+	}
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"gopkg.in/yaml.v3"
+)
+
+// startAdminServer exposes operational endpoints on a separate HTTP listener
+// so nothing here shares the gRPC data path. /healthz answers while the
+// process serves; /readyz answers 503 with the reason while ready fails.
+// /streams lists the calls being proxied; see janitor.go. /routes/config is
+// each route as it is in effect; see configinclude.go. /routes/override is
+// served when override is set; see overrides.go.
+func startAdminServer(addr string, routes []RouteConfig, streams *streamRegistry, ready func() error, overrides *overrideStore, override http.HandlerFunc) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.Handle("/routes", routesHandler(routes, overrides))
+	mux.Handle("/routes/config", routeConfigHandler(routes))
+	if override != nil {
+		mux.HandleFunc("/routes/override", override)
+	}
+	mux.HandleFunc("/streams", streams.handler)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if err := ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		log.Printf("Admin server listening on %s", addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("admin server stopped: %v", err)
+		}
+	}()
+	return srv
+}
+
+// routeSummary is one entry of the /routes dump
+type routeSummary struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Match       string `json:"match"`
+	Priority    int    `json:"priority,omitempty"`
+	Mode        string `json:"mode"`
+	Shadow      bool   `json:"shadow,omitempty"`
+	// Override is the runtime override in effect on the route, if any
+	Override *routeOverride `json:"override,omitempty"`
+}
+
+// routesHandler lists the configured routes in precedence order: a method
+// takes the first that covers it
+func routesHandler(routes []RouteConfig, overrides *overrideStore) http.HandlerFunc {
+	summaries := make([]routeSummary, 0, len(routes))
+	for _, r := range routes {
+		summaries = append(summaries, routeSummary{Name: r.Name, Description: r.Description, Match: r.Match, Priority: r.Priority, Mode: r.Mode, Shadow: r.Shadow})
+	}
+	return func(w http.ResponseWriter, _ *http.Request) {
+		out := summaries
+		if o := overrides.current.Load(); o != nil {
+			out = make([]routeSummary, len(summaries))
+			for i, r := range summaries {
+				r.Override = o.of(r.Name)
+				out[i] = r
+			}
+		}
+		body, _ := json.MarshalIndent(out, "", "  ")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
+
+// routeConfigHandler serves the routes, in precedence order, as YAML with
+// their defaults and envelope templates merged in. Keys at their zero value,
+// which leave a setting at its default, are left out.
+func routeConfigHandler(routes []RouteConfig) http.HandlerFunc {
+	var doc yaml.Node
+	body := []byte("[]\n")
+	if err := doc.Encode(routes); err == nil {
+		pruneZero(&doc)
+		body, _ = yaml.Marshal(&doc)
+	}
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(body)
+	}
+}
+
+// pruneZero drops the mapping entries under n whose values are zero or
+// empty, reporting whether n is
+func pruneZero(n *yaml.Node) bool {
+	switch n.Kind {
+	case yaml.MappingNode:
+		kept := n.Content[:0]
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if !pruneZero(n.Content[i+1]) {
+				kept = append(kept, n.Content[i], n.Content[i+1])
+			}
+		}
+		n.Content = kept
+		return len(kept) == 0
+	case yaml.SequenceNode:
+		for _, c := range n.Content {
+			pruneZero(c)
+		}
+		return len(n.Content) == 0
+	case yaml.ScalarNode:
+		switch n.Tag {
+		case "!!null":
+			return true
+		case "!!str":
+			return n.Value == ""
+		case "!!bool":
+			return n.Value == "false"
+		case "!!int", "!!float":
+			return n.Value == "0"
+		}
+	}
+	return false
+}
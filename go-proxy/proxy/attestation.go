@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// --- Stream Attestation ---
+//
+// On an inspect-verify-sign route with stream_attestation, client-streaming
+// calls are signed once per stream instead of once per request message. The
+// proxy folds the payload of each request, as it would have signed it, into a
+// rolling SHA-256 chain:
+//
+//	chain_0 = 32 zero bytes
+//	chain_i = SHA-256(chain_{i-1} || SHA-256(payload_i))
+//
+// and at the client's half-close sends the backend one more envelope of the
+// request type: type_url_field, when the envelope has one, set to
+// StreamAttestationTypeURL, the payload field set to the statement
+//
+//	"grpc-proxy/stream-attestation/v1" || uint64 big-endian message count || chain_n
+//
+// and the proxy signature field set to an RSA-SHA256 signature over it with
+// the route's request signing key, so the backend checks the whole stream
+// with one verification. gRPC has no client trailers, which is why the
+// attestation travels as a message; the request headers carry
+// x-proxy-stream-attestation: v1 so the backend knows to expect it. Responses are still signed one by one. A stream that ends
+// before the half-close, or that forwarded a message the chain does not cover
+// (one a processor replaced, or that did not decode), gets no attestation.
+
+const (
+	// StreamAttestationTypeURL marks the attestation envelope
+	StreamAttestationTypeURL = "grpc-proxy/stream-attestation/v1"
+	streamAttestationHeader  = "x-proxy-stream-attestation"
+)
+
+// streamAttestation is the chain over one stream's requests. It is used by
+// the request pump's processing goroutine, then by the handler once that
+// pump has finished.
+type streamAttestation struct {
+	chain    [sha256.Size]byte
+	hashed   uint64 // requests folded into chain
+	received uint64 // requests read from the client
+	sent     bool
+}
+
+type attestationKey struct{}
+
+// attestationFromContext returns the call's attestation; nil unless the call
+// is attested
+func attestationFromContext(ctx context.Context) *streamAttestation {
+	att, _ := ctx.Value(attestationKey{}).(*streamAttestation)
+	return att
+}
+
+// attests reports whether calls to method on route are attested
+func (px *Proxy) attests(route *RouteConfig, method string) bool {
+	if !route.StreamAttestation {
+		return false
+	}
+	md, ok := px.lookupMethod(method)
+	return ok && md.IsClientStreaming()
+}
+
+// receive counts a request read from the client
+func (a *streamAttestation) receive() {
+	if a != nil {
+		a.received++
+	}
+}
+
+// add folds one request payload into the chain
+func (a *streamAttestation) add(payload []byte) {
+	sum := sha256.Sum256(payload)
+	h := sha256.New()
+	h.Write(a.chain[:])
+	h.Write(sum[:])
+	h.Sum(a.chain[:0])
+	a.hashed++
+}
+
+// statement is what the proxy signs at the half-close
+func (a *streamAttestation) statement() []byte {
+	out := make([]byte, 0, len(StreamAttestationTypeURL)+8+sha256.Size)
+	out = append(out, StreamAttestationTypeURL...)
+	out = binary.BigEndian.AppendUint64(out, a.hashed)
+	return append(out, a.chain[:]...)
+}
+
+// sendAttestation signs the statement and sends it to the backend as the
+// stream's last request. A stream with requests the chain does not cover
+// gets nothing.
+func (px *Proxy) sendAttestation(ctx context.Context, method string, route *RouteConfig, a *streamAttestation, dst grpc.ClientStream) error {
+	if a.hashed != a.received {
+		metrics.Inc("proxy_stream_attestations_total", Labels{"route": route.Name, "result": "incomplete"})
+		log.Printf("[Attestation] %s: %d of %d requests are not covered; no attestation sent", method, a.received-a.hashed, a.received)
+		a.sent = true // counted
+		return nil
+	}
+	md, ok := px.lookupMethod(method)
+	if !ok {
+		return fmt.Errorf("no descriptor loaded for %s", method)
+	}
+	msgDesc := md.GetInputType()
+	env := px.envelopeFor(route, method, true, msgDesc)
+	statement := a.statement()
+	key := px.cryptoPlanFor(route).request.key
+	sig, decision, err := px.signPayload(ctx, route, key, "Request", sha256.Sum256(statement))
+	if err != nil {
+		return skipCancelled(ctx, route, true, "sign")
+	}
+	ev := auditEvent{op: "sign", signer: "proxy", decision: decision, payload: statement, keyID: key.id()}
+	if err := px.audit(ctx, method, route, true, ev); err != nil {
+		return err
+	}
+	if decision != "signed" {
+		a.sent = true
+		metrics.Inc("proxy_stream_attestations_total", Labels{"route": route.Name, "result": decision})
+		return rejectf(codes.Internal, reasonSigningFailed, "proxy: could not sign the stream attestation")
+	}
+
+	msg := dynamic.NewMessage(msgDesc)
+	if err := setEnvelopeField(msg, env.payload, statement); err != nil {
+		return err
+	}
+	if err := setEnvelopeField(msg, env.proxySig, sig); err != nil {
+		return err
+	}
+	if env.typeURL != nil {
+		if err := setEnvelopeField(msg, env.typeURL, StreamAttestationTypeURL); err != nil {
+			return err
+		}
+	}
+	out, err := marshalDynamic(msg)
+	if err != nil {
+		return err
+	}
+	a.sent = true
+	metrics.Inc("proxy_stream_attestations_total", Labels{"route": route.Name, "result": decision})
+	log.Printf("[Attestation] %s: signed %d requests", method, a.hashed)
+	return dst.SendMsg(&out)
+}
+
+// abandon counts a stream that ended before its attestation went out
+func (a *streamAttestation) abandon(route *RouteConfig) {
+	if a == nil || a.sent {
+		return
+	}
+	metrics.Inc("proxy_stream_attestations_total", Labels{"route": route.Name, "result": "aborted"})
+}
+
+// loadStreamAttestation checks the routes with stream_attestation
+func (px *Proxy) loadStreamAttestation(diag *Diagnostics) {
+	for i, route := range px.cfg.Routes {
+		if !route.StreamAttestation {
+			continue
+		}
+		path := fmt.Sprintf("routes[%d].stream_attestation", i)
+		switch {
+		case route.Mode != "inspect-verify-sign":
+			diag.Errorf("routes", "ROUTE_STREAM_ATTESTATION", path, "only inspect-verify-sign routes sign requests")
+		case route.Unordered:
+			diag.Errorf("routes", "ROUTE_STREAM_ATTESTATION", path, "the chain follows forwarding order, which unordered routes do not keep")
+		case route.Shadow:
+			diag.Errorf("routes", "ROUTE_STREAM_ATTESTATION", path, "shadow routes forward requests unchanged and cannot add the attestation")
+		case len(route.Envelopes) > 0:
+			diag.Errorf("routes", "ROUTE_STREAM_ATTESTATION", path, "not supported with envelopes; use a single envelope")
+		case route.Envelope.ProxySigField == "" || route.Envelope.PayloadField == "":
+			diag.Errorf("routes", "ROUTE_STREAM_ATTESTATION", path, "needs envelope.payload_field and envelope.proxy_sig_field")
+		case px.cryptoPlanFor(&px.cfg.Routes[i]).request.key == nil:
+			diag.Errorf("routes", "ROUTE_STREAM_ATTESTATION", path, "needs requests signed with cms.proxy_private_key or a cms.keys entry")
+		}
+	}
+}
@@ -0,0 +1,452 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// --- Security Audit Log ---
+//
+// Every verify, sign, encrypt, decrypt and reject decision processMsg makes is
+// appended to audit.path as one JSON line, separately from the access log,
+// and so is every change to a route override (op "override"; see
+// overrides.go).
+// Each line carries the hash of the line before it in "prev" and its own hash
+// in "hash", always the last member: SHA-256, or HMAC-SHA256 with
+// audit.hmac_key_file, over the line with its ,"hash":"..." member removed.
+// Truncating, reordering or editing records therefore breaks the chain, which
+// `proxy audit-verify` checks. The chain continues across rotation and
+// restarts; rotation is rotatefile.go's, shared with the capture file.
+//
+// Records are queued for a writer goroutine. When the queue is full a route
+// either blocks the message until there is room (audit_on_full: block, the
+// default) or drops the record (degrade); drops are counted in
+// proxy_audit_dropped_total and in the "dropped" member of the next record
+// written, so a gap is visible in the trail itself.
+
+// AuditConfig sets where the security audit trail goes; it is off without a path
+type AuditConfig struct {
+	Path        string `yaml:"path"`
+	MaxBytes    int64  `yaml:"max_bytes"`     // rotate once the file reaches this size; default 64 MiB
+	MaxFiles    int    `yaml:"max_files"`     // rotated files kept as path.1 .. path.N; default 10
+	Queue       int    `yaml:"queue"`         // records buffered ahead of the writer; default 4096
+	HMACKeyFile string `yaml:"hmac_key_file"` // key the chain with HMAC-SHA256 instead of plain SHA-256
+}
+
+// Route policies for a full audit queue
+const (
+	auditBlock   = "block"
+	auditDegrade = "degrade"
+)
+
+// auditRecord is one line of the audit trail. PayloadSHA256 covers the
+// envelope's payload field (the plaintext on encrypt-payload routes), or the
+// whole message for rejections.
+type auditRecord struct {
+	Time          string `json:"time"`
+	Seq           uint64 `json:"seq"`
+	Route         string `json:"route"`
+	Method        string `json:"method"`
+	Direction     string `json:"direction"`
+	Op            string `json:"op"` // verify, sign, encrypt, decrypt, reject, override
+	Signer        string `json:"signer,omitempty"`
+	Decision      string `json:"decision"`
+	Reason        string `json:"reason,omitempty"`
+	PayloadSHA256 string `json:"payload_sha256"`
+	ClientSigFP   string `json:"client_sig_fingerprint,omitempty"`
+	KeyID         string `json:"key_id,omitempty"`
+	Tenant        string `json:"tenant,omitempty"`  // the trust domain on routes with trust_domain_from
+	Peer          string `json:"peer,omitempty"`    // the client's address, with logging.peer_info
+	Shadow        bool   `json:"shadow,omitempty"`  // decided on a shadow route, not enforced
+	Actor         string `json:"actor,omitempty"`   // who changed a route override
+	Dropped       uint64 `json:"dropped,omitempty"` // records dropped since the previous line
+	Prev          string `json:"prev"`
+	Hash          string `json:"hash,omitempty"`
+}
+
+type auditWriter struct {
+	out     *rotatingFile
+	hmacKey []byte
+	queue   chan *auditRecord
+	done    chan struct{} // closed once the writer has flushed and closed the file
+	dropped atomic.Uint64
+
+	seq  uint64
+	prev string
+}
+
+// auditEvent is what a decision point knows; the writer fills in the chain
+type auditEvent struct {
+	op, signer, decision, reason string
+	payload, clientSig           []byte
+	keyID                        string
+}
+
+// audit records one decision for method on route. It only fails when the
+// route blocks on a full queue and the call ends while waiting.
+func (px *Proxy) audit(ctx context.Context, method string, route *RouteConfig, isReq bool, ev auditEvent) error {
+	w := px.auditor
+	if w == nil {
+		return nil
+	}
+	dir := "response"
+	if isReq {
+		dir = "request"
+	}
+	sum := sha256.Sum256(ev.payload)
+	rec := &auditRecord{
+		Time:          time.Now().UTC().Format(time.RFC3339Nano),
+		Route:         route.Name,
+		Method:        method,
+		Direction:     dir,
+		Op:            ev.op,
+		Signer:        ev.signer,
+		Decision:      ev.decision,
+		Reason:        ev.reason,
+		PayloadSHA256: hex.EncodeToString(sum[:]),
+		KeyID:         ev.keyID,
+		Tenant:        tenantFromContext(ctx),
+		Peer:          px.peerOf(ctx).addr,
+		Shadow:        route.Shadow,
+	}
+	if len(ev.clientSig) > 0 {
+		fp := sha256.Sum256(ev.clientSig)
+		rec.ClientSigFP = hex.EncodeToString(fp[:16])
+	}
+
+	select {
+	case w.queue <- rec:
+		return nil
+	default:
+	}
+	if route.AuditOnFull == auditDegrade {
+		w.dropped.Add(1)
+		metrics.Inc("proxy_audit_dropped_total", Labels{"route": route.Name})
+		return nil
+	}
+	metrics.Inc("proxy_audit_blocked_total", Labels{"route": route.Name})
+	select {
+	case w.queue <- rec:
+		return nil
+	case <-w.done:
+		w.dropped.Add(1)
+		metrics.Inc("proxy_audit_dropped_total", Labels{"route": route.Name})
+		return nil
+	case <-ctx.Done():
+		return rejectf(codes.Unavailable, reasonAuditUnavailable, "proxy: audit log is backlogged")
+	}
+}
+
+// keyID names a public key by the first 8 bytes of its SPKI SHA-256
+func keyID(pub *rsa.PublicKey) string {
+	if pub == nil {
+		return ""
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8])
+}
+
+// pemKeyID names the public key in a PEM block the same way
+func pemKeyID(pemKey []byte) string {
+	block, _ := pem.Decode(pemKey)
+	if block == nil {
+		return ""
+	}
+	sum := sha256.Sum256(block.Bytes)
+	return hex.EncodeToString(sum[:8])
+}
+
+// payloadKeyID names the shared payload key without revealing it
+func payloadKeyID(key []byte) string {
+	sum := sha256.Sum256(append([]byte("payload-key:"), key...))
+	return "aes:" + hex.EncodeToString(sum[:8])
+}
+
+func newAuditWriter(cfg AuditConfig, hmacKey []byte, stop <-chan struct{}) (*auditWriter, error) {
+	maxBytes, maxFiles := cfg.MaxBytes, cfg.MaxFiles
+	if maxBytes == 0 {
+		maxBytes = 64 << 20
+	}
+	if maxFiles == 0 {
+		maxFiles = 10
+	}
+	queue := cfg.Queue
+	if queue == 0 {
+		queue = 4096
+	}
+	w := &auditWriter{hmacKey: hmacKey, queue: make(chan *auditRecord, queue), done: make(chan struct{})}
+	if err := w.resume(cfg.Path); err != nil {
+		return nil, err
+	}
+	out, err := newRotatingFile(cfg.Path, maxBytes, maxFiles, "", "Audit", "proxy_audit")
+	if err != nil {
+		return nil, err
+	}
+	w.out = out
+	go w.run(stop)
+	return w, nil
+}
+
+// resume picks the chain up from the last record of the newest file
+func (w *auditWriter) resume(path string) error {
+	for _, p := range []string{path, path + ".1"} {
+		line, err := lastLine(p)
+		if errors.Is(err, os.ErrNotExist) || (err == nil && line == nil) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var last auditRecord
+		if err := json.Unmarshal(line, &last); err != nil || last.Hash == "" {
+			return fmt.Errorf("last record of %s is unreadable; move the file aside to start a new chain", p)
+		}
+		w.seq, w.prev = last.Seq, last.Hash
+		return nil
+	}
+	return nil
+}
+
+// lastLine returns the final line of a file, nil if it is empty
+func lastLine(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	const tail = 64 << 10
+	off := max(st.Size()-tail, 0)
+	b := make([]byte, st.Size()-off)
+	if _, err := f.ReadAt(b, off); err != nil && err != io.EOF {
+		return nil, err
+	}
+	b = bytes.TrimRight(b, "\n")
+	if len(b) == 0 {
+		return nil, nil
+	}
+	if i := bytes.LastIndexByte(b, '\n'); i >= 0 {
+		return b[i+1:], nil
+	}
+	if off > 0 {
+		return nil, fmt.Errorf("last line of %s is longer than %d bytes", path, tail)
+	}
+	return b, nil
+}
+
+// run writes records until stop is closed, then writes whatever is still
+// queued and closes the file
+func (w *auditWriter) run(stop <-chan struct{}) {
+	defer close(w.done)
+	for {
+		select {
+		case rec := <-w.queue:
+			w.write(rec)
+		case <-stop:
+			for len(w.queue) > 0 {
+				w.write(<-w.queue)
+			}
+			w.out.close()
+			return
+		}
+		if len(w.queue) == 0 {
+			w.out.flush()
+		}
+	}
+}
+
+func (w *auditWriter) write(rec *auditRecord) {
+	rec.Seq = w.seq + 1
+	rec.Dropped = w.dropped.Swap(0)
+	rec.Prev = w.prev
+	rec.Hash = ""
+	body, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("[Audit] Encoding failed: %v", err)
+		return
+	}
+	sum := chainHash(w.hmacKey, body)
+	line := append(body[:len(body)-1], `,"hash":"`+sum+"\"}\n"...)
+
+	if err := w.out.write(line); err != nil {
+		// Nothing was chained, so the next record still links to the last one written
+		log.Printf("[Audit] Write failed: %v", err)
+		w.dropped.Add(rec.Dropped + 1)
+		metrics.Inc("proxy_audit_write_errors_total", nil)
+		return
+	}
+	w.seq, w.prev = rec.Seq, sum
+	metrics.Inc("proxy_audit_records_total", Labels{"op": rec.Op})
+}
+
+// chainHash is the "hash" member for a record encoded without it
+func chainHash(key, body []byte) string {
+	var h hash.Hash
+	if key != nil {
+		h = hmac.New(sha256.New, key)
+	} else {
+		h = sha256.New()
+	}
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// splitChainHash separates a line into the bytes its hash covers and the hash
+func splitChainHash(line []byte) ([]byte, string, bool) {
+	i := bytes.LastIndex(line, []byte(`,"hash":"`))
+	if i < 0 || !bytes.HasSuffix(line, []byte(`"}`)) {
+		return nil, "", false
+	}
+	sum := string(line[i+len(`,"hash":"`) : len(line)-2])
+	body := append(append([]byte{}, line[:i]...), '}')
+	return body, sum, true
+}
+
+// loadAudit validates the audit block and per-route policies, and starts the writer
+func (px *Proxy) loadAudit(diag *Diagnostics) {
+	for i, route := range px.cfg.Routes {
+		switch route.AuditOnFull {
+		case "", auditBlock, auditDegrade:
+		default:
+			diag.Errorf("routes", "ROUTE_AUDIT", fmt.Sprintf("routes[%d].audit_on_full", i), "unknown policy %q (expected block or degrade)", route.AuditOnFull)
+		}
+	}
+	cfg := px.cfg.Audit
+	if cfg.Path == "" {
+		if cfg.HMACKeyFile != "" {
+			diag.Warnf("audit", "AUDIT_PATH", "audit.path", "audit.hmac_key_file is set but audit.path is empty; nothing will be recorded")
+		}
+		return
+	}
+	if cfg.MaxBytes < 0 || cfg.MaxFiles < 0 || cfg.Queue < 0 {
+		diag.Errorf("audit", "AUDIT_LIMITS", "audit", "max_bytes, max_files and queue must not be negative")
+		return
+	}
+	var key []byte
+	if cfg.HMACKeyFile != "" {
+		b, err := os.ReadFile(cfg.HMACKeyFile)
+		if err != nil {
+			diag.Errorf("audit", "AUDIT_HMAC_KEY", "audit.hmac_key_file", "failed to read HMAC key: %v", err)
+			return
+		}
+		if key = bytes.TrimSpace(b); len(key) < 16 {
+			diag.Errorf("audit", "AUDIT_HMAC_KEY", "audit.hmac_key_file", "HMAC key in %s must be at least 16 bytes", cfg.HMACKeyFile)
+			return
+		}
+	}
+	w, err := newAuditWriter(cfg, key, px.stop)
+	if err != nil {
+		diag.Errorf("audit", "AUDIT_FILE", "audit.path", "failed to open audit log: %v", err)
+		return
+	}
+	px.auditor = w
+}
+
+// AuditVerify implements the audit-verify subcommand; args excludes the
+// subcommand name. Files are given oldest first, e.g. audit.log.2 audit.log.1
+// audit.log. It returns the process exit code.
+func AuditVerify(args []string) int {
+	fs := flag.NewFlagSet("audit-verify", flag.ExitOnError)
+	keyFile := fs.String("hmac-key", "", "file holding the audit.hmac_key_file key, if the chain is keyed")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: proxy audit-verify [-hmac-key file] audit.log.N ... audit.log")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	var key []byte
+	if *keyFile != "" {
+		b, err := os.ReadFile(*keyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "audit-verify: %v\n", err)
+			return 2
+		}
+		key = bytes.TrimSpace(b)
+	}
+
+	var prev string
+	var seq, records, dropped uint64
+	first := true
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "audit-verify: %v\n", err)
+			return 2
+		}
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64<<10), 1<<20)
+		for n := 1; sc.Scan(); n++ {
+			line := sc.Bytes()
+			where := fmt.Sprintf("%s:%d", path, n)
+			body, sum, ok := splitChainHash(line)
+			var rec auditRecord
+			if !ok || json.Unmarshal(line, &rec) != nil {
+				fmt.Printf("%s: malformed record\n", where)
+				f.Close()
+				return 1
+			}
+			if !hmac.Equal([]byte(chainHash(key, body)), []byte(sum)) {
+				fmt.Printf("%s: seq %d: hash mismatch (record altered, or wrong -hmac-key)\n", where, rec.Seq)
+				f.Close()
+				return 1
+			}
+			// The first record checked may continue a chain whose start was rotated away
+			if !first && (rec.Prev != prev || rec.Seq != seq+1) {
+				fmt.Printf("%s: seq %d: chain broken after seq %d (records removed or reordered)\n", where, rec.Seq, seq)
+				f.Close()
+				return 1
+			}
+			if rec.Dropped > 0 {
+				fmt.Printf("%s: seq %d: %d record(s) dropped before this one\n", where, rec.Seq, rec.Dropped)
+			}
+			first = false
+			prev, seq = sum, rec.Seq
+			records++
+			dropped += rec.Dropped
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "audit-verify: %s: %v\n", path, err)
+			return 2
+		}
+	}
+	summary := fmt.Sprintf("ok: %d records", records)
+	if records > 0 {
+		summary += fmt.Sprintf(", last seq %d", seq)
+	}
+	if dropped > 0 {
+		summary += fmt.Sprintf(", %d dropped", dropped)
+	}
+	fmt.Println(summary)
+	return 0
+}
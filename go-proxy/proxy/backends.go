@@ -0,0 +1,314 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// EjectionConfig takes an endpoint out of rotation after consecutive failures
+type EjectionConfig struct {
+	ConsecutiveFailures int    `yaml:"consecutive_failures"` // default 5
+	Duration            string `yaml:"duration"`             // default "30s"
+}
+
+const dnsScheme = "dns:///"
+
+// endpoint is one resolved backend address and its health
+type endpoint struct {
+	addr      string
+	authority string // original host:port for DNS-resolved endpoints, so TLS verifies the name
+	labels    Labels
+
+	failures     int
+	ejectedUntil time.Time
+}
+
+// backendPool picks an endpoint for each upstream attempt. Each endpoint has
+// its own connection (see connManager), so balancing happens here rather than
+// in a gRPC balancer: pick_first sends everything to the first healthy
+// endpoint in config order, round_robin rotates across all healthy endpoints.
+// Endpoints that fail consecutively at the connection level are ejected for a
+// while.
+type backendPool struct {
+	targets    []string
+	roundRobin bool
+	ejectAfter int
+	ejectFor   time.Duration
+
+	mu        sync.Mutex
+	endpoints []*endpoint
+	next      int
+}
+
+func newBackendPool(cfg BackendConfig) (*backendPool, error) {
+	p := &backendPool{ejectAfter: 5, ejectFor: 30 * time.Second}
+	if cfg.Address != "" {
+		p.targets = append(p.targets, cfg.Address)
+	}
+	p.targets = append(p.targets, cfg.Addresses...)
+	if len(p.targets) == 0 {
+		return nil, fmt.Errorf("no backend address configured")
+	}
+
+	switch cfg.Policy {
+	case "", "pick_first":
+	case "round_robin":
+		p.roundRobin = true
+	default:
+		return nil, fmt.Errorf("unknown policy %q (expected pick_first or round_robin)", cfg.Policy)
+	}
+	if cfg.Ejection.ConsecutiveFailures < 0 {
+		return nil, fmt.Errorf("ejection.consecutive_failures must not be negative")
+	} else if cfg.Ejection.ConsecutiveFailures > 0 {
+		p.ejectAfter = cfg.Ejection.ConsecutiveFailures
+	}
+	if cfg.Ejection.Duration != "" {
+		d, err := time.ParseDuration(cfg.Ejection.Duration)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("ejection.duration: invalid duration %q", cfg.Ejection.Duration)
+		}
+		p.ejectFor = d
+	}
+	return p, nil
+}
+
+// hasDNSTargets reports whether any target needs periodic re-resolution
+func (p *backendPool) hasDNSTargets() bool {
+	for _, t := range p.targets {
+		if strings.HasPrefix(t, dnsScheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve expands dns:/// targets into one endpoint per address, keeping the
+// health state of endpoints that are still present
+func (p *backendPool) resolve(ctx context.Context) error {
+	var resolved []*endpoint
+	var errs []error
+	for _, t := range p.targets {
+		if !strings.HasPrefix(t, dnsScheme) {
+			resolved = append(resolved, &endpoint{addr: t})
+			continue
+		}
+		hostport := strings.TrimPrefix(t, dnsScheme)
+		host, port, err := net.SplitHostPort(hostport)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", t, err))
+			continue
+		}
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", t, err))
+			continue
+		}
+		for _, a := range addrs {
+			resolved = append(resolved, &endpoint{addr: net.JoinHostPort(a, port), authority: hostport})
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(resolved) == 0 {
+		// Keep serving from the last known endpoints rather than from nothing
+		return errors.Join(errs...)
+	}
+	known := make(map[string]*endpoint, len(p.endpoints))
+	for _, ep := range p.endpoints {
+		known[ep.addr] = ep
+	}
+	for i, ep := range resolved {
+		if old, ok := known[ep.addr]; ok {
+			resolved[i] = old
+			continue
+		}
+		ep.labels = Labels{"endpoint": ep.addr}
+		metrics.Set("proxy_backend_endpoint_healthy", ep.labels, 1)
+	}
+	p.endpoints = resolved
+	return errors.Join(errs...)
+}
+
+// startResolver re-resolves DNS targets every interval until stop is closed
+func (p *backendPool) startResolver(every time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), every)
+			if err := p.resolve(ctx); err != nil {
+				log.Printf("[Backend] Re-resolution failed: %v", err)
+			}
+			cancel()
+		}
+	}()
+}
+
+// pick returns the next healthy endpoint not in tried. When every endpoint is
+// ejected, the one closest to reinstatement is used so traffic keeps probing
+// instead of failing outright.
+func (p *backendPool) pick(tried map[string]bool) (*endpoint, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	n := len(p.endpoints)
+	start := 0
+	if p.roundRobin && n > 0 {
+		start = p.next % n
+		p.next++
+	}
+
+	var fallback *endpoint
+	for i := 0; i < n; i++ {
+		ep := p.endpoints[(start+i)%n]
+		if tried[ep.addr] {
+			continue
+		}
+		if now.After(ep.ejectedUntil) {
+			return ep, nil
+		}
+		if fallback == nil || ep.ejectedUntil.Before(fallback.ejectedUntil) {
+			fallback = ep
+		}
+	}
+	if fallback != nil && len(tried) == 0 {
+		return fallback, nil
+	}
+	return nil, rejectf(codes.Unavailable, reasonNoHealthyBackend, "proxy: no healthy backend endpoints")
+}
+
+// report records the outcome of one attempt against an endpoint. Only
+// connection-level failures count towards ejection; an application error from
+// the backend means the endpoint is up.
+func (p *backendPool) report(ep *endpoint, err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = status.Code(err).String()
+	}
+	metrics.Inc("proxy_backend_requests_total", Labels{"endpoint": ep.addr, "outcome": outcome})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !isConnectionFailure(err) {
+		if ep.failures > 0 || !ep.ejectedUntil.IsZero() {
+			ep.failures = 0
+			ep.ejectedUntil = time.Time{}
+			metrics.Set("proxy_backend_endpoint_healthy", ep.labels, 1)
+		}
+		return
+	}
+	ep.failures++
+	if ep.failures >= p.ejectAfter && time.Now().After(ep.ejectedUntil) {
+		ep.ejectedUntil = time.Now().Add(p.ejectFor)
+		metrics.Inc("proxy_backend_ejections_total", ep.labels)
+		metrics.Set("proxy_backend_endpoint_healthy", ep.labels, 0)
+		log.Printf("[Backend] Ejected %s for %s after %d consecutive failures", ep.addr, p.ejectFor, ep.failures)
+	}
+}
+
+// addresses lists endpoints with healthy ones first, for one-off startup work
+func (p *backendPool) addresses() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var healthy, ejected []string
+	now := time.Now()
+	for _, ep := range p.endpoints {
+		if now.After(ep.ejectedUntil) {
+			healthy = append(healthy, ep.addr)
+		} else {
+			ejected = append(ejected, ep.addr)
+		}
+	}
+	return append(healthy, ejected...)
+}
+
+// snapshot lists the endpoints as currently resolved
+func (p *backendPool) snapshot() []*endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*endpoint(nil), p.endpoints...)
+}
+
+func isConnectionFailure(err error) bool {
+	var timedOut *attemptTimeoutError
+	return status.Code(err) == codes.Unavailable || errors.As(err, &timedOut)
+}
+
+// dialEndpoint opens a client connection to one endpoint
+func (px *Proxy) dialEndpoint(ep *endpoint) (*grpc.ClientConn, error) {
+	opts := append(px.backendDialOptions(), grpc.WithDefaultCallOptions(grpc.ForceCodecV2(bytesCodec{})))
+	if ep.authority != "" {
+		opts = append(opts, grpc.WithAuthority(ep.authority))
+	}
+	if px.backendKeepalive != nil {
+		opts = append(opts, grpc.WithKeepaliveParams(*px.backendKeepalive))
+	}
+	if px.upstreamGzip != nil {
+		opts = append(opts, grpc.WithCompressor(px.upstreamGzip))
+	}
+	return grpc.Dial(ep.addr, opts...)
+}
+
+// loadBackends builds the endpoint pool and resolves DNS targets once before serving
+func (px *Proxy) loadBackends(diag *Diagnostics) {
+	cfg := px.cfg.Backend
+	switch cfg.Mode {
+	case "":
+	case backendModeMock:
+		if cfg.Address != "" || len(cfg.Addresses) > 0 {
+			diag.Warnf("backend", "BACKEND_MOCK", "backend.address", "backend addresses are not used in mock mode")
+		}
+		cfg = BackendConfig{Address: mockAddress}
+		px.mock = px.startMockBackend()
+	default:
+		diag.Errorf("backend", "BACKEND_CONFIG", "backend.mode", "unknown mode %q (expected mock, or none to forward)", cfg.Mode)
+		return
+	}
+	pool, err := newBackendPool(cfg)
+	if err != nil {
+		diag.Errorf("backend", "BACKEND_CONFIG", "backend", "%v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := pool.resolve(ctx); err != nil {
+		// The resolver keeps trying, so an unresolvable backend only fails
+		// startup when the schema must be reflected from it
+		if len(pool.endpoints) == 0 && (px.cfg.Schema.Method == "reflect" || px.cfg.Schema.Method == "both") && px.cfg.Schema.Required {
+			diag.Errorf("backend", "BACKEND_RESOLVE", "backend.addresses", "%v", err)
+			return
+		}
+		diag.Warnf("backend", "BACKEND_RESOLVE", "backend.addresses", "%v", err)
+	}
+	px.backends = pool
+
+	if pool.hasDNSTargets() {
+		every := 30 * time.Second
+		if px.cfg.Backend.ResolveInterval != "" {
+			d, err := time.ParseDuration(px.cfg.Backend.ResolveInterval)
+			if err != nil || d <= 0 {
+				diag.Errorf("backend", "BACKEND_RESOLVE_INTERVAL", "backend.resolve_interval", "invalid duration %q", px.cfg.Backend.ResolveInterval)
+				return
+			}
+			every = d
+		}
+		pool.startResolver(every, px.stop)
+	}
+	log.Printf("[Backend] %d endpoint(s) from %d target(s)", len(pool.endpoints), len(pool.targets))
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc/codes"
+)
+
+// --- Backend Response Attestation ---
+//
+// A signing backend puts an RSA-SHA256 signature over the response payload in
+// envelope.backend_sig_field. On inspect-verify-sign routes the proxy checks it
+// against cms.backend_trust_store, or the trust store the route's
+// response.verify names (directions.go), before relaying: a verified
+// signature is stripped and the proxy countersigns as usual, so the client
+// sees a single proxy attestation, unless response.sign is none. A response
+// that fails is handled by the route's backend_sig_on_fail policy and is
+// never countersigned.
+
+// Backend signature failure policies
+const (
+	backendSigReject  = "reject"  // fail the call with INTERNAL (default)
+	backendSigForward = "forward" // relay untouched, backend signature included
+	backendSigStrip   = "strip"   // relay with the backend signature removed
+)
+
+// backendSigKey checks sig over a payload's digest against every key route
+// trusts for responses, returning the id of the key that verifies it, or "" if
+// none does. An error means the call ended before the check started.
+func (px *Proxy) backendSigKey(ctx context.Context, route *RouteConfig, digest payloadDigest, sig []byte) (string, error) {
+	trust := px.cryptoPlanFor(route).response.trust
+	if len(sig) == 0 || trust == nil {
+		return "", nil
+	}
+	e := px.engineFor(route)
+	key, err := e.verifyKeys(ctx, trust, digest, sig)
+	if err != nil {
+		return "", err
+	}
+	countCrypto(e, "verify_backend")
+	return key, nil
+}
+
+// verifyBackendSig attests one response envelope. It reports whether the
+// response may be countersigned; an error rejects the response.
+func (px *Proxy) verifyBackendSig(ctx context.Context, msg *dynamic.Message, info MethodInfo, payload []byte) (bool, error) {
+	route, method, env := info.Route, info.Method, info.envelope
+	verifySpan := startChildSpan(ctx, "proxy.verify_backend", spanKindInternal)
+	sig := getBytesField(msg, env.backendSig)
+
+	result := "ok"
+	key, err := px.backendSigKey(ctx, route, info.digests.of(payload), sig)
+	if err != nil {
+		verifySpan.end(err)
+		return false, skipCancelled(ctx, route, false, "verify")
+	}
+	switch {
+	case sig == nil:
+		result = "missing"
+	case key == "":
+		result = "failed"
+	}
+	metrics.Inc("proxy_signature_verifications_total", Labels{"signer": "backend", "result": result, "shadow": shadowLabel(route)})
+	verifySpan.set("proxy.verify.result", result)
+
+	policy := route.BackendSigOnFail
+	if policy == "" {
+		policy = backendSigReject
+	}
+	ev := auditEvent{op: "verify", signer: "backend", decision: result, payload: payload, keyID: key}
+	if result != "ok" {
+		ev.reason = "policy: " + policy
+	}
+	if err := px.audit(ctx, method, route, false, ev); err != nil {
+		verifySpan.end(err)
+		return false, err
+	}
+
+	if result == "ok" {
+		verifySpan.end(nil)
+		log.Printf("[Response Security] Verified backend signature (len: %d) for %s", len(sig), method)
+		// The proxy signature replaces it when both share a field
+		if env.backendSig != env.proxySig {
+			msg.TryClearField(env.backendSig)
+		}
+		return true, nil
+	}
+
+	log.Printf("[Response Security Error] Backend signature %s for %s (policy: %s)", result, method, policy)
+	if trust := px.cryptoPlanFor(route).response.trust; result == "failed" && trust != nil {
+		px.sigDebug.report(sigMismatch{
+			info: info, signer: "backend", engine: px.engineFor(route).name(),
+			payload: payload, digest: info.digests.of(payload), sig: sig,
+			sigSource: sigFieldSource(env, "", false), store: trust.name, keyPEMs: trust.load().pems,
+		})
+	}
+	switch policy {
+	case backendSigStrip:
+		if env.backendSig != nil {
+			msg.TryClearField(env.backendSig)
+		}
+	case backendSigReject:
+		reason := reasonSignatureInvalid
+		if result == "missing" {
+			reason = reasonSignatureMissing
+		}
+		err := rejectf(codes.Internal, reason, "proxy: backend response signature %s", result)
+		verifySpan.end(err)
+		return false, err
+	}
+	verifySpan.end(nil)
+	return false, nil
+}
+
+// loadBackendTrustStore reads the RSA keys backends sign responses with
+func (px *Proxy) loadBackendTrustStore(path string, diag *Diagnostics) {
+	keys, err := px.loadTrustKeys(verbBackendTrust, path, "cms.backend_trust_store")
+	if err != nil {
+		diag.Errorf("cms", "CMS_BACKEND_TRUST_STORE", "cms.backend_trust_store", "failed to load backend trust store: %v", err)
+		return
+	}
+	px.backendTrust = keys
+}
+
+// loadBackendSignatures checks each route's backend_sig_field and policy
+func (px *Proxy) loadBackendSignatures(diag *Diagnostics) {
+	for i, route := range px.cfg.Routes {
+		path := fmt.Sprintf("routes[%d]", i)
+		signed := false
+		for _, v := range envelopeVariants(&route) {
+			signed = signed || v.Envelope.BackendSigField != ""
+		}
+		if !signed {
+			if route.BackendSigOnFail != "" {
+				diag.Warnf("routes", "ROUTE_BACKEND_SIG", path+".backend_sig_on_fail", "backend_sig_on_fail has no effect without envelope.backend_sig_field")
+			}
+			continue
+		}
+		if route.Mode != "inspect-verify-sign" {
+			diag.Warnf("routes", "ROUTE_BACKEND_SIG", path+".envelope.backend_sig_field", "backend signatures are only verified on inspect-verify-sign routes")
+			continue
+		}
+		switch route.BackendSigOnFail {
+		case "", backendSigReject, backendSigForward, backendSigStrip:
+		default:
+			diag.Errorf("routes", "ROUTE_BACKEND_SIG", path+".backend_sig_on_fail", "unknown policy %q (expected reject, forward or strip)", route.BackendSigOnFail)
+		}
+		if px.backendTrust == nil && (route.Response == nil || route.Response.Verify == "" || route.Response.Verify == verbBackendTrust) {
+			diag.Errorf("routes", "ROUTE_BACKEND_SIG", path+".envelope.backend_sig_field", "backend_sig_field needs cms.backend_trust_store")
+		}
+	}
+}
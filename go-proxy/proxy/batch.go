@@ -0,0 +1,273 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc/codes"
+)
+
+// --- Batch Envelopes ---
+//
+// Some envelopes batch work items instead of carrying one payload: a
+// repeated message field, each entry with its own payload and signatures.
+// envelope.items_field names that field, and the item_*_field options name
+// fields of the item message:
+//
+//	item_payload_field     the bytes each signature covers
+//	item_client_sig_field  the client's signature over them
+//	item_proxy_sig_field   where the proxy's signature goes (per_item)
+//
+// On an inspect-verify-sign route every request item's client signature is
+// verified and audited on its own, in place of the envelope's. An item whose
+// signature fails, or is missing, fails the batch according to
+// on_item_failure:
+//
+//	reject  (default) the call fails with UNAUTHENTICATED, SIGNATURE_INVALID,
+//	        naming how many items failed
+//	strip   the failing items are removed and the rest forwarded, with the
+//	        number removed in the envelope's metadata_field under
+//	        x-proxy-stripped-items
+//
+// batch_signature says how the proxy signs, in both directions:
+//
+//	per_item   (default) each item's payload, into its item_proxy_sig_field
+//	aggregate  once per message, over the SHA-256 digests of the item
+//	           payloads concatenated in item order, into the envelope's
+//	           proxy_sig_field (or list or metadata key); a batch of no items
+//	           signs the empty string
+//
+// A batch of no items verifies trivially. Items are counted in
+// proxy_batch_items_total by route and result (passed, failed). empty_payload
+// does not apply to items, and items are not spliced by preserve_wire_bytes.
+
+// Values of batch_signature and on_item_failure
+const (
+	batchSignPerItem   = "per_item"
+	batchSignAggregate = "aggregate"
+	itemFailureReject  = "reject"
+	itemFailureStrip   = "strip"
+)
+
+// strippedItemsKey is the metadata_field entry counting stripped items
+const strippedItemsKey = "x-proxy-stripped-items"
+
+// kindItems is the kind of items_field: a repeated message field
+const kindItems = "message_list"
+
+// batchItemFields are the item_*_field options resolved against the item type
+type batchItemFields struct {
+	payload, clientSig, proxySig *desc.FieldDescriptor
+}
+
+// itemFields lists an envelope's item_*_field options
+func itemFields(e EnvelopeConfig) []envelopeField {
+	return []envelopeField{
+		{"item_payload_field", e.ItemPayloadField, "bytes", false},
+		{"item_client_sig_field", e.ItemClientSigField, "bytes", false},
+		{"item_proxy_sig_field", e.ItemProxySigField, "bytes", false},
+	}
+}
+
+// perItemSigned reports whether the route signs each item of a batch
+func perItemSigned(e EnvelopeConfig) bool {
+	return e.ItemsField != "" && e.BatchSignature != batchSignAggregate
+}
+
+// batchDigest is what an aggregate signature covers: the SHA-256 of each
+// item's payload, in item order
+func batchDigest(msg *dynamic.Message, env *resolvedEnvelope) []byte {
+	digest := []byte{}
+	for _, item := range getRepeatedMessages(msg, env.items) {
+		sum := sha256.Sum256(getBytesField(item, env.item.payload))
+		digest = append(digest, sum[:]...)
+	}
+	return digest
+}
+
+// verifyItems checks the client signature of every item of a request batch,
+// then applies on_item_failure to those that failed
+func (px *Proxy) verifyItems(ctx context.Context, info MethodInfo, msg *dynamic.Message) error {
+	route, env := info.Route, info.envelope
+	items := getRepeatedMessages(msg, env.items)
+	kept := make([]*dynamic.Message, 0, len(items))
+	for _, item := range items {
+		verified, err := px.verifyClientSig(ctx, info, ClientToBackend, getBytesField(item, env.item.payload), getBytesField(item, env.item.clientSig))
+		if err != nil || verified == nil {
+			return err
+		}
+		if err := px.audit(ctx, info.Method, route, true, *verified); err != nil {
+			return err
+		}
+		result := "passed"
+		if verified.decision == "failed" || verified.decision == "missing" {
+			result = "failed"
+		} else {
+			kept = append(kept, item)
+		}
+		metrics.Inc("proxy_batch_items_total", Labels{"route": route.Name, "result": result, "shadow": shadowLabel(route)})
+	}
+	failed := len(items) - len(kept)
+	if failed == 0 {
+		return nil
+	}
+	if route.Envelope.OnItemFailure != itemFailureStrip {
+		log.Printf("[Request Security Error] %s: %d of %d batch items failed verification; rejecting the batch", info.Method, failed, len(items))
+		return rejectf(codes.Unauthenticated, reasonSignatureInvalid, "proxy: %d of %d batch items failed signature verification", failed, len(items)).with("failed_items", strconv.Itoa(failed))
+	}
+	log.Printf("[Request Security Error] %s: stripping %d of %d batch items that failed verification", info.Method, failed, len(items))
+	if err := msg.TryClearField(env.items); err != nil {
+		return err
+	}
+	for _, item := range kept {
+		if err := msg.TryAddRepeatedField(env.items, item); err != nil {
+			return err
+		}
+	}
+	return msg.TryPutMapField(env.metadata, strippedItemsKey, strconv.Itoa(failed))
+}
+
+// signItems signs each item's payload with key into its item_proxy_sig_field
+func (px *Proxy) signItems(ctx context.Context, info MethodInfo, dir Direction, key *signingKey, msg *dynamic.Message) error {
+	route, env, label := info.Route, info.envelope, dir.label()
+	for i, item := range getRepeatedMessages(msg, env.items) {
+		payload := getBytesField(item, env.item.payload)
+		sig, decision, err := px.signPayload(ctx, route, key, label, info.digests.of(payload))
+		if err != nil {
+			return skipCancelled(ctx, route, dir == ClientToBackend, "sign")
+		}
+		signed := auditEvent{op: "sign", signer: "proxy", decision: decision, payload: payload, keyID: key.id()}
+		if err := px.audit(ctx, info.Method, route, dir == ClientToBackend, signed); err != nil {
+			return err
+		}
+		if decision != "signed" {
+			return rejectf(codes.Internal, reasonSigningFailed, "proxy: could not sign %s batch item %d", dir.label(), i)
+		}
+		if err := setEnvelopeField(item, env.item.proxySig, sig); err != nil {
+			log.Printf("[%s Security Error] Could not set the proxy signature of batch item %d: %v", label, i, err)
+		}
+	}
+	return nil
+}
+
+// hideItemPayloads replaces each item's payload in a logged envelope, as
+// hidePayload does the envelope's
+func hideItemPayloads(js []byte, env *resolvedEnvelope, indent bool) []byte {
+	if env.items == nil || env.item.payload == nil {
+		return js
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(js, &obj); err != nil {
+		return js
+	}
+	for _, name := range []string{env.items.GetJSONName(), env.items.GetName()} {
+		items, ok := obj[name].([]interface{})
+		if !ok {
+			continue
+		}
+		for _, item := range items {
+			if fields, ok := item.(map[string]interface{}); ok {
+				for _, p := range []string{env.item.payload.GetJSONName(), env.item.payload.GetName()} {
+					if _, ok := fields[p]; ok {
+						fields[p] = redactedValue
+					}
+				}
+			}
+		}
+		return marshalLogJSON(obj, indent)
+	}
+	return js
+}
+
+// loadBatchEnvelopes checks items_field and the options that go with it
+func (px *Proxy) loadBatchEnvelopes(diag *Diagnostics) {
+	methods := px.knownMethods()
+	for i := range px.cfg.Routes {
+		for j, route := range envelopeVariants(&px.cfg.Routes[i]) {
+			e := route.Envelope
+			path := fmt.Sprintf("routes[%d].envelope", i)
+			if len(route.Envelopes) > 0 {
+				path = fmt.Sprintf("routes[%d].envelopes[%d]", i, j)
+			}
+			if e.ItemsField == "" {
+				for _, f := range itemFields(e) {
+					if f.name != "" {
+						diag.Warnf("routes", "ROUTE_BATCH", path+"."+f.key, "has no effect without items_field")
+					}
+				}
+				continue
+			}
+			if route.Mode != "inspect-verify-sign" {
+				diag.Warnf("routes", "ROUTE_BATCH", path+".items_field", "has no effect on %s routes", route.Mode)
+				continue
+			}
+			switch e.BatchSignature {
+			case "", batchSignPerItem:
+				if e.ItemProxySigField == "" {
+					diag.Errorf("routes", "ROUTE_BATCH", path+".item_proxy_sig_field", "batch_signature per_item needs a field on each item for the proxy signature")
+				}
+			case batchSignAggregate:
+				if e.ItemProxySigField != "" {
+					diag.Warnf("routes", "ROUTE_BATCH", path+".item_proxy_sig_field", "has no effect with batch_signature aggregate")
+				}
+			default:
+				diag.Errorf("routes", "ROUTE_BATCH", path+".batch_signature", "unknown batch signature %q (expected per_item or aggregate)", e.BatchSignature)
+			}
+			switch e.OnItemFailure {
+			case "", itemFailureReject:
+			case itemFailureStrip:
+				if e.MetadataField == "" {
+					diag.Errorf("routes", "ROUTE_BATCH", path+".on_item_failure", "strip records the items it removed in metadata_field, which is not set")
+				}
+			default:
+				diag.Errorf("routes", "ROUTE_BATCH", path+".on_item_failure", "unknown policy %q (expected reject or strip)", e.OnItemFailure)
+			}
+			if e.ItemPayloadField == "" {
+				diag.Errorf("routes", "ROUTE_BATCH", path+".item_payload_field", "needed to verify and sign the items")
+			}
+			if e.ItemClientSigField == "" && px.cryptoPlanFor(route).request.verify != verbNone {
+				diag.Errorf("routes", "ROUTE_BATCH", path+".item_client_sig_field", "needed to verify the items of requests; set it or request.verify: none")
+			}
+			if e.PayloadField != "" {
+				diag.Warnf("routes", "ROUTE_BATCH", path+".payload_field", "is neither verified nor signed on a batch envelope")
+			}
+			switch {
+			case route.PreserveWireBytes:
+				diag.Errorf("routes", "ROUTE_BATCH", path+".items_field", "preserve_wire_bytes cannot splice batch items")
+			case route.VerifyBeforeConnect:
+				diag.Errorf("routes", "ROUTE_BATCH", path+".items_field", "verify_before_connect verifies a single payload, not batch items")
+			}
+
+			// The item fields, on the item type of every matched method
+			seen := make(map[*desc.MessageDescriptor]bool)
+			for _, name := range methods {
+				md, ok := px.lookupMethod(name)
+				if !ok || !route.matches(name) || px.shadowedByBuiltin(*route, name) {
+					continue
+				}
+				for _, msgDesc := range []*desc.MessageDescriptor{md.GetInputType(), md.GetOutputType()} {
+					fd := msgDesc.FindFieldByName(e.ItemsField)
+					if fd == nil || !hasFieldKind(fd, kindItems) || seen[fd.GetMessageType()] {
+						continue // checkEnvelopes reports the items field itself
+					}
+					item := fd.GetMessageType()
+					seen[item] = true
+					for _, f := range itemFields(e) {
+						if f.name == "" {
+							continue
+						}
+						if err := checkEnvelopeField(item, f.name, f.kind, e.AllowTypeCoercion); err != nil {
+							diag.Errorf("routes", "ROUTE_BATCH", path+"."+f.key, "%q on %s (items of %s): %v", f.name, item.GetFullyQualifiedName(), name, err)
+						}
+					}
+				}
+			}
+		}
+	}
+}
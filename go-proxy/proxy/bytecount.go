@@ -0,0 +1,88 @@
+package proxy
+
+import "sync/atomic"
+
+// --- Byte Accounting ---
+//
+// Every message is counted where it crosses the proxy's edge, not inside
+// processMsg, so messages that are never processed (pass-thru routes, the
+// zero-copy path) and messages that are rejected are counted too:
+//
+//	original   the message as received, when RecvMsg returns it
+//	forwarded  the message as sent, once SendMsg succeeds
+//	overhead   forwarded minus original, for each forwarded message: what
+//	           signatures, mutations and metadata added (or removed)
+//
+// Each is recorded by method and direction (c2s, s2c) as a histogram of
+// message sizes, proxy_message_bytes{stage="original"|"forwarded"}, and a
+// running total, proxy_message_bytes_total; overhead is the histogram
+// proxy_message_overhead_bytes, whose sum is the running total and may go
+// down. A rejected message counts as original only, so the totals differ by
+// more than the overhead when a call is rejected. A unary response served
+// from the response cache never left the backend and counts as forwarded
+// only. The access log line carries each call's totals by direction.
+
+// Buckets for message sizes and for the size change a proxy makes to one
+var (
+	messageByteBuckets  = []float64{64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+	overheadByteBuckets = []float64{-1024, -256, -1, 0, 64, 128, 256, 512, 1024, 2048, 4096, 16 << 10}
+)
+
+// callBytes counts one call's messages and bytes by direction: c2s, s2c
+type callBytes struct {
+	messages  [2]atomic.Int64
+	original  [2]atomic.Int64
+	forwarded [2]atomic.Int64
+	overhead  [2]atomic.Int64
+}
+
+// byteTotals is one direction of callBytes in the access log
+type byteTotals struct {
+	Messages  int64 `json:"messages"`
+	Original  int64 `json:"original_bytes"`
+	Forwarded int64 `json:"forwarded_bytes"`
+	Overhead  int64 `json:"overhead_bytes"`
+}
+
+func (b *callBytes) totals(dir int) *byteTotals {
+	return &byteTotals{
+		Messages:  b.messages[dir].Load(),
+		Original:  b.original[dir].Load(),
+		Forwarded: b.forwarded[dir].Load(),
+		Overhead:  b.overhead[dir].Load(),
+	}
+}
+
+func (p *pump) dirIndex() int {
+	if p.isReq {
+		return 0
+	}
+	return 1
+}
+
+func (p *pump) stageLabels(stage string) Labels {
+	return Labels{"method": p.method, "direction": p.labels["direction"], "stage": stage}
+}
+
+// countReceived counts a message as RecvMsg returned it
+func (p *pump) countReceived(size int) {
+	dir := p.dirIndex()
+	p.timings.bytes.messages[dir].Add(1)
+	p.timings.bytes.original[dir].Add(int64(size))
+	metrics.ObserveBuckets("proxy_message_bytes", p.stageLabels("original"), messageByteBuckets, float64(size))
+	metrics.Add("proxy_message_bytes_total", p.stageLabels("original"), float64(size))
+}
+
+// countForwarded counts a message SendMsg sent, size bytes of what was
+// received as original bytes; a negative original was never received
+func (p *pump) countForwarded(original, size int) {
+	dir := p.dirIndex()
+	p.timings.bytes.forwarded[dir].Add(int64(size))
+	metrics.ObserveBuckets("proxy_message_bytes", p.stageLabels("forwarded"), messageByteBuckets, float64(size))
+	metrics.Add("proxy_message_bytes_total", p.stageLabels("forwarded"), float64(size))
+	if original < 0 {
+		return
+	}
+	p.timings.bytes.overhead[dir].Add(int64(size - original))
+	metrics.ObserveBuckets("proxy_message_overhead_bytes", p.labels, overheadByteBuckets, float64(size-original))
+}
@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// --- Response Cache ---
+//
+// A route with a cache block answers repeated unary calls from memory. The
+// key is the method and the SHA-256 of the request as it would be forwarded,
+// after verification, mutations, processors and signing, so two calls share
+// an entry only when the backend would have seen the same bytes. So is who
+// is calling: the client identity (see identity.go), the tenant, and the
+// value a sign_key_selector chose the response key by, so a caller is never
+// answered with a response the backend made, or the proxy signed, for
+// another. Other client metadata is not part of the key: only cache methods
+// whose response depends on the request message and the caller alone. A hit is answered without opening an upstream
+// stream. Only OK responses are stored, and entries expire after the TTL;
+// there is no other invalidation. Streaming calls are never cached.
+
+// CacheConfig caches a route's unary responses in memory
+type CacheConfig struct {
+	TTL        string   `yaml:"ttl"`         // e.g. "30s"; required
+	MaxEntries int      `yaml:"max_entries"` // least recently used entries go first; default 1000
+	Headers    []string `yaml:"headers"`     // response headers stored and replayed; others are not sent on hits
+}
+
+const defaultCacheEntries = 1000
+
+// cachedResponse is one stored answer
+type cachedResponse struct {
+	key     string
+	resp    []byte
+	header  metadata.MD
+	expires time.Time
+}
+
+// responseCache is an LRU of a route's responses
+type responseCache struct {
+	route      string
+	ttl        time.Duration
+	maxEntries int
+	headers    []string
+
+	mu      sync.Mutex
+	lru     *list.List // of *cachedResponse, most recently used first
+	entries map[string]*list.Element
+}
+
+func newResponseCache(route string, ttl time.Duration, maxEntries int, headers []string) *responseCache {
+	return &responseCache{route: route, ttl: ttl, maxEntries: maxEntries, headers: headers, lru: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// responseCacheKey is the entry the call's processed request maps to
+func responseCacheKey(ctx context.Context, method string, req []byte) string {
+	caller := []string{clientIdentityFromContext(ctx), tenantFromContext(ctx), ""}
+	if c := keyChoiceFrom(ctx); c != nil {
+		if v := c.value.Load(); v != nil {
+			caller[2] = *v
+		}
+	}
+	h := sha256.New()
+	for _, part := range caller {
+		// length-prefixed, so no two callers' parts run together alike
+		binary.Write(h, binary.BigEndian, uint32(len(part)))
+		h.Write([]byte(part))
+	}
+	h.Write(req)
+	return method + " " + hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns the live entry for key, counting the lookup
+func (c *responseCache) get(key string, now time.Time) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := "miss"
+	defer func() { metrics.Inc("proxy_cache_lookups_total", Labels{"route": c.route, "result": result}) }()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cachedResponse)
+	if !now.Before(e.expires) {
+		c.evict(el, "expired")
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	result = "hit"
+	return e, true
+}
+
+// put stores resp with the configured subset of header, evicting the least
+// recently used entry when the cache is full
+func (c *responseCache) put(key string, resp []byte, header metadata.MD, now time.Time) {
+	kept := metadata.MD{}
+	for _, h := range c.headers {
+		if v := header.Get(h); len(v) > 0 {
+			kept[h] = append([]string(nil), v...)
+		}
+	}
+	e := &cachedResponse{key: key, resp: resp, header: kept, expires: now.Add(c.ttl)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	for c.lru.Len() >= c.maxEntries {
+		c.evict(c.lru.Back(), "capacity")
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	metrics.AddGauge("proxy_cache_entries", Labels{"route": c.route}, 1)
+}
+
+// evict removes el; the caller holds mu
+func (c *responseCache) evict(el *list.Element, reason string) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cachedResponse).key)
+	metrics.AddGauge("proxy_cache_entries", Labels{"route": c.route}, -1)
+	metrics.Inc("proxy_cache_evictions_total", Labels{"route": c.route, "reason": reason})
+}
+
+// loadResponseCaches parses each route's cache block. Settings under which no
+// key could ever repeat fail startup; ones that make the cache moot or its
+// entries stale are warnings.
+func (px *Proxy) loadResponseCaches(diag *Diagnostics) {
+	methods := px.knownMethods()
+	for i, route := range px.cfg.Routes {
+		cfg := route.Cache
+		if cfg == nil {
+			continue
+		}
+		path := fmt.Sprintf("routes[%d].cache", i)
+		switch {
+		case route.Mode == "local-reply":
+			diag.Warnf("routes", "ROUTE_CACHE", path, "cache has no effect on local-reply routes")
+			continue
+		case route.Shadow:
+			diag.Warnf("routes", "ROUTE_CACHE", path, "cache is ignored on shadow routes, which must forward every call")
+			continue
+		case route.Mode == "encrypt-payload":
+			diag.Errorf("routes", "ROUTE_CACHE", path, "encrypt-payload requests carry a fresh nonce, so no two share a cache key")
+			continue
+		}
+		valid := true
+		for j, m := range route.Mutations {
+			if m.Op != "set_timestamp_now" {
+				continue
+			}
+			mpath := fmt.Sprintf("routes[%d].mutations[%d]", i, j)
+			if m.Direction == "response" {
+				diag.Warnf("routes", "ROUTE_CACHE", mpath, "cache hits replay the timestamp %s was set to when the response was stored", m.Field)
+				continue
+			}
+			diag.Errorf("routes", "ROUTE_CACHE", mpath, "set_timestamp_now on requests makes every cache key unique")
+			valid = false
+		}
+
+		d, err := time.ParseDuration(cfg.TTL)
+		if err != nil || d <= 0 {
+			diag.Errorf("routes", "ROUTE_CACHE", path+".ttl", "invalid duration %q", cfg.TTL)
+			valid = false
+		}
+		maxEntries := cfg.MaxEntries
+		if maxEntries == 0 {
+			maxEntries = defaultCacheEntries
+		}
+		if maxEntries < 0 {
+			diag.Errorf("routes", "ROUTE_CACHE", path+".max_entries", "must be positive, got %d", cfg.MaxEntries)
+			valid = false
+		}
+		headers := make([]string, 0, len(cfg.Headers))
+		for _, h := range cfg.Headers {
+			headers = append(headers, strings.ToLower(h))
+		}
+
+		matched, unary := 0, 0
+		for _, name := range methods {
+			if route.matches(name) && !px.shadowedByBuiltin(route, name) {
+				matched++
+				if px.isUnaryMethod(name) {
+					unary++
+				}
+			}
+		}
+		if matched > 0 && unary == 0 {
+			diag.Warnf("routes", "ROUTE_CACHE", path, "%s matches only streaming methods, which are never cached", route.Match)
+		}
+		if _, dup := px.routeCaches[route.Name]; valid && !dup {
+			px.routeCaches[route.Name] = newResponseCache(route.Name, d, maxEntries, headers)
+		}
+	}
+}
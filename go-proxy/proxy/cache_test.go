@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+)
+
+// TestResponseCacheKeyCaller checks that callers share an entry only when the
+// request, the client identity, the tenant and the chosen response key all
+// match
+func TestResponseCacheKeyCaller(t *testing.T) {
+	caller := func(identity, tenant string, key *string) context.Context {
+		ctx := context.WithValue(context.Background(), clientIdentityKey{}, identity)
+		ctx = context.WithValue(ctx, tenantKey{}, tenant)
+		if key != nil {
+			c := &keyChoice{}
+			c.value.Store(key)
+			ctx = context.WithValue(ctx, keyChoiceKey{}, c)
+		}
+		return ctx
+	}
+	partnerA, partnerB := "partner-a", "partner-b"
+	const method = "/echo.SecureService/SecureEcho"
+	req := []byte("request")
+	base := responseCacheKey(caller("alice", "acme", &partnerA), method, req)
+
+	if got := responseCacheKey(caller("alice", "acme", &partnerA), method, req); got != base {
+		t.Errorf("the same caller and request map to %q and %q", base, got)
+	}
+	for name, key := range map[string]string{
+		"another identity":   responseCacheKey(caller("bob", "acme", &partnerA), method, req),
+		"another tenant":     responseCacheKey(caller("alice", "globex", &partnerA), method, req),
+		"another key":        responseCacheKey(caller("alice", "acme", &partnerB), method, req),
+		"no key chosen":      responseCacheKey(caller("alice", "acme", nil), method, req),
+		"another request":    responseCacheKey(caller("alice", "acme", &partnerA), method, []byte("request2")),
+		"another method":     responseCacheKey(caller("alice", "acme", &partnerA), "/echo.EchoService/UnaryEcho", req),
+		"parts run together": responseCacheKey(caller("alic", "eacme", &partnerA), method, req),
+	} {
+		if key == base {
+			t.Errorf("%s shares the entry %q", name, key)
+		}
+	}
+	if anon := responseCacheKey(context.Background(), method, req); anon != responseCacheKey(caller(anonymousIdentity, "", nil), method, req) {
+		t.Errorf("a call without identity keys apart from the anonymous one")
+	}
+}
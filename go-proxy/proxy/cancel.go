@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"context"
+
+	"google.golang.org/grpc/status"
+)
+
+// --- Cancelled Calls ---
+//
+// A client that disconnects, cancels or runs out of deadline cancels its
+// stream's context, which every pump stage and processor receives. From then
+// on the proxy does no more work for the stream's messages: processMsg does
+// not start on one, the engines refuse to sign or verify, and the pumps drop
+// what their queues and workers still hold instead of sending it to the
+// backend or the client. Each message dropped that way is counted in
+// proxy_processing_skipped_total by route, direction and the stage it was
+// dropped at:
+//
+//   - process: before processing started, or while it waited for a cpu class slot
+//   - verify: when a signature check was about to start
+//   - sign: when the proxy signature was about to be made
+//   - send: processed, but still queued to be sent
+
+// skipCancelled returns nil while ctx is live. Once ctx has ended it counts
+// the message as skipped at stage and returns the status to end the stream with.
+func skipCancelled(ctx context.Context, route *RouteConfig, isReq bool, stage string) error {
+	err := ctx.Err()
+	if err == nil {
+		return nil
+	}
+	metrics.Inc("proxy_processing_skipped_total", Labels{"route": route.Name, "direction": directionOf(isReq).String(), "stage": stage, "shadow": shadowLabel(route)})
+	return status.FromContextError(err).Err()
+}
@@ -0,0 +1,359 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// --- Traffic Capture ---
+//
+// Routes with capture: true have every message they relay recorded to disk,
+// exactly as it was received and before any processing, for offline debugging
+// and for `proxy replay`. The data path only does a non-blocking send into a
+// bounded queue; decoding, redaction and file I/O happen on the writer
+// goroutine, and records are dropped (and counted) when it falls behind.
+// The file rotates by size as rotatefile.go describes.
+//
+// File format: the magic "PXCAP001", then one frame per message, each a
+// big-endian uint32 length followed by a protobuf-encoded record:
+//
+//	1: call id (varint)     2: unix nanos (varint)   3: method (string)
+//	4: direction (varint, 0 client->backend, 1 backend->client)
+//	5: raw message (bytes, absent if it could not be redacted)
+//	6: decoded JSON (string, when a descriptor was available)
+//	7: redacted (varint, 1 when fields were cleared from 5 and 6)
+
+// CaptureConfig sets where captured traffic goes; routes opt in with capture: true
+type CaptureConfig struct {
+	Path     string   `yaml:"path"`
+	MaxBytes int64    `yaml:"max_bytes"` // rotate once the file reaches this size; default 64 MiB
+	MaxFiles int      `yaml:"max_files"` // rotated files kept as path.1 .. path.N; default 3
+	Queue    int      `yaml:"queue"`     // records buffered ahead of the writer; default 1024
+	Redact   []string `yaml:"redact"`    // field paths cleared before writing, e.g. "client_signature", "metadata[token]"
+}
+
+const (
+	captureMagic = "PXCAP001"
+
+	captureC2S = 0
+	captureS2C = 1
+)
+
+var captureCallIDs atomic.Uint64
+
+type captureRecord struct {
+	call     uint64
+	at       time.Time
+	method   string
+	dir      int
+	raw      []byte
+	json     string
+	redacted bool
+}
+
+type captureWriter struct {
+	out    *rotatingFile
+	redact []mutation
+	lookup func(method string) (*desc.MethodDescriptor, bool)
+	limits decodeLimits // the global decode_limits, for requests
+	queue  chan *captureRecord
+	done   chan struct{} // closed once the writer has flushed and closed the file
+}
+
+// callCapture tags the messages of one call; nil when the route does not capture
+type callCapture struct {
+	w      *captureWriter
+	id     uint64
+	method string
+}
+
+func (px *Proxy) newCallCapture(method string, route *RouteConfig) *callCapture {
+	if px.capturer == nil || !route.Capture {
+		return nil
+	}
+	return &callCapture{w: px.capturer, id: captureCallIDs.Add(1), method: method}
+}
+
+// record queues one received message without ever blocking the caller
+func (c *callCapture) record(isReq bool, payload []byte) {
+	if c == nil {
+		return
+	}
+	dir := captureS2C
+	if isReq {
+		dir = captureC2S
+	}
+	select {
+	case c.w.queue <- &captureRecord{call: c.id, at: time.Now(), method: c.method, dir: dir, raw: payload}:
+	default:
+		metrics.Inc("proxy_capture_dropped_total", nil)
+	}
+}
+
+func newCaptureWriter(cfg CaptureConfig, redact []mutation, lookup func(string) (*desc.MethodDescriptor, bool), stop <-chan struct{}) (*captureWriter, error) {
+	maxBytes, maxFiles := cfg.MaxBytes, cfg.MaxFiles
+	if maxBytes == 0 {
+		maxBytes = 64 << 20
+	}
+	if maxFiles == 0 {
+		maxFiles = 3
+	}
+	queue := cfg.Queue
+	if queue == 0 {
+		queue = 1024
+	}
+	out, err := newRotatingFile(cfg.Path, maxBytes, maxFiles, captureMagic, "Capture", "proxy_capture")
+	if err != nil {
+		return nil, err
+	}
+	w := &captureWriter{out: out, redact: redact, lookup: lookup, queue: make(chan *captureRecord, queue), done: make(chan struct{})}
+	go w.run(stop)
+	return w, nil
+}
+
+// run writes records until stop is closed, then writes whatever is still
+// queued and closes the file
+func (w *captureWriter) run(stop <-chan struct{}) {
+	defer close(w.done)
+	for {
+		select {
+		case rec := <-w.queue:
+			w.write(rec)
+		case <-stop:
+			for len(w.queue) > 0 {
+				w.write(<-w.queue)
+			}
+			w.out.close()
+			return
+		}
+		// Flush whenever the queue is drained so the file trails live traffic closely
+		if len(w.queue) == 0 {
+			w.out.flush()
+		}
+	}
+}
+
+func (w *captureWriter) write(rec *captureRecord) {
+	w.decode(rec)
+	frame := rec.encode()
+	if err := w.out.write(frame); err != nil {
+		log.Printf("[Capture] Write failed: %v", err)
+		metrics.Inc("proxy_capture_dropped_total", nil)
+		return
+	}
+	metrics.Inc("proxy_capture_records_total", nil)
+	metrics.Add("proxy_capture_bytes_total", nil, float64(len(frame)))
+}
+
+// decode fills in the JSON form and applies redaction. A message that cannot
+// be decoded cannot be redacted either, so its raw bytes are left out.
+func (w *captureWriter) decode(rec *captureRecord) {
+	md, ok := w.lookup(rec.method)
+	var msg *dynamic.Message
+	if ok {
+		if rec.dir == captureC2S {
+			msg = dynamic.NewMessage(md.GetInputType())
+			if w.limits.check(md.GetInputType(), rec.raw) != nil {
+				msg = nil
+			}
+		} else {
+			msg = dynamic.NewMessage(md.GetOutputType())
+		}
+		if msg != nil && msg.Unmarshal(rec.raw) != nil {
+			msg = nil
+		}
+	}
+	if msg == nil {
+		if len(w.redact) > 0 {
+			rec.raw = nil
+			metrics.Inc("proxy_capture_unredactable_total", nil)
+		}
+		return
+	}
+
+	for i := range w.redact {
+		m := &w.redact[i]
+		// A path that does not exist on this message type has nothing to clear
+		if _, err := m.resolve(msg.GetMessageDescriptor()); err != nil {
+			continue
+		}
+		if err := m.apply(msg, rec.at); err == nil {
+			rec.redacted = true
+		}
+	}
+	if rec.redacted {
+		raw, err := marshalDynamic(msg)
+		if err != nil {
+			raw = nil
+		}
+		rec.raw = raw
+	}
+	if js, err := msg.MarshalJSON(); err == nil {
+		rec.json = string(js)
+	}
+}
+
+func (rec *captureRecord) encode() []byte {
+	b := make([]byte, 4, 64+len(rec.raw)+len(rec.json))
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, rec.call)
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(rec.at.UnixNano()))
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	b = protowire.AppendString(b, rec.method)
+	b = protowire.AppendTag(b, 4, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(rec.dir))
+	if rec.raw != nil {
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendBytes(b, rec.raw)
+	}
+	if rec.json != "" {
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendString(b, rec.json)
+	}
+	if rec.redacted {
+		b = protowire.AppendTag(b, 7, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	return b
+}
+
+func decodeCaptureRecord(b []byte) (*captureRecord, error) {
+	rec := &captureRecord{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+			switch num {
+			case 1:
+				rec.call = v
+			case 2:
+				rec.at = time.Unix(0, int64(v))
+			case 4:
+				rec.dir = int(v)
+			case 7:
+				rec.redacted = v == 1
+			}
+		case typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+			switch num {
+			case 3:
+				rec.method = string(v)
+			case 5:
+				rec.raw = append([]byte{}, v...)
+			case 6:
+				rec.json = string(v)
+			}
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return rec, nil
+}
+
+// readCapture calls fn for each record in a capture file, in order
+func readCapture(path string, fn func(*captureRecord) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != captureMagic {
+		return fmt.Errorf("%s is not a capture file", path)
+	}
+	var hdr [4]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		frame := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return fmt.Errorf("truncated frame: %w", err)
+		}
+		rec, err := decodeCaptureRecord(frame)
+		if err != nil {
+			return fmt.Errorf("corrupt frame: %w", err)
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// loadCapture validates the capture block and starts the writer
+func (px *Proxy) loadCapture(diag *Diagnostics) {
+	cfg := px.cfg.Capture
+	capturing := false
+	for _, route := range px.cfg.Routes {
+		capturing = capturing || route.Capture
+	}
+	if cfg.Path == "" {
+		if capturing {
+			diag.Warnf("capture", "CAPTURE_PATH", "capture.path", "routes set capture: true but capture.path is empty; nothing will be recorded")
+		}
+		return
+	}
+	if cfg.MaxBytes < 0 || cfg.MaxFiles < 0 || cfg.Queue < 0 {
+		diag.Errorf("capture", "CAPTURE_LIMITS", "capture", "max_bytes, max_files and queue must not be negative")
+		return
+	}
+	var redact []mutation
+	ok := true
+	for i, field := range cfg.Redact {
+		m, err := parseMutation(MutationConfig{Op: "clear", Field: field, Direction: "both"})
+		if err != nil {
+			diag.Errorf("capture", "CAPTURE_REDACT", fmt.Sprintf("capture.redact[%d]", i), "%v", err)
+			ok = false
+			continue
+		}
+		redact = append(redact, m)
+	}
+	if !ok {
+		return
+	}
+	w, err := newCaptureWriter(cfg, redact, px.lookupMethod, px.stop)
+	if err != nil {
+		diag.Errorf("capture", "CAPTURE_FILE", "capture.path", "failed to open capture file: %v", err)
+		return
+	}
+	w.limits = px.decodeLimits
+	px.capturer = w
+	if !capturing {
+		diag.Warnf("capture", "CAPTURE_PATH", "capture.path", "no route sets capture: true")
+	}
+	log.Printf("[Capture] Recording to %s (rotating at %d bytes, %d files kept)", w.out.path, w.out.maxBytes, w.out.maxFiles)
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+)
+
+// TestCaptureRotationFailure blocks the rename rotation needs and checks the
+// writer keeps appending to the current file instead of losing records
+func TestCaptureRotationFailure(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "calls.pxcap")
+	// A non-empty directory where path.1 belongs cannot be renamed over
+	if err := os.MkdirAll(filepath.Join(path+".1", "in-the-way"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	noDescriptors := func(string) (*desc.MethodDescriptor, bool) { return nil, false }
+	stop := make(chan struct{})
+	w, err := newCaptureWriter(CaptureConfig{Path: path, MaxBytes: 256, MaxFiles: 1}, nil, noDescriptors, stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := counterValue("proxy_capture_rotation_errors_total", nil)
+	const records = 20
+	for i := 0; i < records; i++ {
+		w.queue <- &captureRecord{call: uint64(i), at: time.Now(), method: "/echo.EchoService/UnaryEcho", raw: make([]byte, 64)}
+	}
+	close(stop)
+	<-w.done
+
+	n := 0
+	if err := readCapture(path, func(*captureRecord) error { n++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if n != records {
+		t.Errorf("capture file holds %d records, want all %d", n, records)
+	}
+	if got := counterValue("proxy_capture_rotation_errors_total", nil) - before; got == 0 {
+		t.Errorf("failed rotations were not counted")
+	}
+}
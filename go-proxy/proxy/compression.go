@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+	_ "google.golang.org/grpc/encoding/gzip" // registers gzip
+)
+
+// --- Message Compression ---
+//
+// Compression is a transport concern in gRPC: the server decompresses each
+// message with the compressor named by the request's grpc-encoding before the
+// bytesCodec sees it, and the client stream compresses after the codec. Every
+// mode therefore works on plain protobuf bytes, and the encoding has to be
+// chosen again for each hop. Responses to the client use the client's own
+// encoding. Upstream, the proxy compresses with the client's encoding unless
+// backend.compression.upstream says otherwise.
+//
+// gzip and zstd are built in. Other compressors (snappy, ...) are picked up
+// once an embedding program registers them with encoding.RegisterCompressor
+// before NewProxy; without one, a client using that encoding is refused by
+// the server with UNIMPLEMENTED.
+//
+// Compressors are registered process-wide by name, so gzip_level cannot
+// change the registered gzip without changing it for every proxy (and every
+// other client) in the process. It instead builds a gzip compressor for this
+// proxy's backend connections alone, used for each call whose upstream
+// encoding is gzip; responses to clients are gzipped at the default level.
+
+// CompressionConfig selects how messages are compressed towards the backend
+type CompressionConfig struct {
+	// Upstream is "client" (default, same encoding as the client's request),
+	// "identity" for none, or a registered compressor name such as "gzip"
+	Upstream string `yaml:"upstream"`
+	// GzipLevel is -1 (library default) or 0 (none) to 9 (best); it applies
+	// to the messages the proxy gzips towards the backend
+	GzipLevel *int `yaml:"gzip_level"`
+}
+
+func init() {
+	encoding.RegisterCompressor(&zstdCompressor{})
+}
+
+// zstdCompressor is the "zstd" grpc-encoding. Decompression streams, so
+// max_recv_msg_size stops a message that inflates past it part way.
+type zstdCompressor struct {
+	encoders sync.Pool
+	decoders sync.Pool
+}
+
+func (c *zstdCompressor) Name() string { return "zstd" }
+
+func (c *zstdCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	if enc, ok := c.encoders.Get().(*zstd.Encoder); ok {
+		enc.Reset(w)
+		return &zstdWriter{Encoder: enc, pool: &c.encoders}, nil
+	}
+	enc, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return &zstdWriter{Encoder: enc, pool: &c.encoders}, nil
+}
+
+func (c *zstdCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	if dec, ok := c.decoders.Get().(*zstd.Decoder); ok {
+		if err := dec.Reset(r); err != nil {
+			c.decoders.Put(dec)
+			return nil, err
+		}
+		return &zstdReader{Decoder: dec, pool: &c.decoders}, nil
+	}
+	dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return &zstdReader{Decoder: dec, pool: &c.decoders}, nil
+}
+
+// zstdWriter returns its encoder to the pool once the message is written
+type zstdWriter struct {
+	*zstd.Encoder
+	pool *sync.Pool
+}
+
+func (w *zstdWriter) Close() error {
+	defer w.pool.Put(w.Encoder)
+	return w.Encoder.Close()
+}
+
+// zstdReader returns its decoder to the pool at the end of the message
+type zstdReader struct {
+	*zstd.Decoder
+	pool *sync.Pool
+}
+
+func (r *zstdReader) Read(p []byte) (int, error) {
+	if r.Decoder == nil {
+		return 0, io.EOF
+	}
+	n, err := r.Decoder.Read(p)
+	if err == io.EOF {
+		r.pool.Put(r.Decoder)
+		r.Decoder = nil
+	}
+	return n, err
+}
+
+// requestEncoding is the grpc-encoding the client compressed its messages with
+func requestEncoding(ctx context.Context) string {
+	if s, ok := grpc.ServerTransportStreamFromContext(ctx).(interface{ RecvCompress() string }); ok {
+		return s.RecvCompress()
+	}
+	return ""
+}
+
+// upstreamCallOptions compresses the backend stream of a call with the
+// configured encoding, or the client's. A gzip call is left to the backend
+// connection's compressor when gzip_level set one; every other call names
+// its encoding, identity included, so that compressor does not apply.
+func (px *Proxy) upstreamCallOptions(ctx context.Context) []grpc.CallOption {
+	name := px.cfg.Backend.Compression.Upstream
+	if name == "" || name == "client" {
+		name = requestEncoding(ctx)
+	}
+	if name == "" {
+		name = encoding.Identity
+	}
+	if name == "gzip" && px.upstreamGzip != nil {
+		return nil
+	}
+	if name == encoding.Identity && px.upstreamGzip == nil {
+		return nil
+	}
+	return []grpc.CallOption{grpc.UseCompressor(name)}
+}
+
+// loadCompression checks the upstream encoding is available and builds the
+// gzip compressor for gzip_level
+func (px *Proxy) loadCompression(diag *Diagnostics) {
+	cfg := px.cfg.Backend.Compression
+	switch cfg.Upstream {
+	case "", "client", "identity":
+	default:
+		if encoding.GetCompressor(cfg.Upstream) == nil {
+			diag.Errorf("backend", "BACKEND_COMPRESSION", "backend.compression.upstream", "compressor %q is not registered (gzip and zstd are built in; others must be registered with encoding.RegisterCompressor)", cfg.Upstream)
+		}
+	}
+	if cfg.GzipLevel != nil {
+		cp, err := grpc.NewGZIPCompressorWithLevel(*cfg.GzipLevel)
+		if err != nil {
+			diag.Errorf("backend", "BACKEND_COMPRESSION", "backend.compression.gzip_level", "gzip_level must be between -1 and 9, got %d", *cfg.GzipLevel)
+			return
+		}
+		px.upstreamGzip = cp
+	}
+}
@@ -0,0 +1,327 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/jhump/protoreflect/desc"
+)
+
+// --- Route Config Checks ---
+//
+// A typo in a route (a misspelled mode, a match pattern the matcher cannot
+// satisfy, an envelope field the method's messages do not have) otherwise only
+// shows up as a stream of per-message log lines once traffic arrives. These
+// checks run while the proxy is built so every such problem fails startup in
+// the same diagnostics report as everything else.
+
+var routeModes = []string{"pass-thru", "inspect-outer", "inspect-verify-sign", "encrypt-payload", "local-reply", "session-token", "wrap-envelope"}
+
+// checkRoutes validates each route's mode and match pattern; it needs no
+// descriptors, so it runs before anything is loaded
+func (px *Proxy) checkRoutes(diag *Diagnostics) {
+	names := make(map[string]int)
+	for i, route := range px.cfg.Routes {
+		path := fmt.Sprintf("routes[%d]", i)
+		switch first, dup := names[route.Name]; {
+		case route.Name == "":
+			diag.Errorf("routes", "ROUTE_NAME", path+".name", "name is required")
+		case route.Name == defaultRouteName || route.Name == builtinRouteName:
+			diag.Errorf("routes", "ROUTE_NAME", path+".name", "%q is reserved for the proxy's implicit routes", route.Name)
+		case dup:
+			diag.Errorf("routes", "ROUTE_NAME", path+".name", "name %q is already used by routes[%d]", route.Name, first)
+		default:
+			names[route.Name] = i
+		}
+		if !slices.Contains(routeModes, route.Mode) {
+			msg := fmt.Sprintf("unknown mode %q (expected one of %s)", route.Mode, strings.Join(routeModes, ", "))
+			if route.Mode == "" {
+				msg = fmt.Sprintf("mode is required (one of %s)", strings.Join(routeModes, ", "))
+			} else if s := closest(route.Mode, routeModes); s != "" {
+				msg += fmt.Sprintf("; did you mean %q?", s)
+			}
+			diag.Errorf("routes", "ROUTE_MODE", path+".mode", "%s", msg)
+		}
+		if err := checkMatchPattern(route.Match); err != nil {
+			diag.Errorf("routes", "ROUTE_MATCH", path+".match", "%v", err)
+		}
+		if route.Shadow && (route.Mode == "pass-thru" || route.Mode == "local-reply") {
+			diag.Warnf("routes", "ROUTE_SHADOW", path+".shadow", "shadow has no effect on %s routes, which do not process messages", route.Mode)
+		}
+	}
+}
+
+// checkMatchPattern accepts the two forms matches understands: an exact
+// "/pkg.Service/Method", or a prefix ending in "/*" ("/*" alone covers everything)
+func checkMatchPattern(match string) error {
+	if match == "" {
+		return fmt.Errorf("match is required")
+	}
+	if !strings.HasPrefix(match, "/") {
+		return fmt.Errorf("match %q must start with \"/\"", match)
+	}
+	prefix, wildcard := strings.CutSuffix(match, "/*")
+	if strings.Contains(prefix, "*") {
+		return fmt.Errorf("match %q: wildcards are only supported as a trailing \"/*\"", match)
+	}
+	if wildcard {
+		if strings.Count(prefix, "/") > 1 {
+			return fmt.Errorf("match %q: \"/*\" must follow a service name, e.g. /pkg.Service/*", match)
+		}
+		return nil
+	}
+	parts := strings.Split(strings.TrimPrefix(match, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("match %q must be /pkg.Service/Method or end in \"/*\"", match)
+	}
+	return nil
+}
+
+type envelopeField struct {
+	key, name, kind string // kind is how processMsg reads it; empty accepts any field
+	responseOnly    bool
+}
+
+// envelopeFields lists a route's configured envelope fields,
+// but those read from stream metadata
+func envelopeFields(e EnvelopeConfig) []envelopeField {
+	typeURL, clientSig := e.TypeURLField, e.ClientSigField
+	if _, ok := metadataSource(typeURL); ok {
+		typeURL = ""
+	}
+	if _, ok := metadataSource(clientSig); ok {
+		clientSig = ""
+	}
+	return []envelopeField{
+		{"payload_field", e.PayloadField, "bytes", false},
+		{"type_url_field", typeURL, "string", false},
+		{"client_sig_field", clientSig, "bytes", false},
+		{"proxy_sig_field", e.ProxySigField, "bytes", false},
+		{"proxy_sig_list_field", e.ProxySigListField, kindSigList, false},
+		{"metadata_field", e.MetadataField, kindStringMap, false},
+		{"items_field", e.ItemsField, kindItems, false},
+		{"backend_sig_field", e.BackendSigField, "bytes", true},
+	}
+}
+
+// checkEnvelopes resolves every configured envelope field against the input
+// type of each loaded method the route matches. The same fields are read from
+// responses, so a missing field on an output type is only a warning unless
+// schema.strict_envelopes is set: those responses follow the route's
+// on_decode_failure. A field of the wrong type is an error on either; see
+// fieldtypes.go. Response-only fields must exist on the output type. The
+// resolutions are kept for processMsg, except on a lazy schema, whose
+// descriptors may be evicted. A route with envelopes has each checked.
+func (px *Proxy) checkEnvelopes(diag *Diagnostics) {
+	methods := px.knownMethods()
+	responsef := diag.Warnf
+	if px.cfg.Schema.StrictEnvelopes {
+		responsef = diag.Errorf
+	}
+	for i := range px.cfg.Routes {
+		for j, route := range envelopeVariants(&px.cfg.Routes[i]) {
+			if route.Mode == "pass-thru" || route.Mode == "local-reply" || route.Mode == "wrap-envelope" {
+				continue // wrap-envelope's are checked against wrap's types
+			}
+			path := fmt.Sprintf("routes[%d].envelope", i)
+			if len(route.Envelopes) > 0 {
+				path = fmt.Sprintf("routes[%d].envelopes[%d]", i, j)
+			}
+			fields := envelopeFields(route.Envelope)
+			coerce := route.Envelope.AllowTypeCoercion
+			if route.Mode == "inspect-verify-sign" && !perItemSigned(route.Envelope) && route.Envelope.ProxySigField == "" && route.Envelope.ProxySigListField == "" && route.Envelope.ProxySigMetadataKey == "" {
+				diag.Errorf("routes", "ROUTE_ENVELOPE", path+".proxy_sig_field", "mode inspect-verify-sign needs a proxy_sig_field, proxy_sig_list_field or proxy_sig_metadata_key to carry the proxy signature")
+			}
+
+			// Methods sharing a message type are checked and resolved once per type
+			seen := make(map[string]bool)
+			resolved := make(map[*desc.MessageDescriptor]*resolvedEnvelope)
+			resolve := func(md *desc.MessageDescriptor) *resolvedEnvelope {
+				if resolved[md] == nil {
+					resolved[md] = resolveEnvelope(route.Envelope, md)
+				}
+				return resolved[md]
+			}
+			for _, name := range methods {
+				if !route.matches(name) || px.shadowedByBuiltin(*route, name) {
+					continue
+				}
+				md, ok := px.lookupMethod(name)
+				if !ok {
+					continue
+				}
+				in, out := md.GetInputType(), md.GetOutputType()
+				if px.lazySchema == nil {
+					px.routeEnvelopes[envelopeKey(route, name, true)] = resolve(in)
+					px.routeEnvelopes[envelopeKey(route, name, false)] = resolve(out)
+				}
+				if key := "oneof " + in.GetFullyQualifiedName(); !seen[key] {
+					seen[key] = true
+					for _, c := range oneofConflicts(in, fields, false) {
+						diag.Errorf("routes", "ROUTE_ENVELOPE", path, "%s (request of %s): %s", in.GetFullyQualifiedName(), name, c)
+					}
+				}
+				if key := "oneof " + out.GetFullyQualifiedName(); !seen[key] {
+					seen[key] = true
+					for _, c := range oneofConflicts(out, fields, true) {
+						responsef("routes", "ROUTE_ENVELOPE", path, "%s (response of %s): %s", out.GetFullyQualifiedName(), name, c)
+					}
+				}
+				for _, f := range fields {
+					if f.name == "" {
+						continue
+					}
+					if f.responseOnly {
+						if key := f.key + " " + out.GetFullyQualifiedName(); !seen[key] {
+							seen[key] = true
+							if err := checkEnvelopeField(out, f.name, f.kind, coerce); err != nil {
+								diag.Errorf("routes", "ROUTE_ENVELOPE", path+"."+f.key, "%q on %s (response of %s): %v", f.name, out.GetFullyQualifiedName(), name, err)
+							}
+						}
+						continue
+					}
+					if key := f.key + " " + in.GetFullyQualifiedName(); !seen[key] {
+						seen[key] = true
+						if err := checkEnvelopeField(in, f.name, f.kind, coerce); err != nil {
+							diag.Errorf("routes", "ROUTE_ENVELOPE", path+"."+f.key, "%q on %s (request of %s): %v", f.name, in.GetFullyQualifiedName(), name, err)
+							continue
+						}
+					}
+					if key := f.key + " " + out.GetFullyQualifiedName(); !seen[key] {
+						seen[key] = true
+						// A missing field is only a warning; a mistyped one never is
+						report := responsef
+						if out.FindFieldByName(f.name) != nil {
+							report = diag.Errorf
+						}
+						if err := checkEnvelopeField(out, f.name, f.kind, coerce); err != nil {
+							report("routes", "ROUTE_ENVELOPE", path+"."+f.key, "%q on %s (response of %s): %v", f.name, out.GetFullyQualifiedName(), name, err)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// oneofConflicts describes envelope fields that are members of the same oneof
+// in md. Only one member can be set at a time, so the proxy could not write
+// its signature without clearing the client's, nor read both fields of one
+// message. The backend signature is cleared before the proxy signature is
+// set, so those two may share a oneof on responses.
+func oneofConflicts(md *desc.MessageDescriptor, fields []envelopeField, response bool) []string {
+	var groups []string
+	members := make(map[string][]string)
+	names := make(map[string]map[string]bool)
+	for _, f := range fields {
+		if f.name == "" || (f.responseOnly && !response) {
+			continue
+		}
+		fd := md.FindFieldByName(f.name)
+		if fd == nil || fd.GetOneOf() == nil || fd.GetOneOf().IsSynthetic() {
+			continue
+		}
+		od := fd.GetOneOf().GetName()
+		if names[od] == nil {
+			names[od] = make(map[string]bool)
+			groups = append(groups, od)
+		}
+		if !names[od][f.name] {
+			names[od][f.name] = true
+			members[od] = append(members[od], f.key)
+		}
+	}
+	var out []string
+	for _, od := range groups {
+		keys := members[od]
+		if len(keys) < 2 {
+			continue
+		}
+		if len(keys) == 2 && slices.Contains(keys, "proxy_sig_field") && slices.Contains(keys, "backend_sig_field") {
+			continue
+		}
+		out = append(out, fmt.Sprintf("%s are members of oneof %s, and only one of them can be set", strings.Join(keys, " and "), od))
+	}
+	return out
+}
+
+// shadowedByBuiltin reports whether calls to name bypass route because the
+// built-in reflection and health pass-thru takes them first
+func (px *Proxy) shadowedByBuiltin(route RouteConfig, name string) bool {
+	b := px.builtinRoute(name)
+	return b != nil && b.Match != route.Match
+}
+
+// checkEnvelopeField reports a missing or mistyped field, naming the closest
+// field the message does have
+func checkEnvelopeField(md *desc.MessageDescriptor, name, kind string, coerce bool) error {
+	fd := md.FindFieldByName(name)
+	if fd == nil {
+		var names []string
+		for _, f := range md.GetFields() {
+			names = append(names, f.GetName())
+		}
+		sort.Strings(names)
+		msg := "no such field"
+		if s := closest(name, names); s != "" {
+			msg += fmt.Sprintf("; did you mean %q?", s)
+		}
+		if len(names) > 0 {
+			msg += fmt.Sprintf(" (fields: %s)", strings.Join(names, ", "))
+		}
+		return fmt.Errorf("%s", msg)
+	}
+	return fieldTypeError(fd, kind, coerce)
+}
+
+// kindSigList is the kind of proxy_sig_list_field; see isSigList
+const kindSigList = "signature_list"
+
+// hasFieldKind reports whether fd can be read as kind: "bytes" and "string"
+// need a singular field of that type, kindStringMap a map<string, string>,
+// kindSigList a signature list, and "" accepts any
+func hasFieldKind(fd *desc.FieldDescriptor, kind string) bool {
+	switch kind {
+	case kindSigList:
+		return isSigList(fd)
+	case kindStringMap:
+		return stringMap(fd)
+	case kindItems:
+		return fd.IsRepeated() && !fd.IsMap() && fd.GetMessageType() != nil
+	}
+	t, ok := scalarKinds[kind]
+	return !ok || (fd.GetType() == t && !fd.IsRepeated())
+}
+
+// closest returns the candidate within a small edit distance of s, if any
+func closest(s string, candidates []string) string {
+	best, bestDist := "", len(s)/3+2
+	for _, c := range candidates {
+		if d := editDistance(s, c); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,427 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// --- Config Includes and Templates ---
+//
+// A deployment with many routes mostly repeats one envelope mapping and a few
+// sets of route settings. Three top-level keys keep each in one place:
+//
+//	envelope_templates  name -> envelope block, which a route's
+//	                    envelope_template names
+//	route_defaults      name -> route keys, which a route's defaults names
+//	include             files, or globs of them, whose routes are added
+//	                    after this file's
+//
+// Merging is by key and deterministic: where both sides hold a mapping it
+// recurses, and otherwise the more specific side's value replaces the other
+// whole, so a list is never concatenated and a null (~) drops a default. A
+// route's own keys win over its defaults', which win over the envelope
+// template's; the route's envelope_template, or else its defaults', is the
+// one used. route_defaults entries cannot name defaults of their own, or a
+// route name. The route as merged is what the rest of startup sees.
+//
+// Include paths are relative to the including file, and a glob's matches
+// are read in lexical order, each file once. An included file holds only
+// routes, envelope_templates and route_defaults, which join the including
+// file's; it cannot include more. A route, template or defaults name defined
+// in two files is CONFIG_DUPLICATE, naming both; an unknown name is
+// CONFIG_TEMPLATE_UNKNOWN and a template or defaults no route uses is
+// CONFIG_TEMPLATE_UNUSED (a warning). config-check places a route's findings
+// in the file the route was written in. The admin listener's /routes/config
+// serves every route as it is in effect, in YAML.
+
+// includedConfig is what an included file may hold. Other keys are caught by
+// expand, with the file named, rather than by the strict decoder.
+type includedConfig struct {
+	Routes            []RouteConfig             `yaml:"routes"`
+	EnvelopeTemplates map[string]EnvelopeConfig `yaml:"envelope_templates"`
+	RouteDefaults     map[string]RouteConfig    `yaml:"route_defaults"`
+	Other             map[string]any            `yaml:",inline"`
+}
+
+// configSources are the files a config was read from, kept so config-check
+// can place findings in them
+type configSources struct {
+	main   string
+	doc    *yaml.Node          // the main file's top mapping; nil when it is empty
+	routes []configRoute       // where each route of the merged config was written
+	places map[int]configPlace // diag.Items index -> place, for findings yaml.v3 placed
+}
+
+// configRoute is a route as written, in its file
+type configRoute struct {
+	file string
+	node *yaml.Node
+}
+
+// configPlace is a line of one of the config's files
+type configPlace struct {
+	file string
+	line int
+}
+
+// namedBlock is an envelope_templates or route_defaults entry
+type namedBlock struct {
+	file string
+	node *yaml.Node
+}
+
+// readConfig reads the config file at path with its includes, templates and
+// defaults merged into its routes. strict has every file decoded with unknown
+// keys reported, as config-check does.
+func readConfig(path string, strict bool, diag *Diagnostics) (Config, *configSources, bool) {
+	var cfg Config
+	src := &configSources{main: path, places: map[int]configPlace{}}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		diag.Errorf("config", "CONFIG_READ", path, "failed to read config: %v", err)
+		return cfg, src, false
+	}
+	root, ok := src.parse(b, path, &Config{}, strict, diag)
+	if !ok || root == nil {
+		return cfg, src, ok
+	}
+	src.doc = root
+	merged, ok := src.expand(root, strict, diag)
+	if err := merged.Decode(&cfg); err != nil {
+		var typeErr *yaml.TypeError
+		if !strict || !errors.As(err, &typeErr) { // the strict decoder has reported those
+			diag.Errorf("config", "CONFIG_PARSE", path, "failed to parse yaml: %v", err)
+			return cfg, src, false
+		}
+	}
+	return cfg, src, ok
+}
+
+// parse reads one file's top mapping, nil for an empty file, decoding it
+// strictly into into first when strict is set
+func (src *configSources) parse(b []byte, file string, into any, strict bool, diag *Diagnostics) (*yaml.Node, bool) {
+	if strict && !decodeStrict(b, file, into, diag, src.places) {
+		return nil, false
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		diag.Errorf("config", "CONFIG_PARSE", file, "failed to parse yaml: %v", err)
+		return nil, false
+	}
+	if len(doc.Content) == 0 {
+		return nil, true
+	}
+	if top := doc.Content[0]; top.Kind == yaml.MappingNode {
+		return top, true
+	}
+	diag.Errorf("config", "CONFIG_PARSE", file, "the file is not a mapping of config keys")
+	return nil, false
+}
+
+// expand returns root with its includes read and every route merged with the
+// template and defaults it names
+func (src *configSources) expand(root *yaml.Node, strict bool, diag *Diagnostics) (*yaml.Node, bool) {
+	files, ok := src.includes(root, strict, diag)
+
+	templates, defaults := map[string]namedBlock{}, map[string]namedBlock{}
+	for _, f := range files {
+		for _, sec := range []struct {
+			key   string
+			into  map[string]namedBlock
+			route bool
+		}{{"envelope_templates", templates, false}, {"route_defaults", defaults, true}} {
+			m := mapValue(f.node, sec.key)
+			if m == nil || m.Kind != yaml.MappingNode {
+				continue // the decoder reports anything but a mapping
+			}
+			for j := 0; j+1 < len(m.Content); j += 2 {
+				name, body := m.Content[j].Value, m.Content[j+1]
+				path := sec.key + "." + name
+				if prev, dup := sec.into[name]; dup {
+					diag.Errorf("config", "CONFIG_DUPLICATE", path, "%q is defined in both %s and %s", name, prev.file, f.file)
+					ok = false
+					continue
+				}
+				if sec.route {
+					for _, key := range []string{"name", "defaults"} {
+						if scalarValue(body, key) != "" {
+							diag.Errorf("config", "CONFIG_TEMPLATE", path+"."+key, "route_defaults cannot set %s", key)
+							ok = false
+						}
+					}
+				}
+				sec.into[name] = namedBlock{file: f.file, node: body}
+			}
+		}
+	}
+
+	var routes []*yaml.Node
+	used := map[string]bool{}
+	names := map[string]string{} // route name -> the file it was first defined in
+	for _, f := range files {
+		seq := mapValue(f.node, "routes")
+		if seq == nil || seq.Kind != yaml.SequenceNode {
+			continue
+		}
+		for _, r := range seq.Content {
+			path := fmt.Sprintf("routes[%d]", len(routes))
+			src.routes = append(src.routes, configRoute{file: f.file, node: r})
+			merged, rok := mergeRoute(r, path, templates, defaults, used, diag)
+			ok = ok && rok
+			if name := scalarValue(merged, "name"); name != "" {
+				if prev, dup := names[name]; dup && prev != f.file {
+					diag.Errorf("config", "CONFIG_DUPLICATE", path+".name", "route %q is defined in both %s and %s", name, prev, f.file)
+					ok = false
+				} else if !dup {
+					names[name] = f.file
+				}
+			}
+			routes = append(routes, merged)
+		}
+	}
+
+	for _, sec := range []struct {
+		key    string
+		blocks map[string]namedBlock
+	}{{"envelope_templates", templates}, {"route_defaults", defaults}} {
+		for _, name := range sortedKeys(sec.blocks) {
+			if !used[sec.key+"."+name] {
+				diag.Warnf("config", "CONFIG_TEMPLATE_UNUSED", sec.key+"."+name, "no route uses %q", name)
+			}
+		}
+	}
+
+	return withMapValue(root, "routes", &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: routes}), ok
+}
+
+// includes reads the files root's include names, returning them after root
+func (src *configSources) includes(root *yaml.Node, strict bool, diag *Diagnostics) ([]namedBlock, bool) {
+	files := []namedBlock{{file: src.main, node: root}}
+	inc := mapValue(root, "include")
+	if inc == nil || inc.Kind != yaml.SequenceNode {
+		return files, true // the decoder reports anything but a list
+	}
+	ok := true
+	seen := map[string]bool{filepath.Clean(src.main): true}
+	for i, entry := range inc.Content {
+		path := fmt.Sprintf("include[%d]", i)
+		pattern := entry.Value
+		if pattern == "" {
+			continue
+		}
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(src.main), pattern)
+		}
+		matches := []string{pattern}
+		if strings.ContainsAny(entry.Value, `*?[\`) {
+			var err error
+			if matches, err = filepath.Glob(pattern); err != nil {
+				diag.Errorf("config", "CONFIG_INCLUDE", path, "bad pattern %q: %v", entry.Value, err)
+				ok = false
+				continue
+			}
+			if len(matches) == 0 {
+				diag.Warnf("config", "CONFIG_INCLUDE", path, "%q matches no file", entry.Value)
+			}
+		}
+		for _, file := range matches {
+			if seen[filepath.Clean(file)] {
+				continue
+			}
+			seen[filepath.Clean(file)] = true
+			b, err := os.ReadFile(file)
+			if err != nil {
+				diag.Errorf("config", "CONFIG_INCLUDE", path, "failed to read %s: %v", file, err)
+				ok = false
+				continue
+			}
+			top, parsed := src.parse(b, file, &includedConfig{}, strict, diag)
+			if !parsed {
+				ok = false
+				continue
+			}
+			if top == nil {
+				continue
+			}
+			for j := 0; j+1 < len(top.Content); j += 2 {
+				switch key := top.Content[j]; key.Value {
+				case "routes", "envelope_templates", "route_defaults":
+				default:
+					diag.Errorf("config", "CONFIG_INCLUDE", path, "%s:%d: an included file holds only routes, envelope_templates and route_defaults, not %s", file, key.Line, key.Value)
+					ok = false
+				}
+			}
+			routes := 0
+			if seq := mapValue(top, "routes"); seq != nil {
+				routes = len(seq.Content)
+			}
+			log.Printf("[Config] Including %s (%d route(s))", file, routes)
+			files = append(files, namedBlock{file: file, node: top})
+		}
+	}
+	return files, ok
+}
+
+// mergeRoute is route r merged over its defaults and envelope template
+func mergeRoute(r *yaml.Node, path string, templates, defaults map[string]namedBlock, used map[string]bool, diag *Diagnostics) (*yaml.Node, bool) {
+	if r.Kind != yaml.MappingNode {
+		return r, true
+	}
+	out, ok := r, true
+	if name := scalarValue(r, "defaults"); name != "" {
+		if d, found := defaults[name]; found {
+			used["route_defaults."+name] = true
+			out = mergeNodes(d.node, r)
+		} else {
+			diag.Errorf("config", "CONFIG_TEMPLATE_UNKNOWN", path+".defaults", "no route_defaults entry named %q%s", name, suggest(name, sortedKeys(defaults)))
+			ok = false
+		}
+	}
+	if name := scalarValue(out, "envelope_template"); name != "" {
+		if t, found := templates[name]; found {
+			used["envelope_templates."+name] = true
+			out = withMapValue(out, "envelope", mergeNodes(t.node, mapValue(out, "envelope")))
+		} else {
+			diag.Errorf("config", "CONFIG_TEMPLATE_UNKNOWN", path+".envelope_template", "no envelope_templates entry named %q%s", name, suggest(name, sortedKeys(templates)))
+			ok = false
+		}
+	}
+	return withoutKeys(out, "defaults", "envelope_template"), ok
+}
+
+// suggest is a "did you mean" for a mistyped name, or ""
+func suggest(name string, names []string) string {
+	if s := closest(name, names); s != "" {
+		return fmt.Sprintf("; did you mean %q?", s)
+	}
+	return ""
+}
+
+// mergeNodes is over laid on base: two mappings merge key by key, over's
+// value winning; otherwise over replaces base whole. Neither is modified.
+func mergeNodes(base, over *yaml.Node) *yaml.Node {
+	if base == nil {
+		return over
+	}
+	if over == nil {
+		return base
+	}
+	if base.Kind != yaml.MappingNode || over.Kind != yaml.MappingNode {
+		return over
+	}
+	out := *over
+	out.Content = slices.Clone(base.Content)
+	at := map[string]int{}
+	for i := 0; i+1 < len(out.Content); i += 2 {
+		at[out.Content[i].Value] = i
+	}
+	for i := 0; i+1 < len(over.Content); i += 2 {
+		key, value := over.Content[i], over.Content[i+1]
+		if j, found := at[key.Value]; found {
+			out.Content[j+1] = mergeNodes(out.Content[j+1], value)
+			continue
+		}
+		out.Content = append(out.Content, key, value)
+	}
+	return &out
+}
+
+// mapValue is the value of key in mapping n, or nil
+func mapValue(n *yaml.Node, key string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// scalarValue is the scalar value of key in mapping n, or ""
+func scalarValue(n *yaml.Node, key string) string {
+	if v := mapValue(n, key); v != nil && v.Kind == yaml.ScalarNode {
+		return v.Value
+	}
+	return ""
+}
+
+// withMapValue is a copy of mapping n with key set to value
+func withMapValue(n *yaml.Node, key string, value *yaml.Node) *yaml.Node {
+	out := *n
+	out.Content = slices.Clone(n.Content)
+	for i := 0; i+1 < len(out.Content); i += 2 {
+		if out.Content[i].Value == key {
+			out.Content[i+1] = value
+			return &out
+		}
+	}
+	out.Content = append(out.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+	return &out
+}
+
+// withoutKeys is a copy of mapping n without keys
+func withoutKeys(n *yaml.Node, keys ...string) *yaml.Node {
+	out := *n
+	out.Content = nil
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if !slices.Contains(keys, n.Content[i].Value) {
+			out.Content = append(out.Content, n.Content[i], n.Content[i+1])
+		}
+	}
+	return &out
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// routePath splits a diagnostic path such as routes[3].envelope.payload_field
+var routePath = regexp.MustCompile(`^routes\[(\d+)\]\.?`)
+
+// place is the file and line a finding at a diagnostic path belongs to: a
+// route's, in the file it was written in, or else the main file's
+func (src *configSources) place(path string) configPlace {
+	if m := routePath.FindStringSubmatch(path); m != nil {
+		i, _ := strconv.Atoi(m[1])
+		if i < len(src.routes) {
+			r := src.routes[i]
+			line := nodeLine(r.node, path[len(m[0]):])
+			if line == 0 {
+				line = r.node.Line
+			}
+			return configPlace{file: r.file, line: line}
+		}
+	}
+	return configPlace{file: src.main, line: nodeLine(src.doc, path)}
+}
+
+// checkConfigTemplates fails a config built in code whose routes name
+// defaults or a template, which only readConfig merges in
+func (px *Proxy) checkConfigTemplates(diag *Diagnostics) {
+	for i, route := range px.cfg.Routes {
+		path := fmt.Sprintf("routes[%d]", i)
+		if route.Defaults != "" {
+			diag.Errorf("config", "CONFIG_TEMPLATE", path+".defaults", "route_defaults are merged as the config file is read; build the route whole")
+		}
+		if route.EnvelopeTemplate != "" {
+			diag.Errorf("config", "CONFIG_TEMPLATE", path+".envelope_template", "envelope_templates are merged as the config file is read; build the route whole")
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// --- Config Schema and Check ---
+//
+// Two subcommands let CI gate config changes without starting a proxy.
+//
+// `proxy config-schema` prints a JSON Schema of the config file, and with
+// -example a commented-out example of every key it can hold. Both are
+// reflected from the Config types' yaml tags when the command runs, so they
+// list exactly the keys the proxy reads; an editor can validate against the
+// schema, and regenerating either one (make config-schema) shows in a diff
+// what a change to the types added. Output is deterministic.
+//
+// `proxy config-check -config x.yaml` decodes the file strictly, so a
+// misspelled or misplaced key is an error rather than silently ignored, then
+// runs the same validation as startup and prints each finding at its line:
+//
+//	x.yaml:42: ERROR   ROUTE_WRAP (routes[3].wrap.envelope_type): no message type ...
+//
+// Checks against the schema's descriptors need them: -pb loads them from a
+// descriptor set file in place of the config's schema section, so a config
+// whose schema comes from backend reflection can be checked offline. Both
+// commands exit 1 on a problem (config-check on errors, not warnings) and 2
+// on bad usage.
+
+// jsonSchema is the subset of JSON Schema (2020-12) the config needs
+type jsonSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Ref                  string                 `json:"$ref,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	AdditionalProperties any                    `json:"additionalProperties,omitempty"` // false, or the values' schema
+	Items                *jsonSchema            `json:"items,omitempty"`
+	Defs                 map[string]*jsonSchema `json:"$defs,omitempty"`
+}
+
+// schemaEnums are the keys whose values the proxy checks against a list of its own
+var schemaEnums = map[reflect.Type]map[string][]string{
+	reflect.TypeFor[RouteConfig](): {"mode": routeModes},
+}
+
+// configField is a key of a config struct, with inline structs flattened
+type configField struct {
+	name string
+	typ  reflect.Type
+}
+
+// configFields lists t's keys as yaml.v3 decodes them
+func configFields(t reflect.Type) []configField {
+	var out []configField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if strings.Contains(opts, "inline") {
+			out = append(out, configFields(f.Type)...)
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		out = append(out, configField{name, f.Type})
+	}
+	return out
+}
+
+// schemaBuilder collects one $defs entry per config struct
+type schemaBuilder struct {
+	defs map[string]*jsonSchema
+}
+
+func (b *schemaBuilder) of(t reflect.Type) *jsonSchema {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.of(t.Elem())
+	case reflect.Struct:
+		if _, done := b.defs[t.Name()]; !done {
+			s := &jsonSchema{Type: "object", Properties: map[string]*jsonSchema{}, AdditionalProperties: false}
+			b.defs[t.Name()] = s
+			for _, f := range configFields(t) {
+				p := b.of(f.typ)
+				if enum := schemaEnums[t][f.name]; enum != nil {
+					p.Enum = enum
+				}
+				s.Properties[f.name] = p
+			}
+		}
+		return &jsonSchema{Ref: "#/$defs/" + t.Name()}
+	case reflect.Map:
+		return &jsonSchema{Type: "object", AdditionalProperties: b.of(t.Elem())}
+	case reflect.Slice, reflect.Array:
+		return &jsonSchema{Type: "array", Items: b.of(t.Elem())}
+	case reflect.String:
+		return &jsonSchema{Type: "string"}
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &jsonSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: "number"}
+	}
+	return &jsonSchema{} // any value
+}
+
+// configSchema builds the JSON Schema of the config file
+func configSchema() *jsonSchema {
+	b := &schemaBuilder{defs: map[string]*jsonSchema{}}
+	root := b.of(reflect.TypeFor[Config]())
+	root.Schema = "https://json-schema.org/draft/2020-12/schema"
+	root.Title = "grpc-proxy configuration"
+	root.Defs = b.defs
+	return root
+}
+
+// configTypeName describes a value of t for the example's comments
+func configTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return configTypeName(t.Elem())
+	case reflect.Struct:
+		return t.Name()
+	case reflect.Map:
+		return "map of " + configTypeName(t.Key()) + " to " + configTypeName(t.Elem())
+	case reflect.Slice, reflect.Array:
+		return "list of " + configTypeName(t.Elem())
+	case reflect.Interface:
+		return "any"
+	}
+	return t.Kind().String()
+}
+
+// exampleWriter writes the commented-out example config
+type exampleWriter struct {
+	buf  bytes.Buffer
+	open map[reflect.Type]bool // structs being written, to stop at recursion
+}
+
+func (w *exampleWriter) line(text, note string) {
+	if note == "" {
+		fmt.Fprintf(&w.buf, "# %s\n", text)
+		return
+	}
+	fmt.Fprintf(&w.buf, "# %-56s # %s\n", text, note)
+}
+
+// fields writes t's keys, the first prefixed by first (a list item's "- ")
+// and the rest by indent
+func (w *exampleWriter) fields(t reflect.Type, first, indent string) {
+	w.open[t] = true
+	defer delete(w.open, t)
+	for i, f := range configFields(t) {
+		lead := indent
+		if i == 0 {
+			lead = first
+		}
+		ft := f.typ
+		for ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		switch {
+		case ft.Kind() == reflect.Struct && w.open[ft]:
+			w.line(lead+f.name+": {}", ft.Name()+", as above")
+		case ft.Kind() == reflect.Struct:
+			w.line(lead+f.name+":", ft.Name())
+			w.fields(ft, indent+"  ", indent+"  ")
+		case ft.Kind() == reflect.Slice && ft.Elem().Kind() == reflect.Struct && !w.open[ft.Elem()]:
+			w.line(lead+f.name+":", configTypeName(ft))
+			w.fields(ft.Elem(), indent+"  - ", indent+"    ")
+		case ft.Kind() == reflect.Map && ft.Elem().Kind() == reflect.Struct && !w.open[ft.Elem()]:
+			w.line(lead+f.name+":", configTypeName(ft))
+			w.line(indent+"  <name>:", "")
+			w.fields(ft.Elem(), indent+"    ", indent+"    ")
+		case ft.Kind() == reflect.Slice:
+			w.line(lead+f.name+": []", configTypeName(ft))
+		case ft.Kind() == reflect.Map:
+			w.line(lead+f.name+": {}", configTypeName(ft))
+		default:
+			note := configTypeName(ft)
+			if enum := schemaEnums[t][f.name]; enum != nil {
+				note += ": " + strings.Join(enum, ", ")
+			}
+			w.line(lead+f.name+": "+exampleZero(ft), note)
+		}
+	}
+}
+
+// exampleZero is a scalar's unset value as YAML
+func exampleZero(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return `""`
+	case reflect.Bool:
+		return "false"
+	case reflect.Interface:
+		return "null"
+	}
+	return "0"
+}
+
+// ConfigJSONSchema is the JSON Schema of the config file
+func ConfigJSONSchema() []byte {
+	js, _ := json.MarshalIndent(configSchema(), "", "  ")
+	return append(js, '\n')
+}
+
+// ExampleConfig is every key of the config file, commented out
+func ExampleConfig() []byte {
+	w := &exampleWriter{open: map[reflect.Type]bool{}}
+	w.buf.WriteString("# Every key of the proxy's config file, with its type; unset keys take the\n")
+	w.buf.WriteString("# defaults described in README.md. Generated by `proxy config-schema -example`.\n")
+	w.fields(reflect.TypeFor[Config](), "", "")
+	return w.buf.Bytes()
+}
+
+// ConfigSchema is the config-schema subcommand
+func ConfigSchema(args []string) int {
+	fs := flag.NewFlagSet("config-schema", flag.ExitOnError)
+	example := fs.Bool("example", false, "print every config key, commented out, instead of the JSON Schema")
+	out := fs.String("o", "", "write to this file instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: proxy config-schema [-example] [-o file]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	body := ConfigJSONSchema()
+	if *example {
+		body = ExampleConfig()
+	}
+	var err error
+	if *out == "" {
+		_, err = os.Stdout.Write(body)
+	} else {
+		err = os.WriteFile(*out, body, 0o644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config-schema: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// ConfigFinding is a diagnostic of config-check, placed in the file
+type ConfigFinding struct {
+	Diagnostic
+	File string `json:"file"`
+	Line int    `json:"line,omitempty"` // 0 when the path names no key of the file
+}
+
+// yamlErrorLine splits yaml.v3's "line N: ..." off an error message
+var yamlErrorLine = regexp.MustCompile(`line (\d+): `)
+
+// decodeStrict decodes b, the file path, into out, reporting keys no config
+// type has and values of the wrong type at the lines yaml.v3 names; it is
+// false when the file is not YAML at all
+func decodeStrict(b []byte, path string, out any, diag *Diagnostics, places map[int]configPlace) bool {
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	err := dec.Decode(out)
+	if err == nil || errors.Is(err, io.EOF) {
+		return true
+	}
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		place := configPlace{file: path}
+		if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+			place.line, _ = strconv.Atoi(m[1])
+		}
+		places[len(diag.Items)] = place
+		diag.Errorf("config", "CONFIG_PARSE", path, "failed to parse yaml: %v", err)
+		return false
+	}
+	for _, msg := range typeErr.Errors {
+		code := "CONFIG_TYPE"
+		if strings.Contains(msg, "not found in type") {
+			code = "CONFIG_UNKNOWN_FIELD"
+		}
+		place := configPlace{file: path}
+		if m := yamlErrorLine.FindStringSubmatchIndex(msg); m != nil {
+			place.line, _ = strconv.Atoi(msg[m[2]:m[3]])
+			msg = msg[m[1]:]
+		}
+		places[len(diag.Items)] = place
+		diag.Errorf("config", code, "", "%s", msg)
+	}
+	return true
+}
+
+// nodeLine is the line of the key a diagnostic path such as
+// sign_key_selector.keys.acme names under mapping n, or of the deepest part
+// of it n has; 0 when it has none
+func nodeLine(n *yaml.Node, path string) int {
+	if n == nil || path == "" {
+		return 0
+	}
+	line := 0
+	for _, part := range strings.Split(path, ".") {
+		key, indexes, _ := strings.Cut(part, "[")
+		if key != "" {
+			if n.Kind != yaml.MappingNode {
+				return line
+			}
+			var next *yaml.Node
+			for j := 0; j+1 < len(n.Content); j += 2 {
+				if n.Content[j].Value == key {
+					next, line = n.Content[j+1], n.Content[j].Line
+					break
+				}
+			}
+			if next == nil {
+				return line
+			}
+			n = next
+		}
+		for indexes != "" {
+			var index string
+			index, indexes, _ = strings.Cut(indexes, "]")
+			indexes = strings.TrimPrefix(indexes, "[")
+			i, err := strconv.Atoi(index)
+			if err != nil || n.Kind != yaml.SequenceNode || i < 0 || i >= len(n.Content) {
+				return line
+			}
+			n = n.Content[i]
+			line = n.Line
+		}
+	}
+	return line
+}
+
+// CheckConfig reads the config file at path strictly, with its includes, and
+// runs the startup validation on it, with the schema loaded from pbPath when
+// it is set. The findings are in file order, the main file's first, those
+// without a line last.
+func CheckConfig(path, pbPath, engine string) []ConfigFinding {
+	diag := &Diagnostics{}
+	cfg, src, ok := readConfig(path, true, diag)
+	if ok {
+		if pbPath != "" {
+			cfg.Schema.Method, cfg.Schema.PBPath, cfg.Schema.Lazy = "pb", pbPath, false
+		}
+		if px, _ := NewProxy(cfg, WithCryptoEngine(engine), WithDiagnostics(diag)); px != nil {
+			px.Shutdown(context.Background())
+		}
+	}
+
+	found := make([]ConfigFinding, len(diag.Items))
+	for i, item := range diag.Items {
+		place, placed := src.places[i]
+		if !placed {
+			place = src.place(item.Path)
+		}
+		found[i] = ConfigFinding{Diagnostic: item, File: place.file, Line: place.line}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		a, b := found[i], found[j]
+		if a.File != b.File {
+			return a.File == path || (b.File != path && a.File < b.File)
+		}
+		return a.Line != 0 && (b.Line == 0 || a.Line < b.Line)
+	})
+	return found
+}
+
+// ConfigCheck is the config-check subcommand
+func ConfigCheck(args []string) int {
+	fs := flag.NewFlagSet("config-check", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "config file to check")
+	pbPath := fs.String("pb", "", "FileDescriptorSet to check routes against, in place of the config's schema section")
+	engine := fs.String("crypto", "go", "crypto engine to load keys with: "+strings.Join(CryptoEngines(), " or "))
+	asJSON := fs.Bool("json", false, "print the findings as JSON")
+	verbose := fs.Bool("v", false, "show the loaders' logs")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: proxy config-check [-config file] [-pb file] [-json]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	found := CheckConfig(*configPath, *pbPath, *engine)
+	errs, warnings := 0, 0
+	for _, f := range found {
+		if f.Severity == SeverityError {
+			errs++
+		} else {
+			warnings++
+		}
+	}
+	if *asJSON {
+		js, _ := json.MarshalIndent(struct {
+			Diagnostics []ConfigFinding `json:"diagnostics"`
+		}{found}, "", "  ")
+		fmt.Println(string(js))
+	} else {
+		for _, f := range found {
+			at := f.File
+			if f.Line > 0 {
+				at += ":" + strconv.Itoa(f.Line)
+			}
+			loc := ""
+			if f.Path != "" {
+				loc = " (" + f.Path + ")"
+			}
+			fmt.Printf("%s: %-7s %s%s: %s\n", at, strings.ToUpper(string(f.Severity)), f.Code, loc, f.Message)
+		}
+		fmt.Printf("config-check: %s: %d error(s), %d warning(s)\n", *configPath, errs, warnings)
+	}
+	if errs > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,430 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// --- Conformance ---
+//
+// `proxy conformance -backend host:port -proxy host:port` runs the same
+// calls straight at a backend and through a proxy in front of it, and diffs
+// what each side saw. The calls go to echo.EchoService, which
+// go-proxy/backend and the integration harness serve, so the proxy's route
+// for it decides what is being checked (pass-thru in the example config):
+//
+//	unary, server-streaming, client-streaming, bidi-streaming
+//	large-unary, large-stream    1 MiB in one message, 4 x 256 KiB on a stream
+//	error-status, error-details  a status code, and one with a BadRequest detail
+//	metadata                     request metadata, and the backend's header and trailer
+//	deadline                     a stream left open past its 200ms deadline
+//	cancellation                 a stream cancelled after its second response
+//	compression                  a gzip-compressed unary call
+//
+// A scenario passes when both sides end with the same status code, message
+// and details (only the code for DEADLINE_EXCEEDED and CANCELLED, whose message
+// the client's gRPC library may write), the same response bytes, the same
+// header and trailer, and the proxied call took at most -max-overhead longer.
+// Metadata gRPC itself sets (content-type, grpc-*) and the proxy's own
+// x-proxy-* keys are left out of the comparison, with more by
+// -ignore-metadata. The report is one line per scenario, or JSON with
+// -json, and the exit code is 1 when any scenario failed. RunConformance
+// runs the same matrix over connections a test already holds.
+
+const (
+	defaultConformanceOverhead = 250 * time.Millisecond
+	conformanceTimeout         = 10 * time.Second
+	conformanceDeadline        = 200 * time.Millisecond
+	conformanceHeader          = "x-conformance-scenario"
+)
+
+// conformanceIgnored are the metadata keys no scenario compares; a key
+// ending in * is a prefix
+var conformanceIgnored = []string{"content-type", "grpc-*", "x-proxy-*"}
+
+// ConformanceOptions tunes RunConformance
+type ConformanceOptions struct {
+	// MaxOverhead is how much longer a proxied call may take than the direct
+	// one; 0 means 250ms
+	MaxOverhead time.Duration
+	// IgnoreMetadata are more header and trailer keys to leave out of the
+	// comparison; a key ending in * is a prefix
+	IgnoreMetadata []string
+	// Scenarios limits the run to these scenario names; empty runs them all
+	Scenarios []string
+}
+
+// ConformanceResult is one scenario's verdict
+type ConformanceResult struct {
+	Scenario    string        `json:"scenario"`
+	Passed      bool          `json:"passed"`
+	Differences []string      `json:"differences,omitempty"`
+	Direct      time.Duration `json:"direct_ns"`
+	Proxied     time.Duration `json:"proxied_ns"`
+}
+
+// conformanceScenario is one call, made the same way on both sides. Every
+// call is opened as a bidirectional stream, as replay does.
+type conformanceScenario struct {
+	name        string
+	method      string
+	requests    [][]byte
+	metadata    metadata.MD
+	pingPong    bool // read each request's response before sending the next
+	hold        bool // never half-close, so the call runs into its deadline
+	cancelAfter int  // cancel the call once this many responses arrived
+	timeout     time.Duration
+	compress    bool
+}
+
+// echoRequest encodes an echo.EchoRequest
+func echoRequest(message string, repeat int32) []byte {
+	var b []byte
+	if message != "" {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, message)
+	}
+	if repeat != 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(repeat))
+	}
+	return b
+}
+
+func echoRequests(prefix string, n, size int) [][]byte {
+	reqs := make([][]byte, n)
+	for i := range reqs {
+		msg := fmt.Sprintf("%s %d", prefix, i+1)
+		if size > len(msg) {
+			msg += strings.Repeat("x", size-len(msg))
+		}
+		reqs[i] = echoRequest(msg, 0)
+	}
+	return reqs
+}
+
+func conformanceScenarios() []conformanceScenario {
+	const echoService = "/echo.EchoService/"
+	unary, bidi := echoService+"UnaryEcho", echoService+"BidirectionalStreamingEcho"
+	return []conformanceScenario{
+		{name: "unary", method: unary, requests: [][]byte{echoRequest("conformance", 0)}},
+		{name: "server-streaming", method: echoService + "ServerStreamingEcho", requests: [][]byte{echoRequest("conformance", 5)}},
+		{name: "client-streaming", method: echoService + "ClientStreamingEcho", requests: echoRequests("conformance", 5, 0)},
+		{name: "bidi-streaming", method: bidi, requests: echoRequests("conformance", 5, 0), pingPong: true},
+		{name: "large-unary", method: unary, requests: echoRequests("large", 1, 1<<20)},
+		{name: "large-stream", method: bidi, requests: echoRequests("large", 4, 256<<10), pingPong: true},
+		{name: "error-status", method: unary, requests: [][]byte{echoRequest("fail:NotFound", 0)}},
+		{name: "error-details", method: unary, requests: [][]byte{echoRequest("bad-request", 0)}},
+		{name: "metadata", method: unary, requests: [][]byte{echoRequest("metadata", 0)},
+			metadata: metadata.Pairs("x-conformance-text", "conformance", "x-conformance-bin", "\x00\x01\x02")},
+		{name: "deadline", method: bidi, requests: echoRequests("deadline", 1, 0), pingPong: true, hold: true, timeout: conformanceDeadline},
+		{name: "cancellation", method: bidi, requests: echoRequests("cancel", 3, 0), pingPong: true, cancelAfter: 2},
+		{name: "compression", method: unary, requests: echoRequests("gzip", 1, 4<<10), compress: true},
+	}
+}
+
+// conformanceOutcome is what one side of a scenario saw
+type conformanceOutcome struct {
+	status    *status.Status
+	responses [][]byte
+	header    metadata.MD
+	trailer   metadata.MD
+	took      time.Duration
+}
+
+// run makes s's call on conn
+func (s conformanceScenario) run(ctx context.Context, conn grpc.ClientConnInterface) (out conformanceOutcome) {
+	timeout := s.timeout
+	if timeout == 0 {
+		timeout = conformanceTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	md := metadata.Join(metadata.Pairs(conformanceHeader, s.name), s.metadata)
+	ctx = metadata.NewOutgoingContext(ctx, md)
+	opts := []grpc.CallOption{grpc.ForceCodecV2(bytesCodec{})}
+	if s.compress {
+		opts = append(opts, grpc.UseCompressor(gzip.Name))
+	}
+
+	start := time.Now()
+	defer func() { out.took = time.Since(start) }()
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, s.method, opts...)
+	if err != nil {
+		out.status = status.Convert(err)
+		return out
+	}
+	recv := func() error {
+		var resp []byte
+		if err := stream.RecvMsg(&resp); err != nil {
+			return err
+		}
+		if len(out.responses) == 0 {
+			out.header, _ = stream.Header()
+		}
+		out.responses = append(out.responses, resp)
+		if s.cancelAfter > 0 && len(out.responses) == s.cancelAfter {
+			cancel()
+		}
+		return nil
+	}
+
+	err = nil
+	for _, req := range s.requests {
+		msg := req
+		if err = stream.SendMsg(&msg); err != nil {
+			// The real error is the status, which RecvMsg reports
+			err = nil
+			break
+		}
+		if s.pingPong {
+			if err = recv(); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil && !s.hold {
+		stream.CloseSend()
+	}
+	for err == nil {
+		err = recv()
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	out.status = status.Convert(err)
+	if out.header == nil {
+		out.header, _ = stream.Header()
+	}
+	out.trailer = stream.Trailer()
+	return out
+}
+
+// RunConformance runs the conformance scenarios against direct, a backend,
+// and proxied, a proxy in front of it, one scenario and side at a time
+func RunConformance(ctx context.Context, direct, proxied grpc.ClientConnInterface, opts ConformanceOptions) []ConformanceResult {
+	maxOverhead := opts.MaxOverhead
+	if maxOverhead == 0 {
+		maxOverhead = defaultConformanceOverhead
+	}
+	ignored := append(append([]string{}, conformanceIgnored...), opts.IgnoreMetadata...)
+	var results []ConformanceResult
+	for _, s := range conformanceScenarios() {
+		if len(opts.Scenarios) > 0 && !contains(opts.Scenarios, s.name) {
+			continue
+		}
+		want := s.run(ctx, direct)
+		got := s.run(ctx, proxied)
+		diffs := diffOutcomes(want, got, ignored)
+		if extra := got.took - want.took; extra > maxOverhead {
+			diffs = append(diffs, fmt.Sprintf("took %s longer than direct, over the %s allowed", extra.Round(time.Microsecond), maxOverhead))
+		}
+		results = append(results, ConformanceResult{Scenario: s.name, Passed: len(diffs) == 0, Differences: diffs, Direct: want.took, Proxied: got.took})
+	}
+	return results
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// diffOutcomes describes how got, the proxied side, differs from want
+func diffOutcomes(want, got conformanceOutcome, ignored []string) []string {
+	var diffs []string
+	if g, w := got.status.Code(), want.status.Code(); g != w {
+		diffs = append(diffs, fmt.Sprintf("status %s, direct %s", g, w))
+	} else if w != codes.DeadlineExceeded && w != codes.Canceled {
+		if g, w := got.status.Message(), want.status.Message(); g != w {
+			diffs = append(diffs, fmt.Sprintf("status message %q, direct %q", g, w))
+		}
+		if g, w := got.status.Proto().GetDetails(), want.status.Proto().GetDetails(); !detailsEqual(g, w) {
+			diffs = append(diffs, fmt.Sprintf("%d status detail(s), direct %d, or their bytes differ", len(g), len(w)))
+		}
+	}
+	if g, w := len(got.responses), len(want.responses); g != w {
+		diffs = append(diffs, fmt.Sprintf("%d response(s), direct %d", g, w))
+	}
+	for i := 0; i < len(got.responses) && i < len(want.responses); i++ {
+		if !bytes.Equal(got.responses[i], want.responses[i]) {
+			diffs = append(diffs, fmt.Sprintf("response %d is %d bytes, direct %d, and they differ", i+1, len(got.responses[i]), len(want.responses[i])))
+			break
+		}
+	}
+	if g, w := formatMD(got.header, ignored), formatMD(want.header, ignored); g != w {
+		diffs = append(diffs, fmt.Sprintf("header {%s}, direct {%s}", g, w))
+	}
+	if g, w := formatMD(got.trailer, ignored), formatMD(want.trailer, ignored); g != w {
+		diffs = append(diffs, fmt.Sprintf("trailer {%s}, direct {%s}", g, w))
+	}
+	return diffs
+}
+
+func detailsEqual(a, b []*anypb.Any) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !proto.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// formatMD lists md's keys and values in order, but for the ignored keys
+func formatMD(md metadata.MD, ignored []string) string {
+	var pairs []string
+	for k, vs := range md {
+		if metadataIgnored(k, ignored) {
+			continue
+		}
+		for _, v := range vs {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", k, v))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+func metadataIgnored(key string, ignored []string) bool {
+	for _, k := range ignored {
+		if prefix, ok := strings.CutSuffix(k, "*"); ok && strings.HasPrefix(key, prefix) || k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// conformanceTLS are the TLS flags of one side of the conformance subcommand
+type conformanceTLS struct{ ca, cert, key, serverName *string }
+
+func conformanceTLSFlags(fs *flag.FlagSet, side string) conformanceTLS {
+	return conformanceTLS{
+		ca:         fs.String(side+"-ca", "", "CA file; enables TLS to the "+side),
+		cert:       fs.String(side+"-cert", "", "client certificate for mTLS to the "+side),
+		key:        fs.String(side+"-key", "", "client key for mTLS to the "+side),
+		serverName: fs.String(side+"-server-name", "", "TLS server name override for the "+side),
+	}
+}
+
+func (t conformanceTLS) dial(target string) (*grpc.ClientConn, error) {
+	transport := grpc.WithTransportCredentials(insecure.NewCredentials())
+	if *t.ca != "" || *t.cert != "" {
+		tlsCfg, err := backendTLSConfig(BackendTLSConfig{CAFile: *t.ca, CertFile: *t.cert, KeyFile: *t.key, ServerName: *t.serverName})
+		if err != nil {
+			return nil, err
+		}
+		transport = grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg))
+	}
+	return grpc.Dial(target, transport)
+}
+
+// Conformance implements the conformance subcommand; args excludes the
+// subcommand name. It returns the process exit code.
+func Conformance(args []string) int {
+	fs := flag.NewFlagSet("conformance", flag.ExitOnError)
+	backend := fs.String("backend", "", "backend address, called directly")
+	proxyAddr := fs.String("proxy", "", "address of the proxy in front of that backend")
+	backendTLS := conformanceTLSFlags(fs, "backend")
+	proxyTLS := conformanceTLSFlags(fs, "proxy")
+	maxOverhead := fs.Duration("max-overhead", defaultConformanceOverhead, "how much longer a proxied call may take than the direct one")
+	ignore := fs.String("ignore-metadata", "", "comma-separated header and trailer keys not to compare; a key ending in * is a prefix")
+	only := fs.String("scenarios", "", "comma-separated scenarios to run; default all")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: proxy conformance -backend host:port -proxy host:port [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *backend == "" || *proxyAddr == "" || fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	opts := ConformanceOptions{MaxOverhead: *maxOverhead}
+	if *ignore != "" {
+		opts.IgnoreMetadata = strings.Split(*ignore, ",")
+	}
+	if *only != "" {
+		opts.Scenarios = strings.Split(*only, ",")
+		for _, name := range opts.Scenarios {
+			if !knownScenario(name) {
+				fmt.Fprintf(os.Stderr, "conformance: unknown scenario %q\n", name)
+				return 2
+			}
+		}
+	}
+
+	direct, err := backendTLS.dial(*backend)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "conformance: dial %s: %v\n", *backend, err)
+		return 1
+	}
+	defer direct.Close()
+	proxied, err := proxyTLS.dial(*proxyAddr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "conformance: dial %s: %v\n", *proxyAddr, err)
+		return 1
+	}
+	defer proxied.Close()
+
+	results := RunConformance(context.Background(), direct, proxied, opts)
+	failed := 0
+	for _, r := range results {
+		if !r.Passed {
+			failed++
+		}
+	}
+	if *asJSON {
+		js, _ := json.MarshalIndent(results, "", "  ")
+		fmt.Println(string(js))
+	} else {
+		for _, r := range results {
+			verdict := "PASS"
+			if !r.Passed {
+				verdict = "FAIL"
+			}
+			fmt.Printf("%s %-18s direct %-12s proxied %s\n", verdict, r.Scenario, r.Direct.Round(time.Microsecond), r.Proxied.Round(time.Microsecond))
+			for _, d := range r.Differences {
+				fmt.Printf("     %s\n", d)
+			}
+		}
+		fmt.Printf("%d scenarios, %d failed\n", len(results), failed)
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func knownScenario(name string) bool {
+	for _, s := range conformanceScenarios() {
+		if s.name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// --- Upstream Connections ---
+//
+// Backend connections are shared between calls. connManager keeps one
+// connection per endpoint and set of backend credentials, dialled on the first
+// call that needs it. A connection with no open streams for
+// backend.idle_connection_ttl is closed, and dialled again on next use; one
+// with open streams is never closed underneath them. An attempt that fails to
+// establish its stream at the connection level drops the connection, so a
+// retry dials afresh rather than waiting out the old one's reconnect backoff.
+
+const defaultConnectionTTL = 5 * time.Minute
+
+// upstreamConn is one shared backend connection
+type upstreamConn struct {
+	key    string
+	labels Labels
+	conn   *grpc.ClientConn
+
+	// guarded by connManager.mu
+	streams  int
+	lastUsed time.Time
+	dropped  bool // out of the manager; closed when its last stream ends
+}
+
+type connManager struct {
+	ttl   time.Duration
+	creds string // identifies the credentials connections are dialled with
+	dial  func(ep *endpoint) (*grpc.ClientConn, error)
+
+	mu    sync.Mutex
+	conns map[string]*upstreamConn
+}
+
+func newConnManager(ttl time.Duration, creds string, dial func(ep *endpoint) (*grpc.ClientConn, error)) *connManager {
+	return &connManager{ttl: ttl, creds: creds, dial: dial, conns: make(map[string]*upstreamConn)}
+}
+
+// acquire returns the endpoint's connection, dialling it if there is none,
+// with one more stream counted against it. Every acquire is paired with a
+// release.
+func (m *connManager) acquire(ep *endpoint) (*upstreamConn, error) {
+	key := m.creds + "|" + ep.addr + "|" + ep.authority
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.conns[key]
+	if c == nil {
+		conn, err := m.dial(ep)
+		if err != nil {
+			return nil, err
+		}
+		c = &upstreamConn{key: key, labels: Labels{"endpoint": ep.addr}, conn: conn}
+		m.conns[key] = c
+		go m.watch(c)
+		metrics.AddGauge("proxy_upstream_connections", c.labels, 1)
+		log.Printf("[Backend] Opened connection to %s", ep.addr)
+	}
+	c.streams++
+	c.lastUsed = time.Now()
+	metrics.AddGauge("proxy_upstream_streams", c.labels, 1)
+	return c, nil
+}
+
+// release ends one stream on c. drop takes the connection out of use after a
+// connection-level failure; it closes once no stream is left on it.
+func (m *connManager) release(c *upstreamConn, drop bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c.streams--
+	c.lastUsed = time.Now()
+	metrics.AddGauge("proxy_upstream_streams", c.labels, -1)
+	if drop && !c.dropped {
+		m.remove(c, "failed")
+	}
+	if c.dropped && c.streams == 0 {
+		c.conn.Close()
+	}
+}
+
+// remove takes c out of the manager; the caller holds mu
+func (m *connManager) remove(c *upstreamConn, reason string) {
+	delete(m.conns, c.key)
+	c.dropped = true
+	metrics.AddGauge("proxy_upstream_connections", c.labels, -1)
+	metrics.Inc("proxy_upstream_connections_closed_total", Labels{"endpoint": c.labels["endpoint"], "reason": reason})
+}
+
+// reap closes connections that have had no streams for the TTL
+func (m *connManager) reap(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.conns {
+		if c.streams == 0 && now.Sub(c.lastUsed) >= m.ttl {
+			m.remove(c, "idle")
+			c.conn.Close()
+			log.Printf("[Backend] Closed connection to %s after %s idle", c.labels["endpoint"], m.ttl)
+		}
+	}
+}
+
+// startReaper checks for idle connections until stop is closed
+func (m *connManager) startReaper(stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(max(m.ttl/4, time.Second))
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				m.reap(now)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// closeAll closes every connection; streams still open on them end
+func (m *connManager) closeAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.conns {
+		m.remove(c, "shutdown")
+		c.conn.Close()
+	}
+}
+
+// loadConnManager sets up the shared backend connections
+func (px *Proxy) loadConnManager(diag *Diagnostics) {
+	ttl := defaultConnectionTTL
+	if s := px.cfg.Backend.IdleConnectionTTL; s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			diag.Errorf("backend", "BACKEND_CONNECTION_TTL", "backend.idle_connection_ttl", "invalid duration %q", s)
+			return
+		}
+		ttl = d
+	}
+	creds := "insecure"
+	if t := px.cfg.Backend.TLS; t != nil {
+		creds = fmt.Sprintf("tls:%s:%s:%s:%s", t.CAFile, t.CertFile, t.KeyFile, t.ServerName)
+	}
+	px.conns = newConnManager(ttl, creds, px.dialEndpoint)
+	px.conns.startReaper(px.stop)
+}
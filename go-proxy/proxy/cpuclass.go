@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// --- CPU Classes ---
+//
+// Every call runs on its own goroutine, so a burst of signing on one route
+// can take every core and slow unrelated routes down. A route with a
+// cpu_class processes each message, decoding, verification, signing and
+// re-encoding, only while it holds one of the class's max_concurrent slots.
+// Routes of one class queue among themselves; a message that waits longer
+// than queue_timeout is rejected with RESOURCE_EXHAUSTED rather than joining
+// an ever longer backlog. Pass-thru routes never decode, so never queue.
+
+// CPUClassConfig bounds the concurrent message processing of its routes
+type CPUClassConfig struct {
+	MaxConcurrent int    `yaml:"max_concurrent"` // required
+	QueueTimeout  string `yaml:"queue_timeout"`  // e.g. "500ms"; default 1s
+}
+
+const defaultCPUQueueTimeout = time.Second
+
+// cpuClass is one class's shared slots
+type cpuClass struct {
+	name    string
+	labels  Labels
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+func newCPUClass(name string, maxConcurrent int, timeout time.Duration) *cpuClass {
+	return &cpuClass{name: name, labels: Labels{"class": name}, slots: make(chan struct{}, maxConcurrent), timeout: timeout}
+}
+
+// acquire waits for a slot for one message on route; the returned func gives
+// it back. A nil class admits everything at once.
+func (c *cpuClass) acquire(ctx context.Context, route *RouteConfig) (func(), error) {
+	if c == nil {
+		return func() {}, nil
+	}
+	release := func() { <-c.slots }
+	select {
+	case c.slots <- struct{}{}:
+		metrics.Observe("proxy_cpu_class_wait_seconds", c.labels, 0)
+		return release, nil
+	default:
+	}
+
+	start := time.Now()
+	metrics.AddGauge("proxy_cpu_class_queue_depth", c.labels, 1)
+	defer metrics.AddGauge("proxy_cpu_class_queue_depth", c.labels, -1)
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case c.slots <- struct{}{}:
+		metrics.ObserveDuration("proxy_cpu_class_wait_seconds", c.labels, time.Since(start))
+		return release, nil
+	case <-timer.C:
+		metrics.Inc("proxy_cpu_class_shed_total", Labels{"class": c.name, "route": route.Name})
+		return nil, rejectf(codes.ResourceExhausted, reasonCPUClassSaturated, "proxy: cpu class %q had no free slot within %s", c.name, c.timeout)
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// loadCPUClasses builds the configured classes and checks that every
+// route's cpu_class names one of them
+func (px *Proxy) loadCPUClasses(diag *Diagnostics) {
+	names := make([]string, 0, len(px.cfg.CPUClasses))
+	for name := range px.cfg.CPUClasses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cfg := px.cfg.CPUClasses[name]
+		path := "cpu_classes." + name
+		valid := true
+		if cfg.MaxConcurrent <= 0 {
+			diag.Errorf("cpu_classes", "CPU_CLASS", path+".max_concurrent", "must be positive, got %d", cfg.MaxConcurrent)
+			valid = false
+		}
+		timeout := defaultCPUQueueTimeout
+		if s := cfg.QueueTimeout; s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				diag.Errorf("cpu_classes", "CPU_CLASS", path+".queue_timeout", "invalid duration %q", s)
+				valid = false
+			}
+			timeout = d
+		}
+		if valid {
+			px.cpuClasses[name] = newCPUClass(name, cfg.MaxConcurrent, timeout)
+		}
+	}
+
+	used := make(map[string]bool)
+	for i, route := range px.cfg.Routes {
+		if route.CPUClass == "" {
+			continue
+		}
+		path := fmt.Sprintf("routes[%d].cpu_class", i)
+		used[route.CPUClass] = true
+		if _, ok := px.cfg.CPUClasses[route.CPUClass]; !ok {
+			diag.Errorf("routes", "CPU_CLASS", path, "unknown cpu class %q", route.CPUClass)
+			continue
+		}
+		if route.Mode == "pass-thru" || route.Mode == "local-reply" {
+			diag.Warnf("routes", "CPU_CLASS", path, "%s routes process no messages; cpu_class has no effect", route.Mode)
+		}
+	}
+	for _, name := range names {
+		if !used[name] {
+			diag.Warnf("cpu_classes", "CPU_CLASS", "cpu_classes."+name, "no route uses cpu class %q", name)
+		}
+	}
+}
@@ -1,25 +1,43 @@
-package main
+//go:build cgo && !norust
+
+package proxy
 
 /*
-#cgo CFLAGS: -I../../rust-crypto
-#cgo darwin LDFLAGS: -L../../rust-crypto/target/release -lrustcrypto
-#cgo linux LDFLAGS: -L../../rust-crypto/target/release -lrustcrypto
+#cgo CFLAGS: -I${SRCDIR}/../../rust-crypto
+#cgo darwin LDFLAGS: -L${SRCDIR}/../../rust-crypto/target/release -lrustcrypto
+#cgo linux LDFLAGS: -L${SRCDIR}/../../rust-crypto/target/release -lrustcrypto
+#cgo windows LDFLAGS: -L${SRCDIR}/../../rust-crypto/target/release -lrustcrypto
 #include "cryptolib.h"
 #include <stdlib.h>
 */
 import "C"
 import (
-	"log"
+	"fmt"
 	"unsafe"
 )
 
-// RustVerifySignature calls the Rust FFI verify_signature function
-func RustVerifySignature(payload, sig, pubKeyPEM []byte) bool {
-	if len(payload) == 0 || len(sig) == 0 || len(pubKeyPEM) == 0 {
-		return false
+// rustEngineLinked is reported by ReadBuildInfo; see engines.go for the
+// builds that leave the Rust library out
+const rustEngineLinked = true
+
+// cBytes copies b into C memory. Unlike C.CBytes it never returns NULL, not
+// even for an empty b, which the Rust side would refuse: an empty payload is
+// signed and verified like any other.
+func cBytes(b []byte) unsafe.Pointer {
+	p := C.malloc(C.size_t(len(b) + 1))
+	copy(unsafe.Slice((*byte)(p), len(b)), b)
+	return p
+}
+
+// RustVerifySignature calls the Rust FFI verify_signature function. It
+// reports whether sig verifies; an error, a *RustError, means the library
+// could not check it at all.
+func RustVerifySignature(payload, sig, pubKeyPEM []byte) (bool, error) {
+	if len(sig) == 0 || len(pubKeyPEM) == 0 {
+		return false, nil
 	}
 
-	cPayload := C.CBytes(payload)
+	cPayload := cBytes(payload)
 	cSig := C.CBytes(sig)
 	cPubKey := C.CBytes(pubKeyPEM)
 
@@ -27,22 +45,31 @@ func RustVerifySignature(payload, sig, pubKeyPEM []byte) bool {
 	defer C.free(cSig)
 	defer C.free(cPubKey)
 
-	res := C.verify_signature(
+	var cErr *C.char
+	rc := C.verify_signature(
 		(*C.uint8_t)(cPayload), C.uintptr_t(len(payload)),
 		(*C.uint8_t)(cSig), C.uintptr_t(len(sig)),
 		(*C.uint8_t)(cPubKey), C.uintptr_t(len(pubKeyPEM)),
+		&cErr,
 	)
 
-	return bool(res)
+	switch rc {
+	case C.RC_OK:
+		return true, nil
+	case C.RC_INVALID_SIGNATURE:
+		return false, nil
+	}
+	return false, rustFailure("verify", rc, cErr)
 }
 
-// RustSignPayload calls the Rust FFI sign_payload function
-func RustSignPayload(payload, privKeyPEM []byte) []byte {
-	if len(payload) == 0 || len(privKeyPEM) == 0 {
-		return nil
+// RustSignPayload calls the Rust FFI sign_payload function. An error is a
+// *RustError.
+func RustSignPayload(payload, privKeyPEM []byte) ([]byte, error) {
+	if len(privKeyPEM) == 0 {
+		return nil, &RustError{Op: "sign", Code: "null_argument", Message: "no private key"}
 	}
 
-	cPayload := C.CBytes(payload)
+	cPayload := cBytes(payload)
 	cPrivKey := C.CBytes(privKeyPEM)
 
 	defer C.free(cPayload)
@@ -51,16 +78,92 @@ func RustSignPayload(payload, privKeyPEM []byte) []byte {
 	var cOutSig *C.uint8_t
 	var cOutLen C.uintptr_t
 	var cOutCap C.uintptr_t
+	var cErr *C.char
 
-	success := C.sign_payload(
+	rc := C.sign_payload(
 		(*C.uint8_t)(cPayload), C.uintptr_t(len(payload)),
 		(*C.uint8_t)(cPrivKey), C.uintptr_t(len(privKeyPEM)),
 		&cOutSig, &cOutLen, &cOutCap,
+		&cErr,
+	)
+	return rustSignature(rc, cOutSig, cOutLen, cOutCap, cErr)
+}
+
+// RustVerifyDigest calls the Rust FFI verify_digest function: it checks sig
+// against the SHA-256 digest of a payload, so only the 32-byte digest crosses
+// the boundary. Results are as RustVerifySignature's.
+func RustVerifyDigest(digest, sig, pubKeyPEM []byte) (bool, error) {
+	if len(digest) != C.DIGEST_LEN {
+		return false, &RustError{Op: "verify", Code: "digest_length", Message: fmt.Sprintf("digest is %d bytes, not %d", len(digest), C.DIGEST_LEN)}
+	}
+	if len(sig) == 0 || len(pubKeyPEM) == 0 {
+		return false, nil
+	}
+
+	cSig := C.CBytes(sig)
+	cPubKey := C.CBytes(pubKeyPEM)
+
+	defer C.free(cSig)
+	defer C.free(cPubKey)
+
+	// The digest holds no Go pointers, so the library may read it in place
+	var cErr *C.char
+	rc := C.verify_digest(
+		(*C.uint8_t)(unsafe.Pointer(&digest[0])), C.uintptr_t(len(digest)),
+		(*C.uint8_t)(cSig), C.uintptr_t(len(sig)),
+		(*C.uint8_t)(cPubKey), C.uintptr_t(len(pubKeyPEM)),
+		&cErr,
+	)
+
+	switch rc {
+	case C.RC_OK:
+		return true, nil
+	case C.RC_INVALID_SIGNATURE:
+		return false, nil
+	}
+	return false, rustFailure("verify", rc, cErr)
+}
+
+// RustSignDigest calls the Rust FFI sign_digest function, which signs the
+// SHA-256 digest of a payload. The signature is the one RustSignPayload makes
+// over the payload. An error is a *RustError.
+func RustSignDigest(digest, privKeyPEM []byte) ([]byte, error) {
+	if len(digest) != C.DIGEST_LEN {
+		return nil, &RustError{Op: "sign", Code: "digest_length", Message: fmt.Sprintf("digest is %d bytes, not %d", len(digest), C.DIGEST_LEN)}
+	}
+	if len(privKeyPEM) == 0 {
+		return nil, &RustError{Op: "sign", Code: "null_argument", Message: "no private key"}
+	}
+
+	cPrivKey := C.CBytes(privKeyPEM)
+	defer C.free(cPrivKey)
+
+	var cOutSig *C.uint8_t
+	var cOutLen C.uintptr_t
+	var cOutCap C.uintptr_t
+	var cErr *C.char
+
+	rc := C.sign_digest(
+		(*C.uint8_t)(unsafe.Pointer(&digest[0])), C.uintptr_t(len(digest)),
+		(*C.uint8_t)(cPrivKey), C.uintptr_t(len(privKeyPEM)),
+		&cOutSig, &cOutLen, &cOutCap,
+		&cErr,
 	)
+	return rustSignature(rc, cOutSig, cOutLen, cOutCap, cErr)
+}
 
-	if !bool(success) || cOutSig == nil {
-		log.Printf("[Rust FFI Error] Failed to sign payload")
-		return nil
+// rustSignature copies the signature a sign call returned into Go memory and
+// frees the library's copy
+func rustSignature(rc C.int32_t, cOutSig *C.uint8_t, cOutLen, cOutCap C.uintptr_t, cErr *C.char) ([]byte, error) {
+	if rc != C.RC_OK {
+		return nil, rustFailure("sign", rc, cErr)
+	}
+	if cOutSig == nil || cOutLen == 0 {
+		// Success without a signature would break the contract; never trust it
+		if cOutSig != nil {
+			C.free_signature(cOutSig, cOutLen, cOutCap)
+		}
+		return nil, &RustError{Op: "sign", Code: "sign_failed", Message: "library reported success but returned no signature"}
 	}
 
 	// Copy the signature bytes from Rust memory into Go memory
@@ -70,5 +173,34 @@ func RustSignPayload(payload, privKeyPEM []byte) []byte {
 	// Ask Rust to free its allocated Vec<u8>
 	C.free_signature(cOutSig, cOutLen, cOutCap)
 
-	return sigBytes
+	return sigBytes, nil
+}
+
+// rustFailure copies the library's message for a failed call and frees it
+func rustFailure(op string, rc C.int32_t, cErr *C.char) *RustError {
+	msg := "no message from the library"
+	if cErr != nil {
+		msg = C.GoString(cErr)
+		C.free_error(cErr)
+	}
+	return &RustError{Op: op, Code: rustErrorCode(rc), Message: msg}
+}
+
+// rustErrorCode names a status code from cryptolib.h
+func rustErrorCode(rc C.int32_t) string {
+	switch rc {
+	case C.RC_NULL_ARGUMENT:
+		return "null_argument"
+	case C.RC_KEY_ENCODING:
+		return "key_encoding"
+	case C.RC_KEY_PARSE:
+		return "key_parse"
+	case C.RC_SIGN_FAILED:
+		return "sign_failed"
+	case C.RC_PANIC:
+		return "panic"
+	case C.RC_DIGEST_LENGTH:
+		return "digest_length"
+	}
+	return fmt.Sprintf("code_%d", int(rc))
 }
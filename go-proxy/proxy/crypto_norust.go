@@ -0,0 +1,27 @@
+//go:build !cgo || norust
+
+package proxy
+
+// Builds without cgo, or with the norust tag, have only the Go engine; NewProxy
+// refuses WithCryptoEngine("rust") before these could be called.
+const rustEngineLinked = false
+
+// RustVerifySignature always fails: the Rust engine is not linked in
+func RustVerifySignature(payload, sig, pubKeyPEM []byte) (bool, error) {
+	return false, &RustError{Op: "verify", Code: "not_linked", Message: "the rust engine is not compiled into this build"}
+}
+
+// RustSignPayload always fails: the Rust engine is not linked in
+func RustSignPayload(payload, privKeyPEM []byte) ([]byte, error) {
+	return nil, &RustError{Op: "sign", Code: "not_linked", Message: "the rust engine is not compiled into this build"}
+}
+
+// RustVerifyDigest always fails: the Rust engine is not linked in
+func RustVerifyDigest(digest, sig, pubKeyPEM []byte) (bool, error) {
+	return false, &RustError{Op: "verify", Code: "not_linked", Message: "the rust engine is not compiled into this build"}
+}
+
+// RustSignDigest always fails: the Rust engine is not linked in
+func RustSignDigest(digest, privKeyPEM []byte) ([]byte, error) {
+	return nil, &RustError{Op: "sign", Code: "not_linked", Message: "the rust engine is not compiled into this build"}
+}
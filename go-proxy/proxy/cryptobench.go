@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// --- Crypto Bench ---
+//
+// `proxy crypto-bench -key certs/proxy.key` times each engine this build has
+// signing a payload (-size, default 1 MiB) and verifying the signature, two
+// ways:
+//
+//	payload  the engine is handed the payload and hashes it for each
+//	         operation; for Rust, sign_payload and verify_signature, which
+//	         first copy it into C memory
+//	digest   the payload is hashed once and the engine is handed the 32-byte
+//	         digest, as the proxy does (sign_digest and verify_digest for Rust)
+//
+// Each line is the mean over -n rounds; a digest round's hash is counted once
+// in its total. RSA PKCS#1 v1.5 signatures are deterministic, so every
+// engine and path must make the same signature of the payload: the exit code
+// is 1 when one differs or does not verify. make bench-crypto builds the Rust
+// library and runs it.
+
+const (
+	defaultCryptoBenchSize   = 1 << 20
+	defaultCryptoBenchRounds = 20
+)
+
+// CryptoBenchResult is one engine's timings on one path
+type CryptoBenchResult struct {
+	Engine string        `json:"engine"`
+	Path   string        `json:"path"` // payload or digest
+	Hash   time.Duration `json:"hash_ns"`
+	Sign   time.Duration `json:"sign_ns"`
+	Verify time.Duration `json:"verify_ns"`
+	Total  time.Duration `json:"total_ns"`
+}
+
+// benchPath signs and verifies one payload its own way
+type benchPath struct {
+	engine, path string
+	run          func(payload []byte, r *CryptoBenchResult) ([]byte, error)
+}
+
+// cryptoBenchPaths are the paths of every engine this build has, over key
+func cryptoBenchPaths(key *signingKey) []benchPath {
+	ctx := context.Background()
+	trust := newTrustKeys(key.name, []*rsa.PublicKey{&key.load().priv.PublicKey})
+	digestPath := func(e cryptoEngine) benchPath {
+		return benchPath{e.name(), "digest", func(payload []byte, r *CryptoBenchResult) ([]byte, error) {
+			start := time.Now()
+			digest := payloadDigest(sha256.Sum256(payload))
+			hashed := time.Now()
+			sig, err := e.sign(ctx, key, digest)
+			if err != nil {
+				return nil, err
+			}
+			signed := time.Now()
+			id, err := e.verifyKeys(ctx, trust, digest, sig)
+			if err == nil && id == "" {
+				err = fmt.Errorf("the %s engine does not verify its own signature", e.name())
+			}
+			r.Hash += hashed.Sub(start)
+			r.Sign += signed.Sub(hashed)
+			r.Verify += time.Since(signed)
+			return sig, err
+		}}
+	}
+	payloadPath := func(engine string, sign func([]byte) ([]byte, error), verify func(payload, sig []byte) (bool, error)) benchPath {
+		return benchPath{engine, "payload", func(payload []byte, r *CryptoBenchResult) ([]byte, error) {
+			start := time.Now()
+			sig, err := sign(payload)
+			if err != nil {
+				return nil, err
+			}
+			signed := time.Now()
+			ok, err := verify(payload, sig)
+			if err == nil && !ok {
+				err = fmt.Errorf("the %s engine does not verify its own signature", engine)
+			}
+			r.Sign += signed.Sub(start)
+			r.Verify += time.Since(signed)
+			return sig, err
+		}}
+	}
+
+	m := key.load()
+	paths := []benchPath{
+		payloadPath(engineGo, func(payload []byte) ([]byte, error) {
+			hashed := sha256.Sum256(payload)
+			return rsa.SignPKCS1v15(nil, m.priv, crypto.SHA256, hashed[:])
+		}, func(payload, sig []byte) (bool, error) {
+			hashed := sha256.Sum256(payload)
+			return rsa.VerifyPKCS1v15(&m.priv.PublicKey, crypto.SHA256, hashed[:], sig) == nil, nil
+		}),
+		digestPath(goEngine{}),
+	}
+	if rustEngineLinked {
+		pubPEM := trust.load().pems[0]
+		paths = append(paths,
+			payloadPath(engineRust, func(payload []byte) ([]byte, error) {
+				return RustSignPayload(payload, m.pem)
+			}, func(payload, sig []byte) (bool, error) {
+				return RustVerifySignature(payload, sig, pubPEM)
+			}),
+			digestPath(rustEngine{}),
+		)
+	}
+	return paths
+}
+
+// RunCryptoBench times every engine and path over a random payload of size
+// bytes signed with the PEM private key keyPEM, rounds times each. It fails
+// when a path's signature differs from the others or does not verify.
+func RunCryptoBench(keyPEM []byte, size, rounds int) ([]CryptoBenchResult, error) {
+	diag := &Diagnostics{}
+	key := parseSigningKey("bench", keyPEM, "-key", diag)
+	if err := diag.Err(); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, size)
+	rand.Read(payload)
+
+	var want []byte
+	var results []CryptoBenchResult
+	for _, p := range cryptoBenchPaths(key) {
+		r := CryptoBenchResult{Engine: p.engine, Path: p.path}
+		for range rounds {
+			sig, err := p.run(payload, &r)
+			if err != nil {
+				return results, fmt.Errorf("%s engine, %s path: %v", p.engine, p.path, err)
+			}
+			if want == nil {
+				want = sig
+			} else if !bytes.Equal(sig, want) {
+				return results, fmt.Errorf("%s engine, %s path: the signature differs from the %s engine's on the %s path", p.engine, p.path, results[0].Engine, results[0].Path)
+			}
+		}
+		n := time.Duration(max(rounds, 1))
+		r.Hash, r.Sign, r.Verify = r.Hash/n, r.Sign/n, r.Verify/n
+		r.Total = r.Hash + r.Sign + r.Verify
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// CryptoBench is `proxy crypto-bench`; it returns the exit code
+func CryptoBench(args []string) int {
+	fs := flag.NewFlagSet("crypto-bench", flag.ExitOnError)
+	keyPath := fs.String("key", "certs/proxy.key", "PEM RSA private key to sign with")
+	size := fs.Int("size", defaultCryptoBenchSize, "payload size in bytes")
+	rounds := fs.Int("n", defaultCryptoBenchRounds, "rounds per engine and path")
+	asJSON := fs.Bool("json", false, "print the results as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: proxy crypto-bench [-key file] [-size bytes] [-n rounds] [-json]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 || *size < 0 || *rounds < 1 {
+		fs.Usage()
+		return 2
+	}
+	keyPEM, err := os.ReadFile(*keyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "crypto-bench: %v\n", err)
+		return 2
+	}
+	results, err := RunCryptoBench(keyPEM, *size, *rounds)
+	if *asJSON {
+		body, _ := json.MarshalIndent(results, "", "  ")
+		fmt.Println(string(body))
+	} else {
+		fmt.Printf("%d-byte payload, %d rounds\n", *size, *rounds)
+		fmt.Printf("%-6s %-8s %12s %12s %12s %12s\n", "engine", "path", "hash", "sign", "verify", "total")
+		for _, r := range results {
+			hash := "-"
+			if r.Path == "digest" {
+				hash = r.Hash.String()
+			}
+			fmt.Printf("%-6s %-8s %12s %12s %12s %12s\n", r.Engine, r.Path, hash, r.Sign, r.Verify, r.Total)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "crypto-bench: %v\n", err)
+		return 1
+	}
+	if !*asJSON {
+		fmt.Println("signatures identical on every engine and path")
+	}
+	return 0
+}
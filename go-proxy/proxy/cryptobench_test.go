@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"testing"
+)
+
+// BenchmarkDigest1MiB signs and verifies a 1 MiB payload on each engine and
+// path crypto-bench times: handed the payload, or its digest hashed once
+func BenchmarkDigest1MiB(b *testing.B) {
+	keyPEM, err := testKey()
+	if err != nil {
+		b.Fatal(err)
+	}
+	diag := &Diagnostics{}
+	key := parseSigningKey("bench", keyPEM, "testKey", diag)
+	if err := diag.Err(); err != nil {
+		b.Fatal(err)
+	}
+	payload := make([]byte, 1<<20)
+	rand.Read(payload)
+	for _, p := range cryptoBenchPaths(key) {
+		b.Run(p.engine+"/"+p.path, func(b *testing.B) {
+			var r CryptoBenchResult
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := p.run(payload, &r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type routeTimeouts struct {
+	defaultTimeout time.Duration
+	maxTimeout     time.Duration
+	idleTimeout    time.Duration
+}
+
+// enforcedTimeout is the cancellation cause when the proxy, rather than the
+// client, ends a call. It reaches the client as DEADLINE_EXCEEDED.
+type enforcedTimeout struct {
+	kind   string // default, max or idle
+	reason string
+}
+
+func (e *enforcedTimeout) Error() string { return "proxy: " + e.reason }
+
+func (e *enforcedTimeout) GRPCStatus() *status.Status {
+	return e.rejection().GRPCStatus()
+}
+
+func (e *enforcedTimeout) rejection() *rejection {
+	return rejectf(codes.DeadlineExceeded, reasonTimeout, "%s", e.Error()).with("timeout", e.kind)
+}
+
+// callDeadline is the upstream context for one call with the route's
+// deadline and idle timeout applied
+type callDeadline struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	abort  context.CancelCauseFunc // ends the call with cause, e.g. from the janitor
+	idle   *idleWatch              // nil unless the route has an idle timeout and the call streams
+}
+
+// withRouteDeadline injects default_timeout when the client sent no deadline,
+// clamps the client's deadline to max_timeout, and arms the idle watchdog for
+// streaming calls.
+func (px *Proxy) withRouteDeadline(parent context.Context, route *RouteConfig, unary bool) *callDeadline {
+	t := px.routeTimeoutSettings[route.Name]
+	ctx, cancelCause := context.WithCancelCause(parent)
+	dl := &callDeadline{ctx: ctx, cancel: func() { cancelCause(nil) }, abort: cancelCause}
+
+	clientDeadline, hasDeadline := parent.Deadline()
+	var enforce time.Duration
+	var cause *enforcedTimeout
+	switch {
+	case !hasDeadline && t.defaultTimeout > 0:
+		enforce = t.defaultTimeout
+		cause = &enforcedTimeout{kind: "default", reason: fmt.Sprintf("default timeout of %s for route %q exceeded", enforce, route.Name)}
+	case hasDeadline && t.maxTimeout > 0 && time.Until(clientDeadline) > t.maxTimeout:
+		enforce = t.maxTimeout
+		cause = &enforcedTimeout{kind: "max", reason: fmt.Sprintf("max timeout of %s for route %q exceeded", enforce, route.Name)}
+	}
+	if enforce > 0 {
+		var cancelDeadline context.CancelFunc
+		dl.ctx, cancelDeadline = context.WithTimeoutCause(ctx, enforce, cause)
+		dl.cancel = func() {
+			cancelDeadline()
+			cancelCause(nil)
+		}
+	}
+
+	if t.idleTimeout > 0 && !unary {
+		dl.idle = newIdleWatch(t.idleTimeout)
+		go dl.idle.run(dl.ctx, func() {
+			cancelCause(&enforcedTimeout{kind: "idle", reason: fmt.Sprintf("stream idle for more than %s on route %q", t.idleTimeout, route.Name)})
+		})
+	}
+	return dl
+}
+
+// enforcedErr replaces err with the proxy's own timeout when that is what
+// ended the call, so the client learns the proxy cut it off. The client's own
+// cancellation or deadline is left untouched.
+func (dl *callDeadline) enforcedErr(clientCtx context.Context, err error) error {
+	var enforced *enforcedTimeout
+	if err == nil || clientCtx.Err() != nil {
+		return err
+	}
+	if cause := context.Cause(dl.ctx); errors.As(cause, &enforced) {
+		metrics.Inc("proxy_enforced_timeouts_total", Labels{"kind": enforced.kind})
+		return enforced
+	}
+	return err
+}
+
+// idleWatch fires when no message has moved in either direction for timeout
+type idleWatch struct {
+	timeout time.Duration
+	last    atomic.Int64
+}
+
+func newIdleWatch(timeout time.Duration) *idleWatch {
+	w := &idleWatch{timeout: timeout}
+	w.touch()
+	return w
+}
+
+func (w *idleWatch) touch() {
+	if w != nil {
+		w.last.Store(time.Now().UnixNano())
+	}
+}
+
+func (w *idleWatch) run(ctx context.Context, expire func()) {
+	timer := time.NewTimer(w.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			idle := time.Since(time.Unix(0, w.last.Load()))
+			if idle >= w.timeout {
+				expire()
+				return
+			}
+			timer.Reset(w.timeout - idle)
+		}
+	}
+}
+
+// loadRouteTimeouts parses each route's timeout settings
+func (px *Proxy) loadRouteTimeouts(diag *Diagnostics) {
+	for i, route := range px.cfg.Routes {
+		var t routeTimeouts
+		ok := true
+		for _, f := range []struct {
+			name string
+			raw  string
+			dst  *time.Duration
+		}{
+			{"default_timeout", route.DefaultTimeout, &t.defaultTimeout},
+			{"max_timeout", route.MaxTimeout, &t.maxTimeout},
+			{"idle_timeout", route.IdleTimeout, &t.idleTimeout},
+		} {
+			if f.raw == "" {
+				continue
+			}
+			d, err := time.ParseDuration(f.raw)
+			if err != nil || d <= 0 {
+				diag.Errorf("routes", "ROUTE_TIMEOUT", fmt.Sprintf("routes[%d].%s", i, f.name), "invalid duration %q", f.raw)
+				ok = false
+				continue
+			}
+			*f.dst = d
+		}
+		if !ok || t == (routeTimeouts{}) {
+			continue
+		}
+		if t.defaultTimeout > 0 && t.maxTimeout > 0 && t.defaultTimeout > t.maxTimeout {
+			diag.Warnf("routes", "ROUTE_TIMEOUT", fmt.Sprintf("routes[%d].default_timeout", i), "default_timeout %s exceeds max_timeout %s", t.defaultTimeout, t.maxTimeout)
+		}
+		if _, dup := px.routeTimeoutSettings[route.Name]; !dup {
+			px.routeTimeoutSettings[route.Name] = t
+		}
+	}
+}
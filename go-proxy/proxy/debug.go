@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	rpprof "runtime/pprof"
+	"strings"
+)
+
+// --- Debug Listener ---
+//
+// debug.listen_address starts a third HTTP listener, separate from the data
+// path and from admin, for profiling a running proxy: net/http/pprof under
+// /debug/pprof/, expvar under /debug/vars with the proxy's own counters
+// under "proxy", a full goroutine dump at /debug/goroutines and the build at
+// /debug/buildinfo. pprof exposes heap contents, so an address without a
+// host binds to localhost only; name 0.0.0.0 to listen on every interface.
+
+type DebugConfig struct {
+	ListenAddress string `yaml:"listen_address"` // e.g. ":6060", which means 127.0.0.1:6060
+}
+
+// Internal counters for /debug/vars. Like metrics they are process-wide;
+// pass-thru messages are never decoded and so never counted.
+var (
+	debugMessages = new(expvar.Map).Init() // messages through the envelope pipeline, by mode
+	debugCrypto   = new(expvar.Map).Init() // signature and payload crypto operations, by engine.op
+)
+
+// countCrypto records one crypto operation on e for /debug/vars
+func countCrypto(e cryptoEngine, op string) {
+	debugCrypto.Add(e.name()+"."+op, 1)
+}
+
+// debugAddress defaults addr's host to localhost
+func debugAddress(addr string) string {
+	if !strings.Contains(addr, ":") {
+		addr = ":" + addr
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+		return net.JoinHostPort("127.0.0.1", port)
+	}
+	return addr
+}
+
+// startDebugServer serves the profiling endpoints on their own listener
+func (px *Proxy) startDebugServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/vars", px.varsHandler)
+	mux.HandleFunc("/debug/goroutines", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		rpprof.Lookup("goroutine").WriteTo(w, 2)
+	})
+	mux.HandleFunc("/debug/buildinfo", func(w http.ResponseWriter, _ *http.Request) {
+		body, _ := json.MarshalIndent(ReadBuildInfo(), "", "  ")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+
+	srv := &http.Server{Addr: debugAddress(addr), Handler: mux}
+	go func() {
+		log.Printf("Debug server listening on %s", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("debug server stopped: %v", err)
+		}
+	}()
+	return srv
+}
+
+// varsHandler is expvar.Handler plus this proxy's counters. They are not
+// published with expvar.Publish, which would allow only one Proxy per process.
+func (px *Proxy) varsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	expvar.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintf(w, "%q: %s,\n", kv.Key, kv.Value)
+	})
+	stats, _ := json.Marshal(px.debugVars())
+	fmt.Fprintf(w, "%q: %s\n}\n", "proxy", stats)
+}
+
+// debugVars snapshots the proxy's internal stats
+func (px *Proxy) debugVars() map[string]any {
+	descriptors := map[string]int{}
+	if l := px.lazySchema; l != nil {
+		l.mu.Lock()
+		descriptors["methods"] = len(l.methods)
+		descriptors["materialized_entries"] = len(l.entries)
+		l.mu.Unlock()
+	} else {
+		descriptors["methods"] = len(px.eagerDescriptors())
+	}
+	return map[string]any{
+		"messages_processed": json.RawMessage(debugMessages.String()),
+		"crypto_ops":         json.RawMessage(debugCrypto.String()),
+		"descriptor_cache":   descriptors,
+		"goroutines":         runtime.NumGoroutine(),
+		"crypto_engine":      px.cryptoEngine,
+	}
+}
+
+// gitCommit overrides the VCS revision for builds that carry none, e.g.
+// go run: -ldflags "-X github.com/anthony/grpc-proxy/go-proxy/proxy.gitCommit=$(git rev-parse HEAD)"
+var gitCommit string
+
+// BuildInfo describes the running binary
+type BuildInfo struct {
+	GoVersion  string `json:"go_version"`
+	Commit     string `json:"commit,omitempty"`
+	CommitTime string `json:"commit_time,omitempty"`
+	Modified   bool   `json:"modified,omitempty"` // built from a tree with uncommitted changes
+	RustEngine bool   `json:"rust_engine"`
+}
+
+// ReadBuildInfo reports the binary's Go version, source revision and
+// whether the Rust crypto engine is linked in
+func ReadBuildInfo() BuildInfo {
+	b := BuildInfo{GoVersion: runtime.Version(), Commit: gitCommit, RustEngine: rustEngineLinked}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if b.Commit == "" {
+					b.Commit = s.Value
+				}
+			case "vcs.time":
+				b.CommitTime = s.Value
+			case "vcs.modified":
+				b.Modified = s.Value == "true"
+			}
+		}
+	}
+	return b
+}
+
+func (b BuildInfo) String() string {
+	commit := b.Commit
+	if commit == "" {
+		commit = "unknown"
+	} else if b.Modified {
+		commit += " (modified)"
+	}
+	engines := engineGo
+	if b.RustEngine {
+		engines = engineGo + ", " + engineRust
+	}
+	return fmt.Sprintf("grpc-proxy commit %s, %s, crypto engines: %s", commit, b.GoVersion, engines)
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/jhump/protoreflect/dynamic"
+)
+
+// --- Decode ---
+//
+// `proxy decode -pb echo.pb -method /echo.SecureService/SecureEcho blob.b64`
+// prints what a message blob from a log or capture decodes to, as JSON. The
+// schema is loaded by the proxy's own loaders, from -pb, -reflect or the
+// schema section of -config, and an envelope's inner payload is decoded
+// through its type URL the way processMsg does it. With -config the
+// envelope's field names come from the route that matches -method.
+
+// decodeOutput is what the decode subcommand prints
+type decodeOutput struct {
+	Method    string          `json:"method"`
+	Direction string          `json:"direction"`
+	Type      string          `json:"type"`
+	Message   json.RawMessage `json:"message"`
+	Inner     *decodedInner   `json:"inner,omitempty"`
+}
+
+type decodedInner struct {
+	TypeURL string          `json:"type_url"`
+	Type    string          `json:"type"`
+	Message json.RawMessage `json:"message"`
+}
+
+// Decode implements the decode subcommand; args excludes the subcommand name.
+// It returns the process exit code.
+func Decode(args []string) int {
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	configPath := fs.String("config", "", "proxy config to take the schema and envelope fields from")
+	pbPath := fs.String("pb", "", "FileDescriptorSet to decode with")
+	reflectAddr := fs.String("reflect", "", "backend address to load the schema from by server reflection")
+	method := fs.String("method", "", "full method name, e.g. /echo.SecureService/SecureEcho")
+	direction := fs.String("direction", "request", "request or response")
+	encoding := fs.String("encoding", "auto", "input encoding: raw, base64, hex, or auto (hex, then base64, then raw)")
+	payloadField := fs.String("payload-field", "payload", "envelope field holding the inner payload")
+	typeURLField := fs.String("type-url-field", "type_url", "envelope field holding the inner type URL")
+	verbose := fs.Bool("v", false, "show the schema loaders' logs")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: proxy decode (-pb file | -reflect host:port | -config file) -method /pkg.Svc/Method [flags] [file]")
+		fmt.Fprintln(fs.Output(), "Reads the message from file, or stdin when file is omitted or \"-\".")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *method == "" || fs.NArg() > 1 || (*configPath == "" && *pbPath == "" && *reflectAddr == "") ||
+		(*pbPath != "" && *reflectAddr != "") || (*direction != "request" && *direction != "response") {
+		fs.Usage()
+		return 2
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	diag := &Diagnostics{}
+	var cfg Config
+	if *configPath != "" {
+		var ok bool
+		if cfg, ok = LoadConfig(*configPath, diag); !ok {
+			diag.Report(os.Stderr)
+			return 1
+		}
+	}
+	switch {
+	case *pbPath != "":
+		cfg.Schema = SchemaConfig{Method: "pb", PBPath: *pbPath}
+	case *reflectAddr != "":
+		cfg.Schema = SchemaConfig{Method: "reflect"}
+		cfg.Backend.Address, cfg.Backend.Addresses = *reflectAddr, nil
+	}
+	cfg.Schema.Lazy = false
+
+	px := &Proxy{cfg: cfg, routes: newRouteTable(cfg.Routes), stop: make(chan struct{})}
+	defer close(px.stop)
+	px.loadBackendTLS(diag)
+	if cfg.Schema.Method == "reflect" {
+		px.loadBackends(diag)
+	}
+	px.loadSchema(diag)
+	if diag.HasErrors() {
+		diag.Report(os.Stderr)
+		return 1
+	}
+
+	md, ok := px.lookupMethod(*method)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "decode: no descriptor loaded for %s\n", *method)
+		return 1
+	}
+	msgDesc := md.GetInputType()
+	if *direction == "response" {
+		msgDesc = md.GetOutputType()
+	}
+
+	raw, err := readDecodeInput(fs.Arg(0), *encoding)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "decode: %v\n", err)
+		return 1
+	}
+	msg := dynamic.NewMessage(msgDesc)
+	if err := msg.Unmarshal(raw); err != nil {
+		fmt.Fprintf(os.Stderr, "decode: %d bytes do not decode as %s: %v\n", len(raw), msgDesc.GetFullyQualifiedName(), err)
+		return 1
+	}
+	js, _ := msg.MarshalJSON()
+	out := decodeOutput{Method: *method, Direction: *direction, Type: msgDesc.GetFullyQualifiedName(), Message: js}
+
+	// The route's envelope fields apply unless the flags name others
+	if *configPath != "" {
+		env := px.configuredRoute(*method).Envelope
+		if !set["payload-field"] && env.PayloadField != "" {
+			*payloadField = env.PayloadField
+		}
+		if !set["type-url-field"] && env.TypeURLField != "" {
+			*typeURLField = env.TypeURLField
+		}
+	}
+	code := 0
+	typeURL := getStringField(msg, msgDesc.FindFieldByName(*typeURLField))
+	inner, innerErr := px.decodeInner(typeURL, getBytesField(msg, msgDesc.FindFieldByName(*payloadField)))
+	switch {
+	case innerErr != nil:
+		fmt.Fprintf(os.Stderr, "decode: %s does not decode as %s: %v\n", *payloadField, typeURL, innerErr)
+		code = 1
+	case inner != nil:
+		innerJS, _ := inner.MarshalJSON()
+		out.Inner = &decodedInner{TypeURL: typeURL, Type: inner.GetMessageDescriptor().GetFullyQualifiedName(), Message: innerJS}
+	case typeURL != "":
+		fmt.Fprintf(os.Stderr, "decode: inner type %q is not in the loaded schema\n", typeURL)
+	}
+
+	pretty, _ := json.MarshalIndent(out, "", "  ")
+	fmt.Println(string(pretty))
+	return code
+}
+
+// readDecodeInput reads the message from path, or stdin for "" and "-", and
+// undoes its text encoding
+func readDecodeInput(path, encoding string) ([]byte, error) {
+	var b []byte
+	var err error
+	if path == "" || path == "-" {
+		b, err = io.ReadAll(os.Stdin)
+	} else {
+		b, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	text := bytes.TrimSpace(b)
+	switch encoding {
+	case "raw":
+		return b, nil
+	case "hex":
+		return hex.DecodeString(string(text))
+	case "base64":
+		return base64.StdEncoding.DecodeString(string(text))
+	case "auto":
+		if d, err := hex.DecodeString(string(text)); err == nil {
+			return d, nil
+		}
+		if d, err := base64.StdEncoding.DecodeString(string(text)); err == nil {
+			return d, nil
+		}
+		if d, err := base64.RawURLEncoding.DecodeString(string(bytes.TrimRight(text, "="))); err == nil {
+			return d, nil
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("unknown encoding %q (expected raw, base64, hex or auto)", encoding)
+}
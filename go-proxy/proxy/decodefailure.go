@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// --- Undecodable Messages ---
+//
+// A message the proxy cannot decode is one whose method has no descriptor
+// (reflection still pending, a method the schema lacks), whose envelope does
+// not unmarshal, whose type lacks the route's payload field (or, on a route
+// signing that direction, its proxy signature field), or whose envelope
+// fields have the wrong type (see fieldtypes.go). Nothing can be
+// verified or signed on it, so what happens is the route's on_decode_failure:
+//
+//	pass    forward the message byte for byte, uninspected
+//	reject  fail the call with ENVELOPE_UNDECODABLE: INVALID_ARGUMENT for a
+//	        request, INTERNAL for a response
+//
+// inspect-verify-sign routes reject by default, so an enforcing route never
+// forwards what it could not check; inspect-outer routes pass by default.
+// session-token routes, which only decode a stream's first message, always
+// reject: a stream they cannot verify gets no token.
+// encrypt-payload and wrap-envelope routes always reject, and requests failing a route's
+// validate_inner rules are rejected by those. Either way the message is
+// counted in proxy_decode_failures_total by route, direction, reason
+// (no_descriptor, unmarshal_error, missing_field, wrong_type) and policy, and logged with
+// its method and first bytes, at most once per decodeLogInterval for each
+// route, method and reason.
+
+// Decode failure policies
+const (
+	decodeFailurePass   = "pass"
+	decodeFailureReject = "reject"
+)
+
+// Decode failure reasons
+const (
+	decodeNoDescriptor   = "no_descriptor"
+	decodeUnmarshalError = "unmarshal_error"
+	decodeMissingField   = "missing_field"
+	decodeWrongType      = "wrong_type"
+)
+
+const (
+	decodeLogInterval = 10 * time.Second
+	decodeLogBytes    = 16 // of the message, in hex
+)
+
+// decodeFailurePolicy is route's on_decode_failure, or its mode's default
+func decodeFailurePolicy(route *RouteConfig) string {
+	switch {
+	case route.OnDecodeFailure != "":
+		return route.OnDecodeFailure
+	case route.Mode == "inspect-verify-sign" || route.Mode == "session-token":
+		return decodeFailureReject
+	}
+	return decodeFailurePass
+}
+
+// decodeFailed applies route's policy to a message processEnvelope could not
+// decode, returning it unchanged to pass or the rejection
+func (px *Proxy) decodeFailed(route *RouteConfig, method string, isReq bool, reason string, payload []byte, cause error) ([]byte, error) {
+	policy := decodeFailurePolicy(route)
+	if route.Mode == "encrypt-payload" || route.Mode == "wrap-envelope" {
+		policy = decodeFailureReject
+	}
+	dir := directionOf(isReq)
+	metrics.Inc("proxy_decode_failures_total", Labels{"route": route.Name, "direction": dir.String(), "reason": reason, "policy": policy, "shadow": shadowLabel(route)})
+	px.decodeLogs.printf(route.Name+" "+method+" "+reason, "[%s Decode Failure] %s (route %s, %s): %v; first bytes %x (policy: %s)",
+		dir.label(), method, route.Name, reason, cause, payload[:min(len(payload), decodeLogBytes)], policy)
+
+	if route.Mode == "encrypt-payload" {
+		return nil, cryptRejection(route, isReq, "undecodable", "%v", cause)
+	}
+	if isReq {
+		if err := px.checkEnvelope(route, cause); err != nil {
+			return nil, err
+		}
+	}
+	if policy == decodeFailurePass {
+		return payload, nil
+	}
+	code := codes.InvalidArgument
+	if !isReq {
+		code = codes.Internal
+	}
+	return nil, rejectf(code, reasonEnvelopeUndecodable, "proxy: %v", cause)
+}
+
+// missingEnvelopeField names the route's envelope field env's type lacks that
+// the message cannot be handled without, or is ""
+func (px *Proxy) missingEnvelopeField(route *RouteConfig, env *resolvedEnvelope, isReq bool) string {
+	if route.Envelope.PayloadField != "" && env.payload == nil {
+		return fmt.Sprintf("payload_field %q", route.Envelope.PayloadField)
+	}
+	e, signs := route.Envelope, px.cryptoPlanFor(route).of(isReq).signs
+	if route.Mode == "inspect-verify-sign" && e.ItemsField != "" {
+		switch {
+		case env.items == nil:
+			return fmt.Sprintf("items_field %q", e.ItemsField)
+		case e.ItemPayloadField != "" && env.item.payload == nil:
+			return fmt.Sprintf("item_payload_field %q", e.ItemPayloadField)
+		case perItemSigned(e) && signs && env.item.proxySig == nil:
+			return fmt.Sprintf("item_proxy_sig_field %q", e.ItemProxySigField)
+		}
+	}
+	if route.Mode == "inspect-verify-sign" && !perItemSigned(e) && env.proxySig == nil && env.proxySigList == nil && e.ProxySigMetadataKey == "" && signs {
+		if route.Envelope.ProxySigListField != "" {
+			return fmt.Sprintf("proxy_sig_list_field %q", route.Envelope.ProxySigListField)
+		}
+		return fmt.Sprintf("proxy_sig_field %q", route.Envelope.ProxySigField)
+	}
+	if route.Mode == "session-token" && isReq && env.clientSig == nil && env.clientSigHeader == "" {
+		return fmt.Sprintf("client_sig_field %q", route.Envelope.ClientSigField)
+	}
+	return ""
+}
+
+// sampledLog prints at most one line per key and interval, counting the
+// lines it held back in the next one
+type sampledLog struct {
+	interval time.Duration
+	mu       sync.Mutex
+	keys     map[string]*sampledKey
+}
+
+type sampledKey struct {
+	last       time.Time
+	suppressed int
+}
+
+func newSampledLog(interval time.Duration) *sampledLog {
+	return &sampledLog{interval: interval, keys: make(map[string]*sampledKey)}
+}
+
+func (l *sampledLog) printf(key, format string, args ...interface{}) {
+	suppressed, ok := l.allow(key)
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		format += fmt.Sprintf(" (%d like it suppressed)", suppressed)
+	}
+	log.Printf(format, args...)
+}
+
+// allow reports whether a line for key may be printed now, and how many
+// were held back since the last one
+func (l *sampledLog) allow(key string) (int, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	k := l.keys[key]
+	if k == nil {
+		k = &sampledKey{}
+		l.keys[key] = k
+	}
+	now := time.Now()
+	if !k.last.IsZero() && now.Sub(k.last) < l.interval {
+		k.suppressed++
+		return 0, false
+	}
+	suppressed := k.suppressed
+	k.last, k.suppressed = now, 0
+	return suppressed, true
+}
+
+// loadDecodeFailures checks each route's on_decode_failure
+func (px *Proxy) loadDecodeFailures(diag *Diagnostics) {
+	for i, route := range px.cfg.Routes {
+		if route.OnDecodeFailure == "" {
+			continue
+		}
+		path := fmt.Sprintf("routes[%d].on_decode_failure", i)
+		switch route.OnDecodeFailure {
+		case decodeFailurePass, decodeFailureReject:
+		default:
+			diag.Errorf("routes", "ROUTE_DECODE_FAILURE", path, "unknown policy %q (expected pass or reject)", route.OnDecodeFailure)
+			continue
+		}
+		switch {
+		case route.Mode == "pass-thru" || route.Mode == "local-reply":
+			diag.Warnf("routes", "ROUTE_DECODE_FAILURE", path, "has no effect on %s routes, which do not decode", route.Mode)
+		case route.Mode == "encrypt-payload" && route.OnDecodeFailure == decodeFailurePass:
+			diag.Errorf("routes", "ROUTE_DECODE_FAILURE", path, "encrypt-payload routes cannot pass messages they cannot encrypt")
+		case route.Mode == "wrap-envelope" && route.OnDecodeFailure == decodeFailurePass:
+			diag.Errorf("routes", "ROUTE_DECODE_FAILURE", path, "wrap-envelope routes cannot pass messages they cannot wrap or unwrap")
+		case route.Mode == "session-token" && route.OnDecodeFailure == decodeFailurePass:
+			diag.Errorf("routes", "ROUTE_DECODE_FAILURE", path, "session-token routes cannot mint a token for a first message they cannot verify")
+		case route.Mode == "inspect-verify-sign" && route.OnDecodeFailure == decodeFailurePass:
+			diag.Warnf("routes", "ROUTE_DECODE_FAILURE", path, "forwards undecodable messages unverified and unsigned")
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// --- Decode Guards ---
+//
+// Dynamic unmarshal allocates for every field and nesting level it meets, so
+// a small crafted message (thousands of nested groups, or a flood of tiny
+// unknown fields) can cost far more memory than its size suggests. Before a
+// request envelope, or the inner payload its type_url names, is unmarshalled,
+// processMsg checks its size and walks its wire format once without
+// allocating, counting fields and nesting (message fields by the descriptor,
+// groups always). A request over any limit is rejected with INVALID_ARGUMENT
+// and reason DECODE_LIMIT_EXCEEDED before decoding starts. decode_limits sets
+// the limits for every route; a route's own decode_limits overrides them one
+// by one. Responses come from the backend and are not guarded. Tap and
+// capture skip decoding what the guards would reject.
+
+// DecodeLimitsConfig bounds what is handed to dynamic unmarshal. Zero values
+// take the defaults globally, and the global values on a route.
+type DecodeLimitsConfig struct {
+	MaxMessageBytes int `yaml:"max_message_bytes"` // default 4 MiB
+	MaxDepth        int `yaml:"max_depth"`         // nesting below the top-level message; default 100
+	MaxFields       int `yaml:"max_fields"`        // fields at every level together; default 100000
+}
+
+const (
+	defaultDecodeMaxBytes  = 4 << 20
+	defaultDecodeMaxDepth  = 100
+	defaultDecodeMaxFields = 100000
+)
+
+// decodeLimits are a route's effective limits
+type decodeLimits struct {
+	maxBytes, maxDepth, maxFields int
+}
+
+// decodeLimitExceeded names the limit a message broke
+type decodeLimitExceeded struct {
+	limit string // max_message_bytes, max_depth or max_fields
+	max   int
+}
+
+func (e *decodeLimitExceeded) Error() string {
+	return fmt.Sprintf("%s of %d exceeded", e.limit, e.max)
+}
+
+// check reports the first limit b breaks as a message of type md; md may be
+// nil, and then only groups count as nesting
+func (l decodeLimits) check(md *desc.MessageDescriptor, b []byte) *decodeLimitExceeded {
+	if len(b) > l.maxBytes {
+		return &decodeLimitExceeded{"max_message_bytes", l.maxBytes}
+	}
+	s := wireScan{limits: l}
+	_, err := s.scan(b, md, 0, 0)
+	return err
+}
+
+// wireScan walks a message's wire format, counting fields across levels
+type wireScan struct {
+	limits decodeLimits
+	fields int
+}
+
+// scan walks one message's fields and returns how many bytes it consumed:
+// all of b, or up to and including the end tag of the group it is inside.
+// Malformed input ends the walk without an error; unmarshal reports it.
+func (s *wireScan) scan(b []byte, md *desc.MessageDescriptor, depth int, group protowire.Number) (int, *decodeLimitExceeded) {
+	if depth > s.limits.maxDepth {
+		return 0, &decodeLimitExceeded{"max_depth", s.limits.maxDepth}
+	}
+	off := 0
+	for off < len(b) {
+		num, typ, n := protowire.ConsumeTag(b[off:])
+		if n < 0 {
+			return len(b), nil
+		}
+		off += n
+		if typ == protowire.EndGroupType {
+			if num != group {
+				return len(b), nil
+			}
+			return off, nil
+		}
+		if s.fields++; s.fields > s.limits.maxFields {
+			return 0, &decodeLimitExceeded{"max_fields", s.limits.maxFields}
+		}
+		var sub *desc.MessageDescriptor
+		if md != nil {
+			if fd := md.FindFieldByNumber(int32(num)); fd != nil {
+				sub = fd.GetMessageType() // map entries included
+			}
+		}
+		switch typ {
+		case protowire.StartGroupType:
+			n, err := s.scan(b[off:], sub, depth+1, num)
+			if err != nil {
+				return 0, err
+			}
+			off += n
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b[off:])
+			if n < 0 {
+				return len(b), nil
+			}
+			if sub != nil {
+				if _, err := s.scan(v, sub, depth+1, 0); err != nil {
+					return 0, err
+				}
+			}
+			off += n
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b[off:])
+			if n < 0 {
+				return len(b), nil
+			}
+			off += n
+		}
+	}
+	return off, nil
+}
+
+// decodeLimitsFor is route's effective limits
+func (px *Proxy) decodeLimitsFor(route *RouteConfig) decodeLimits {
+	if l, ok := px.routeDecodeLimits[route.Name]; ok {
+		return l
+	}
+	return px.decodeLimits
+}
+
+// guardDecode rejects a request message of type md that breaks the route's
+// limits; what is the log and metadata name for it, envelope or inner
+func (px *Proxy) guardDecode(route *RouteConfig, method, what string, md *desc.MessageDescriptor, b []byte) error {
+	exceeded := px.decodeLimitsFor(route).check(md, b)
+	if exceeded == nil {
+		return nil
+	}
+	metrics.Inc("proxy_decode_limit_rejections_total", Labels{"route": route.Name, "limit": exceeded.limit, "shadow": shadowLabel(route)})
+	log.Printf("[Request Rejected] %s: %s of %d bytes breaks %v", method, what, len(b), exceeded)
+	return rejectf(codes.InvalidArgument, reasonDecodeLimit, "proxy: request %s exceeds %s (%d)", what, exceeded.limit, exceeded.max).
+		with("limit", exceeded.limit).with("max", strconv.Itoa(exceeded.max))
+}
+
+// resolveDecodeLimits fills unset values of cfg from base
+func resolveDecodeLimits(cfg DecodeLimitsConfig, base decodeLimits) decodeLimits {
+	l := base
+	if cfg.MaxMessageBytes > 0 {
+		l.maxBytes = cfg.MaxMessageBytes
+	}
+	if cfg.MaxDepth > 0 {
+		l.maxDepth = cfg.MaxDepth
+	}
+	if cfg.MaxFields > 0 {
+		l.maxFields = cfg.MaxFields
+	}
+	return l
+}
+
+func checkDecodeLimits(cfg DecodeLimitsConfig, component, path string, diag *Diagnostics) bool {
+	if cfg.MaxMessageBytes < 0 || cfg.MaxDepth < 0 || cfg.MaxFields < 0 {
+		diag.Errorf(component, "DECODE_LIMITS_NEGATIVE", path, "decode limits must not be negative")
+		return false
+	}
+	return true
+}
+
+// loadDecodeLimits resolves the global decode limits and each route's
+func (px *Proxy) loadDecodeLimits(diag *Diagnostics) {
+	px.decodeLimits = decodeLimits{defaultDecodeMaxBytes, defaultDecodeMaxDepth, defaultDecodeMaxFields}
+	if checkDecodeLimits(px.cfg.DecodeLimits, "decode_limits", "decode_limits", diag) {
+		px.decodeLimits = resolveDecodeLimits(px.cfg.DecodeLimits, px.decodeLimits)
+	}
+	for i, route := range px.cfg.Routes {
+		if route.DecodeLimits == (DecodeLimitsConfig{}) {
+			continue
+		}
+		path := fmt.Sprintf("routes[%d].decode_limits", i)
+		if !checkDecodeLimits(route.DecodeLimits, "routes", path, diag) {
+			continue
+		}
+		if route.Mode == "pass-thru" || route.Mode == "local-reply" {
+			diag.Warnf("routes", "ROUTE_DECODE_LIMITS", path, "%s routes do not decode requests", route.Mode)
+		}
+		if _, dup := px.routeDecodeLimits[route.Name]; !dup {
+			px.routeDecodeLimits[route.Name] = resolveDecodeLimits(route.DecodeLimits, px.decodeLimits)
+		}
+	}
+}
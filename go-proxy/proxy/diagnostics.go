@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// --- Startup Diagnostics ---
+//
+// Every startup phase (config parsing, descriptor loading, CMS material, TLS,
+// route planning) reports problems into a shared Diagnostics collection rather
+// than exiting on the first one, so operators see everything in one run.
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+type Diagnostic struct {
+	Code      string   `json:"code"`
+	Severity  Severity `json:"severity"`
+	Component string   `json:"component"`      // config, schema, cms, tls, routes, ...
+	Path      string   `json:"path,omitempty"` // config path or file the problem refers to
+	Message   string   `json:"message"`
+}
+
+type Diagnostics struct {
+	Items []Diagnostic `json:"diagnostics"`
+}
+
+func (d *Diagnostics) add(sev Severity, component, code, path, format string, args ...interface{}) {
+	d.Items = append(d.Items, Diagnostic{
+		Code:      code,
+		Severity:  sev,
+		Component: component,
+		Path:      path,
+		Message:   fmt.Sprintf(format, args...),
+	})
+}
+
+func (d *Diagnostics) Errorf(component, code, path, format string, args ...interface{}) {
+	d.add(SeverityError, component, code, path, format, args...)
+}
+
+func (d *Diagnostics) Warnf(component, code, path, format string, args ...interface{}) {
+	d.add(SeverityWarning, component, code, path, format, args...)
+}
+
+func (d *Diagnostics) count(sev Severity) int {
+	n := 0
+	for _, item := range d.Items {
+		if item.Severity == sev {
+			n++
+		}
+	}
+	return n
+}
+
+func (d *Diagnostics) HasErrors() bool {
+	return d.count(SeverityError) > 0
+}
+
+// Err returns the collection as an error when it contains at least one error
+func (d *Diagnostics) Err() error {
+	if !d.HasErrors() {
+		return nil
+	}
+	return &DiagnosticsError{Diagnostics: d}
+}
+
+// Report writes a human-readable report grouped by component, errors first
+func (d *Diagnostics) Report(w io.Writer) {
+	if len(d.Items) == 0 {
+		return
+	}
+	groups := make(map[string][]Diagnostic)
+	var components []string
+	for _, item := range d.Items {
+		if _, ok := groups[item.Component]; !ok {
+			components = append(components, item.Component)
+		}
+		groups[item.Component] = append(groups[item.Component], item)
+	}
+	sort.Strings(components)
+
+	fmt.Fprintf(w, "Startup diagnostics: %d error(s), %d warning(s)\n", d.count(SeverityError), d.count(SeverityWarning))
+	for _, c := range components {
+		items := groups[c]
+		sort.SliceStable(items, func(i, j int) bool { return items[i].Severity == SeverityError && items[j].Severity != SeverityError })
+		fmt.Fprintf(w, "[%s]\n", c)
+		for _, item := range items {
+			loc := ""
+			if item.Path != "" {
+				loc = " (" + item.Path + ")"
+			}
+			fmt.Fprintf(w, "  %-7s %s%s: %s\n", strings.ToUpper(string(item.Severity)), item.Code, loc, item.Message)
+		}
+	}
+}
+
+func (d *Diagnostics) JSON() ([]byte, error) {
+	return json.MarshalIndent(d, "", "  ")
+}
+
+// DiagnosticsError lets callers recover the full diagnostics list with errors.As
+type DiagnosticsError struct {
+	Diagnostics *Diagnostics
+}
+
+func (e *DiagnosticsError) Error() string {
+	var b strings.Builder
+	e.Diagnostics.Report(&b)
+	return strings.TrimSpace(b.String())
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// TestDiagnosticsReportEveryProblem starts a proxy from a config with five
+// unrelated problems in different startup phases, and checks that one run
+// reports all five in its JSON report
+func TestDiagnosticsReportEveryProblem(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+	cfg := testConfig(t, []RouteConfig{
+		{Name: "unknown-mode", Match: "/echo.EchoService/*", Mode: "inspect-everything"},
+		{Name: "secure", Match: "/echo.SecureService/*", Mode: "inspect-outer", Envelope: secureEnvelope,
+			Processors: []string{"pii-scan"},
+			Limits:     LimitsConfig{RequestsPerSecond: -1}},
+	})
+	cfg.Server.TLS = &TLSConfig{CertFile: missing + ".crt", KeyFile: missing + ".key"}
+	cfg.CMS.ProxyPrivateKey = missing + ".key"
+
+	diag := &Diagnostics{}
+	_, err := NewProxy(cfg, WithDiagnostics(diag))
+	var derr *DiagnosticsError
+	if !errors.As(err, &derr) || derr.Diagnostics != diag {
+		t.Fatalf("NewProxy: %v, want the diagnostics as its error", err)
+	}
+
+	b, err := diag.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report struct {
+		Diagnostics []Diagnostic `json:"diagnostics"`
+	}
+	if err := json.Unmarshal(b, &report); err != nil {
+		t.Fatal(err)
+	}
+	var codes []string
+	for _, d := range report.Diagnostics {
+		if d.Severity == SeverityError {
+			codes = append(codes, d.Code)
+		}
+	}
+	slices.Sort(codes)
+	want := []string{"CMS_PRIVATE_KEY_READ", "LISTENER_TLS", "ROUTE_LIMITS_NEGATIVE", "ROUTE_MODE", "ROUTE_PROCESSOR"}
+	if !slices.Equal(codes, want) {
+		t.Errorf("report has errors %v, want %v:\n%s", codes, want, b)
+	}
+}
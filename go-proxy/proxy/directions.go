@@ -0,0 +1,369 @@
+package proxy
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"sync/atomic"
+)
+
+// --- Per-Direction Verify and Sign ---
+//
+// An inspect-verify-sign route may say what happens to each direction with
+// two verbs, verify and sign:
+//
+//	request:  {verify: none, sign: proxy_key}       # egress: attest what leaves
+//	response: {verify: partner_trust, sign: none}   # check the partner's reply
+//
+// verify is none, client_trust (requests; cms.client_trust_store or the
+// route's trust domains, over envelope.client_sig_field), backend_trust
+// (responses; cms.backend_trust_store over envelope.backend_sig_field) or a
+// cms.trust_stores name, which checks the signature field of that direction.
+// sign is none, proxy_key (cms.proxy_private_key) or a cms.keys name, and
+// writes envelope.proxy_sig_field. A direction left out keeps the default:
+//
+//	request:  {verify: client_trust, sign: proxy_key}
+//	response: {verify: backend_trust, sign: proxy_key}  # backend_trust only with backend_sig_field
+//
+// so the other modes read as verbs too: inspect-outer is none/none both ways,
+// and an egress proxy is the route above, pointed at the partner over
+// backend.tls. A response checked against a named store follows
+// backend_sig_on_fail, like one checked against backend_trust. A request
+// whose signature fails the check is audited and rejected UNAUTHENTICATED
+// (SIGNATURE_INVALID), as under client_trust, and never signed; only a shadow
+// route forwards it, counting it in proxy_shadow_decisions_total as rejected.
+// Each route's verbs are resolved once at startup into a cryptoPlan.
+
+// DirectionCryptoConfig is what an inspect-verify-sign route does to the
+// messages travelling one way
+type DirectionCryptoConfig struct {
+	Verify string `yaml:"verify"` // none, client_trust, backend_trust or a cms.trust_stores name
+	Sign   string `yaml:"sign"`   // none, proxy_key or a cms.keys name
+}
+
+// Built-in verb values
+const (
+	verbNone         = "none"
+	verbClientTrust  = "client_trust"
+	verbBackendTrust = "backend_trust"
+	verbProxyKey     = "proxy_key"
+)
+
+// signingKey is a private key, with its PEM for the Rust FFI
+type signingKey struct {
+	name     string                      // proxy_key or the cms.keys name
+	material atomic.Pointer[keyMaterial] // replaced whole on reload; see secrets.go
+}
+
+// keyMaterial is a private key with its PEM for the Rust FFI
+type keyMaterial struct {
+	priv *rsa.PrivateKey
+	pem  []byte
+}
+
+func newSigningKey(name string, priv *rsa.PrivateKey, pemBytes []byte) *signingKey {
+	k := &signingKey{name: name}
+	k.material.Store(&keyMaterial{priv: priv, pem: pemBytes})
+	return k
+}
+
+// load is the key's current material; sign with one load, not two
+func (k *signingKey) load() *keyMaterial {
+	return k.material.Load()
+}
+
+// id is the key's audit id, "" for none
+func (k *signingKey) id() string {
+	if k == nil {
+		return ""
+	}
+	return keyID(&k.load().priv.PublicKey)
+}
+
+// trustKeys are the public keys a signature may verify against, with their
+// PEM for the Rust FFI
+type trustKeys struct {
+	name     string // backend_trust or the cms.trust_stores name
+	material atomic.Pointer[trustMaterial]
+}
+
+type trustMaterial struct {
+	keys []*rsa.PublicKey
+	pems [][]byte
+}
+
+func (t *trustKeys) load() *trustMaterial {
+	return t.material.Load()
+}
+
+// directionPlan is one direction's resolved verbs
+type directionPlan struct {
+	verify string     // verbNone, verbClientTrust, or the name of trust
+	trust  *trustKeys // for every verify but none and client_trust
+	signs  bool
+	key    *signingKey // set whenever signs is, or the route does not start
+}
+
+// verifies reports whether the direction checks a signature against trust
+func (d *directionPlan) verifies() bool {
+	return d.verify != verbNone && d.verify != verbClientTrust
+}
+
+// cryptoPlan is a route's verify and sign verbs for both directions
+type cryptoPlan struct {
+	request, response directionPlan
+}
+
+// of is the plan for requests or responses
+func (p *cryptoPlan) of(isReq bool) *directionPlan {
+	if isReq {
+		return &p.request
+	}
+	return &p.response
+}
+
+// cryptoPlanFor is route's plan; routes without verbs share the default
+func (px *Proxy) cryptoPlanFor(route *RouteConfig) *cryptoPlan {
+	if p, ok := px.routeCrypto[route.Name]; ok {
+		return p
+	}
+	return px.defaultCrypto
+}
+
+// loadNamedKeys reads cms.keys and cms.trust_stores
+func (px *Proxy) loadNamedKeys(diag *Diagnostics) {
+	for name, path := range px.cfg.CMS.Keys {
+		diagPath := "cms.keys." + name
+		if name == verbNone || name == verbProxyKey {
+			diag.Errorf("cms", "CMS_NAMED_KEY", diagPath, "%q is a built-in sign verb", name)
+			continue
+		}
+		if key := px.loadSigningKey(name, path, diagPath, diag); key != nil {
+			px.namedKeys[name] = key
+		}
+	}
+	for name, path := range px.cfg.CMS.TrustStores {
+		diagPath := "cms.trust_stores." + name
+		if name == verbNone || name == verbClientTrust || name == verbBackendTrust {
+			diag.Errorf("cms", "CMS_NAMED_TRUST_STORE", diagPath, "%q is a built-in verify verb", name)
+			continue
+		}
+		keys, err := px.loadTrustKeys(name, path, diagPath)
+		if err != nil {
+			diag.Errorf("cms", "CMS_TRUST_STORE_READ", diagPath, "failed to load trust store: %v", err)
+			continue
+		}
+		px.namedTrust[name] = keys
+	}
+}
+
+// loadSigningKey reads an RSA private key from the secret uri, and swaps in
+// the new key whenever the secret changes
+func (px *Proxy) loadSigningKey(name, uri, diagPath string, diag *Diagnostics) *signingKey {
+	keyBytes, p, err := px.readSecret(uri)
+	if err != nil {
+		diag.Errorf("cms", "CMS_PRIVATE_KEY_READ", diagPath, "failed to read private key: %v", err)
+		return nil
+	}
+	key := parseSigningKey(name, keyBytes, diagPath, diag)
+	if key != nil {
+		px.watchSecret(diagPath, p, keyBytes, func(b []byte) error {
+			parsed := &Diagnostics{}
+			next := parseSigningKey(name, b, diagPath, parsed)
+			if next == nil {
+				return reparseError(parsed)
+			}
+			key.material.Store(next.load())
+			return nil
+		})
+	}
+	return key
+}
+
+// parseSigningKey parses an RSA private key in PKCS#8 or PKCS#1 PEM
+func parseSigningKey(name string, keyBytes []byte, diagPath string, diag *Diagnostics) *signingKey {
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		diag.Errorf("cms", "CMS_PRIVATE_KEY_PARSE", diagPath, "failed to parse PEM block containing the key")
+		return nil
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		priv, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			diag.Errorf("cms", "CMS_PRIVATE_KEY_PARSE", diagPath, "failed to parse private key: %v", err)
+			return nil
+		}
+	}
+	key, ok := priv.(*rsa.PrivateKey)
+	if !ok {
+		diag.Errorf("cms", "CMS_PRIVATE_KEY_TYPE", diagPath, "private key is not RSA")
+		return nil
+	}
+	return newSigningKey(name, key, keyBytes)
+}
+
+// loadTrustKeys reads the RSA keys of the certificates in the secret uri, and
+// swaps in the new keys whenever the secret changes
+func (px *Proxy) loadTrustKeys(name, uri, diagPath string) (*trustKeys, error) {
+	b, p, err := px.readSecret(uri)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseCertKeys(b, uri)
+	if err != nil {
+		return nil, err
+	}
+	t := newTrustKeys(name, keys)
+	px.watchSecret(diagPath, p, b, func(b []byte) error {
+		keys, err := parseCertKeys(b, uri)
+		if err != nil {
+			return err
+		}
+		t.material.Store(newTrustKeys(name, keys).load())
+		return nil
+	})
+	return t, nil
+}
+
+// newTrustKeys holds keys along with the PEM forms the Rust engine takes
+func newTrustKeys(name string, keys []*rsa.PublicKey) *trustKeys {
+	m := &trustMaterial{keys: keys}
+	for _, key := range keys {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			continue
+		}
+		m.pems = append(m.pems, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	}
+	t := &trustKeys{name: name}
+	t.material.Store(m)
+	return t
+}
+
+// loadCryptoPlans resolves each route's request and response verbs
+func (px *Proxy) loadCryptoPlans(diag *Diagnostics) {
+	px.defaultCrypto = &cryptoPlan{
+		request:  directionPlan{verify: verbClientTrust, signs: true, key: px.proxyKey},
+		response: directionPlan{verify: verbNone, signs: true, key: px.proxyKey},
+	}
+	for i, route := range px.cfg.Routes {
+		backendSigned := false
+		for _, v := range envelopeVariants(&route) {
+			backendSigned = backendSigned || v.Envelope.BackendSigField != ""
+		}
+		if route.Request == nil && route.Response == nil && !backendSigned {
+			continue
+		}
+		path := fmt.Sprintf("routes[%d]", i)
+		if route.Mode != "inspect-verify-sign" && route.Mode != "session-token" {
+			if route.Request != nil || route.Response != nil {
+				diag.Errorf("routes", "ROUTE_CRYPTO_VERBS", path, "request and response verbs only apply to inspect-verify-sign and session-token routes")
+			}
+			continue
+		}
+		if route.Mode == "session-token" && route.Response != nil {
+			diag.Errorf("routes", "ROUTE_CRYPTO_VERBS", path+".response", "session-token routes forward responses untouched")
+			continue
+		}
+		plan := *px.defaultCrypto
+		if backendSigned {
+			plan.response.verify, plan.response.trust = verbBackendTrust, px.backendTrust
+		}
+		ok := px.resolveDirection(&plan.request, route.Request, true, path+".request", diag)
+		ok = px.resolveDirection(&plan.response, route.Response, false, path+".response", diag) && ok
+		if !ok {
+			continue
+		}
+		for _, v := range envelopeVariants(&route) {
+			env := v.Envelope
+			if plan.request.verifies() && env.ClientSigField == "" && env.ItemsField == "" {
+				diag.Errorf("routes", "ROUTE_CRYPTO_VERBS", path+".request.verify", "verifying requests against %s needs envelope.client_sig_field", plan.request.verify)
+			}
+			if route.Response != nil && plan.response.verifies() && env.BackendSigField == "" {
+				diag.Errorf("routes", "ROUTE_CRYPTO_VERBS", path+".response.verify", "verifying responses against %s needs envelope.backend_sig_field", plan.response.verify)
+			}
+		}
+		if _, dup := px.routeCrypto[route.Name]; !dup {
+			px.routeCrypto[route.Name] = &plan
+		}
+	}
+	for i := range px.cfg.Routes {
+		route := &px.cfg.Routes[i]
+		plan := px.cryptoPlanFor(route)
+		dirs := []struct {
+			name string
+			plan *directionPlan
+		}{{"request", &plan.request}, {"response", &plan.response}}
+		switch route.Mode {
+		case "inspect-verify-sign":
+		case "session-token":
+			dirs = dirs[:1] // the token's key; responses pass untouched
+		default:
+			continue
+		}
+		for _, d := range dirs {
+			if d.plan.signs && d.plan.key == nil {
+				diag.Errorf("routes", "ROUTE_SIGNING_KEY", fmt.Sprintf("routes[%d].%s.sign", i, d.name), "%ss are signed with proxy_key but cms.proxy_private_key is not set; set sign: none to forward them unsigned", d.name)
+			}
+		}
+	}
+}
+
+// resolveDirection applies one direction's configured verbs to d, reporting
+// whether they resolved
+func (px *Proxy) resolveDirection(d *directionPlan, cfg *DirectionCryptoConfig, isReq bool, path string, diag *Diagnostics) bool {
+	if cfg == nil {
+		return true
+	}
+	ok := true
+	switch cfg.Verify {
+	case "":
+	case verbNone:
+		d.verify, d.trust = verbNone, nil
+	case verbClientTrust:
+		if !isReq {
+			diag.Errorf("routes", "ROUTE_CRYPTO_VERBS", path+".verify", "client_trust checks requests; use backend_trust or a cms.trust_stores name for responses")
+			ok = false
+			break
+		}
+		d.verify, d.trust = verbClientTrust, nil
+	case verbBackendTrust:
+		if px.backendTrust == nil {
+			diag.Errorf("routes", "ROUTE_CRYPTO_VERBS", path+".verify", "backend_trust needs cms.backend_trust_store")
+			ok = false
+			break
+		}
+		d.verify, d.trust = verbBackendTrust, px.backendTrust
+	default:
+		t, found := px.namedTrust[cfg.Verify]
+		if !found {
+			diag.Errorf("routes", "ROUTE_CRYPTO_VERBS", path+".verify", "no cms.trust_stores entry named %q", cfg.Verify)
+			ok = false
+			break
+		}
+		d.verify, d.trust = cfg.Verify, t
+	}
+	switch cfg.Sign {
+	case "":
+	case verbNone:
+		d.signs, d.key = false, nil
+	case verbProxyKey:
+		if px.proxyKey == nil {
+			diag.Errorf("routes", "ROUTE_CRYPTO_VERBS", path+".sign", "proxy_key needs cms.proxy_private_key")
+			ok = false
+			break
+		}
+		d.signs, d.key = true, px.proxyKey
+	default:
+		key, found := px.namedKeys[cfg.Sign]
+		if !found {
+			diag.Errorf("routes", "ROUTE_CRYPTO_VERBS", path+".sign", "no cms.keys entry named %q", cfg.Sign)
+			ok = false
+			break
+		}
+		d.signs, d.key = true, key
+	}
+	return ok
+}
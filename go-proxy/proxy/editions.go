@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// --- Protobuf Editions ---
+//
+// Descriptor sets load through protodesc, which resolves an editions file's
+// features (edition 2023 and the proto2 and proto3 syntaxes alike), and the
+// proxy decodes envelopes into dynamic messages, which read every encoding
+// those features allow. Encoding is where editions differ: dynamic.Message
+// writes by the proto2 and proto3 syntax rules and ignores features, so it
+// would write an editions file's repeated scalars unpacked, keep
+// implicit-presence fields that are set to zero, and write DELIMITED message
+// fields length-prefixed instead of as groups. An envelope whose type, or the
+// type of any field it holds, comes from an editions file is therefore
+// re-encoded with dynamicpb from google.golang.org/protobuf, which takes each
+// field's encoding and presence from the resolved features: the dynamic
+// message is copied into a dynamicpb message field by field, its unknown
+// fields carried over as they came, and marshalled from there. Types from
+// proto2 and proto3 files, proto2 groups included, keep the dynamic encoding,
+// which already writes them as protoc-generated code does.
+//
+// Presence follows the features too: an implicit-presence field that holds
+// its zero value reads as absent, as an unset proto3 field does.
+
+// editionsTypes caches usesEditions by message descriptor
+var editionsTypes sync.Map // *desc.MessageDescriptor -> bool
+
+// usesEditions reports whether md, or the type of any message field it holds
+// at any depth, is declared in an editions file
+func usesEditions(md *desc.MessageDescriptor) bool {
+	if v, ok := editionsTypes.Load(md); ok {
+		return v.(bool)
+	}
+	found := scanEditions(md, map[*desc.MessageDescriptor]bool{})
+	editionsTypes.Store(md, found)
+	return found
+}
+
+func scanEditions(md *desc.MessageDescriptor, seen map[*desc.MessageDescriptor]bool) bool {
+	if seen[md] {
+		return false
+	}
+	seen[md] = true
+	if md.GetFile().UnwrapFile().Syntax() == protoreflect.Editions {
+		return true
+	}
+	for _, fd := range md.GetFields() {
+		if sub := fd.GetMessageType(); sub != nil && scanEditions(sub, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// marshalDynamic encodes msg as its descriptor's features say; see above
+func marshalDynamic(msg *dynamic.Message) ([]byte, error) {
+	if !usesEditions(msg.GetMessageDescriptor()) {
+		return msg.Marshal()
+	}
+	out, err := toDynamicpb(msg)
+	if err != nil {
+		return nil, err
+	}
+	// Deterministic also means field number order, as dynamic writes them
+	return proto.MarshalOptions{Deterministic: true}.Marshal(out)
+}
+
+// toDynamicpb copies msg, unknown fields included, into a dynamicpb message
+// of the same type
+func toDynamicpb(msg *dynamic.Message) (*dynamicpb.Message, error) {
+	md := msg.GetMessageDescriptor()
+	out := dynamicpb.NewMessage(md.UnwrapMessage())
+	for _, fd := range msg.GetKnownFields() {
+		if !msg.HasField(fd) {
+			continue
+		}
+		f := fd.UnwrapField()
+		val, err := msg.TryGetField(fd)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case f.IsMap():
+			m := out.NewField(f).Map()
+			for k, v := range val.(map[interface{}]interface{}) {
+				pv, err := dynamicpbValue(f.MapValue(), v)
+				if err != nil {
+					return nil, err
+				}
+				m.Set(protoreflect.ValueOf(k).MapKey(), pv)
+			}
+			out.Set(f, protoreflect.ValueOfMap(m))
+		case f.IsList():
+			list := out.NewField(f).List()
+			for _, v := range val.([]interface{}) {
+				pv, err := dynamicpbValue(f, v)
+				if err != nil {
+					return nil, err
+				}
+				list.Append(pv)
+			}
+			out.Set(f, protoreflect.ValueOfList(list))
+		default:
+			pv, err := dynamicpbValue(f, val)
+			if err != nil {
+				return nil, err
+			}
+			// Setting an implicit-presence field to zero clears it
+			out.Set(f, pv)
+		}
+	}
+	out.SetUnknown(unknownFieldBytes(msg))
+	return out, nil
+}
+
+// dynamicpbValue converts one value of field f as dynamic.Message holds it
+func dynamicpbValue(f protoreflect.FieldDescriptor, v interface{}) (protoreflect.Value, error) {
+	switch f.Kind() {
+	case protoreflect.EnumKind:
+		n, ok := v.(int32)
+		if !ok {
+			return protoreflect.Value{}, fmt.Errorf("enum field %s holds %T", f.FullName(), v)
+		}
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(n)), nil
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		sub, ok := v.(*dynamic.Message)
+		if !ok {
+			return protoreflect.Value{}, fmt.Errorf("message field %s holds %T", f.FullName(), v)
+		}
+		m, err := toDynamicpb(sub)
+		if err != nil {
+			return protoreflect.Value{}, err
+		}
+		return protoreflect.ValueOfMessage(m), nil
+	}
+	return protoreflect.ValueOf(v), nil
+}
+
+// unknownFieldBytes encodes msg's unknown fields as dynamic.Message would
+func unknownFieldBytes(msg *dynamic.Message) []byte {
+	var b []byte
+	for _, num := range msg.GetUnknownFields() {
+		n := protowire.Number(num)
+		for _, u := range msg.GetUnknownField(num) {
+			typ := protowire.Type(u.Encoding)
+			b = protowire.AppendTag(b, n, typ)
+			switch typ {
+			case protowire.BytesType:
+				b = protowire.AppendBytes(b, u.Contents)
+			case protowire.StartGroupType:
+				b = append(b, u.Contents...)
+				b = protowire.AppendTag(b, n, protowire.EndGroupType)
+			case protowire.Fixed32Type:
+				b = protowire.AppendFixed32(b, uint32(u.Value))
+			case protowire.Fixed64Type:
+				b = protowire.AppendFixed64(b, u.Value)
+			default:
+				b = protowire.AppendVarint(b, u.Value)
+			}
+		}
+	}
+	return b
+}
+
+// implicitZero reports whether val is the zero value of a field without
+// presence, which then reads as absent
+func implicitZero(fd *desc.FieldDescriptor, val interface{}) bool {
+	if fd.HasPresence() {
+		return false
+	}
+	if b, ok := val.([]byte); ok {
+		return len(b) == 0
+	}
+	return val == nil || reflect.ValueOf(val).IsZero()
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc/codes"
+)
+
+// --- Empty Payloads ---
+//
+// A zero-length payload is a valid message, and both engines sign it like
+// any other: RSA-SHA256 over the hash of no bytes. Whether an inspect-verify-
+// sign route should is its empty_payload policy:
+//
+//	sign-empty  sign it (default)
+//	skip-sign   forward it with the proxy signature field cleared
+//	reject      fail the call: INVALID_ARGUMENT for a request, INTERNAL for a
+//	            response, reason EMPTY_PAYLOAD
+//
+// There is no placeholder signature: a route that signs needs a key at
+// startup, and a signature that cannot be made fails the call with
+// SIGNING_FAILED rather than forwarding the message. An envelope that leaves
+// a payload field with presence unset is treated as empty, and also counted
+// in proxy_envelope_payload_missing_total; a message type with no such field
+// cannot be decoded at all (see decodefailure.go).
+
+// Empty payload policies
+const (
+	emptyPayloadSign   = "sign-empty"
+	emptyPayloadSkip   = "skip-sign"
+	emptyPayloadReject = "reject"
+)
+
+// emptyPayload applies route's policy to a message whose payload is empty.
+// It reports whether the message is still to be signed; an error rejects it.
+func (px *Proxy) emptyPayload(route *RouteConfig, info MethodInfo, dir Direction, msg *dynamic.Message) (bool, error) {
+	policy := route.EmptyPayload
+	if policy == "" {
+		policy = emptyPayloadSign
+	}
+	metrics.Inc("proxy_empty_payloads_total", Labels{"route": route.Name, "direction": dir.String(), "policy": policy, "shadow": shadowLabel(route)})
+	label := dir.label()
+	switch policy {
+	case emptyPayloadReject:
+		log.Printf("[%s Rejected] %s: empty payload", label, info.Method)
+		code := codes.InvalidArgument
+		if dir == BackendToClient {
+			code = codes.Internal
+		}
+		return false, rejectf(code, reasonEmptyPayload, "proxy: %s payload is empty", strings.ToLower(label))
+	case emptyPayloadSkip:
+		log.Printf("[%s Security] %s: empty payload forwarded unsigned", label, info.Method)
+		if info.envelope.proxySig != nil {
+			msg.TryClearField(info.envelope.proxySig)
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// payloadMissing counts an envelope that does not carry its payload field
+func (px *Proxy) payloadMissing(route *RouteConfig, method string, isReq bool, env *resolvedEnvelope) {
+	if route.Envelope.PayloadField == "" || (env.payload != nil && !env.payload.HasPresence()) {
+		return // unset proto3 bytes are indistinguishable from empty ones
+	}
+	dir := directionOf(isReq)
+	metrics.Inc("proxy_envelope_payload_missing_total", Labels{"route": route.Name, "direction": dir.String()})
+	log.Printf("[%s Envelope Error] %s: no %s field in the envelope", dir.label(), method, route.Envelope.PayloadField)
+}
+
+// loadEmptyPayloads checks each route's empty_payload policy
+func (px *Proxy) loadEmptyPayloads(diag *Diagnostics) {
+	for i, route := range px.cfg.Routes {
+		if route.EmptyPayload == "" {
+			continue
+		}
+		path := fmt.Sprintf("routes[%d].empty_payload", i)
+		switch route.EmptyPayload {
+		case emptyPayloadSign, emptyPayloadSkip, emptyPayloadReject:
+		default:
+			diag.Errorf("routes", "ROUTE_EMPTY_PAYLOAD", path, "unknown policy %q (expected sign-empty, skip-sign or reject)", route.EmptyPayload)
+			continue
+		}
+		if route.Mode != "inspect-verify-sign" {
+			diag.Warnf("routes", "ROUTE_EMPTY_PAYLOAD", path, "%s routes do not sign payloads", route.Mode)
+		}
+	}
+}
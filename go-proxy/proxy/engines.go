@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// --- Crypto Engines ---
+//
+// The Go engine is always built in. The Rust engine links rust-crypto's
+// library through cgo (crypto.go) and is left out of builds without cgo or
+// with the norust tag (crypto_norust.go), so cross-compiling needs no C
+// toolchain:
+//
+//	CGO_ENABLED=0 GOOS=windows GOARCH=amd64 go build ./go-proxy/cmd/proxy
+//
+// The library is looked for in rust-crypto/target/release, then in any -L
+// directory in CGO_LDFLAGS at build time (make sets it from
+// RUST_CRYPTO_LIB_DIR). On Windows the import library of rustcrypto.dll is
+// preferred, and the DLL must then be on PATH or beside the binary.
+//
+// -crypto (WithCryptoEngine) picks the engine for every route; a route's
+// crypto_engine overrides it. Each engine in use is built once and the
+// routes selecting it share it; the keys it signs and verifies with come from
+// the route's verbs (directions.go).
+// A route that names an engine must find it compiled in and holding the keys
+// the route needs, or the proxy does not start.
+
+const (
+	engineGo   = "go"
+	engineRust = "rust"
+)
+
+// CryptoEngines lists the crypto engines this build can run
+func CryptoEngines() []string {
+	if rustEngineLinked {
+		return []string{engineGo, engineRust}
+	}
+	return []string{engineGo}
+}
+
+// payloadDigest is the SHA-256 of a payload, which is what the engines sign
+// and verify: the payload itself never reaches them
+type payloadDigest [sha256.Size]byte
+
+// payloadDigests remembers the last payload of one message it hashed, so
+// verifying that message and signing it again hash the payload once. A payload
+// is the same when it is the same slice: mutations that change one set a new
+// slice, and processEnvelope starts afresh before a route's own processors,
+// which might write into the old. A nil *payloadDigests hashes every time.
+type payloadDigests struct {
+	payload []byte
+	sum     payloadDigest
+}
+
+// of is payload's digest
+func (d *payloadDigests) of(payload []byte) payloadDigest {
+	if d == nil {
+		return sha256.Sum256(payload)
+	}
+	if len(payload) == 0 || len(d.payload) != len(payload) || &d.payload[0] != &payload[0] {
+		d.payload, d.sum = payload, sha256.Sum256(payload)
+	}
+	return d.sum
+}
+
+// cryptoEngine makes and checks RSA-SHA256 signatures with the keys it is
+// handed, over a digest the caller has computed. Each operation first checks
+// ctx, the call's context, and returns its error without starting when the
+// call has already ended.
+type cryptoEngine interface {
+	name() string
+	sign(ctx context.Context, key *signingKey, digest payloadDigest) ([]byte, error)
+	// verifyClient checks sig against anchor's keys, returning the id of the
+	// key that verifies it and the decision: ok, failed, unverified (the
+	// engine does not check client signatures) or unconfigured
+	verifyClient(ctx context.Context, anchor *trustAnchor, digest payloadDigest, sig []byte) (string, string, error)
+	// verifyKeys returns the id of the key in t that verifies sig, or "" if
+	// none does
+	verifyKeys(ctx context.Context, t *trustKeys, digest payloadDigest, sig []byte) (string, error)
+}
+
+// goEngine is crypto/rsa
+type goEngine struct{}
+
+func (goEngine) name() string { return engineGo }
+
+func (goEngine) sign(ctx context.Context, key *signingKey, digest payloadDigest) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return rsa.SignPKCS1v15(nil, key.load().priv, crypto.SHA256, digest[:])
+}
+
+func (goEngine) verifyClient(ctx context.Context, anchor *trustAnchor, digest payloadDigest, sig []byte) (string, string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", "", err
+	}
+	return "", "unverified", nil // the Go engine does not check client signatures yet
+}
+
+func (goEngine) verifyKeys(ctx context.Context, t *trustKeys, digest payloadDigest, sig []byte) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	for _, key := range t.load().keys {
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil {
+			return keyID(key), nil
+		}
+	}
+	return "", nil
+}
+
+// rustEngine is rust-crypto over cgo, which takes its keys as PEM. Only the
+// digest crosses into the library (sign_digest, verify_digest), however
+// large the payload.
+type rustEngine struct{}
+
+func (rustEngine) name() string { return engineRust }
+
+func (rustEngine) sign(ctx context.Context, key *signingKey, digest payloadDigest) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sig, err := RustSignDigest(digest[:], key.load().pem)
+	if err != nil {
+		reportRustError(err)
+		return nil, err
+	}
+	return sig, nil
+}
+
+func (rustEngine) verifyClient(ctx context.Context, anchor *trustAnchor, digest payloadDigest, sig []byte) (string, string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", "", err
+	}
+	if len(anchor.load().keyPEMs) == 0 {
+		return "", "unconfigured", nil
+	}
+	if key := anchor.rustVerify(digest, sig); key != "" {
+		return key, "ok", nil
+	}
+	return "", "failed", nil
+}
+
+func (rustEngine) verifyKeys(ctx context.Context, t *trustKeys, digest payloadDigest, sig []byte) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	for _, pemKey := range t.load().pems {
+		ok, err := RustVerifyDigest(digest[:], sig, pemKey)
+		if err != nil {
+			reportRustError(err) // a key that cannot check sig does not verify it
+			continue
+		}
+		if ok {
+			return pemKeyID(pemKey), nil
+		}
+	}
+	return "", nil
+}
+
+// engineFor is the engine route signs and verifies with
+func (px *Proxy) engineFor(route *RouteConfig) cryptoEngine {
+	if e, ok := px.routeEngines[route.Name]; ok {
+		return e
+	}
+	return px.engines[px.cryptoEngine]
+}
+
+// newEngine builds the named engine
+func newEngine(name string) cryptoEngine {
+	if name == engineRust {
+		return rustEngine{}
+	}
+	return goEngine{}
+}
+
+// checkCryptoEngine fails startup for an engine this build does not have
+func (px *Proxy) checkCryptoEngine(diag *Diagnostics) {
+	if err := engineAvailable(px.cryptoEngine); err != nil {
+		diag.Errorf("crypto", "CRYPTO_ENGINE", "-crypto", "%v", err)
+	}
+}
+
+func engineAvailable(name string) error {
+	for _, e := range CryptoEngines() {
+		if name == e {
+			return nil
+		}
+	}
+	available := strings.Join(CryptoEngines(), ", ")
+	if name == engineRust {
+		return fmt.Errorf("the rust engine is not compiled into this build (built without cgo or with -tags norust); available engines: %s", available)
+	}
+	return fmt.Errorf("unknown crypto engine %q; available engines: %s", name, available)
+}
+
+// loadCryptoEngines builds the default engine and those routes name, and
+// checks each such route has the keys its engine needs
+func (px *Proxy) loadCryptoEngines(diag *Diagnostics) {
+	px.engines[px.cryptoEngine] = newEngine(px.cryptoEngine)
+	for i, route := range px.cfg.Routes {
+		if route.CryptoEngine == "" {
+			continue
+		}
+		path := fmt.Sprintf("routes[%d].crypto_engine", i)
+		if err := engineAvailable(route.CryptoEngine); err != nil {
+			diag.Errorf("routes", "ROUTE_CRYPTO_ENGINE", path, "%v", err)
+			continue
+		}
+		if route.Mode != "inspect-verify-sign" && route.Mode != "session-token" && route.Mode != "wrap-envelope" {
+			diag.Warnf("routes", "ROUTE_CRYPTO_ENGINE", path, "%s routes do not sign or verify", route.Mode)
+			continue
+		}
+		e, ok := px.engines[route.CryptoEngine]
+		if !ok {
+			e = newEngine(route.CryptoEngine)
+			px.engines[route.CryptoEngine] = e
+		}
+		if err := px.engineKeysFor(&px.cfg.Routes[i], e); err != nil {
+			diag.Errorf("routes", "ROUTE_CRYPTO_ENGINE", path, "the %s engine %v", e.name(), err)
+			continue
+		}
+		if _, dup := px.routeEngines[route.Name]; !dup {
+			px.routeEngines[route.Name] = e
+		}
+	}
+}
+
+// engineKeysFor reports key material e lacks for route
+func (px *Proxy) engineKeysFor(route *RouteConfig, e cryptoEngine) error {
+	if route.Mode == "wrap-envelope" {
+		return nil // it signs with wrap.sign's key, which loadWrapEnvelopes checks
+	}
+	plan := px.cryptoPlanFor(route)
+	for _, d := range []*directionPlan{&plan.request, &plan.response} {
+		if d.signs && d.key == nil {
+			return errors.New("needs cms.proxy_private_key to sign")
+		}
+	}
+	if _, ok := e.(rustEngine); !ok {
+		return nil
+	}
+	for _, d := range []*directionPlan{&plan.request, &plan.response} {
+		if d.verifies() && len(d.trust.load().pems) == 0 {
+			return fmt.Errorf("has no public key from the %s trust store", d.trust.name)
+		}
+	}
+	if plan.request.verify != verbClientTrust {
+		return nil
+	}
+	anchors := []*trustAnchor{px.clientTrust}
+	if _, ok := px.routeTenantSources[route.Name]; ok {
+		anchors = anchors[:0]
+		for _, a := range px.trustDomains {
+			anchors = append(anchors, a)
+		}
+	}
+	for _, a := range anchors {
+		if a != nil && len(a.load().keyPEMs) == 0 {
+			return fmt.Errorf("has no public key from the client trust store %s", a.label())
+		}
+	}
+	return nil
+}
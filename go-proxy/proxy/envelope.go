@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"github.com/jhump/protoreflect/desc"
+)
+
+// --- Resolved Envelopes ---
+//
+// A route's envelope names its fields; processMsg reads them by descriptor.
+// checkEnvelopes resolves the names against the input and output types of
+// every loaded method the route matches, once at startup, and processMsg looks
+// the result up by route, method and direction. Methods the schema did not
+// list at startup (a lazy schema, a route from the MatchRoute hook) are
+// resolved per message instead.
+
+// resolvedEnvelope is an envelope's fields on one message type. A field is
+// nil when it is not configured, or when the type has no field of that name
+// and kind; it reads as unset and cannot be written.
+type resolvedEnvelope struct {
+	msg *desc.MessageDescriptor
+	cfg EnvelopeConfig
+
+	payload, typeURL, clientSig, proxySig, metadata, backendSig *desc.FieldDescriptor
+	typeURLHeader, clientSigHeader                              string // from_metadata sources; see envelopeheaders.go
+	proxySigList                                                *desc.FieldDescriptor
+	items                                                       *desc.FieldDescriptor
+	item                                                        batchItemFields // on items' message type
+
+	mistyped []mistypedField // configured fields of md that cannot be read as their kind
+}
+
+// resolveEnvelope resolves e's field names against md
+func resolveEnvelope(e EnvelopeConfig, md *desc.MessageDescriptor) *resolvedEnvelope {
+	find := func(name, kind string) *desc.FieldDescriptor {
+		if name == "" {
+			return nil
+		}
+		if fd := md.FindFieldByName(name); fd != nil && fieldTypeError(fd, kind, e.AllowTypeCoercion) == nil {
+			return fd
+		}
+		return nil
+	}
+	var mistyped []mistypedField
+	for _, f := range envelopeFields(e) {
+		if fd := md.FindFieldByName(f.name); f.name != "" && fd != nil {
+			if err := fieldTypeError(fd, f.kind, e.AllowTypeCoercion); err != nil {
+				mistyped = append(mistyped, mistypedField{key: f.key, responseOnly: f.responseOnly, err: err})
+			}
+		}
+	}
+	env := &resolvedEnvelope{
+		msg:          md,
+		cfg:          e,
+		payload:      find(e.PayloadField, "bytes"),
+		typeURL:      find(e.TypeURLField, "string"),
+		clientSig:    find(e.ClientSigField, "bytes"),
+		proxySig:     find(e.ProxySigField, "bytes"),
+		metadata:     find(e.MetadataField, kindStringMap),
+		backendSig:   find(e.BackendSigField, "bytes"),
+		proxySigList: find(e.ProxySigListField, kindSigList),
+		items:        find(e.ItemsField, kindItems),
+	}
+	if env.items != nil {
+		item := env.items.GetMessageType()
+		resolved := make([]*desc.FieldDescriptor, 3)
+		for i, f := range itemFields(e) {
+			fd := item.FindFieldByName(f.name)
+			if f.name == "" || fd == nil {
+				continue
+			}
+			if err := fieldTypeError(fd, f.kind, e.AllowTypeCoercion); err != nil {
+				mistyped = append(mistyped, mistypedField{key: f.key, err: err})
+				continue
+			}
+			resolved[i] = fd
+		}
+		env.item = batchItemFields{payload: resolved[0], clientSig: resolved[1], proxySig: resolved[2]}
+	}
+	env.mistyped = mistyped
+	env.typeURLHeader, _ = metadataSource(e.TypeURLField)
+	env.clientSigHeader, _ = metadataSource(e.ClientSigField)
+	return env
+}
+
+func envelopeKey(route *RouteConfig, method string, isReq bool) string {
+	return route.Name + " " + route.envelopeVersion + " " + method + " " + directionOf(isReq).label()
+}
+
+// envelopeFor returns route's envelope on md, the request or response type of
+// method. A startup resolution is used when it was made for the same envelope
+// and type; a hook route sharing a configured route's match may differ.
+func (px *Proxy) envelopeFor(route *RouteConfig, method string, isReq bool, md *desc.MessageDescriptor) *resolvedEnvelope {
+	if env := px.routeEnvelopes[envelopeKey(route, method, isReq)]; env != nil && env.msg == md && env.cfg == route.Envelope {
+		return env
+	}
+	return resolveEnvelope(route.Envelope, md)
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+// --- Envelope Fields From Metadata ---
+//
+// Some clients send what the proxy needs to check their messages once, as
+// headers on the stream, instead of in every envelope. An envelope's
+// type_url_field and client_sig_field may name a request header rather than
+// a field:
+//
+//	type_url_field: "from_metadata:x-payload-type"
+//	client_sig_field: "from_metadata:x-client-signature"
+//
+// The headers are read once, as the call arrives, and stand in for those
+// fields of every request message on the stream; the other fields are still
+// read from the messages. A signature header is base64 unless its name ends
+// in -bin, which gRPC has already decoded. A stream missing one of its
+// route's headers, or with a signature that is not base64, fails with
+// INVALID_ARGUMENT (ENVELOPE_HEADER_INVALID) before the backend is dialled;
+// a shadow route only logs it. Responses read those fields as unset. Every
+// header any of a route's envelopes names is required.
+
+const fromMetadataPrefix = "from_metadata:"
+
+// metadataSource is the header an envelope field value names, if it names one
+func metadataSource(name string) (string, bool) {
+	key, ok := strings.CutPrefix(name, fromMetadataPrefix)
+	if !ok {
+		return "", false
+	}
+	return strings.ToLower(key), true
+}
+
+// envelopeHeaderSources are the headers a route's envelopes read
+type envelopeHeaderSources struct {
+	typeURLs, clientSigs []string
+}
+
+// envelopeHeaders are a stream's values of its route's envelope headers
+type envelopeHeaders struct {
+	typeURLs   map[string]string
+	clientSigs map[string][]byte
+}
+
+type envelopeHeadersKey struct{}
+
+func envelopeHeadersFrom(ctx context.Context) *envelopeHeaders {
+	h, _ := ctx.Value(envelopeHeadersKey{}).(*envelopeHeaders)
+	return h
+}
+
+// typeURLOf is msg's type URL, from its field or the stream's header
+func (env *resolvedEnvelope) typeURLOf(ctx context.Context, msg *dynamic.Message, isReq bool) string {
+	if env.typeURLHeader == "" {
+		return getStringField(msg, env.typeURL)
+	}
+	if h := envelopeHeadersFrom(ctx); h != nil && isReq {
+		return h.typeURLs[env.typeURLHeader]
+	}
+	return ""
+}
+
+// clientSigOf is msg's client signature, from its field or the stream's header
+func (env *resolvedEnvelope) clientSigOf(ctx context.Context, msg *dynamic.Message, isReq bool) []byte {
+	if env.clientSigHeader == "" {
+		return getBytesField(msg, env.clientSig)
+	}
+	if h := envelopeHeadersFrom(ctx); h != nil && isReq {
+		return h.clientSigs[env.clientSigHeader]
+	}
+	return nil
+}
+
+// captureEnvelopeHeaders reads the stream's envelope headers, failing the
+// call when one is missing or malformed
+func (px *Proxy) captureEnvelopeHeaders(route *RouteConfig, md metadata.MD) (*envelopeHeaders, error) {
+	src := px.routeEnvelopeHeaders[route.Name]
+	if src == nil {
+		return nil, nil
+	}
+	h := &envelopeHeaders{typeURLs: map[string]string{}, clientSigs: map[string][]byte{}}
+	var problems []error
+	for _, key := range src.typeURLs {
+		if v := first(md, key); v != "" {
+			h.typeURLs[key] = v
+		} else {
+			problems = append(problems, rejectf(codes.InvalidArgument, reasonEnvelopeHeader, "proxy: the stream has no %s header", key).with("header", key))
+		}
+	}
+	for _, key := range src.clientSigs {
+		v := md.Get(key)
+		switch {
+		case len(v) == 0:
+			problems = append(problems, rejectf(codes.InvalidArgument, reasonEnvelopeHeader, "proxy: the stream has no %s header", key).with("header", key))
+		case strings.HasSuffix(key, "-bin"):
+			h.clientSigs[key] = []byte(v[0])
+		default:
+			sig, err := base64.StdEncoding.DecodeString(v[0])
+			if err != nil {
+				problems = append(problems, rejectf(codes.InvalidArgument, reasonEnvelopeHeader, "proxy: the %s header is not base64", key).with("header", key))
+				continue
+			}
+			h.clientSigs[key] = sig
+		}
+	}
+	if len(problems) == 0 {
+		return h, nil
+	}
+	if !route.Shadow {
+		return nil, problems[0]
+	}
+	for _, err := range problems {
+		log.Printf("[Shadow] Route %s would reject the stream: %v", route.Name, err)
+	}
+	return h, nil
+}
+
+// loadEnvelopeHeaders collects the headers each route's envelopes read
+func (px *Proxy) loadEnvelopeHeaders(diag *Diagnostics) {
+	for i := range px.cfg.Routes {
+		route := &px.cfg.Routes[i]
+		if route.Mode == "pass-thru" || route.Mode == "local-reply" {
+			continue
+		}
+		src := &envelopeHeaderSources{}
+		ok := true
+		for j, v := range envelopeVariants(route) {
+			path := fmt.Sprintf("routes[%d].envelope", i)
+			if len(route.Envelopes) > 0 {
+				path = fmt.Sprintf("routes[%d].envelopes[%d]", i, j)
+			}
+			e := v.Envelope
+			for _, f := range []struct {
+				key, name string
+				into      *[]string
+			}{
+				{"type_url_field", e.TypeURLField, &src.typeURLs},
+				{"client_sig_field", e.ClientSigField, &src.clientSigs},
+				{"payload_field", e.PayloadField, nil},
+				{"proxy_sig_field", e.ProxySigField, nil},
+				{"proxy_sig_list_field", e.ProxySigListField, nil},
+				{"metadata_field", e.MetadataField, nil},
+				{"items_field", e.ItemsField, nil},
+				{"item_payload_field", e.ItemPayloadField, nil},
+				{"item_client_sig_field", e.ItemClientSigField, nil},
+				{"item_proxy_sig_field", e.ItemProxySigField, nil},
+				{"backend_sig_field", e.BackendSigField, nil},
+				{"nonce_field", e.NonceField, nil},
+				{"wrapped_key_field", e.WrappedKeyField, nil},
+				{"identity_field", e.IdentityField, nil},
+			} {
+				key, named := metadataSource(f.name)
+				switch {
+				case !named:
+				case f.into == nil:
+					diag.Errorf("routes", "ENVELOPE_FROM_METADATA", path+"."+f.key, "only type_url_field and client_sig_field can come from metadata")
+					ok = false
+				case route.Mode == "wrap-envelope":
+					diag.Errorf("routes", "ENVELOPE_FROM_METADATA", path+"."+f.key, "wrap-envelope routes build their envelopes; %s cannot come from metadata", f.key)
+					ok = false
+				case key == "" || strings.ContainsAny(key, " :"):
+					diag.Errorf("routes", "ENVELOPE_FROM_METADATA", path+"."+f.key, "%q names no header", f.name)
+					ok = false
+				case !slices.Contains(*f.into, key):
+					*f.into = append(*f.into, key)
+				}
+			}
+		}
+		if !ok || len(src.typeURLs)+len(src.clientSigs) == 0 {
+			continue
+		}
+		if _, dup := px.routeEnvelopeHeaders[route.Name]; !dup {
+			px.routeEnvelopeHeaders[route.Name] = src
+			log.Printf("[Envelope] Route %s reads %s from stream metadata", route.Name, strings.Join(append(slices.Clone(src.typeURLs), src.clientSigs...), ", "))
+		}
+	}
+}
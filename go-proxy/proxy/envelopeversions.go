@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// --- Envelope Versions ---
+//
+// A route migrating between envelope shapes lists each one under envelopes,
+// tagged with a version, instead of a single envelope. Each message is matched
+// to a version by version_field, a field of the envelope itself (a path as in
+// mutations, so "metadata[schema_version]" works too), or by version_header,
+// a request header that decides for both directions of the call. processMsg
+// then handles the message exactly as on a route with that envelope. A
+// message whose version is missing or not listed is rejected, or forwarded
+// untouched with unknown_version: pass-thru. Every envelope is checked
+// against the loaded descriptors at startup like a single one.
+
+// VersionedEnvelope is one envelope shape a route accepts
+type VersionedEnvelope struct {
+	Version        string `yaml:"version"`
+	EnvelopeConfig `yaml:",inline"`
+}
+
+// Policies for messages with an unlisted envelope version
+const (
+	unknownVersionReject   = "reject"
+	unknownVersionPassThru = "pass-thru"
+)
+
+// envelopeVersions is a route's envelopes block, parsed
+type envelopeVersions struct {
+	field    *mutation // nil when the header decides
+	header   string
+	variants map[string]*RouteConfig // by version
+	passThru bool
+}
+
+// envelopeVariants is route itself, or a copy of it per entry of its
+// envelopes with Envelope set to that entry's
+func envelopeVariants(route *RouteConfig) []*RouteConfig {
+	if len(route.Envelopes) == 0 {
+		return []*RouteConfig{route}
+	}
+	variants := make([]*RouteConfig, 0, len(route.Envelopes))
+	for _, e := range route.Envelopes {
+		v := *route
+		v.Envelope, v.envelopeVersion = e.EnvelopeConfig, e.Version
+		variants = append(variants, &v)
+	}
+	return variants
+}
+
+// envelopeVariant picks the route variant whose envelope msg carries. It
+// returns route itself when the route has a single envelope, and nil when the
+// version is unknown and the route forwards such messages untouched.
+func (px *Proxy) envelopeVariant(ctx context.Context, route *RouteConfig, msg *dynamic.Message, isReq bool) (*RouteConfig, error) {
+	ev := px.routeEnvelopeVersions[route.Name]
+	if ev == nil {
+		return route, nil
+	}
+	variant, version := ev.variant(ctx, msg)
+	label := version
+	if variant == nil {
+		label = "unknown"
+	}
+	metrics.Inc("proxy_envelope_versions_total", Labels{"route": route.Name, "version": label, "shadow": shadowLabel(route)})
+	if variant != nil {
+		return variant, nil
+	}
+	log.Printf("[%s] Unknown envelope version %q on route %s", directionOf(isReq).label(), version, route.Name)
+	if ev.passThru {
+		return nil, nil
+	}
+	code := codes.InvalidArgument
+	if !isReq {
+		code = codes.Internal // the backend answered in a shape the route does not list
+	}
+	return nil, rejectf(code, reasonEnvelopeVersion, "proxy: unknown envelope version %q", version).with("version", version)
+}
+
+// variant reads the message's envelope version and returns the route variant
+// for it, nil when the version is missing or not listed
+func (ev *envelopeVersions) variant(ctx context.Context, msg *dynamic.Message) (*RouteConfig, string) {
+	var version string
+	ok := false
+	if ev.field == nil {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if v := md.Get(ev.header); len(v) > 0 {
+			version, ok = v[0], true
+		}
+	} else {
+		version, ok = readVersionField(ev.field, msg)
+	}
+	if !ok {
+		return nil, version
+	}
+	return ev.variants[version], version
+}
+
+// readVersionField renders the scalar or map entry at m's path
+func readVersionField(m *mutation, msg *dynamic.Message) (string, bool) {
+	fd, err := m.resolve(msg.GetMessageDescriptor())
+	if err != nil {
+		return "", false
+	}
+	for _, name := range m.path[:len(m.path)-1] {
+		v, err := msg.TryGetFieldByName(name)
+		sub, ok := v.(*dynamic.Message)
+		if err != nil || !ok || sub == nil {
+			return "", false
+		}
+		msg = sub
+	}
+	if m.hasKey {
+		v, err := msg.TryGetMapField(fd, m.key)
+		s, ok := v.(string)
+		return s, err == nil && ok
+	}
+	v, err := msg.TryGetField(fd)
+	if err != nil {
+		return "", false
+	}
+	return fmt.Sprint(v), true
+}
+
+// checkVersionField checks that m names a string, integer or enum field, or
+// a map<string,string> entry, on md
+func checkVersionField(m *mutation, md *desc.MessageDescriptor) error {
+	fd, err := m.resolve(md)
+	if err != nil || m.hasKey {
+		return err
+	}
+	if fd.IsRepeated() {
+		return fmt.Errorf("%s is repeated", fd.GetFullyQualifiedName())
+	}
+	switch fd.GetType() {
+	case descriptorpb.FieldDescriptorProto_TYPE_STRING, descriptorpb.FieldDescriptorProto_TYPE_ENUM,
+		descriptorpb.FieldDescriptorProto_TYPE_INT32, descriptorpb.FieldDescriptorProto_TYPE_INT64,
+		descriptorpb.FieldDescriptorProto_TYPE_UINT32, descriptorpb.FieldDescriptorProto_TYPE_UINT64,
+		descriptorpb.FieldDescriptorProto_TYPE_SINT32, descriptorpb.FieldDescriptorProto_TYPE_SINT64,
+		descriptorpb.FieldDescriptorProto_TYPE_FIXED32, descriptorpb.FieldDescriptorProto_TYPE_FIXED64,
+		descriptorpb.FieldDescriptorProto_TYPE_SFIXED32, descriptorpb.FieldDescriptorProto_TYPE_SFIXED64:
+		return nil
+	}
+	return fmt.Errorf("%s is not a string, integer or enum field", fd.GetFullyQualifiedName())
+}
+
+// loadEnvelopeVersions parses each route's envelopes and its version source.
+// The envelopes themselves are checked by checkEnvelopes.
+func (px *Proxy) loadEnvelopeVersions(diag *Diagnostics) {
+	methods := px.knownMethods()
+	for i, route := range px.cfg.Routes {
+		path := fmt.Sprintf("routes[%d]", i)
+		if len(route.Envelopes) == 0 {
+			if route.VersionField != "" || route.VersionHeader != "" || route.UnknownVersion != "" {
+				diag.Warnf("routes", "ROUTE_ENVELOPE_VERSION", path, "version_field, version_header and unknown_version have no effect without envelopes")
+			}
+			continue
+		}
+		switch {
+		case route.Mode == "pass-thru" || route.Mode == "local-reply":
+			diag.Warnf("routes", "ROUTE_ENVELOPE_VERSION", path+".envelopes", "%s routes do not decode envelopes", route.Mode)
+			continue
+		case route.Mode == "encrypt-payload" || route.BindTransportIdentity:
+			diag.Errorf("routes", "ROUTE_ENVELOPE_VERSION", path+".envelopes", "envelopes are not supported with encrypt-payload or bind_transport_identity; use a single envelope")
+			continue
+		case route.Envelope != (EnvelopeConfig{}):
+			diag.Errorf("routes", "ROUTE_ENVELOPE_VERSION", path+".envelopes", "set either envelope or envelopes, not both")
+			continue
+		}
+
+		ev := &envelopeVersions{variants: map[string]*RouteConfig{}}
+		valid := true
+		switch route.UnknownVersion {
+		case "", unknownVersionReject:
+		case unknownVersionPassThru:
+			ev.passThru = true
+		default:
+			diag.Errorf("routes", "ROUTE_ENVELOPE_VERSION", path+".unknown_version", "unknown policy %q (expected reject or pass-thru)", route.UnknownVersion)
+			valid = false
+		}
+		for j, v := range envelopeVariants(&px.cfg.Routes[i]) {
+			p := fmt.Sprintf("%s.envelopes[%d].version", path, j)
+			if v.envelopeVersion == "" {
+				diag.Errorf("routes", "ROUTE_ENVELOPE_VERSION", p, "every envelope needs a version")
+				valid = false
+			} else if ev.variants[v.envelopeVersion] != nil {
+				diag.Errorf("routes", "ROUTE_ENVELOPE_VERSION", p, "version %q is listed twice", v.envelopeVersion)
+				valid = false
+			}
+			ev.variants[v.envelopeVersion] = v
+		}
+
+		switch {
+		case (route.VersionField == "") == (route.VersionHeader == ""):
+			diag.Errorf("routes", "ROUTE_ENVELOPE_VERSION", path, "envelopes need exactly one of version_field and version_header")
+			valid = false
+		case route.VersionHeader != "":
+			ev.header = strings.ToLower(route.VersionHeader)
+		default:
+			m, err := parseMutation(MutationConfig{Op: "clear", Field: route.VersionField, Direction: "both"})
+			if err != nil {
+				diag.Errorf("routes", "ROUTE_ENVELOPE_VERSION", path+".version_field", "%v", err)
+				valid = false
+				break
+			}
+			ev.field = &m
+		check:
+			for _, name := range methods {
+				if !route.matches(name) || px.shadowedByBuiltin(route, name) {
+					continue
+				}
+				md, ok := px.lookupMethod(name)
+				if !ok {
+					continue
+				}
+				for _, t := range []*desc.MessageDescriptor{md.GetInputType(), md.GetOutputType()} {
+					if err := checkVersionField(ev.field, t); err != nil {
+						diag.Errorf("routes", "ROUTE_ENVELOPE_VERSION", path+".version_field", "%q on %s: %v", route.VersionField, name, err)
+						valid = false
+						break check
+					}
+				}
+			}
+		}
+		if _, dup := px.routeEnvelopeVersions[route.Name]; valid && !dup {
+			px.routeEnvelopeVersions[route.Name] = ev
+		}
+	}
+}
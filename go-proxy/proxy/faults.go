@@ -0,0 +1,376 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// --- Fault Injection ---
+//
+// To see how clients and backends cope with a proxy that misbehaves, a
+// route's fault_injection block makes it misbehave on purpose:
+//
+//	delay           hold a message this long before forwarding it
+//	abort           end the call with a status before the backend is dialled
+//	truncate        cut bytes off the end of a message
+//	corrupt         overwrite bytes at random offsets of a message
+//	drop_responses  leave a streaming call's response unsent
+//
+// each with its own probability, per call for abort and per message for the
+// rest; delay, truncate and corrupt take direction requests, responses or
+// both (default). The block is only honoured when the proxy runs with
+// -enable-faults (WithFaultInjection); without it a route that has one is a
+// startup warning and behaves normally. Truncating and corrupting happen
+// after the route's processing, so the far side gets the damaged bytes as
+// the proxy would have sent them. Pass-thru routes with faults lose their
+// zero-copy forwarding.
+//
+// Draws come from PCG generators seeded with the route's seed and the
+// call's number on the route, one per direction, so the nth call on a route
+// draws the same faults on every run with the same seed, whatever the calls
+// around it did. Unordered routes draw in the order their workers finish.
+// Without a seed one is picked at startup and logged. Each fault is logged
+// with the call's number and counted in proxy_faults_injected_total by route
+// and fault.
+
+// FaultInjectionConfig is the faults a route injects with -enable-faults
+type FaultInjectionConfig struct {
+	Seed          uint64             `yaml:"seed"` // 0 picks one at startup
+	Delay         *FaultDelayConfig  `yaml:"delay"`
+	Abort         *FaultAbortConfig  `yaml:"abort"`
+	Truncate      *FaultBytesConfig  `yaml:"truncate"`
+	Corrupt       *FaultBytesConfig  `yaml:"corrupt"`
+	DropResponses *FaultChanceConfig `yaml:"drop_responses"`
+}
+
+// FaultChanceConfig is a fault with nothing to it but how often
+type FaultChanceConfig struct {
+	Probability float64 `yaml:"probability"` // 0 to 1
+}
+
+// FaultDelayConfig holds messages before forwarding them
+type FaultDelayConfig struct {
+	Probability float64 `yaml:"probability"`
+	Duration    string  `yaml:"duration"`  // e.g. "200ms"; required
+	Direction   string  `yaml:"direction"` // requests, responses or both (default)
+}
+
+// FaultAbortConfig ends calls as they arrive
+type FaultAbortConfig struct {
+	Probability float64 `yaml:"probability"`
+	Code        string  `yaml:"code"`    // default UNAVAILABLE; OK is not allowed
+	Message     string  `yaml:"message"` // default "injected fault"
+}
+
+// FaultBytesConfig damages bytes of messages
+type FaultBytesConfig struct {
+	Probability float64 `yaml:"probability"`
+	Bytes       int     `yaml:"bytes"`     // how many; default 1
+	Direction   string  `yaml:"direction"` // requests, responses or both (default)
+}
+
+// Draws on a call come from one generator per source, so one direction's
+// traffic does not shift the other's
+const (
+	faultSourceCall = iota
+	faultSourceRequests
+	faultSourceResponses
+	faultSourceDrops
+	faultSources
+)
+
+// faultDirections says which messages a per-message fault applies to
+type faultDirections struct{ requests, responses bool }
+
+func (d faultDirections) has(isReq bool) bool {
+	if isReq {
+		return d.requests
+	}
+	return d.responses
+}
+
+// faultInjector is a route's fault_injection block, parsed at startup
+type faultInjector struct {
+	route string
+	seed  uint64
+	calls atomic.Uint64
+
+	delayChance    float64
+	delay          time.Duration
+	delayDirs      faultDirections
+	abortChance    float64
+	abortCode      codes.Code
+	abortMessage   string
+	truncateChance float64
+	truncateBytes  int
+	truncateDirs   faultDirections
+	corruptChance  float64
+	corruptBytes   int
+	corruptDirs    faultDirections
+	dropChance     float64
+}
+
+// callFaults are the draws of one call
+type callFaults struct {
+	inj    *faultInjector
+	method string
+	call   uint64
+	mu     [faultSources]sync.Mutex
+	rng    [faultSources]*rand.Rand
+}
+
+type callFaultsKey struct{}
+
+func callFaultsFrom(ctx context.Context) *callFaults {
+	f, _ := ctx.Value(callFaultsKey{}).(*callFaults)
+	return f
+}
+
+// newCall numbers a call on the route and seeds its generators; nil when
+// the route injects nothing
+func (inj *faultInjector) newCall(method string) *callFaults {
+	if inj == nil {
+		return nil
+	}
+	f := &callFaults{inj: inj, method: method, call: inj.calls.Add(1)}
+	for i := range f.rng {
+		f.rng[i] = rand.New(rand.NewPCG(inj.seed, f.call*faultSources+uint64(i)))
+	}
+	return f
+}
+
+// roll reports whether a fault of probability p happens, drawing from source
+func (f *callFaults) roll(source int, p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	f.mu[source].Lock()
+	defer f.mu[source].Unlock()
+	return f.rng[source].Float64() < p
+}
+
+// intN draws an int in [0, n) from source
+func (f *callFaults) intN(source, n int) int {
+	f.mu[source].Lock()
+	defer f.mu[source].Unlock()
+	return f.rng[source].IntN(n)
+}
+
+func (f *callFaults) injected(fault, format string, args ...any) {
+	log.Printf("[Fault] Route %s, %s call %d: %s", f.inj.route, f.method, f.call, fmt.Sprintf(format, args...))
+	metrics.Inc("proxy_faults_injected_total", Labels{"route": f.inj.route, "fault": fault})
+}
+
+// abort is the status the call ends with before it is proxied, or nil
+func (f *callFaults) abort() error {
+	if f == nil || !f.roll(faultSourceCall, f.inj.abortChance) {
+		return nil
+	}
+	f.injected("abort", "aborting with %s", f.inj.abortCode)
+	return rejectf(f.inj.abortCode, reasonFaultInjected, "proxy: %s", f.inj.abortMessage).with("fault", "abort")
+}
+
+// message delays and damages one processed message, returning what to
+// forward in its place
+func (f *callFaults) message(ctx context.Context, isReq bool, payload []byte) ([]byte, error) {
+	if f == nil {
+		return payload, nil
+	}
+	source, kind := faultSourceResponses, "response"
+	if isReq {
+		source, kind = faultSourceRequests, "request"
+	}
+	inj := f.inj
+	if inj.delayDirs.has(isReq) && f.roll(source, inj.delayChance) {
+		f.injected("delay", "delaying a %s by %s", kind, inj.delay)
+		t := time.NewTimer(inj.delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		}
+	}
+	if inj.truncateDirs.has(isReq) && f.roll(source, inj.truncateChance) {
+		n := min(inj.truncateBytes, len(payload))
+		f.injected("truncate", "cutting %d of a %s's %d bytes", n, kind, len(payload))
+		payload = payload[:len(payload)-n]
+	}
+	if inj.corruptDirs.has(isReq) && len(payload) > 0 && f.roll(source, inj.corruptChance) {
+		// The payload may still be the received buffer, which capture and
+		// shadow routes hold on to
+		damaged := make([]byte, len(payload))
+		copy(damaged, payload)
+		offsets := make([]int, inj.corruptBytes)
+		for i := range offsets {
+			offsets[i] = f.intN(source, len(damaged))
+			damaged[offsets[i]] ^= byte(1 + f.intN(source, 255))
+		}
+		f.injected("corrupt", "overwriting a %s's bytes at %v", kind, offsets)
+		payload = damaged
+	}
+	return payload, nil
+}
+
+// dropResponses wraps a streaming call's client side so that responses
+// drop_responses picks are never sent; dst itself when the route drops none
+func (f *callFaults) dropResponses(dst grpc.Stream) grpc.Stream {
+	if f == nil || f.inj.dropChance <= 0 {
+		return dst
+	}
+	return &faultDropStream{Stream: dst, faults: f}
+}
+
+type faultDropStream struct {
+	grpc.Stream
+	faults *callFaults
+}
+
+func (s *faultDropStream) SendMsg(m any) error {
+	if s.faults.roll(faultSourceDrops, s.faults.inj.dropChance) {
+		s.faults.injected("drop_responses", "dropping a response")
+		return nil
+	}
+	return s.Stream.SendMsg(m)
+}
+
+// WithFaultInjection honours the routes' fault_injection blocks, which are
+// otherwise ignored; the binary's -enable-faults
+func WithFaultInjection() Option {
+	return func(px *Proxy) { px.faultsEnabled = true }
+}
+
+// loadFaultInjection parses every route's fault_injection block, checking it
+// whether or not faults are enabled so config-check catches mistakes
+func (px *Proxy) loadFaultInjection(diag *Diagnostics) {
+	for i := range px.cfg.Routes {
+		route := &px.cfg.Routes[i]
+		cfg := route.FaultInjection
+		if cfg == nil {
+			continue
+		}
+		path := fmt.Sprintf("routes[%d].fault_injection", i)
+		inj, ok := parseFaultInjection(cfg, route.Name, path, diag)
+		if !ok {
+			continue
+		}
+		if !px.faultsEnabled {
+			diag.Warnf("routes", "FAULT_INJECTION_DISABLED", path, "ignored without -enable-faults")
+			continue
+		}
+		if inj.seed == 0 {
+			inj.seed = rand.Uint64() | 1
+		}
+		if _, dup := px.routeFaults[route.Name]; !dup {
+			px.routeFaults[route.Name] = inj
+			log.Printf("[Fault] Route %s injects faults (seed %d): %s", route.Name, inj.seed, inj.summary())
+		}
+	}
+}
+
+func parseFaultInjection(cfg *FaultInjectionConfig, route, path string, diag *Diagnostics) (*faultInjector, bool) {
+	inj := &faultInjector{route: route, seed: cfg.Seed}
+	ok := true
+	chance := func(key string, p float64) float64 {
+		if p < 0 || p > 1 {
+			diag.Errorf("routes", "ROUTE_FAULT_INJECTION", path+"."+key+".probability", "%v is not between 0 and 1", p)
+			ok = false
+		}
+		return p
+	}
+	directions := func(key, raw string) faultDirections {
+		switch raw {
+		case "", "both":
+			return faultDirections{true, true}
+		case "requests":
+			return faultDirections{requests: true}
+		case "responses":
+			return faultDirections{responses: true}
+		}
+		diag.Errorf("routes", "ROUTE_FAULT_INJECTION", path+"."+key+".direction", "unknown direction %q; want requests, responses or both", raw)
+		ok = false
+		return faultDirections{}
+	}
+	byteCount := func(key string, n int) int {
+		switch {
+		case n < 0:
+			diag.Errorf("routes", "ROUTE_FAULT_INJECTION", path+"."+key+".bytes", "must not be negative")
+			ok = false
+		case n == 0:
+			n = 1
+		}
+		return n
+	}
+
+	if d := cfg.Delay; d != nil {
+		inj.delayChance = chance("delay", d.Probability)
+		inj.delayDirs = directions("delay", d.Direction)
+		dur, err := time.ParseDuration(d.Duration)
+		if err != nil || dur <= 0 {
+			diag.Errorf("routes", "ROUTE_FAULT_INJECTION", path+".delay.duration", "invalid duration %q", d.Duration)
+			ok = false
+		}
+		inj.delay = dur
+	}
+	if a := cfg.Abort; a != nil {
+		inj.abortChance = chance("abort", a.Probability)
+		inj.abortCode, inj.abortMessage = codes.Unavailable, "injected fault"
+		if a.Code != "" {
+			c, err := parseStatusCode(a.Code)
+			switch {
+			case err != nil:
+				diag.Errorf("routes", "ROUTE_FAULT_INJECTION", path+".abort.code", "%v", err)
+				ok = false
+			case c == codes.OK:
+				diag.Errorf("routes", "ROUTE_FAULT_INJECTION", path+".abort.code", "an aborted call cannot end with OK")
+				ok = false
+			}
+			inj.abortCode = c
+		}
+		if a.Message != "" {
+			inj.abortMessage = a.Message
+		}
+	}
+	if t := cfg.Truncate; t != nil {
+		inj.truncateChance = chance("truncate", t.Probability)
+		inj.truncateBytes = byteCount("truncate", t.Bytes)
+		inj.truncateDirs = directions("truncate", t.Direction)
+	}
+	if c := cfg.Corrupt; c != nil {
+		inj.corruptChance = chance("corrupt", c.Probability)
+		inj.corruptBytes = byteCount("corrupt", c.Bytes)
+		inj.corruptDirs = directions("corrupt", c.Direction)
+	}
+	if d := cfg.DropResponses; d != nil {
+		inj.dropChance = chance("drop_responses", d.Probability)
+	}
+	return inj, ok
+}
+
+// summary lists the faults the route injects, for the startup log
+func (inj *faultInjector) summary() string {
+	var parts []string
+	add := func(p float64, format string, args ...any) {
+		if p > 0 {
+			parts = append(parts, fmt.Sprintf("%g%% ", p*100)+fmt.Sprintf(format, args...))
+		}
+	}
+	add(inj.delayChance, "delay %s", inj.delay)
+	add(inj.abortChance, "abort %s", inj.abortCode)
+	add(inj.truncateChance, "truncate %d byte(s)", inj.truncateBytes)
+	add(inj.corruptChance, "corrupt %d byte(s)", inj.corruptBytes)
+	add(inj.dropChance, "drop responses")
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
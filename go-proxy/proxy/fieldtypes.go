@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// --- Envelope Field Types ---
+//
+// Each envelope field is read as one kind:
+//
+//	bytes       payload_field, client_sig_field, proxy_sig_field, backend_sig_field
+//	string      type_url_field
+//	string map  metadata_field, a map<string, string>
+//	items       items_field, a repeated message (see batch.go)
+//
+// A field of any other type would read as unset, so a payload_field naming a
+// string field would have the proxy sign no bytes at all. A configured field
+// of the wrong type therefore fails startup (ROUTE_ENVELOPE) on request and
+// response types alike, and on a method resolved only at runtime (a lazy
+// schema, a MatchRoute route) it is a decode failure with reason wrong_type,
+// which follows the route's on_decode_failure.
+//
+// Legacy envelopes that keep these values in the other scalar type can set
+// envelope.allow_type_coercion. A string field then stands in for a bytes
+// field as the standard base64 of the bytes, as in protobuf's JSON mapping,
+// and a bytes field stands in for a string field as its UTF-8 text. The
+// proxy reads and writes both that way; a string that is not valid base64 is
+// a wrong_type decode failure.
+
+// kindStringMap is the kind of metadata_field
+const kindStringMap = "string_map"
+
+var scalarKinds = map[string]descriptorpb.FieldDescriptorProto_Type{
+	"bytes":  descriptorpb.FieldDescriptorProto_TYPE_BYTES,
+	"string": descriptorpb.FieldDescriptorProto_TYPE_STRING,
+}
+
+// coercible reports whether allow_type_coercion lets fd stand in for kind
+func coercible(fd *desc.FieldDescriptor, kind string) bool {
+	if fd.IsRepeated() {
+		return false
+	}
+	switch kind {
+	case "bytes":
+		return fd.GetType() == descriptorpb.FieldDescriptorProto_TYPE_STRING
+	case "string":
+		return fd.GetType() == descriptorpb.FieldDescriptorProto_TYPE_BYTES
+	}
+	return false
+}
+
+// coerced reports whether fd is read as kind through coercion
+func coerced(fd *desc.FieldDescriptor, kind string) bool {
+	return fd != nil && !hasFieldKind(fd, kind) && coercible(fd, kind)
+}
+
+// fieldTypeError says why fd cannot be read as kind, or is nil
+func fieldTypeError(fd *desc.FieldDescriptor, kind string, coerce bool) error {
+	if hasFieldKind(fd, kind) || (coerce && coercible(fd, kind)) {
+		return nil
+	}
+	var want string
+	switch kind {
+	case kindSigList:
+		return fmt.Errorf("is %s; it must be a repeated message field whose entries have key_id, algorithm and signature fields", describeFieldType(fd))
+	case kindItems:
+		return fmt.Errorf("is %s; it must be a repeated message field", describeFieldType(fd))
+	case kindStringMap:
+		want = "map<string, string>"
+	default:
+		want = "singular " + kind
+	}
+	msg := fmt.Sprintf("is %s; it must be a %s field", describeFieldType(fd), want)
+	if !coerce && coercible(fd, kind) {
+		msg += " (or set allow_type_coercion)"
+	}
+	return fmt.Errorf("%s", msg)
+}
+
+// describeFieldType names fd's type the way a .proto file would
+func describeFieldType(fd *desc.FieldDescriptor) string {
+	name := func(fd *desc.FieldDescriptor) string {
+		if mt := fd.GetMessageType(); mt != nil {
+			return mt.GetFullyQualifiedName()
+		}
+		if et := fd.GetEnumType(); et != nil {
+			return et.GetFullyQualifiedName()
+		}
+		return strings.ToLower(strings.TrimPrefix(fd.GetType().String(), "TYPE_"))
+	}
+	switch {
+	case fd.IsMap():
+		return fmt.Sprintf("map<%s, %s>", name(fd.GetMapKeyType()), name(fd.GetMapValueType()))
+	case fd.IsRepeated():
+		return "repeated " + name(fd)
+	}
+	return name(fd)
+}
+
+// mistypedField is a configured envelope field whose type cannot be read as
+// its kind
+type mistypedField struct {
+	key          string // e.g. payload_field
+	responseOnly bool
+	err          error
+}
+
+// checkTypes reports the envelope's mistyped fields that apply to a message
+// going the isReq way, and coerced strings in msg that are not base64
+func (env *resolvedEnvelope) checkTypes(msg *dynamic.Message, isReq bool) error {
+	var problems []string
+	for _, m := range env.mistyped {
+		if isReq && m.responseOnly {
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("%s %v", m.key, m.err))
+	}
+	for _, f := range []struct {
+		key string
+		fd  *desc.FieldDescriptor
+	}{{"payload_field", env.payload}, {"client_sig_field", env.clientSig}, {"proxy_sig_field", env.proxySig}, {"backend_sig_field", env.backendSig}} {
+		if !coerced(f.fd, "bytes") {
+			continue
+		}
+		if s, ok := fieldValue(msg, f.fd); ok {
+			if _, err := base64.StdEncoding.DecodeString(s.(string)); err != nil {
+				problems = append(problems, fmt.Sprintf("%s %s does not hold base64: %v", f.key, f.fd.GetName(), err))
+			}
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(problems, "; "))
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// --- Backend Restarts ---
+//
+// A backend stopping gracefully sends GOAWAY: it takes no new streams on the
+// connection, finishes the ones it has, and closes it. gRPC already moves
+// calls that had not started yet to a new connection; what is left to the
+// proxy is the calls the closing connection cut off, which reach it as
+// UNAVAILABLE "the connection is draining" or "received prior goaway".
+//
+//	unary calls     the request is held until the backend answers, so a call
+//	                cut off before any answer is replayed on a new
+//	                connection, up to backend.restart.max_attempts in all
+//	                (default 3) and within the client's deadline. These
+//	                replays come before, and do not count against, the
+//	                route's retry policy.
+//	streams         cannot be replayed once messages have gone out. They end
+//	                UNAVAILABLE with the ErrorInfo reason BACKEND_RESTARTING,
+//	                and a grpc-retry-pushback-ms trailer of
+//	                backend.restart.pushback (default 1s) that gRPC clients
+//	                with a retry policy wait before trying again. So do unary
+//	                calls out of replays.
+//
+// The connection manager watches each backend connection, and takes one that
+// stops being ready (GOAWAY, or the backend dropping it) out of use straight
+// away: calls already on it run to their end, new ones dial afresh. Replays
+// are counted in proxy_backend_restart_replays_total{method}, and the
+// connections in proxy_upstream_connections_closed_total{reason="closed"}.
+
+// BackendRestartConfig is how calls cut off by a backend's GOAWAY end
+type BackendRestartConfig struct {
+	MaxAttempts int    `yaml:"max_attempts"` // of a unary call, the first included; default 3, 1 replays none
+	Pushback    string `yaml:"pushback"`     // grpc-retry-pushback-ms on BACKEND_RESTARTING; default "1s"
+}
+
+const (
+	reasonBackendRestarting   = "BACKEND_RESTARTING"
+	retryPushbackTrailer      = "grpc-retry-pushback-ms"
+	defaultRestartAttempts    = 3
+	defaultRestartPushback    = time.Second
+	connectionClosedByBackend = "closed"
+)
+
+// restartPolicy is backend.restart, parsed
+type restartPolicy struct {
+	maxAttempts int
+	pushback    time.Duration
+}
+
+// backendRestarting reports whether err is a call cut off by a backend
+// connection that had sent GOAWAY
+func backendRestarting(err error) bool {
+	s, ok := status.FromError(err)
+	if !ok || s.Code() != codes.Unavailable {
+		return false
+	}
+	return strings.Contains(s.Message(), "the connection is draining") || strings.Contains(s.Message(), "received prior goaway")
+}
+
+// replayAfterRestart decides whether a unary request the backend never
+// answered goes out again after err, counting the replay in replays
+func (px *Proxy) replayAfterRestart(ctx context.Context, method string, replays *int, err error) bool {
+	if !backendRestarting(err) || *replays+1 >= px.restarts.maxAttempts || ctx.Err() != nil {
+		return false
+	}
+	*replays++
+	metrics.Inc("proxy_backend_restart_replays_total", Labels{"method": method})
+	log.Printf("[Backend] %s was cut off by a backend GOAWAY; replaying it on a new connection (%d of %d)", method, *replays, px.restarts.maxAttempts-1)
+	return true
+}
+
+// restartStatus turns a call cut off by a backend GOAWAY into a
+// BACKEND_RESTARTING rejection with its pushback; other errors are returned
+// unchanged
+func (px *Proxy) restartStatus(serverStream grpc.ServerStream, err error) error {
+	if !backendRestarting(err) {
+		return err
+	}
+	ms := strconv.FormatInt(px.restarts.pushback.Milliseconds(), 10)
+	serverStream.SetTrailer(metadata.Pairs(retryPushbackTrailer, ms))
+	return rejectf(codes.Unavailable, reasonBackendRestarting, "proxy: the backend is restarting; retry after %sms", ms).with("pushback_ms", ms)
+}
+
+// watch takes c out of use once it stops being ready, which a backend GOAWAY
+// does to it; it returns when c closes
+func (m *connManager) watch(c *upstreamConn) {
+	state := c.conn.GetState()
+	for c.conn.WaitForStateChange(context.Background(), state) {
+		prev := state
+		state = c.conn.GetState()
+		if state == connectivity.Shutdown {
+			return
+		}
+		if prev != connectivity.Ready || state == connectivity.Ready {
+			continue
+		}
+		m.mu.Lock()
+		if !c.dropped {
+			m.remove(c, connectionClosedByBackend)
+			log.Printf("[Backend] Connection to %s closed by the backend; new calls get a new one", c.labels["endpoint"])
+		}
+		if c.streams == 0 {
+			c.conn.Close()
+		}
+		m.mu.Unlock()
+		return
+	}
+}
+
+// loadBackendRestarts parses backend.restart
+func (px *Proxy) loadBackendRestarts(diag *Diagnostics) {
+	px.restarts = &restartPolicy{maxAttempts: defaultRestartAttempts, pushback: defaultRestartPushback}
+	cfg := px.cfg.Backend.Restart
+	if cfg == nil {
+		return
+	}
+	switch {
+	case cfg.MaxAttempts < 0:
+		diag.Errorf("backend", "BACKEND_RESTART", "backend.restart.max_attempts", "must not be negative")
+	case cfg.MaxAttempts > 0:
+		px.restarts.maxAttempts = cfg.MaxAttempts
+	}
+	if cfg.Pushback != "" {
+		d, err := time.ParseDuration(cfg.Pushback)
+		if err != nil || d < 0 {
+			diag.Errorf("backend", "BACKEND_RESTART", "backend.restart.pushback", "invalid duration %q", cfg.Pushback)
+			return
+		}
+		px.restarts.pushback = d
+	}
+	if px.cfg.Backend.Mode == backendModeMock {
+		diag.Warnf("backend", "BACKEND_RESTART", "backend.restart", "the mock backend never restarts")
+	}
+	log.Printf("[Backend] Calls cut off by a backend restart: unary calls get up to %d attempts, streams a %s pushback", px.restarts.maxAttempts, px.restarts.pushback)
+}
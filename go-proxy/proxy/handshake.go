@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// ticketKeysRetained is how many session ticket keys stay valid for decryption.
+// New tickets are always issued with the newest key; keeping the previous ones
+// lets clients resume across a rotation instead of falling back to a full
+// handshake.
+const ticketKeysRetained = 3
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(v string) (uint16, error) {
+	if version, ok := tlsVersions[strings.TrimPrefix(v, "TLS")]; ok {
+		return version, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q (want 1.0, 1.1, 1.2 or 1.3)", v)
+}
+
+// parseCipherSuites resolves IANA suite names (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256).
+// Go does not allow TLS 1.3 suites to be configured, so these only affect TLS 1.2 and below.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[s.Name] = s.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// applyTLSTuning sets the version range, cipher suites and ALPN list on the
+// listener config. "h2" is always offered since gRPC cannot run without it.
+func applyTLSTuning(tlsCfg *tls.Config, cfg TLSConfig) error {
+	var err error
+	if cfg.MinVersion != "" {
+		if tlsCfg.MinVersion, err = parseTLSVersion(cfg.MinVersion); err != nil {
+			return fmt.Errorf("min_version: %w", err)
+		}
+	}
+	if cfg.MaxVersion != "" {
+		if tlsCfg.MaxVersion, err = parseTLSVersion(cfg.MaxVersion); err != nil {
+			return fmt.Errorf("max_version: %w", err)
+		}
+	}
+	if tlsCfg.MinVersion != 0 && tlsCfg.MaxVersion != 0 && tlsCfg.MinVersion > tlsCfg.MaxVersion {
+		return fmt.Errorf("min_version %s is above max_version %s", cfg.MinVersion, cfg.MaxVersion)
+	}
+	if len(cfg.CipherSuites) > 0 {
+		if tlsCfg.CipherSuites, err = parseCipherSuites(cfg.CipherSuites); err != nil {
+			return fmt.Errorf("cipher_suites: %w", err)
+		}
+	}
+	tlsCfg.NextProtos = append([]string(nil), cfg.ALPN...)
+	if !slices.Contains(tlsCfg.NextProtos, "h2") {
+		tlsCfg.NextProtos = append(tlsCfg.NextProtos, "h2")
+	}
+	if cfg.DisableSessionTickets {
+		tlsCfg.SessionTicketsDisabled = true
+	}
+	return nil
+}
+
+// ticketKeyRotation returns the configured rotation interval, or 0 to leave
+// rotation to the Go runtime's built-in schedule.
+func (cfg TLSConfig) ticketKeyRotation() (time.Duration, error) {
+	if cfg.TicketKeyRotation == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(cfg.TicketKeyRotation)
+	if err != nil {
+		return 0, fmt.Errorf("ticket_key_rotation: %w", err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("ticket_key_rotation must be positive, got %s", d)
+	}
+	return d, nil
+}
+
+// startTicketKeyRotation installs a fresh session ticket key every interval.
+// The gRPC credentials clone the listener config, so keys set on it later would
+// never be seen; instead the handshake is served from a config returned by
+// GetConfigForClient, whose keys we own. SetSessionTicketKeys is safe to call
+// while serving, established connections are unaffected, and tickets issued
+// under the previous keys still resume.
+func startTicketKeyRotation(tlsCfg *tls.Config, every time.Duration, stop <-chan struct{}) error {
+	served := tlsCfg.Clone()
+	var keys [][32]byte
+	rotate := func() error {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		keys = append([][32]byte{key}, keys...)
+		if len(keys) > ticketKeysRetained {
+			keys = keys[:ticketKeysRetained]
+		}
+		served.SetSessionTicketKeys(keys)
+		metrics.Inc("proxy_tls_ticket_key_rotations_total", nil)
+		return nil
+	}
+	if err := rotate(); err != nil {
+		return fmt.Errorf("generate session ticket key: %w", err)
+	}
+	tlsCfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return served, nil
+	}
+
+	go func() {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			if err := rotate(); err != nil {
+				log.Printf("[TLS] Session ticket key rotation failed: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// handshakeMetricsCreds wraps the listener TLS credentials to record how each
+// handshake went: full vs resumed, how long it took, what was negotiated, and
+// whether the client authenticated with a certificate.
+type handshakeMetricsCreds struct {
+	credentials.TransportCredentials
+}
+
+func newHandshakeMetricsCreds(tlsCfg *tls.Config) credentials.TransportCredentials {
+	return handshakeMetricsCreds{credentials.NewTLS(tlsCfg)}
+}
+
+func (c handshakeMetricsCreds) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	start := time.Now()
+	conn, authInfo, err := c.TransportCredentials.ServerHandshake(rawConn)
+	elapsed := time.Since(start)
+
+	if err != nil {
+		metrics.Inc("proxy_tls_handshake_failures_total", Labels{"reason": handshakeFailureReason(err)})
+		metrics.ObserveDuration("proxy_tls_handshake_duration_seconds", Labels{"result": "failed"}, elapsed)
+		return conn, authInfo, err
+	}
+
+	info, ok := authInfo.(credentials.TLSInfo)
+	if !ok {
+		return conn, authInfo, nil
+	}
+	cs := info.State
+	result := "full"
+	if cs.DidResume {
+		result = "resumed"
+	}
+	metrics.Inc("proxy_tls_handshakes_total", Labels{
+		"result":      result,
+		"version":     tls.VersionName(cs.Version),
+		"cipher":      tls.CipherSuiteName(cs.CipherSuite),
+		"client_auth": clientAuthOutcome(cs),
+	})
+	metrics.ObserveDuration("proxy_tls_handshake_duration_seconds", Labels{"result": result}, elapsed)
+	return conn, authInfo, nil
+}
+
+func (c handshakeMetricsCreds) Clone() credentials.TransportCredentials {
+	return handshakeMetricsCreds{c.TransportCredentials.Clone()}
+}
+
+// clientAuthOutcome classifies a completed handshake: verified against the
+// client CA, presented but unverified, or no client certificate at all.
+func clientAuthOutcome(cs tls.ConnectionState) string {
+	switch {
+	case len(cs.VerifiedChains) > 0:
+		return "verified"
+	case len(cs.PeerCertificates) > 0:
+		return "unverified"
+	}
+	return "none"
+}
+
+// handshakeFailureReason buckets handshake errors so the failure counter stays
+// low-cardinality. crypto/tls does not expose typed errors for client
+// certificate problems, so those are recognised by message.
+func handshakeFailureReason(err error) string {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "certificate"):
+		return "client_auth"
+	case strings.Contains(msg, "timeout"), strings.Contains(msg, "deadline"):
+		return "timeout"
+	case strings.Contains(msg, "EOF"), strings.Contains(msg, "reset"):
+		return "closed"
+	}
+	return "protocol"
+}
@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	defaultIdentityHeader = "x-proxy-client-identity"
+	anonymousIdentity     = "anonymous"
+	maxIdentitySkew       = 5 * time.Minute
+)
+
+type clientIdentityKey struct{}
+
+// clientIdentityFromContext returns the effective client identity for an RPC
+func clientIdentityFromContext(ctx context.Context) string {
+	if id, ok := ctx.Value(clientIdentityKey{}).(string); ok {
+		return id
+	}
+	return anonymousIdentity
+}
+
+func (px *Proxy) identityHeader() string {
+	if px.cfg.Identity.Header != "" {
+		return px.cfg.Identity.Header
+	}
+	return defaultIdentityHeader
+}
+
+// transportIdentity extracts the verified mTLS peer identity, if any
+func transportIdentity(ctx context.Context) (string, bool) {
+	cert := peerCertificate(ctx)
+	if cert == nil {
+		return "", false
+	}
+	return certIdentity(cert), true
+}
+
+// identityAssertion is the byte string an upstream proxy signs to vouch for a
+// client identity on a specific method at a specific time.
+func identityAssertion(identity, method, ts string) []byte {
+	return []byte(identity + "\n" + method + "\n" + ts)
+}
+
+// resolveClientIdentity works out who the original client is and rewrites md
+// for the upstream hop. Identity headers arriving from the wire are always
+// stripped; they are only honoured when signed by a trusted upstream proxy,
+// and re-issued (signed with our key) when propagation is enabled.
+func (px *Proxy) resolveClientIdentity(ctx context.Context, method string, md metadata.MD) (string, error) {
+	hdr := px.identityHeader()
+	asserted, ts, sig := first(md, hdr), first(md, hdr+"-ts"), first(md, hdr+"-sig")
+	delete(md, hdr)
+	delete(md, hdr+"-ts")
+	delete(md, hdr+"-sig")
+
+	identity, ok := transportIdentity(ctx)
+	if !ok {
+		identity = anonymousIdentity
+	}
+
+	if asserted != "" && len(px.upstreamIdentityKeys) > 0 {
+		if err := px.verifyIdentityAssertion(asserted, method, ts, sig); err != nil {
+			return "", rejectf(codes.Unauthenticated, reasonIdentityInvalid, "proxy: invalid upstream identity assertion: %v", err)
+		}
+		identity = asserted
+	}
+
+	if px.cfg.Identity.Propagate && px.proxyKey != nil {
+		now := strconv.FormatInt(time.Now().Unix(), 10)
+		hashed := sha256.Sum256(identityAssertion(identity, method, now))
+		s, err := rsa.SignPKCS1v15(nil, px.proxyKey.load().priv, crypto.SHA256, hashed[:])
+		if err != nil {
+			return "", rejectf(codes.Internal, reasonIdentitySigning, "proxy: failed to sign identity assertion: %v", err)
+		}
+		md.Set(hdr, identity)
+		md.Set(hdr+"-ts", now)
+		md.Set(hdr+"-sig", base64.StdEncoding.EncodeToString(s))
+	}
+	return identity, nil
+}
+
+func (px *Proxy) verifyIdentityAssertion(identity, method, ts, sig string) error {
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad timestamp")
+	}
+	if skew := time.Since(time.Unix(unix, 0)); skew > maxIdentitySkew || skew < -maxIdentitySkew {
+		return fmt.Errorf("timestamp outside allowed skew")
+	}
+	sigBytes, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("bad signature encoding")
+	}
+	hashed := sha256.Sum256(identityAssertion(identity, method, ts))
+	for _, key := range px.upstreamIdentityKeys {
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sigBytes) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature does not match any trusted upstream key")
+}
+
+// readCertKeys reads the RSA public keys of every certificate in the PEM
+// bundle at the secret uri, once
+func (px *Proxy) readCertKeys(uri string) ([]*rsa.PublicKey, error) {
+	b, _, err := px.readSecret(uri)
+	if err != nil {
+		return nil, err
+	}
+	return parseCertKeys(b, uri)
+}
+
+// parseCertKeys parses the RSA public keys of every certificate in a PEM
+// bundle read from source
+func parseCertKeys(b []byte, source string) ([]*rsa.PublicKey, error) {
+	var keys []*rsa.PublicKey
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if pub, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+			keys = append(keys, pub)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no RSA certificates found in %s", source)
+	}
+	return keys, nil
+}
+
+func first(md metadata.MD, key string) string {
+	if v := md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// Policies for bind_transport_identity calls without a client certificate
+const (
+	identityMissingReject    = "reject"
+	identityMissingAnonymous = "anonymous"
+)
+
+// bindTransportIdentity writes the client certificate's identity into a
+// request envelope on routes with bind_transport_identity, replacing whatever
+// the client put there. It reports whether the envelope was changed.
+func (px *Proxy) bindTransportIdentity(ctx context.Context, msg *dynamic.Message, route *RouteConfig, method string) (bool, error) {
+	m, ok := px.routeIdentityFields[route.Name]
+	if !ok {
+		return false, nil
+	}
+	identity, ok := transportIdentity(ctx)
+	result := "bound"
+	if !ok {
+		if route.IdentityOnMissing != identityMissingAnonymous {
+			metrics.Inc("proxy_identity_bindings_total", Labels{"route": route.Name, "result": "rejected", "shadow": shadowLabel(route)})
+			return false, rejectf(codes.Unauthenticated, reasonIdentityMissing, "proxy: route %q requires a client certificate", route.Name)
+		}
+		identity, result = anonymousIdentity, identityMissingAnonymous
+	}
+	m.str = identity
+	if err := m.apply(msg, time.Now()); err != nil {
+		return false, rejectf(codes.Internal, reasonIdentityBinding, "proxy: bind client identity to %s: %v", m.field, err)
+	}
+	metrics.Inc("proxy_identity_bindings_total", Labels{"route": route.Name, "result": result, "shadow": shadowLabel(route)})
+	log.Printf("[Request Security] Bound client identity %q into %s for %s", identity, m.field, method)
+	return true, nil
+}
+
+// loadIdentityBindings checks each route's bind_transport_identity settings
+// and resolves envelope.identity_field against the request type of every
+// loaded method the route matches
+func (px *Proxy) loadIdentityBindings(diag *Diagnostics) {
+	methods := px.knownMethods()
+	clientCerts := false
+	for _, l := range px.listeners {
+		clientCerts = clientCerts || (l.tls != nil && l.tls.ClientAuth != tls.NoClientCert)
+	}
+	for i, route := range px.cfg.Routes {
+		path := fmt.Sprintf("routes[%d]", i)
+		if !route.BindTransportIdentity {
+			if route.IdentityOnMissing != "" || route.Envelope.IdentityField != "" {
+				diag.Warnf("routes", "ROUTE_IDENTITY_BINDING", path, "identity_field and identity_on_missing have no effect without bind_transport_identity")
+			}
+			continue
+		}
+		if route.Mode == "pass-thru" || route.Mode == "local-reply" {
+			diag.Errorf("routes", "ROUTE_IDENTITY_BINDING", path+".bind_transport_identity", "%s routes do not decode envelopes to bind an identity into", route.Mode)
+			continue
+		}
+		switch route.IdentityOnMissing {
+		case "", identityMissingReject, identityMissingAnonymous:
+		default:
+			diag.Errorf("routes", "ROUTE_IDENTITY_BINDING", path+".identity_on_missing", "unknown policy %q (expected reject or anonymous)", route.IdentityOnMissing)
+			continue
+		}
+		if route.Envelope.IdentityField == "" {
+			diag.Errorf("routes", "ROUTE_IDENTITY_BINDING", path+".envelope.identity_field", "bind_transport_identity needs an identity_field to write the identity to")
+			continue
+		}
+		m, err := parseMutation(MutationConfig{Op: "set_string", Field: route.Envelope.IdentityField})
+		if err != nil {
+			diag.Errorf("routes", "ROUTE_IDENTITY_BINDING", path+".envelope.identity_field", "%v", err)
+			continue
+		}
+		valid := true
+		for _, name := range methods {
+			if !route.matches(name) || px.shadowedByBuiltin(route, name) {
+				continue
+			}
+			md, ok := px.lookupMethod(name)
+			if !ok {
+				continue
+			}
+			if _, err := m.resolve(md.GetInputType()); err != nil {
+				diag.Errorf("routes", "ROUTE_IDENTITY_BINDING", path+".envelope.identity_field", "field %q on %s: %v", route.Envelope.IdentityField, name, err)
+				valid = false
+				break
+			}
+		}
+		if !clientCerts {
+			diag.Warnf("routes", "ROUTE_IDENTITY_BINDING", path+".bind_transport_identity", "no listener asks for client certificates, so every call is handled by identity_on_missing")
+		}
+		if _, dup := px.routeIdentityFields[route.Name]; valid && !dup {
+			px.routeIdentityFields[route.Name] = m
+		}
+	}
+}
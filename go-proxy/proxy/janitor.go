@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/peer"
+)
+
+// --- Stream Janitor ---
+//
+// Every proxied call is entered in a registry for as long as it runs: its
+// method, route, client address, start, and when a message last arrived from
+// each side. The admin listener lists them at /streams, oldest first, so a
+// stream neither side is using shows before anything acts on it. The janitor
+// block then has a goroutine end such streams:
+//
+//	max_stream_age   calls running longer than this
+//	max_stream_idle  streams without a message either way for this long
+//	interval         how often to look; default 10s
+//
+// A call the janitor ends fails with DEADLINE_EXCEEDED (TIMEOUT, with
+// timeout stream_age or stream_idle), its backend call is cancelled with it,
+// and it is counted in proxy_janitor_cancelled_total by route and reason.
+// Unlike a route's idle_timeout, these apply to every route. Recording
+// activity is one atomic store per message; the registry's map is only
+// touched as calls start and end.
+
+// JanitorConfig bounds how long proxied calls may run or sit idle
+type JanitorConfig struct {
+	MaxStreamAge  string `yaml:"max_stream_age"`
+	MaxStreamIdle string `yaml:"max_stream_idle"`
+	Interval      string `yaml:"interval"`
+}
+
+const defaultJanitorInterval = 10 * time.Second
+
+// streamRegistry is every call being proxied
+type streamRegistry struct {
+	next    atomic.Uint64
+	streams sync.Map // id -> *activeStream
+}
+
+// activeStream is one call in the registry
+type activeStream struct {
+	id     uint64
+	method string
+	route  *RouteConfig
+	peer   string
+	unary  bool
+	start  time.Time
+	last   [2]atomic.Int64 // unix nanos of the last message received: [0] from the client, [1] from the backend
+	abort  func(cause error)
+}
+
+type activeStreamKey struct{}
+
+func activeStreamFrom(ctx context.Context) *activeStream {
+	s, _ := ctx.Value(activeStreamKey{}).(*activeStream)
+	return s
+}
+
+// add enters a call, which abort ends
+func (r *streamRegistry) add(ctx context.Context, method string, route *RouteConfig, unary bool, abort func(error)) (context.Context, *activeStream) {
+	s := &activeStream{id: r.next.Add(1), method: method, route: route, unary: unary, start: time.Now(), abort: abort, peer: "unknown"}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		s.peer = p.Addr.String()
+	}
+	r.streams.Store(s.id, s)
+	return context.WithValue(ctx, activeStreamKey{}, s), s
+}
+
+func (r *streamRegistry) remove(s *activeStream) {
+	r.streams.Delete(s.id)
+}
+
+// touch records a message received by one direction's pump
+func (s *activeStream) touch(isReq bool) {
+	if s == nil {
+		return
+	}
+	i := 1
+	if isReq {
+		i = 0
+	}
+	s.last[i].Store(time.Now().UnixNano())
+}
+
+// idle is how long since a message arrived either way, or since the start
+func (s *activeStream) idle(now time.Time) time.Duration {
+	last := s.start.UnixNano()
+	for i := range s.last {
+		last = max(last, s.last[i].Load())
+	}
+	return now.Sub(time.Unix(0, last))
+}
+
+// streamSummary is one entry of the /streams dump
+type streamSummary struct {
+	ID          uint64 `json:"id"`
+	Method      string `json:"method"`
+	Route       string `json:"route"`
+	Peer        string `json:"peer"`
+	Shape       string `json:"shape"`
+	Started     string `json:"started"`
+	Age         string `json:"age"`
+	Idle        string `json:"idle"`
+	ClientIdle  string `json:"client_idle,omitempty"` // omitted until the client has sent
+	BackendIdle string `json:"backend_idle,omitempty"`
+}
+
+// snapshot lists the calls oldest first
+func (r *streamRegistry) snapshot() []streamSummary {
+	now := time.Now()
+	var active []*activeStream
+	r.streams.Range(func(_, v any) bool {
+		active = append(active, v.(*activeStream))
+		return true
+	})
+	sort.Slice(active, func(i, j int) bool { return active[i].start.Before(active[j].start) })
+	out := make([]streamSummary, 0, len(active))
+	for _, s := range active {
+		sum := streamSummary{
+			ID: s.id, Method: s.method, Route: s.route.Name, Peer: s.peer, Shape: "stream",
+			Started: s.start.UTC().Format(time.RFC3339Nano),
+			Age:     now.Sub(s.start).Round(time.Millisecond).String(),
+			Idle:    s.idle(now).Round(time.Millisecond).String(),
+		}
+		if s.unary {
+			sum.Shape = "unary"
+		}
+		for i, dst := range []*string{&sum.ClientIdle, &sum.BackendIdle} {
+			if last := s.last[i].Load(); last != 0 {
+				*dst = now.Sub(time.Unix(0, last)).Round(time.Millisecond).String()
+			}
+		}
+		out = append(out, sum)
+	}
+	return out
+}
+
+// handler serves /streams
+func (r *streamRegistry) handler(w http.ResponseWriter, _ *http.Request) {
+	body, _ := json.MarshalIndent(r.snapshot(), "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// janitor ends calls past maxAge, and streams idle past maxIdle
+type janitor struct {
+	streams         *streamRegistry
+	maxAge, maxIdle time.Duration
+}
+
+func (j *janitor) sweep(now time.Time) {
+	j.streams.streams.Range(func(_, v any) bool {
+		s := v.(*activeStream)
+		var cause *enforcedTimeout
+		age, idle := now.Sub(s.start), s.idle(now)
+		switch {
+		case j.maxAge > 0 && age > j.maxAge:
+			cause = &enforcedTimeout{kind: "stream_age", reason: fmt.Sprintf("call running for more than max_stream_age %s", j.maxAge)}
+		case j.maxIdle > 0 && !s.unary && idle > j.maxIdle:
+			cause = &enforcedTimeout{kind: "stream_idle", reason: fmt.Sprintf("stream idle for more than max_stream_idle %s", j.maxIdle)}
+		default:
+			return true
+		}
+		log.Printf("[Janitor] Ending %s from %s on route %s after %s (idle %s): %s", s.method, s.peer, s.route.Name, age.Round(time.Millisecond), idle.Round(time.Millisecond), cause.reason)
+		metrics.Inc("proxy_janitor_cancelled_total", Labels{"route": s.route.Name, "reason": cause.kind})
+		j.streams.remove(s)
+		s.abort(cause)
+		return true
+	})
+}
+
+// loadJanitor parses the janitor block and starts sweeping
+func (px *Proxy) loadJanitor(diag *Diagnostics) {
+	cfg := px.cfg.Janitor
+	j := &janitor{streams: px.streams}
+	every := defaultJanitorInterval
+	for _, f := range []struct {
+		name, raw string
+		dst       *time.Duration
+	}{
+		{"max_stream_age", cfg.MaxStreamAge, &j.maxAge},
+		{"max_stream_idle", cfg.MaxStreamIdle, &j.maxIdle},
+		{"interval", cfg.Interval, &every},
+	} {
+		if f.raw == "" {
+			continue
+		}
+		d, err := time.ParseDuration(f.raw)
+		if err != nil || d <= 0 {
+			diag.Errorf("janitor", "JANITOR_DURATION", "janitor."+f.name, "invalid duration %q", f.raw)
+			return
+		}
+		*f.dst = d
+	}
+	if j.maxAge == 0 && j.maxIdle == 0 {
+		if cfg.Interval != "" {
+			diag.Warnf("janitor", "JANITOR_DURATION", "janitor.interval", "has no effect without max_stream_age or max_stream_idle")
+		}
+		return
+	}
+	go func() {
+		t := time.NewTicker(every)
+		defer t.Stop()
+		for {
+			select {
+			case <-px.stop:
+				return
+			case now := <-t.C:
+				j.sweep(now)
+			}
+		}
+	}()
+	log.Printf("[Janitor] Checking proxied calls every %s (max_stream_age %s, max_stream_idle %s)", every, orOff(j.maxAge), orOff(j.maxIdle))
+}
+
+// orOff renders an unset limit as off
+func orOff(d time.Duration) string {
+	if d == 0 {
+		return "off"
+	}
+	return d.String()
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// --- Connection Lifetime and Keepalive ---
+//
+// Listener connections can be aged out (letting clients rebalance after a
+// deploy), closed when idle, and pinged to detect dead peers; pings from
+// clients are policed by the enforcement policy. Backend connections get their
+// own keepalive, since a NAT box that drops an idle long-lived stream otherwise
+// leaves the call hanging until its deadline, or forever. Every unset value
+// keeps the gRPC default.
+
+// KeepaliveEnforcementConfig polices client pings; clients pinging more often
+// than min_time are disconnected with ENHANCE_YOUR_CALM
+type KeepaliveEnforcementConfig struct {
+	MinTime             string `yaml:"min_time"`              // default "5m"
+	PermitWithoutStream bool   `yaml:"permit_without_stream"` // allow pings with no active stream
+}
+
+// BackendKeepaliveConfig pings backend connections so dead ones fail fast
+type BackendKeepaliveConfig struct {
+	Time                string `yaml:"time"`    // ping after this long without activity; at least "10s"
+	Timeout             string `yaml:"timeout"` // close if the ping is not answered; default "20s"
+	PermitWithoutStream bool   `yaml:"permit_without_stream"`
+}
+
+// durationField is one optional duration setting and where it lands
+type durationField struct {
+	path string
+	raw  string
+	dst  *time.Duration
+}
+
+// parseDurations fills each set field, reporting bad values by config path
+func parseDurations(diag *Diagnostics, fields []durationField) bool {
+	ok := true
+	for _, f := range fields {
+		if f.raw == "" {
+			continue
+		}
+		d, err := time.ParseDuration(f.raw)
+		if err != nil || d <= 0 {
+			diag.Errorf("keepalive", "KEEPALIVE_DURATION", f.path, "invalid duration %q", f.raw)
+			ok = false
+			continue
+		}
+		*f.dst = d
+	}
+	return ok
+}
+
+// loadKeepalive builds the listener keepalive options and the backend client parameters
+func (px *Proxy) loadKeepalive(diag *Diagnostics) {
+	s := px.cfg.Server
+	var sp keepalive.ServerParameters
+	var ep keepalive.EnforcementPolicy
+	if parseDurations(diag, []durationField{
+		{"server.max_connection_idle", s.MaxConnectionIdle, &sp.MaxConnectionIdle},
+		{"server.max_connection_age", s.MaxConnectionAge, &sp.MaxConnectionAge},
+		{"server.max_connection_age_grace", s.MaxConnectionAgeGrace, &sp.MaxConnectionAgeGrace},
+		{"server.keepalive_time", s.KeepaliveTime, &sp.Time},
+		{"server.keepalive_timeout", s.KeepaliveTimeout, &sp.Timeout},
+		{"server.keepalive_enforcement.min_time", s.KeepaliveEnforcement.MinTime, &ep.MinTime},
+	}) {
+		if sp.MaxConnectionIdle > 0 && sp.MaxConnectionAge > 0 && sp.MaxConnectionIdle >= sp.MaxConnectionAge {
+			diag.Errorf("keepalive", "KEEPALIVE_IDLE_AGE", "server.max_connection_idle", "max_connection_idle %s must be below max_connection_age %s, or connections are aged out before they can idle out", sp.MaxConnectionIdle, sp.MaxConnectionAge)
+		}
+		if sp.MaxConnectionAgeGrace > 0 && sp.MaxConnectionAge == 0 {
+			diag.Warnf("keepalive", "KEEPALIVE_AGE_GRACE", "server.max_connection_age_grace", "max_connection_age_grace has no effect without max_connection_age")
+		}
+		if sp.Time > 0 && sp.Time < time.Second {
+			diag.Warnf("keepalive", "KEEPALIVE_TIME", "server.keepalive_time", "keepalive_time %s is raised to gRPC's minimum of 1s", sp.Time)
+		}
+		if sp.Timeout > 0 && sp.Time > 0 && sp.Timeout >= sp.Time {
+			diag.Errorf("keepalive", "KEEPALIVE_TIMEOUT", "server.keepalive_timeout", "keepalive_timeout %s must be below keepalive_time %s", sp.Timeout, sp.Time)
+		}
+		if s.KeepaliveEnforcement.MinTime != "" || s.KeepaliveEnforcement.PermitWithoutStream {
+			ep.PermitWithoutStream = s.KeepaliveEnforcement.PermitWithoutStream
+			px.serverKeepalive = append(px.serverKeepalive, grpc.KeepaliveEnforcementPolicy(ep))
+		}
+		if sp != (keepalive.ServerParameters{}) {
+			px.serverKeepalive = append(px.serverKeepalive, grpc.KeepaliveParams(sp))
+		}
+	}
+
+	b := px.cfg.Backend.Keepalive
+	if b == nil {
+		return
+	}
+	cp := keepalive.ClientParameters{PermitWithoutStream: b.PermitWithoutStream}
+	if !parseDurations(diag, []durationField{
+		{"backend.keepalive.time", b.Time, &cp.Time},
+		{"backend.keepalive.timeout", b.Timeout, &cp.Timeout},
+	}) {
+		return
+	}
+	if cp.Time == 0 {
+		diag.Errorf("keepalive", "KEEPALIVE_BACKEND", "backend.keepalive.time", "backend keepalive needs a time")
+		return
+	}
+	if cp.Time < 10*time.Second {
+		diag.Warnf("keepalive", "KEEPALIVE_BACKEND", "backend.keepalive.time", "time %s is raised to gRPC's minimum of 10s", cp.Time)
+	} else if cp.Time < 5*time.Minute {
+		diag.Warnf("keepalive", "KEEPALIVE_BACKEND", "backend.keepalive.time", "backends with gRPC's default enforcement policy disconnect clients that ping more often than every 5m; make sure they permit %s", cp.Time)
+	}
+	px.backendKeepalive = &cp
+}
@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+// --- Response Key Selection ---
+//
+// One backend serving several partners through the proxy may owe each
+// partner responses signed with that partner's key. An inspect-verify-sign
+// route's sign_key_selector picks the response signing key per call from
+// what the requests carry:
+//
+//	header        a request header, e.g. x-partner; or
+//	field         a field of the request envelope (a path as in mutations,
+//	              so "metadata[partner_id]" works too), read from every
+//	              request message, the latest one deciding
+//	keys          selector value -> cms.keys name
+//	fallback      default (the route's own response.sign key) or reject
+//	key_id_field  a string field or map<string,string> entry of the response
+//	              envelope the chosen key's id is written to, so verifiers
+//	              know which public key to check against
+//
+// A value keys does not list, or none at all, takes the fallback. reject
+// fails the call with PERMISSION_DENIED (SIGNING_KEY_UNKNOWN): with header
+// before the backend is dialled, with field on the request message that
+// named it. Shadow routes sign with the default key and only count. The id
+// of the key each response was signed with is on its sign audit record, and
+// selections are counted in proxy_sign_key_selections_total by route and key
+// (the cms.keys name, default or rejected).
+
+// SignKeySelectorConfig picks a route's response signing key per call
+type SignKeySelectorConfig struct {
+	Header     string            `yaml:"header"`
+	Field      string            `yaml:"field"`
+	Keys       map[string]string `yaml:"keys"`     // selector value -> cms.keys name
+	Fallback   string            `yaml:"fallback"` // default or reject
+	KeyIDField string            `yaml:"key_id_field"`
+}
+
+// Values of sign_key_selector.fallback
+const (
+	keyFallbackDefault = "default"
+	keyFallbackReject  = "reject"
+)
+
+// keySelector is a route's sign_key_selector, resolved at startup
+type keySelector struct {
+	header string    // lower-cased; empty when field decides
+	field  *mutation // nil when header decides
+	keys   map[string]*signingKey
+	reject bool
+	keyID  *mutation // set_string of the chosen key's id; nil to write none
+}
+
+// keyChoice is the call's selector value
+type keyChoice struct{ value atomic.Pointer[string] }
+
+type keyChoiceKey struct{}
+
+func keyChoiceFrom(ctx context.Context) *keyChoice {
+	c, _ := ctx.Value(keyChoiceKey{}).(*keyChoice)
+	return c
+}
+
+// choose counts the selection of value's key, failing the call when there is
+// none and the route rejects
+func (s *keySelector) choose(route *RouteConfig, value string) error {
+	name := "default"
+	if key := s.keys[value]; key != nil {
+		name = key.name
+	} else if s.reject {
+		name = "rejected"
+	}
+	metrics.Inc("proxy_sign_key_selections_total", Labels{"route": route.Name, "key": name, "shadow": shadowLabel(route)})
+	if name != "rejected" {
+		return nil
+	}
+	if route.Shadow {
+		log.Printf("[Shadow] Route %s would reject signing key selector %q: no key", route.Name, value)
+		return nil
+	}
+	if value == "" {
+		return rejectf(codes.PermissionDenied, reasonSigningKeyUnknown, "proxy: the call names no signing key")
+	}
+	return rejectf(codes.PermissionDenied, reasonSigningKeyUnknown, "proxy: no signing key for %q", value).with("selector", value)
+}
+
+// selectSignKey starts the call's key choice on a route with
+// sign_key_selector; a header decides it here and now
+func (px *Proxy) selectSignKey(route *RouteConfig, md metadata.MD) (*keyChoice, error) {
+	s := px.routeKeySelectors[route.Name]
+	if s == nil {
+		return nil, nil
+	}
+	c := &keyChoice{}
+	if s.header == "" {
+		return c, nil
+	}
+	value := first(md, s.header)
+	if err := s.choose(route, value); err != nil {
+		return nil, err
+	}
+	c.value.Store(&value)
+	return c, nil
+}
+
+// noteSignKey reads the selector field of a request envelope into the call's
+// key choice
+func (px *Proxy) noteSignKey(ctx context.Context, route *RouteConfig, msg *dynamic.Message) error {
+	s, c := px.routeKeySelectors[route.Name], keyChoiceFrom(ctx)
+	if s == nil || s.field == nil || c == nil {
+		return nil
+	}
+	value, _ := readVersionField(s.field, msg)
+	if err := s.choose(route, value); err != nil {
+		return err
+	}
+	c.value.Store(&value)
+	return nil
+}
+
+// responseKey is the key responses of the call are signed with: the one its
+// selector value names, or fallback, the route's own
+func (px *Proxy) responseKey(ctx context.Context, route *RouteConfig, fallback *signingKey) (*signingKey, error) {
+	s := px.routeKeySelectors[route.Name]
+	if s == nil {
+		return fallback, nil
+	}
+	var value *string
+	if c := keyChoiceFrom(ctx); c != nil {
+		value = c.value.Load()
+	}
+	if value != nil {
+		if key := s.keys[*value]; key != nil {
+			return key, nil
+		}
+	}
+	if s.reject && !route.Shadow {
+		// Only a response ahead of every request gets here unchosen
+		return nil, rejectf(codes.PermissionDenied, reasonSigningKeyUnknown, "proxy: no signing key chosen for the response")
+	}
+	return fallback, nil
+}
+
+// stampKeyID writes key's id into the response envelope's key_id_field
+func (px *Proxy) stampKeyID(route *RouteConfig, msg *dynamic.Message, key *signingKey) error {
+	s := px.routeKeySelectors[route.Name]
+	if s == nil || s.keyID == nil {
+		return nil
+	}
+	m := *s.keyID
+	m.str = key.id()
+	return m.apply(msg, time.Now())
+}
+
+// loadKeySelectors resolves each route's sign_key_selector
+func (px *Proxy) loadKeySelectors(diag *Diagnostics) {
+	methods := px.knownMethods()
+	for i := range px.cfg.Routes {
+		route := &px.cfg.Routes[i]
+		cfg := route.SignKeySelector
+		if cfg == nil {
+			continue
+		}
+		path := fmt.Sprintf("routes[%d].sign_key_selector", i)
+		if route.Mode != "inspect-verify-sign" {
+			diag.Errorf("routes", "ROUTE_SIGN_KEY_SELECTOR", path, "only inspect-verify-sign routes sign responses")
+			continue
+		}
+		if !px.cryptoPlanFor(route).response.signs {
+			diag.Errorf("routes", "ROUTE_SIGN_KEY_SELECTOR", path, "the route does not sign responses (response.sign: none)")
+			continue
+		}
+		s := &keySelector{keys: map[string]*signingKey{}}
+		ok := true
+		switch cfg.Fallback {
+		case "", keyFallbackDefault:
+		case keyFallbackReject:
+			s.reject = true
+		default:
+			diag.Errorf("routes", "ROUTE_SIGN_KEY_SELECTOR", path+".fallback", "unknown fallback %q (expected default or reject)", cfg.Fallback)
+			ok = false
+		}
+		if len(cfg.Keys) == 0 {
+			diag.Errorf("routes", "ROUTE_SIGN_KEY_SELECTOR", path+".keys", "lists no keys to select")
+			ok = false
+		}
+		for value, name := range cfg.Keys {
+			key := px.namedKeys[name]
+			if key == nil {
+				diag.Errorf("routes", "ROUTE_SIGN_KEY_SELECTOR", path+".keys."+value, "no cms.keys entry named %q", name)
+				ok = false
+				continue
+			}
+			s.keys[value] = key
+		}
+
+		// Where the selector value comes from, checked on every matched request type
+		var types, responses []*desc.MessageDescriptor
+		for _, name := range methods {
+			if !route.matches(name) || px.shadowedByBuiltin(*route, name) {
+				continue
+			}
+			if md, found := px.lookupMethod(name); found {
+				types = append(types, md.GetInputType())
+				responses = append(responses, md.GetOutputType())
+			}
+		}
+		switch {
+		case (cfg.Header == "") == (cfg.Field == ""):
+			diag.Errorf("routes", "ROUTE_SIGN_KEY_SELECTOR", path, "needs exactly one of header and field")
+			ok = false
+		case cfg.Header != "":
+			s.header = strings.ToLower(cfg.Header)
+		default:
+			m, err := parseMutation(MutationConfig{Op: "clear", Field: cfg.Field})
+			if err != nil {
+				diag.Errorf("routes", "ROUTE_SIGN_KEY_SELECTOR", path+".field", "%v", err)
+				ok = false
+				break
+			}
+			s.field = &m
+			for _, t := range types {
+				if err := checkVersionField(s.field, t); err != nil {
+					diag.Errorf("routes", "ROUTE_SIGN_KEY_SELECTOR", path+".field", "%q on %s: %v", cfg.Field, t.GetFullyQualifiedName(), err)
+					ok = false
+					break
+				}
+			}
+		}
+
+		if cfg.KeyIDField != "" {
+			switch {
+			case route.PreserveWireBytes:
+				diag.Errorf("routes", "ROUTE_SIGN_KEY_SELECTOR", path+".key_id_field", "preserve_wire_bytes forwards responses as received, without the key id")
+				ok = false
+			case route.Envelope.ProxySigMetadataKey != "":
+				diag.Errorf("routes", "ROUTE_SIGN_KEY_SELECTOR", path+".key_id_field", "proxy_sig_metadata_key leaves the envelope alone; the signature's key id has nowhere to go")
+				ok = false
+			}
+			m, err := parseMutation(MutationConfig{Op: "set_string", Field: cfg.KeyIDField, Direction: "response"})
+			if err != nil {
+				diag.Errorf("routes", "ROUTE_SIGN_KEY_SELECTOR", path+".key_id_field", "%v", err)
+				ok = false
+			} else {
+				s.keyID = &m
+				for _, t := range responses {
+					if _, err := s.keyID.resolve(t); err != nil {
+						diag.Errorf("routes", "ROUTE_SIGN_KEY_SELECTOR", path+".key_id_field", "%q on %s: %v", cfg.KeyIDField, t.GetFullyQualifiedName(), err)
+						ok = false
+						break
+					}
+				}
+			}
+		}
+		if _, dup := px.routeKeySelectors[route.Name]; ok && !dup {
+			px.routeKeySelectors[route.Name] = s
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// --- Lazy Descriptor Materialization ---
+//
+// A monorepo FileDescriptorSet can be tens of megabytes while a proxy only
+// serves a handful of methods, and the fully linked desc graph costs many
+// times the raw size. In lazy mode only the raw bytes of each file are kept,
+// indexed by the symbols they define. A method (or message type) is linked on
+// first use from its file plus transitive dependencies, and dropped again once
+// it has been idle for schema.idle_eviction. The raw bytes are never evicted,
+// so an evicted entry simply rematerializes on its next use.
+
+type rawFile struct {
+	raw  []byte
+	deps []string
+}
+
+type materialized struct {
+	method   *desc.MethodDescriptor
+	message  *desc.MessageDescriptor
+	rawBytes int // raw size of the file closure behind this entry
+	lastUsed time.Time
+}
+
+type lazyDescriptors struct {
+	files    map[string]*rawFile
+	methods  map[string]string // "/pkg.Service/Method" -> defining file
+	messages map[string]string // fully-qualified message name -> defining file
+	rawBytes int
+
+	mu      sync.Mutex
+	entries map[string]*materialized // keyed by method name, or "type:" + message name
+}
+
+// indexDescriptorSet splits a serialized FileDescriptorSet into per-file raw
+// bytes and records which file defines each method and message. Each file is
+// decoded only long enough to read its symbol names.
+func indexDescriptorSet(b []byte) (*lazyDescriptors, error) {
+	l := &lazyDescriptors{
+		files:    make(map[string]*rawFile),
+		methods:  make(map[string]string),
+		messages: make(map[string]string),
+		entries:  make(map[string]*materialized),
+	}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		if num != 1 || typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		raw, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := l.indexFile(raw); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *lazyDescriptors) indexFile(raw []byte) error {
+	fd := &descriptorpb.FileDescriptorProto{}
+	if err := proto.Unmarshal(raw, fd); err != nil {
+		return err
+	}
+	name := fd.GetName()
+	l.files[name] = &rawFile{raw: raw, deps: fd.GetDependency()}
+	l.rawBytes += len(raw)
+
+	prefix := ""
+	if fd.GetPackage() != "" {
+		prefix = fd.GetPackage() + "."
+	}
+	for _, svc := range fd.GetService() {
+		for _, m := range svc.GetMethod() {
+			l.methods[fmt.Sprintf("/%s%s/%s", prefix, svc.GetName(), m.GetName())] = name
+		}
+	}
+	var walk func(scope string, msgs []*descriptorpb.DescriptorProto)
+	walk = func(scope string, msgs []*descriptorpb.DescriptorProto) {
+		for _, msg := range msgs {
+			full := scope + msg.GetName()
+			l.messages[full] = name
+			walk(full+".", msg.GetNestedType())
+		}
+	}
+	walk(prefix, fd.GetMessageType())
+	return nil
+}
+
+// link builds the desc graph for one file and everything it imports
+func (l *lazyDescriptors) link(file string) (*desc.FileDescriptor, int, error) {
+	fds := &descriptorpb.FileDescriptorSet{}
+	seen := make(map[string]bool)
+	size := 0
+	var visit func(name string) error
+	visit = func(name string) error {
+		if seen[name] {
+			return nil
+		}
+		seen[name] = true
+		rf, ok := l.files[name]
+		if !ok {
+			return fmt.Errorf("descriptor set is missing dependency %q", name)
+		}
+		for _, dep := range rf.deps {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		fd := &descriptorpb.FileDescriptorProto{}
+		if err := proto.Unmarshal(rf.raw, fd); err != nil {
+			return err
+		}
+		fds.File = append(fds.File, fd)
+		size += len(rf.raw)
+		return nil
+	}
+	if err := visit(file); err != nil {
+		return nil, 0, err
+	}
+	linked, err := desc.CreateFileDescriptorsFromSet(fds)
+	if err != nil {
+		return nil, 0, err
+	}
+	return linked[file], size, nil
+}
+
+// lookupMethod returns the method descriptor, materializing it if needed
+func (l *lazyDescriptors) lookupMethod(method string) (*desc.MethodDescriptor, bool) {
+	file, ok := l.methods[method]
+	if !ok {
+		return nil, false
+	}
+	e, err := l.materialize(method, file, func(fd *desc.FileDescriptor) (*materialized, error) {
+		parts := strings.Split(strings.TrimPrefix(method, "/"), "/")
+		svc := fd.FindService(parts[0])
+		if svc == nil {
+			return nil, fmt.Errorf("service %s not found in %s", parts[0], file)
+		}
+		md := svc.FindMethodByName(parts[1])
+		if md == nil {
+			return nil, fmt.Errorf("method %s not found in %s", method, file)
+		}
+		return &materialized{method: md}, nil
+	})
+	if err != nil {
+		log.Printf("[Schema] Failed to materialize %s: %v", method, err)
+		return nil, false
+	}
+	return e.method, true
+}
+
+// lookupMessageSuffix mirrors findDescByType: the first indexed message whose
+// fully-qualified name typeNameMatches suffix is materialized and returned
+func (l *lazyDescriptors) lookupMessageSuffix(suffix string) *desc.MessageDescriptor {
+	for name, file := range l.messages {
+		if !typeNameMatches(name, suffix) {
+			continue
+		}
+		e, err := l.materialize("type:"+name, file, func(fd *desc.FileDescriptor) (*materialized, error) {
+			msg := fd.FindMessage(name)
+			if msg == nil {
+				return nil, fmt.Errorf("message %s not found in %s", name, file)
+			}
+			return &materialized{message: msg}, nil
+		})
+		if err != nil {
+			log.Printf("[Schema] Failed to materialize %s: %v", name, err)
+			return nil
+		}
+		return e.message
+	}
+	return nil
+}
+
+// materialize returns the cached entry for key or links its file closure.
+// The lock is held while linking; materialization is rare and this keeps two
+// callers from building the same graph twice.
+func (l *lazyDescriptors) materialize(key, file string, pick func(*desc.FileDescriptor) (*materialized, error)) (*materialized, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.entries[key]; ok {
+		e.lastUsed = time.Now()
+		return e, nil
+	}
+
+	start := time.Now()
+	fd, size, err := l.link(file)
+	if err != nil {
+		return nil, err
+	}
+	e, err := pick(fd)
+	if err != nil {
+		return nil, err
+	}
+	e.rawBytes = size
+	e.lastUsed = time.Now()
+	l.entries[key] = e
+
+	metrics.Inc("proxy_schema_materializations_total", nil)
+	metrics.ObserveDuration("proxy_schema_materialize_seconds", nil, time.Since(start))
+	l.observeLocked()
+	log.Printf("[Schema] Materialized %s from %s (%d bytes raw)", key, file, size)
+	return e, nil
+}
+
+// evictIdle drops entries not used within idle; it returns how many it removed
+func (l *lazyDescriptors) evictIdle(idle time.Duration) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cutoff := time.Now().Add(-idle)
+	n := 0
+	for key, e := range l.entries {
+		if e.lastUsed.Before(cutoff) {
+			delete(l.entries, key)
+			n++
+		}
+	}
+	if n > 0 {
+		metrics.Add("proxy_schema_evictions_total", nil, float64(n))
+		l.observeLocked()
+	}
+	return n
+}
+
+// observeLocked refreshes the occupancy gauges. The memory estimate counts the
+// raw bytes behind each entry (shared imports are counted once per entry); the
+// linked graph is typically several times larger than this.
+func (l *lazyDescriptors) observeLocked() {
+	methods, size := 0, 0
+	for _, e := range l.entries {
+		if e.method != nil {
+			methods++
+		}
+		size += e.rawBytes
+	}
+	metrics.Set("proxy_schema_materialized_methods", nil, float64(methods))
+	metrics.Set("proxy_schema_materialized_entries", nil, float64(len(l.entries)))
+	metrics.Set("proxy_schema_materialized_raw_bytes", nil, float64(size))
+}
+
+func (l *lazyDescriptors) startEviction(idle time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(idle / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			if n := l.evictIdle(idle); n > 0 {
+				log.Printf("[Schema] Evicted %d idle descriptor entries", n)
+			}
+		}
+	}()
+}
+
+func loadLazyPB(path string, diag *Diagnostics) *lazyDescriptors {
+	abs, _ := filepath.Abs(path)
+	b, err := os.ReadFile(abs)
+	if err != nil {
+		diag.Errorf("schema", "SCHEMA_PB_READ", "schema.pb_path", "failed to read pb %s: %v", abs, err)
+		return nil
+	}
+	l, err := indexDescriptorSet(b)
+	if err != nil {
+		diag.Errorf("schema", "SCHEMA_PB_PARSE", "schema.pb_path", "failed to index fds %s: %v", abs, err)
+		return nil
+	}
+	metrics.Set("proxy_schema_raw_bytes", nil, float64(l.rawBytes))
+	metrics.Set("proxy_schema_indexed_methods", nil, float64(len(l.methods)))
+	log.Printf("Indexed %d methods in %d files from %s (lazy)", len(l.methods), len(l.files), path)
+	return l
+}
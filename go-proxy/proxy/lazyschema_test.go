@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jhump/protoreflect/desc/builder"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// syntheticSchema is a descriptor set of n files, each a service lazy.SvcI
+// with one method Call taking a ReqI that holds a message every file imports
+// from common.proto
+func syntheticSchema(tb testing.TB, n int) []byte {
+	tb.Helper()
+	shared := builder.NewMessage("Shared").AddField(builder.NewField("id", builder.FieldTypeString()))
+	common, err := builder.NewFile("common.proto").SetPackageName("lazy").SetProto3(true).AddMessage(shared).Build()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	fds := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{common.AsFileDescriptorProto()}}
+	sharedType := common.FindMessage("lazy.Shared")
+	for i := 0; i < n; i++ {
+		req := builder.NewMessage(fmt.Sprintf("Req%d", i)).
+			AddField(builder.NewField("shared", builder.FieldTypeImportedMessage(sharedType))).
+			AddField(builder.NewField("note", builder.FieldTypeString()))
+		svc := builder.NewService(fmt.Sprintf("Svc%d", i)).
+			AddMethod(builder.NewMethod("Call", builder.RpcTypeMessage(req, false), builder.RpcTypeImportedMessage(sharedType, false)))
+		fd, err := builder.NewFile(fmt.Sprintf("svc%d.proto", i)).SetPackageName("lazy").SetProto3(true).
+			AddMessage(req).AddService(svc).Build()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		fds.File = append(fds.File, fd.AsFileDescriptorProto())
+	}
+	b, err := proto.Marshal(fds)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return b
+}
+
+// TestLazyDescriptorsEviction materializes two methods of a large set, evicts
+// the idle one and looks it up again: only what was looked up is linked, and
+// the rematerialized method is the same as the evicted one
+func TestLazyDescriptorsEviction(t *testing.T) {
+	const files = 200
+	l, err := indexDescriptorSet(syntheticSchema(t, files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.methods) != files || len(l.entries) != 0 {
+		t.Fatalf("indexed %d methods with %d materialized, want %d and none", len(l.methods), len(l.entries), files)
+	}
+
+	const idleMethod, busyMethod = "/lazy.Svc7/Call", "/lazy.Svc123/Call"
+	before, ok := l.lookupMethod(idleMethod)
+	if !ok {
+		t.Fatalf("%s did not materialize", idleMethod)
+	}
+	if _, ok := l.lookupMethod(busyMethod); !ok {
+		t.Fatalf("%s did not materialize", busyMethod)
+	}
+	if _, ok := l.lookupMethod("/lazy.Svc7/Missing"); ok {
+		t.Fatalf("a method the set lacks materialized")
+	}
+	if len(l.entries) != 2 {
+		t.Fatalf("%d entries materialized, want only the 2 looked up", len(l.entries))
+	}
+
+	l.mu.Lock()
+	l.entries[idleMethod].lastUsed = time.Now().Add(-time.Hour)
+	l.mu.Unlock()
+	if n := l.evictIdle(time.Minute); n != 1 {
+		t.Fatalf("evicted %d entries, want the idle one", n)
+	}
+	if _, ok := l.entries[busyMethod]; !ok {
+		t.Fatalf("the recently used entry was evicted")
+	}
+
+	materialized := counterValue("proxy_schema_materializations_total", nil)
+	after, ok := l.lookupMethod(idleMethod)
+	if !ok {
+		t.Fatalf("%s did not rematerialize after eviction", idleMethod)
+	}
+	if got := counterValue("proxy_schema_materializations_total", nil) - materialized; got != 1 {
+		t.Errorf("rematerializing counted %v materializations, want 1", got)
+	}
+	if after == before {
+		t.Errorf("the evicted descriptor was returned instead of a relinked one")
+	}
+	if !proto.Equal(after.AsMethodDescriptorProto(), before.AsMethodDescriptorProto()) ||
+		!proto.Equal(after.GetInputType().AsDescriptorProto(), before.GetInputType().AsDescriptorProto()) {
+		t.Errorf("rematerialized %s differs from the evicted one", idleMethod)
+	}
+	if f := after.GetInputType().FindFieldByName("shared"); f == nil || f.GetMessageType().GetFullyQualifiedName() != "lazy.Shared" {
+		t.Errorf("rematerialized %s lost its import of lazy.Shared", idleMethod)
+	}
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// LimitsConfig protects the backend from a single route being overrun. The
+// state behind it is per route and shared by every connection.
+type LimitsConfig struct {
+	// Token bucket refill rate. A unary call takes one token when it arrives;
+	// streaming calls take one per client-to-server message.
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	// Bucket size; defaults to one second worth of tokens (at least 1)
+	Burst int `yaml:"burst"`
+	// Cap on concurrently open streaming calls; unary calls are not counted
+	MaxConcurrentStreams int `yaml:"max_concurrent_streams"`
+
+	// Per-stream guards, counted separately for every streaming call. A stream
+	// that goes over one ends with RESOURCE_EXHAUSTED and an
+	// x-proxy-stream-limit trailer naming it.
+	MaxMessagesPerStream int64  `yaml:"max_messages_per_stream"` // in either direction
+	MaxTotalBytes        int64  `yaml:"max_total_bytes"`         // both directions together
+	MaxStreamDuration    string `yaml:"max_stream_duration"`     // e.g. "10m"
+
+	// Slow consumers: a streaming call whose client stops reading ends with
+	// UNAVAILABLE once one response has waited longer than
+	// SlowConsumerTimeout to be sent, or more than MaxUnsentResponses
+	// responses from the backend are waiting; see slowconsumer.go
+	SlowConsumerTimeout string `yaml:"slow_consumer_timeout"` // e.g. "5s"
+	MaxUnsentResponses  int64  `yaml:"max_unsent_responses"`
+}
+
+type routeLimiter struct {
+	route  string
+	labels Labels
+
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time // time.Now; tests swap in a fake clock
+
+	maxStreams int
+	streams    int
+}
+
+func newRouteLimiter(route string, cfg LimitsConfig) *routeLimiter {
+	l := &routeLimiter{
+		route:      route,
+		labels:     Labels{"route": route},
+		rate:       cfg.RequestsPerSecond,
+		burst:      float64(cfg.Burst),
+		maxStreams: cfg.MaxConcurrentStreams,
+		now:        time.Now,
+	}
+	l.last = l.now()
+	if l.burst <= 0 {
+		l.burst = math.Max(1, math.Ceil(l.rate))
+	}
+	l.tokens = l.burst
+	return l
+}
+
+// limiterFor returns the shared limiter for a route, or nil if it has no limits
+func (px *Proxy) limiterFor(route *RouteConfig) *routeLimiter {
+	return px.routeLimiters[route.Name]
+}
+
+// allow takes one token from the bucket, refilling for the time since the last call
+func (l *routeLimiter) allow() error {
+	if l == nil || l.rate <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := l.now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	ok := l.tokens >= 1
+	if ok {
+		l.tokens--
+	}
+	l.mu.Unlock()
+
+	if !ok {
+		metrics.Inc("proxy_route_limited_total", Labels{"route": l.route, "reason": "rate"})
+		return rejectf(codes.ResourceExhausted, reasonRateLimited, "proxy: rate limit exceeded for route %q", l.route)
+	}
+	metrics.Inc("proxy_route_admitted_total", l.labels)
+	return nil
+}
+
+// openStream reserves a concurrent stream slot; the returned func releases it
+func (l *routeLimiter) openStream() (func(), error) {
+	if l == nil || l.maxStreams <= 0 {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	if l.streams >= l.maxStreams {
+		l.mu.Unlock()
+		metrics.Inc("proxy_route_limited_total", Labels{"route": l.route, "reason": "streams"})
+		return nil, rejectf(codes.ResourceExhausted, reasonConcurrencyLimited, "proxy: too many concurrent streams for route %q (max %d)", l.route, l.maxStreams)
+	}
+	l.streams++
+	l.mu.Unlock()
+	metrics.AddGauge("proxy_route_active_streams", l.labels, 1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			l.streams--
+			l.mu.Unlock()
+			metrics.AddGauge("proxy_route_active_streams", l.labels, -1)
+		})
+	}, nil
+}
+
+// loadRouteLimits validates each route's limits block and builds its shared limiter
+func (px *Proxy) loadRouteLimits(diag *Diagnostics) {
+	for i, route := range px.cfg.Routes {
+		lim := route.Limits
+		path := fmt.Sprintf("routes[%d].limits", i)
+
+		if lim.RequestsPerSecond < 0 || lim.Burst < 0 || lim.MaxConcurrentStreams < 0 {
+			diag.Errorf("routes", "ROUTE_LIMITS_NEGATIVE", path, "limits for %q must not be negative", route.Match)
+			continue
+		}
+		if lim.RequestsPerSecond == 0 && lim.MaxConcurrentStreams == 0 {
+			if lim.Burst > 0 {
+				diag.Warnf("routes", "ROUTE_LIMITS_BURST", path+".burst", "burst for %q has no effect without requests_per_second", route.Match)
+			}
+			continue
+		}
+		px.routeLimiters[route.Name] = newRouteLimiter(route.Name, lim)
+	}
+}
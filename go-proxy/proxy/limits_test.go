@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestRouteLimiterRefill drains a route's token bucket on a fake clock and
+// checks that calls are turned away at the threshold and admitted again as
+// the bucket refills, never past its burst
+func TestRouteLimiterRefill(t *testing.T) {
+	clock := time.Unix(1700000000, 0)
+	l := newRouteLimiter("limited", LimitsConfig{RequestsPerSecond: 2, Burst: 3})
+	l.now = func() time.Time { return clock }
+	l.last = clock
+
+	admit := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if err := l.allow(); err != nil {
+				t.Fatalf("call %d of %d at %v: %v", i+1, n, clock, err)
+			}
+		}
+	}
+	refuse := func() {
+		t.Helper()
+		err := l.allow()
+		var r *rejection
+		if status.Code(err) != codes.ResourceExhausted || !errors.As(err, &r) || r.reason != reasonRateLimited {
+			t.Fatalf("call past the threshold at %v: %v, want %s", clock, err, reasonRateLimited)
+		}
+	}
+
+	admit(3) // the full burst
+	refuse()
+
+	clock = clock.Add(499 * time.Millisecond)
+	refuse() // just short of one token at 2/s
+	clock = clock.Add(time.Millisecond)
+	admit(1)
+	refuse()
+
+	clock = clock.Add(time.Minute)
+	admit(3) // refilled to the burst and no further
+	refuse()
+}
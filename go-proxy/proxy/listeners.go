@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+const unixScheme = "unix://"
+
+// ListenerConfig is one address the proxy accepts gRPC connections on. Each
+// listener has its own TLS settings; every other server setting, and
+// trusted_upstreams, is shared.
+type ListenerConfig struct {
+	Address string     `yaml:"address"` // host:port, or unix:///path/to/proxy.sock
+	TLS     *TLSConfig `yaml:"tls"`
+	// SocketMode sets the permissions of a unix socket file (octal, e.g.
+	// "0660"); empty leaves them to the umask
+	SocketMode string `yaml:"socket_mode"`
+}
+
+// listener is a resolved ListenerConfig with the gRPC server that serves it
+type listener struct {
+	network string // tcp or unix
+	addr    string // host:port, or the socket path
+	tls     *tls.Config
+	mode    fs.FileMode // 0 leaves the socket file as created
+	server  *grpc.Server
+}
+
+// listenerConfigs is server.listeners, or the single listener described by
+// server.listen_address and server.tls
+func (s ServerConfig) listenerConfigs() []ListenerConfig {
+	if len(s.Listeners) > 0 {
+		return s.Listeners
+	}
+	return []ListenerConfig{{Address: s.ListenAddress, TLS: s.TLS}}
+}
+
+// parseListenAddress splits a listener address into its network and address
+func parseListenAddress(addr string) (network, address string, err error) {
+	if path, ok := strings.CutPrefix(addr, unixScheme); ok {
+		if path == "" {
+			return "", "", fmt.Errorf("unix listener needs a socket path, e.g. unix:///var/run/proxy.sock")
+		}
+		return "unix", path, nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", "", fmt.Errorf("invalid listen address %q: %v", addr, err)
+	}
+	return "tcp", addr, nil
+}
+
+// loadListenerSecurity resolves the listeners, builds their TLS configs and
+// the trusted upstream CIDR allowlist. The allowlist and SAN checks apply to
+// TCP listeners; a unix socket is guarded by its file permissions instead.
+func (px *Proxy) loadListenerSecurity(diag *Diagnostics) {
+	server := px.cfg.Server
+	upstreams := server.TrustedUpstreams
+	configs := server.listenerConfigs()
+	legacy := len(server.Listeners) == 0
+	if !legacy && (server.ListenAddress != "" || server.TLS != nil) {
+		diag.Errorf("tls", "LISTENER_CONFIG", "server.listeners", "server.listen_address and server.tls cannot be combined with server.listeners")
+	}
+
+	seen := make(map[string]bool)
+	for i, lc := range configs {
+		path := fmt.Sprintf("server.listeners[%d]", i)
+		tlsPath := path + ".tls"
+		if legacy {
+			path, tlsPath = "server.listen_address", "server.tls"
+		}
+		l := &listener{network: "tcp"}
+		var err error
+		// An empty listen_address is fine for embedders that only call Serve
+		if !legacy || lc.Address != "" {
+			if l.network, l.addr, err = parseListenAddress(lc.Address); err != nil {
+				diag.Errorf("tls", "LISTENER_ADDRESS", path, "%v", err)
+				continue
+			}
+		}
+		if seen[lc.Address] {
+			diag.Errorf("tls", "LISTENER_ADDRESS", path, "%s is listed twice", lc.Address)
+			continue
+		}
+		seen[lc.Address] = true
+
+		if lc.SocketMode != "" {
+			mode, err := strconv.ParseUint(lc.SocketMode, 8, 32)
+			switch {
+			case l.network != "unix":
+				diag.Warnf("tls", "LISTENER_SOCKET_MODE", path+".socket_mode", "socket_mode only applies to unix listeners")
+			case err != nil || mode == 0 || mode > 0o777:
+				diag.Errorf("tls", "LISTENER_SOCKET_MODE", path+".socket_mode", "invalid socket_mode %q (want octal permissions, e.g. \"0660\")", lc.SocketMode)
+			default:
+				l.mode = fs.FileMode(mode)
+			}
+		}
+
+		checkUpstreams := upstreams
+		if l.network == "unix" {
+			checkUpstreams = TrustedUpstreamsConfig{}
+		}
+		if lc.TLS != nil {
+			l.tls, err = serverTLSConfig(*lc.TLS, checkUpstreams)
+			if err != nil {
+				diag.Errorf("tls", "LISTENER_TLS", tlsPath, "failed to configure listener TLS: %v", err)
+			} else {
+				px.loadTicketKeyRotation(l.tls, *lc.TLS, tlsPath, diag)
+			}
+		} else if len(checkUpstreams.SANs) > 0 {
+			diag.Errorf("tls", "TRUSTED_UPSTREAMS_TLS", "server.trusted_upstreams.sans", "trusted_upstreams.sans requires %s", tlsPath)
+		}
+		px.listeners = append(px.listeners, l)
+		if px.listenerTLS == nil && l.network == "tcp" {
+			px.listenerTLS = l.tls
+		}
+	}
+
+	nets := make([]*net.IPNet, 0, len(upstreams.CIDRs))
+	for i, c := range upstreams.CIDRs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			diag.Errorf("tls", "TRUSTED_UPSTREAMS_CIDR", fmt.Sprintf("server.trusted_upstreams.cidrs[%d]", i), "invalid cidr %q: %v", c, err)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	px.upstreamNets = nets
+}
+
+// newServers builds one gRPC server per listener, all proxying through
+// transparentHandler behind the security checks
+func (px *Proxy) newServers() {
+	for _, l := range px.listeners {
+		serverOpts := []grpc.ServerOption{
+			grpc.ForceServerCodecV2(bytesCodec{}),
+			grpc.UnknownServiceHandler(px.transparentHandler),
+		}
+		if l.tls != nil {
+			serverOpts = append(serverOpts, grpc.Creds(newHandshakeMetricsCreds(l.tls)))
+		}
+		serverOpts = append(serverOpts, px.serverKeepalive...)
+		if px.perimeterOn {
+			serverOpts = append(serverOpts, grpc.StreamInterceptor(px.perimeterInterceptor))
+		}
+		if px.cfg.Logging.PeerInfo {
+			serverOpts = append(serverOpts, grpc.StatsHandler(peerStats{}))
+		}
+		l.server = grpc.NewServer(serverOpts...)
+	}
+	px.server = px.listeners[0].server
+}
+
+// ListenAndServe opens every configured listener and serves them until
+// Shutdown. It returns the first error from opening or serving any of them.
+func (px *Proxy) ListenAndServe() error {
+	if err := px.start(); err != nil {
+		return err
+	}
+	var opened []net.Listener
+	for _, l := range px.listeners {
+		lis, err := l.listen()
+		if err != nil {
+			for _, o := range opened {
+				o.Close()
+			}
+			return err
+		}
+		opened = append(opened, lis)
+	}
+
+	errs := make(chan error, len(px.listeners))
+	for i, l := range px.listeners {
+		go func(l *listener, lis net.Listener) {
+			errs <- px.serveOn(l, lis)
+		}(l, opened[i])
+	}
+	var first error
+	for range px.listeners {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+			px.stopServers()
+		}
+	}
+	return first
+}
+
+// listen opens the listener's socket. A unix socket file left behind by a
+// proxy that is no longer running is removed first; one that still accepts
+// connections, or a path that is not a socket, is an error.
+func (l *listener) listen() (net.Listener, error) {
+	if l.network == "unix" {
+		if err := removeStaleSocket(l.addr); err != nil {
+			return nil, err
+		}
+	}
+	lis, err := net.Listen(l.network, l.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed listening on %s: %w", l.addr, err)
+	}
+	if l.mode != 0 {
+		if err := os.Chmod(l.addr, l.mode); err != nil {
+			lis.Close()
+			return nil, fmt.Errorf("set permissions on %s: %w", l.addr, err)
+		}
+	}
+	return lis, nil
+}
+
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	log.Printf("[Proxy] Removing stale socket %s", path)
+	return os.Remove(path)
+}
+
+// serveOn serves lis with the listener's server, restricting TCP peers to
+// trusted_upstreams.cidrs when it is set
+func (px *Proxy) serveOn(l *listener, lis net.Listener) error {
+	if len(px.upstreamNets) > 0 && lis.Addr().Network() == "tcp" {
+		lis = &cidrListener{Listener: lis, nets: px.upstreamNets}
+	}
+	log.Printf("Proxy listening on %s", lis.Addr().String())
+	return l.server.Serve(lis)
+}
+
+// stopServers closes every listener and ends the calls still open on them
+func (px *Proxy) stopServers() {
+	for _, l := range px.listeners {
+		l.server.Stop()
+	}
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anthony/grpc-proxy/api/echo"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// TestUnixSockets serves a proxy on a unix socket in front of a backend on
+// another, both in the test's directory. A call through it reaches the
+// backend, the socket gets its socket_mode, and Shutdown removes it.
+func TestUnixSockets(t *testing.T) {
+	dir := t.TempDir()
+	proxySock, backendSock := filepath.Join(dir, "proxy.sock"), filepath.Join(dir, "backend.sock")
+
+	backendLis, err := net.Listen("unix", backendSock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backendSrv := grpc.NewServer()
+	echo.RegisterEchoServiceServer(backendSrv, benchBackend{})
+	go backendSrv.Serve(backendLis)
+	defer backendSrv.Stop()
+
+	px := newTestProxy(t, []RouteConfig{{Name: "echo", Match: "/echo.EchoService/*", Mode: "pass-thru"}}, func(cfg *Config) {
+		cfg.Backend.Address = unixScheme + backendSock
+		cfg.Server.Listeners = []ListenerConfig{{Address: unixScheme + proxySock, SocketMode: "0600"}}
+	})
+	served := make(chan error, 1)
+	go func() { served <- px.ListenAndServe() }()
+
+	conn, err := grpc.NewClient(unixScheme+proxySock, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// The listener may still be opening
+	resp, err := echo.NewEchoServiceClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: "over a socket"}, grpc.WaitForReady(true))
+	if err != nil {
+		t.Fatalf("call over %s: %v", proxySock, err)
+	}
+	if resp.Message != "over a socket" {
+		t.Errorf("response %q, want the backend's echo", resp.Message)
+	}
+
+	fi, err := os.Stat(proxySock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&fs.ModeSocket == 0 || fi.Mode().Perm() != 0o600 {
+		t.Errorf("%s has mode %v, want a socket with 0600", proxySock, fi.Mode())
+	}
+
+	conn.Close()
+	if err := px.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("ListenAndServe: %v", err)
+	}
+	if _, err := os.Stat(proxySock); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("%s is left after Shutdown: %v", proxySock, err)
+	}
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// --- Load Shedding ---
+//
+// A proxy that accepts more calls than it can decode, verify and sign only
+// gets slower for all of them until every call misses its deadline. With
+// load_shedding enabled the proxy watches two signs of pressure:
+//
+//	latency  a moving average of how long processMsg takes per message,
+//	         cpu class queueing included; it forgets over window, and decays
+//	         while no message is processed
+//	pending  the messages inside processMsg right now, queued or running
+//
+// When either goes over its limit (max_latency, max_pending) the proxy starts
+// shedding: new calls on routes that process messages fail at once with
+// RESOURCE_EXHAUSTED and reason LOAD_SHED, while calls already running carry
+// on. Pass-thru and local-reply routes are never shed, nor are shadow routes,
+// which never reject. Shedding stops only once both have fallen below
+// recover_at times their limits, so a proxy hovering at a limit does not
+// flap. Each shed call is counted in proxy_load_shed_total by route and
+// trigger (the limit that started shedding); proxy_load_shedding is 1 while
+// shedding, and every start and stop is logged. Disabled, the default,
+// nothing is measured, which is the baseline for benchmarks.
+
+// LoadSheddingConfig sheds new calls while message processing is overloaded
+type LoadSheddingConfig struct {
+	Enabled    bool    `yaml:"enabled"`
+	MaxLatency string  `yaml:"max_latency"` // average per message, e.g. "100ms"; default 250ms
+	MaxPending int     `yaml:"max_pending"` // messages being processed or queued; default 1024
+	RecoverAt  float64 `yaml:"recover_at"`  // fraction of both limits to stop below; default 0.8
+	Window     string  `yaml:"window"`      // how long the average remembers; default 5s
+}
+
+const (
+	defaultShedMaxLatency = 250 * time.Millisecond
+	defaultShedMaxPending = 1024
+	defaultShedRecoverAt  = 0.8
+	defaultShedWindow     = 5 * time.Second
+
+	// shedSampleWeight is the weight of one message's latency in the average
+	shedSampleWeight = 0.1
+)
+
+// loadShedder tracks processing pressure and decides whether to shed
+type loadShedder struct {
+	maxLatency time.Duration
+	maxPending int64
+	recoverAt  float64
+	window     time.Duration
+
+	pending atomic.Int64
+
+	mu       sync.Mutex
+	avg      float64   // seconds, as of last
+	last     time.Time // of the last sample
+	shedding bool
+	trigger  string // latency or pending, while shedding
+}
+
+// latencyLocked is the average, decayed for the time since the last sample
+func (s *loadShedder) latencyLocked(now time.Time) float64 {
+	if s.last.IsZero() {
+		return 0
+	}
+	return s.avg * math.Exp(-now.Sub(s.last).Seconds()/s.window.Seconds())
+}
+
+// track counts a message as pending; the returned func records how long it
+// took. A nil shedder measures nothing.
+func (s *loadShedder) track() func() {
+	if s == nil {
+		return func() {}
+	}
+	s.pending.Add(1)
+	metrics.AddGauge("proxy_load_pending_messages", nil, 1)
+	start := time.Now()
+	return func() {
+		s.pending.Add(-1)
+		metrics.AddGauge("proxy_load_pending_messages", nil, -1)
+		now := time.Now()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.avg = s.latencyLocked(now)*(1-shedSampleWeight) + now.Sub(start).Seconds()*shedSampleWeight
+		s.last = now
+		metrics.Set("proxy_load_average_process_seconds", nil, s.avg)
+		s.updateLocked(now)
+	}
+}
+
+// updateLocked starts or stops shedding as the pressure calls for
+func (s *loadShedder) updateLocked(now time.Time) {
+	latency, pending := s.latencyLocked(now), s.pending.Load()
+	limit := s.maxLatency.Seconds()
+	if !s.shedding {
+		switch {
+		case latency > limit:
+			s.trigger = "latency"
+		case pending > s.maxPending:
+			s.trigger = "pending"
+		default:
+			return
+		}
+		s.shedding = true
+		metrics.Set("proxy_load_shedding", nil, 1)
+		log.Printf("[Load Shedding] Started (%s): average processing %s over %s, %d messages pending of %d", s.trigger, seconds(latency), s.maxLatency, pending, s.maxPending)
+		return
+	}
+	if latency < limit*s.recoverAt && float64(pending) < float64(s.maxPending)*s.recoverAt {
+		s.shedding = false
+		metrics.Set("proxy_load_shedding", nil, 0)
+		log.Printf("[Load Shedding] Stopped: average processing %s, %d messages pending", seconds(latency), pending)
+	}
+}
+
+// admit rejects a new call on route while the proxy is shedding
+func (s *loadShedder) admit(route *RouteConfig) error {
+	if s == nil || route.Mode == "pass-thru" || route.Mode == "local-reply" || route.Shadow {
+		return nil
+	}
+	s.mu.Lock()
+	s.updateLocked(time.Now())
+	shedding, trigger := s.shedding, s.trigger
+	s.mu.Unlock()
+	if !shedding {
+		return nil
+	}
+	metrics.Inc("proxy_load_shed_total", Labels{"route": route.Name, "trigger": trigger})
+	return rejectf(codes.ResourceExhausted, reasonLoadShed, "proxy: overloaded (%s); try again later", trigger).with("trigger", trigger)
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second)).Round(time.Microsecond)
+}
+
+// loadLoadShedding builds the shedder when load_shedding is enabled
+func (px *Proxy) loadLoadShedding(diag *Diagnostics) {
+	cfg := px.cfg.LoadShedding
+	if !cfg.Enabled {
+		return
+	}
+	s := &loadShedder{
+		maxLatency: defaultShedMaxLatency,
+		maxPending: defaultShedMaxPending,
+		recoverAt:  defaultShedRecoverAt,
+		window:     defaultShedWindow,
+	}
+	valid := true
+	for _, d := range []struct {
+		key, value string
+		into       *time.Duration
+	}{{"max_latency", cfg.MaxLatency, &s.maxLatency}, {"window", cfg.Window, &s.window}} {
+		if d.value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(d.value)
+		if err != nil || parsed <= 0 {
+			diag.Errorf("load_shedding", "LOAD_SHEDDING", "load_shedding."+d.key, "invalid duration %q", d.value)
+			valid = false
+		}
+		*d.into = parsed
+	}
+	switch {
+	case cfg.MaxPending < 0:
+		diag.Errorf("load_shedding", "LOAD_SHEDDING", "load_shedding.max_pending", "must not be negative, got %d", cfg.MaxPending)
+		valid = false
+	case cfg.MaxPending > 0:
+		s.maxPending = int64(cfg.MaxPending)
+	}
+	switch {
+	case cfg.RecoverAt < 0 || cfg.RecoverAt >= 1:
+		diag.Errorf("load_shedding", "LOAD_SHEDDING", "load_shedding.recover_at", "must be between 0 and 1, got %g", cfg.RecoverAt)
+		valid = false
+	case cfg.RecoverAt > 0:
+		s.recoverAt = cfg.RecoverAt
+	}
+	if !valid {
+		return
+	}
+	px.shedder = s
+	metrics.Set("proxy_load_shedding", nil, 0)
+	log.Printf("[Load Shedding] Enabled: shedding over %s average processing or %d pending messages, until both are below %g of that", s.maxLatency, s.maxPending, s.recoverAt)
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// LocalReplyConfig is the answer a local-reply route gives without involving
+// the backend: a non-OK status, or code OK with a static response message.
+type LocalReplyConfig struct {
+	Code     string `yaml:"code"`     // e.g. "UNIMPLEMENTED", "UNAVAILABLE"; defaults to OK when response is set
+	Message  string `yaml:"message"`  // status message, e.g. a migration hint
+	Response string `yaml:"response"` // JSON for the method's output type; requires code OK
+}
+
+// localReply is a LocalReplyConfig parsed at startup. Responses are encoded
+// against the output type of every loaded method the route matches.
+type localReply struct {
+	status    *status.Status
+	responses map[string][]byte // by full method name
+}
+
+// serveLocalReply answers the call from the route's config. It waits for the
+// first client message (or half-close) so streaming clients see the status
+// in place of their first response.
+func (px *Proxy) serveLocalReply(method string, route *RouteConfig, serverStream grpc.ServerStream) error {
+	r := px.routeLocalReplies[route.Name]
+	if r == nil {
+		return rejectf(codes.Internal, reasonLocalReply, "proxy: route has no local reply")
+	}
+	var req []byte
+	if err := serverStream.RecvMsg(&req); err != nil && err != io.EOF {
+		return err
+	}
+	metrics.Inc("proxy_local_replies_total", Labels{"route": route.Name, "code": r.status.Code().String()})
+	if r.status.Code() != codes.OK {
+		return r.status.Err()
+	}
+	resp, ok := r.responses[method]
+	if !ok {
+		return rejectf(codes.Internal, reasonLocalReply, "proxy: no local reply response encoded for %s", method)
+	}
+	return serverStream.SendMsg(&resp)
+}
+
+// loadLocalReplies parses local_reply for every local-reply route and encodes
+// its response up front, so a config that does not fit the schema fails
+// startup rather than the first call
+func (px *Proxy) loadLocalReplies(diag *Diagnostics) {
+	methods := px.knownMethods()
+	for i, route := range px.cfg.Routes {
+		path := fmt.Sprintf("routes[%d].local_reply", i)
+		if route.Mode != "local-reply" {
+			if route.LocalReply != nil {
+				diag.Warnf("routes", "ROUTE_LOCAL_REPLY", path, "local_reply is ignored unless mode is local-reply")
+			}
+			continue
+		}
+		cfg := route.LocalReply
+		if cfg == nil {
+			diag.Errorf("routes", "ROUTE_LOCAL_REPLY", path, "mode local-reply needs a local_reply block")
+			continue
+		}
+
+		code := codes.OK
+		if cfg.Code != "" {
+			c, err := parseStatusCode(cfg.Code)
+			if err != nil {
+				diag.Errorf("routes", "ROUTE_LOCAL_REPLY", path+".code", "%v", err)
+				continue
+			}
+			code = c
+		}
+		if code != codes.OK && cfg.Response != "" {
+			diag.Errorf("routes", "ROUTE_LOCAL_REPLY", path+".response", "a response is only sent with code OK, not %s", code)
+			continue
+		}
+		if code == codes.OK && cfg.Response == "" {
+			diag.Errorf("routes", "ROUTE_LOCAL_REPLY", path, "code OK needs a response message")
+			continue
+		}
+
+		r := &localReply{status: status.New(code, cfg.Message), responses: map[string][]byte{}}
+		valid := true
+		if cfg.Response != "" {
+			for _, name := range methods {
+				if !route.matches(name) {
+					continue
+				}
+				md, ok := px.lookupMethod(name)
+				if !ok {
+					continue
+				}
+				msg := dynamic.NewMessage(md.GetOutputType())
+				if err := msg.UnmarshalJSON([]byte(cfg.Response)); err != nil {
+					diag.Errorf("routes", "ROUTE_LOCAL_REPLY", path+".response", "not a valid %s for %s: %v", md.GetOutputType().GetFullyQualifiedName(), name, err)
+					valid = false
+					break
+				}
+				b, err := marshalDynamic(msg)
+				if err != nil {
+					diag.Errorf("routes", "ROUTE_LOCAL_REPLY", path+".response", "encode for %s: %v", name, err)
+					valid = false
+					break
+				}
+				r.responses[name] = b
+			}
+			if valid && len(r.responses) == 0 {
+				diag.Warnf("routes", "ROUTE_LOCAL_REPLY", fmt.Sprintf("routes[%d].match", i), "no loaded method matches %s; calls to it will fail with INTERNAL", route.Match)
+			}
+		}
+		if _, dup := px.routeLocalReplies[route.Name]; valid && !dup {
+			px.routeLocalReplies[route.Name] = r
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// MetadataRules rewrite gRPC metadata as it passes through the proxy. They run
+// in the order remove, rename, add. Keys are case-insensitive, as on the wire.
+type MetadataRules struct {
+	Remove []string          `yaml:"remove"`
+	Rename map[string]string `yaml:"rename"` // old key -> new key; all values move
+	Add    []MetadataEntry   `yaml:"add"`    // repeated keys produce multi-valued metadata
+}
+
+// MetadataEntry is one value to append. Value may reference ${client_cn},
+// ${client_identity}, ${request_id} or ${method}.
+type MetadataEntry struct {
+	Key   string `yaml:"key"`
+	Value string `yaml:"value"`
+}
+
+var templateVar = regexp.MustCompile(`\$\{([a-z_]+)\}`)
+
+var templateVars = map[string]bool{
+	"client_cn":       true,
+	"client_identity": true,
+	"request_id":      true,
+	"method":          true,
+}
+
+// metadataContext supplies template values for one call. The request id is
+// generated on first use so calls that never reference it pay nothing; the
+// request and response directions may expand templates concurrently.
+type metadataContext struct {
+	ctx      context.Context
+	method   string
+	identity string
+
+	idOnce    sync.Once
+	requestID string
+}
+
+func (c *metadataContext) lookup(name string) string {
+	switch name {
+	case "client_cn":
+		return peerCommonName(c.ctx)
+	case "client_identity":
+		return c.identity
+	case "method":
+		return c.method
+	case "request_id":
+		c.idOnce.Do(func() { c.requestID = newRequestID() })
+		return c.requestID
+	}
+	return ""
+}
+
+func (c *metadataContext) expand(value string) string {
+	return templateVar.ReplaceAllStringFunc(value, func(m string) string {
+		return c.lookup(templateVar.FindStringSubmatch(m)[1])
+	})
+}
+
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// peerCommonName is the subject CN of the verified client certificate
+func peerCommonName(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.AuthInfo == nil {
+		return ""
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 {
+		return ""
+	}
+	return info.State.VerifiedChains[0][0].Subject.CommonName
+}
+
+// apply rewrites md in place
+func (r *MetadataRules) apply(md metadata.MD, tc *metadataContext) {
+	for _, k := range r.Remove {
+		delete(md, strings.ToLower(k))
+	}
+	for from, to := range r.Rename {
+		from, to = strings.ToLower(from), strings.ToLower(to)
+		if vals, ok := md[from]; ok {
+			delete(md, from)
+			md[to] = append(md[to], vals...)
+		}
+	}
+	for _, e := range r.Add {
+		md.Append(e.Key, tc.expand(e.Value))
+	}
+}
+
+// validateMetadataRules rejects rules that would touch reserved keys or use
+// unknown template variables
+func validateMetadataRules(r MetadataRules, path string, diag *Diagnostics) {
+	check := func(field, key string) {
+		k := strings.ToLower(key)
+		switch {
+		case k == "":
+			diag.Errorf("routes", "ROUTE_METADATA", path+"."+field, "empty metadata key")
+		case strings.HasPrefix(k, ":") || strings.HasPrefix(k, "grpc-"):
+			diag.Errorf("routes", "ROUTE_METADATA", path+"."+field, "metadata key %q is reserved by gRPC", key)
+		}
+	}
+	for _, k := range r.Remove {
+		check("remove", k)
+	}
+	for from, to := range r.Rename {
+		check("rename", from)
+		check("rename", to)
+	}
+	for i, e := range r.Add {
+		check(fmt.Sprintf("add[%d].key", i), e.Key)
+		for _, m := range templateVar.FindAllStringSubmatch(e.Value, -1) {
+			if !templateVars[m[1]] {
+				diag.Errorf("routes", "ROUTE_METADATA", fmt.Sprintf("%s.add[%d].value", path, i), "unknown template variable ${%s}", m[1])
+			}
+		}
+	}
+}
+
+func (px *Proxy) loadMetadataRules(diag *Diagnostics) {
+	for i, route := range px.cfg.Routes {
+		validateMetadataRules(route.Metadata, fmt.Sprintf("routes[%d].metadata", i), diag)
+		validateMetadataRules(route.ResponseMetadata, fmt.Sprintf("routes[%d].response_metadata", i), diag)
+	}
+}
+
+// responseHeaderStream forwards the backend's response headers (rewritten by
+// response_metadata) to the client just before the first response message.
+type responseHeaderStream struct {
+	grpc.ServerStream
+	backend grpc.ClientStream
+	rules   *MetadataRules
+	tc      *metadataContext
+	copied  *copiedHeaders // envelope metadata bound for the headers, if any
+	sent    bool
+}
+
+func (s *responseHeaderStream) SendMsg(m interface{}) error {
+	if !s.sent {
+		s.sent = true
+		if hdr, err := s.backend.Header(); err == nil {
+			hdr = hdr.Copy()
+			s.rules.apply(hdr, s.tc)
+			s.copied.mergeInto(hdr)
+			if err := s.ServerStream.SendHeader(hdr); err != nil {
+				return err
+			}
+		}
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+// forwardTrailer copies the backend's trailer to the client once the call
+// ends, with any envelope metadata that came too late for the headers
+func forwardTrailer(serverStream grpc.ServerStream, backend grpc.ClientStream, rules *MetadataRules, tc *metadataContext, copied *copiedHeaders) {
+	trailer := backend.Trailer().Copy()
+	rules.apply(trailer, tc)
+	copied.mergeInto(trailer)
+	serverStream.SetTrailer(trailer)
+}
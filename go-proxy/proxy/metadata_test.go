@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// TestMetadataRules applies metadata rules written in any case to
+// multi-valued metadata, which must match keys case-insensitively and move or
+// drop every value of a key, not just the first
+func TestMetadataRules(t *testing.T) {
+	const method = "/echo.EchoService/UnaryEcho"
+	for _, tc := range []struct {
+		name  string
+		rules MetadataRules
+		in    metadata.MD
+		want  metadata.MD
+	}{
+		{
+			name:  "remove drops every value",
+			rules: MetadataRules{Remove: []string{"X-Secret"}},
+			in:    metadata.Pairs("x-secret", "a", "X-SECRET", "b", "keep", "1"),
+			want:  metadata.Pairs("keep", "1"),
+		},
+		{
+			name:  "rename moves every value in order",
+			rules: MetadataRules{Rename: map[string]string{"X-Old": "X-New"}},
+			in:    metadata.Pairs("x-old", "1", "x-old", "2"),
+			want:  metadata.Pairs("x-new", "1", "x-new", "2"),
+		},
+		{
+			name:  "rename appends to values the new key has",
+			rules: MetadataRules{Rename: map[string]string{"x-old": "X-NEW"}},
+			in:    metadata.Pairs("X-New", "0", "X-Old", "1", "x-old", "2"),
+			want:  metadata.Pairs("x-new", "0", "x-new", "1", "x-new", "2"),
+		},
+		{
+			name:  "rename of a missing key changes nothing",
+			rules: MetadataRules{Rename: map[string]string{"X-Absent": "x-new"}},
+			in:    metadata.Pairs("x-new", "0"),
+			want:  metadata.Pairs("x-new", "0"),
+		},
+		{
+			name: "repeated adds make one multi-valued key",
+			rules: MetadataRules{Add: []MetadataEntry{
+				{Key: "X-Via", Value: "proxy"},
+				{Key: "x-via", Value: "${method}"},
+			}},
+			in:   metadata.Pairs("X-VIA", "client"),
+			want: metadata.Pairs("x-via", "client", "x-via", "proxy", "x-via", method),
+		},
+		{
+			name: "remove, rename, add run in that order",
+			rules: MetadataRules{
+				Remove: []string{"X-Tag"},
+				Rename: map[string]string{"X-Tenant": "x-tag"},
+				Add:    []MetadataEntry{{Key: "X-Tag", Value: "added"}},
+			},
+			in:   metadata.Pairs("x-tag", "client", "x-tenant", "acme", "X-Tenant", "beta"),
+			want: metadata.Pairs("x-tag", "acme", "x-tag", "beta", "x-tag", "added"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			md := tc.in.Copy()
+			tc.rules.apply(md, &metadataContext{ctx: context.Background(), method: method})
+			if !reflect.DeepEqual(md, tc.want) {
+				t.Errorf("got %v, want %v", md, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// --- Copying Metadata Between gRPC and the Envelope ---
+//
+// copy_grpc_metadata_to_envelope copies the named request headers, as the
+// client sent them, into each request envelope's metadata_field map, so the
+// backend reads them from the application message. The copy is made after
+// verification and before the route's mutations and the proxy signature;
+// note the signature covers the payload only, not the metadata map. Several
+// values of one header are joined with ", ".
+//
+// copy_envelope_metadata_to_grpc goes the other way on responses: the named
+// entries of each response envelope's metadata map are sent to the client as
+// response headers, or in the trailer when the headers have already gone out
+// with an earlier message of the stream.
+//
+// Either way a key the source lacks is skipped, and a key the target already
+// has keeps its value unless the route sets overwrite: true. Keys are
+// lowercase, as gRPC metadata keys are; binary ("-bin") headers are not
+// copied, since the map holds strings. Shadow routes copy nothing.
+
+// copiedHeadersKey carries a call's copiedHeaders from the response pump to
+// the stream that sends the client its headers
+type copiedHeadersKey struct{}
+
+// copiedHeaders holds response envelope entries until the client's headers or
+// trailer are sent
+type copiedHeaders struct {
+	mu        sync.Mutex
+	md        metadata.MD
+	overwrite bool
+}
+
+// newCopiedHeaders returns route's holder, or nil when it copies nothing into
+// response headers
+func newCopiedHeaders(route *RouteConfig) *copiedHeaders {
+	if len(route.CopyEnvelopeMetadataToGRPC) == 0 || route.Shadow {
+		return nil
+	}
+	return &copiedHeaders{md: metadata.MD{}, overwrite: route.Overwrite}
+}
+
+func copiedHeadersFrom(ctx context.Context) *copiedHeaders {
+	c, _ := ctx.Value(copiedHeadersKey{}).(*copiedHeaders)
+	return c
+}
+
+func (c *copiedHeaders) set(key, value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.md.Set(key, value)
+}
+
+// mergeInto moves the held entries into md, keeping md's own values for keys
+// it has unless overwriting
+func (c *copiedHeaders) mergeInto(md metadata.MD) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, v := range c.md {
+		if _, ok := md[k]; ok && !c.overwrite {
+			continue
+		}
+		md[k] = v
+	}
+	c.md = metadata.MD{}
+}
+
+// grpcMetadataToEnvelope copies the route's request headers into the request
+// envelope, reporting whether it changed anything
+func (px *Proxy) grpcMetadataToEnvelope(ctx context.Context, route *RouteConfig, method string, msg *dynamic.Message, env *resolvedEnvelope) bool {
+	if len(route.CopyGRPCMetadataToEnvelope) == 0 || !stringMap(env.metadata) {
+		return false
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	changed := false
+	for _, key := range route.CopyGRPCMetadataToEnvelope {
+		vals := md.Get(key)
+		if len(vals) == 0 {
+			continue
+		}
+		if _, ok := getMapString(msg, env.metadata, key); ok && !route.Overwrite {
+			continue
+		}
+		if err := msg.TryPutMapField(env.metadata, key, strings.Join(vals, ", ")); err != nil {
+			log.Printf("[Request Metadata Error] %s: copy %s into %s: %v", method, key, env.metadata.GetName(), err)
+			continue
+		}
+		changed = true
+	}
+	return changed
+}
+
+// envelopeMetadataToGRPC holds the route's entries of a response envelope for
+// the client's response headers
+func (px *Proxy) envelopeMetadataToGRPC(ctx context.Context, route *RouteConfig, msg *dynamic.Message, env *resolvedEnvelope) {
+	c := copiedHeadersFrom(ctx)
+	if c == nil || !stringMap(env.metadata) {
+		return
+	}
+	for _, key := range route.CopyEnvelopeMetadataToGRPC {
+		if v, ok := getMapString(msg, env.metadata, key); ok {
+			c.set(key, v)
+		}
+	}
+}
+
+// stringMap reports whether fd is a map<string, string> field
+func stringMap(fd *desc.FieldDescriptor) bool {
+	return fd != nil && fd.IsMap() &&
+		fd.GetMapKeyType().GetType() == descriptorpb.FieldDescriptorProto_TYPE_STRING &&
+		fd.GetMapValueType().GetType() == descriptorpb.FieldDescriptorProto_TYPE_STRING
+}
+
+// getMapString reads key of a map<string, string> field, reporting whether
+// the map has it
+func getMapString(msg *dynamic.Message, fd *desc.FieldDescriptor, key string) (string, bool) {
+	val, err := msg.TryGetMapField(fd, key)
+	if err != nil || val == nil {
+		return "", false
+	}
+	s, ok := val.(string)
+	return s, ok
+}
+
+// loadMetadataCopies checks each route's copy_grpc_metadata_to_envelope and
+// copy_envelope_metadata_to_grpc keys, which need an envelope metadata map on
+// a route that decodes envelopes
+func (px *Proxy) loadMetadataCopies(diag *Diagnostics) {
+	for i, route := range px.cfg.Routes {
+		lists := []struct {
+			field string
+			keys  []string
+		}{
+			{"copy_grpc_metadata_to_envelope", route.CopyGRPCMetadataToEnvelope},
+			{"copy_envelope_metadata_to_grpc", route.CopyEnvelopeMetadataToGRPC},
+		}
+		for _, l := range lists {
+			if len(l.keys) == 0 {
+				continue
+			}
+			path := fmt.Sprintf("routes[%d].%s", i, l.field)
+			switch {
+			case route.Mode != "inspect-outer" && route.Mode != "inspect-verify-sign":
+				diag.Errorf("routes", "ROUTE_METADATA_COPY", path, "%s routes do not decode envelopes", route.Mode)
+			case !routeHasMetadataField(route):
+				diag.Errorf("routes", "ROUTE_METADATA_COPY", path, "needs envelope.metadata_field")
+			}
+			for j, key := range l.keys {
+				kpath := fmt.Sprintf("%s[%d]", path, j)
+				switch {
+				case key == "":
+					diag.Errorf("routes", "ROUTE_METADATA_COPY", kpath, "empty metadata key")
+				case key != strings.ToLower(key):
+					diag.Errorf("routes", "ROUTE_METADATA_COPY", kpath, "metadata key %q is not lowercase", key)
+				case strings.HasPrefix(key, ":") || strings.HasPrefix(key, "grpc-"):
+					diag.Errorf("routes", "ROUTE_METADATA_COPY", kpath, "metadata key %q is reserved by gRPC", key)
+				case strings.HasSuffix(key, "-bin"):
+					diag.Errorf("routes", "ROUTE_METADATA_COPY", kpath, "binary metadata key %q cannot be copied into a string map", key)
+				}
+			}
+		}
+		if route.Overwrite && len(route.CopyGRPCMetadataToEnvelope) == 0 && len(route.CopyEnvelopeMetadataToGRPC) == 0 {
+			diag.Warnf("routes", "ROUTE_METADATA_COPY", fmt.Sprintf("routes[%d].overwrite", i), "has no effect without copy_grpc_metadata_to_envelope or copy_envelope_metadata_to_grpc")
+		}
+	}
+}
+
+// routeHasMetadataField reports whether every envelope the route may use names
+// a metadata field
+func routeHasMetadataField(route RouteConfig) bool {
+	if len(route.Envelopes) == 0 {
+		return route.Envelope.MetadataField != ""
+	}
+	for _, e := range route.Envelopes {
+		if e.MetadataField == "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Metrics Registry ---
+//
+// A deliberately small, dependency-free metrics registry. Series are keyed by
+// metric name plus a sorted label set and rendered in the Prometheus text
+// exposition format on the admin listener.
+
+type Labels map[string]string
+
+var defaultBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Buckets for histograms of counts and sizes rather than seconds
+var (
+	countBuckets = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 100000, 1000000}
+	byteBuckets  = []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20, 256 << 20, 1 << 30}
+)
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64 // one per bucket, non-cumulative
+	sum     float64
+	count   uint64
+}
+
+type metricsRegistry struct {
+	mu         sync.Mutex
+	counters   map[string]float64
+	gauges     map[string]float64
+	histograms map[string]*histogram
+}
+
+var metrics = newMetricsRegistry()
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		counters:   make(map[string]float64),
+		gauges:     make(map[string]float64),
+		histograms: make(map[string]*histogram),
+	}
+}
+
+// seriesKey renders name{k="v",...} with labels sorted for stable output
+func seriesKey(name string, labels Labels) string {
+	if len(labels) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%q", k, labels[k]))
+	}
+	return name + "{" + strings.Join(parts, ",") + "}"
+}
+
+func (r *metricsRegistry) Inc(name string, labels Labels) {
+	r.Add(name, labels, 1)
+}
+
+func (r *metricsRegistry) Add(name string, labels Labels, delta float64) {
+	key := seriesKey(name, labels)
+	r.mu.Lock()
+	r.counters[key] += delta
+	r.mu.Unlock()
+}
+
+func (r *metricsRegistry) Set(name string, labels Labels, value float64) {
+	key := seriesKey(name, labels)
+	r.mu.Lock()
+	r.gauges[key] = value
+	r.mu.Unlock()
+}
+
+func (r *metricsRegistry) AddGauge(name string, labels Labels, delta float64) {
+	key := seriesKey(name, labels)
+	r.mu.Lock()
+	r.gauges[key] += delta
+	r.mu.Unlock()
+}
+
+// Observe records a value (seconds for durations) into a histogram series
+func (r *metricsRegistry) Observe(name string, labels Labels, value float64) {
+	r.ObserveBuckets(name, labels, defaultBuckets, value)
+}
+
+// ObserveBuckets records into a histogram with its own bucket bounds; they
+// are fixed by the first observation of each series
+func (r *metricsRegistry) ObserveBuckets(name string, labels Labels, buckets []float64, value float64) {
+	key := seriesKey(name, labels)
+	r.mu.Lock()
+	h, ok := r.histograms[key]
+	if !ok {
+		h = &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+		r.histograms[key] = h
+	}
+	for i, b := range h.buckets {
+		if value <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += value
+	h.count++
+	r.mu.Unlock()
+}
+
+func (r *metricsRegistry) ObserveDuration(name string, labels Labels, d time.Duration) {
+	r.Observe(name, labels, d.Seconds())
+}
+
+// WritePrometheus dumps every series in the text exposition format
+func (r *metricsRegistry) WritePrometheus(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	writeSorted := func(m map[string]float64) {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s %v\n", k, m[k])
+		}
+	}
+	writeSorted(r.counters)
+	writeSorted(r.gauges)
+
+	keys := make([]string, 0, len(r.histograms))
+	for k := range r.histograms {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h := r.histograms[k]
+		name, lbls := k, ""
+		if i := strings.IndexByte(k, '{'); i >= 0 {
+			name, lbls = k[:i], k[i+1:len(k)-1]+","
+		}
+		var cumulative uint64
+		for i, b := range h.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%v\"} %d\n", name, lbls, b, cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, lbls, h.count)
+		suffix := ""
+		if lbls != "" {
+			suffix = "{" + strings.TrimSuffix(lbls, ",") + "}"
+		}
+		fmt.Fprintf(w, "%s_sum%s %v\n", name, suffix, h.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", name, suffix, h.count)
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.WritePrometheus(w)
+}
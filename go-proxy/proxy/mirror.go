@@ -0,0 +1,351 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/mem"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// --- Request Mirroring ---
+//
+// A route with a mirror block copies a sample of its calls to a second
+// backend, to try a new backend version on live traffic while the primary
+// keeps serving. percent of the route's calls are picked as they arrive;
+// with scope requests (default) only unary calls are mirrored, with streams
+// streaming calls are too. A mirrored call carries the primary's request
+// metadata plus x-mirrored: true, and the request messages as the primary
+// was sent them, after the route's processing: a unary request once, before
+// any retry, and a stream's messages one by one as the c2s pump forwards
+// them, half-closed when the client half-closes. Whatever the mirror answers
+// is read and discarded.
+//
+// Mirrored calls run on their own goroutines and connection, each bounded by
+// mirror.timeout (default 5s) instead of the client's deadline, and at most
+// max_concurrent (default 32) per route at once; a call picked while the
+// route is at its limit is skipped. A stream's messages queue for the mirror
+// up to the route's buffer_depth, and a stream whose mirror falls further
+// behind than that is cut off rather than slowing the primary. Nothing the
+// mirror does reaches the client or the primary's access log: its failures
+// are logged (at most once per route every 10s) and counted as
+// proxy_mirror_errors_total{route, reason}, next to proxy_mirror_rpcs_total,
+// proxy_mirror_skipped_total and proxy_mirror_lag_seconds, how long each
+// request took to reach the mirror after reaching the primary (on a unary
+// call, until the mirror answered, which Invoke does not tell apart).
+
+// MirrorConfig copies a sample of a route's calls to a second backend
+type MirrorConfig struct {
+	Address       string  `yaml:"address"`        // host:port, dialled with the backend's TLS settings
+	Percent       float64 `yaml:"percent"`        // of the route's calls mirrored, 0 to 100
+	Scope         string  `yaml:"scope"`          // requests (unary calls only, default) or streams (every call)
+	MaxConcurrent int     `yaml:"max_concurrent"` // mirrored calls in flight on the route; default 32
+	Timeout       string  `yaml:"timeout"`        // of each mirrored call; default "5s"
+}
+
+const (
+	mirroredHeader          = "x-mirrored"
+	mirrorScopeRequests     = "requests"
+	mirrorScopeStreams      = "streams"
+	defaultMirrorConcurrent = 32
+	defaultMirrorTimeout    = 5 * time.Second
+	mirrorLogInterval       = 10 * time.Second
+)
+
+// errMirrorOverflow ends a mirrored stream that fell a buffer behind
+var errMirrorOverflow = errors.New("fell behind the primary by more than buffer_depth messages")
+
+// routeMirror is one route's mirror backend
+type routeMirror struct {
+	route   string
+	address string
+	conn    *grpc.ClientConn
+	percent float64
+	streams bool
+	timeout time.Duration
+	depth   int
+	slots   chan struct{}
+	labels  Labels
+	log     *sampledLog
+}
+
+// mirrorStreamDesc opens mirrored streams; bytesCodec does not care which
+// side streams
+var mirrorStreamDesc = &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}
+
+// pick samples a call and takes a slot for it, reporting whether it is
+// mirrored; a picked call is released once its mirror finishes
+func (m *routeMirror) pick() bool {
+	if m == nil || rand.Float64()*100 >= m.percent {
+		return false
+	}
+	select {
+	case m.slots <- struct{}{}:
+		metrics.Inc("proxy_mirror_rpcs_total", m.labels)
+		return true
+	default:
+		metrics.Inc("proxy_mirror_skipped_total", m.labels)
+		return false
+	}
+}
+
+// callContext is a mirrored call's own context, carrying the primary's
+// request metadata from ctx
+func (m *routeMirror) callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	md.Set(mirroredHeader, "true")
+	return context.WithTimeout(metadata.NewOutgoingContext(context.Background(), md), m.timeout)
+}
+
+// finish releases a mirrored call's slot and counts how it ended
+func (m *routeMirror) finish(method string, err error) {
+	<-m.slots
+	if err == nil {
+		return
+	}
+	reason := status.Code(err).String()
+	if errors.Is(err, errMirrorOverflow) {
+		reason = "overflow"
+	}
+	metrics.Inc("proxy_mirror_errors_total", Labels{"route": m.route, "reason": reason})
+	m.log.printf(m.route, "[Mirror] %s to %s failed: %v", method, m.address, err)
+}
+
+// unary mirrors one unary request, if the call is picked
+func (m *routeMirror) unary(ctx context.Context, method string, req []byte) {
+	if !m.pick() {
+		return
+	}
+	ctx, cancel := m.callContext(ctx)
+	at := time.Now()
+	go func() {
+		defer cancel()
+		var resp []byte
+		err := m.conn.Invoke(ctx, method, &req, &resp)
+		if err == nil {
+			metrics.ObserveDuration("proxy_mirror_lag_seconds", m.labels, time.Since(at))
+		}
+		m.finish(method, err)
+	}()
+}
+
+// mirrorCall is one stream's copy on the way to the mirror. Every method is
+// a no-op on nil, a stream that is not mirrored.
+type mirrorCall struct {
+	m      *routeMirror
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	queue    chan mirrorMessage
+	closed   bool
+	overflow bool
+}
+
+type mirrorMessage struct {
+	payload []byte
+	at      time.Time
+}
+
+// stream starts mirroring a streaming call, if the route mirrors streams and
+// the call is picked
+func (m *routeMirror) stream(ctx context.Context, method string) *mirrorCall {
+	if m == nil || !m.streams || !m.pick() {
+		return nil
+	}
+	ctx, cancel := m.callContext(ctx)
+	c := &mirrorCall{m: m, cancel: cancel, queue: make(chan mirrorMessage, m.depth)}
+	go func() {
+		defer cancel()
+		err := c.run(ctx, method)
+		c.mu.Lock()
+		if c.overflow {
+			err = errMirrorOverflow
+		}
+		c.mu.Unlock()
+		m.finish(method, err)
+	}()
+	return c
+}
+
+// run sends the queued messages to the mirror, then reads and discards its
+// responses
+func (c *mirrorCall) run(ctx context.Context, method string) error {
+	stream, err := c.m.conn.NewStream(ctx, mirrorStreamDesc, method)
+	if err != nil {
+		return err
+	}
+	for msg := range c.queue {
+		if err := stream.SendMsg(&msg.payload); err != nil {
+			// The cause is on RecvMsg
+			c.stop()
+			break
+		}
+		metrics.ObserveDuration("proxy_mirror_lag_seconds", c.m.labels, time.Since(msg.at))
+	}
+	stream.CloseSend()
+	for {
+		var resp []byte
+		if err := stream.RecvMsg(&resp); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// send queues a copy of a message the primary took, cutting the mirror off
+// when its queue is full
+func (c *mirrorCall) send(payload []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.queue <- mirrorMessage{payload: payload, at: time.Now()}:
+	default:
+		c.overflow = true
+		c.cancel()
+		c.closeLocked()
+	}
+}
+
+// stop half-closes the mirrored stream once its queue is sent: when the
+// client half-closes, the call ends, or the mirror failed
+func (c *mirrorCall) stop() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeLocked()
+}
+
+func (c *mirrorCall) closeLocked() {
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+}
+
+// tee is dst, copying each message the primary takes to the mirror
+func (c *mirrorCall) tee(dst grpc.Stream) grpc.Stream {
+	if c == nil {
+		return dst
+	}
+	return &mirrorTee{Stream: dst, call: c}
+}
+
+type mirrorTee struct {
+	grpc.Stream
+	call *mirrorCall
+}
+
+func (t *mirrorTee) SendMsg(m interface{}) error {
+	if err := t.Stream.SendMsg(m); err != nil {
+		return err
+	}
+	switch b := m.(type) {
+	case *[]byte:
+		t.call.send(*b) // never written again once sent
+	case *mem.BufferSlice:
+		t.call.send(b.Materialize()) // freed once sent
+	}
+	return nil
+}
+
+// loadMirrors dials each route's mirror backend
+func (px *Proxy) loadMirrors(diag *Diagnostics) {
+	for i := range px.cfg.Routes {
+		route := &px.cfg.Routes[i]
+		cfg := route.Mirror
+		if cfg == nil {
+			continue
+		}
+		path := fmt.Sprintf("routes[%d].mirror", i)
+		m := &routeMirror{route: route.Name, address: cfg.Address, percent: cfg.Percent, timeout: defaultMirrorTimeout,
+			depth: defaultBufferDepth, labels: Labels{"route": route.Name}, log: newSampledLog(mirrorLogInterval)}
+		ok := true
+		if cfg.Address == "" {
+			diag.Errorf("routes", "ROUTE_MIRROR", path+".address", "required")
+			ok = false
+		}
+		switch {
+		case cfg.Percent < 0 || cfg.Percent > 100:
+			diag.Errorf("routes", "ROUTE_MIRROR", path+".percent", "%v is not between 0 and 100", cfg.Percent)
+			ok = false
+		case cfg.Percent == 0:
+			diag.Warnf("routes", "ROUTE_MIRROR", path+".percent", "0 mirrors nothing")
+		}
+		switch cfg.Scope {
+		case "", mirrorScopeRequests:
+		case mirrorScopeStreams:
+			m.streams = true
+		default:
+			diag.Errorf("routes", "ROUTE_MIRROR", path+".scope", "unknown scope %q; want requests or streams", cfg.Scope)
+			ok = false
+		}
+		concurrent := defaultMirrorConcurrent
+		if cfg.MaxConcurrent < 0 {
+			diag.Errorf("routes", "ROUTE_MIRROR", path+".max_concurrent", "must not be negative")
+			ok = false
+		} else if cfg.MaxConcurrent > 0 {
+			concurrent = cfg.MaxConcurrent
+		}
+		if cfg.Timeout != "" {
+			d, err := time.ParseDuration(cfg.Timeout)
+			if err != nil || d <= 0 {
+				diag.Errorf("routes", "ROUTE_MIRROR", path+".timeout", "invalid duration %q", cfg.Timeout)
+				ok = false
+			}
+			m.timeout = d
+		}
+		if route.BufferDepth > 0 {
+			m.depth = route.BufferDepth
+		}
+		if route.Mode == "local-reply" {
+			diag.Warnf("routes", "ROUTE_MIRROR", path, "local-reply routes never call a backend, so have nothing to mirror")
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if _, dup := px.routeMirrors[route.Name]; dup {
+			continue
+		}
+		opts := append(px.backendDialOptions(), grpc.WithDefaultCallOptions(grpc.ForceCodecV2(bytesCodec{})))
+		conn, err := grpc.Dial(cfg.Address, opts...)
+		if err != nil {
+			diag.Errorf("routes", "ROUTE_MIRROR", path+".address", "%v", err)
+			continue
+		}
+		m.conn = conn
+		m.slots = make(chan struct{}, concurrent)
+		px.routeMirrors[route.Name] = m
+		scope := "unary calls"
+		if m.streams {
+			scope = "calls"
+		}
+		log.Printf("[Mirror] Route %s mirrors %g%% of its %s to %s", route.Name, m.percent, scope, m.address)
+	}
+}
+
+// closeMirrors closes the mirror connections, ending calls still on them
+func (px *Proxy) closeMirrors() {
+	for _, m := range px.routeMirrors {
+		m.conn.Close()
+	}
+}
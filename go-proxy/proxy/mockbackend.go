@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// --- Mock Backend ---
+//
+// backend.mode: mock replaces the backend with an in-process gRPC server
+// that answers every method in the loaded schema. The proxy dials it like
+// any endpoint, so routes inspect, verify, sign and encrypt exactly as they
+// would against a real backend; only the answer is made up. A method's
+// response is its mock.responses template, or else its output type filled
+// with placeholders: strings and bytes hold the field's name, numbers are 1,
+// bools true, enums their first value, and nested messages are filled the
+// same way a few levels deep. Streaming methods answer each request message
+// with stream_responses copies; client-streaming ones answer once, at
+// half-close.
+
+const backendModeMock = "mock"
+
+// MockConfig shapes the answers of backend.mode: mock
+type MockConfig struct {
+	// Responses are JSON output messages by full method name, e.g.
+	// "/echo.EchoService/UnaryEcho": '{"message": "mocked"}'
+	Responses       map[string]string `yaml:"responses"`
+	StreamResponses int               `yaml:"stream_responses"` // per request message; default 1
+}
+
+// mockAddress is the endpoint the pool holds in mock mode
+const mockAddress = "mock"
+
+// mockDepth bounds how deep placeholder messages nest
+const mockDepth = 3
+
+type mockBackend struct {
+	px        *Proxy
+	lis       *bufconn.Listener
+	srv       *grpc.Server
+	templates map[string][]byte // encoded mock.responses, by method
+	perMsg    int
+
+	generated sync.Map // method -> []byte, placeholder responses built on first use
+}
+
+// startMockBackend serves the mock on an in-memory listener and points the
+// backend dialer at it
+func (px *Proxy) startMockBackend() *mockBackend {
+	m := &mockBackend{px: px, lis: bufconn.Listen(1 << 20), templates: map[string][]byte{}, perMsg: 1}
+	m.srv = grpc.NewServer(grpc.ForceServerCodecV2(bytesCodec{}), grpc.UnknownServiceHandler(m.handle))
+	go m.srv.Serve(m.lis)
+	px.backendDialer = func(ctx context.Context, _ string) (net.Conn, error) {
+		return m.lis.DialContext(ctx)
+	}
+	log.Printf("[Backend] Mock mode: answering from the loaded schema")
+	return m
+}
+
+// handle answers one call of any method
+func (m *mockBackend) handle(_ any, stream grpc.ServerStream) error {
+	method, _ := grpc.MethodFromServerStream(stream)
+	md, ok := m.px.lookupMethod(method)
+	if !ok {
+		return status.Errorf(codes.Unimplemented, "mock backend: %s is not in the loaded schema", method)
+	}
+	resp, err := m.response(method, md)
+	if err != nil {
+		return status.Errorf(codes.Internal, "mock backend: %v", err)
+	}
+
+	if !md.IsServerStreaming() {
+		var req []byte
+		for {
+			if err := stream.RecvMsg(&req); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			if !md.IsClientStreaming() {
+				break
+			}
+		}
+		return stream.SendMsg(&resp)
+	}
+	for {
+		var req []byte
+		if err := stream.RecvMsg(&req); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for i := 0; i < m.perMsg; i++ {
+			if err := stream.SendMsg(&resp); err != nil {
+				return err
+			}
+		}
+		if !md.IsClientStreaming() {
+			return nil
+		}
+	}
+}
+
+// response is method's template, or its placeholder output message
+func (m *mockBackend) response(method string, md *desc.MethodDescriptor) ([]byte, error) {
+	if b, ok := m.templates[method]; ok {
+		return b, nil
+	}
+	if b, ok := m.generated.Load(method); ok {
+		return b.([]byte), nil
+	}
+	b, err := marshalDynamic(mockMessage(md.GetOutputType(), mockDepth))
+	if err != nil {
+		return nil, fmt.Errorf("encode placeholder %s: %v", md.GetOutputType().GetFullyQualifiedName(), err)
+	}
+	m.generated.Store(method, b)
+	return b, nil
+}
+
+// mockMessage fills md's fields with placeholder values; repeated fields get
+// one element, maps and oneofs after their first field are left empty
+func mockMessage(md *desc.MessageDescriptor, depth int) *dynamic.Message {
+	msg := dynamic.NewMessage(md)
+	for _, fd := range md.GetFields() {
+		if oneof := fd.GetOneOf(); fd.IsMap() || oneof != nil && oneof.GetChoices()[0] != fd {
+			continue
+		}
+		v, ok := mockValue(fd, depth)
+		if !ok {
+			continue
+		}
+		if fd.IsRepeated() {
+			msg.TryAddRepeatedField(fd, v)
+		} else {
+			msg.TrySetField(fd, v)
+		}
+	}
+	return msg
+}
+
+func mockValue(fd *desc.FieldDescriptor, depth int) (any, bool) {
+	switch fd.GetType() {
+	case descriptorpb.FieldDescriptorProto_TYPE_STRING:
+		return fd.GetName(), true
+	case descriptorpb.FieldDescriptorProto_TYPE_BYTES:
+		return []byte(fd.GetName()), true
+	case descriptorpb.FieldDescriptorProto_TYPE_BOOL:
+		return true, true
+	case descriptorpb.FieldDescriptorProto_TYPE_INT32, descriptorpb.FieldDescriptorProto_TYPE_SINT32, descriptorpb.FieldDescriptorProto_TYPE_SFIXED32:
+		return int32(1), true
+	case descriptorpb.FieldDescriptorProto_TYPE_INT64, descriptorpb.FieldDescriptorProto_TYPE_SINT64, descriptorpb.FieldDescriptorProto_TYPE_SFIXED64:
+		return int64(1), true
+	case descriptorpb.FieldDescriptorProto_TYPE_UINT32, descriptorpb.FieldDescriptorProto_TYPE_FIXED32:
+		return uint32(1), true
+	case descriptorpb.FieldDescriptorProto_TYPE_UINT64, descriptorpb.FieldDescriptorProto_TYPE_FIXED64:
+		return uint64(1), true
+	case descriptorpb.FieldDescriptorProto_TYPE_FLOAT:
+		return float32(1), true
+	case descriptorpb.FieldDescriptorProto_TYPE_DOUBLE:
+		return float64(1), true
+	case descriptorpb.FieldDescriptorProto_TYPE_ENUM:
+		values := fd.GetEnumType().GetValues()
+		if len(values) == 0 {
+			return nil, false
+		}
+		return values[0].GetNumber(), true
+	case descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, descriptorpb.FieldDescriptorProto_TYPE_GROUP:
+		if depth <= 1 {
+			return nil, false
+		}
+		return mockMessage(fd.GetMessageType(), depth-1), true
+	}
+	return nil, false
+}
+
+// loadMockBackend encodes backend.mock against the schema. It runs after
+// loadSchema; loadBackends has already started the server.
+func (px *Proxy) loadMockBackend(diag *Diagnostics) {
+	cfg := px.cfg.Backend.Mock
+	if px.mock == nil {
+		if cfg.Responses != nil || cfg.StreamResponses != 0 {
+			diag.Warnf("backend", "BACKEND_MOCK", "backend.mock", "mock is ignored unless backend.mode is mock")
+		}
+		return
+	}
+	if px.cfg.Schema.Method == "reflection" {
+		diag.Errorf("backend", "BACKEND_MOCK", "schema.method", "mock mode has no backend to run reflection against; use a pb schema")
+	}
+	if cfg.StreamResponses < 0 {
+		diag.Errorf("backend", "BACKEND_MOCK", "backend.mock.stream_responses", "must not be negative, got %d", cfg.StreamResponses)
+	} else if cfg.StreamResponses > 0 {
+		px.mock.perMsg = cfg.StreamResponses
+	}
+
+	methods := make([]string, 0, len(cfg.Responses))
+	for method := range cfg.Responses {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		path := "backend.mock.responses[" + method + "]"
+		md, ok := px.lookupMethod(method)
+		if !ok {
+			diag.Errorf("backend", "BACKEND_MOCK", path, "%s is not in the loaded schema", method)
+			continue
+		}
+		msg := dynamic.NewMessage(md.GetOutputType())
+		if err := msg.UnmarshalJSON([]byte(cfg.Responses[method])); err != nil {
+			diag.Errorf("backend", "BACKEND_MOCK", path, "not a valid %s: %v", md.GetOutputType().GetFullyQualifiedName(), err)
+			continue
+		}
+		b, err := marshalDynamic(msg)
+		if err != nil {
+			diag.Errorf("backend", "BACKEND_MOCK", path, "encode: %v", err)
+			continue
+		}
+		px.mock.templates[method] = b
+	}
+}
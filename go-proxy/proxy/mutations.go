@@ -0,0 +1,301 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// MutationConfig is one edit the proxy makes to the envelope before
+// forwarding it. Field is a path of field names from the envelope, separated
+// by dots for nested messages, and may end in [key] to address one entry of
+// a map<string,string> field, e.g. "metadata[proxy_id]".
+type MutationConfig struct {
+	Op        string `yaml:"op"`        // set_string, set_bytes, set_timestamp_now, clear
+	Field     string `yaml:"field"`     // e.g. "received_at", "metadata[proxy_id]", "header.debug_info"
+	Value     string `yaml:"value"`     // set_string: literal; set_bytes: standard base64
+	Direction string `yaml:"direction"` // request (default), response or both
+}
+
+const timestampType = "google.protobuf.Timestamp"
+
+// mutation is a MutationConfig parsed at startup
+type mutation struct {
+	op       string
+	field    string
+	path     []string
+	key      string
+	hasKey   bool
+	str      string
+	raw      []byte
+	request  bool
+	response bool
+}
+
+func parseMutation(cfg MutationConfig) (mutation, error) {
+	m := mutation{op: cfg.Op, field: cfg.Field, str: cfg.Value}
+	switch cfg.Direction {
+	case "", "request":
+		m.request = true
+	case "response":
+		m.response = true
+	case "both":
+		m.request, m.response = true, true
+	default:
+		return m, fmt.Errorf("unknown direction %q (expected request, response or both)", cfg.Direction)
+	}
+
+	field := cfg.Field
+	if open := strings.Index(field, "["); open >= 0 {
+		if !strings.HasSuffix(field, "]") || open == len(field)-2 {
+			return m, fmt.Errorf("malformed map key in field path %q", cfg.Field)
+		}
+		m.key, m.hasKey = field[open+1:len(field)-1], true
+		field = field[:open]
+	}
+	m.path = strings.Split(field, ".")
+	for _, name := range m.path {
+		if name == "" {
+			return m, fmt.Errorf("malformed field path %q", cfg.Field)
+		}
+	}
+
+	switch cfg.Op {
+	case "set_string":
+	case "set_bytes":
+		if m.hasKey {
+			return m, fmt.Errorf("set_bytes cannot target a map<string,string> entry")
+		}
+		b, err := base64.StdEncoding.DecodeString(cfg.Value)
+		if err != nil {
+			return m, fmt.Errorf("set_bytes value is not valid base64: %v", err)
+		}
+		m.raw = b
+	case "set_timestamp_now", "clear":
+		if cfg.Value != "" {
+			return m, fmt.Errorf("%s takes no value", cfg.Op)
+		}
+	default:
+		return m, fmt.Errorf("unknown op %q (expected set_string, set_bytes, set_timestamp_now or clear)", cfg.Op)
+	}
+	return m, nil
+}
+
+// resolve walks the path against md and checks the final field suits the op
+func (m *mutation) resolve(md *desc.MessageDescriptor) (*desc.FieldDescriptor, error) {
+	var fd *desc.FieldDescriptor
+	for i, name := range m.path {
+		fd = md.FindFieldByName(name)
+		if fd == nil {
+			return nil, fmt.Errorf("%s has no field %q", md.GetFullyQualifiedName(), name)
+		}
+		if i == len(m.path)-1 {
+			break
+		}
+		if fd.GetMessageType() == nil || fd.IsRepeated() {
+			return nil, fmt.Errorf("%s.%s is not a singular message field", md.GetFullyQualifiedName(), name)
+		}
+		md = fd.GetMessageType()
+	}
+
+	if m.hasKey {
+		if !fd.IsMap() || fd.GetMapKeyType().GetType() != descriptorpb.FieldDescriptorProto_TYPE_STRING ||
+			fd.GetMapValueType().GetType() != descriptorpb.FieldDescriptorProto_TYPE_STRING {
+			return nil, fmt.Errorf("%s is not a map<string,string> field", fd.GetFullyQualifiedName())
+		}
+		return fd, nil
+	}
+	if m.op == "clear" {
+		return fd, nil
+	}
+	if fd.IsRepeated() {
+		return nil, fmt.Errorf("%s is repeated; only clear is supported", fd.GetFullyQualifiedName())
+	}
+	t := fd.GetType()
+	ok := false
+	switch m.op {
+	case "set_string":
+		ok = t == descriptorpb.FieldDescriptorProto_TYPE_STRING
+	case "set_bytes":
+		ok = t == descriptorpb.FieldDescriptorProto_TYPE_BYTES
+	case "set_timestamp_now":
+		ok = timestampValue(fd, time.Time{}) != nil
+	}
+	if !ok {
+		return nil, fmt.Errorf("%s cannot target %s of type %s", m.op, fd.GetFullyQualifiedName(), strings.ToLower(strings.TrimPrefix(t.String(), "TYPE_")))
+	}
+	return fd, nil
+}
+
+// timestampValue renders now for the field's type: a google.protobuf.Timestamp,
+// an RFC 3339 string, or Unix nanoseconds in a 64-bit integer. It returns nil
+// for any other type.
+func timestampValue(fd *desc.FieldDescriptor, now time.Time) interface{} {
+	switch fd.GetType() {
+	case descriptorpb.FieldDescriptorProto_TYPE_MESSAGE:
+		if fd.GetMessageType().GetFullyQualifiedName() != timestampType {
+			return nil
+		}
+		ts := dynamic.NewMessage(fd.GetMessageType())
+		ts.SetFieldByName("seconds", now.Unix())
+		ts.SetFieldByName("nanos", int32(now.Nanosecond()))
+		return ts
+	case descriptorpb.FieldDescriptorProto_TYPE_STRING:
+		return now.UTC().Format(time.RFC3339Nano)
+	case descriptorpb.FieldDescriptorProto_TYPE_INT64, descriptorpb.FieldDescriptorProto_TYPE_SINT64, descriptorpb.FieldDescriptorProto_TYPE_SFIXED64:
+		return now.UnixNano()
+	case descriptorpb.FieldDescriptorProto_TYPE_UINT64, descriptorpb.FieldDescriptorProto_TYPE_FIXED64:
+		return uint64(now.UnixNano())
+	}
+	return nil
+}
+
+// apply edits msg in place. Intermediate messages on the path are created
+// when absent, so a set always lands.
+func (m *mutation) apply(msg *dynamic.Message, now time.Time) error {
+	fd, err := m.resolve(msg.GetMessageDescriptor())
+	if err != nil {
+		return err
+	}
+	target := msg
+	var parents []*dynamic.Message
+	for _, name := range m.path[:len(m.path)-1] {
+		parent := target
+		pfd := parent.GetMessageDescriptor().FindFieldByName(name)
+		v, err := parent.TryGetField(pfd)
+		if err != nil {
+			return err
+		}
+		sub, ok := v.(*dynamic.Message)
+		if !ok || sub == nil {
+			if m.op == "clear" {
+				return nil // nothing below an absent message to clear
+			}
+			sub = dynamic.NewMessage(pfd.GetMessageType())
+		}
+		parents = append(parents, parent)
+		target = sub
+	}
+
+	switch {
+	case m.hasKey && m.op == "clear":
+		err = target.TryRemoveMapField(fd, m.key)
+	case m.hasKey && m.op == "set_timestamp_now":
+		err = target.TryPutMapField(fd, m.key, now.UTC().Format(time.RFC3339Nano))
+	case m.hasKey:
+		err = target.TryPutMapField(fd, m.key, m.str)
+	case m.op == "clear":
+		err = target.TryClearField(fd)
+	case m.op == "set_string":
+		err = target.TrySetField(fd, m.str)
+	case m.op == "set_bytes":
+		err = target.TrySetField(fd, m.raw)
+	case m.op == "set_timestamp_now":
+		err = target.TrySetField(fd, timestampValue(fd, now))
+	}
+	if err != nil {
+		return err
+	}
+
+	// Reattach nested messages that were created or copied on the way down
+	for i := len(parents) - 1; i >= 0; i-- {
+		pfd := parents[i].GetMessageDescriptor().FindFieldByName(m.path[i])
+		if err := parents[i].TrySetField(pfd, target); err != nil {
+			return err
+		}
+		target = parents[i]
+	}
+	return nil
+}
+
+// applyMutations runs the route's mutations for one direction in config
+// order and reports whether any ran
+func (px *Proxy) applyMutations(msg *dynamic.Message, route *RouteConfig, isReq bool) (bool, error) {
+	now := time.Now()
+	applied := false
+	for i := range px.routeMutations[route.Name] {
+		m := &px.routeMutations[route.Name][i]
+		if (isReq && !m.request) || (!isReq && !m.response) {
+			continue
+		}
+		if err := m.apply(msg, now); err != nil {
+			return applied, fmt.Errorf("mutation %s %s: %w", m.op, m.field, err)
+		}
+		applied = true
+	}
+	return applied, nil
+}
+
+// loadMutations parses each route's mutations and checks every field path
+// against the envelope types of all loaded methods the route matches, so a
+// bad path fails startup instead of the first call
+func (px *Proxy) loadMutations(diag *Diagnostics) {
+	methods := px.knownMethods()
+	for i, route := range px.cfg.Routes {
+		if len(route.Mutations) == 0 {
+			continue
+		}
+		if route.Mode == "pass-thru" {
+			diag.Warnf("routes", "ROUTE_MUTATION", fmt.Sprintf("routes[%d].mutations", i), "mutations have no effect on pass-thru routes")
+			continue
+		}
+
+		var matched []*desc.MethodDescriptor
+		for _, name := range methods {
+			if route.matches(name) && !px.shadowedByBuiltin(route, name) {
+				if md, ok := px.lookupMethod(name); ok {
+					matched = append(matched, md)
+				}
+			}
+		}
+		if len(matched) == 0 {
+			diag.Warnf("routes", "ROUTE_MUTATION", fmt.Sprintf("routes[%d].match", i), "no loaded method matches %s; its mutations cannot be checked", route.Match)
+		}
+
+		var parsed []mutation
+		valid := true
+		for j, cfg := range route.Mutations {
+			path := fmt.Sprintf("routes[%d].mutations[%d]", i, j)
+			m, err := parseMutation(cfg)
+			if err != nil {
+				diag.Errorf("routes", "ROUTE_MUTATION", path, "%v", err)
+				valid = false
+				continue
+			}
+			for _, md := range matched {
+				var err error
+				if m.request {
+					_, err = m.resolve(md.GetInputType())
+				}
+				if err == nil && m.response {
+					_, err = m.resolve(md.GetOutputType())
+				}
+				if err != nil {
+					diag.Errorf("routes", "ROUTE_MUTATION", path+".field", "field %q on %s: %v", cfg.Field, md.GetFullyQualifiedName(), err)
+					valid = false
+					break
+				}
+			}
+			parsed = append(parsed, m)
+		}
+		if _, dup := px.routeMutations[route.Name]; valid && !dup {
+			px.routeMutations[route.Name] = parsed
+		}
+	}
+}
+
+// mutateEnvelope applies the route's mutations to an envelope in processMsg,
+// logging rather than failing the call if one cannot be applied
+func (px *Proxy) mutateEnvelope(msg *dynamic.Message, route *RouteConfig, isReq bool, dir, method string) bool {
+	applied, err := px.applyMutations(msg, route, isReq)
+	if err != nil {
+		log.Printf("[%s Mutation Error] %s: %v", dir, method, err)
+	}
+	return applied
+}
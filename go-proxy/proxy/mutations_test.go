@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/builder"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// nestedEnvelope is an envelope with the nesting the echo types lack:
+//
+//	message Envelope {
+//	  bytes payload = 1;
+//	  Header header = 2;
+//	  repeated Header hops = 3;
+//	  map<string, string> metadata = 4;
+//	  google.protobuf.Timestamp received_at = 5;
+//	}
+//	message Header { Trace trace = 1; string debug_info = 2; map<string, string> labels = 3; int64 sent_at = 4; }
+//	message Trace { string id = 1; bytes parent = 2; }
+func nestedEnvelope(tb testing.TB) *desc.MessageDescriptor {
+	tb.Helper()
+	ts, err := desc.LoadMessageDescriptorForMessage(&timestamppb.Timestamp{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	trace := builder.NewMessage("Trace").
+		AddField(builder.NewField("id", builder.FieldTypeString())).
+		AddField(builder.NewField("parent", builder.FieldTypeBytes()))
+	header := builder.NewMessage("Header").
+		AddField(builder.NewField("trace", builder.FieldTypeMessage(trace))).
+		AddField(builder.NewField("debug_info", builder.FieldTypeString())).
+		AddField(builder.NewMapField("labels", builder.FieldTypeString(), builder.FieldTypeString())).
+		AddField(builder.NewField("sent_at", builder.FieldTypeInt64()))
+	envelope := builder.NewMessage("Envelope").
+		AddField(builder.NewField("payload", builder.FieldTypeBytes())).
+		AddField(builder.NewField("header", builder.FieldTypeMessage(header))).
+		AddField(builder.NewField("hops", builder.FieldTypeMessage(header)).SetRepeated()).
+		AddField(builder.NewMapField("metadata", builder.FieldTypeString(), builder.FieldTypeString())).
+		AddField(builder.NewField("received_at", builder.FieldTypeImportedMessage(ts)))
+	fd, err := builder.NewFile("nested.proto").SetPackageName("fuzz").SetProto3(true).
+		AddMessage(trace).AddMessage(header).AddMessage(envelope).Build()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return fd.FindMessage("fuzz.Envelope")
+}
+
+// mutationOps are the ops FuzzEnvelopeFieldPaths picks from
+var mutationOps = []string{"set_string", "set_bytes", "set_timestamp_now", "clear"}
+
+// FuzzEnvelopeFieldPaths parses arbitrary field paths as mutations, and
+// applies those that resolve to arbitrary messages of nestedEnvelope's type.
+// Nothing may panic; a set must read back through the same path, and the
+// edited message must still encode.
+func FuzzEnvelopeFieldPaths(f *testing.F) {
+	md := nestedEnvelope(f)
+	seed := dynamic.NewMessage(md)
+	seed.SetFieldByName("payload", []byte("inner"))
+	header := dynamic.NewMessage(md.FindFieldByName("header").GetMessageType())
+	header.SetFieldByName("debug_info", "on")
+	seed.SetFieldByName("header", header)
+	seed.PutMapFieldByName("metadata", "proxy_id", "a")
+	valid, err := seed.Marshal()
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, s := range []struct {
+		op    uint8
+		field string
+		msg   []byte
+	}{
+		{0, "header.trace.id", valid},
+		{0, "header.labels[env]", valid},
+		{0, "metadata[proxy_id]", valid[:len(valid)-3]},                        // truncated
+		{1, "header.trace.parent", []byte{0x12, 0xff, 0xff, 0xff, 0xff, 0x0f}}, // header claiming 4 GiB
+		{2, "header.sent_at", valid},
+		{2, "received_at", []byte{0x2a, 0x02, 0x08}},
+		{3, "hops", valid},
+		{3, "header.trace", nil},
+		{0, "header..id", valid},
+		{0, "metadata[", valid},
+		{0, "metadata[]", valid},
+		{0, "hops.debug_info", valid},
+		{0, ".", nil},
+	} {
+		f.Add(s.op, s.field, "value", s.msg)
+	}
+
+	now := time.Unix(1700000000, 5)
+	f.Fuzz(func(t *testing.T, op uint8, field, value string, raw []byte) {
+		cfg := MutationConfig{Op: mutationOps[int(op)%len(mutationOps)], Field: field, Value: value}
+		switch cfg.Op {
+		case "set_bytes":
+			cfg.Value = base64.StdEncoding.EncodeToString([]byte(value))
+		case "set_timestamp_now", "clear":
+			cfg.Value = ""
+		}
+		m, err := parseMutation(cfg)
+		if err != nil {
+			return
+		}
+		if _, err := m.resolve(md); err != nil {
+			return
+		}
+		msg := dynamic.NewMessage(md)
+		if msg.Unmarshal(raw) != nil {
+			msg = dynamic.NewMessage(md)
+		}
+		if err := m.apply(msg, now); err != nil {
+			t.Fatalf("%s %s resolved but does not apply: %v", cfg.Op, field, err)
+		}
+		if _, err := marshalDynamic(msg); err != nil {
+			t.Fatalf("%s %s left a message that does not encode: %v", cfg.Op, field, err)
+		}
+
+		set := cfg.Op == "set_string" || cfg.Op == "set_bytes"
+		if !set {
+			return
+		}
+		if got, ok := readFieldPath(msg, m.path, m.key, m.hasKey); !ok || got != value {
+			t.Fatalf("%s %s = %q reads back as %q (%v)", cfg.Op, field, value, got, ok)
+		}
+		if !m.hasKey && (value != "") != hasFieldPath(msg, m.path) {
+			t.Fatalf("hasFieldPath(%s) after setting %q disagrees", field, value)
+		}
+	})
+}
+
+// readFieldPath reads a string or bytes field, or a map entry, at path
+func readFieldPath(msg *dynamic.Message, path []string, key string, hasKey bool) (string, bool) {
+	for _, name := range path[:len(path)-1] {
+		sub, ok := msg.GetFieldByName(name).(*dynamic.Message)
+		if !ok || sub == nil {
+			return "", false
+		}
+		msg = sub
+	}
+	fd := msg.GetMessageDescriptor().FindFieldByName(path[len(path)-1])
+	if hasKey {
+		v, err := msg.TryGetMapField(fd, key)
+		s, ok := v.(string)
+		return s, err == nil && ok
+	}
+	switch v := msg.GetField(fd).(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	}
+	return "", false
+}
@@ -0,0 +1,362 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc/codes"
+)
+
+// --- Nested Envelopes ---
+//
+// An envelope's payload may hold another envelope: a request the edge signed
+// and the organisation signed again arrives as an org-signed envelope whose
+// payload is the edge-signed one, whose payload is the message. With
+// nested_envelopes: N an inspect-verify-sign route walks up to N levels in
+// from the outer envelope, level 0, which it handles as it always does:
+//
+//	nested_envelopes: 2
+//	nested_levels:                            # level 1, then level 2
+//	  - {verify: org_trust}
+//	  - {verify: edge_trust, sign: proxy_key}
+//
+// A level's payload holds the next level when its type URL names the next
+// level's type: nested_levels[i].type, by default the type of the level
+// around it. A level's payload_field, type_url_field, client_sig_field and
+// proxy_sig_field default to the route's envelope fields; verify is none
+// (default), backend_trust or a cms.trust_stores name, and sign none
+// (default), proxy_key or a cms.keys name. Levels past those listed verify
+// and sign nothing.
+//
+// Each level's client signature covers that level's payload field as it
+// arrived. Levels are verified outermost first; one whose signature fails or
+// is missing rejects the request UNAUTHENTICATED (SIGNATURE_INVALID or
+// SIGNATURE_MISSING). Signing goes the other way: the innermost level that
+// signs is signed first and re-encoded into its parent's payload, and so on
+// out to level 0, so a proxy signature at one level covers every level
+// inside it. The client signatures of the levels around a signing level
+// no longer match their payload after that; the route's own signature on
+// level 0, signed last, vouches for them.
+//
+// Requests are rejected INVALID_ARGUMENT when
+//
+//	ENVELOPE_NESTING_TOO_DEEP  level N's payload holds yet another envelope
+//	ENVELOPE_CYCLE             a level carries the client signature of a level
+//	                           around it: an envelope replayed inside itself
+//	ENVELOPE_UNDECODABLE       a level does not decode as its type
+//
+// each with the level in the ErrorInfo. The route's validate_inner,
+// allowed_types and require_fields apply to the innermost payload instead of
+// level 0's. Responses are forwarded as the route handles them today.
+// Verifications are counted in
+// proxy_nested_envelope_verifications_total{route, level, result}.
+
+// NestedLevelConfig is what a route does with one level of nesting
+type NestedLevelConfig struct {
+	Type           string `yaml:"type"`          // the level's message type; default the type of the level around it
+	PayloadField   string `yaml:"payload_field"` // default envelope.payload_field, and so on
+	TypeURLField   string `yaml:"type_url_field"`
+	ClientSigField string `yaml:"client_sig_field"`
+	ProxySigField  string `yaml:"proxy_sig_field"`
+	Verify         string `yaml:"verify"` // none (default), backend_trust or a cms.trust_stores name
+	Sign           string `yaml:"sign"`   // none (default), proxy_key or a cms.keys name
+}
+
+const (
+	reasonNestingTooDeep = "ENVELOPE_NESTING_TOO_DEEP"
+	reasonEnvelopeCycle  = "ENVELOPE_CYCLE"
+	maxNestedEnvelopes   = 16
+)
+
+// nestedLevel is one level's resolved config
+type nestedLevel struct {
+	cfg  NestedLevelConfig
+	plan directionPlan
+}
+
+// routeNesting is a route's nested_envelopes, resolved
+type routeNesting struct {
+	depth  int
+	levels []nestedLevel // depth entries; levels[0] is level 1
+	envs   sync.Map      // nestedEnvKey -> *resolvedEnvelope
+}
+
+type nestedEnvKey struct {
+	level int
+	outer EnvelopeConfig
+	md    *desc.MessageDescriptor
+}
+
+// envelopeConfig is level k's fields over the route's envelope e
+func (n *routeNesting) envelopeConfig(k int, e EnvelopeConfig) EnvelopeConfig {
+	level := EnvelopeConfig{PayloadField: e.PayloadField, TypeURLField: e.TypeURLField, ClientSigField: e.ClientSigField,
+		ProxySigField: e.ProxySigField, AllowTypeCoercion: e.AllowTypeCoercion}
+	cfg := n.levels[k-1].cfg
+	if cfg.PayloadField != "" {
+		level.PayloadField = cfg.PayloadField
+	}
+	if cfg.TypeURLField != "" {
+		level.TypeURLField = cfg.TypeURLField
+	}
+	if cfg.ClientSigField != "" {
+		level.ClientSigField = cfg.ClientSigField
+	}
+	if cfg.ProxySigField != "" {
+		level.ProxySigField = cfg.ProxySigField
+	}
+	return level
+}
+
+// envelope is level k's fields on md
+func (n *routeNesting) envelope(k int, e EnvelopeConfig, md *desc.MessageDescriptor) *resolvedEnvelope {
+	key := nestedEnvKey{level: k, outer: e, md: md}
+	if env, ok := n.envs.Load(key); ok {
+		return env.(*resolvedEnvelope)
+	}
+	env := resolveEnvelope(n.envelopeConfig(k, e), md)
+	n.envs.Store(key, env)
+	return env
+}
+
+// nextNestedType is the type of level k+1 when level k, of type md, carries
+// typeURL, or nil when its payload holds no envelope
+func (px *Proxy) nextNestedType(n *routeNesting, k int, md *desc.MessageDescriptor, typeURL string) *desc.MessageDescriptor {
+	if n == nil || typeURL == "" {
+		return nil
+	}
+	next := md
+	if k < n.depth && n.levels[k].cfg.Type != "" {
+		next = px.findDescByType(n.levels[k].cfg.Type)
+	}
+	if next == nil || !typeNameMatches(next.GetFullyQualifiedName(), typeName(typeURL)) {
+		return nil
+	}
+	return next
+}
+
+// nestedFrame is one decoded level of a request
+type nestedFrame struct {
+	msg *dynamic.Message
+	env *resolvedEnvelope
+}
+
+// nestedRejection rejects a request for what it found at level k
+func nestedRejection(code codes.Code, reason string, k int, format string, args ...interface{}) error {
+	return rejectf(code, reason, "proxy: nested envelope level %d: "+format, append([]interface{}{k}, args...)...).with("level", strconv.Itoa(k))
+}
+
+// processNested walks the envelopes inside a request's outer envelope msg,
+// verifies and signs them as the route's levels say, and writes them back
+// into msg's payload, reporting whether it did
+func (px *Proxy) processNested(ctx context.Context, info MethodInfo, msg *dynamic.Message) (bool, error) {
+	route := info.Route
+	n := px.routeNesting[route.Name]
+	if n == nil {
+		return false, nil
+	}
+	frames := []nestedFrame{{msg: msg, env: info.envelope}}
+	sigs := map[string]int{}
+	if sig := info.envelope.clientSigOf(ctx, msg, true); len(sig) > 0 {
+		sigs[string(sig)] = 0
+	}
+	typeURL := info.envelope.typeURLOf(ctx, msg, true)
+	for {
+		k := len(frames) - 1
+		parent := frames[k]
+		next := px.nextNestedType(n, k, parent.env.msg, typeURL)
+		if next == nil {
+			break
+		}
+		if k == n.depth {
+			log.Printf("[Request Security Error] %s: envelopes nest deeper than nested_envelopes: %d", info.Method, n.depth)
+			return false, nestedRejection(codes.InvalidArgument, reasonNestingTooDeep, k, "the payload holds another %s, past nested_envelopes: %d", next.GetFullyQualifiedName(), n.depth)
+		}
+		payload := getBytesField(parent.msg, parent.env.payload)
+		if err := px.guardDecode(route, info.Method, "nested envelope", next, payload); err != nil {
+			return false, err
+		}
+		level := dynamic.NewMessage(next)
+		if err := level.Unmarshal(payload); err != nil {
+			return false, nestedRejection(codes.InvalidArgument, reasonEnvelopeUndecodable, k+1, "does not decode as %s: %v", next.GetFullyQualifiedName(), err)
+		}
+		env := n.envelope(k+1, route.Envelope, next)
+		if sig := getBytesField(level, env.clientSig); len(sig) > 0 {
+			if outer, seen := sigs[string(sig)]; seen {
+				return false, nestedRejection(codes.InvalidArgument, reasonEnvelopeCycle, k+1, "carries the client signature of level %d", outer)
+			}
+			sigs[string(sig)] = k + 1
+		}
+		frames = append(frames, nestedFrame{msg: level, env: env})
+		typeURL = getStringField(level, env.typeURL)
+	}
+	if len(frames) == 1 {
+		return false, nil
+	}
+
+	// Verify outermost first, each level against its payload as it came
+	for k := 1; k < len(frames); k++ {
+		if err := px.verifyNested(ctx, info, n.levels[k-1].plan, k, frames[k]); err != nil {
+			return false, err
+		}
+	}
+	inner := frames[len(frames)-1]
+	payload := getBytesField(inner.msg, inner.env.payload)
+	innerMsg, innerErr := px.decodeInner(typeURL, payload)
+	if err := px.checkInner(route, typeURL, innerMsg, innerErr); err != nil {
+		log.Printf("[Request Rejected] %s: %v", info.Method, err)
+		return false, err
+	}
+
+	// Then sign innermost first, re-encoding each level into its parent
+	changed := false
+	for k := len(frames) - 1; k >= 1; k-- {
+		f, plan := frames[k], n.levels[k-1].plan
+		if plan.signs {
+			if err := px.signNested(ctx, info, plan.key, k, f); err != nil {
+				return false, err
+			}
+		} else if !changed {
+			continue
+		}
+		out, err := marshalDynamic(f.msg)
+		if err != nil {
+			return false, err
+		}
+		if err := setEnvelopeField(frames[k-1].msg, frames[k-1].env.payload, out); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// verifyNested checks level k's client signature as plan says
+func (px *Proxy) verifyNested(ctx context.Context, info MethodInfo, plan directionPlan, k int, f nestedFrame) error {
+	if !plan.verifies() {
+		return nil
+	}
+	route := info.Route
+	payload := getBytesField(f.msg, f.env.payload)
+	verified, err := px.verifyTrusted(ctx, route, plan.trust, "Request", payload, payloadDigest(sha256.Sum256(payload)), getBytesField(f.msg, f.env.clientSig))
+	if err != nil {
+		return skipCancelled(ctx, route, true, "verify")
+	}
+	verified.reason = fmt.Sprintf("nested level %d", k)
+	metrics.Inc("proxy_nested_envelope_verifications_total", Labels{"route": route.Name, "level": strconv.Itoa(k), "result": verified.decision})
+	if err := px.audit(ctx, info.Method, route, true, verified); err != nil {
+		return err
+	}
+	switch verified.decision {
+	case "missing":
+		return nestedRejection(codes.Unauthenticated, reasonSignatureMissing, k, "carries no client signature to verify against %s", plan.trust.name)
+	case "failed":
+		return nestedRejection(codes.Unauthenticated, reasonSignatureInvalid, k, "client signature does not verify against %s", plan.trust.name)
+	}
+	return nil
+}
+
+// signNested signs level k's payload with key into its proxy signature field
+func (px *Proxy) signNested(ctx context.Context, info MethodInfo, key *signingKey, k int, f nestedFrame) error {
+	route := info.Route
+	payload := getBytesField(f.msg, f.env.payload)
+	sig, decision, err := px.signPayload(ctx, route, key, "Request", payloadDigest(sha256.Sum256(payload)))
+	if err != nil {
+		return skipCancelled(ctx, route, true, "sign")
+	}
+	signed := auditEvent{op: "sign", signer: "proxy", decision: decision, reason: fmt.Sprintf("nested level %d", k), payload: payload, keyID: key.id()}
+	if err := px.audit(ctx, info.Method, route, true, signed); err != nil {
+		return err
+	}
+	if decision != "signed" {
+		return nestedRejection(codes.Internal, reasonSigningFailed, k, "could not sign the payload")
+	}
+	return setEnvelopeField(f.msg, f.env.proxySig, sig)
+}
+
+// loadNestedEnvelopes resolves each route's nested_envelopes and
+// nested_levels
+func (px *Proxy) loadNestedEnvelopes(diag *Diagnostics) {
+	for i := range px.cfg.Routes {
+		route := &px.cfg.Routes[i]
+		if route.NestedEnvelopes == 0 && len(route.NestedLevels) == 0 {
+			continue
+		}
+		path := fmt.Sprintf("routes[%d]", i)
+		switch {
+		case route.NestedEnvelopes < 0 || route.NestedEnvelopes > maxNestedEnvelopes:
+			diag.Errorf("routes", "ROUTE_NESTED_ENVELOPES", path+".nested_envelopes", "%d is not between 1 and %d", route.NestedEnvelopes, maxNestedEnvelopes)
+			continue
+		case route.NestedEnvelopes == 0:
+			diag.Errorf("routes", "ROUTE_NESTED_ENVELOPES", path+".nested_levels", "nested_levels needs nested_envelopes")
+			continue
+		case len(route.NestedLevels) > route.NestedEnvelopes:
+			diag.Errorf("routes", "ROUTE_NESTED_ENVELOPES", path+".nested_levels", "%d levels listed for nested_envelopes: %d", len(route.NestedLevels), route.NestedEnvelopes)
+			continue
+		case route.Mode != "inspect-verify-sign":
+			diag.Errorf("routes", "ROUTE_NESTED_ENVELOPES", path+".nested_envelopes", "nested envelopes are walked on inspect-verify-sign routes only")
+			continue
+		}
+		n := &routeNesting{depth: route.NestedEnvelopes, levels: make([]nestedLevel, route.NestedEnvelopes)}
+		ok := true
+		for j := range n.levels {
+			lvl := &n.levels[j]
+			lvl.plan = directionPlan{verify: verbNone}
+			if j >= len(route.NestedLevels) {
+				continue
+			}
+			lvl.cfg = route.NestedLevels[j]
+			lp := fmt.Sprintf("%s.nested_levels[%d]", path, j)
+			if lvl.cfg.Verify == verbClientTrust {
+				diag.Errorf("routes", "ROUTE_NESTED_ENVELOPES", lp+".verify", "client_trust verifies level 0; name a cms.trust_stores entry")
+				ok = false
+				continue
+			}
+			ok = px.resolveDirection(&lvl.plan, &DirectionCryptoConfig{Verify: lvl.cfg.Verify, Sign: lvl.cfg.Sign}, true, lp, diag) && ok
+			if lvl.plan.signs && route.PreserveWireBytes {
+				diag.Errorf("routes", "ROUTE_NESTED_ENVELOPES", lp+".sign", "signing a nested level rewrites the payload, which preserve_wire_bytes forwards as it came")
+				ok = false
+			}
+			if lvl.cfg.Type != "" && px.lazySchema == nil && px.findDescByType(lvl.cfg.Type) == nil {
+				diag.Warnf("routes", "ROUTE_NESTED_ENVELOPES", lp+".type", "no loaded message type is named %q", lvl.cfg.Type)
+			}
+		}
+		for _, v := range envelopeVariants(route) {
+			if v.Envelope.ItemsField != "" {
+				diag.Errorf("routes", "ROUTE_NESTED_ENVELOPES", path+".envelope.items_field", "batch envelopes carry no payload to nest envelopes in")
+				ok = false
+				break
+			}
+			for k := 1; k <= n.depth; k++ {
+				e := n.envelopeConfig(k, v.Envelope)
+				lp := fmt.Sprintf("%s.nested_levels[%d]", path, k-1)
+				fields := []struct{ key, name string }{{"payload_field", e.PayloadField}, {"type_url_field", e.TypeURLField}}
+				if n.levels[k-1].plan.verifies() {
+					fields = append(fields, struct{ key, name string }{"client_sig_field", e.ClientSigField})
+				}
+				for _, f := range fields {
+					if _, header := metadataSource(f.name); header || f.name == "" {
+						diag.Errorf("routes", "ROUTE_NESTED_ENVELOPES", lp+"."+f.key, "nested levels read their %s from the level's own envelope; name a field", f.key)
+						ok = false
+					}
+				}
+				if n.levels[k-1].plan.signs && e.ProxySigField == "" {
+					diag.Errorf("routes", "ROUTE_NESTED_ENVELOPES", lp+".proxy_sig_field", "signing level %d needs a proxy_sig_field", k)
+					ok = false
+				}
+			}
+		}
+		if !ok {
+			continue
+		}
+		if _, dup := px.routeNesting[route.Name]; !dup {
+			px.routeNesting[route.Name] = n
+			log.Printf("[Route] %s walks up to %d nested envelopes", route.Name, n.depth)
+		}
+	}
+}
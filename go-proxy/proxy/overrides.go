@@ -0,0 +1,378 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// --- Route Overrides ---
+//
+// During an incident a route can be switched off without editing the config.
+// With admin.route_overrides.enabled the admin listener takes
+//
+//	POST /routes/override {"route": "secure", "action": "force-pass-thru", "ttl": "15m", "reason": "INC-42"}
+//
+// from the operators listed in admin.route_overrides.operators, each a name
+// and the hex SHA-256 of the token they send as "Authorization: Bearer
+// <token>". A POST without a known token is 401, and one that is not
+// Content-Type application/json is 415, so a browser page cannot forge one
+// with a simple cross-origin form or text/plain request. route is a route name, or "*" for every route (the global kill
+// switch), and action one of
+//
+//	force-pass-thru  the route's calls are forwarded untouched, as on the
+//	                 default route: nothing is decoded, verified or signed,
+//	                 and none of the route's limits, mirror or cache apply
+//	force-reject     the route's calls fail UNAVAILABLE with the ErrorInfo
+//	                 reason ROUTE_DISABLED before anything else runs
+//	restore-config   the override is removed and the route runs as configured
+//
+// ttl, optional, restores the route by itself once it passes. A route's own
+// override wins over the global one, and neither applies to the built-in
+// reflection and health pass-thru. GET /routes/override lists the overrides
+// in effect, and /routes shows each route's, with who set it, when and until
+// when; by is the operator the token names. With
+// admin.route_overrides.sigusr1 the process also cycles the global override
+// on each SIGUSR1: force-pass-thru, then force-reject, then restore-config.
+//
+// Every change is logged, written to the audit log as an "override" record
+// naming the route, the action and who made it, and counted in
+// proxy_route_overrides_total{route, action}. The routes are read once at
+// startup, so there is no config reload for an override to outlast;
+// overrides live in memory and end with the process. matchRoute consults
+// them after matching, at the cost of one atomic load while none is set.
+
+// RouteOverridesConfig enables runtime route overrides
+type RouteOverridesConfig struct {
+	Enabled bool `yaml:"enabled"` // serve POST /routes/override on the admin listener
+	SIGUSR1 bool `yaml:"sigusr1"` // cycle the global override on SIGUSR1
+	// Operators may POST overrides: each name's hex SHA-256 bearer token
+	Operators map[string]string `yaml:"operators"`
+}
+
+// Override actions
+const (
+	overridePassThru = "force-pass-thru"
+	overrideReject   = "force-reject"
+	overrideRestore  = "restore-config"
+	overrideAllRoute = "*"
+	reasonRouteOff   = "ROUTE_DISABLED"
+)
+
+// routeOverride is one override in effect
+type routeOverride struct {
+	Route   string     `json:"route"`
+	Action  string     `json:"action"`
+	By      string     `json:"by"`
+	Reason  string     `json:"reason,omitempty"`
+	Set     time.Time  `json:"set"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// routeOverrides is a snapshot of the overrides in effect; it is replaced
+// whole, never changed
+type routeOverrides struct {
+	byRoute map[string]*routeOverride
+	global  *routeOverride
+}
+
+// of is the override that applies to the route named name, or nil
+func (o *routeOverrides) of(name string) *routeOverride {
+	if ov := o.byRoute[name]; ov != nil {
+		return ov
+	}
+	if name == builtinRouteName {
+		return nil
+	}
+	return o.global
+}
+
+// apply is route as its override has it
+func (o *routeOverrides) apply(route *RouteConfig) *RouteConfig {
+	ov := o.of(route.Name)
+	if ov == nil {
+		return route
+	}
+	return &RouteConfig{Name: route.Name, Description: route.Description, Mode: "pass-thru", override: ov}
+}
+
+// overrideStore holds the overrides and serialises changes to them
+type overrideStore struct {
+	current atomic.Pointer[routeOverrides] // nil while no override is set
+
+	// operators and digests are admin.route_overrides.operators, by name
+	operators []string
+	digests   [][]byte
+
+	mu     sync.Mutex
+	timers map[string]*time.Timer // expiries, by route
+	cycle  int                    // the SIGUSR1 position
+}
+
+// overrideChange is one change made, reported once the lock is released
+type overrideChange struct {
+	route, action, by, note string
+}
+
+// operator is the operator whose token authorises r, or ""
+func (s *overrideStore) operator(r *http.Request) string {
+	token, ok := cutPrefixFold(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return ""
+	}
+	if i := tokenMatch(token, s.digests); i >= 0 {
+		return s.operators[i]
+	}
+	return ""
+}
+
+// list is the overrides in effect, by route
+func (s *overrideStore) list() []*routeOverride {
+	o := s.current.Load()
+	if o == nil {
+		return []*routeOverride{}
+	}
+	out := make([]*routeOverride, 0, len(o.byRoute)+1)
+	if o.global != nil {
+		out = append(out, o.global)
+	}
+	for _, ov := range o.byRoute {
+		out = append(out, ov)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Route < out[j].Route })
+	return out
+}
+
+// overrideRejection fails a call on a force-reject route
+func overrideRejection(route *RouteConfig) error {
+	ov := route.override
+	if ov == nil || ov.Action != overrideReject {
+		return nil
+	}
+	r := rejectf(codes.Unavailable, reasonRouteOff, "proxy: route %s is disabled", route.Name).with("by", ov.By)
+	if ov.Expires != nil {
+		r = r.with("expires", ov.Expires.UTC().Format(time.RFC3339))
+	}
+	return r
+}
+
+// setOverride applies action to route (a name or "*"), restoring it after
+// ttl when ttl is positive
+func (px *Proxy) setOverride(route, action, by, reason string, ttl time.Duration) error {
+	if route != overrideAllRoute && route != defaultRouteName && !px.routeNames[route] {
+		return fmt.Errorf("no route named %q", route)
+	}
+	switch action {
+	case overridePassThru, overrideReject, overrideRestore:
+	default:
+		return fmt.Errorf("unknown action %q; want %s, %s or %s", action, overridePassThru, overrideReject, overrideRestore)
+	}
+	px.overrides.mu.Lock()
+	change := px.changeOverrideLocked(route, action, by, reason, ttl)
+	px.overrides.mu.Unlock()
+	px.reportOverride(change)
+	return nil
+}
+
+// changeOverrideLocked replaces the snapshot with route's override changed.
+// The change is reported by the caller, after it releases the lock, so a
+// full audit queue never holds up the calls that read the overrides.
+func (px *Proxy) changeOverrideLocked(route, action, by, reason string, ttl time.Duration) overrideChange {
+	s := px.overrides
+	next := &routeOverrides{byRoute: map[string]*routeOverride{}}
+	if cur := s.current.Load(); cur != nil {
+		next.global = cur.global
+		for name, ov := range cur.byRoute {
+			next.byRoute[name] = ov
+		}
+	}
+	if t := s.timers[route]; t != nil {
+		t.Stop()
+		delete(s.timers, route)
+	}
+	var ov *routeOverride
+	if action != overrideRestore {
+		ov = &routeOverride{Route: route, Action: action, By: by, Reason: reason, Set: time.Now().UTC()}
+		if ttl > 0 {
+			expires := ov.Set.Add(ttl)
+			ov.Expires = &expires
+			s.timers[route] = time.AfterFunc(ttl, func() { px.expireOverride(ov) })
+		}
+	}
+	if route == overrideAllRoute {
+		next.global = ov
+	} else if ov != nil {
+		next.byRoute[route] = ov
+	} else {
+		delete(next.byRoute, route)
+	}
+	if next.global == nil && len(next.byRoute) == 0 {
+		next = nil
+	}
+	s.current.Store(next)
+
+	note := reason
+	if ov != nil && ov.Expires != nil {
+		note = fmt.Sprintf("%s (until %s)", reason, ov.Expires.Format(time.RFC3339))
+	}
+	return overrideChange{route: route, action: action, by: by, note: note}
+}
+
+// reportOverride logs, counts and audits a change
+func (px *Proxy) reportOverride(c overrideChange) {
+	log.Printf("[Override] %s set route %s to %s: %s", c.by, c.route, c.action, c.note)
+	metrics.Inc("proxy_route_overrides_total", Labels{"route": c.route, "action": c.action})
+	px.auditOverride(c.route, c.action, c.by, c.note)
+}
+
+// expireOverride restores ov's route, unless ov has been replaced since
+func (px *Proxy) expireOverride(ov *routeOverride) {
+	px.overrides.mu.Lock()
+	if cur := px.overrides.current.Load(); cur == nil || (cur.byRoute[ov.Route] != ov && cur.global != ov) {
+		px.overrides.mu.Unlock()
+		return
+	}
+	change := px.changeOverrideLocked(ov.Route, overrideRestore, "expiry", fmt.Sprintf("%s set by %s expired", ov.Action, ov.By), 0)
+	px.overrides.mu.Unlock()
+	px.reportOverride(change)
+}
+
+// cycleGlobalOverride moves the global override on a step: force-pass-thru,
+// force-reject, restore-config
+func (px *Proxy) cycleGlobalOverride() {
+	steps := []string{overridePassThru, overrideReject, overrideRestore}
+	px.overrides.mu.Lock()
+	action := steps[px.overrides.cycle%len(steps)]
+	px.overrides.cycle++
+	change := px.changeOverrideLocked(overrideAllRoute, action, "SIGUSR1", "signal", 0)
+	px.overrides.mu.Unlock()
+	px.reportOverride(change)
+}
+
+// auditOverride writes an override change to the audit log
+func (px *Proxy) auditOverride(route, action, by, reason string) {
+	w := px.auditor
+	if w == nil {
+		return
+	}
+	sum := sha256.Sum256(nil)
+	rec := &auditRecord{
+		Time:          time.Now().UTC().Format(time.RFC3339Nano),
+		Route:         route,
+		Op:            "override",
+		Decision:      action,
+		Reason:        reason,
+		Actor:         by,
+		PayloadSHA256: hex.EncodeToString(sum[:]),
+	}
+	select {
+	case w.queue <- rec:
+	case <-w.done:
+	}
+}
+
+// overrideRequest is the body of POST /routes/override
+type overrideRequest struct {
+	Route  string `json:"route"`
+	Action string `json:"action"`
+	TTL    string `json:"ttl"`
+	Reason string `json:"reason"`
+}
+
+// overrideHandler serves /routes/override: GET lists the overrides, POST
+// changes one for an operator
+func (px *Proxy) overrideHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+			http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+		by := px.overrides.operator(r)
+		if by == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="route overrides"`)
+			http.Error(w, "an operator token is required", http.StatusUnauthorized)
+			return
+		}
+		var req overrideRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad override request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var ttl time.Duration
+		if req.TTL != "" {
+			d, err := time.ParseDuration(req.TTL)
+			if err != nil || d <= 0 {
+				http.Error(w, fmt.Sprintf("invalid ttl %q", req.TTL), http.StatusBadRequest)
+				return
+			}
+			ttl = d
+		}
+		if err := px.setOverride(req.Route, req.Action, by, req.Reason, ttl); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	body, _ := json.MarshalIndent(px.overrides.list(), "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// loadRouteOverrides checks admin.route_overrides and, with sigusr1, starts
+// listening for the signal
+func (px *Proxy) loadRouteOverrides(diag *Diagnostics) {
+	for _, route := range px.cfg.Routes {
+		px.routeNames[route.Name] = true
+	}
+	cfg := px.cfg.Admin.RouteOverrides
+	if cfg.Enabled && px.cfg.Admin.ListenAddress == "" {
+		diag.Warnf("admin", "ADMIN_ROUTE_OVERRIDES", "admin.route_overrides.enabled", "route overrides are served on the admin listener, and admin.listen_address is not set")
+	}
+	if cfg.Enabled && len(cfg.Operators) == 0 {
+		diag.Errorf("admin", "ADMIN_ROUTE_OVERRIDES", "admin.route_overrides.operators", "route overrides need at least one operator to accept them from")
+	}
+	names := make([]string, 0, len(cfg.Operators))
+	for name := range cfg.Operators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d, ok := tokenDigest(cfg.Operators[name])
+		if !ok {
+			diag.Errorf("admin", "ADMIN_ROUTE_OVERRIDES", "admin.route_overrides.operators."+name, "not a hex SHA-256 digest")
+			continue
+		}
+		px.overrides.operators = append(px.overrides.operators, name)
+		px.overrides.digests = append(px.overrides.digests, d)
+	}
+	if cfg.SIGUSR1 {
+		if !notifyOverrideSignal(px.cycleGlobalOverride, px.stop) {
+			diag.Warnf("admin", "ADMIN_ROUTE_OVERRIDES", "admin.route_overrides.sigusr1", "this platform has no SIGUSR1")
+		}
+	}
+}
+
+// stopOverrides cancels the pending expiries
+func (px *Proxy) stopOverrides() {
+	px.overrides.mu.Lock()
+	defer px.overrides.mu.Unlock()
+	for route, t := range px.overrides.timers {
+		t.Stop()
+		delete(px.overrides.timers, route)
+	}
+}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package proxy
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyOverrideSignal calls cycle on each SIGUSR1 until stop closes
+func notifyOverrideSignal(cycle func(), stop <-chan struct{}) bool {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-sigs:
+				cycle()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return true
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package proxy
+
+// notifyOverrideSignal reports that there is no SIGUSR1 to listen for
+func notifyOverrideSignal(func(), <-chan struct{}) bool {
+	return false
+}
@@ -0,0 +1,363 @@
+package proxy
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// --- Payload Encryption ---
+//
+// On encrypt-payload routes the proxy seals envelope.payload_field with
+// AES-256-GCM before forwarding a request, storing the random 96-bit nonce in
+// envelope.nonce_field, and opens the payload of each response the same way.
+// The key is either cms.payload_key, shared with the backend, or a fresh key
+// per request wrapped with RSA-OAEP (SHA-256) for cms.backend_encryption_cert
+// into envelope.wrapped_key_field; the backend then wraps its response key
+// for the proxy's certificate, which the proxy unwraps with proxy_private_key.
+//
+// A response that does not decode or fails authentication is rejected, as is
+// any message on these routes that cannot be decoded at all: neither
+// ciphertext nor plaintext is ever passed through unprocessed.
+
+// cryptSlot is an envelope field holding binary key material: a bytes field,
+// or a string field or map<string,string> entry ("metadata[nonce]") holding
+// standard base64
+type cryptSlot struct {
+	field  string
+	key    string
+	hasKey bool
+}
+
+func parseCryptSlot(s string) (cryptSlot, error) {
+	slot := cryptSlot{field: s}
+	if open := strings.Index(s, "["); open >= 0 {
+		if !strings.HasSuffix(s, "]") || open == len(s)-2 || open == 0 {
+			return slot, fmt.Errorf("malformed map key in %q", s)
+		}
+		slot.field, slot.key, slot.hasKey = s[:open], s[open+1:len(s)-1], true
+	}
+	if slot.field == "" || strings.Contains(slot.field, ".") {
+		return slot, fmt.Errorf("%q must name a top-level field of the envelope", s)
+	}
+	return slot, nil
+}
+
+// check verifies md has a field the slot can hold bytes in
+func (s cryptSlot) check(md *desc.MessageDescriptor) error {
+	fd := md.FindFieldByName(s.field)
+	if fd == nil {
+		return fmt.Errorf("%s has no field %q", md.GetFullyQualifiedName(), s.field)
+	}
+	if s.hasKey {
+		if !fd.IsMap() || fd.GetMapKeyType().GetType() != descriptorpb.FieldDescriptorProto_TYPE_STRING ||
+			fd.GetMapValueType().GetType() != descriptorpb.FieldDescriptorProto_TYPE_STRING {
+			return fmt.Errorf("%s is not a map<string,string> field", fd.GetFullyQualifiedName())
+		}
+		return nil
+	}
+	if t := fd.GetType(); fd.IsRepeated() || (t != descriptorpb.FieldDescriptorProto_TYPE_BYTES && t != descriptorpb.FieldDescriptorProto_TYPE_STRING) {
+		return fmt.Errorf("%s must be a singular bytes or string field", fd.GetFullyQualifiedName())
+	}
+	return nil
+}
+
+func (s cryptSlot) get(msg *dynamic.Message) ([]byte, error) {
+	fd := msg.GetMessageDescriptor().FindFieldByName(s.field)
+	if fd == nil {
+		return nil, fmt.Errorf("no field %q", s.field)
+	}
+	var v interface{}
+	if s.hasKey {
+		var err error
+		if v, err = msg.TryGetMapField(fd, s.key); err != nil {
+			return nil, err
+		}
+	} else {
+		v, _ = fieldValue(msg, fd)
+	}
+	switch v := v.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return base64.StdEncoding.DecodeString(v)
+	}
+	return nil, nil
+}
+
+func (s cryptSlot) set(msg *dynamic.Message, b []byte) error {
+	fd := msg.GetMessageDescriptor().FindFieldByName(s.field)
+	if fd == nil {
+		return fmt.Errorf("no field %q", s.field)
+	}
+	if s.hasKey {
+		return msg.TryPutMapField(fd, s.key, base64.StdEncoding.EncodeToString(b))
+	}
+	if fd.GetType() == descriptorpb.FieldDescriptorProto_TYPE_STRING {
+		return setEnvelopeField(msg, fd, base64.StdEncoding.EncodeToString(b))
+	}
+	return setEnvelopeField(msg, fd, b)
+}
+
+func (s cryptSlot) clear(msg *dynamic.Message) {
+	fd := msg.GetMessageDescriptor().FindFieldByName(s.field)
+	if fd == nil {
+		return
+	}
+	if s.hasKey {
+		msg.TryRemoveMapField(fd, s.key)
+	} else {
+		msg.TryClearField(fd)
+	}
+}
+
+// payloadCipher is a route's encryption setup, parsed at startup
+type payloadCipher struct {
+	nonce   cryptSlot
+	wrapped *cryptSlot // nil when the static payload key is used
+}
+
+// cryptRejection fails the call. Only a request envelope that cannot be read
+// is the client's fault; everything else is INTERNAL.
+func cryptRejection(route *RouteConfig, isReq bool, reason, format string, args ...interface{}) error {
+	op, code, detail := "decrypt", codes.Internal, reasonDecryptionFailed
+	if isReq {
+		op, detail = "encrypt", reasonEncryptionFailed
+		if reason == "undecodable" {
+			code = codes.InvalidArgument
+		}
+	}
+	if reason == "undecodable" {
+		detail = reasonEnvelopeUndecodable
+	}
+	metrics.Inc("proxy_payload_crypto_total", Labels{"route": route.Name, "op": op, "result": reason, "shadow": shadowLabel(route)})
+	return rejectf(code, detail, "proxy: "+format, args...)
+}
+
+// cryptPayload encrypts a request's payload or decrypts a response's.
+// Mutations and processors run on the plaintext side: before sealing, after
+// opening.
+func (px *Proxy) cryptPayload(ctx context.Context, msg *dynamic.Message, info MethodInfo, isReq bool, dir string) ([]byte, error) {
+	route, method := info.Route, info.Method
+	pc := px.routeCiphers[route.Name]
+	if pc == nil {
+		return nil, cryptRejection(route, isReq, "unconfigured", "no payload encryption is configured for route %q", route.Name)
+	}
+	field := info.envelope.payload
+	payload := getBytesField(msg, field)
+
+	op, keyName, plain := "decrypt", payloadKeyID(px.payloadKey), payload
+	if isReq {
+		op = "encrypt"
+		px.mutateEnvelope(msg, route, isReq, dir, method)
+		if _, err := px.bindTransportIdentity(ctx, msg, route, method); err != nil {
+			return nil, err
+		}
+		if err := px.plaintextProcessors(ctx, info, isReq, msg); err != nil {
+			return nil, err
+		}
+		payload = getBytesField(msg, field)
+		plain = payload
+
+		key := px.payloadKey
+		if pc.wrapped != nil {
+			keyName = keyID(px.backendEncryptionKey)
+			key = make([]byte, 32)
+			rand.Read(key)
+			wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, px.backendEncryptionKey, key, nil)
+			if err != nil {
+				return nil, cryptRejection(route, isReq, "failed", "wrap payload key: %v", err)
+			}
+			if err := pc.wrapped.set(msg, wrapped); err != nil {
+				return nil, cryptRejection(route, isReq, "failed", "set %s: %v", route.Envelope.WrappedKeyField, err)
+			}
+		}
+		gcm, err := newGCM(key)
+		if err != nil {
+			return nil, cryptRejection(route, isReq, "failed", "%v", err)
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		rand.Read(nonce)
+		if err := pc.nonce.set(msg, nonce); err != nil {
+			return nil, cryptRejection(route, isReq, "failed", "set %s: %v", route.Envelope.NonceField, err)
+		}
+		if err := setEnvelopeField(msg, field, gcm.Seal(nil, nonce, payload, nil)); err != nil {
+			return nil, cryptRejection(route, isReq, "failed", "set %s: %v", route.Envelope.PayloadField, err)
+		}
+		log.Printf("[%s Security] Encrypted payload (len: %d) for %s", dir, len(payload), method)
+	} else {
+		key := px.payloadKey
+		if pc.wrapped != nil {
+			priv := px.proxyKey.load().priv
+			keyName = keyID(&priv.PublicKey)
+			wrapped, err := pc.wrapped.get(msg)
+			if err != nil || len(wrapped) == 0 {
+				return nil, cryptRejection(route, isReq, "missing_key", "response carries no wrapped payload key")
+			}
+			if key, err = rsa.DecryptOAEP(sha256.New(), nil, priv, wrapped, nil); err != nil {
+				return nil, cryptRejection(route, isReq, "failed", "response payload key does not unwrap")
+			}
+			pc.wrapped.clear(msg)
+		}
+		nonce, err := pc.nonce.get(msg)
+		gcm, gcmErr := newGCM(key)
+		if gcmErr != nil {
+			return nil, cryptRejection(route, isReq, "failed", "%v", gcmErr)
+		}
+		if err != nil || len(nonce) != gcm.NonceSize() {
+			return nil, cryptRejection(route, isReq, "bad_nonce", "response carries no valid nonce")
+		}
+		plain, err = gcm.Open(nil, nonce, payload, nil)
+		if err != nil {
+			log.Printf("[%s Security Error] Payload of %s failed authentication", dir, method)
+			return nil, cryptRejection(route, isReq, "failed", "response payload failed to decrypt")
+		}
+		pc.nonce.clear(msg)
+		if err := setEnvelopeField(msg, field, plain); err != nil {
+			return nil, cryptRejection(route, isReq, "failed", "set %s: %v", route.Envelope.PayloadField, err)
+		}
+		px.mutateEnvelope(msg, route, isReq, dir, method)
+		if err := px.plaintextProcessors(ctx, info, isReq, msg); err != nil {
+			return nil, err
+		}
+		log.Printf("[%s Security] Decrypted payload (len: %d) for %s", dir, len(plain), method)
+	}
+
+	out, err := marshalDynamic(msg)
+	if err != nil {
+		return nil, cryptRejection(route, isReq, "failed", "encode envelope: %v", err)
+	}
+	metrics.Inc("proxy_payload_crypto_total", Labels{"route": route.Name, "op": op, "result": "ok", "shadow": shadowLabel(route)})
+	debugCrypto.Add("go."+op, 1) // AES-GCM is always done in Go
+	if err := px.audit(ctx, method, route, isReq, auditEvent{op: op, decision: "ok", payload: plain, keyID: keyName}); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// plaintextProcessors runs the route's processors on a decrypted envelope. A
+// processor may not replace the message here, since the bytes it returns would
+// bypass encryption.
+func (px *Proxy) plaintextProcessors(ctx context.Context, info MethodInfo, isReq bool, msg *dynamic.Message) error {
+	out, err := px.runProcessors(ctx, info, directionOf(isReq), msg, info.Route.Processors)
+	if err != nil {
+		return err
+	}
+	if out != nil {
+		return cryptRejection(info.Route, isReq, "failed", "a processor replaced the message, which encrypt-payload routes do not allow")
+	}
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// loadPayloadKey reads a base64-encoded 32-byte AES key
+func (px *Proxy) loadPayloadKey(path string, diag *Diagnostics) {
+	b, _, err := px.readSecret(path)
+	if err != nil {
+		diag.Errorf("cms", "CMS_PAYLOAD_KEY", "cms.payload_key", "failed to read payload key: %v", err)
+		return
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) != 32 {
+		diag.Errorf("cms", "CMS_PAYLOAD_KEY", "cms.payload_key", "%s must hold a base64-encoded 32-byte key", path)
+		return
+	}
+	px.payloadKey = key
+}
+
+// loadBackendEncryptionCert reads the RSA key per-request payload keys are wrapped for
+func (px *Proxy) loadBackendEncryptionCert(path string, diag *Diagnostics) {
+	keys, err := px.readCertKeys(path)
+	if err != nil {
+		diag.Errorf("cms", "CMS_BACKEND_ENCRYPTION_CERT", "cms.backend_encryption_cert", "failed to load backend encryption certificate: %v", err)
+		return
+	}
+	px.backendEncryptionKey = keys[0]
+}
+
+// loadPayloadEncryption checks each encrypt-payload route's fields and key material
+func (px *Proxy) loadPayloadEncryption(diag *Diagnostics) {
+	methods := px.knownMethods()
+	for i, route := range px.cfg.Routes {
+		path := fmt.Sprintf("routes[%d].envelope", i)
+		if route.Mode != "encrypt-payload" {
+			if route.Envelope.NonceField != "" || route.Envelope.WrappedKeyField != "" {
+				diag.Warnf("routes", "ROUTE_ENCRYPTION", path, "nonce_field and wrapped_key_field are ignored unless mode is encrypt-payload")
+			}
+			continue
+		}
+		if route.Envelope.PayloadField == "" || route.Envelope.NonceField == "" {
+			diag.Errorf("routes", "ROUTE_ENCRYPTION", path, "mode encrypt-payload needs envelope.payload_field and envelope.nonce_field")
+			continue
+		}
+		pc := &payloadCipher{}
+		var err error
+		if pc.nonce, err = parseCryptSlot(route.Envelope.NonceField); err != nil {
+			diag.Errorf("routes", "ROUTE_ENCRYPTION", path+".nonce_field", "%v", err)
+			continue
+		}
+		slots := map[string]cryptSlot{"nonce_field": pc.nonce}
+		if route.Envelope.WrappedKeyField != "" {
+			w, err := parseCryptSlot(route.Envelope.WrappedKeyField)
+			if err != nil {
+				diag.Errorf("routes", "ROUTE_ENCRYPTION", path+".wrapped_key_field", "%v", err)
+				continue
+			}
+			pc.wrapped = &w
+			slots["wrapped_key_field"] = w
+			if px.backendEncryptionKey == nil || px.proxyKey == nil {
+				diag.Errorf("routes", "ROUTE_ENCRYPTION", path+".wrapped_key_field", "wrapped payload keys need cms.backend_encryption_cert and cms.proxy_private_key")
+				continue
+			}
+		} else if px.payloadKey == nil {
+			diag.Errorf("routes", "ROUTE_ENCRYPTION", path, "mode encrypt-payload needs cms.payload_key, or envelope.wrapped_key_field for per-message keys")
+			continue
+		}
+
+		valid := true
+		seen := make(map[string]bool)
+		for _, name := range methods {
+			if !route.matches(name) || px.shadowedByBuiltin(route, name) {
+				continue
+			}
+			md, ok := px.lookupMethod(name)
+			if !ok {
+				continue
+			}
+			for key, slot := range slots {
+				for _, t := range []*desc.MessageDescriptor{md.GetInputType(), md.GetOutputType()} {
+					if seen[key+" "+t.GetFullyQualifiedName()] {
+						continue
+					}
+					seen[key+" "+t.GetFullyQualifiedName()] = true
+					if err := slot.check(t); err != nil {
+						diag.Errorf("routes", "ROUTE_ENCRYPTION", path+"."+key, "%s: %v", name, err)
+						valid = false
+					}
+				}
+			}
+		}
+		if _, dup := px.routeCiphers[route.Name]; valid && !dup {
+			px.routeCiphers[route.Name] = pc
+		}
+	}
+}
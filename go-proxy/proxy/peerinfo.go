@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/stats"
+)
+
+// --- Peer Info ---
+//
+// With logging.peer_info, each call is tied to the client connection it came
+// in on. Its peer, the remote address and, on a TLS listener, the negotiated
+// version, cipher suite and verified client certificate's common name, goes
+// into the lines that open and close the call, and into its audit records:
+//
+//	[Proxy] Intercepted ...    | Peer: 10.1.2.3:50514 (TLS 1.3, TLS_AES_128_GCM_SHA256, cn=client)
+//	[Access] {...}             "peer" and "peer_tls"
+//	audit records              "peer"
+//	proxy_rpcs_by_peer_total   by peer, route and code
+//
+// A label per client address would grow without bound, so
+// logging.peer_metric_label says what the metric's peer label holds:
+//
+//	subnet   (default) the client's network: its IPv4 /24 or IPv6 /48
+//	address  the client's IP; for a small, known set of clients
+//	off      proxy_rpcs_by_peer_total is not kept
+//
+// Peers without an IP address (unix sockets, in-process listeners) are
+// labelled with their network. Connections are logged as well, by a gRPC
+// stats handler on every listener: "[Peer] Connection from ... established"
+// as a client connects, and, once it goes, how long it was open and how many
+// calls it carried. proxy_client_connections counts those open and
+// proxy_client_connection_rpcs observes the calls each closed one carried.
+
+// LoggingConfig adds detail to the proxy's log lines
+type LoggingConfig struct {
+	PeerInfo        bool   `yaml:"peer_info"`
+	PeerMetricLabel string `yaml:"peer_metric_label"` // subnet (default), address or off
+}
+
+// Values of logging.peer_metric_label
+const (
+	peerLabelSubnet  = "subnet"
+	peerLabelAddress = "address"
+	peerLabelOff     = "off"
+)
+
+// peerInfo is a call's client as logged; the zero value, with peer_info off,
+// adds nothing
+type peerInfo struct {
+	addr  string // remote address
+	tls   string // version, suite and client CN; empty off TLS
+	label string // proxy_rpcs_by_peer_total's peer label; empty when not kept
+}
+
+// peerOf describes the client of the call ctx belongs to
+func (px *Proxy) peerOf(ctx context.Context) peerInfo {
+	cfg := px.cfg.Logging
+	if !cfg.PeerInfo {
+		return peerInfo{}
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return peerInfo{addr: "unknown"}
+	}
+	pi := peerInfo{addr: p.Addr.String(), tls: describeTLS(p.AuthInfo)}
+	if cfg.PeerMetricLabel != peerLabelOff {
+		pi.label = peerLabel(p.Addr, cfg.PeerMetricLabel)
+	}
+	return pi
+}
+
+func (p peerInfo) String() string {
+	if p.tls == "" {
+		return p.addr
+	}
+	return p.addr + " (" + p.tls + ")"
+}
+
+// describeTLS summarises a TLS connection's state, or "" for another transport
+func describeTLS(auth credentials.AuthInfo) string {
+	info, ok := auth.(credentials.TLSInfo)
+	if !ok {
+		return ""
+	}
+	parts := []string{tls.VersionName(info.State.Version), tls.CipherSuiteName(info.State.CipherSuite)}
+	if chains := info.State.VerifiedChains; len(chains) > 0 && len(chains[0]) > 0 {
+		parts = append(parts, "cn="+chains[0][0].Subject.CommonName)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// peerLabel aggregates a client address as peer_metric_label says
+func peerLabel(addr net.Addr, mode string) string {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return addr.Network()
+	}
+	ip := ap.Addr().Unmap()
+	if mode == peerLabelAddress {
+		return ip.String()
+	}
+	bits := 24
+	if ip.Is6() {
+		bits = 48
+	}
+	prefix, _ := ip.Prefix(bits)
+	return prefix.String()
+}
+
+// peerConnKey carries a connection's *peerConn from TagConn to its calls
+type peerConnKey struct{}
+
+// peerConn is one client connection, from TagConn to ConnEnd
+type peerConn struct {
+	addr, local string
+	start       time.Time
+	rpcs        atomic.Int64
+	tls         atomic.Pointer[string] // from its first call; the handshake is not visible before
+}
+
+// peerStats logs client connections as they open and close, counting the
+// calls each carries
+type peerStats struct{}
+
+func (peerStats) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	c := &peerConn{addr: "unknown", local: "unknown", start: time.Now()}
+	if info.RemoteAddr != nil {
+		c.addr = info.RemoteAddr.String()
+	}
+	if info.LocalAddr != nil {
+		c.local = info.LocalAddr.String()
+	}
+	return context.WithValue(ctx, peerConnKey{}, c)
+}
+
+func (peerStats) HandleConn(ctx context.Context, s stats.ConnStats) {
+	c, ok := ctx.Value(peerConnKey{}).(*peerConn)
+	if !ok {
+		return
+	}
+	switch s.(type) {
+	case *stats.ConnBegin:
+		log.Printf("[Peer] Connection from %s established on %s", c.addr, c.local)
+		metrics.AddGauge("proxy_client_connections", Labels{}, 1)
+	case *stats.ConnEnd:
+		rpcs := c.rpcs.Load()
+		state := ""
+		if t := c.tls.Load(); t != nil && *t != "" {
+			state = " (" + *t + ")"
+		}
+		log.Printf("[Peer] Connection from %s%s closed after %s, %d call(s)", c.addr, state, time.Since(c.start).Round(time.Millisecond), rpcs)
+		metrics.AddGauge("proxy_client_connections", Labels{}, -1)
+		metrics.ObserveBuckets("proxy_client_connection_rpcs", Labels{}, countBuckets, float64(rpcs))
+	}
+}
+
+func (peerStats) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	c, ok := ctx.Value(peerConnKey{}).(*peerConn)
+	if !ok {
+		return ctx
+	}
+	c.rpcs.Add(1)
+	if c.tls.Load() == nil {
+		if p, ok := peer.FromContext(ctx); ok {
+			state := describeTLS(p.AuthInfo)
+			c.tls.CompareAndSwap(nil, &state)
+		}
+	}
+	return ctx
+}
+
+func (peerStats) HandleRPC(context.Context, stats.RPCStats) {}
+
+// loadPeerInfo checks the logging block
+func (px *Proxy) loadPeerInfo(diag *Diagnostics) {
+	cfg := px.cfg.Logging
+	switch cfg.PeerMetricLabel {
+	case "", peerLabelSubnet, peerLabelAddress, peerLabelOff:
+	default:
+		diag.Errorf("logging", "LOGGING_PEER_INFO", "logging.peer_metric_label", "unknown label %q (expected subnet, address or off)", cfg.PeerMetricLabel)
+		return
+	}
+	if !cfg.PeerInfo {
+		if cfg.PeerMetricLabel != "" {
+			diag.Warnf("logging", "LOGGING_PEER_INFO", "logging.peer_metric_label", "has no effect without peer_info")
+		}
+		return
+	}
+	label := cfg.PeerMetricLabel
+	if label == "" {
+		label = peerLabelSubnet
+	}
+	log.Printf("[Peer] Logging client peers and connections; proxy_rpcs_by_peer_total peer label: %s", label)
+}
@@ -0,0 +1,274 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// --- Perimeter Controls ---
+//
+// The security block checks every call on the proxy's own listeners, gRPC-Web
+// included, before it is handled: a stream interceptor ahead of
+// transparentHandler, so a refused call never dials the backend and never
+// reaches a route's limits or inspection.
+//
+//	security:
+//	  require_metadata_token:
+//	    key: x-api-key          # authorization takes "Bearer <token>" too
+//	    sha256: ["9f86d0..."]   # hex SHA-256 of each accepted token
+//	  allowed_cidrs: ["10.0.0.0/8"]
+//
+// A call without the key is UNAUTHENTICATED (TOKEN_MISSING), one whose token
+// hashes to none of the listed digests UNAUTHENTICATED (TOKEN_INVALID); the
+// presented token is hashed and compared with every digest in constant time,
+// so neither the token nor which digest came close leaks through timing. A
+// client address outside allowed_cidrs is PERMISSION_DENIED
+// (ADDRESS_NOT_ALLOWED). Unix socket clients have no address and pass
+// allowed_cidrs, as they pass server.trusted_upstreams.cidrs; they still need
+// the token. Unlike trusted_upstreams, which drops connections unseen, these
+// are per call and answer with a status.
+//
+// A route's security block overrides either check for its calls:
+// require_token: false exempts a public route from the token, and its
+// allowed_cidrs replaces the global list. The checks follow the route as
+// configured, so a runtime override (see overrides.go) does not lift them.
+// Refusals are logged and counted in
+// proxy_perimeter_rejections_total{route, reason}.
+
+// SecurityConfig is the token and address every call must present
+type SecurityConfig struct {
+	RequireMetadataToken *MetadataTokenConfig `yaml:"require_metadata_token"`
+	AllowedCIDRs         []string             `yaml:"allowed_cidrs"`
+}
+
+// MetadataTokenConfig names the request header carrying the token and the
+// tokens accepted, as hex SHA-256 digests so the config holds no secret
+type MetadataTokenConfig struct {
+	Key    string   `yaml:"key"`
+	SHA256 []string `yaml:"sha256"`
+}
+
+// RouteSecurityConfig overrides the security block for one route
+type RouteSecurityConfig struct {
+	RequireToken *bool    `yaml:"require_token"` // false exempts the route from require_metadata_token
+	AllowedCIDRs []string `yaml:"allowed_cidrs"` // replaces security.allowed_cidrs
+}
+
+// ErrorInfo reasons for perimeter refusals
+const (
+	reasonTokenMissing      = "TOKEN_MISSING"
+	reasonTokenInvalid      = "TOKEN_INVALID"
+	reasonAddressNotAllowed = "ADDRESS_NOT_ALLOWED"
+)
+
+// perimeterRule is the checks one route's calls pass
+type perimeterRule struct {
+	tokenKey string       // empty: no token required
+	digests  [][]byte     // SHA-256 of each accepted token
+	nets     []*net.IPNet // nil: any address
+}
+
+// check refuses a call whose metadata or peer does not pass r
+func (r *perimeterRule) check(ctx context.Context) *rejection {
+	if r.nets != nil {
+		if addr, ok := clientIP(ctx); ok && !containsIP(r.nets, addr) {
+			return rejectf(codes.PermissionDenied, reasonAddressNotAllowed, "proxy: client address %s is not allowed", addr)
+		}
+	}
+	if r.tokenKey == "" {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(r.tokenKey)
+	if len(values) == 0 || values[0] == "" {
+		return rejectf(codes.Unauthenticated, reasonTokenMissing, "proxy: missing %s", r.tokenKey).with("key", r.tokenKey)
+	}
+	token := values[0]
+	if r.tokenKey == "authorization" {
+		if rest, ok := cutPrefixFold(token, "Bearer "); ok {
+			token = rest
+		}
+	}
+	if tokenMatch(token, r.digests) < 0 {
+		return rejectf(codes.Unauthenticated, reasonTokenInvalid, "proxy: invalid %s", r.tokenKey).with("key", r.tokenKey)
+	}
+	return nil
+}
+
+// clientIP is the address of the call's client; ok is false for clients
+// without one, such as those on a unix socket
+func clientIP(ctx context.Context) (ip net.IP, ok bool) {
+	p, found := peer.FromContext(ctx)
+	if !found || p.Addr == nil {
+		return nil, true // no peer at all is refused as an unknown address
+	}
+	if tcp, isTCP := p.Addr.(*net.TCPAddr); isTCP {
+		return tcp.IP, true
+	}
+	if p.Addr.Network() == "unix" {
+		return nil, false
+	}
+	// gRPC-Web calls arrive through ServeHTTP with the request's RemoteAddr
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		host = p.Addr.String()
+	}
+	return net.ParseIP(host), true
+}
+
+// containsIP reports whether one of nets holds ip; a nil ip is in none
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+// perimeterFor is the rule route's calls pass
+func (px *Proxy) perimeterFor(route *RouteConfig) *perimeterRule {
+	if r, ok := px.routePerimeter[route.Name]; ok {
+		return r
+	}
+	return px.perimeter
+}
+
+// perimeterInterceptor runs the security checks ahead of transparentHandler
+func (px *Proxy) perimeterInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	route := px.configuredRoute(info.FullMethod)
+	if r := px.perimeterFor(route).check(ss.Context()); r != nil {
+		client := "unknown"
+		if p, ok := peer.FromContext(ss.Context()); ok && p.Addr != nil {
+			client = p.Addr.String()
+		}
+		log.Printf("[Security] Refused %s from %s: %s (route %s)", info.FullMethod, client, r.reason, route.Name)
+		metrics.Inc("proxy_perimeter_rejections_total", Labels{"route": route.Name, "reason": r.reason})
+		return markRejection(ss, info.FullMethod, route, r)
+	}
+	return handler(srv, ss)
+}
+
+// loadPerimeter checks the security block and the routes' overrides of it
+func (px *Proxy) loadPerimeter(diag *Diagnostics) {
+	cfg := px.cfg.Security
+	global := &perimeterRule{}
+	if tc := cfg.RequireMetadataToken; tc != nil {
+		global.tokenKey, global.digests = parseMetadataToken(*tc, diag)
+	}
+	if cfg.AllowedCIDRs != nil {
+		global.nets = parseAllowedCIDRs(cfg.AllowedCIDRs, "security", "security.allowed_cidrs", diag)
+	}
+	px.perimeter = global
+	px.perimeterOn = global.tokenKey != "" || global.nets != nil
+
+	for i, route := range px.cfg.Routes {
+		rs := route.Security
+		if rs == nil {
+			continue
+		}
+		path := fmt.Sprintf("routes[%d].security", i)
+		r := *global
+		if rs.RequireToken != nil {
+			switch {
+			case !*rs.RequireToken:
+				r.tokenKey, r.digests = "", nil
+			case global.tokenKey == "":
+				diag.Errorf("routes", "ROUTE_SECURITY", path+".require_token", "require_token needs security.require_metadata_token")
+			}
+		}
+		if rs.AllowedCIDRs != nil {
+			r.nets = parseAllowedCIDRs(rs.AllowedCIDRs, "routes", path+".allowed_cidrs", diag)
+		}
+		if _, dup := px.routePerimeter[route.Name]; !dup {
+			px.routePerimeter[route.Name] = &r
+		}
+		if r.tokenKey != "" || r.nets != nil {
+			px.perimeterOn = true
+		}
+	}
+}
+
+// parseMetadataToken checks require_metadata_token, returning its key and
+// digests; an invalid one requires a token nothing matches
+func parseMetadataToken(tc MetadataTokenConfig, diag *Diagnostics) (string, [][]byte) {
+	path := "security.require_metadata_token"
+	key := strings.ToLower(strings.TrimSpace(tc.Key))
+	if key == "" {
+		diag.Errorf("security", "SECURITY_TOKEN", path+".key", "require_metadata_token needs the metadata key carrying the token")
+		key = "authorization"
+	} else if strings.HasPrefix(key, "grpc-") || strings.HasPrefix(key, ":") {
+		diag.Errorf("security", "SECURITY_TOKEN", path+".key", "%q is reserved by gRPC", tc.Key)
+	}
+	if len(tc.SHA256) == 0 {
+		diag.Errorf("security", "SECURITY_TOKEN", path+".sha256", "no accepted tokens; list the hex SHA-256 of each")
+	}
+	digests := make([][]byte, 0, len(tc.SHA256))
+	for i, h := range tc.SHA256 {
+		d, ok := tokenDigest(h)
+		if !ok {
+			diag.Errorf("security", "SECURITY_TOKEN", fmt.Sprintf("%s.sha256[%d]", path, i), "not a hex SHA-256 digest")
+			continue
+		}
+		digests = append(digests, d)
+	}
+	return key, digests
+}
+
+// tokenDigest parses a token's hex SHA-256 digest as the config gives it
+func tokenDigest(h string) ([]byte, bool) {
+	d, err := hex.DecodeString(strings.TrimSpace(h))
+	return d, err == nil && len(d) == sha256.Size
+}
+
+// tokenMatch is the index of the digest token hashes to, or -1. Every digest
+// is compared, in constant time, whichever matches.
+func tokenMatch(token string, digests [][]byte) int {
+	sum := sha256.Sum256([]byte(token))
+	match := -1
+	for i, d := range digests {
+		if subtle.ConstantTimeCompare(sum[:], d) == 1 {
+			match = i
+		}
+	}
+	return match
+}
+
+// parseAllowedCIDRs parses an allowed_cidrs list; the result is never nil,
+// so an empty list refuses every address
+func parseAllowedCIDRs(cidrs []string, component, path string, diag *Diagnostics) []*net.IPNet {
+	nets := []*net.IPNet{}
+	for i, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			diag.Errorf(component, "SECURITY_CIDRS", fmt.Sprintf("%s[%d]", path, i), "invalid cidr %q: %v", c, err)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	if len(cidrs) == 0 {
+		diag.Warnf(component, "SECURITY_CIDRS", path, "an empty allowed_cidrs refuses every client with an address")
+	}
+	return nets
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errStreamStopped = status.Error(codes.Canceled, "proxy: stream stopped")
+
+// prefetchStream reads ahead from the backend so that up to a bounded number of
+// messages (and bytes) are already buffered at the proxy when the client is
+// ready for them. Over a long-haul backend link this keeps the upstream
+// pipeline full instead of relaying one message per round trip.
+type prefetchStream struct {
+	grpc.ClientStream
+
+	maxMsgs  int
+	maxBytes int
+	labels   Labels
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   [][]byte
+	bytes   int
+	err     error // terminal RecvMsg error, returned once the queue drains
+	stopped bool
+}
+
+func newPrefetchStream(cs grpc.ClientStream, cfg PrefetchConfig, method string) *prefetchStream {
+	p := &prefetchStream{
+		ClientStream: cs,
+		maxMsgs:      cfg.Messages,
+		maxBytes:     cfg.Bytes,
+		labels:       Labels{"method": method},
+	}
+	if p.maxMsgs <= 0 {
+		p.maxMsgs = 1
+	}
+	p.cond = sync.NewCond(&p.mu)
+	go p.fill()
+	return p
+}
+
+func (p *prefetchStream) full(next int) bool {
+	if len(p.queue) >= p.maxMsgs {
+		return true
+	}
+	// Always admit at least one message, even if it alone exceeds the byte budget
+	return p.maxBytes > 0 && len(p.queue) > 0 && p.bytes+next > p.maxBytes
+}
+
+func (p *prefetchStream) fill() {
+	for {
+		var payload []byte
+		err := p.ClientStream.RecvMsg(&payload)
+
+		p.mu.Lock()
+		if err != nil {
+			p.err = err
+			p.cond.Broadcast()
+			p.mu.Unlock()
+			return
+		}
+		for p.full(len(payload)) && !p.stopped {
+			p.cond.Wait()
+		}
+		if p.stopped {
+			p.mu.Unlock()
+			return
+		}
+		p.queue = append(p.queue, payload)
+		p.bytes += len(payload)
+		p.observe(1, len(payload))
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	}
+}
+
+func (p *prefetchStream) RecvMsg(m interface{}) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.queue) == 0 && p.err == nil && !p.stopped {
+		p.cond.Wait()
+	}
+	if len(p.queue) == 0 {
+		if p.err != nil {
+			return p.err
+		}
+		return errStreamStopped
+	}
+	payload := p.queue[0]
+	p.queue = p.queue[1:]
+	p.bytes -= len(payload)
+	p.observe(-1, -len(payload))
+	p.cond.Broadcast()
+
+	*(m.(*[]byte)) = payload
+	return nil
+}
+
+// stop releases the fill goroutine and discards anything still buffered
+func (p *prefetchStream) stop() {
+	p.mu.Lock()
+	p.stopped = true
+	p.observe(-len(p.queue), -p.bytes)
+	p.queue = nil
+	p.bytes = 0
+	p.cond.Broadcast()
+	p.mu.Unlock()
+}
+
+// observe adjusts the per-method occupancy gauges, which sum across streams
+func (p *prefetchStream) observe(msgs, bytes int) {
+	metrics.AddGauge("proxy_prefetch_buffered_messages", p.labels, float64(msgs))
+	metrics.AddGauge("proxy_prefetch_buffered_bytes", p.labels, float64(bytes))
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anthony/grpc-proxy/api/echo"
+	"google.golang.org/grpc"
+)
+
+// BenchmarkPrefetch streams responses from a backend with a 40ms round trip,
+// as make bench-latency does, through a pass-thru route without a prefetch
+// window and with one
+func BenchmarkPrefetch(b *testing.B) {
+	const linkDelay = 20 * time.Millisecond // each way
+	req := &echo.EchoRequest{Message: strings.Repeat("x", 16<<10), Repeat: 100}
+	for _, window := range []int{0, 64} {
+		b.Run(fmt.Sprintf("messages=%d", window), func(b *testing.B) {
+			conn := serveTestProxy(b, []RouteConfig{{
+				Name: "stream", Match: "/echo.EchoService/*", Mode: "pass-thru",
+				Prefetch: PrefetchConfig{Messages: window},
+			}}, func(s *grpc.Server) {
+				echo.RegisterEchoServiceServer(s, benchBackend{})
+			}, linkDelay)
+			client := echo.NewEchoServiceClient(conn)
+			ctx := context.Background()
+			call := func() {
+				stream, err := client.ServerStreamingEcho(ctx, req)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for {
+					if _, err := stream.Recv(); err == io.EOF {
+						return
+					} else if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			// The first call dials the proxy and the backend
+			call()
+			b.SetBytes(int64(len(req.Message)) * int64(req.Repeat))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				call()
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// --- Preflight ---
+//
+// Without it the first calls after a start pay for the descriptor lookups,
+// backend dials and first crypto calls the proxy defers until it needs them.
+// WithPreflight (-preflight-timeout) moves that work ahead of the first
+// listener: Serve and ListenAndServe first
+//
+//  1. dial every backend endpoint through the shared connections and ask it
+//     grpc.health.v1 Check for the server as a whole; a backend without the
+//     health service counts as up once it answers UNIMPLEMENTED
+//  2. wait for a deferred reflection and resolve the route envelopes against
+//     the schema it brings, as NewProxy does when the schema is there already
+//  3. have every engine in use sign a test payload with every signing key and
+//     verify the signature, which catches key material an engine cannot use
+//     and pays the Rust engine's first-call cost
+//
+// and only then open the listeners, the web gateway's included. The admin
+// and debug listeners start first, so /readyz answers 503 until preflight has
+// passed. Findings are reported like startup diagnostics, naming the endpoint,
+// schema or key at fault. An endpoint that fails its check is a warning while
+// another passes; every other finding, or the timeout running out first,
+// fails Serve and ListenAndServe with a DiagnosticsError.
+
+// preflightPayload is what the crypto self-test signs
+const preflightPayload = "grpc-proxy preflight"
+
+// WithPreflight runs the preflight checks before the proxy accepts calls,
+// failing Serve and ListenAndServe when they do not pass within timeout
+func WithPreflight(timeout time.Duration) Option {
+	return func(px *Proxy) {
+		px.preflightTimeout = timeout
+		px.preflightPending.Store(timeout > 0)
+	}
+}
+
+// preflight runs the checks when WithPreflight asked for them
+func (px *Proxy) preflight() error {
+	if px.preflightTimeout <= 0 {
+		return nil
+	}
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), px.preflightTimeout)
+	defer cancel()
+	diag := &Diagnostics{}
+	px.preflightBackends(ctx, diag)
+	px.preflightSchema(ctx, diag)
+	px.preflightCrypto(ctx, diag)
+	if err := diag.Err(); err != nil {
+		return err
+	}
+	for _, item := range diag.Items {
+		log.Printf("[Preflight] %s (%s): %s", item.Code, item.Path, item.Message)
+	}
+	px.preflightPending.Store(false)
+	log.Printf("[Preflight] Passed in %s", time.Since(started).Round(time.Millisecond))
+	return nil
+}
+
+// preflightBackends health-checks every backend endpoint
+func (px *Proxy) preflightBackends(ctx context.Context, diag *Diagnostics) {
+	if px.backends == nil || px.conns == nil {
+		return // the backend config is already reported
+	}
+	endpoints := px.backends.snapshot()
+	passed := 0
+	for _, ep := range endpoints {
+		if err := px.checkEndpoint(ctx, ep); err != nil {
+			diag.Warnf("backend", "PREFLIGHT_BACKEND", "backend.addresses", "%s: %v", ep.addr, err)
+			continue
+		}
+		passed++
+	}
+	if passed == 0 {
+		diag.Errorf("backend", "PREFLIGHT_BACKEND", "backend.addresses", "none of the %d backend endpoints passed its health check", len(endpoints))
+	}
+}
+
+// checkEndpoint asks one endpoint for its health over its shared connection,
+// which stays open for the calls that follow
+func (px *Proxy) checkEndpoint(ctx context.Context, ep *endpoint) error {
+	c, err := px.conns.acquire(ep)
+	if err != nil {
+		return err
+	}
+	req, err := proto.Marshal(&healthpb.HealthCheckRequest{})
+	if err != nil {
+		px.conns.release(c, false)
+		return err
+	}
+	var resp []byte
+	err = c.conn.Invoke(ctx, healthpb.Health_Check_FullMethodName, &req, &resp)
+	px.conns.release(c, isConnectionFailure(err))
+	if status.Code(err) == codes.Unimplemented {
+		return nil // no health service, but the backend answered
+	}
+	if err != nil {
+		return err
+	}
+	var res healthpb.HealthCheckResponse
+	if err := proto.Unmarshal(resp, &res); err != nil {
+		return fmt.Errorf("health check response: %v", err)
+	}
+	if res.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("health status %s", res.GetStatus())
+	}
+	return nil
+}
+
+// preflightSchema waits out a deferred reflection, then resolves the route
+// envelopes against the schema it brought
+func (px *Proxy) preflightSchema(ctx context.Context, diag *Diagnostics) {
+	if !px.schemaPending.Load() {
+		return // resolved by NewProxy
+	}
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for px.schemaPending.Load() {
+		select {
+		case <-ctx.Done():
+			diag.Errorf("schema", "PREFLIGHT_SCHEMA", "schema.method", "reflection is still pending after %s", px.preflightTimeout)
+			return
+		case <-tick.C:
+		}
+	}
+	px.checkEnvelopes(diag)
+}
+
+// preflightCrypto signs and verifies with every engine and key in use
+func (px *Proxy) preflightCrypto(ctx context.Context, diag *Diagnostics) {
+	keys := map[string]*signingKey{}
+	if px.proxyKey != nil {
+		keys["cms.proxy_private_key"] = px.proxyKey
+	}
+	for name, key := range px.namedKeys {
+		keys["cms.keys."+name] = key
+	}
+	paths := make([]string, 0, len(keys))
+	for path := range keys {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	names := make([]string, 0, len(px.engines))
+	for name := range px.engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		e := px.engines[name]
+		for _, path := range paths {
+			if err := selfTest(ctx, e, keys[path]); err != nil {
+				diag.Errorf("crypto", "PREFLIGHT_CRYPTO", path, "the %s engine %v", e.name(), err)
+			}
+		}
+	}
+}
+
+// selfTest signs the preflight payload with key and verifies the signature
+// against key's public half
+func selfTest(ctx context.Context, e cryptoEngine, key *signingKey) error {
+	digest := payloadDigest(sha256.Sum256([]byte(preflightPayload)))
+	sig, err := e.sign(ctx, key, digest)
+	if err != nil {
+		return fmt.Errorf("cannot sign with it: %v", err)
+	}
+	if id, err := e.verifyKeys(ctx, newTrustKeys(key.name, []*rsa.PublicKey{&key.load().priv.PublicKey}), digest, sig); err != nil || id == "" {
+		return errors.New("made a signature its public key does not verify")
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// --- Message Processors ---
+//
+// A MessageProcessor runs on the decoded envelope of every message on the
+// routes that list it in processors, in list order, after the envelope is
+// unmarshalled and before it is re-marshalled for forwarding. Processors are
+// registered per proxy at compile time by the embedding program:
+//
+//	px, err := proxy.NewProxy(cfg, proxy.WithProcessor("pii-scan", piiScanner{}))
+//
+// and referenced by name from the config:
+//
+//	routes:
+//	  - match: "/acme.Orders/*"
+//	    mode: "inspect-outer"
+//	    processors: ["pii-scan"]
+//
+// The proxy's own signature handling is built on the same interface. On
+// inspect-verify-sign routes the built-in verify-backend (responses with an
+// envelope.backend_sig_field), verify-client and verify-upstream-proxy (routes
+// with verify_upstream_proxy) run first, then the route's
+// mutations and processors, and sign last, so the proxy signature covers every
+// change. The built-ins always run implicitly and cannot be listed. On
+// encrypt-payload routes processors see the plaintext: before a request is
+// sealed and after a response is opened.
+
+// Direction is which way a message is travelling
+type Direction int
+
+const (
+	ClientToBackend Direction = iota
+	BackendToClient
+)
+
+func (d Direction) String() string {
+	if d == ClientToBackend {
+		return "client_to_backend"
+	}
+	return "backend_to_client"
+}
+
+// label is the prefix processMsg logs under
+func (d Direction) label() string {
+	if d == ClientToBackend {
+		return "Request"
+	}
+	return "Response"
+}
+
+func directionOf(isReq bool) Direction {
+	if isReq {
+		return ClientToBackend
+	}
+	return BackendToClient
+}
+
+// MethodInfo describes the call a processed message belongs to
+type MethodInfo struct {
+	Method     string // e.g. "/echo.SecureService/SecureEcho"
+	Route      *RouteConfig
+	Descriptor *desc.MethodDescriptor
+	Identity   string // the resolved client identity; empty when there is none
+	Tenant     string // the trust domain on routes with trust_domain_from
+
+	envelope *resolvedEnvelope // the route's envelope fields on this message's type
+	wire     []byte            // the message as it arrived
+	digests  *payloadDigests   // the message's payload digest, hashed once for verify and sign
+}
+
+// MessageProcessor inspects or edits one decoded envelope. Changes made to msg
+// are forwarded unless the returned Action says otherwise. A non-nil error
+// ends the call: status errors are returned to the client with their code,
+// message and details, any other error as INTERNAL.
+type MessageProcessor interface {
+	Process(ctx context.Context, info MethodInfo, dir Direction, msg *dynamic.Message) (Action, error)
+}
+
+// ProcessorFunc adapts a function to MessageProcessor
+type ProcessorFunc func(ctx context.Context, info MethodInfo, dir Direction, msg *dynamic.Message) (Action, error)
+
+func (f ProcessorFunc) Process(ctx context.Context, info MethodInfo, dir Direction, msg *dynamic.Message) (Action, error) {
+	return f(ctx, info, dir, msg)
+}
+
+type actionKind int
+
+const (
+	actionContinue actionKind = iota
+	actionReplace
+	actionReject
+)
+
+func (k actionKind) String() string {
+	switch k {
+	case actionReplace:
+		return "replace"
+	case actionReject:
+		return "reject"
+	}
+	return "continue"
+}
+
+// Action is what a processor wants done with the message
+type Action struct {
+	kind    actionKind
+	payload []byte
+	status  *status.Status
+}
+
+// Continue hands the (possibly edited) message to the next processor
+func Continue() Action {
+	return Action{}
+}
+
+// ReplaceBytes forwards payload as the message, already encoded. Later
+// processors, including sign, do not run.
+func ReplaceBytes(payload []byte) Action {
+	if payload == nil {
+		payload = []byte{}
+	}
+	return Action{kind: actionReplace, payload: payload}
+}
+
+// Reject ends the call with st; a nil or OK status is sent as INTERNAL
+func Reject(st *status.Status) Action {
+	return Action{kind: actionReject, status: st}
+}
+
+// WithProcessor registers a processor under name for routes to reference.
+// Registering a name twice, or a built-in name, fails NewProxy.
+func WithProcessor(name string, p MessageProcessor) Option {
+	return func(px *Proxy) {
+		px.registered = append(px.registered, namedProcessor{name, p})
+	}
+}
+
+type namedProcessor struct {
+	name string
+	p    MessageProcessor
+}
+
+// Built-in processors, in the order inspect-verify-sign runs them
+const (
+	processorVerifyBackend = "verify-backend"
+	processorVerifyClient  = "verify-client"
+	// processorVerifyUpstream checks the previous proxy's entry; see proxychain.go
+	processorVerifyUpstream = "verify-upstream-proxy"
+	processorSign           = "sign"
+)
+
+// methodInfo is the MethodInfo for one message processMsg is handling
+func methodInfo(ctx context.Context, method string, route *RouteConfig, md *desc.MethodDescriptor) MethodInfo {
+	identity, _ := ctx.Value(clientIdentityKey{}).(string)
+	return MethodInfo{Method: method, Route: route, Descriptor: md, Identity: identity, Tenant: tenantFromContext(ctx), digests: &payloadDigests{}}
+}
+
+// runProcessors applies the named processors to msg in order. It returns the
+// bytes to forward when one replaced the message, and nil to carry on with msg.
+func (px *Proxy) runProcessors(ctx context.Context, info MethodInfo, dir Direction, msg *dynamic.Message, names []string) ([]byte, error) {
+	for _, name := range names {
+		p := px.processors[name]
+		var sp *span
+		if !isBuiltinProcessor(name) {
+			sp = startChildSpan(ctx, "proxy.processor "+name, spanKindInternal)
+			sp.set("proxy.direction", dir.String())
+		}
+		act, err := p.Process(ctx, info, dir, msg)
+		result := act.kind.String()
+		if err != nil {
+			result = "error"
+			err = processorRejection(name, reasonProcessorFailed, err)
+		} else if act.kind == actionReject {
+			if act.status == nil || act.status.Code() == codes.OK {
+				err = rejectf(codes.Internal, reasonProcessorRejected, "proxy: processor %s rejected the message", name).with("processor", name)
+			} else {
+				err = processorRejection(name, reasonProcessorRejected, act.status.Err())
+			}
+		}
+		metrics.Inc("proxy_processor_actions_total", Labels{"processor": name, "action": result, "shadow": shadowLabel(info.Route)})
+		sp.end(err)
+		if err != nil {
+			log.Printf("[%s Rejected] %s by processor %s: %v", dir.label(), info.Method, name, err)
+			return nil, err
+		}
+		if act.kind == actionReplace {
+			log.Printf("[%s Processor] %s replaced the message for %s", dir.label(), name, info.Method)
+			return act.payload, nil
+		}
+	}
+	return nil, nil
+}
+
+// processorRejection keeps the code, message and details of a status error
+// from a processor and adds the proxy's ErrorInfo. Proxy rejections, such as
+// a built-in's, pass through; any other error becomes INTERNAL.
+func processorRejection(name, reason string, err error) error {
+	var rj rejector
+	if errors.As(err, &rj) {
+		return err
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return rejectf(codes.Internal, reason, "proxy: processor %s: %v", name, err).with("processor", name)
+	}
+	r := rejectf(st.Code(), reason, "%s", st.Message()).with("processor", name)
+	r.details = st.Proto().GetDetails()
+	return r
+}
+
+func isBuiltinProcessor(name string) bool {
+	return name == processorVerifyBackend || name == processorVerifyClient || name == processorVerifyUpstream || name == processorSign
+}
+
+// loadProcessors installs the built-ins and registered processors, and checks
+// every route's processors list against them
+func (px *Proxy) loadProcessors(diag *Diagnostics) {
+	px.processors = map[string]MessageProcessor{
+		processorVerifyBackend:  backendVerifier{px},
+		processorVerifyClient:   clientVerifier{px},
+		processorVerifyUpstream: upstreamVerifier{px},
+		processorSign:           proxySigner{px},
+	}
+	for _, r := range px.registered {
+		switch {
+		case r.name == "" || r.p == nil:
+			diag.Errorf("processors", "PROCESSOR_REGISTER", r.name, "processors need a name and an implementation")
+		case isBuiltinProcessor(r.name):
+			diag.Errorf("processors", "PROCESSOR_REGISTER", r.name, "%q is a built-in processor name", r.name)
+		case px.processors[r.name] != nil:
+			diag.Errorf("processors", "PROCESSOR_REGISTER", r.name, "processor %q is registered twice", r.name)
+		default:
+			px.processors[r.name] = r.p
+		}
+	}
+
+	var names []string
+	for name := range px.processors {
+		if !isBuiltinProcessor(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for i, route := range px.cfg.Routes {
+		if len(route.Processors) == 0 {
+			continue
+		}
+		path := fmt.Sprintf("routes[%d].processors", i)
+		if route.Mode == "pass-thru" || route.Mode == "local-reply" {
+			diag.Warnf("routes", "ROUTE_PROCESSOR", path, "processors never run on %s routes, whose messages are not decoded", route.Mode)
+			continue
+		}
+		for j, name := range route.Processors {
+			p := fmt.Sprintf("%s[%d]", path, j)
+			if isBuiltinProcessor(name) {
+				diag.Errorf("routes", "ROUTE_PROCESSOR", p, "%q is built in and runs implicitly on inspect-verify-sign routes", name)
+				continue
+			}
+			if px.processors[name] == nil {
+				msg := fmt.Sprintf("no processor named %q is registered", name)
+				if s := closest(name, names); s != "" {
+					msg += fmt.Sprintf("; did you mean %q?", s)
+				}
+				diag.Errorf("routes", "ROUTE_PROCESSOR", p, "%s", msg)
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/anthony/grpc-proxy/api/echo"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// TestProcessorChain runs stub processors on a route and checks they run in
+// list order, and that the first to fail or reject stops the chain with its
+// status code intact for the client
+func TestProcessorChain(t *testing.T) {
+	const method = "/echo.SecureService/SecureEcho"
+	inner, _ := proto.Marshal(&echo.EchoRequest{Message: "chain"})
+	msg, _ := proto.Marshal(&echo.SecureEnvelope{TypeUrl: "type.googleapis.com/echo.EchoRequest", Payload: inner})
+
+	for _, tc := range []struct {
+		name       string
+		stop       func() (Action, error)
+		wantCode   codes.Code
+		wantReason string
+	}{
+		{"error", func() (Action, error) { return Continue(), status.Error(codes.FailedPrecondition, "stub failed") }, codes.FailedPrecondition, reasonProcessorFailed},
+		{"reject", func() (Action, error) { return Reject(status.New(codes.PermissionDenied, "stub rejected")), nil }, codes.PermissionDenied, reasonProcessorRejected},
+		{"plain error", func() (Action, error) { return Continue(), errors.New("stub broke") }, codes.Internal, reasonProcessorFailed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var ran []string
+			stub := func(name string, act func() (Action, error)) Option {
+				return WithProcessor(name, ProcessorFunc(func(context.Context, MethodInfo, Direction, *dynamic.Message) (Action, error) {
+					ran = append(ran, name)
+					return act()
+				}))
+			}
+			next := func() (Action, error) { return Continue(), nil }
+			px := newTestProxy(t, []RouteConfig{{
+				Name: "chain", Match: method, Mode: "inspect-outer", Envelope: secureEnvelope,
+				Processors: []string{"first", "second", "stop", "never"},
+			}}, nil, stub("first", next), stub("second", next), stub("stop", tc.stop), stub("never", next))
+
+			_, err := px.newPump(context.Background(), method, true, px.configuredRoute(method), nil).process(msg)
+			if want := []string{"first", "second", "stop"}; !slices.Equal(ran, want) {
+				t.Errorf("processors ran %v, want %v", ran, want)
+			}
+			if got := status.Code(err); got != tc.wantCode {
+				t.Fatalf("client gets %v (%v), want %v", got, err, tc.wantCode)
+			}
+			var r *rejection
+			if !errors.As(err, &r) || r.reason != tc.wantReason || r.metadata["processor"] != "stop" {
+				t.Errorf("rejection %+v, want %s from processor stop", r, tc.wantReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,1723 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/jhump/protoreflect/grpcreflect"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/mem"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// --- Configuration Types ---
+
+type Config struct {
+	Server   ServerConfig   `yaml:"server"`
+	Backend  BackendConfig  `yaml:"backend"`
+	Schema   SchemaConfig   `yaml:"schema"`
+	Routes   []RouteConfig  `yaml:"routes"`
+	CMS      CMSConfig      `yaml:"cms"`
+	Admin    AdminConfig    `yaml:"admin"`
+	Debug    DebugConfig    `yaml:"debug"`
+	Identity IdentityConfig `yaml:"identity"`
+	Tracing  TracingConfig  `yaml:"tracing"`
+	Web      WebConfig      `yaml:"web"`
+	Capture  CaptureConfig  `yaml:"capture"`
+	Audit    AuditConfig    `yaml:"audit"`
+	Logging  LoggingConfig  `yaml:"logging"`
+	Janitor  JanitorConfig  `yaml:"janitor"`
+
+	// SignatureDebug bounds the reports of routes with
+	// debug_signature_mismatch; see sigdebug.go
+	SignatureDebug SignatureDebugConfig `yaml:"signature_debug"`
+
+	// CPUClasses are named bounds on concurrent message processing, shared
+	// by the routes whose cpu_class names them; see cpuclass.go
+	CPUClasses map[string]CPUClassConfig `yaml:"cpu_classes"`
+	// TapSinks receive the messages of routes with a tap block; see tap.go
+	TapSinks map[string]TapSinkConfig `yaml:"tap_sinks"`
+	// DecodeLimits bound request messages before they are decoded; see
+	// decodeguard.go
+	DecodeLimits DecodeLimitsConfig `yaml:"decode_limits"`
+	// LoadShedding rejects new calls while message processing is overloaded;
+	// see loadshed.go
+	LoadShedding LoadSheddingConfig `yaml:"load_shedding"`
+
+	// Security is the token and client address every call is checked for
+	// before it is handled; see perimeter.go
+	Security SecurityConfig `yaml:"security"`
+
+	// BuiltinPassthrough routes reflection and health traffic pass-thru ahead
+	// of user wildcards; set it to false to route them like any other method
+	BuiltinPassthrough *bool `yaml:"builtin_passthrough"`
+
+	// Include, EnvelopeTemplates and RouteDefaults are merged into Routes as
+	// LoadConfig reads the file; see configinclude.go
+	Include           []string                  `yaml:"include"`
+	EnvelopeTemplates map[string]EnvelopeConfig `yaml:"envelope_templates"`
+	RouteDefaults     map[string]RouteConfig    `yaml:"route_defaults"`
+}
+
+type ServerConfig struct {
+	// A single listener; use listeners for several, e.g. a unix socket for a
+	// sidecar's app next to a TLS port for everything else
+	ListenAddress    string                 `yaml:"listen_address"`
+	TLS              *TLSConfig             `yaml:"tls"`
+	Listeners        []ListenerConfig       `yaml:"listeners"`
+	TrustedUpstreams TrustedUpstreamsConfig `yaml:"trusted_upstreams"`
+
+	// Connection lifetime and keepalive; unset values keep the gRPC defaults
+	MaxConnectionIdle     string                     `yaml:"max_connection_idle"`      // close connections idle this long
+	MaxConnectionAge      string                     `yaml:"max_connection_age"`       // GOAWAY connections older than this
+	MaxConnectionAgeGrace string                     `yaml:"max_connection_age_grace"` // then force-close after this
+	KeepaliveTime         string                     `yaml:"keepalive_time"`           // ping clients idle this long; default "2h"
+	KeepaliveTimeout      string                     `yaml:"keepalive_timeout"`        // close if unanswered; default "20s"
+	KeepaliveEnforcement  KeepaliveEnforcementConfig `yaml:"keepalive_enforcement"`
+}
+
+type TLSConfig struct {
+	CertFile          string `yaml:"cert_file"`
+	KeyFile           string `yaml:"key_file"`
+	ClientCAFile      string `yaml:"client_ca_file"`
+	RequireClientCert bool   `yaml:"require_client_cert"`
+
+	// Handshake tuning; empty values keep the crypto/tls defaults
+	MinVersion            string   `yaml:"min_version"` // "1.2", "1.3"
+	MaxVersion            string   `yaml:"max_version"`
+	CipherSuites          []string `yaml:"cipher_suites"`       // IANA names, TLS 1.2 only
+	ALPN                  []string `yaml:"alpn"`                // "h2" is always offered
+	TicketKeyRotation     string   `yaml:"ticket_key_rotation"` // e.g. "1h"; empty uses Go's built-in rotation
+	DisableSessionTickets bool     `yaml:"disable_session_tickets"`
+}
+
+// TrustedUpstreamsConfig restricts the listener to connections from known
+// upstream proxies (e.g. the outer proxy in a chain).
+type TrustedUpstreamsConfig struct {
+	SANs  []string `yaml:"sans"`  // glob patterns matched against the client cert URI/DNS SANs and CN
+	CIDRs []string `yaml:"cidrs"` // remote address allowlist
+}
+
+type BackendConfig struct {
+	// Mode mock answers every call in-process instead; see mockbackend.go
+	Mode    string            `yaml:"mode"`
+	Mock    MockConfig        `yaml:"mock"`
+	Address string            `yaml:"address"`
+	TLS     *BackendTLSConfig `yaml:"tls"`
+	Retry   *RetryConfig      `yaml:"retry"` // default for routes without their own retry block
+	// Restart is how calls cut off by the backend's GOAWAY end; see goaway.go
+	Restart *BackendRestartConfig `yaml:"restart"`
+
+	// Additional endpoints (host:port or dns:///host:port), balanced with Address
+	Addresses       []string       `yaml:"addresses"`
+	Policy          string         `yaml:"policy"` // pick_first (default) or round_robin
+	Ejection        EjectionConfig `yaml:"ejection"`
+	ResolveInterval string         `yaml:"resolve_interval"` // dns:/// targets; default "30s"
+	// Shared connections with no open streams are closed after this; default "5m"
+	IdleConnectionTTL string `yaml:"idle_connection_ttl"`
+
+	Compression CompressionConfig       `yaml:"compression"`
+	Keepalive   *BackendKeepaliveConfig `yaml:"keepalive"`
+}
+
+type BackendTLSConfig struct {
+	CAFile     string `yaml:"ca_file"`
+	CertFile   string `yaml:"cert_file"` // client cert presented to the backend (or next proxy)
+	KeyFile    string `yaml:"key_file"`
+	ServerName string `yaml:"server_name"`
+}
+
+// IdentityConfig controls how the original client identity travels across a
+// chain of proxies as a signed metadata header.
+type IdentityConfig struct {
+	Header             string `yaml:"header"`               // defaults to x-proxy-client-identity
+	Propagate          bool   `yaml:"propagate"`            // sign and forward the identity upstream
+	UpstreamTrustStore string `yaml:"upstream_trust_store"` // certs of proxies allowed to assert identities
+}
+
+type SchemaConfig struct {
+	Method string `yaml:"method"` // pb, reflect, url, or both (see schemaboth.go)
+	PBPath string `yaml:"pb_path"`
+
+	// Lazy keeps only raw descriptor bytes and links methods on first use (pb only)
+	Lazy         bool   `yaml:"lazy"`
+	IdleEviction string `yaml:"idle_eviction"` // e.g. "10m"; empty never evicts
+
+	// Required fails startup when reflection cannot reach a backend, instead
+	// of serving without descriptors and retrying in the background
+	Required bool `yaml:"required"`
+	// Each reflection attempt gives up after ReflectTimeout (default "10s");
+	// one failing with UNAVAILABLE or DEADLINE_EXCEEDED is made up to
+	// ReflectAttempts times (default 3) before the endpoint counts as failed
+	ReflectTimeout  string `yaml:"reflect_timeout"`
+	ReflectAttempts int    `yaml:"reflect_attempts"`
+
+	// Remote is where method url fetches the descriptor set; see remoteschema.go
+	Remote RemoteSchemaConfig `yaml:"remote"`
+
+	// StrictEnvelopes fails startup when a matched method's response type
+	// lacks a configured envelope field, instead of warning
+	StrictEnvelopes bool `yaml:"strict_envelopes"`
+}
+
+type RouteConfig struct {
+	// Name identifies the route in logs, metrics, audit records and error
+	// details; it is required and unique
+	Name        string         `yaml:"name"`
+	Description string         `yaml:"description"` // shown by the admin /routes endpoint
+	Match       string         `yaml:"match"`
+	Priority    int            `yaml:"priority"` // outranks specificity; 0 is the same as unset, see routetable.go
+	Mode        string         `yaml:"mode"`     // pass-thru, inspect-outer, inspect-verify-sign, encrypt-payload, local-reply, session-token, wrap-envelope
+	Unordered   bool           `yaml:"unordered"`
+	Envelope    EnvelopeConfig `yaml:"envelope"`
+
+	// Defaults and EnvelopeTemplate name a route_defaults entry and an
+	// envelope_templates entry to merge under the route's own keys; both are
+	// resolved, and cleared, as the file is read. See configinclude.go.
+	Defaults         string `yaml:"defaults"`
+	EnvelopeTemplate string `yaml:"envelope_template"`
+
+	// Envelopes replaces Envelope with several shapes, told apart per message
+	// by VersionField or VersionHeader; UnknownVersion is reject (default)
+	// or pass-thru. See envelopeversions.go.
+	Envelopes      []VersionedEnvelope `yaml:"envelopes"`
+	VersionField   string              `yaml:"version_field"`
+	VersionHeader  string              `yaml:"version_header"`
+	UnknownVersion string              `yaml:"unknown_version"`
+	Prefetch       PrefetchConfig      `yaml:"prefetch"`
+	Limits         LimitsConfig        `yaml:"limits"`
+	CPUClass       string              `yaml:"cpu_class"` // a cpu_classes entry
+	// Metadata rules for client->backend, and for headers/trailers going back
+	Metadata         MetadataRules `yaml:"metadata"`
+	ResponseMetadata MetadataRules `yaml:"response_metadata"`
+	Retry            *RetryConfig  `yaml:"retry"` // replaces backend.retry for this route
+
+	// Headers copied into the request envelope's metadata_field map, and
+	// response envelope metadata entries copied into the client's response
+	// headers; Overwrite lets a copy replace a value already there. See
+	// metadatacopy.go.
+	CopyGRPCMetadataToEnvelope []string `yaml:"copy_grpc_metadata_to_envelope"`
+	CopyEnvelopeMetadataToGRPC []string `yaml:"copy_envelope_metadata_to_grpc"`
+	Overwrite                  bool     `yaml:"overwrite"`
+
+	// Mutations edit the envelope after verification and before proxy signing
+	Mutations []MutationConfig `yaml:"mutations"`
+
+	// Inner payload rules for requests, rejected with INVALID_ARGUMENT.
+	// validate_inner requires the payload to decode as its type_url;
+	// allowed_types entries are full type URLs or bare type names.
+	ValidateInner bool     `yaml:"validate_inner"`
+	AllowedTypes  []string `yaml:"allowed_types"`
+	RequireFields []string `yaml:"require_fields"` // field paths, e.g. "user_id", "actor.id"
+	// TypeURLPolicy normalizes request type URLs and limits the types they
+	// name; see typeurl.go
+	TypeURLPolicy *TypeURLPolicyConfig `yaml:"type_url_policy"`
+
+	// BackendSigOnFail handles responses whose envelope.backend_sig_field does
+	// not verify: reject (default), forward or strip
+	BackendSigOnFail string `yaml:"backend_sig_on_fail"`
+
+	// BindTransportIdentity writes the client certificate's identity into
+	// envelope.identity_field of each request, before the proxy signs.
+	// IdentityOnMissing handles calls without a client certificate: reject
+	// (default) or anonymous.
+	BindTransportIdentity bool   `yaml:"bind_transport_identity"`
+	IdentityOnMissing     string `yaml:"identity_on_missing"`
+
+	// TrustDomainFrom picks the cms.trust_domains entry that verifies client
+	// signatures: "metadata:<header>" or "mtls-san"
+	TrustDomainFrom string `yaml:"trust_domain_from"`
+
+	// DecodeLimits overrides the global decode_limits for this route
+	DecodeLimits DecodeLimitsConfig `yaml:"decode_limits"`
+
+	// Security exempts the route from the security block's token or
+	// replaces its allowed_cidrs; see perimeter.go
+	Security *RouteSecurityConfig `yaml:"security"`
+
+	// CryptoEngine signs and verifies this route with "go" or "rust" instead
+	// of the -crypto engine
+	CryptoEngine string `yaml:"crypto_engine"`
+
+	// Request and Response override what an inspect-verify-sign route
+	// verifies and signs in each direction; see directions.go
+	Request  *DirectionCryptoConfig `yaml:"request"`
+	Response *DirectionCryptoConfig `yaml:"response"`
+	// SignKeySelector picks the key responses are signed with per call, from
+	// a request header or envelope field; see keyselect.go
+	SignKeySelector *SignKeySelectorConfig `yaml:"sign_key_selector"`
+
+	// DebugSignatureMismatch logs what the proxy hashed, and which keys it
+	// tried, for each signature on the route that does not verify
+	DebugSignatureMismatch bool `yaml:"debug_signature_mismatch"`
+
+	// EmptyPayload is what an inspect-verify-sign route does with a
+	// zero-length payload: sign-empty (default), skip-sign or reject
+	EmptyPayload string `yaml:"empty_payload"`
+
+	// OnDecodeFailure is what a route does with a message it cannot decode:
+	// pass (forward it as it came) or reject. The default is reject on
+	// inspect-verify-sign routes and pass on inspect-outer; see decodefailure.go
+	OnDecodeFailure string `yaml:"on_decode_failure"`
+
+	// PreserveWireBytes forwards an inspect-verify-sign route's envelopes as
+	// they arrived with only the proxy's own fields rewritten, instead of
+	// re-marshalling them; see wirebytes.go
+	PreserveWireBytes bool `yaml:"preserve_wire_bytes"`
+
+	// SessionToken is how a session-token route mints the token it sends the
+	// backend for each verified stream; see sessiontoken.go
+	SessionToken *SessionTokenConfig `yaml:"session_token"`
+
+	// Wrap is the envelope a wrap-envelope route puts each bare request
+	// into, and takes each response out of; see wrapenvelope.go
+	Wrap *WrapConfig `yaml:"wrap"`
+
+	// StreamAttestation signs client-streaming requests once per stream, over
+	// a rolling hash sent as a final envelope at the half-close
+	StreamAttestation bool `yaml:"stream_attestation"`
+
+	// VerifyBeforeConnect holds an inspect-verify-sign route's backend call
+	// until the client's first message has verified; see verifyconnect.go
+	VerifyBeforeConnect bool `yaml:"verify_before_connect"`
+
+	// VerifyUpstreamProxy is a cms.trust_stores name that checks the previous
+	// proxy's entry in envelope.proxy_sig_list_field; see proxychain.go
+	VerifyUpstreamProxy string `yaml:"verify_upstream_proxy"`
+
+	// Processors are registered MessageProcessors run in order on each
+	// decoded envelope, after mutations and before proxy signing
+	Processors []string `yaml:"processors"`
+
+	// Shadow runs the route's inspection, verification, signing and
+	// processors, logging and counting what they decide, but always forwards
+	// the original bytes, so on the wire the route behaves as pass-thru
+	Shadow bool `yaml:"shadow"`
+
+	// Capture records every message on this route to capture.path
+	Capture bool `yaml:"capture"`
+	// Tap exports the route's messages as JSON to a tap sink
+	Tap *TapConfig `yaml:"tap"`
+	// RedactFields are field paths whose values are replaced in the JSON the
+	// route logs and taps, with "[REDACTED]" or, with RedactWith hash, a
+	// hash; LogInnerPayload logs the decoded inner payload. See redact.go.
+	RedactFields    []string `yaml:"redact_fields"`
+	RedactWith      string   `yaml:"redact_with"`
+	LogInnerPayload bool     `yaml:"log_inner_payload"`
+	// AuditOnFull is what happens when the audit queue is full: block the
+	// message until there is room (default), or degrade by dropping the record
+	AuditOnFull string `yaml:"audit_on_full"`
+	// LocalReply is the proxy's own answer on local-reply routes
+	LocalReply *LocalReplyConfig `yaml:"local_reply"`
+	// Cache answers repeated unary calls from memory; see cache.go
+	Cache *CacheConfig `yaml:"cache"`
+	// FaultInjection delays, aborts and damages the route's calls on
+	// purpose, only with -enable-faults; see faults.go
+	FaultInjection *FaultInjectionConfig `yaml:"fault_injection"`
+	// Mirror copies a sample of the route's calls to a second backend,
+	// discarding its answers; see mirror.go
+	Mirror *MirrorConfig `yaml:"mirror"`
+	// NestedEnvelopes is how many envelopes deep an inspect-verify-sign
+	// route walks into its requests' payloads, verifying and signing each
+	// level as NestedLevels says; see nested.go
+	NestedEnvelopes int                 `yaml:"nested_envelopes"`
+	NestedLevels    []NestedLevelConfig `yaml:"nested_levels"`
+
+	// Deadlines: default_timeout applies when the client sent none, max_timeout
+	// clamps longer client deadlines, idle_timeout ends quiet streams
+	DefaultTimeout string `yaml:"default_timeout"`
+	MaxTimeout     string `yaml:"max_timeout"`
+	IdleTimeout    string `yaml:"idle_timeout"`
+
+	// BufferDepth bounds the messages buffered between Recv and Send per
+	// direction (default 100); a full buffer stops the pump from receiving.
+	BufferDepth int `yaml:"buffer_depth"`
+	// Ordering is relaxed (default) or strict: whether an unordered route
+	// forwards messages as they finish or in the order they arrived
+	Ordering string        `yaml:"ordering"`
+	Reorder  ReorderConfig `yaml:"reorder"`
+
+	envelopeVersion string         // the Envelopes entry this copy of a route handles
+	override        *routeOverride // the runtime override this route stands in for; see overrides.go
+}
+
+// PrefetchConfig bounds how far ahead of the client the proxy reads backend
+// responses (s2c direction). Disabled when Messages is 0.
+type PrefetchConfig struct {
+	Messages int `yaml:"messages"`
+	Bytes    int `yaml:"bytes"`
+}
+
+type EnvelopeConfig struct {
+	PayloadField   string `yaml:"payload_field"`
+	TypeURLField   string `yaml:"type_url_field"`
+	ClientSigField string `yaml:"client_sig_field"`
+	ProxySigField  string `yaml:"proxy_sig_field"`
+	MetadataField  string `yaml:"metadata_field"`
+	// ProxySigListField appends the proxy signature to a repeated message
+	// field instead, keeping earlier proxies' entries; see proxychain.go
+	ProxySigListField string `yaml:"proxy_sig_list_field"`
+	// ItemsField names a repeated message field of work items, each verified
+	// and signed on its own through the item_* fields; see batch.go
+	ItemsField         string `yaml:"items_field"`
+	ItemPayloadField   string `yaml:"item_payload_field"`
+	ItemClientSigField string `yaml:"item_client_sig_field"`
+	ItemProxySigField  string `yaml:"item_proxy_sig_field"`
+	BatchSignature     string `yaml:"batch_signature"` // per_item or aggregate
+	OnItemFailure      string `yaml:"on_item_failure"` // reject or strip
+	// AllowTypeCoercion reads a string field where bytes are expected, as
+	// base64, and a bytes field where a string is; see fieldtypes.go
+	AllowTypeCoercion bool `yaml:"allow_type_coercion"`
+	// ProxySigMetadataKey sends the proxy signature in gRPC metadata instead
+	// of proxy_sig_field; ProxySigMetadataMode is first or per_message
+	ProxySigMetadataKey  string `yaml:"proxy_sig_metadata_key"`
+	ProxySigMetadataMode string `yaml:"proxy_sig_metadata_mode"`
+	// BackendSigField carries the backend's signature on responses
+	BackendSigField string `yaml:"backend_sig_field"`
+	// AES-GCM nonce and RSA-wrapped payload key on encrypt-payload routes;
+	// either may be a map<string,string> entry such as "metadata[nonce]"
+	NonceField      string `yaml:"nonce_field"`
+	WrappedKeyField string `yaml:"wrapped_key_field"`
+	// IdentityField receives the client's mTLS identity on routes with
+	// bind_transport_identity: a string field path or a map<string,string>
+	// entry, as in mutations, e.g. "metadata[client_identity]"
+	IdentityField string `yaml:"identity_field"`
+}
+
+type AdminConfig struct {
+	ListenAddress string `yaml:"listen_address"` // serves /metrics when set
+	// RouteOverrides lets operators force routes to pass-thru or to reject
+	// at runtime; see overrides.go
+	RouteOverrides RouteOverridesConfig `yaml:"route_overrides"`
+}
+
+type CMSConfig struct {
+	ClientTrustStore string `yaml:"client_trust_store"`
+	ProxyPrivateKey  string `yaml:"proxy_private_key"`
+	ProxyCertificate string `yaml:"proxy_certificate"`
+	// Certificates whose keys may sign backend responses
+	BackendTrustStore string `yaml:"backend_trust_store"`
+	// encrypt-payload key material: a base64 AES-256 key shared with the
+	// backend, or the backend certificate per-message keys are wrapped for
+	PayloadKey            string `yaml:"payload_key"`
+	BackendEncryptionCert string `yaml:"backend_encryption_cert"`
+	// TrustDomains are per-tenant client trust stores, chosen per call on
+	// routes with trust_domain_from; see tenants.go
+	TrustDomains map[string]TrustDomainConfig `yaml:"trust_domains"`
+	// Keys are private keys and TrustStores certificates, by name, for the
+	// request and response verbs of routes; see directions.go
+	Keys        map[string]string `yaml:"keys"`
+	TrustStores map[string]string `yaml:"trust_stores"`
+	// Every entry above is a secret URI (file, env:// or vault://), checked
+	// for changes every SecretRefresh; see secrets.go and vault.go
+	SecretRefresh string       `yaml:"secret_refresh"`
+	Vault         *VaultConfig `yaml:"vault"`
+}
+
+// bytesCodec hands messages over undecoded. A *[]byte gets its own copy of
+// the message. A *mem.BufferSlice shares gRPC's receive buffers instead, for
+// pumps that forward a message without reading it (see runZeroCopy); its
+// holder frees it once the message is sent.
+type bytesCodec struct{}
+
+func (bytesCodec) Marshal(v interface{}) (mem.BufferSlice, error) {
+	switch b := v.(type) {
+	case *[]byte:
+		return mem.BufferSlice{mem.SliceBuffer(*b)}, nil
+	case *mem.BufferSlice:
+		// gRPC frees what Marshal returns once it is written; the caller's
+		// reference stays the caller's
+		b.Ref()
+		return *b, nil
+	}
+	return nil, fmt.Errorf("expected *[]byte or *mem.BufferSlice, got %T", v)
+}
+
+func (bytesCodec) Unmarshal(data mem.BufferSlice, v interface{}) error {
+	switch b := v.(type) {
+	case *[]byte:
+		*b = data.Materialize()
+		return nil
+	case *mem.BufferSlice:
+		// gRPC frees data when Unmarshal returns; keep a reference past that
+		data.Ref()
+		*b = data
+		return nil
+	}
+	return fmt.Errorf("expected *[]byte or *mem.BufferSlice, got %T", v)
+}
+
+func (bytesCodec) Name() string {
+	return "proto"
+}
+
+// --- Proxy ---
+
+// Proxy is one configured proxy instance. Everything parsed from the config
+// at startup lives here, so several proxies can share a process; only the
+// metrics registry is process-wide.
+type Proxy struct {
+	cfg          Config
+	cryptoEngine string // engineGo or engineRust
+	hooks        Hooks
+	diag         *Diagnostics // startup findings; set by WithDiagnostics
+
+	// Descriptors. lazySchema is non-nil when schema.lazy is enabled;
+	// methodDescriptors is then unused. Reflected descriptors may arrive
+	// after startup (see schemaretry.go) and fetched ones may be replaced
+	// (see remoteschema.go), hence the atomic.
+	methodDescriptors atomic.Pointer[map[string]*desc.MethodDescriptor]
+	lazySchema        *lazyDescriptors
+	schemaPending     atomic.Bool   // reflection is still being retried
+	reflectTimeout    time.Duration // per reflection attempt; see schemaretry.go
+	reflectAttempts   int
+	remoteSchema      *remoteSchema // schema.method url; nil otherwise
+	pbSchema          *pbSchema     // schema.method both; nil otherwise
+
+	// Cryptographic materials, with the raw PEM kept for the Rust CGO FFI
+	clientTrust *trustAnchor // cms.client_trust_store
+	proxyKey    *signingKey  // cms.proxy_private_key
+
+	// Secrets to reload as they change, and the Vault client vault://
+	// secrets share; see secrets.go
+	secretWatches []*secretWatch
+	vault         *vaultClient
+	vaultErr      error
+	vaultOnce     sync.Once
+
+	// Per-tenant client trust stores by domain name, and the domain each
+	// client certificate SAN selects; see tenants.go
+	trustDomains       map[string]*trustAnchor
+	trustDomainSANs    map[string]string
+	routeTenantSources map[string]tenantSource
+
+	// Public keys of upstream proxies allowed to assert a client identity
+	upstreamIdentityKeys []*rsa.PublicKey
+
+	// Public keys backends sign responses with (cms.backend_trust_store)
+	backendTrust *trustKeys
+
+	// cms.keys and cms.trust_stores by name, and each route's verify and
+	// sign verbs; see directions.go
+	namedKeys     map[string]*signingKey
+	namedTrust    map[string]*trustKeys
+	defaultCrypto *cryptoPlan
+	routeCrypto   map[string]*cryptoPlan
+	routeSessions map[string]*sessionTokens
+	upstreamTrust map[string]*trustKeys // verify_upstream_proxy; see proxychain.go
+
+	// Per-call response signing keys; see keyselect.go
+	routeKeySelectors map[string]*keySelector
+	// Envelope fields read from stream metadata; see envelopeheaders.go
+	routeEnvelopeHeaders map[string]*envelopeHeaderSources
+	// Faults routes inject, only with WithFaultInjection; see faults.go
+	routeFaults   map[string]*faultInjector
+	faultsEnabled bool
+	// nil unless a route has debug_signature_mismatch; see sigdebug.go
+	sigDebug *sigDebugger
+	// Second backends routes copy calls to; see mirror.go
+	routeMirrors map[string]*routeMirror
+	// Envelopes routes walk inside their requests' payloads; see nested.go
+	routeNesting map[string]*routeNesting
+	// Runtime route overrides, by route name; see overrides.go
+	overrides  *overrideStore
+	routeNames map[string]bool
+
+	// Payload encryption keys: the shared AES key and the backend's wrapping key
+	payloadKey           []byte
+	backendEncryptionKey *rsa.PublicKey
+
+	// Upstream (m)TLS settings (nil means plaintext) and the endpoint pool
+	backendTLS *tls.Config
+	backends   *backendPool
+	conns      *connManager // shared backend connections
+
+	// Listener TLS (nil means plaintext) and the trusted upstream CIDRs
+	listeners    []*listener
+	listenerTLS  *tls.Config // the first TCP listener's, which the web gateway reuses
+	upstreamNets []*net.IPNet
+	// The security checks, globally and by route; perimeterOn installs the
+	// interceptor that runs them. See perimeter.go.
+	perimeter      *perimeterRule
+	routePerimeter map[string]*perimeterRule
+	perimeterOn    bool
+
+	// Keepalive and connection lifetime options for the listener and the
+	// backend dial; empty and nil keep the gRPC defaults
+	serverKeepalive  []grpc.ServerOption
+	backendKeepalive *keepalive.ClientParameters
+	backendDialer    func(context.Context, string) (net.Conn, error) // nil dials the network
+	mock             *mockBackend                                    // backend.mode: mock
+
+	// upstreamGzip compresses gzip messages to the backend at
+	// backend.compression.gzip_level; nil uses the registered gzip
+	upstreamGzip grpc.Compressor
+
+	// Per-route state keyed by RouteConfig.Name, which is unique, so routes
+	// sharing a match keep their own settings. defaultRetry applies to
+	// routes without their own retry block; a route block replaces it entirely.
+	routeLimiters         map[string]*routeLimiter
+	routeRetries          map[string]*retryPolicy
+	defaultRetry          *retryPolicy
+	restarts              *restartPolicy // see goaway.go
+	routeTimeoutSettings  map[string]routeTimeouts
+	routeStreamLimits     map[string]streamLimits
+	routeMutations        map[string][]mutation
+	routeInnerRules       map[string]*innerRules
+	routeTypeURLs         map[string]*typeURLPolicy
+	routeLocalReplies     map[string]*localReply
+	routeWrappers         map[string]*envelopeWrapper
+	routeCiphers          map[string]*payloadCipher
+	routeEnvelopes        map[string]*resolvedEnvelope // by route, method and direction; see envelopeKey
+	routeEnvelopeVersions map[string]*envelopeVersions
+	routeCaches           map[string]*responseCache
+	routeIdentityFields   map[string]mutation // set_string into envelope.identity_field
+	routeReorders         map[string]*reorderPolicy
+	cpuClasses            map[string]*cpuClass // by class name
+	shedder               *loadShedder         // nil unless load_shedding is enabled
+	routeTaps             map[string]*routeTap
+	routeRedactions       map[string]*redaction
+	decodeLimits          decodeLimits
+	routeDecodeLimits     map[string]decodeLimits
+	decodeLogs            *sampledLog             // undecodable messages; see decodefailure.go
+	routes                *routeTable             // matchRoute's index over cfg.Routes
+	engines               map[string]cryptoEngine // by name, those in use
+	routeEngines          map[string]cryptoEngine
+	registeredSinks       []namedTapSink
+	tapQueues             []*tapQueue
+
+	// Message processors by name: the built-ins plus those from WithProcessor
+	processors map[string]MessageProcessor
+	registered []namedProcessor
+
+	tracer   *spanExporter   // nil when tracing is not configured
+	capturer *captureWriter  // nil when capture is not configured
+	auditor  *auditWriter    // nil when audit is not configured
+	web      *webGateway     // nil without web.listen_address
+	streams  *streamRegistry // every call being proxied; see janitor.go
+
+	server    *grpc.Server
+	admin     *http.Server
+	debug     *http.Server
+	startOnce sync.Once
+	startErr  error
+	stopOnce  sync.Once
+	stop      chan struct{} // closed by Shutdown; ends resolvers, rotation, eviction and exporters
+
+	preflightTimeout time.Duration // 0 skips preflight; see preflight.go
+	preflightPending atomic.Bool   // preflight has yet to pass
+}
+
+// Hooks let an embedding program add behaviour without forking the proxy.
+// Nil hooks are skipped.
+type Hooks struct {
+	// MatchRoute runs before the configured routes; returning nil falls back
+	// to them. Limits, retries, timeouts, mutations, validation and local
+	// replies are looked up by the returned route's Match, so a route that is
+	// not in the config runs without them. Its Name labels the call's metrics.
+	MatchRoute func(method string) *RouteConfig
+
+	// ProcessMessage runs on every message after the proxy's own processing,
+	// in every mode except local-reply. It returns the payload to forward; an
+	// error ends the call with that error. For logic that needs the decoded
+	// envelope, or must run before signing, register a MessageProcessor.
+	ProcessMessage func(ctx context.Context, msg *Message) ([]byte, error)
+}
+
+// Message is one message passing through the proxy, as seen by Hooks.ProcessMessage
+type Message struct {
+	Method  string
+	Request bool // client->backend
+	Route   *RouteConfig
+	Payload []byte
+}
+
+// Option configures NewProxy
+type Option func(*Proxy)
+
+// WithCryptoEngine selects "go" (the default) or "rust" for verify and sign;
+// CryptoEngines lists those the build has
+func WithCryptoEngine(engine string) Option {
+	return func(px *Proxy) { px.cryptoEngine = engine }
+}
+
+// WithHooks installs embedding hooks
+func WithHooks(h Hooks) Option {
+	return func(px *Proxy) { px.hooks = h }
+}
+
+// WithBackendDialer connects to backend endpoints through dial instead of the
+// network, e.g. to an in-process bufconn listener; addr is the configured address
+func WithBackendDialer(dial func(ctx context.Context, addr string) (net.Conn, error)) Option {
+	return func(px *Proxy) { px.backendDialer = dial }
+}
+
+// WithDiagnostics collects every startup finding, warnings included, into
+// diag. Without it NewProxy only reports errors, through its error.
+func WithDiagnostics(diag *Diagnostics) Option {
+	return func(px *Proxy) { px.diag = diag }
+}
+
+// NewProxy loads descriptors and cryptographic material for cfg and builds
+// the gRPC server. It does not listen; call Serve. Every startup phase reports
+// into one Diagnostics so all problems surface together.
+func NewProxy(cfg Config, opts ...Option) (*Proxy, error) {
+	px := &Proxy{
+		cfg:                   cfg,
+		cryptoEngine:          engineGo,
+		routeLimiters:         map[string]*routeLimiter{},
+		routeRetries:          map[string]*retryPolicy{},
+		routeTimeoutSettings:  map[string]routeTimeouts{},
+		routeStreamLimits:     map[string]streamLimits{},
+		routeMutations:        map[string][]mutation{},
+		routeInnerRules:       map[string]*innerRules{},
+		routeTypeURLs:         map[string]*typeURLPolicy{},
+		routeLocalReplies:     map[string]*localReply{},
+		routeWrappers:         map[string]*envelopeWrapper{},
+		routeCiphers:          map[string]*payloadCipher{},
+		routeEnvelopes:        map[string]*resolvedEnvelope{},
+		routeCaches:           map[string]*responseCache{},
+		routeIdentityFields:   map[string]mutation{},
+		routeReorders:         map[string]*reorderPolicy{},
+		cpuClasses:            map[string]*cpuClass{},
+		routeTaps:             map[string]*routeTap{},
+		routeRedactions:       map[string]*redaction{},
+		routeDecodeLimits:     map[string]decodeLimits{},
+		routePerimeter:        map[string]*perimeterRule{},
+		decodeLogs:            newSampledLog(decodeLogInterval),
+		engines:               map[string]cryptoEngine{},
+		routeEngines:          map[string]cryptoEngine{},
+		namedKeys:             map[string]*signingKey{},
+		namedTrust:            map[string]*trustKeys{},
+		routeCrypto:           map[string]*cryptoPlan{},
+		routeSessions:         map[string]*sessionTokens{},
+		routeKeySelectors:     map[string]*keySelector{},
+		routeEnvelopeHeaders:  map[string]*envelopeHeaderSources{},
+		routeFaults:           map[string]*faultInjector{},
+		routeMirrors:          map[string]*routeMirror{},
+		routeNesting:          map[string]*routeNesting{},
+		overrides:             &overrideStore{timers: map[string]*time.Timer{}},
+		routeNames:            map[string]bool{},
+		upstreamTrust:         map[string]*trustKeys{},
+		routeEnvelopeVersions: map[string]*envelopeVersions{},
+		trustDomains:          map[string]*trustAnchor{},
+		trustDomainSANs:       map[string]string{},
+		routeTenantSources:    map[string]tenantSource{},
+		streams:               &streamRegistry{},
+		stop:                  make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(px)
+	}
+	diag := px.diag
+	if diag == nil {
+		diag = &Diagnostics{}
+	}
+
+	px.checkCryptoEngine(diag)
+	px.checkConfigTemplates(diag)
+	px.checkRoutes(diag)
+	px.loadRouteTable(diag)
+	px.loadBackendTLS(diag)
+	px.loadBackends(diag)
+	px.loadConnManager(diag)
+	px.loadCompression(diag)
+	px.loadSchema(diag)
+	px.loadMockBackend(diag)
+	px.checkEnvelopes(diag)
+	px.loadEnvelopeVersions(diag)
+	px.loadEnvelopeHeaders(diag)
+	px.loadDecodeLimits(diag)
+	px.loadCMSMaterial(diag)
+	px.loadListenerSecurity(diag)
+	px.loadPerimeter(diag)
+	px.loadKeepalive(diag)
+	px.loadRouteLimits(diag)
+	px.loadStreamLimits(diag)
+	px.loadOrdering(diag)
+	px.loadCPUClasses(diag)
+	px.loadLoadShedding(diag)
+	px.loadRetryPolicies(diag)
+	px.loadBackendRestarts(diag)
+	px.loadRouteTimeouts(diag)
+	px.loadMetadataRules(diag)
+	px.loadMetadataCopies(diag)
+	px.loadBackendSignatures(diag)
+	px.loadPayloadEncryption(diag)
+	px.loadMutations(diag)
+	px.loadIdentityBindings(diag)
+	px.loadTrustDomains(diag)
+	px.loadSecretRefresh(diag)
+	px.loadCryptoPlans(diag)
+	px.loadKeySelectors(diag)
+	px.loadEmptyPayloads(diag)
+	px.loadDecodeFailures(diag)
+	px.loadWirePreservation(diag)
+	px.loadStreamAttestation(diag)
+	px.loadVerifyBeforeConnect(diag)
+	px.loadProxySigMetadata(diag)
+	px.loadProxyChains(diag)
+	px.loadBatchEnvelopes(diag)
+	px.loadNestedEnvelopes(diag)
+	px.loadCryptoEngines(diag)
+	px.loadSessionTokens(diag)
+	px.loadWrapEnvelopes(diag)
+	px.loadProcessors(diag)
+	px.loadInnerValidation(diag)
+	px.loadTypeURLPolicies(diag)
+	px.loadLocalReplies(diag)
+	px.loadResponseCaches(diag)
+	px.loadTracing(diag)
+	px.loadPeerInfo(diag)
+	px.loadJanitor(diag)
+	px.loadFaultInjection(diag)
+	px.loadSignatureDebug(diag)
+	px.loadMirrors(diag)
+	px.loadRouteOverrides(diag)
+	px.loadCapture(diag)
+	px.loadTaps(diag)
+	px.loadRedaction(diag)
+	px.loadAudit(diag)
+	px.web = px.loadWebGateway(diag)
+	if err := diag.Err(); err != nil {
+		px.stopOnce.Do(func() { close(px.stop) })
+		if px.conns != nil {
+			px.conns.closeAll()
+		}
+		px.closeMirrors()
+		return nil, err
+	}
+
+	px.newServers()
+	return px, nil
+}
+
+// Config returns the configuration the proxy was built from
+func (px *Proxy) Config() Config {
+	return px.cfg
+}
+
+// Serve accepts gRPC connections on lis until Shutdown, with the first
+// listener's TLS settings. The first call to Serve or ListenAndServe also
+// starts the admin, debug and web listeners when they are configured, and
+// runs preflight when WithPreflight asked for it.
+func (px *Proxy) Serve(lis net.Listener) error {
+	if err := px.start(); err != nil {
+		return err
+	}
+	return px.serveOn(px.listeners[0], lis)
+}
+
+func (px *Proxy) start() error {
+	px.startOnce.Do(func() {
+		if px.cfg.Admin.ListenAddress != "" {
+			var override http.HandlerFunc
+			if px.cfg.Admin.RouteOverrides.Enabled {
+				override = px.overrideHandler
+			}
+			px.admin = startAdminServer(px.cfg.Admin.ListenAddress, px.orderedRoutes(), px.streams, px.readiness, px.overrides, override)
+		}
+		if px.cfg.Debug.ListenAddress != "" {
+			px.debug = px.startDebugServer(px.cfg.Debug.ListenAddress)
+		}
+		if px.startErr = px.preflight(); px.startErr != nil {
+			return
+		}
+		if px.web != nil {
+			px.startErr = px.web.start(px.server, px.listenerTLS, px.upstreamNets)
+		}
+	})
+	return px.startErr
+}
+
+// Shutdown stops accepting calls and waits for in-flight ones to finish. If
+// ctx ends first the remaining calls are cancelled and ctx's error returned.
+// Background work stops, and queued spans, captured and tapped messages and
+// audit records are flushed.
+func (px *Proxy) Shutdown(ctx context.Context) error {
+	if px.web != nil && px.web.srv != nil {
+		px.web.srv.Shutdown(ctx)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, l := range px.listeners {
+			wg.Add(1)
+			go func(s *grpc.Server) {
+				defer wg.Done()
+				s.GracefulStop()
+			}(l.server)
+		}
+		wg.Wait()
+		close(stopped)
+	}()
+	var err error
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		px.stopServers()
+		err = ctx.Err()
+	}
+	if px.admin != nil {
+		px.admin.Shutdown(ctx)
+	}
+	if px.debug != nil {
+		px.debug.Shutdown(ctx)
+	}
+	if px.mock != nil {
+		px.mock.srv.Stop()
+	}
+
+	px.stopOnce.Do(func() { close(px.stop) })
+	px.closeMirrors()
+	px.stopOverrides()
+	for _, done := range px.flushers() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// flushers are the background writers Shutdown waits for
+func (px *Proxy) flushers() []chan struct{} {
+	var done []chan struct{}
+	if px.tracer != nil {
+		done = append(done, px.tracer.done)
+	}
+	if px.capturer != nil {
+		done = append(done, px.capturer.done)
+	}
+	if px.auditor != nil {
+		done = append(done, px.auditor.done)
+	}
+	for _, q := range px.tapQueues {
+		done = append(done, q.done)
+	}
+	return done
+}
+
+// builtinPassthrough lists the services that are proxied untouched by default.
+// Their messages are never envelopes, so inspecting them under a broad
+// wildcard only produces unmarshal errors on every exchange.
+var builtinPassthrough = []string{
+	"/grpc.reflection.v1alpha.",
+	"/grpc.reflection.v1.",
+	"/grpc.health.v1.",
+}
+
+// Names of the routes matchRoute makes up when no config route applies
+const (
+	defaultRouteName = "default-pass-thru"
+	builtinRouteName = "builtin-pass-thru"
+)
+
+// matchRoute determines which routing mode to use. Precedence, first wins:
+//  1. the MatchRoute hook
+//  2. for reflection and health methods, a config route whose pattern names
+//     that service explicitly (e.g. "/grpc.health.v1.Health/*")
+//  3. for reflection and health methods, the built-in pass-thru route, unless
+//     builtin_passthrough is false
+//  4. config routes, by priority, then specificity, then order (see
+//     routetable.go)
+//  5. pass-thru
+//
+// and then takes whatever runtime override applies to the route it picked;
+// see overrides.go.
+func (px *Proxy) matchRoute(methodName string) *RouteConfig {
+	route := px.configuredRoute(methodName)
+	if o := px.overrides.current.Load(); o != nil {
+		return o.apply(route)
+	}
+	return route
+}
+
+// configuredRoute is matchRoute without overrides
+func (px *Proxy) configuredRoute(methodName string) *RouteConfig {
+	if px.hooks.MatchRoute != nil {
+		if route := px.hooks.MatchRoute(methodName); route != nil {
+			return route
+		}
+	}
+	if route := px.builtinRoute(methodName); route != nil {
+		return route
+	}
+	if i := px.routes.lookup(px.cfg.Routes, methodName, nil); i >= 0 {
+		route := px.cfg.Routes[i]
+		return &route
+	}
+	// Default to pass-through if no match
+	return &RouteConfig{Name: defaultRouteName, Mode: "pass-thru"}
+}
+
+// builtinRoute returns the route for a reflection or health method when the
+// built-in pass-thru applies to it, covering steps 2 and 3 of matchRoute
+func (px *Proxy) builtinRoute(methodName string) *RouteConfig {
+	if b := px.cfg.BuiltinPassthrough; b != nil && !*b {
+		return nil
+	}
+	for _, prefix := range builtinPassthrough {
+		if !strings.HasPrefix(methodName, prefix) {
+			continue
+		}
+		explicit := func(r *RouteConfig) bool { return strings.HasPrefix(r.Match, prefix) }
+		if i := px.routes.lookup(px.cfg.Routes, methodName, explicit); i >= 0 {
+			route := px.cfg.Routes[i]
+			return &route
+		}
+		return &RouteConfig{Name: builtinRouteName, Match: prefix + "*", Mode: "pass-thru"}
+	}
+	return nil
+}
+
+// matches reports whether the route's pattern covers methodName. A prefix
+// keeps its "/", so "/a.B/*" covers the methods of a.B but not of a.Bar.
+func (r *RouteConfig) matches(methodName string) bool {
+	if strings.HasSuffix(r.Match, "/*") {
+		return strings.HasPrefix(methodName, strings.TrimSuffix(r.Match, "*"))
+	}
+	return r.Match == methodName
+}
+
+// lookupMethod resolves a method descriptor from the lazy index or the eager map
+func (px *Proxy) lookupMethod(method string) (*desc.MethodDescriptor, bool) {
+	if px.lazySchema != nil {
+		return px.lazySchema.lookupMethod(method)
+	}
+	md, ok := px.eagerDescriptors()[method]
+	return md, ok
+}
+
+// knownMethods lists every method name the loaded schema describes
+func (px *Proxy) knownMethods() []string {
+	var names []string
+	if px.lazySchema != nil {
+		for name := range px.lazySchema.methods {
+			names = append(names, name)
+		}
+		return names
+	}
+	for name := range px.eagerDescriptors() {
+		names = append(names, name)
+	}
+	return names
+}
+
+// isUnaryMethod reports whether the loaded descriptor says neither side streams
+func (px *Proxy) isUnaryMethod(method string) bool {
+	md, ok := px.lookupMethod(method)
+	return ok && !md.IsClientStreaming() && !md.IsServerStreaming()
+}
+
+func (px *Proxy) transparentHandler(srv interface{}, serverStream grpc.ServerStream) (err error) {
+	fullMethodName, ok := grpc.MethodFromServerStream(serverStream)
+	if !ok {
+		return status.Errorf(codes.Internal, "lowLevelServerStream not exists in context")
+	}
+
+	route := px.matchRoute(fullMethodName)
+	client := px.peerOf(serverStream.Context())
+	if client.addr != "" {
+		log.Printf("[Proxy] Intercepted %s | Route: %s | Mode: %s | Peer: %s", fullMethodName, route.Name, route.Mode, client)
+	} else {
+		log.Printf("[Proxy] Intercepted %s | Route: %s | Mode: %s", fullMethodName, route.Name, route.Mode)
+	}
+
+	timings := newCallTimings()
+	var identity string
+	var rpcSpan *span
+	unary := px.isUnaryMethod(fullMethodName)
+	defer func() {
+		rpcSpan.end(err)
+		finishCall(fullMethodName, route, identity, client, unary, timings, rpcSpan, err)
+	}()
+	defer func() { err = markRejection(serverStream, fullMethodName, route, err) }()
+	defer func() { err = callStatus(err) }()
+	defer func() { err = px.restartStatus(serverStream, err) }()
+
+	if err = overrideRejection(route); err != nil {
+		return err
+	}
+	if err = px.shedder.admit(route); err != nil {
+		return err
+	}
+	limiter := px.limiterFor(route)
+	if unary {
+		if err = limiter.allow(); err != nil {
+			return err
+		}
+	} else {
+		release, lerr := limiter.openStream()
+		if lerr != nil {
+			return lerr
+		}
+		defer release()
+	}
+
+	md, _ := metadata.FromIncomingContext(serverStream.Context())
+	md = md.Copy()
+	rpcSpan = px.startRPCSpan(fullMethodName, md)
+	rpcSpan.set("proxy.route.name", route.Name)
+	rpcSpan.set("proxy.route.mode", route.Mode)
+	identity, err = px.resolveClientIdentity(serverStream.Context(), fullMethodName, md)
+	if err != nil {
+		return err
+	}
+	tenant, err := px.resolveTenant(serverStream.Context(), route, md)
+	if err != nil {
+		return err
+	}
+	keys, err := px.selectSignKey(route, md)
+	if err != nil {
+		return err
+	}
+	envHeaders, err := px.captureEnvelopeHeaders(route, md)
+	if err != nil {
+		return err
+	}
+	faults := px.routeFaults[route.Name].newCall(fullMethodName)
+	if err = faults.abort(); err != nil {
+		return err
+	}
+	tc := &metadataContext{ctx: serverStream.Context(), method: fullMethodName, identity: identity}
+	route.Metadata.apply(md, tc)
+	rpcSpan.set("proxy.client_identity", identity)
+
+	// Answered by the proxy itself; the backend is never dialled
+	if route.Mode == "local-reply" {
+		return px.serveLocalReply(fullMethodName, route, serverStream)
+	}
+
+	// The backend hop gets its own span, which the backend sees as its parent
+	spanCtx := contextWithSpan(serverStream.Context(), rpcSpan)
+	backendSpan := startChildSpan(spanCtx, "proxy.backend "+fullMethodName, spanKindClient)
+	defer func() { backendSpan.end(err) }()
+	backendSpan.inject(md)
+
+	var att *streamAttestation
+	if px.attests(route, fullMethodName) {
+		att = &streamAttestation{}
+		defer att.abandon(route)
+		md.Set(streamAttestationHeader, "v1")
+	}
+
+	outCtx := metadata.NewOutgoingContext(spanCtx, md)
+	outCtx = context.WithValue(outCtx, clientIdentityKey{}, identity)
+	outCtx = context.WithValue(outCtx, tenantKey{}, tenant)
+	if keys != nil {
+		outCtx = context.WithValue(outCtx, keyChoiceKey{}, keys)
+	}
+	if envHeaders != nil {
+		outCtx = context.WithValue(outCtx, envelopeHeadersKey{}, envHeaders)
+	}
+	if att != nil {
+		outCtx = context.WithValue(outCtx, attestationKey{}, att)
+	}
+	if faults != nil {
+		outCtx = context.WithValue(outCtx, callFaultsKey{}, faults)
+	}
+	copied := newCopiedHeaders(route)
+	if copied != nil {
+		outCtx = context.WithValue(outCtx, copiedHeadersKey{}, copied)
+	}
+	sigs := px.newProxySigs(route)
+	if sigs != nil {
+		outCtx = context.WithValue(outCtx, proxySigsKey{}, sigs)
+	}
+
+	dl := px.withRouteDeadline(outCtx, route, unary)
+	defer dl.cancel()
+	defer func() { err = dl.enforcedErr(serverStream.Context(), err) }()
+	callCtx, active := px.streams.add(dl.ctx, fullMethodName, route, unary, dl.abort)
+	defer px.streams.remove(active)
+	guard, clientCtx := px.guardStream(callCtx, fullMethodName, route, unary)
+
+	// A session-token route opens the backend call once the first message
+	// has verified, with the token it minted for the stream
+	var clientSrc grpc.ServerStream = serverStream
+	if route.Mode == "session-token" {
+		if clientCtx, clientSrc, err = px.openSession(clientCtx, fullMethodName, route, serverStream); err != nil {
+			return err
+		}
+	}
+	// So does a verify_before_connect route, without the token
+	if route.VerifyBeforeConnect && route.Mode == "inspect-verify-sign" {
+		if clientCtx, clientSrc, err = px.verifyBeforeConnect(clientCtx, fullMethodName, route, serverStream); err != nil {
+			return err
+		}
+	}
+
+	policy := px.retryPolicyFor(route)
+	if unary {
+		return px.proxyUnary(clientCtx, fullMethodName, route, policy, timings, clientSrc, tc)
+	}
+
+	// With the request signature in metadata the backend call waits for the
+	// first message to be signed
+	var clientStream grpc.ClientStream
+	if sigs != nil && sigs.request {
+		deferred := px.deferUpstream(clientCtx, fullMethodName, policy, sigs)
+		defer deferred.close()
+		clientStream = deferred
+	} else {
+		up, err := px.openUpstream(clientCtx, fullMethodName, policy)
+		if err != nil {
+			return err
+		}
+		defer up.close()
+		clientStream = up.stream
+	}
+	mirror := px.routeMirrors[route.Name].stream(clientCtx, fullMethodName)
+	defer mirror.stop()
+
+	var backendSrc grpc.Stream = clientStream
+	if route.Prefetch.Messages > 0 {
+		prefetcher := newPrefetchStream(clientStream, route.Prefetch, fullMethodName)
+		defer prefetcher.stop()
+		backendSrc = prefetcher
+	}
+
+	s2c := px.newPump(clientCtx, fullMethodName, false, route, timings)
+	c2s := px.newPump(clientCtx, fullMethodName, true, route, timings)
+	s2c.idle, c2s.idle = dl.idle, dl.idle
+	s2c.guard, c2s.guard = guard, guard
+	s2c.slow = guard.slowConsumer()
+	s2c.capture = px.newCallCapture(fullMethodName, route)
+	c2s.capture = s2c.capture
+
+	// Response headers go out with the first message; the trailer once the
+	// backend has finished (it is only safe to read after that)
+	clientDst := &responseHeaderStream{ServerStream: serverStream, backend: clientStream, rules: &route.ResponseMetadata, tc: tc, copied: copied}
+	s2cDone := false
+	defer func() {
+		if s2cDone {
+			forwardTrailer(serverStream, clientStream, &route.ResponseMetadata, tc, copied)
+			sigs.setTrailer(serverStream)
+		}
+	}()
+	defer func() { err = guard.finish(serverStream, err, &s2cDone) }()
+
+	s2cErrChan := make(chan error, 1)
+	go s2c.run(backendSrc, clientDst, s2cErrChan)
+
+	c2sErrChan := make(chan error, 1)
+	go c2s.run(clientSrc, mirror.tee(clientStream), c2sErrChan)
+
+	select {
+	case <-s2c.slow.slow():
+		return s2c.slow.err
+	case err := <-s2cErrChan:
+		s2cDone = true
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	case err := <-c2sErrChan:
+		if err == io.EOF {
+			if att != nil {
+				if err := px.sendAttestation(clientCtx, fullMethodName, route, att, clientStream); err != nil {
+					log.Printf("[Attestation] %s: %v", fullMethodName, err)
+				}
+			}
+			clientStream.CloseSend()
+			mirror.stop()
+			timings.markRequestComplete()
+			err = <-s2cErrChan
+			s2cDone = true
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		return err
+	}
+}
+
+// processMsg runs the route's processing on one message, holding a slot of
+// the route's cpu class if it has one, and timing it for load shedding.
+// Shadow routes do all of it on a copy and forward the original bytes
+// whatever the outcome.
+func (px *Proxy) processMsg(ctx context.Context, method string, isReq bool, payload []byte, route *RouteConfig) ([]byte, error) {
+	debugMessages.Add(route.Mode, 1)
+	if err := skipCancelled(ctx, route, isReq, "process"); err != nil {
+		return nil, err
+	}
+	defer px.shedder.track()()
+	release, err := px.cpuClasses[route.CPUClass].acquire(ctx, route)
+	if err != nil {
+		if skipped := skipCancelled(ctx, route, isReq, "process"); skipped != nil {
+			return nil, skipped
+		}
+		if route.Shadow {
+			return payload, nil
+		}
+		return nil, err
+	}
+	defer release()
+	if !route.Shadow {
+		return px.processEnvelope(ctx, method, isReq, payload, route)
+	}
+	out, err := px.processEnvelope(ctx, method, isReq, bytes.Clone(payload), route)
+	px.recordShadow(method, isReq, route, payload, out, err)
+	return payload, nil
+}
+
+// processEnvelope dynamically decodes the envelope, performs CMS logic, and re-encodes.
+// An error rejects the message; only the route's inner payload rules, its
+// backend signature policy, payload encryption, its processors and a blocked
+// audit log do that. Every rejection is audited along with the verify and sign decisions.
+func (px *Proxy) processEnvelope(ctx context.Context, method string, isReq bool, payload []byte, route *RouteConfig) (_ []byte, err error) {
+	dir := "Response"
+	if isReq {
+		dir = "Request"
+	}
+	defer func() {
+		if err != nil {
+			px.audit(ctx, method, route, isReq, auditEvent{op: "reject", decision: status.Code(err).String(), reason: status.Convert(err).Message(), payload: payload})
+		}
+	}()
+
+	if route.Mode == "wrap-envelope" {
+		return px.wrapEnvelope(ctx, method, isReq, payload, route)
+	}
+	md, ok := px.lookupMethod(method)
+	if !ok {
+		return px.decodeFailed(route, method, isReq, decodeNoDescriptor, payload, fmt.Errorf("no descriptor loaded for %s", method))
+	}
+
+	var msgDesc *desc.MessageDescriptor
+	if isReq {
+		msgDesc = md.GetInputType()
+	} else {
+		msgDesc = md.GetOutputType()
+	}
+
+	// 1. Unmarshal into the Dynamic Message representation, once the
+	// request is known not to be built to exhaust it
+	if isReq {
+		if err := px.guardDecode(route, method, "envelope", msgDesc, payload); err != nil {
+			return nil, err
+		}
+	}
+	dynMsg := dynamic.NewMessage(msgDesc)
+	if err := dynMsg.Unmarshal(payload); err != nil {
+		return px.decodeFailed(route, method, isReq, decodeUnmarshalError, payload, fmt.Errorf("%s envelope does not decode: %v", strings.ToLower(dir), err))
+	}
+
+	// 2. Extract specific fields defined by the YAML config dynamically, from
+	// the envelope version the message carries when the route lists several
+	variant, err := px.envelopeVariant(ctx, route, dynMsg, isReq)
+	if err != nil {
+		return nil, err
+	}
+	if variant == nil {
+		return payload, nil
+	}
+	route = variant
+	env := px.envelopeFor(route, method, isReq, msgDesc)
+	if err := env.checkTypes(dynMsg, isReq); err != nil {
+		return px.decodeFailed(route, method, isReq, decodeWrongType, payload, fmt.Errorf("%s: %v", msgDesc.GetFullyQualifiedName(), err))
+	}
+	if field := px.missingEnvelopeField(route, env, isReq); field != "" {
+		return px.decodeFailed(route, method, isReq, decodeMissingField, payload, fmt.Errorf("%s has no %s", msgDesc.GetFullyQualifiedName(), field))
+	}
+	payloadBytes := getBytesField(dynMsg, env.payload)
+	if payloadBytes == nil {
+		px.payloadMissing(route, method, isReq, env)
+	}
+	typeURL := env.typeURLOf(ctx, dynMsg, isReq)
+	retyped := false
+	if isReq {
+		url, out, err := px.checkTypeURL(route, method, typeURL, payload)
+		if out != nil || err != nil {
+			return out, err
+		}
+		if url != typeURL {
+			retyped = setEnvelopeField(dynMsg, env.typeURL, url) == nil
+			typeURL = url
+		}
+	}
+
+	// Log the full Envelope structure (Metadata, TypeURL, etc.), redacted
+	redact := px.redactionFor(route)
+	js, _ := dynMsg.MarshalJSONIndent()
+	if !route.LogInnerPayload {
+		js = hideItemPayloads(hidePayload(js, env.payload, true), env, true)
+	}
+	js, _ = redact.redactJSON(js, msgDesc, true)
+	log.Printf("[%s Envelope] %s:\n%s", dir, method, string(js))
+
+	// Attempt to parse the inner payload if it has a TypeURL
+	if isReq && typeURL != "" {
+		if innerDesc := px.findDescByType(typeName(typeURL)); innerDesc != nil {
+			if err := px.guardDecode(route, method, "inner payload", innerDesc, payloadBytes); err != nil {
+				return nil, err
+			}
+		}
+	}
+	innerDynMsg, innerErr := px.decodeInner(typeURL, payloadBytes)
+	switch {
+	case innerDynMsg == nil || innerErr != nil || len(payloadBytes) == 0:
+	case route.LogInnerPayload:
+		jsInner, _ := innerDynMsg.MarshalJSONIndent()
+		jsInner, _ = redact.redactJSON(jsInner, innerDynMsg.GetMessageDescriptor(), true)
+		log.Printf("[%s Inner Payload Decoded] %s:\n%s", dir, typeURL, string(jsInner))
+	default:
+		log.Printf("[%s Inner Payload Decoded] %s (%d bytes; log_inner_payload is off)", dir, typeURL, len(payloadBytes))
+	}
+	if isReq && px.nextNestedType(px.routeNesting[route.Name], 0, msgDesc, typeURL) == nil {
+		if err := px.checkInner(route, typeURL, innerDynMsg, innerErr); err != nil {
+			log.Printf("[%s Rejected] %s: %v", dir, method, err)
+			return nil, err
+		}
+	}
+
+	info := methodInfo(ctx, method, route, md)
+	info.envelope = env
+	info.wire = payload
+	if route.Mode == "encrypt-payload" {
+		return px.cryptPayload(ctx, dynMsg, info, isReq, dir)
+	}
+
+	if !isReq {
+		px.envelopeMetadataToGRPC(ctx, route, dynMsg, env)
+	}
+
+	// 3. Verify, mutate, run the route's processors and sign, in that order
+	pdir := directionOf(isReq)
+	signing := route.Mode == "inspect-verify-sign"
+	if signing {
+		if out, err := px.runProcessors(ctx, info, pdir, dynMsg, []string{processorVerifyBackend, processorVerifyClient, processorVerifyUpstream}); out != nil || err != nil {
+			return out, err
+		}
+	}
+	nested := false
+	if isReq && signing {
+		if err := px.noteSignKey(ctx, route, dynMsg); err != nil {
+			return nil, err
+		}
+		if nested, err = px.processNested(ctx, info, dynMsg); err != nil {
+			return nil, err
+		}
+	}
+	changed := isReq && px.grpcMetadataToEnvelope(ctx, route, method, dynMsg, env)
+	changed = px.mutateEnvelope(dynMsg, route, isReq, dir, method) || changed || retyped || nested
+	if isReq {
+		bound, err := px.bindTransportIdentity(ctx, dynMsg, route, method)
+		if err != nil {
+			return nil, err
+		}
+		changed = changed || bound
+	}
+	steps := append([]string{}, route.Processors...)
+	if len(route.Processors) > 0 {
+		info.digests = &payloadDigests{} // they may have written into the payload verified above
+	}
+	if signing {
+		steps = append(steps, processorSign)
+	}
+	if out, err := px.runProcessors(ctx, info, pdir, dynMsg, steps); out != nil || err != nil {
+		return out, err
+	}
+	// A signature bound for metadata leaves nothing in the envelope to re-encode
+	sigOnly := len(route.Processors) == 0 && route.Envelope.ProxySigMetadataKey != ""
+	if !changed && (len(steps) == 0 || sigOnly) {
+		return payload, nil
+	}
+
+	// 4. Re-serialize the Dynamic Message to bytes for forwarding
+	if route.PreserveWireBytes {
+		return spliceEnvelope(payload, dynMsg, env)
+	}
+	newPayload, err := marshalDynamic(dynMsg)
+	if err == nil {
+		return newPayload, nil
+	}
+	log.Printf("[%s Encoding Error] Failed to marshal dynamic msg: %v", dir, err)
+	return payload, nil
+}
+
+// Helpers for extracting dynamic fields safely. A oneof member only reads as
+// present while it is the oneof's case, and a field with presence (proto3
+// optional, oneof members, proto2) that is set to empty bytes reads as empty
+// rather than nil; nil always means the message does not carry the field.
+func getBytesField(msg *dynamic.Message, fd *desc.FieldDescriptor) []byte {
+	val, ok := fieldValue(msg, fd)
+	if !ok {
+		return nil
+	}
+	if s, ok := val.(string); ok {
+		// a string field read as bytes under allow_type_coercion
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil
+		}
+		return b
+	}
+	b, ok := val.([]byte)
+	if !ok {
+		return nil
+	}
+	if b == nil {
+		return []byte{}
+	}
+	return b
+}
+
+func getStringField(msg *dynamic.Message, fd *desc.FieldDescriptor) string {
+	val, ok := fieldValue(msg, fd)
+	if !ok {
+		return ""
+	}
+	if b, ok := val.([]byte); ok {
+		return string(b) // allow_type_coercion
+	}
+	s, ok := val.(string)
+	if !ok {
+		return ""
+	}
+	return s
+}
+
+// fieldValue reads a singular field, reporting whether the message has it
+// set. A nil fd is a field the message does not have, and a field without
+// presence (proto3, or implicit under editions) is unset while it is zero.
+func fieldValue(msg *dynamic.Message, fd *desc.FieldDescriptor) (interface{}, bool) {
+	if fd == nil || fd.IsRepeated() || !msg.HasField(fd) {
+		return nil, false
+	}
+	val, err := msg.TryGetField(fd)
+	if err != nil || implicitZero(fd, val) {
+		return nil, false
+	}
+	return val, true
+}
+
+// setEnvelopeField writes a field the proxy owns. Setting a oneof member
+// clears whichever member was set before, so a write that would replace a
+// different member (the client's signature, say) is refused instead.
+func setEnvelopeField(msg *dynamic.Message, fd *desc.FieldDescriptor, val interface{}) error {
+	if fd == nil {
+		return fmt.Errorf("no such field on %s", msg.GetMessageDescriptor().GetFullyQualifiedName())
+	}
+	if od := fd.GetOneOf(); od != nil && !od.IsSynthetic() {
+		cur, _, err := msg.TryGetOneOfField(od)
+		if err != nil {
+			return err
+		}
+		if cur != nil && cur.GetNumber() != fd.GetNumber() {
+			return fmt.Errorf("setting %s would clear %s, which is set in the same oneof %s", fd.GetName(), cur.GetName(), od.GetName())
+		}
+	}
+	// Fields allow_type_coercion lets stand in for the other scalar type
+	switch v := val.(type) {
+	case []byte:
+		if fd.GetType() == descriptorpb.FieldDescriptorProto_TYPE_STRING {
+			val = base64.StdEncoding.EncodeToString(v)
+		}
+	case string:
+		if fd.GetType() == descriptorpb.FieldDescriptorProto_TYPE_BYTES {
+			val = []byte(v)
+		}
+	}
+	return msg.TrySetField(fd, val)
+}
+
+// addRepeatedMessage appends an entry with the named fields set to the
+// repeated message field fd
+func addRepeatedMessage(msg *dynamic.Message, fd *desc.FieldDescriptor, fields map[string]interface{}) error {
+	if fd == nil || !fd.IsRepeated() || fd.IsMap() || fd.GetMessageType() == nil {
+		return fmt.Errorf("no repeated message field to append to on %s", msg.GetMessageDescriptor().GetFullyQualifiedName())
+	}
+	entry := dynamic.NewMessage(fd.GetMessageType())
+	for name, val := range fields {
+		if err := entry.TrySetFieldByName(name, val); err != nil {
+			return err
+		}
+	}
+	return msg.TryAddRepeatedField(fd, entry)
+}
+
+// getRepeatedMessages returns the entries of a repeated message field, or nil
+func getRepeatedMessages(msg *dynamic.Message, fd *desc.FieldDescriptor) []*dynamic.Message {
+	if fd == nil || !fd.IsRepeated() || fd.IsMap() {
+		return nil
+	}
+	n, err := msg.TryFieldLength(fd)
+	if err != nil {
+		return nil
+	}
+	out := make([]*dynamic.Message, 0, n)
+	for i := 0; i < n; i++ {
+		v, err := msg.TryGetRepeatedField(fd, i)
+		if err != nil {
+			return nil
+		}
+		if m, ok := v.(*dynamic.Message); ok {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// decodeInner decodes an envelope's inner payload as the type its type URL
+// names. The message is nil when the URL is empty or names no loaded type;
+// the error is the unmarshal error when one is found.
+func (px *Proxy) decodeInner(typeURL string, payload []byte) (*dynamic.Message, error) {
+	if typeURL == "" {
+		return nil, nil
+	}
+	md := px.findDescByType(typeName(typeURL))
+	if md == nil {
+		return nil, nil
+	}
+	inner := dynamic.NewMessage(md)
+	return inner, inner.Unmarshal(payload)
+}
+
+// Highly simplified lookup for inner message types (just looks through cache)
+func (px *Proxy) findDescByType(suffixName string) *desc.MessageDescriptor {
+	if px.lazySchema != nil {
+		return px.lazySchema.lookupMessageSuffix(suffixName)
+	}
+	if md := px.pbSchema.lookupMessageSuffix(suffixName); md != nil {
+		return md
+	}
+	for _, md := range px.eagerDescriptors() {
+		// Just check inputs for poc
+		if typeNameMatches(md.GetInputType().GetFullyQualifiedName(), suffixName) {
+			return md.GetInputType()
+		}
+		if md.GetOutputType() != nil && typeNameMatches(md.GetOutputType().GetFullyQualifiedName(), suffixName) {
+			return md.GetOutputType()
+		}
+	}
+	return nil
+}
+
+func loadFromPB(path string, diag *Diagnostics) map[string]*desc.MethodDescriptor {
+	fdMap := loadPBFiles(path, diag)
+	if fdMap == nil {
+		return nil
+	}
+	res := methodsOf(fdMap)
+	log.Printf("Loaded %d methods from %s file", len(res), path)
+	return res
+}
+
+// loadPBFiles reads and links the descriptor set at path
+func loadPBFiles(path string, diag *Diagnostics) map[string]*desc.FileDescriptor {
+	abs, _ := filepath.Abs(path)
+	b, err := os.ReadFile(abs)
+	if err != nil {
+		diag.Errorf("schema", "SCHEMA_PB_READ", "schema.pb_path", "failed to read pb %s: %v", abs, err)
+		return nil
+	}
+
+	fds := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(b, fds); err != nil {
+		diag.Errorf("schema", "SCHEMA_PB_PARSE", "schema.pb_path", "failed unmarshal fds %s: %v", abs, err)
+		return nil
+	}
+
+	fdMap, err := desc.CreateFileDescriptorsFromSet(fds)
+	if err != nil {
+		diag.Errorf("schema", "SCHEMA_PB_PARSE", "schema.pb_path", "failed to parse fds %s: %v", abs, err)
+		return nil
+	}
+	return fdMap
+}
+
+// methodsOf indexes the methods of every service in fdMap by full method name
+func methodsOf(fdMap map[string]*desc.FileDescriptor) map[string]*desc.MethodDescriptor {
+	res := make(map[string]*desc.MethodDescriptor)
+	for _, fd := range fdMap {
+		for _, svc := range fd.GetServices() {
+			for _, md := range svc.GetMethods() {
+				fullMethod := fmt.Sprintf("/%s/%s", svc.GetFullyQualifiedName(), md.GetName())
+				res[fullMethod] = md
+			}
+		}
+	}
+	return res
+}
+
+func (px *Proxy) loadFromReflection(addr string, diag *Diagnostics) map[string]*desc.MethodDescriptor {
+	conn, err := grpc.Dial(addr, px.backendDialOptions()...)
+	if err != nil {
+		diag.Errorf("schema", "SCHEMA_REFLECT_DIAL", "backend.address", "reflect dial error: %v", err)
+		return nil
+	}
+	defer conn.Close()
+
+	timeout, attempts := px.reflectLimits()
+	wait := reflectBackoffMin
+	for attempt := 1; ; attempt++ {
+		res, err := reflectServices(conn, timeout, diag)
+		if err == nil {
+			log.Printf("Loaded %d methods from reflection API", len(res))
+			return res
+		}
+		if attempt >= attempts || !transientReflectError(err) {
+			diag.Errorf("schema", "SCHEMA_REFLECT_LIST", "backend.address", "list services error: %v", err)
+			return nil
+		}
+		log.Printf("[Schema] Reflection via %s failed (%v); attempt %d of %d in %s", addr, err, attempt+1, attempts, wait)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// reflectServices resolves every service the backend lists but the
+// reflection services themselves, asking grpc.reflection.v1 and falling back
+// to v1alpha when the backend does not serve it
+func reflectServices(conn *grpc.ClientConn, timeout time.Duration, diag *Diagnostics) (map[string]*desc.MethodDescriptor, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	client := grpcreflect.NewClientAuto(ctx, conn)
+	defer client.Reset()
+
+	svcs, err := client.ListServices()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]*desc.MethodDescriptor)
+	for _, svcName := range svcs {
+		if reflectionServices[svcName] {
+			continue
+		}
+		sd, err := client.ResolveService(svcName)
+		if err != nil {
+			diag.Warnf("schema", "SCHEMA_REFLECT_RESOLVE", svcName, "ResolveService failed: %v", err)
+			continue
+		}
+		for _, md := range sd.GetMethods() {
+			fullMethod := fmt.Sprintf("/%s/%s", svcName, md.GetName())
+			res[fullMethod] = md
+		}
+	}
+	return res, nil
+}
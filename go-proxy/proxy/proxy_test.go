@@ -0,0 +1,444 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anthony/grpc-proxy/api/echo"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/builder"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// --- Package Tests ---
+//
+// These tests drive a Proxy without serving it: newTestProxy builds one over
+// the echo descriptors with a signing key, and the tests call into its
+// message path directly. The benchmarks that need whole calls serve one over
+// bufconn with serveTestProxy, and the listener tests on real sockets. The
+// end-to-end checks are in go-proxy/integration.
+// The proxy logs every envelope it inspects, so its log is dropped unless the
+// tests run with -v.
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// secureEnvelope is SecureEnvelope's layout
+var secureEnvelope = EnvelopeConfig{
+	PayloadField:   "payload",
+	TypeURLField:   "type_url",
+	ClientSigField: "client_signature",
+	ProxySigField:  "proxy_signature",
+	MetadataField:  "metadata",
+}
+
+// testKey is the proxy signing key every test proxy shares, generated once
+var testKey = sync.OnceValues(func() ([]byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), nil
+})
+
+// newTestProxy builds a proxy over the echo descriptors with routes, shut
+// down when the test ends; edit, if set, changes the config first, and opts
+// go to NewProxy
+func newTestProxy(tb testing.TB, routes []RouteConfig, edit func(*Config), opts ...Option) *Proxy {
+	tb.Helper()
+	cfg := testConfig(tb, routes)
+	if edit != nil {
+		edit(&cfg)
+	}
+	px, err := NewProxy(cfg, opts...)
+	if err != nil {
+		tb.Fatalf("NewProxy: %v", err)
+	}
+	tb.Cleanup(func() { px.Shutdown(context.Background()) })
+	return px
+}
+
+// serveTestProxy serves a proxy with routes in front of a backend with the
+// services register adds, both over bufconn, and returns a connection to the
+// proxy. Every write between the proxy and the backend arrives linkDelay
+// later, or at once for 0. All of it is closed when the test ends.
+func serveTestProxy(tb testing.TB, routes []RouteConfig, register func(*grpc.Server), linkDelay time.Duration) *grpc.ClientConn {
+	tb.Helper()
+	backendSrv := grpc.NewServer()
+	register(backendSrv)
+	backendLis := bufconn.Listen(1 << 20)
+	go backendSrv.Serve(delayedListener{backendLis, linkDelay})
+	tb.Cleanup(backendSrv.Stop)
+
+	px := newTestProxy(tb, routes, nil, WithBackendDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		conn, err := backendLis.DialContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return newDelayedConn(conn, linkDelay), nil
+	}))
+	lis := bufconn.Listen(1 << 20)
+	go px.Serve(lis)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// delayedListener delays the writes of the connections it accepts
+type delayedListener struct {
+	net.Listener
+	delay time.Duration
+}
+
+func (l delayedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newDelayedConn(conn, l.delay), nil
+}
+
+// delayedConn delivers each write delay after it was made, in order and
+// without holding up the writer, as the backend's -latency flag does
+type delayedConn struct {
+	net.Conn
+	delay   time.Duration
+	pending chan delayedWrite
+	once    sync.Once
+	done    chan struct{}
+}
+
+type delayedWrite struct {
+	at   time.Time
+	data []byte
+}
+
+func newDelayedConn(conn net.Conn, delay time.Duration) net.Conn {
+	if delay <= 0 {
+		return conn
+	}
+	c := &delayedConn{Conn: conn, delay: delay, pending: make(chan delayedWrite, 4096), done: make(chan struct{})}
+	go c.deliver()
+	return c
+}
+
+func (c *delayedConn) Write(b []byte) (int, error) {
+	select {
+	case c.pending <- delayedWrite{at: time.Now().Add(c.delay), data: bytes.Clone(b)}:
+		return len(b), nil
+	case <-c.done:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *delayedConn) deliver() {
+	defer c.Conn.Close()
+	for {
+		select {
+		case w := <-c.pending:
+			time.Sleep(time.Until(w.at))
+			if _, err := c.Conn.Write(w.data); err != nil {
+				c.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *delayedConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+// testConfig is a config with routes over the echo descriptors and the test
+// signing key, both written to a temporary directory
+func testConfig(tb testing.TB, routes []RouteConfig) Config {
+	tb.Helper()
+	dir := tb.TempDir()
+	fds := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{
+		protodesc.ToFileDescriptorProto(echo.File_api_echo_echo_proto),
+	}}
+	b, err := proto.Marshal(fds)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "echo.pb"), b, 0o600); err != nil {
+		tb.Fatal(err)
+	}
+	keyPEM, err := testKey()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "proxy.key"), keyPEM, 0o600); err != nil {
+		tb.Fatal(err)
+	}
+	return Config{
+		Backend: BackendConfig{Address: "bufnet"},
+		Schema:  SchemaConfig{Method: "pb", PBPath: filepath.Join(dir, "echo.pb")},
+		Routes:  routes,
+		CMS:     CMSConfig{ProxyPrivateKey: filepath.Join(dir, "proxy.key")},
+	}
+}
+
+// counterValue reads a counter series of the package's metrics
+func counterValue(name string, labels Labels) float64 {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	return metrics.counters[seriesKey(name, labels)]
+}
+
+// FuzzProcessMsg sends arbitrary bytes as SecureEcho's request and response
+// through a route in each mode processMsg handles. Nothing may panic, and
+// pass-thru and shadow routes must forward the bytes they were given.
+func FuzzProcessMsg(f *testing.F) {
+	inner, _ := proto.Marshal(&echo.EchoRequest{Message: "fuzz", Repeat: 2})
+	valid, _ := proto.Marshal(&echo.SecureEnvelope{
+		Metadata:        map[string]string{"schema_version": "1"},
+		TypeUrl:         "type.googleapis.com/echo.EchoRequest",
+		Payload:         inner,
+		ClientSignature: []byte("not a signature"),
+	})
+	bareSlash, _ := proto.Marshal(&echo.SecureEnvelope{TypeUrl: "/", Payload: inner})
+	f.Add(valid, true)
+	f.Add(valid, false)
+	f.Add(valid[:len(valid)/2], true)                                          // truncated mid-field
+	f.Add(bareSlash, true)                                                     // a type_url of "/" alone
+	f.Add([]byte{0x1a, 0xff, 0xff, 0xff, 0xff, 0x0f}, true)                    // payload claiming 4 GiB
+	f.Add([]byte{0x0a, 0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}, false) // metadata entry claiming 2^63 bytes
+	f.Add([]byte{0x32, 0x80, 0x80, 0x80, 0x80, 0x10, 0x0a}, true)              // proxy_signatures entry past the varint limit
+	f.Add([]byte{}, true)
+
+	const method = "/echo.SecureService/SecureEcho"
+	type mode struct {
+		px    *Proxy
+		route *RouteConfig
+	}
+	var modes []mode
+	for _, route := range []RouteConfig{
+		{Name: "pass-thru", Match: method, Mode: "pass-thru"},
+		{Name: "inspect-outer", Match: method, Mode: "inspect-outer", Envelope: secureEnvelope},
+		{Name: "inspect-verify-sign", Match: method, Mode: "inspect-verify-sign", Envelope: secureEnvelope, AllowedTypes: []string{"echo.EchoRequest"}},
+		{Name: "shadow", Match: method, Mode: "inspect-verify-sign", Envelope: secureEnvelope, Shadow: true},
+	} {
+		px := newTestProxy(f, []RouteConfig{route}, nil)
+		modes = append(modes, mode{px, px.configuredRoute(method)})
+	}
+
+	f.Fuzz(func(t *testing.T, payload []byte, isReq bool) {
+		for _, m := range modes {
+			in := bytes.Clone(payload)
+			out, err := m.px.newPump(context.Background(), method, isReq, m.route, nil).process(in)
+			if m.route.Mode == "pass-thru" || m.route.Shadow {
+				if err != nil || !bytes.Equal(out, payload) {
+					t.Errorf("%s route changed the message: %x, %v", m.route.Name, out, err)
+				}
+			}
+		}
+	})
+}
+
+// oneofEnvelope is an envelope whose signatures share a oneof:
+//
+//	message Envelope {
+//	  bytes payload = 1;
+//	  oneof signature { bytes client_signature = 2; bytes proxy_signature = 3; }
+//	  Header header = 4;
+//	}
+//	message Header { oneof route { string name = 1; Header inner = 2; } }
+func oneofEnvelope(tb testing.TB) *desc.MessageDescriptor {
+	tb.Helper()
+	header := builder.NewMessage("Header")
+	header.AddOneOf(builder.NewOneOf("route").
+		AddChoice(builder.NewField("name", builder.FieldTypeString())).
+		AddChoice(builder.NewField("inner", builder.FieldTypeMessage(header))))
+	envelope := builder.NewMessage("Envelope").
+		AddField(builder.NewField("payload", builder.FieldTypeBytes())).
+		AddOneOf(builder.NewOneOf("signature").
+			AddChoice(builder.NewField("client_signature", builder.FieldTypeBytes())).
+			AddChoice(builder.NewField("proxy_signature", builder.FieldTypeBytes()))).
+		AddField(builder.NewField("header", builder.FieldTypeMessage(header)))
+	fd, err := builder.NewFile("oneof.proto").SetPackageName("oneof").SetProto3(true).
+		AddMessage(header).AddMessage(envelope).Build()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return fd.FindMessage("oneof.Envelope")
+}
+
+// TestOneofFieldAccess reads and writes oneof members through the envelope
+// field helpers and mutation paths: setting a member, clearing it, and
+// switching the oneof's case
+func TestOneofFieldAccess(t *testing.T) {
+	md := oneofEnvelope(t)
+	client, proxySig := md.FindFieldByName("client_signature"), md.FindFieldByName("proxy_signature")
+	od := client.GetOneOf()
+
+	mutate := func(msg *dynamic.Message, op, field, value string) error {
+		m, err := parseMutation(MutationConfig{Op: op, Field: field, Value: value})
+		if err != nil {
+			return err
+		}
+		return m.apply(msg, time.Now())
+	}
+	for _, c := range []struct {
+		name       string
+		edit       func(msg *dynamic.Message) error
+		wantErr    bool
+		wantCase   string // the oneof's case afterwards, "" for none
+		wantClient []byte // nil when the member reads as absent
+		wantProxy  []byte
+	}{
+		{
+			name:     "set a member",
+			edit:     func(msg *dynamic.Message) error { return setEnvelopeField(msg, proxySig, []byte("proxy")) },
+			wantCase: "proxy_signature", wantProxy: []byte("proxy"),
+		},
+		{
+			name:     "set a member to empty bytes",
+			edit:     func(msg *dynamic.Message) error { return setEnvelopeField(msg, client, []byte{}) },
+			wantCase: "client_signature", wantClient: []byte{},
+		},
+		{
+			name: "set the member that is the case again",
+			edit: func(msg *dynamic.Message) error {
+				if err := setEnvelopeField(msg, client, []byte("first")); err != nil {
+					return err
+				}
+				return setEnvelopeField(msg, client, []byte("second"))
+			},
+			wantCase: "client_signature", wantClient: []byte("second"),
+		},
+		{
+			name: "setting another member is refused",
+			edit: func(msg *dynamic.Message) error {
+				if err := setEnvelopeField(msg, client, []byte("client")); err != nil {
+					t.Fatal(err)
+				}
+				return setEnvelopeField(msg, proxySig, []byte("proxy"))
+			},
+			wantErr:  true,
+			wantCase: "client_signature", wantClient: []byte("client"),
+		},
+		{
+			name: "clear the case",
+			edit: func(msg *dynamic.Message) error {
+				if err := setEnvelopeField(msg, client, []byte("client")); err != nil {
+					return err
+				}
+				return mutate(msg, "clear", "client_signature", "")
+			},
+		},
+		{
+			name: "clear a member that is not the case",
+			edit: func(msg *dynamic.Message) error {
+				if err := setEnvelopeField(msg, client, []byte("client")); err != nil {
+					return err
+				}
+				return mutate(msg, "clear", "proxy_signature", "")
+			},
+			wantCase: "client_signature", wantClient: []byte("client"),
+		},
+		{
+			name: "clear, then set the other member",
+			edit: func(msg *dynamic.Message) error {
+				if err := setEnvelopeField(msg, client, []byte("client")); err != nil {
+					return err
+				}
+				if err := mutate(msg, "clear", "client_signature", ""); err != nil {
+					return err
+				}
+				return setEnvelopeField(msg, proxySig, []byte("proxy"))
+			},
+			wantCase: "proxy_signature", wantProxy: []byte("proxy"),
+		},
+		{
+			name: "a mutation switches the case",
+			edit: func(msg *dynamic.Message) error {
+				if err := setEnvelopeField(msg, client, []byte("client")); err != nil {
+					return err
+				}
+				return mutate(msg, "set_bytes", "proxy_signature", base64.StdEncoding.EncodeToString([]byte("mutated")))
+			},
+			wantCase: "proxy_signature", wantProxy: []byte("mutated"),
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			msg := dynamic.NewMessage(md)
+			msg.SetFieldByName("payload", []byte("payload"))
+			if err := c.edit(msg); (err != nil) != c.wantErr {
+				t.Fatalf("got %v, want an error: %v", err, c.wantErr)
+			}
+			cur, _, err := msg.TryGetOneOfField(od)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if cur != nil {
+				got = cur.GetName()
+			}
+			if got != c.wantCase {
+				t.Errorf("oneof case %q, want %q", got, c.wantCase)
+			}
+			if got := getBytesField(msg, client); !bytes.Equal(got, c.wantClient) || (got == nil) != (c.wantClient == nil) {
+				t.Errorf("client_signature reads %q, want %q", got, c.wantClient)
+			}
+			if got := getBytesField(msg, proxySig); !bytes.Equal(got, c.wantProxy) || (got == nil) != (c.wantProxy == nil) {
+				t.Errorf("proxy_signature reads %q, want %q", got, c.wantProxy)
+			}
+			if got := getBytesField(msg, md.FindFieldByName("payload")); string(got) != "payload" {
+				t.Errorf("payload reads %q after editing the oneof", got)
+			}
+		})
+	}
+
+	// A path through a message held in a oneof: setting below it selects the
+	// message member, and the string member reads as absent
+	msg := dynamic.NewMessage(md)
+	if err := mutate(msg, "set_string", "header.name", "edge"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mutate(msg, "set_string", "header.inner.name", "core"); err != nil {
+		t.Fatal(err)
+	}
+	header := msg.GetFieldByName("header").(*dynamic.Message)
+	if hasFieldPath(msg, []string{"header", "name"}) {
+		t.Errorf("header.name still reads as set after header.inner was")
+	}
+	if got := getStringField(header.GetFieldByName("inner").(*dynamic.Message), md.FindFieldByName("header").GetMessageType().FindFieldByName("name")); got != "core" {
+		t.Errorf("header.inner.name reads %q, want core", got)
+	}
+}
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// --- Proxy Chains ---
+//
+// Proxies deployed in series (an edge proxy in front of an internal one) each
+// sign the payload, and with proxy_sig_field the second signature overwrites
+// the first. envelope.proxy_sig_list_field names a repeated message field
+// instead, such as SecureEnvelope.proxy_signatures, to which every proxy
+// appends its own entry:
+//
+//	key_id     the signing key's id, as in the audit log
+//	algorithm  RSA-SHA256
+//	signature  RSA PKCS#1 v1.5 over the SHA-256 of the payload, as in
+//	           proxy_sig_field
+//
+// Each entry covers the payload alone, so a backend can check any hop's
+// entry on its own, and the entries read in the order the hops signed. A
+// route's verify_upstream_proxy, a cms.trust_stores name, checks the last
+// entry of each request, the previous hop's, against that store before the
+// proxy appends its own. Like a client signature check it does not reject:
+// the outcome (ok, failed, or missing when the request has no entry) is
+// audited with signer upstream_proxy and counted in
+// proxy_signature_verifications_total.
+
+// sigAlgorithm is the algorithm a proxy writes into its list entries
+const sigAlgorithm = "RSA-SHA256"
+
+// Fields of a proxy_sig_list_field entry
+const (
+	sigEntryKeyID     = "key_id"
+	sigEntryAlgorithm = "algorithm"
+	sigEntrySignature = "signature"
+)
+
+// isSigList reports whether fd is a repeated message field whose entries
+// can hold a proxy signature
+func isSigList(fd *desc.FieldDescriptor) bool {
+	mt := fd.GetMessageType()
+	if !fd.IsRepeated() || fd.IsMap() || mt == nil {
+		return false
+	}
+	for name, t := range map[string]descriptorpb.FieldDescriptorProto_Type{
+		sigEntryKeyID:     descriptorpb.FieldDescriptorProto_TYPE_STRING,
+		sigEntryAlgorithm: descriptorpb.FieldDescriptorProto_TYPE_STRING,
+		sigEntrySignature: descriptorpb.FieldDescriptorProto_TYPE_BYTES,
+	} {
+		f := mt.FindFieldByName(name)
+		if f == nil || f.GetType() != t || f.IsRepeated() {
+			return false
+		}
+	}
+	return true
+}
+
+// appendProxySig adds this proxy's entry to the list field fd
+func appendProxySig(msg *dynamic.Message, fd *desc.FieldDescriptor, keyID string, sig []byte) error {
+	return addRepeatedMessage(msg, fd, map[string]interface{}{
+		sigEntryKeyID:     keyID,
+		sigEntryAlgorithm: sigAlgorithm,
+		sigEntrySignature: sig,
+	})
+}
+
+// lastProxySig is the signature of the list's last entry, nil when the list
+// is empty
+func lastProxySig(msg *dynamic.Message, fd *desc.FieldDescriptor) []byte {
+	entries := getRepeatedMessages(msg, fd)
+	if len(entries) == 0 {
+		return nil
+	}
+	last := entries[len(entries)-1]
+	sig, _ := last.GetFieldByName(sigEntrySignature).([]byte)
+	if sig == nil {
+		sig = []byte{}
+	}
+	return sig
+}
+
+// upstreamVerifier checks the previous proxy's entry on requests of routes
+// with verify_upstream_proxy
+type upstreamVerifier struct{ px *Proxy }
+
+func (v upstreamVerifier) Process(ctx context.Context, info MethodInfo, dir Direction, msg *dynamic.Message) (Action, error) {
+	px, route := v.px, info.Route
+	trust := px.upstreamTrust[route.Name]
+	if dir != ClientToBackend || trust == nil || info.envelope.proxySigList == nil {
+		return Continue(), nil
+	}
+	payloadBytes := getBytesField(msg, info.envelope.payload)
+	verified := auditEvent{op: "verify", signer: "upstream_proxy", decision: "missing", payload: payloadBytes}
+	if sig := lastProxySig(msg, info.envelope.proxySigList); sig != nil {
+		ev, err := px.verifyTrusted(ctx, route, trust, dir.label(), payloadBytes, info.digests.of(payloadBytes), sig)
+		if err != nil {
+			return Continue(), skipCancelled(ctx, route, true, "verify")
+		}
+		verified.decision, verified.keyID = ev.decision, ev.keyID
+	} else {
+		log.Printf("[Request Security Error] %s: no upstream proxy signature to verify against %s", info.Method, trust.name)
+	}
+	metrics.Inc("proxy_signature_verifications_total", Labels{"signer": "upstream_proxy", "result": verified.decision, "tenant": info.Tenant, "shadow": shadowLabel(route)})
+	return Continue(), px.audit(ctx, info.Method, route, true, verified)
+}
+
+// loadProxyChains checks proxy_sig_list_field and verify_upstream_proxy
+func (px *Proxy) loadProxyChains(diag *Diagnostics) {
+	for i := range px.cfg.Routes {
+		route := &px.cfg.Routes[i]
+		listed := false
+		for j, v := range envelopeVariants(route) {
+			env := v.Envelope
+			if env.ProxySigListField == "" {
+				continue
+			}
+			listed = true
+			path := fmt.Sprintf("routes[%d].envelope.proxy_sig_list_field", i)
+			if len(route.Envelopes) > 0 {
+				path = fmt.Sprintf("routes[%d].envelopes[%d].proxy_sig_list_field", i, j)
+			}
+			switch {
+			case route.Mode != "inspect-verify-sign":
+				diag.Warnf("routes", "ROUTE_PROXY_CHAIN", path, "has no effect on %s routes", route.Mode)
+			case env.ProxySigField != "" || env.ProxySigMetadataKey != "":
+				diag.Errorf("routes", "ROUTE_PROXY_CHAIN", path, "set one of proxy_sig_field, proxy_sig_list_field and proxy_sig_metadata_key")
+			}
+		}
+		if route.VerifyUpstreamProxy == "" {
+			continue
+		}
+		path := fmt.Sprintf("routes[%d].verify_upstream_proxy", i)
+		trust, found := px.namedTrust[route.VerifyUpstreamProxy]
+		switch {
+		case route.Mode != "inspect-verify-sign":
+			diag.Errorf("routes", "ROUTE_PROXY_CHAIN", path, "only inspect-verify-sign routes verify signatures")
+		case !listed:
+			diag.Errorf("routes", "ROUTE_PROXY_CHAIN", path, "needs envelope.proxy_sig_list_field to find the upstream proxy's signature")
+		case !found:
+			diag.Errorf("routes", "ROUTE_PROXY_CHAIN", path, "no cms.trust_stores entry named %q", route.VerifyUpstreamProxy)
+		default:
+			if _, dup := px.upstreamTrust[route.Name]; !dup {
+				px.upstreamTrust[route.Name] = trust
+			}
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/mem"
+)
+
+const defaultBufferDepth = 100
+
+// pump relays messages from src to dst for one direction of a proxied stream.
+//
+// Recv and Send are decoupled by a bounded buffer of route.BufferDepth
+// messages. When the buffer is full the pump stops calling RecvMsg, so gRPC
+// flow control pushes back on the sender instead of the proxy queueing
+// without limit. The terminal Recv error (io.EOF on half-close) is only
+// reported once every buffered message has been sent, so callers can safely
+// CloseSend after it.
+type pump struct {
+	px      *Proxy
+	ctx     context.Context // cancelled when the handler returns; unblocks every stage
+	method  string
+	isReq   bool
+	route   *RouteConfig
+	timings *callTimings
+	labels  Labels
+	limiter *routeLimiter      // per-message rate limit on client streams; nil when unlimited
+	idle    *idleWatch         // shared by both directions; nil without an idle timeout
+	capture *callCapture       // shared by both directions; nil unless the route captures
+	tap     *routeTap          // nil unless the route taps
+	guard   *streamGuard       // shared by both directions; nil for unary calls
+	slow    *consumerWatch     // responses of streams with slow consumer limits; nil otherwise
+	reorder *reorderPolicy     // unordered routes with ordering: strict; nil otherwise
+	attest  *streamAttestation // requests of attested streams; nil otherwise
+	stream  *activeStream      // the call's registry entry; see janitor.go
+	faults  *callFaults        // nil unless the route injects faults; see faults.go
+}
+
+func (px *Proxy) newPump(ctx context.Context, method string, isReq bool, route *RouteConfig, timings *callTimings) *pump {
+	dir := "s2c"
+	if isReq {
+		dir = "c2s"
+	}
+	p := &pump{
+		px:      px,
+		ctx:     ctx,
+		method:  method,
+		isReq:   isReq,
+		route:   route,
+		timings: timings,
+		labels:  Labels{"method": method, "direction": dir},
+		reorder: px.routeReorders[route.Name],
+		tap:     px.routeTaps[route.Name],
+		stream:  activeStreamFrom(ctx),
+		faults:  callFaultsFrom(ctx),
+	}
+	if isReq {
+		p.attest = attestationFromContext(ctx)
+	}
+	// Unary calls were already charged one token when the call arrived
+	if isReq && !px.isUnaryMethod(method) {
+		p.limiter = px.limiterFor(route)
+	}
+	return p
+}
+
+func (p *pump) depth() int {
+	if p.route.BufferDepth > 0 {
+		return p.route.BufferDepth
+	}
+	return defaultBufferDepth
+}
+
+func (p *pump) buffered(delta int) {
+	metrics.AddGauge("proxy_pump_buffered_messages", p.labels, float64(delta))
+}
+
+func (p *pump) received(payload []byte) {
+	p.countReceived(len(payload))
+	p.idle.touch()
+	p.stream.touch(p.isReq)
+	p.slow.received()
+	p.capture.record(p.isReq, payload)
+	p.tap.record(p.method, p.isReq, payload)
+	p.attest.receive()
+	if !p.isReq {
+		p.timings.markFirstResponse()
+	}
+}
+
+// sent follows a successful SendMsg of size bytes, received as original
+// bytes; see countForwarded
+func (p *pump) sent(original, size int) {
+	p.countForwarded(original, size)
+	if p.isReq {
+		p.timings.markRequestSent()
+	}
+}
+
+// inspects reports whether the route processes the messages this pump
+// forwards; a session-token route checked the stream's first message before
+// the pumps started
+func (p *pump) inspects() bool {
+	return p.route.Mode != "pass-thru" && p.route.Mode != "session-token"
+}
+
+func (p *pump) process(payload []byte) ([]byte, error) {
+	if p.inspects() {
+		var err error
+		if payload, err = p.px.processMsg(p.ctx, p.method, p.isReq, payload, p.route); err != nil {
+			return nil, err
+		}
+	}
+	if hook := p.px.hooks.ProcessMessage; hook != nil {
+		var err error
+		if payload, err = hook(p.ctx, &Message{Method: p.method, Request: p.isReq, Route: p.route, Payload: payload}); err != nil {
+			return nil, err
+		}
+	}
+	return p.faults.message(p.ctx, p.isReq, payload)
+}
+
+func (p *pump) run(src, dst grpc.Stream, errChan chan<- error) {
+	if !p.isReq {
+		dst = p.faults.dropResponses(dst)
+	}
+	switch {
+	case p.zeroCopy(src):
+		p.runZeroCopy(src, dst, errChan)
+	case p.route.Unordered:
+		p.runUnordered(src, dst, errChan)
+	default:
+		p.runOrdered(src, dst, errChan)
+	}
+}
+
+// zeroCopy reports whether nothing on this pump reads the messages it
+// forwards: a pass-thru route with no ProcessMessage hook, no capture, no
+// faults and no prefetching, whose buffer holds its own copies
+func (p *pump) zeroCopy(src grpc.Stream) bool {
+	_, prefetched := src.(*prefetchStream)
+	return p.route.Mode == "pass-thru" && p.px.hooks.ProcessMessage == nil && p.capture == nil && p.tap == nil && p.faults == nil && !prefetched
+}
+
+// runOrdered receives and processes on one goroutine and sends on another,
+// preserving message order.
+func (p *pump) runOrdered(src, dst grpc.Stream, errChan chan<- error) {
+	queue := make(chan processed, p.depth())
+	recvErr := make(chan error, 1)
+
+	go func() {
+		defer close(queue)
+		for {
+			var payload []byte
+			if err := src.RecvMsg(&payload); err != nil {
+				recvErr <- err
+				return
+			}
+			if err := p.limiter.allow(); err != nil {
+				recvErr <- err
+				return
+			}
+			if err := p.guard.count(p.isReq, len(payload)); err != nil {
+				recvErr <- err
+				return
+			}
+			p.received(payload)
+			original := len(payload)
+			payload, err := p.process(payload)
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case queue <- processed{payload: payload, original: original}:
+				p.buffered(1)
+			case <-p.ctx.Done():
+				recvErr <- p.ctx.Err()
+				return
+			}
+		}
+	}()
+
+	for r := range queue {
+		p.buffered(-1)
+		err := p.skipped()
+		if err == nil {
+			p.slow.sending()
+			err = dst.SendMsg(&r.payload)
+		}
+		p.slow.done()
+		if err != nil {
+			errChan <- err
+			// Discard whatever is still queued so the receiver can exit
+			go func() {
+				for range queue {
+					p.buffered(-1)
+					p.skipped()
+					p.slow.done()
+				}
+			}()
+			return
+		}
+		p.sent(r.original, len(r.payload))
+	}
+	errChan <- <-recvErr
+}
+
+// skipped returns the status to end the stream with once its context has
+// ended, counting the processed message it will not send; nil before that
+func (p *pump) skipped() error {
+	if !p.inspects() {
+		return nil // nothing was spent on the message
+	}
+	return skipCancelled(p.ctx, p.route, p.isReq, "send")
+}
+
+// runZeroCopy is runOrdered for messages nothing reads. Each is forwarded in
+// the buffers gRPC received it into, which go back to gRPC's pool once it has
+// been sent, so a pass-thru message is never copied at the proxy.
+func (p *pump) runZeroCopy(src, dst grpc.Stream, errChan chan<- error) {
+	queue := make(chan mem.BufferSlice, p.depth())
+	recvErr := make(chan error, 1)
+
+	go func() {
+		defer close(queue)
+		for {
+			var payload mem.BufferSlice
+			if err := src.RecvMsg(&payload); err != nil {
+				recvErr <- err
+				return
+			}
+			err := p.limiter.allow()
+			if err == nil {
+				err = p.guard.count(p.isReq, payload.Len())
+			}
+			if err != nil {
+				payload.Free()
+				recvErr <- err
+				return
+			}
+			p.countReceived(payload.Len())
+			p.idle.touch()
+			p.stream.touch(p.isReq)
+			p.slow.received()
+			if !p.isReq {
+				p.timings.markFirstResponse()
+			}
+			select {
+			case queue <- payload:
+				p.buffered(1)
+			case <-p.ctx.Done():
+				payload.Free()
+				recvErr <- p.ctx.Err()
+				return
+			}
+		}
+	}()
+
+	for payload := range queue {
+		p.buffered(-1)
+		p.slow.sending()
+		err := dst.SendMsg(&payload)
+		p.slow.done()
+		size := payload.Len()
+		payload.Free()
+		if err != nil {
+			errChan <- err
+			go func() {
+				for payload := range queue {
+					payload.Free()
+					p.buffered(-1)
+					p.slow.done()
+				}
+			}()
+			return
+		}
+		p.sent(size, size)
+	}
+	errChan <- <-recvErr
+}
+
+// processed is a message ready to send, or an unordered worker's result; a
+// rejected message ends the stream
+type processed struct {
+	seq      uint64 // receive order
+	payload  []byte
+	err      error
+	original int // size as received
+}
+
+// runUnordered fans processing out to concurrent workers and forwards results
+// as they complete, or in receive order with ordering: strict. A slot is taken
+// before each RecvMsg and released after the result is sent, so at most depth
+// messages are in flight (processing plus queued) per direction.
+func (p *pump) runUnordered(src, dst grpc.Stream, errChan chan<- error) {
+	depth := p.depth()
+	slots := make(chan struct{}, depth)
+	out := make(chan processed, depth) // never blocks: at most depth results exist
+	recvErr := make(chan error, 1)
+
+	go func() {
+		var wg sync.WaitGroup
+		defer func() {
+			wg.Wait()
+			close(out)
+		}()
+		for seq := uint64(0); ; seq++ {
+			select {
+			case slots <- struct{}{}:
+				p.buffered(1)
+			case <-p.ctx.Done():
+				recvErr <- p.ctx.Err()
+				return
+			}
+			var payload []byte
+			err := src.RecvMsg(&payload)
+			if err == nil {
+				err = p.limiter.allow()
+			}
+			if err == nil {
+				err = p.guard.count(p.isReq, len(payload))
+			}
+			if err != nil {
+				<-slots
+				p.buffered(-1)
+				recvErr <- err
+				return
+			}
+			p.received(payload)
+
+			if !p.inspects() && p.px.hooks.ProcessMessage == nil && p.faults == nil {
+				out <- processed{seq: seq, payload: payload, original: len(payload)}
+				continue
+			}
+			wg.Add(1)
+			go func(seq uint64, payload []byte) {
+				defer wg.Done()
+				original := len(payload)
+				payload, err := p.process(payload)
+				out <- processed{seq, payload, err, original}
+			}(seq, payload)
+		}
+	}()
+
+	release := func() {
+		<-slots
+		p.buffered(-1)
+	}
+	send := func(r processed) error {
+		err := r.err
+		if err == nil {
+			err = p.skipped()
+		}
+		if err == nil {
+			p.slow.sending()
+			err = dst.SendMsg(&r.payload)
+		}
+		p.slow.done()
+		release()
+		if err == nil {
+			p.sent(r.original, len(r.payload))
+		}
+		return err
+	}
+	var err error
+	if p.reorder != nil {
+		err = p.reorder.forward(out, send, release)
+	} else {
+		for r := range out {
+			if err = send(r); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		errChan <- err
+		go func() {
+			for r := range out {
+				if r.err == nil {
+					p.skipped()
+				}
+				p.slow.done()
+				release()
+			}
+		}()
+		return
+	}
+	errChan <- <-recvErr
+}
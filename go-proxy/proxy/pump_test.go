@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"google.golang.org/grpc/mem"
+)
+
+// benchStream is one side of a proxied stream as gRPC presents it to a pump.
+// RecvMsg reads each of n messages into a pooled buffer and decodes it with
+// bytesCodec, freeing the buffer after, as gRPC does; SendMsg encodes with
+// bytesCodec and frees the result once "written".
+type benchStream struct {
+	ctx     context.Context
+	pool    mem.BufferPool
+	message []byte
+	n       int
+}
+
+func (s *benchStream) Context() context.Context { return s.ctx }
+
+func (s *benchStream) RecvMsg(m interface{}) error {
+	if s.n == 0 {
+		return io.EOF
+	}
+	s.n--
+	buf := s.pool.Get(len(s.message))
+	copy(*buf, s.message)
+	data := mem.BufferSlice{mem.NewBuffer(buf, s.pool)}
+	defer data.Free()
+	return bytesCodec{}.Unmarshal(data, m)
+}
+
+func (s *benchStream) SendMsg(m interface{}) error {
+	data, err := bytesCodec{}.Marshal(m)
+	if err != nil {
+		return err
+	}
+	data.Free()
+	return nil
+}
+
+// benchmarkPump relays b.N messages of each size through a pass-thru route's
+// request pump, run by run
+func benchmarkPump(b *testing.B, run func(p *pump, src, dst *benchStream, errChan chan<- error)) {
+	const method = "/echo.EchoService/BidirectionalStreamingEcho"
+	px := newTestProxy(b, []RouteConfig{{Name: "pass-thru", Match: "/echo.EchoService/*", Mode: "pass-thru"}}, nil)
+	route := px.configuredRoute(method)
+	for _, size := range []int{1 << 10, 64 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			src := &benchStream{ctx: ctx, pool: mem.DefaultBufferPool(), message: make([]byte, size), n: b.N}
+			dst := &benchStream{ctx: ctx}
+			p := px.newPump(ctx, method, true, route, &callTimings{})
+			errChan := make(chan error, 1)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			run(p, src, dst, errChan)
+			if err := <-errChan; err != io.EOF {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+// BenchmarkPumpCopy forwards each message as its own []byte, as every pump
+// that reads messages must
+func BenchmarkPumpCopy(b *testing.B) {
+	benchmarkPump(b, func(p *pump, src, dst *benchStream, errChan chan<- error) {
+		p.runOrdered(src, dst, errChan)
+	})
+}
+
+// BenchmarkPumpZeroCopy forwards each message in the buffers it was received
+// into, as pass-thru pumps do
+func BenchmarkPumpZeroCopy(b *testing.B) {
+	benchmarkPump(b, func(p *pump, src, dst *benchStream, errChan chan<- error) {
+		p.runZeroCopy(src, dst, errChan)
+	})
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jhump/protoreflect/desc"
+)
+
+// --- Log Redaction ---
+//
+// Inspecting routes log each envelope they decode, and the inner payload its
+// type_url names, as JSON; tapped routes export the same JSON. Both would
+// carry whatever personal data the messages do. A route's redact_fields lists
+// field paths, in the form mutations use ("user_id", "actor.email",
+// "metadata[authorization]"), whose values are replaced in that JSON:
+//
+//	redact_fields: [user_id, actor.email, "metadata[authorization]"]
+//	redact_with: mask   # "[REDACTED]" (default), or hash: "sha256:" and the
+//	                    # first 16 hex digits of the value's SHA-256
+//
+// Each path applies to whichever of the two messages has it, and passes
+// through repeated message fields. hash keeps equal values correlatable
+// across log lines without showing them. Redaction only touches the JSON
+// written out: the forwarded bytes, signatures, capture files and audit
+// records are unchanged.
+//
+// The inner payload is only logged on routes with log_inner_payload: true;
+// otherwise the log shows its type_url and size, and the envelope dump shows
+// the payload field as "[REDACTED]".
+
+// Values of redact_with
+const (
+	redactMask = "mask"
+	redactHash = "hash"
+)
+
+const redactedValue = "[REDACTED]"
+
+// redaction is a route's redact_fields and redact_with, parsed
+type redaction struct {
+	fields []mutation // parsed for their path and map key only
+	hash   bool
+}
+
+// redactionFor is route's redaction, nil when it has none
+func (px *Proxy) redactionFor(route *RouteConfig) *redaction {
+	return px.routeRedactions[route.Name]
+}
+
+// redactJSON returns js, the protobuf JSON form of a message of type md, with
+// every field r names replaced, and whether any was. The result is indented
+// when indent is set.
+func (r *redaction) redactJSON(js []byte, md *desc.MessageDescriptor, indent bool) ([]byte, bool) {
+	if r == nil || len(r.fields) == 0 {
+		return js, false
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(js, &obj); err != nil {
+		return js, false
+	}
+	redacted := false
+	for i := range r.fields {
+		m := &r.fields[i]
+		if r.redactPath(obj, md, m.path, m) {
+			redacted = true
+		}
+	}
+	if !redacted {
+		return js, false
+	}
+	return marshalLogJSON(obj, indent), true
+}
+
+// redactPath replaces the value path leads to under obj, a message of type md
+func (r *redaction) redactPath(obj map[string]interface{}, md *desc.MessageDescriptor, path []string, m *mutation) bool {
+	fd := md.FindFieldByName(path[0])
+	if fd == nil {
+		return false
+	}
+	name := fd.GetJSONName()
+	if _, ok := obj[name]; !ok {
+		name = fd.GetName()
+	}
+	v, ok := obj[name]
+	if !ok {
+		return false
+	}
+	if len(path) > 1 {
+		sub := fd.GetMessageType()
+		if sub == nil {
+			return false
+		}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			return r.redactPath(v, sub, path[1:], m)
+		case []interface{}:
+			redacted := false
+			for _, elem := range v {
+				if elem, ok := elem.(map[string]interface{}); ok && r.redactPath(elem, sub, path[1:], m) {
+					redacted = true
+				}
+			}
+			return redacted
+		}
+		return false
+	}
+	if m.hasKey {
+		entries, ok := v.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if _, ok := entries[m.key]; !ok {
+			return false
+		}
+		entries[m.key] = r.replace(entries[m.key])
+		return true
+	}
+	obj[name] = r.replace(v)
+	return true
+}
+
+// replace is what a redacted value is logged as
+func (r *redaction) replace(v interface{}) interface{} {
+	if !r.hash {
+		return redactedValue
+	}
+	b, _ := json.Marshal(v)
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// hidePayload replaces the payload field in an envelope's JSON form
+func hidePayload(js []byte, payload *desc.FieldDescriptor, indent bool) []byte {
+	if payload == nil {
+		return js
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(js, &obj); err != nil {
+		return js
+	}
+	for _, name := range []string{payload.GetJSONName(), payload.GetName()} {
+		if _, ok := obj[name]; ok {
+			obj[name] = redactedValue
+			return marshalLogJSON(obj, indent)
+		}
+	}
+	return js
+}
+
+func marshalLogJSON(obj map[string]interface{}, indent bool) []byte {
+	if indent {
+		b, _ := json.MarshalIndent(obj, "", "  ")
+		return b
+	}
+	b, _ := json.Marshal(obj)
+	return b
+}
+
+// loadRedaction parses each route's redact_fields and redact_with
+func (px *Proxy) loadRedaction(diag *Diagnostics) {
+	for i, route := range px.cfg.Routes {
+		path := fmt.Sprintf("routes[%d]", i)
+		r := &redaction{}
+		valid := true
+		switch route.RedactWith {
+		case "", redactMask:
+		case redactHash:
+			r.hash = true
+		default:
+			diag.Errorf("routes", "ROUTE_REDACT", path+".redact_with", "unknown value %q (expected mask or hash)", route.RedactWith)
+			valid = false
+		}
+		if len(route.RedactFields) == 0 {
+			if route.RedactWith != "" {
+				diag.Warnf("routes", "ROUTE_REDACT", path+".redact_with", "has no effect without redact_fields")
+			}
+			continue
+		}
+		for j, field := range route.RedactFields {
+			m, err := parseMutation(MutationConfig{Op: "clear", Field: field, Direction: "both"})
+			if err != nil {
+				diag.Errorf("routes", "ROUTE_REDACT", fmt.Sprintf("%s.redact_fields[%d]", path, j), "%v", err)
+				valid = false
+				continue
+			}
+			r.fields = append(r.fields, m)
+		}
+		if (route.Mode == "pass-thru" || route.Mode == "local-reply") && route.Tap == nil {
+			diag.Warnf("routes", "ROUTE_REDACT", path+".redact_fields", "%s routes without a tap write no message JSON to redact", route.Mode)
+		}
+		if _, dup := px.routeRedactions[route.Name]; valid && !dup {
+			px.routeRedactions[route.Name] = r
+		}
+	}
+}
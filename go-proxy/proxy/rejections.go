@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// --- Rejection Details ---
+//
+// Every status the proxy ends a call with itself carries a google.rpc.ErrorInfo
+// in the "grpc-proxy" domain. Its reason says why (SIGNATURE_INVALID,
+// TYPE_NOT_ALLOWED, RATE_LIMITED, ...) and its metadata names the route and
+// method, plus whatever the reason needs (the limit, the processor). The
+// response also carries x-proxy-rejected: true, in the headers when they have
+// not been sent yet and in the trailer otherwise. Statuses from the backend
+// are forwarded as they are, without either.
+
+const (
+	rejectionDomain = "grpc-proxy"
+	rejectedHeader  = "x-proxy-rejected"
+)
+
+// ErrorInfo reasons
+const (
+	reasonSignatureInvalid    = "SIGNATURE_INVALID"
+	reasonSignatureMissing    = "SIGNATURE_MISSING"
+	reasonSigningFailed       = "SIGNING_FAILED"
+	reasonEmptyPayload        = "EMPTY_PAYLOAD"
+	reasonIdentityInvalid     = "IDENTITY_INVALID"
+	reasonIdentitySigning     = "IDENTITY_SIGNING_FAILED"
+	reasonIdentityMissing     = "TRANSPORT_IDENTITY_MISSING"
+	reasonIdentityBinding     = "IDENTITY_BINDING_FAILED"
+	reasonTenantUnknown       = "TENANT_UNKNOWN"
+	reasonSigningKeyUnknown   = "SIGNING_KEY_UNKNOWN"
+	reasonEnvelopeHeader      = "ENVELOPE_HEADER_INVALID"
+	reasonEnvelopeUndecodable = "ENVELOPE_UNDECODABLE"
+	reasonEnvelopeVersion     = "ENVELOPE_VERSION_UNKNOWN"
+	reasonDecodeLimit         = "DECODE_LIMIT_EXCEEDED"
+	reasonTypeNotAllowed      = "TYPE_NOT_ALLOWED"
+	reasonUnknownType         = "UNKNOWN_TYPE"
+	reasonPayloadUndecodable  = "PAYLOAD_UNDECODABLE"
+	reasonMissingField        = "MISSING_FIELD"
+	reasonEncryptionFailed    = "ENCRYPTION_FAILED"
+	reasonDecryptionFailed    = "DECRYPTION_FAILED"
+	reasonProcessorRejected   = "PROCESSOR_REJECTED"
+	reasonProcessorFailed     = "PROCESSOR_FAILED"
+	reasonRateLimited         = "RATE_LIMITED"
+	reasonConcurrencyLimited  = "CONCURRENCY_LIMITED"
+	reasonCPUClassSaturated   = "CPU_CLASS_SATURATED"
+	reasonLoadShed            = "LOAD_SHED"
+	reasonStreamLimit         = "STREAM_LIMIT_EXCEEDED"
+	reasonReorderWindow       = "REORDER_WINDOW_EXCEEDED"
+	reasonReorderStalled      = "REORDER_STALLED"
+	reasonSlowConsumer        = "SLOW_CONSUMER"
+	reasonTimeout             = "TIMEOUT"
+	reasonAttemptTimeout      = "ATTEMPT_TIMEOUT"
+	reasonNoHealthyBackend    = "NO_HEALTHY_BACKEND"
+	reasonAuditUnavailable    = "AUDIT_UNAVAILABLE"
+	reasonLocalReply          = "LOCAL_REPLY_UNAVAILABLE"
+	reasonMalformedCall       = "MALFORMED_CALL"
+	reasonBackendProtocol     = "BACKEND_PROTOCOL_ERROR"
+	reasonProxyTransport      = "PROXY_TRANSPORT_ERROR"
+	reasonFaultInjected       = "FAULT_INJECTED"
+)
+
+// rejection is a status originated by the proxy
+type rejection struct {
+	code     codes.Code
+	message  string
+	reason   string
+	metadata map[string]string
+	details  []*anypb.Any // a processor's own status details, ahead of the ErrorInfo
+}
+
+// rejectf builds a rejection the way status.Errorf builds a status
+func rejectf(code codes.Code, reason, format string, args ...interface{}) *rejection {
+	return &rejection{code: code, message: fmt.Sprintf(format, args...), reason: reason}
+}
+
+// with adds a metadata entry to the ErrorInfo
+func (r *rejection) with(key, value string) *rejection {
+	if r.metadata == nil {
+		r.metadata = make(map[string]string)
+	}
+	r.metadata[key] = value
+	return r
+}
+
+func (r *rejection) Error() string { return status.New(r.code, r.message).Err().Error() }
+
+func (r *rejection) GRPCStatus() *status.Status {
+	p := status.New(r.code, r.message).Proto()
+	p.Details = append(p.Details, r.details...)
+	info := &errdetails.ErrorInfo{Domain: rejectionDomain, Reason: r.reason, Metadata: r.metadata}
+	st, err := status.FromProto(p).WithDetails(info)
+	if err != nil {
+		return status.FromProto(p)
+	}
+	return st
+}
+
+func (r *rejection) rejection() *rejection { return r }
+
+// rejector is implemented by the errors the proxy ends calls with: rejection
+// itself, and the timeouts and limits that carry their own state
+type rejector interface {
+	error
+	rejection() *rejection
+}
+
+// callStatus is the status a call ends with for err. Statuses, the backend's
+// and the proxy's own, are returned exactly, details included, even when
+// wrapped; cancellation and deadlines keep their codes. Anything else failed
+// in the proxy's own plumbing and becomes an UNAVAILABLE rejection.
+func callStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	var rj rejector
+	if errors.As(err, &rj) {
+		return err
+	}
+	var se interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &se) {
+		return se.GRPCStatus().Err()
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+	return rejectf(codes.Unavailable, reasonProxyTransport, "proxy: %v", err)
+}
+
+// markRejection completes a proxy-originated error with the route and method
+// and flags the response as rejected. Other errors are returned unchanged.
+func markRejection(serverStream grpc.ServerStream, method string, route *RouteConfig, err error) error {
+	var rj rejector
+	if err == nil || !errors.As(err, &rj) {
+		return err
+	}
+	r := rj.rejection()
+	r.with("route", route.Name).with("method", method)
+	flag := metadata.Pairs(rejectedHeader, "true")
+	if serverStream.SetHeader(flag) != nil {
+		serverStream.SetTrailer(flag)
+	}
+	return r
+}
@@ -0,0 +1,334 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// --- Remote Descriptor Sets ---
+//
+// schema.method url fetches the descriptor set over HTTPS from schema.remote.url
+// instead of reading it from disk: a FileDescriptorSet, or a Buf image, whose
+// encoding is a FileDescriptorSet's with extra fields the proxy ignores. The
+// URL may be an artifact server or a registry endpoint that serves the image
+// with a GET; bearer_token_file, read before each fetch, is sent as an
+// Authorization: Bearer header, and ca_file replaces the system roots for a
+// server with a private CA.
+//
+// With sha256 set, a body with another digest is refused, at startup as at a
+// refresh. Every good body is written to cache_path, and when the server
+// cannot be reached at startup (a network error, a timeout, a 5xx or a 429) the proxy
+// starts from that copy with a warning instead of failing. Any other failure,
+// such as a bad URL, a 4xx, a checksum mismatch or a body that does not
+// parse, fails startup.
+//
+// With refresh_interval set, the set is fetched again on that interval with
+// If-None-Match and the ETag of the last good body. A changed set replaces
+// the loaded descriptors in one swap, so calls in flight finish with the
+// descriptors they started with; a refresh that fails keeps the ones loaded.
+// proxy_schema_refreshes_total counts refreshes by result: updated,
+// not_modified, unchanged or failed.
+
+// RemoteSchemaConfig is where method url fetches the descriptor set
+type RemoteSchemaConfig struct {
+	URL             string `yaml:"url"`               // https:// only
+	SHA256          string `yaml:"sha256"`            // expected hex digest of the body; empty accepts any
+	BearerTokenFile string `yaml:"bearer_token_file"` // token sent as Authorization: Bearer
+	CAFile          string `yaml:"ca_file"`           // PEM roots for the server; default the system's
+	CachePath       string `yaml:"cache_path"`        // last good body; started from when the server is down
+	Timeout         string `yaml:"timeout"`           // per fetch; default 10s
+	RefreshInterval string `yaml:"refresh_interval"`  // e.g. "5m"; empty never re-fetches
+}
+
+const defaultRemoteSchemaTimeout = 10 * time.Second
+
+// remoteSchema fetches a descriptor set and remembers the last good one
+type remoteSchema struct {
+	cfg     RemoteSchemaConfig
+	client  *http.Client
+	timeout time.Duration
+
+	// Owned by loadRemoteSchema, then by the refresh goroutine
+	etag   string
+	digest string
+}
+
+// errUnreachable marks a fetch that failed because the server could not be
+// reached or could not answer, which the cached copy may stand in for
+var errUnreachable = errors.New("unreachable")
+
+// loadRemoteSchema checks schema.remote, fetches the descriptor set or falls
+// back to the cached copy, and starts the refreshes
+func (px *Proxy) loadRemoteSchema(diag *Diagnostics) {
+	cfg := px.cfg.Schema.Remote
+	rs, refresh := newRemoteSchema(cfg, diag)
+	if rs == nil {
+		return
+	}
+	px.remoteSchema = rs
+
+	body, etag, err := rs.fetch()
+	if err == nil {
+		res, err := rs.accept(body)
+		if err != nil {
+			diag.Errorf("schema", "SCHEMA_URL_INVALID", "schema.remote.url", "%s: %v", cfg.URL, err)
+			return
+		}
+		rs.etag = etag
+		rs.saveCache(body)
+		px.setDescriptors(res)
+		metrics.Set("proxy_schema_ready", nil, 1)
+		log.Printf("[Schema] Loaded %d methods from %s (sha256 %s)", len(res), cfg.URL, rs.digest)
+	} else if !errors.Is(err, errUnreachable) {
+		diag.Errorf("schema", "SCHEMA_URL_FETCH", "schema.remote.url", "%s: %v", cfg.URL, err)
+		return
+	} else if !px.loadCachedSchema(rs, err, diag) {
+		return
+	}
+	if refresh > 0 {
+		go px.refreshRemoteSchema(rs, refresh, px.stop)
+	}
+}
+
+// newRemoteSchema checks cfg, returning the fetcher and refresh interval, or
+// nil after reporting what is wrong
+func newRemoteSchema(cfg RemoteSchemaConfig, diag *Diagnostics) (*remoteSchema, time.Duration) {
+	ok := true
+	u, err := url.Parse(cfg.URL)
+	switch {
+	case cfg.URL == "":
+		diag.Errorf("schema", "SCHEMA_URL", "schema.remote.url", "method url needs schema.remote.url")
+		ok = false
+	case err != nil:
+		diag.Errorf("schema", "SCHEMA_URL", "schema.remote.url", "invalid URL %q: %v", cfg.URL, err)
+		ok = false
+	case u.Scheme != "https" || u.Host == "":
+		diag.Errorf("schema", "SCHEMA_URL", "schema.remote.url", "%q is not an https:// URL", cfg.URL)
+		ok = false
+	}
+	if cfg.SHA256 != "" {
+		if b, err := hex.DecodeString(cfg.SHA256); err != nil || len(b) != sha256.Size {
+			diag.Errorf("schema", "SCHEMA_URL", "schema.remote.sha256", "%q is not a hex SHA-256 digest", cfg.SHA256)
+			ok = false
+		}
+	}
+	durations := []struct {
+		path, raw string
+		d         time.Duration
+	}{
+		{"schema.remote.timeout", cfg.Timeout, defaultRemoteSchemaTimeout},
+		{"schema.remote.refresh_interval", cfg.RefreshInterval, 0},
+	}
+	for i, f := range durations {
+		if f.raw == "" {
+			continue
+		}
+		d, err := time.ParseDuration(f.raw)
+		if err != nil || d <= 0 {
+			diag.Errorf("schema", "SCHEMA_URL", f.path, "invalid duration %q", f.raw)
+			ok = false
+			continue
+		}
+		durations[i].d = d
+	}
+	if cfg.BearerTokenFile != "" {
+		if _, err := os.Stat(cfg.BearerTokenFile); err != nil {
+			diag.Errorf("schema", "SCHEMA_URL", "schema.remote.bearer_token_file", "%v", err)
+			ok = false
+		}
+	}
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CAFile != "" {
+		pool, err := loadCertPool(cfg.CAFile)
+		if err != nil {
+			diag.Errorf("schema", "SCHEMA_URL", "schema.remote.ca_file", "%v", err)
+			ok = false
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if !ok {
+		return nil, 0
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+	return &remoteSchema{
+		cfg:     cfg,
+		client:  &http.Client{Transport: transport},
+		timeout: durations[0].d,
+	}, durations[1].d
+}
+
+// loadCachedSchema starts from the cached copy after the server could not be
+// reached, reporting whether it could
+func (px *Proxy) loadCachedSchema(rs *remoteSchema, fetchErr error, diag *Diagnostics) bool {
+	path := rs.cfg.CachePath
+	if path == "" {
+		diag.Errorf("schema", "SCHEMA_URL_FETCH", "schema.remote.url", "%s: %v, and no schema.remote.cache_path to fall back to", rs.cfg.URL, fetchErr)
+		return false
+	}
+	body, err := os.ReadFile(path)
+	if err != nil {
+		diag.Errorf("schema", "SCHEMA_URL_FETCH", "schema.remote.url", "%s: %v, and the cached copy cannot be read: %v", rs.cfg.URL, fetchErr, err)
+		return false
+	}
+	res, err := rs.accept(body)
+	if err != nil {
+		diag.Errorf("schema", "SCHEMA_URL_INVALID", "schema.remote.cache_path", "%s: %v", path, err)
+		return false
+	}
+	px.setDescriptors(res)
+	metrics.Set("proxy_schema_ready", nil, 1)
+	modified := "unknown"
+	if fi, err := os.Stat(path); err == nil {
+		modified = fi.ModTime().UTC().Format(time.RFC3339)
+	}
+	diag.Warnf("schema", "SCHEMA_URL_CACHED", "schema.remote.cache_path", "%s: %v; serving %d methods from the copy cached at %s (written %s)", rs.cfg.URL, fetchErr, len(res), path, modified)
+	return true
+}
+
+// fetch GETs the descriptor set and its ETag, returning a nil body without an
+// error when the server answers 304 Not Modified
+func (rs *remoteSchema) fetch() ([]byte, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), rs.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rs.cfg.URL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", "application/octet-stream")
+	if rs.etag != "" {
+		req.Header.Set("If-None-Match", rs.etag)
+	}
+	if rs.cfg.BearerTokenFile != "" {
+		token, err := os.ReadFile(rs.cfg.BearerTokenFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("bearer token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := rs.client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", errUnreachable, err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return nil, rs.etag, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return nil, "", fmt.Errorf("%w: server answered %s", errUnreachable, resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return nil, "", fmt.Errorf("server answered %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", errUnreachable, err)
+	}
+	return body, resp.Header.Get("ETag"), nil
+}
+
+// accept checks body against the expected digest and parses it, recording
+// its digest once it is good
+func (rs *remoteSchema) accept(body []byte) (map[string]*desc.MethodDescriptor, error) {
+	sum := sha256.Sum256(body)
+	digest := hex.EncodeToString(sum[:])
+	if rs.cfg.SHA256 != "" && !strings.EqualFold(digest, rs.cfg.SHA256) {
+		return nil, fmt.Errorf("checksum mismatch: sha256 %s, want %s", digest, strings.ToLower(rs.cfg.SHA256))
+	}
+	fds := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(body, fds); err != nil {
+		return nil, fmt.Errorf("not a FileDescriptorSet or Buf image: %v", err)
+	}
+	fdMap, err := desc.CreateFileDescriptorsFromSet(fds)
+	if err != nil {
+		return nil, fmt.Errorf("descriptor set does not link: %v", err)
+	}
+	rs.digest = digest
+	return methodsOf(fdMap), nil
+}
+
+// saveCache writes body to the cache path through a temporary file, so a
+// crash never leaves a torn copy to start from
+func (rs *remoteSchema) saveCache(body []byte) {
+	path := rs.cfg.CachePath
+	if path == "" {
+		return
+	}
+	if cached, err := os.ReadFile(path); err == nil && bytes.Equal(cached, body) {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err == nil {
+		_, err = tmp.Write(body)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), path)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		log.Printf("[Schema Error] Could not cache the descriptor set at %s: %v", path, err)
+	}
+}
+
+// refreshRemoteSchema fetches the descriptor set every interval until stop is
+// closed, swapping in the descriptors of a set that changed
+func (px *Proxy) refreshRemoteSchema(rs *remoteSchema, interval time.Duration, stop <-chan struct{}) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-stop:
+			return
+		}
+		result := px.refreshOnce(rs)
+		metrics.Inc("proxy_schema_refreshes_total", Labels{"result": result})
+	}
+}
+
+// refreshOnce fetches the set once, returning the refresh result
+func (px *Proxy) refreshOnce(rs *remoteSchema) string {
+	previous := rs.digest
+	body, etag, err := rs.fetch()
+	if err != nil {
+		log.Printf("[Schema Error] Refresh from %s failed, keeping the loaded descriptors: %v", rs.cfg.URL, err)
+		return "failed"
+	}
+	if body == nil {
+		return "not_modified"
+	}
+	res, err := rs.accept(body)
+	if err != nil {
+		log.Printf("[Schema Error] Refresh from %s refused, keeping the loaded descriptors: %v", rs.cfg.URL, err)
+		return "failed"
+	}
+	rs.etag = etag
+	if rs.digest == previous {
+		return "unchanged"
+	}
+	rs.saveCache(body)
+	px.setDescriptors(res)
+	log.Printf("[Schema] Refreshed %d methods from %s (sha256 %s)", len(res), rs.cfg.URL, rs.digest)
+	return "updated"
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// --- Strict Ordering for Unordered Routes ---
+//
+// unordered: true processes a stream's messages concurrently. With ordering:
+// relaxed (the default) each is forwarded as soon as it is done, so a slow
+// message is overtaken by later ones. With ordering: strict every message is
+// numbered as it is received, and finished ones wait in a reorder buffer until
+// all earlier ones have been sent, so each direction forwards in exactly the
+// order it received. The buffer holds at most reorder.window messages; a
+// stream that would need more, or whose next message is still unfinished
+// after reorder.stall_timeout, ends with an error instead of buffering more.
+
+// ReorderConfig bounds the reorder buffer of an ordering: strict route
+type ReorderConfig struct {
+	Window       int    `yaml:"window"`        // finished messages held back; default buffer_depth
+	StallTimeout string `yaml:"stall_timeout"` // e.g. "5s"; default 10s
+}
+
+const (
+	orderingRelaxed = "relaxed"
+	orderingStrict  = "strict"
+
+	defaultReorderStall = 10 * time.Second
+)
+
+// reorderPolicy is a strict route's parsed reorder settings
+type reorderPolicy struct {
+	window int
+	stall  time.Duration
+}
+
+// forward sends the results from out in sequence order. drop releases a
+// result that is discarded unsent when forwarding ends early.
+func (rp *reorderPolicy) forward(out <-chan processed, send func(processed) error, drop func()) error {
+	pending := make(map[uint64]processed)
+	defer func() {
+		for range pending {
+			drop()
+		}
+	}()
+	var next uint64
+	stall := time.NewTimer(rp.stall)
+	stall.Stop()
+	for {
+		select {
+		case r, ok := <-out:
+			if !ok {
+				return nil
+			}
+			pending[r.seq] = r
+			advanced := false
+			for {
+				r, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+				next++
+				advanced = true
+				if err := send(r); err != nil {
+					return err
+				}
+			}
+			if len(pending) > rp.window {
+				return rejectf(codes.ResourceExhausted, reasonReorderWindow, "proxy: %d messages are waiting for message %d, more than the reorder window of %d", len(pending), next, rp.window)
+			}
+			switch {
+			case len(pending) == 0:
+				stall.Stop()
+			case advanced || len(pending) == 1:
+				stall.Reset(rp.stall)
+			}
+		case <-stall.C:
+			return rejectf(codes.Aborted, reasonReorderStalled, "proxy: message %d was not processed within %s while %d later messages waited", next, rp.stall, len(pending))
+		}
+	}
+}
+
+// loadOrdering parses each route's ordering and reorder settings
+func (px *Proxy) loadOrdering(diag *Diagnostics) {
+	for i, route := range px.cfg.Routes {
+		path := fmt.Sprintf("routes[%d]", i)
+		switch route.Ordering {
+		case "", orderingRelaxed:
+			if route.Reorder != (ReorderConfig{}) {
+				diag.Warnf("routes", "ROUTE_ORDERING", path+".reorder", "reorder only applies with ordering: strict")
+			}
+			continue
+		case orderingStrict:
+		default:
+			diag.Errorf("routes", "ROUTE_ORDERING", path+".ordering", "unknown ordering %q (expected strict or relaxed)", route.Ordering)
+			continue
+		}
+		if !route.Unordered {
+			diag.Warnf("routes", "ROUTE_ORDERING", path+".ordering", "routes without unordered: true always forward in order")
+			continue
+		}
+
+		rp := &reorderPolicy{window: route.Reorder.Window, stall: defaultReorderStall}
+		if rp.window == 0 {
+			rp.window = defaultBufferDepth
+			if route.BufferDepth > 0 {
+				rp.window = route.BufferDepth
+			}
+		}
+		valid := true
+		if rp.window < 0 {
+			diag.Errorf("routes", "ROUTE_ORDERING", path+".reorder.window", "must be positive, got %d", route.Reorder.Window)
+			valid = false
+		}
+		if s := route.Reorder.StallTimeout; s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				diag.Errorf("routes", "ROUTE_ORDERING", path+".reorder.stall_timeout", "invalid duration %q", s)
+				valid = false
+			}
+			rp.stall = d
+		}
+		if _, dup := px.routeReorders[route.Name]; valid && !dup {
+			px.routeReorders[route.Name] = rp
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// --- Replay ---
+//
+// `proxy replay -target host:port capture.bin [capture.bin.1 ...]` re-sends
+// the client->backend messages of each captured call, one call at a time in
+// the order the calls started. Every call is opened as a bidirectional stream,
+// which every gRPC method accepts on the wire, so unary and streaming calls
+// replay the same way. Redacted messages are sent as redacted; calls with a
+// message that could not be recorded are skipped.
+
+type replayCall struct {
+	id       uint64
+	method   string
+	start    time.Time
+	messages [][]byte
+	missing  bool
+}
+
+// Replay implements the replay subcommand; args excludes the subcommand name.
+// It returns the process exit code.
+func Replay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := fs.String("target", "", "address to replay against, e.g. the proxy or a backend")
+	prefix := fs.String("method", "", "only replay calls whose method starts with this prefix")
+	caFile := fs.String("ca", "", "CA file; enables TLS to the target")
+	certFile := fs.String("cert", "", "client certificate for mTLS")
+	keyFile := fs.String("key", "", "client key for mTLS")
+	serverName := fs.String("server-name", "", "TLS server name override")
+	timeout := fs.Duration("timeout", 10*time.Second, "deadline for each replayed call")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: proxy replay -target host:port [flags] capture-file...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *target == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	calls, err := loadReplayCalls(fs.Args(), *prefix)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+
+	transport := grpc.WithTransportCredentials(insecure.NewCredentials())
+	if *caFile != "" || *certFile != "" {
+		tlsCfg, err := backendTLSConfig(BackendTLSConfig{CAFile: *caFile, CertFile: *certFile, KeyFile: *keyFile, ServerName: *serverName})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+			return 1
+		}
+		transport = grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg))
+	}
+	conn, err := grpc.Dial(*target, transport, grpc.WithDefaultCallOptions(grpc.ForceCodecV2(bytesCodec{})))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: dial %s: %v\n", *target, err)
+		return 1
+	}
+	defer conn.Close()
+
+	if replayCalls(os.Stdout, conn, calls, *timeout) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// loadReplayCalls reads the client->backend messages of the calls in files
+// whose method starts with prefix, in the order the calls started
+func loadReplayCalls(files []string, prefix string) ([]*replayCall, error) {
+	calls := map[uint64]*replayCall{}
+	for _, file := range files {
+		err := readCapture(file, func(rec *captureRecord) error {
+			if rec.dir != captureC2S || !strings.HasPrefix(rec.method, prefix) {
+				return nil
+			}
+			c := calls[rec.call]
+			if c == nil {
+				c = &replayCall{id: rec.call, method: rec.method, start: rec.at}
+				calls[rec.call] = c
+			}
+			if rec.raw == nil {
+				c.missing = true
+			}
+			c.messages = append(c.messages, rec.raw)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	ordered := make([]*replayCall, 0, len(calls))
+	for _, c := range calls {
+		ordered = append(ordered, c)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].start.Before(ordered[j].start) })
+	return ordered, nil
+}
+
+// replayCalls replays each call on conn in turn, writing a line per call and
+// a summary to w, and returns how many failed
+func replayCalls(w io.Writer, conn *grpc.ClientConn, calls []*replayCall, timeout time.Duration) int {
+	failed := 0
+	for _, c := range calls {
+		if c.missing {
+			fmt.Fprintf(w, "call %d %s: skipped (a message was not recorded)\n", c.id, c.method)
+			continue
+		}
+		responses, err := replayOne(conn, c, timeout)
+		st := status.Convert(err)
+		if err != nil {
+			failed++
+		}
+		fmt.Fprintf(w, "call %d %s: %s (%d sent, %d received)", c.id, c.method, st.Code(), len(c.messages), responses)
+		if st.Message() != "" {
+			fmt.Fprintf(w, ": %s", st.Message())
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "replayed %d calls, %d failed\n", len(calls), failed)
+	return failed
+}
+
+// replayOne sends every captured request of c, half-closes, and drains the responses
+func replayOne(conn *grpc.ClientConn, c *replayCall, timeout time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, c.method)
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range c.messages {
+		msg := m
+		if err := stream.SendMsg(&msg); err != nil {
+			// The real error is the status, which RecvMsg reports
+			break
+		}
+	}
+	stream.CloseSend()
+	responses := 0
+	for {
+		var resp []byte
+		if err := stream.RecvMsg(&resp); err != nil {
+			if err == io.EOF {
+				return responses, nil
+			}
+			return responses, err
+		}
+		responses++
+	}
+}
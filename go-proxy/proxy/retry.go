@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryConfig controls how the proxy retries establishing the upstream call.
+// Messages are never replayed mid-stream; the one exception is BufferUnary,
+// where the single request of a unary call is replayed so the whole call can
+// be retried (see proxyUnary).
+type RetryConfig struct {
+	MaxAttempts       int      `yaml:"max_attempts"`        // total attempts including the first; <=1 disables retries
+	PerAttemptTimeout string   `yaml:"per_attempt_timeout"` // e.g. "2s"; streams: establishment only; unary: with buffer_unary only
+	InitialBackoff    string   `yaml:"initial_backoff"`     // default 50ms
+	MaxBackoff        string   `yaml:"max_backoff"`         // default 2s
+	BackoffMultiplier float64  `yaml:"backoff_multiplier"`  // default 2
+	RetryableCodes    []string `yaml:"retryable_codes"`     // default ["UNAVAILABLE"]
+	BufferUnary       bool     `yaml:"buffer_unary"`
+}
+
+type retryPolicy struct {
+	maxAttempts       int
+	perAttemptTimeout time.Duration
+	initialBackoff    time.Duration
+	maxBackoff        time.Duration
+	multiplier        float64
+	retryable         map[codes.Code]bool
+	bufferUnary       bool
+}
+
+// noRetryPolicy applies when neither the route nor the backend has a retry block
+var noRetryPolicy = &retryPolicy{maxAttempts: 1}
+
+func (px *Proxy) retryPolicyFor(route *RouteConfig) *retryPolicy {
+	if p, ok := px.routeRetries[route.Name]; ok {
+		return p
+	}
+	if px.defaultRetry != nil {
+		return px.defaultRetry
+	}
+	return noRetryPolicy
+}
+
+func parseRetryConfig(cfg RetryConfig) (*retryPolicy, error) {
+	p := &retryPolicy{
+		maxAttempts:    cfg.MaxAttempts,
+		initialBackoff: 50 * time.Millisecond,
+		maxBackoff:     2 * time.Second,
+		multiplier:     cfg.BackoffMultiplier,
+		retryable:      map[codes.Code]bool{codes.Unavailable: true},
+		bufferUnary:    cfg.BufferUnary,
+	}
+	if p.maxAttempts < 1 {
+		p.maxAttempts = 1
+	}
+	if p.multiplier == 0 {
+		p.multiplier = 2
+	} else if p.multiplier < 1 {
+		return nil, fmt.Errorf("backoff_multiplier must be >= 1, got %v", p.multiplier)
+	}
+	var err error
+	if p.perAttemptTimeout, err = parseRetryDuration("per_attempt_timeout", cfg.PerAttemptTimeout, 0); err != nil {
+		return nil, err
+	}
+	if p.initialBackoff, err = parseRetryDuration("initial_backoff", cfg.InitialBackoff, p.initialBackoff); err != nil {
+		return nil, err
+	}
+	if p.maxBackoff, err = parseRetryDuration("max_backoff", cfg.MaxBackoff, p.maxBackoff); err != nil {
+		return nil, err
+	}
+	if len(cfg.RetryableCodes) > 0 {
+		p.retryable = make(map[codes.Code]bool)
+		for _, name := range cfg.RetryableCodes {
+			c, err := parseStatusCode(name)
+			if err != nil {
+				return nil, fmt.Errorf("retryable_codes: %v", err)
+			}
+			p.retryable[c] = true
+		}
+	}
+	return p, nil
+}
+
+// parseStatusCode accepts canonical code names in any case, e.g. "unavailable"
+func parseStatusCode(name string) (codes.Code, error) {
+	var c codes.Code
+	if err := c.UnmarshalJSON([]byte(strconv.Quote(strings.ToUpper(name)))); err != nil {
+		return c, fmt.Errorf("unknown status code %q", name)
+	}
+	return c, nil
+}
+
+func parseRetryDuration(field, raw string, def time.Duration) (time.Duration, error) {
+	if raw == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%s: invalid duration %q", field, raw)
+	}
+	return d, nil
+}
+
+// loadRetryPolicies validates the global and per-route retry blocks
+func (px *Proxy) loadRetryPolicies(diag *Diagnostics) {
+	if cfg := px.cfg.Backend.Retry; cfg != nil {
+		p, err := parseRetryConfig(*cfg)
+		if err != nil {
+			diag.Errorf("routes", "RETRY_POLICY", "backend.retry", "%v", err)
+		}
+		px.defaultRetry = p
+	}
+	for i, route := range px.cfg.Routes {
+		if route.Retry == nil {
+			continue
+		}
+		p, err := parseRetryConfig(*route.Retry)
+		if err != nil {
+			diag.Errorf("routes", "RETRY_POLICY", fmt.Sprintf("routes[%d].retry", i), "%v", err)
+			continue
+		}
+		if _, dup := px.routeRetries[route.Name]; !dup {
+			px.routeRetries[route.Name] = p
+		}
+	}
+}
+
+// backoff returns the jittered delay before the given retry (1-based)
+func (p *retryPolicy) backoff(retry int) time.Duration {
+	d := float64(p.initialBackoff)
+	for i := 1; i < retry; i++ {
+		d *= p.multiplier
+	}
+	if max := float64(p.maxBackoff); d > max {
+		d = max
+	}
+	// Full jitter keeps a restarting backend from being hit by synchronized waves
+	return time.Duration(rand.Float64() * d)
+}
+
+// shouldRetry decides whether another attempt may be made after err. It never
+// sleeps past the client's deadline: if the backoff would outlive it, the last
+// error is returned to the client instead.
+func (p *retryPolicy) shouldRetry(ctx context.Context, method string, attempt int, err error) bool {
+	code := status.Code(err)
+	var timedOut *attemptTimeoutError
+	if attempt >= p.maxAttempts || ctx.Err() != nil || !(p.retryable[code] || errors.As(err, &timedOut)) {
+		return false
+	}
+	wait := p.backoff(attempt)
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= wait {
+		return false
+	}
+	metrics.Inc("proxy_upstream_retries_total", Labels{"method": method, "code": code.String()})
+	log.Printf("[Retry] %s attempt %d failed (%s), retrying in %s", method, attempt, code, wait)
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// attemptTimeoutError marks an attempt cut short by per_attempt_timeout. It is
+// always retryable, whatever retryable_codes says, and reaches the client as
+// DEADLINE_EXCEEDED if no attempts remain.
+type attemptTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e *attemptTimeoutError) Error() string {
+	return fmt.Sprintf("proxy: upstream attempt timed out after %s", e.timeout)
+}
+
+func (e *attemptTimeoutError) GRPCStatus() *status.Status {
+	return e.rejection().GRPCStatus()
+}
+
+func (e *attemptTimeoutError) rejection() *rejection {
+	return rejectf(codes.DeadlineExceeded, reasonAttemptTimeout, "%s", e.Error())
+}
+
+// upstream is one established backend call
+type upstream struct {
+	conns  *connManager
+	conn   *upstreamConn
+	stream grpc.ClientStream
+	cancel context.CancelFunc
+}
+
+func (u *upstream) close() {
+	u.cancel()
+	u.conns.release(u.conn, false)
+}
+
+// withFailover runs one attempt, moving on to the next endpoint whenever the
+// current one fails in a way failover allows, for streams any connection-level
+// failure. Each endpoint is tried at most once per attempt; backoff between
+// attempts is left to the retry policy.
+func (px *Proxy) withFailover(attempt func(ep *endpoint) error, failover func(error) bool) error {
+	tried := make(map[string]bool)
+	var lastErr error
+	for {
+		ep, err := px.backends.pick(tried)
+		if err != nil {
+			if lastErr != nil {
+				return lastErr
+			}
+			return err
+		}
+		err = attempt(ep)
+		px.backends.report(ep, err)
+		if err == nil || !failover(err) {
+			return err
+		}
+		tried[ep.addr] = true
+		lastErr = err
+	}
+}
+
+// dialUpstream makes a single attempt at opening the backend stream on the
+// endpoint's shared connection. A connection-level failure drops that
+// connection so a retry is not stuck behind its reconnect backoff. The
+// per-attempt timeout covers only the establishment, never the lifetime of
+// the stream.
+func (px *Proxy) dialUpstream(ctx context.Context, ep *endpoint, method string, timeout time.Duration) (*upstream, error) {
+	conn, err := px.conns.acquire(ep)
+	if err != nil {
+		return nil, err
+	}
+
+	attemptCtx, cancel := context.WithCancel(ctx)
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, cancel)
+	}
+	stream, err := grpc.NewClientStream(attemptCtx, &grpc.StreamDesc{
+		ServerStreams: true,
+		ClientStreams: true,
+	}, conn.conn, method, px.upstreamCallOptions(ctx)...)
+	if timer != nil && !timer.Stop() && ctx.Err() == nil {
+		// The timer fired, so this attempt's context is gone even if the stream opened
+		err = &attemptTimeoutError{timeout}
+	}
+	if err != nil {
+		cancel()
+		px.conns.release(conn, isConnectionFailure(err))
+		return nil, err
+	}
+	return &upstream{conns: px.conns, conn: conn, stream: stream, cancel: cancel}, nil
+}
+
+// openUpstream establishes the backend stream under the route's retry policy
+func (px *Proxy) openUpstream(ctx context.Context, method string, policy *retryPolicy) (*upstream, error) {
+	for attempt := 1; ; attempt++ {
+		var up *upstream
+		err := px.withFailover(func(ep *endpoint) (err error) {
+			up, err = px.dialUpstream(ctx, ep, method, policy.perAttemptTimeout)
+			return err
+		}, isConnectionFailure)
+		if err == nil {
+			return up, nil
+		}
+		if !policy.shouldRetry(ctx, method, attempt, err) {
+			return nil, err
+		}
+	}
+}
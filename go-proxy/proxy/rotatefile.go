@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// --- Rotating Files ---
+//
+// The capture file and the audit log are both appended to by one writer
+// goroutine and rotated by size: once the next record would take the file
+// past max_bytes it becomes path.1, older files shift up to path.N and the
+// oldest is dropped. rotatingFile is that file, shared by both. A rename that
+// fails, on a full or read-only directory, leaves the current file in place
+// and appending continues there, so no record is lost to a failed rotation;
+// each failure is logged and counted in <metric>_rotation_errors_total, and
+// each rotation in <metric>_rotations_total.
+
+// rotatingFile is an append-only file rotated by size
+type rotatingFile struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+	magic    string // written at the start of every new file
+	tag      string // the log prefix, e.g. Capture
+	metric   string // the metric name prefix, e.g. proxy_capture
+
+	file *os.File
+	buf  *bufio.Writer
+	size int64
+}
+
+// newRotatingFile opens path for appending, creating its directory
+func newRotatingFile(path string, maxBytes int64, maxFiles int, magic, tag, metric string) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxBytes: maxBytes, maxFiles: maxFiles, magic: magic, tag: tag, metric: metric}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open appends to path, writing the magic when the file is new
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	st, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.buf, f.size = file, bufio.NewWriter(file), st.Size()
+	if f.size == 0 && f.magic != "" {
+		n, _ := f.buf.WriteString(f.magic)
+		f.size += int64(n)
+	}
+	return nil
+}
+
+// rotate shifts path -> path.1 -> ... -> path.N, dropping the oldest. When
+// path cannot be renamed it is reopened, to keep appending to.
+func (f *rotatingFile) rotate() error {
+	f.buf.Flush()
+	f.file.Close()
+	for i := f.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		if oerr := f.open(); oerr != nil {
+			return oerr
+		}
+		return err
+	}
+	metrics.Inc(f.metric+"_rotations_total", nil)
+	return f.open()
+}
+
+// write appends b, rotating first if b would take the file past maxBytes.
+// A file holding nothing but its magic is never rotated, however large b is.
+func (f *rotatingFile) write(b []byte) error {
+	if f.size+int64(len(b)) > f.maxBytes && f.size > int64(len(f.magic)) {
+		if err := f.rotate(); err != nil {
+			log.Printf("[%s] Rotation failed: %v", f.tag, err)
+			metrics.Inc(f.metric+"_rotation_errors_total", nil)
+		}
+	}
+	if _, err := f.buf.Write(b); err != nil {
+		return err
+	}
+	f.size += int64(len(b))
+	return nil
+}
+
+// flush writes out what is buffered, logging a failure
+func (f *rotatingFile) flush() {
+	if err := f.buf.Flush(); err != nil {
+		log.Printf("[%s] Flush failed: %v", f.tag, err)
+	}
+}
+
+// close flushes and closes the file
+func (f *rotatingFile) close() {
+	f.flush()
+	f.file.Close()
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRotatingFile writes past max_bytes several times and checks each file
+// starts with the magic, holds whole records, and only maxFiles are kept
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub", "log")
+	f, err := newRotatingFile(path, 32, 2, "MAGIC", "Test", "proxy_test_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := []byte("0123456789\n")
+	for i := 0; i < 10; i++ {
+		if err := f.write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.close()
+
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rest, ok := bytes.CutPrefix(b, []byte("MAGIC"))
+		if !ok || len(rest) == 0 || len(rest)%len(record) != 0 || len(b) > 32 {
+			t.Errorf("%s holds %q", p, b)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 kept past max_files: %v", path, err)
+	}
+	if got := counterValue("proxy_test_file_rotations_total", nil); got == 0 {
+		t.Errorf("rotations were not counted")
+	}
+}
+
+// TestRotatingFileRenameFailure blocks the rename of a file without magic,
+// as the audit log is, and checks every record still lands in it
+func TestRotatingFileRenameFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := os.MkdirAll(filepath.Join(path+".1", "in-the-way"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := newRotatingFile(path, 16, 1, "", "Test", "proxy_test_blocked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := []byte("0123456789\n")
+	const records = 5
+	for i := 0; i < records; i++ {
+		if err := f.write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.close()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := bytes.Repeat(record, records); !bytes.Equal(b, want) {
+		t.Errorf("file holds %d bytes, want all %d records", len(b), records)
+	}
+	if got := counterValue("proxy_test_blocked_rotation_errors_total", nil); got != records-1 {
+		t.Errorf("counted %v failed rotations, want %d", got, records-1)
+	}
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// --- Route Precedence ---
+//
+// Of the config routes whose pattern covers a method, matchRoute picks the
+// one that ranks highest by, in turn:
+//
+//  1. priority, higher first. Unset is 0, and a route that sets 0 ranks as
+//     one without; a negative priority ranks below the routes without one.
+//  2. specificity: an exact match beats every prefix, and a longer prefix
+//     beats a shorter one ("/*" ranks last)
+//  3. config order, earlier first
+//
+// The ranking does not depend on the method, so it orders the routes once
+// and for all: a method takes the first route in that order that covers it,
+// which is also the order /routes lists them in. matchRoute does not walk
+// that list per call. Exact patterns are looked up in a map, and prefixes in
+// a map per distinct prefix length, so a call costs one lookup for the exact
+// route plus one per prefix length in the config.
+
+// routeRank is what a route is ordered by
+type routeRank struct {
+	index       int // into cfg.Routes
+	priority    int
+	specificity int
+}
+
+// beats reports whether r ranks above o
+func (r routeRank) beats(o routeRank) bool {
+	if r.priority != o.priority {
+		return r.priority > o.priority
+	}
+	if r.specificity != o.specificity {
+		return r.specificity > o.specificity
+	}
+	return r.index < o.index
+}
+
+// routeTable is matchRoute's index over the config routes
+type routeTable struct {
+	exact    map[string]routeRank // by method
+	prefixes map[string]routeRank // by the pattern less its "*"
+	lengths  []int                // distinct keys of prefixes by length, longest first
+	ordered  []int                // every route, best rank first
+}
+
+// rankRoute is route i's rank
+func rankRoute(i int, route *RouteConfig) routeRank {
+	r := routeRank{index: i, priority: route.Priority, specificity: math.MaxInt}
+	if strings.HasSuffix(route.Match, "/*") {
+		r.specificity = len(route.Match) - 1
+	}
+	return r
+}
+
+// newRouteTable indexes routes, keeping the best ranked of those sharing a
+// pattern
+func newRouteTable(routes []RouteConfig) *routeTable {
+	t := &routeTable{exact: map[string]routeRank{}, prefixes: map[string]routeRank{}}
+	ranks := make([]routeRank, len(routes))
+	lengths := map[int]bool{}
+	for i := range routes {
+		r := rankRoute(i, &routes[i])
+		ranks[i] = r
+		m, key := t.exact, routes[i].Match
+		if r.specificity != math.MaxInt {
+			// "/a.B/*" covers methods starting "/a.B/", as matches does
+			m, key = t.prefixes, strings.TrimSuffix(key, "*")
+			lengths[len(key)] = true
+		}
+		if cur, ok := m[key]; !ok || r.beats(cur) {
+			m[key] = r
+		}
+		t.ordered = append(t.ordered, i)
+	}
+	for l := range lengths {
+		t.lengths = append(t.lengths, l)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(t.lengths)))
+	sort.SliceStable(t.ordered, func(a, b int) bool { return ranks[t.ordered[a]].beats(ranks[t.ordered[b]]) })
+	return t
+}
+
+// lookup returns the index of the best route covering method among those
+// keep accepts, or -1. keep sees one route per pattern, the best ranked.
+func (t *routeTable) lookup(routes []RouteConfig, method string, keep func(*RouteConfig) bool) int {
+	best, found := routeRank{}, false
+	consider := func(r routeRank, ok bool) {
+		if ok && (keep == nil || keep(&routes[r.index])) && (!found || r.beats(best)) {
+			best, found = r, true
+		}
+	}
+	r, ok := t.exact[method]
+	consider(r, ok)
+	for _, l := range t.lengths {
+		if l > len(method) {
+			continue
+		}
+		r, ok := t.prefixes[method[:l]]
+		consider(r, ok)
+	}
+	if !found {
+		return -1
+	}
+	return best.index
+}
+
+// orderedRoutes lists the config routes best ranked first
+func (px *Proxy) orderedRoutes() []RouteConfig {
+	out := make([]RouteConfig, 0, len(px.routes.ordered))
+	for _, i := range px.routes.ordered {
+		out = append(out, px.cfg.Routes[i])
+	}
+	return out
+}
+
+// MatchRoute returns the route calls to method take, as the proxy resolves
+// it for each call: the MatchRoute hook, the built-in pass-thru, then the
+// config routes by precedence, falling back to a pass-thru route named
+// default-pass-thru
+func (px *Proxy) MatchRoute(method string) RouteConfig {
+	return *px.matchRoute(method)
+}
+
+// loadRouteTable indexes the config routes for matchRoute, warning about
+// routes that share a pattern, all but the best ranked of which never match
+func (px *Proxy) loadRouteTable(diag *Diagnostics) {
+	px.routes = newRouteTable(px.cfg.Routes)
+	for i, route := range px.cfg.Routes {
+		m, key := px.routes.exact, route.Match
+		if strings.HasSuffix(key, "/*") {
+			m, key = px.routes.prefixes, strings.TrimSuffix(key, "*")
+		}
+		if best := m[key].index; best != i {
+			diag.Warnf("routes", "ROUTE_UNREACHABLE", fmt.Sprintf("routes[%d].match", i), "never matches: routes[%d] (%s) has the same match and ranks higher", best, px.cfg.Routes[best].Name)
+		}
+	}
+}
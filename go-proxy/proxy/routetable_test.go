@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// TestSharedMatchKeepsRouteState checks that of two routes with the same
+// match, the one that wins by priority runs with its own settings, not with
+// those of the route earlier in the file
+func TestSharedMatchKeepsRouteState(t *testing.T) {
+	const method = "/echo.SecureService/SecureEcho"
+	public := false
+	sum := sha256.Sum256([]byte("token"))
+	px := newTestProxy(t, []RouteConfig{
+		{
+			Name: "public", Match: method, Mode: "pass-thru",
+			Security: &RouteSecurityConfig{RequireToken: &public},
+			Limits:   LimitsConfig{RequestsPerSecond: 1},
+		},
+		{Name: "guarded", Match: method, Mode: "pass-thru", Priority: 1},
+	}, func(cfg *Config) {
+		cfg.Security.RequireMetadataToken = &MetadataTokenConfig{Key: "x-api-key", SHA256: []string{hex.EncodeToString(sum[:])}}
+	})
+
+	route := px.configuredRoute(method)
+	if route.Name != "guarded" {
+		t.Fatalf("%s takes %s, want guarded", method, route.Name)
+	}
+	if r := px.perimeterFor(route).check(context.Background()); r == nil || r.reason != reasonTokenMissing {
+		t.Errorf("guarded takes public's token exemption: %+v", r)
+	}
+	if l := px.limiterFor(route); l != nil {
+		t.Errorf("guarded takes public's limits")
+	}
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// --- Rust FFI Errors ---
+//
+// Every rust-crypto entry point returns a status code and, when it fails, a
+// message the library allocated, which crypto.go copies into a RustError and
+// hands back to the library to free. A panic inside the library is caught at
+// the boundary (catch_unwind) and returned as the panic code, so a malformed
+// key or a library bug costs one operation, never the process. The failure
+// then meets the route's usual policy: a payload that cannot be signed fails
+// its call with SIGNING_FAILED, and a key that cannot check a signature
+// counts as not verifying it. Each failure is logged with its reason and
+// counted in proxy_crypto_engine_errors_total by engine, op and code.
+
+// RustError is a failure the Rust engine reported
+type RustError struct {
+	Op      string // sign or verify
+	Code    string // null_argument, key_encoding, key_parse, sign_failed, panic or not_linked
+	Message string // the library's own description
+}
+
+func (e *RustError) Error() string {
+	return fmt.Sprintf("rust engine %s failed (%s): %s", e.Op, e.Code, e.Message)
+}
+
+// reportRustError logs and counts err when the Rust engine reported it
+func reportRustError(err error) {
+	var re *RustError
+	if !errors.As(err, &re) {
+		return
+	}
+	metrics.Inc("proxy_crypto_engine_errors_total", Labels{"engine": engineRust, "op": re.Op, "code": re.Code})
+	log.Printf("[Rust FFI Error] %v", re)
+}
@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/builder"
+)
+
+// --- Combined Schema ---
+//
+// schema.method both (or -schema both) loads the pb_path descriptor set and
+// reflects the backend, and reconciles the two:
+//
+//	pb          the source of truth for message types: envelopes and inner
+//	            payloads always resolve against its definitions
+//	reflection  the source of truth for which methods the backend serves
+//
+// A method the backend serves that the pb lacks is reported
+// (SCHEMA_RECONCILE) and still proxied, with the pb's message types when the
+// pb defines them and the backend's otherwise. Methods only the pb has are
+// kept: during a deploy the backend's reflection lags the schema registry,
+// and the pb is the newer view. A message both define differently is
+// reported (SCHEMA_CONFLICT) with the field numbers that differ, and the pb
+// definition is used.
+//
+// If no backend answers at startup the pb serves alone, and reflection is
+// retried in the background as in reflect mode and reconciled when it
+// succeeds; readiness is not held back, since every pb method already has its
+// descriptor. With schema.required an unreachable backend fails startup.
+
+// pbSchema is the pb half of a combined schema
+type pbSchema struct {
+	methods map[string]*desc.MethodDescriptor
+	types   map[string]*desc.MessageDescriptor // by fully-qualified name
+}
+
+// lookupMessageSuffix mirrors findDescByType over the pb's message types
+func (s *pbSchema) lookupMessageSuffix(suffix string) *desc.MessageDescriptor {
+	if s == nil {
+		return nil
+	}
+	if md, ok := s.types[suffix]; ok {
+		return md
+	}
+	for name, md := range s.types {
+		if typeNameMatches(name, suffix) {
+			return md
+		}
+	}
+	return nil
+}
+
+// loadBothSchema loads the pb, then reconciles it with the backend's
+// reflection or, when no backend answers, serves the pb until one does
+func (px *Proxy) loadBothSchema(diag *Diagnostics) {
+	files := loadPBFiles(px.cfg.Schema.PBPath, diag)
+	if files == nil {
+		return
+	}
+	px.pbSchema = &pbSchema{methods: methodsOf(files), types: make(map[string]*desc.MessageDescriptor)}
+	for _, fd := range files {
+		collectMessages(px.pbSchema.types, fd.GetMessageTypes())
+	}
+	log.Printf("Loaded %d methods from %s file", len(px.pbSchema.methods), px.cfg.Schema.PBPath)
+	px.setDescriptors(px.pbSchema.methods)
+
+	attempt := &Diagnostics{}
+	reflected := px.loadFromAnyBackend(attempt)
+	if reflected != nil && !attempt.HasErrors() {
+		px.setDescriptors(px.reconcileSchema(reflected, diag))
+		return
+	}
+	if px.backends == nil {
+		return // the backend config is already reported
+	}
+	if px.cfg.Schema.Required {
+		diag.Items = append(diag.Items, attempt.Items...)
+		if !attempt.HasErrors() {
+			diag.Errorf("schema", "SCHEMA_REFLECT_DIAL", "backend.address", "no backend endpoint to reflect from")
+		}
+		return
+	}
+	diag.Warnf("schema", "SCHEMA_DEFERRED", "schema.method", "reflection failed (%s); serving the pb descriptors alone and reconciling once reflection succeeds", reflectFailure(attempt))
+	go px.retryReflection(px.stop)
+}
+
+// reconcileLater reconciles reflection that arrived after startup, logging
+// what startup would have reported
+func (px *Proxy) reconcileLater(reflected map[string]*desc.MethodDescriptor) map[string]*desc.MethodDescriptor {
+	diag := &Diagnostics{}
+	res := px.reconcileSchema(reflected, diag)
+	for _, item := range diag.Items {
+		log.Printf("[Schema] %s: %s", item.Code, item.Message)
+	}
+	return res
+}
+
+// reconcileSchema merges the backend's methods into the pb's and reports
+// what the two disagree on
+func (px *Proxy) reconcileSchema(reflected map[string]*desc.MethodDescriptor, diag *Diagnostics) map[string]*desc.MethodDescriptor {
+	pb := px.pbSchema
+	res := make(map[string]*desc.MethodDescriptor, len(pb.methods)+len(reflected))
+	for name, md := range pb.methods {
+		res[name] = md
+	}
+
+	reflectedTypes := make(map[string]*desc.MessageDescriptor)
+	seen := make(map[string]bool)
+	var missing []string
+	for name, md := range reflected {
+		collectFileMessages(reflectedTypes, md.GetFile(), seen)
+		if _, ok := pb.methods[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		md, rebound := pb.rebind(reflected[name])
+		res[name] = md
+		types := "the pb's message types"
+		if !rebound {
+			types = "the backend's message types, which the pb does not define"
+		}
+		diag.Warnf("schema", "SCHEMA_RECONCILE", "schema.pb_path", "%s is served by the backend but missing from the pb; proxying it with %s", name, types)
+	}
+
+	names := make([]string, 0, len(reflectedTypes))
+	for name := range reflectedTypes {
+		if _, ok := pb.types[name]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if diff := fieldConflicts(pb.types[name], reflectedTypes[name]); len(diff) > 0 {
+			diag.Warnf("schema", "SCHEMA_CONFLICT", "schema.pb_path", "message %s differs between the pb and reflection at field numbers %s; using the pb definition", name, strings.Join(diff, ", "))
+		}
+	}
+	log.Printf("[Schema] Reconciled %d pb methods with %d reflected: %d only reflected", len(pb.methods), len(reflected), len(missing))
+	return res
+}
+
+// rebind returns md with its request and response types replaced by the
+// pb's definitions of the same names, and whether it could be
+func (s *pbSchema) rebind(md *desc.MethodDescriptor) (*desc.MethodDescriptor, bool) {
+	in := s.types[md.GetInputType().GetFullyQualifiedName()]
+	out := s.types[md.GetOutputType().GetFullyQualifiedName()]
+	if in == nil || out == nil {
+		return md, false
+	}
+	svc := md.GetService()
+	method := builder.NewMethod(md.GetName(),
+		builder.RpcTypeImportedMessage(in, md.IsClientStreaming()),
+		builder.RpcTypeImportedMessage(out, md.IsServerStreaming()))
+	file := builder.NewFile("").
+		SetPackageName(svc.GetFile().GetPackage()).
+		AddService(builder.NewService(svc.GetName()).AddMethod(method))
+	fd, err := file.Build()
+	if err != nil {
+		log.Printf("[Schema] Could not bind %s to the pb's types: %v", md.GetFullyQualifiedName(), err)
+		return md, false
+	}
+	return fd.FindService(svc.GetFullyQualifiedName()).FindMethodByName(md.GetName()), true
+}
+
+// collectMessages indexes msgs and their nested messages by name
+func collectMessages(into map[string]*desc.MessageDescriptor, msgs []*desc.MessageDescriptor) {
+	for _, md := range msgs {
+		into[md.GetFullyQualifiedName()] = md
+		collectMessages(into, md.GetNestedMessageTypes())
+	}
+}
+
+// collectFileMessages indexes the messages of fd and of every file it imports
+func collectFileMessages(into map[string]*desc.MessageDescriptor, fd *desc.FileDescriptor, seen map[string]bool) {
+	if fd == nil || seen[fd.GetName()] {
+		return
+	}
+	seen[fd.GetName()] = true
+	collectMessages(into, fd.GetMessageTypes())
+	for _, dep := range fd.GetDependencies() {
+		collectFileMessages(into, dep, seen)
+	}
+}
+
+// fieldConflicts lists the field numbers at which two definitions of a
+// message disagree: present in one only, or differing in name, type,
+// cardinality or the message or enum they refer to
+func fieldConflicts(a, b *desc.MessageDescriptor) []string {
+	numbers := make(map[int32]bool)
+	for _, fd := range a.GetFields() {
+		numbers[fd.GetNumber()] = true
+	}
+	for _, fd := range b.GetFields() {
+		numbers[fd.GetNumber()] = true
+	}
+	var diff []int
+	for n := range numbers {
+		fa, fb := a.FindFieldByNumber(n), b.FindFieldByNumber(n)
+		if fa == nil || fb == nil || fa.GetName() != fb.GetName() || fa.GetType() != fb.GetType() ||
+			fa.GetLabel() != fb.GetLabel() || fieldTypeName(fa) != fieldTypeName(fb) {
+			diff = append(diff, int(n))
+		}
+	}
+	sort.Ints(diff)
+	out := make([]string, len(diff))
+	for i, n := range diff {
+		out[i] = fmt.Sprint(n)
+	}
+	return out
+}
+
+// fieldTypeName is the message or enum a field refers to, or ""
+func fieldTypeName(fd *desc.FieldDescriptor) string {
+	if mt := fd.GetMessageType(); mt != nil {
+		return mt.GetFullyQualifiedName()
+	}
+	if et := fd.GetEnumType(); et != nil {
+		return et.GetFullyQualifiedName()
+	}
+	return ""
+}
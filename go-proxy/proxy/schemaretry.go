@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// --- Deferred Reflection ---
+//
+// In reflect mode the descriptors come from the backend, which may not be up
+// when the proxy starts. Unless schema.required is set, failing to reflect is
+// only a warning: the proxy serves right away and retries reflection in the
+// background, backing off from 1s to 30s between attempts. Until descriptors
+// arrive no method has one, so each message is handled by its route's
+// on_decode_failure (see decodefailure.go): inspect-outer routes forward as
+// pass-thru while inspect-verify-sign and encrypt-payload routes reject, and
+// the admin /readyz answers 503 so orchestration can hold traffic back.
+//
+// Reflection asks for grpc.reflection.v1 first and falls back to v1alpha, so
+// backends serving only one of them both work. Each attempt is bounded by
+// schema.reflect_timeout (default 10s), so a backend that accepts the
+// connection but never answers cannot hold up startup, and an attempt failing
+// with UNAVAILABLE or DEADLINE_EXCEEDED, as while a backend is starting, is
+// made up to schema.reflect_attempts times (default 3, 100ms apart and
+// doubling) before the endpoint counts as failed.
+
+const (
+	schemaRetryMin = time.Second
+	schemaRetryMax = 30 * time.Second
+
+	defaultReflectTimeout  = 10 * time.Second
+	defaultReflectAttempts = 3
+	reflectBackoffMin      = 100 * time.Millisecond
+)
+
+// reflectionServices are the services reflection lists about itself
+var reflectionServices = map[string]bool{
+	"grpc.reflection.v1.ServerReflection":      true,
+	"grpc.reflection.v1alpha.ServerReflection": true,
+}
+
+// loadReflectLimits checks schema.reflect_timeout and reflect_attempts
+func (px *Proxy) loadReflectLimits(diag *Diagnostics) {
+	cfg := px.cfg.Schema
+	if cfg.ReflectTimeout != "" {
+		d, err := time.ParseDuration(cfg.ReflectTimeout)
+		if err != nil || d <= 0 {
+			diag.Errorf("schema", "SCHEMA_REFLECT_LIMITS", "schema.reflect_timeout", "invalid duration %q", cfg.ReflectTimeout)
+		} else {
+			px.reflectTimeout = d
+		}
+	}
+	if cfg.ReflectAttempts < 0 {
+		diag.Errorf("schema", "SCHEMA_REFLECT_LIMITS", "schema.reflect_attempts", "must not be negative, got %d", cfg.ReflectAttempts)
+	} else {
+		px.reflectAttempts = cfg.ReflectAttempts
+	}
+}
+
+// reflectLimits is the timeout of each reflection attempt and how many to make
+func (px *Proxy) reflectLimits() (time.Duration, int) {
+	timeout, attempts := px.reflectTimeout, px.reflectAttempts
+	if timeout == 0 {
+		timeout = defaultReflectTimeout
+	}
+	if attempts == 0 {
+		attempts = defaultReflectAttempts
+	}
+	return timeout, attempts
+}
+
+// transientReflectError reports a failure another attempt may not meet
+func transientReflectError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// eagerDescriptors is the loaded method map; nil before reflection succeeds
+func (px *Proxy) eagerDescriptors() map[string]*desc.MethodDescriptor {
+	if m := px.methodDescriptors.Load(); m != nil {
+		return *m
+	}
+	return nil
+}
+
+func (px *Proxy) setDescriptors(m map[string]*desc.MethodDescriptor) {
+	px.methodDescriptors.Store(&m)
+}
+
+// loadReflectedSchema reflects the schema from the backend, or defers it to
+// the background when no backend answers and the schema is not required
+func (px *Proxy) loadReflectedSchema(diag *Diagnostics) {
+	attempt := &Diagnostics{}
+	res := px.loadFromAnyBackend(attempt)
+	if res != nil && !attempt.HasErrors() {
+		px.setDescriptors(res)
+		metrics.Set("proxy_schema_ready", nil, 1)
+		return
+	}
+	if px.backends == nil {
+		return // the backend config is already reported
+	}
+	if px.cfg.Schema.Required {
+		diag.Items = append(diag.Items, attempt.Items...)
+		if !attempt.HasErrors() {
+			diag.Errorf("schema", "SCHEMA_REFLECT_DIAL", "backend.address", "no backend endpoint to reflect from")
+		}
+		return
+	}
+	diag.Warnf("schema", "SCHEMA_DEFERRED", "schema.method", "reflection failed (%s); serving without descriptors and retrying in the background", reflectFailure(attempt))
+	px.schemaPending.Store(true)
+	metrics.Set("proxy_schema_ready", nil, 0)
+	go px.retryReflection(px.stop)
+}
+
+// retryReflection reflects with backoff until it succeeds or stop is closed
+func (px *Proxy) retryReflection(stop <-chan struct{}) {
+	wait := schemaRetryMin
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-time.After(wait):
+		case <-stop:
+			return
+		}
+		diag := &Diagnostics{}
+		res := px.loadFromAnyBackend(diag)
+		if res != nil && !diag.HasErrors() {
+			if px.pbSchema != nil {
+				res = px.reconcileLater(res)
+			}
+			px.setDescriptors(res)
+			px.schemaPending.Store(false)
+			metrics.Set("proxy_schema_ready", nil, 1)
+			log.Printf("[Schema] Reflection succeeded after %d retries; inspecting routes are active", attempt)
+			return
+		}
+		wait = min(wait*2, schemaRetryMax)
+		log.Printf("[Schema] Reflection retry %d failed (%s); next in %s", attempt, reflectFailure(diag), wait)
+	}
+}
+
+// reflectFailure is the first error of a failed reflection attempt
+func reflectFailure(diag *Diagnostics) string {
+	for _, item := range diag.Items {
+		if item.Severity == SeverityError {
+			return item.Message
+		}
+	}
+	return "no backend endpoint"
+}
+
+// readiness says why the proxy should not be sent traffic yet, or is nil
+func (px *Proxy) readiness() error {
+	if px.preflightPending.Load() {
+		return errors.New("preflight: not passed yet")
+	}
+	if px.schemaPending.Load() {
+		return errors.New("schema: reflection pending; inspecting routes apply on_decode_failure")
+	}
+	if px.backends != nil && len(px.backends.addresses()) == 0 {
+		return errors.New("backend: no endpoints resolved")
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// --- Secret Providers ---
+//
+// Every cms entry naming key material (client_trust_store, proxy_private_key,
+// backend_trust_store, payload_key, backend_encryption_cert, keys,
+// trust_stores and the trust_store of trust_domains), and
+// identity.upstream_trust_store, is a secret URI:
+//
+//	/etc/proxy/key.pem      a file, as before; file:///etc/proxy/key.pem too
+//	env://PROXY_KEY         an environment variable holding the secret's
+//	                        bytes base64-encoded, e.g. base64 of the PEM
+//	vault://secret/data/proxy-key#private_key
+//	                        a field of a HashiCorp Vault secret, read at that
+//	                        API path (KV version 2 paths include data/); see
+//	                        vault.go for cms.vault
+//
+// Secrets that can change are checked every cms.secret_refresh (default 30s,
+// "off" to never): a file when its modification time or size has changed, a
+// Vault secret every time. One whose bytes changed is parsed again and, for
+// signing keys and trust stores (proxy_private_key, keys, client_trust_store,
+// trust_stores, backend_trust_store and trust domains), swapped in without a
+// restart. Key material is swapped whole, and every signature or
+// verification loads it once, so none ever sees a half-loaded key: a call
+// signing while a key rotates signs with the old key or the new. Material
+// that fails to read or parse is logged and the current material kept.
+// payload_key, backend_encryption_cert and identity.upstream_trust_store are
+// read once, at startup. Each reload is counted in proxy_secret_reloads_total
+// by entry (the config path) and result (ok, failed).
+
+// SecretProvider reads one secret
+type SecretProvider interface {
+	// Read returns the secret's bytes
+	Read(ctx context.Context) ([]byte, error)
+	// Changed reports whether the secret may differ from what Read last
+	// returned; a provider that cannot tell cheaply reports true
+	Changed(ctx context.Context) (bool, error)
+}
+
+const (
+	defaultSecretRefresh = 30 * time.Second
+	secretReadTimeout    = 30 * time.Second
+)
+
+// fileSecret is a file, read again when its modification time or size change
+type fileSecret struct {
+	path string
+	mod  time.Time
+	size int64
+}
+
+func (s *fileSecret) Read(ctx context.Context) ([]byte, error) {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	s.mod, s.size = fi.ModTime(), fi.Size()
+	return b, nil
+}
+
+func (s *fileSecret) Changed(ctx context.Context) (bool, error) {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return false, err
+	}
+	return !fi.ModTime().Equal(s.mod) || fi.Size() != s.size, nil
+}
+
+// envSecret is an environment variable holding base64, read once
+type envSecret struct{ name string }
+
+func (s envSecret) Read(ctx context.Context) ([]byte, error) {
+	v, ok := os.LookupEnv(s.name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", s.name)
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+	if err != nil {
+		return nil, fmt.Errorf("environment variable %s does not hold base64: %v", s.name, err)
+	}
+	return b, nil
+}
+
+func (envSecret) Changed(ctx context.Context) (bool, error) { return false, nil }
+
+// secretProvider parses a secret URI
+func (px *Proxy) secretProvider(uri string) (SecretProvider, error) {
+	scheme, rest, ok := strings.Cut(uri, "://")
+	if !ok {
+		return &fileSecret{path: uri}, nil
+	}
+	switch scheme {
+	case "file":
+		return &fileSecret{path: rest}, nil
+	case "env":
+		if rest == "" {
+			return nil, fmt.Errorf("%s names no environment variable", uri)
+		}
+		return envSecret{name: rest}, nil
+	case "vault":
+		path, field, _ := strings.Cut(rest, "#")
+		if path == "" || field == "" {
+			return nil, fmt.Errorf("%s: a Vault secret is vault://<path>#<field>", uri)
+		}
+		c, err := px.vaultClient()
+		if err != nil {
+			return nil, err
+		}
+		return &vaultSecret{client: c, path: path, field: field}, nil
+	}
+	return nil, fmt.Errorf("%s: unknown secret scheme %q (expected file, env or vault)", uri, scheme)
+}
+
+// readSecret reads the secret at uri, returning its provider for watchSecret
+func (px *Proxy) readSecret(uri string) ([]byte, SecretProvider, error) {
+	p, err := px.secretProvider(uri)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secretReadTimeout)
+	defer cancel()
+	b, err := p.Read(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, p, nil
+}
+
+// secretWatch is a secret to check every cms.secret_refresh
+type secretWatch struct {
+	entry    string // config path, e.g. cms.proxy_private_key
+	provider SecretProvider
+	sum      [sha256.Size]byte // of the bytes in use
+	apply    func([]byte) error
+}
+
+// watchSecret has apply parse and swap in the secret p reads whenever its
+// bytes differ from b, the ones in use
+func (px *Proxy) watchSecret(entry string, p SecretProvider, b []byte, apply func([]byte) error) {
+	if _, fixed := p.(envSecret); fixed {
+		return
+	}
+	px.secretWatches = append(px.secretWatches, &secretWatch{entry: entry, provider: p, sum: sha256.Sum256(b), apply: apply})
+}
+
+// reparseError is the first error parsing a reloaded secret reported
+func reparseError(d *Diagnostics) error {
+	for _, item := range d.Items {
+		if item.Severity == SeverityError {
+			return errors.New(item.Message)
+		}
+	}
+	return errors.New("could not parse the secret")
+}
+
+func (w *secretWatch) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), secretReadTimeout)
+	defer cancel()
+	changed, err := w.provider.Changed(ctx)
+	if err == nil && !changed {
+		return
+	}
+	var b []byte
+	if err == nil {
+		b, err = w.provider.Read(ctx)
+	}
+	if err == nil {
+		sum := sha256.Sum256(b)
+		if sum == w.sum {
+			return
+		}
+		if err = w.apply(b); err == nil {
+			w.sum = sum
+		}
+	}
+	result := "ok"
+	if err != nil {
+		result = "failed"
+		log.Printf("[Secrets] %s: could not reload, keeping the current material: %v", w.entry, err)
+	} else {
+		log.Printf("[Secrets] %s: reloaded", w.entry)
+	}
+	metrics.Inc("proxy_secret_reloads_total", Labels{"entry": w.entry, "result": result})
+}
+
+// loadSecretRefresh starts checking the secrets that can change
+func (px *Proxy) loadSecretRefresh(diag *Diagnostics) {
+	every := defaultSecretRefresh
+	switch raw := px.cfg.CMS.SecretRefresh; raw {
+	case "":
+	case "off":
+		every = 0
+	default:
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			diag.Errorf("cms", "CMS_SECRET_REFRESH", "cms.secret_refresh", "invalid duration %q (or off)", raw)
+			return
+		}
+		every = d
+	}
+	if every == 0 || len(px.secretWatches) == 0 {
+		return
+	}
+	watches := px.secretWatches
+	go func() {
+		t := time.NewTicker(every)
+		defer t.Stop()
+		for {
+			select {
+			case <-px.stop:
+				return
+			case <-t.C:
+				for _, w := range watches {
+					w.refresh()
+				}
+			}
+		}
+	}()
+	log.Printf("[Secrets] Checking %d secret(s) for changes every %s", len(watches), every)
+}
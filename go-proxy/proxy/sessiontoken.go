@@ -0,0 +1,321 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/anthony/grpc-proxy/go-proxy/sessiontoken"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// --- Session Tokens ---
+//
+// An inspect-verify-sign route verifies and signs every message, which a
+// long stream pays for message by message. A session-token route checks the
+// stream once instead: it holds the backend call until the client's first
+// message arrives, verifies that message's client signature with the route's
+// request verify verb, and opens the call with a token in the
+// x-proxy-attestation header. Every message, the first included, then goes
+// through untouched, as on a pass-thru route.
+//
+// The token is a JWT signed with the route's request sign key (proxy_key by
+// default) on the route's engine; the sessiontoken package mints it and is
+// what a backend imports to check it. Besides the issuer and the times it
+// carries the claims the route lists, by default method, identity (the
+// client identity, as sub) and payload_hash (the SHA-256 of the first
+// message's payload field). session_token sets them:
+//
+//	session_token:
+//	  ttl: 1m                                   # default 1m
+//	  header: x-proxy-attestation               # default
+//	  claims: [method, identity, payload_hash]  # and route, tenant
+//
+// A stream whose first message is missing, does not decode or does not verify
+// is rejected with UNAUTHENTICATED (INVALID_ARGUMENT when it does not decode)
+// and the backend is never dialled. Each outcome is counted in
+// proxy_session_tokens_total by route and result: minted, rejected or
+// failed (the proxy could not sign). Since the proxy edits nothing, a
+// session-token route cannot have mutations, processors, identity binding,
+// metadata copies into the envelope or inner payload rules, and cannot be a
+// shadow route.
+
+// SessionTokenConfig is how a session-token route mints its tokens
+type SessionTokenConfig struct {
+	TTL    string   `yaml:"ttl"`    // default 1m
+	Header string   `yaml:"header"` // default x-proxy-attestation
+	Claims []string `yaml:"claims"` // method, identity, payload_hash, route, tenant
+}
+
+// Session token claims a route may list
+const (
+	claimMethod      = "method"
+	claimIdentity    = "identity"
+	claimPayloadHash = "payload_hash"
+	claimRoute       = "route"
+	claimTenant      = "tenant"
+)
+
+const defaultSessionTTL = time.Minute
+
+var (
+	sessionClaims        = []string{claimMethod, claimIdentity, claimPayloadHash, claimRoute, claimTenant}
+	defaultSessionClaims = []string{claimMethod, claimIdentity, claimPayloadHash}
+)
+
+// sessionTokens is a route's session_token, parsed
+type sessionTokens struct {
+	ttl    time.Duration
+	header string
+	claims map[string]bool
+}
+
+// openSession verifies the first message of a call on a session-token route.
+// It returns the context to open the backend call with, which carries the
+// token, and the client stream with the first message put back in front.
+func (px *Proxy) openSession(ctx context.Context, method string, route *RouteConfig, src grpc.ServerStream) (context.Context, grpc.ServerStream, error) {
+	st := px.routeSessions[route.Name]
+	var first []byte
+	if err := src.RecvMsg(&first); err != nil {
+		if err == io.EOF {
+			metrics.Inc("proxy_session_tokens_total", Labels{"route": route.Name, "result": "rejected"})
+			return nil, nil, rejectf(codes.Unauthenticated, reasonSignatureMissing, "proxy: the stream ended before its first message")
+		}
+		return nil, nil, err
+	}
+	release, err := px.cpuClasses[route.CPUClass].acquire(ctx, route)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+	payload, err := px.verifyFirst(ctx, method, route, first)
+	if err != nil {
+		metrics.Inc("proxy_session_tokens_total", Labels{"route": route.Name, "result": "rejected"})
+		px.audit(ctx, method, route, true, auditEvent{op: "reject", decision: status.Code(err).String(), reason: status.Convert(err).Message(), payload: first})
+		return nil, nil, err
+	}
+	token, err := px.mintSession(ctx, method, route, st, payload)
+	if err != nil {
+		if skipped := skipCancelled(ctx, route, true, "sign"); skipped != nil {
+			return nil, nil, skipped
+		}
+		metrics.Inc("proxy_session_tokens_total", Labels{"route": route.Name, "result": "failed"})
+		log.Printf("[Session Token Error] %s: %v", method, err)
+		return nil, nil, rejectf(codes.Internal, reasonSigningFailed, "proxy: could not mint the session token")
+	}
+	metrics.Inc("proxy_session_tokens_total", Labels{"route": route.Name, "result": "minted"})
+	return metadata.AppendToOutgoingContext(ctx, st.header, token), &replayFirstStream{ServerStream: src, first: first}, nil
+}
+
+// verifyFirst decodes the first request and checks its client signature,
+// returning its payload field
+func (px *Proxy) verifyFirst(ctx context.Context, method string, route *RouteConfig, wire []byte) ([]byte, error) {
+	md, ok := px.lookupMethod(method)
+	if !ok {
+		return px.decodeFailed(route, method, true, decodeNoDescriptor, wire, fmt.Errorf("no descriptor loaded for %s", method))
+	}
+	msgDesc := md.GetInputType()
+	if err := px.guardDecode(route, method, "envelope", msgDesc, wire); err != nil {
+		return nil, err
+	}
+	msg := dynamic.NewMessage(msgDesc)
+	if err := msg.Unmarshal(wire); err != nil {
+		return px.decodeFailed(route, method, true, decodeUnmarshalError, wire, fmt.Errorf("request envelope does not decode: %v", err))
+	}
+	variant, err := px.envelopeVariant(ctx, route, msg, true)
+	if err != nil {
+		return nil, err
+	}
+	if variant == nil {
+		return nil, rejectf(codes.Unauthenticated, reasonSignatureMissing, "proxy: cannot verify an envelope of unknown version")
+	}
+	env := px.envelopeFor(variant, method, true, msgDesc)
+	if field := px.missingEnvelopeField(variant, env, true); field != "" {
+		return px.decodeFailed(variant, method, true, decodeMissingField, wire, fmt.Errorf("%s has no %s", msgDesc.GetFullyQualifiedName(), field))
+	}
+	payload := getBytesField(msg, env.payload)
+	sig := env.clientSigOf(ctx, msg, true)
+
+	plan := px.cryptoPlanFor(route).request
+	verified := auditEvent{op: "verify", signer: "client", decision: "missing", payload: payload, clientSig: sig}
+	e, digest := px.engineFor(route), payloadDigest(sha256.Sum256(payload))
+	switch anchor := px.clientTrustFor(ctx, route); {
+	case plan.verifies():
+		if verified, err = px.verifyTrusted(ctx, route, plan.trust, "Request", payload, digest, sig); err != nil {
+			return nil, skipCancelled(ctx, route, true, "verify")
+		}
+	case sig != nil && anchor != nil:
+		verified.keyID = anchor.keyID()
+		key, result, err := e.verifyClient(ctx, anchor, digest, sig)
+		if err != nil {
+			return nil, skipCancelled(ctx, route, true, "verify")
+		}
+		countCrypto(e, "verify")
+		verified.decision = result
+		if key != "" {
+			verified.keyID = key
+		}
+	case sig != nil:
+		verified.decision = "unconfigured"
+	}
+	metrics.Inc("proxy_signature_verifications_total", Labels{"signer": "client", "result": verified.decision, "tenant": tenantFromContext(ctx), "shadow": shadowLabel(route)})
+	if err := px.audit(ctx, method, route, true, verified); err != nil {
+		return nil, err
+	}
+	switch verified.decision {
+	case "ok":
+		log.Printf("[Session Token] %s: first message verified against %s", method, plan.verify)
+		return payload, nil
+	case "missing":
+		return nil, rejectf(codes.Unauthenticated, reasonSignatureMissing, "proxy: the first message carries no client signature")
+	}
+	return nil, rejectf(codes.Unauthenticated, reasonSignatureInvalid, "proxy: the first message's client signature does not verify (%s)", verified.decision)
+}
+
+// mintSession signs a token for a stream whose first message carried payload
+func (px *Proxy) mintSession(ctx context.Context, method string, route *RouteConfig, st *sessionTokens, payload []byte) (string, error) {
+	now := time.Now()
+	c := sessiontoken.Claims{Issuer: sessiontoken.Issuer, IssuedAt: now.Unix(), ExpiresAt: now.Add(st.ttl).Unix()}
+	if st.claims[claimMethod] {
+		c.Method = method
+	}
+	if st.claims[claimIdentity] {
+		c.Subject, _ = ctx.Value(clientIdentityKey{}).(string)
+	}
+	if st.claims[claimPayloadHash] {
+		c.PayloadSHA256 = sessiontoken.PayloadHash(payload)
+	}
+	if st.claims[claimRoute] {
+		c.Route = route.Name
+	}
+	if st.claims[claimTenant] {
+		c.Tenant = tenantFromContext(ctx)
+	}
+	key := px.cryptoPlanFor(route).request.key
+	e := px.engineFor(route)
+	token, err := sessiontoken.Mint(c, key.id(), func(input []byte) ([]byte, error) {
+		return e.sign(ctx, key, sha256.Sum256(input))
+	})
+	countCrypto(e, "sign")
+	if err == nil {
+		px.audit(ctx, method, route, true, auditEvent{op: "sign", signer: "proxy", decision: "signed", payload: payload, keyID: key.id()})
+	}
+	return token, err
+}
+
+// replayFirstStream hands the message openSession read to the first RecvMsg
+type replayFirstStream struct {
+	grpc.ServerStream
+	first []byte
+}
+
+func (s *replayFirstStream) RecvMsg(m interface{}) error {
+	if s.first == nil {
+		return s.ServerStream.RecvMsg(m)
+	}
+	out, ok := m.(*[]byte)
+	if !ok {
+		return fmt.Errorf("proxy: session-token stream received into %T", m)
+	}
+	*out, s.first = s.first, nil
+	return nil
+}
+
+// loadSessionTokens parses each session-token route's session_token and
+// checks the route can verify and mint
+func (px *Proxy) loadSessionTokens(diag *Diagnostics) {
+	for i := range px.cfg.Routes {
+		route := &px.cfg.Routes[i]
+		path := fmt.Sprintf("routes[%d]", i)
+		if route.Mode != "session-token" {
+			if route.SessionToken != nil {
+				diag.Warnf("routes", "ROUTE_SESSION_TOKEN", path+".session_token", "has no effect on %s routes", route.Mode)
+			}
+			continue
+		}
+		st := &sessionTokens{ttl: defaultSessionTTL, header: sessiontoken.DefaultHeader, claims: map[string]bool{}}
+		cfg := route.SessionToken
+		if cfg == nil {
+			cfg = &SessionTokenConfig{}
+		}
+		ok := true
+		if cfg.TTL != "" {
+			d, err := time.ParseDuration(cfg.TTL)
+			if err != nil || d <= 0 {
+				diag.Errorf("routes", "ROUTE_SESSION_TOKEN", path+".session_token.ttl", "invalid ttl %q (expected a positive duration such as 30s)", cfg.TTL)
+				ok = false
+			}
+			st.ttl = d
+		}
+		if cfg.Header != "" {
+			st.header = strings.ToLower(cfg.Header)
+			if strings.HasPrefix(st.header, "grpc-") || strings.HasPrefix(st.header, ":") || strings.HasSuffix(st.header, "-bin") {
+				diag.Errorf("routes", "ROUTE_SESSION_TOKEN", path+".session_token.header", "%q cannot carry the token (reserved, or a binary header)", cfg.Header)
+				ok = false
+			}
+		}
+		claims := cfg.Claims
+		if claims == nil {
+			claims = defaultSessionClaims
+		}
+		for _, c := range claims {
+			if !slices.Contains(sessionClaims, c) {
+				diag.Errorf("routes", "ROUTE_SESSION_TOKEN", path+".session_token.claims", "unknown claim %q (expected one of %s)", c, strings.Join(sessionClaims, ", "))
+				ok = false
+			}
+			st.claims[c] = true
+		}
+
+		plan := px.cryptoPlanFor(route).request
+		switch {
+		case plan.verify == verbNone:
+			diag.Errorf("routes", "ROUTE_SESSION_TOKEN", path+".request.verify", "session-token routes mint a token only for a verified stream; verify cannot be none")
+			ok = false
+		case plan.verify == verbClientTrust && px.engineFor(route).name() == engineGo:
+			diag.Errorf("routes", "ROUTE_SESSION_TOKEN", path+".request.verify", "the go engine does not check client_trust signatures; name a cms.trust_stores entry or use crypto_engine: rust")
+			ok = false
+		}
+		if !plan.signs {
+			diag.Errorf("routes", "ROUTE_SESSION_TOKEN", path+".request.sign", "session-token routes sign the token with the request sign key; sign cannot be none")
+			ok = false
+		}
+		for _, v := range envelopeVariants(route) {
+			if v.Envelope.ClientSigField == "" {
+				diag.Errorf("routes", "ROUTE_SESSION_TOKEN", path+".envelope.client_sig_field", "session-token routes verify the first message's client_sig_field")
+				ok = false
+				break
+			}
+		}
+		for _, refused := range []struct {
+			set  bool
+			name string
+		}{
+			{len(route.Mutations) > 0, "mutations"},
+			{len(route.Processors) > 0, "processors"},
+			{route.BindTransportIdentity, "bind_transport_identity"},
+			{len(route.CopyGRPCMetadataToEnvelope) > 0, "copy_grpc_metadata_to_envelope"},
+			{route.ValidateInner || len(route.AllowedTypes) > 0 || len(route.RequireFields) > 0, "inner payload rules"},
+		} {
+			if refused.set {
+				diag.Errorf("routes", "ROUTE_SESSION_TOKEN", path, "session-token routes forward messages untouched and cannot have %s", refused.name)
+				ok = false
+			}
+		}
+		if route.Shadow {
+			diag.Errorf("routes", "ROUTE_SESSION_TOKEN", path+".shadow", "a session-token route cannot be a shadow route; the token it adds changes the call")
+			ok = false
+		}
+		if _, dup := px.routeSessions[route.Name]; ok && !dup {
+			px.routeSessions[route.Name] = st
+		}
+	}
+}
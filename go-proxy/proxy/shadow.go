@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"bytes"
+	"log"
+
+	"google.golang.org/grpc/status"
+)
+
+// --- Shadow Routes ---
+//
+// A route with shadow: true is a dry run of its mode: every message is
+// decoded, verified, signed, mutated and run through its processors as usual,
+// but the proxy forwards the bytes it received, so clients and backends see a
+// pass-thru route. What the route would have done is logged and counted in
+// proxy_shadow_decisions_total; the signature, validation, crypto and
+// processor metrics it emits carry shadow="true", and its audit records are
+// flagged. Streams are held to the route's limits and timeouts as usual.
+
+func shadowLabel(route *RouteConfig) string {
+	if route != nil && route.Shadow {
+		return "true"
+	}
+	return "false"
+}
+
+// recordShadow logs and counts what a shadow route decided for one message:
+// rejected (with the code), modified, or unchanged
+func (px *Proxy) recordShadow(method string, isReq bool, route *RouteConfig, in, out []byte, err error) {
+	dir := directionOf(isReq)
+	decision, code := "unchanged", "OK"
+	switch {
+	case err != nil:
+		decision, code = "rejected", status.Code(err).String()
+		log.Printf("[Shadow %s] %s would have been rejected: %v", dir.label(), method, err)
+	case !bytes.Equal(in, out):
+		decision = "modified"
+		log.Printf("[Shadow %s] %s would have been modified (%d -> %d bytes)", dir.label(), method, len(in), len(out))
+	}
+	metrics.Inc("proxy_shadow_decisions_total", Labels{"route": route.Name, "direction": dir.String(), "decision": decision, "code": code})
+}
@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// --- Signature Mismatch Debugging ---
+//
+// "signature verification failed" says nothing about what the proxy hashed.
+// A route with debug_signature_mismatch: true reports each client signature
+// (and, on responses, backend signature) that does not verify:
+//
+//	payload    the field it was read from, its length and SHA-256
+//	signed     what the signature covers, in order, with each part's SHA-256;
+//	           the proxy signs and verifies RSA PKCS#1 v1.5 over the SHA-256
+//	           of the payload field's bytes, nothing else
+//	signature  the field or header it was read from, its length and first bytes
+//	keys       the trust store tried, with each key's fingerprint (the id
+//	           audit records use)
+//	wire       the field numbers of the envelope as it arrived, with their
+//	           names and lengths, so a payload the client put under another
+//	           number, or twice, shows up
+//
+// The payload itself is never logged. With signature_debug.dump_dir set it is
+// also written to a new file there, cut to max_dump_bytes (default 64 KiB),
+// until max_dumps files (default 100) have been written; a route with
+// redact_fields never has its payloads dumped, since the bytes cannot be
+// redacted and still match the hash. Reports are at most one per route and
+// direction each signature_debug.interval (default 10s), counting those held
+// back, so a flood of bad signatures cannot flood the log. Everything is off
+// unless a route asks for it.
+
+// SignatureDebugConfig bounds what debug_signature_mismatch routes report
+type SignatureDebugConfig struct {
+	Interval     string `yaml:"interval"`       // one report per route and direction this often; default "10s"
+	DumpDir      string `yaml:"dump_dir"`       // payloads of reported messages are written here; empty writes none
+	MaxDumpBytes int    `yaml:"max_dump_bytes"` // default 64 KiB
+	MaxDumps     int    `yaml:"max_dumps"`      // default 100
+}
+
+const (
+	defaultSigDebugInterval = 10 * time.Second
+	defaultSigDumpBytes     = 64 << 10
+	defaultSigDumps         = 100
+	sigDebugPrefixBytes     = 8 // of the signature, shown in hex
+)
+
+// sigDebugger reports the signature mismatches of debug_signature_mismatch
+// routes
+type sigDebugger struct {
+	log      *sampledLog
+	dumpDir  string
+	maxBytes int
+	dumpsCap int64
+	dumps    atomic.Int64
+}
+
+// sigMismatch is one signature that did not verify
+type sigMismatch struct {
+	info      MethodInfo
+	isReq     bool
+	signer    string // client or backend
+	engine    string
+	payload   []byte
+	digest    payloadDigest
+	sig       []byte
+	sigSource string // the field or header the signature came from
+	store     string // the trust store tried
+	keyPEMs   [][]byte
+}
+
+// sigFieldSource names the field fd, or the header, a signature came from
+func sigFieldSource(env *resolvedEnvelope, header string, isClient bool) string {
+	if isClient && header != "" {
+		return "header " + header
+	}
+	fd := env.backendSig
+	if isClient {
+		fd = env.clientSig
+	}
+	if fd == nil {
+		return "no field"
+	}
+	return fmt.Sprintf("field %s (#%d)", fd.GetName(), fd.GetNumber())
+}
+
+// report logs m if the route asks for it and its interval allows
+func (d *sigDebugger) report(m sigMismatch) {
+	route := m.info.Route
+	if d == nil || !route.DebugSignatureMismatch {
+		return
+	}
+	dir := "response"
+	if m.isReq {
+		dir = "request"
+	}
+	suppressed, ok := d.log.allow(route.Name + " " + dir)
+	if !ok {
+		return
+	}
+	held := ""
+	if suppressed > 0 {
+		held = fmt.Sprintf(" (%d like it suppressed)", suppressed)
+	}
+	env := m.info.envelope
+	payloadField := "no field"
+	if env.payload != nil {
+		payloadField = fmt.Sprintf("field %s (#%d)", env.payload.GetName(), env.payload.GetNumber())
+	}
+	sum := sha256.Sum256(m.payload)
+	keys := make([]string, 0, len(m.keyPEMs))
+	for _, pemKey := range m.keyPEMs {
+		keys = append(keys, pemKeyID(pemKey))
+	}
+	if len(keys) == 0 {
+		keys = append(keys, "none loaded")
+	}
+
+	lines := []string{
+		fmt.Sprintf("route %s, %s %s: the %s signature does not verify on the %s engine%s", route.Name, m.info.Method, dir, m.signer, m.engine, held),
+		fmt.Sprintf("payload: %s, %d bytes, sha256 %x", payloadField, len(m.payload), sum),
+		fmt.Sprintf("signed: RSA PKCS#1 v1.5 over sha256 of 1 part: [1] payload, sha256 %x", m.digest),
+		fmt.Sprintf("signature: %s, %d bytes, begins %x", m.sigSource, len(m.sig), m.sig[:min(len(m.sig), sigDebugPrefixBytes)]),
+		fmt.Sprintf("keys: %s: %s", m.store, strings.Join(keys, ", ")),
+	}
+	if m.info.wire != nil {
+		lines = append(lines, "wire: "+wireFieldSummary(m.info.wire, env))
+	}
+	if dump := d.dump(route, dir, m.payload); dump != "" {
+		lines = append(lines, "dump: "+dump)
+	}
+	for _, line := range lines {
+		log.Printf("[Signature Debug] %s", line)
+	}
+}
+
+// wireFieldSummary lists the top-level fields of an encoded envelope in the
+// order they arrived
+func wireFieldSummary(wire []byte, env *resolvedEnvelope) string {
+	var fields []string
+	for b := wire; len(b) > 0; {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return strings.Join(append(fields, "undecodable from here"), ", ")
+		}
+		m := protowire.ConsumeFieldValue(num, typ, b[n:])
+		if m < 0 {
+			return strings.Join(append(fields, fmt.Sprintf("#%d undecodable", num)), ", ")
+		}
+		name := "unknown"
+		if fd := env.msg.FindFieldByNumber(int32(num)); fd != nil {
+			name = fd.GetName()
+		}
+		fields = append(fields, fmt.Sprintf("#%d %s %d bytes", num, name, m))
+		b = b[n+m:]
+	}
+	if len(fields) == 0 {
+		return "empty"
+	}
+	return strings.Join(fields, ", ")
+}
+
+// dump writes payload to a new file, returning what the report says about it
+func (d *sigDebugger) dump(route *RouteConfig, dir string, payload []byte) string {
+	switch {
+	case d.dumpDir == "":
+		return ""
+	case len(route.RedactFields) > 0:
+		return "skipped, the route redacts fields"
+	case d.dumps.Add(1) > d.dumpsCap:
+		return fmt.Sprintf("skipped, max_dumps %d written", d.dumpsCap)
+	}
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == os.PathSeparator || r == '*' {
+			return '_'
+		}
+		return r
+	}, route.Name)
+	f, err := os.CreateTemp(d.dumpDir, fmt.Sprintf("sigmismatch-%s-%s-*.bin", name, dir))
+	if err != nil {
+		return fmt.Sprintf("failed: %v", err)
+	}
+	defer f.Close()
+	cut := payload[:min(len(payload), d.maxBytes)]
+	if _, err := f.Write(cut); err != nil {
+		return fmt.Sprintf("failed: %v", err)
+	}
+	if len(cut) < len(payload) {
+		return fmt.Sprintf("%s (first %d of %d bytes)", f.Name(), len(cut), len(payload))
+	}
+	return fmt.Sprintf("%s (%d bytes)", f.Name(), len(cut))
+}
+
+// loadSignatureDebug sets up reporting when a route asks for it
+func (px *Proxy) loadSignatureDebug(diag *Diagnostics) {
+	cfg := px.cfg.SignatureDebug
+	var debugged int
+	for i, route := range px.cfg.Routes {
+		if !route.DebugSignatureMismatch {
+			continue
+		}
+		debugged++
+		if route.Mode != "inspect-verify-sign" {
+			diag.Warnf("routes", "ROUTE_SIGNATURE_DEBUG", fmt.Sprintf("routes[%d].debug_signature_mismatch", i), "only inspect-verify-sign routes verify signatures")
+		}
+	}
+	if debugged == 0 {
+		if cfg != (SignatureDebugConfig{}) {
+			diag.Warnf("signature_debug", "SIGNATURE_DEBUG", "signature_debug", "has no effect without a route with debug_signature_mismatch")
+		}
+		return
+	}
+
+	interval := defaultSigDebugInterval
+	if cfg.Interval != "" {
+		d, err := time.ParseDuration(cfg.Interval)
+		if err != nil || d <= 0 {
+			diag.Errorf("signature_debug", "SIGNATURE_DEBUG", "signature_debug.interval", "invalid duration %q", cfg.Interval)
+			return
+		}
+		interval = d
+	}
+	d := &sigDebugger{log: newSampledLog(interval), dumpDir: cfg.DumpDir, maxBytes: defaultSigDumpBytes, dumpsCap: defaultSigDumps}
+	if cfg.MaxDumpBytes < 0 || cfg.MaxDumps < 0 {
+		diag.Errorf("signature_debug", "SIGNATURE_DEBUG", "signature_debug", "max_dump_bytes and max_dumps must not be negative")
+		return
+	}
+	if cfg.MaxDumpBytes > 0 {
+		d.maxBytes = cfg.MaxDumpBytes
+	}
+	if cfg.MaxDumps > 0 {
+		d.dumpsCap = int64(cfg.MaxDumps)
+	}
+	if d.dumpDir != "" {
+		if err := os.MkdirAll(d.dumpDir, 0o700); err != nil {
+			diag.Errorf("signature_debug", "SIGNATURE_DEBUG", "signature_debug.dump_dir", "%v", err)
+			return
+		}
+	}
+	px.sigDebug = d
+	log.Printf("[Signature Debug] Reporting signature mismatches on %d route(s), at most once per %s each", debugged, interval)
+}
@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// --- Proxy Signatures in Metadata ---
+//
+// A backend that cannot add a proxy_signature field to its messages can read
+// the signature from gRPC metadata instead. With envelope.proxy_sig_metadata_key
+// (and no proxy_sig_field) an inspect-verify-sign route signs the payload as
+// usual but sends the signature, base64, under that key rather than writing
+// it into the envelope:
+//
+//	requests   in the backend call's headers
+//	responses  in the trailer the client gets
+//
+// The envelope itself is then forwarded as it arrived, unless the route's
+// mutations, metadata copies, identity binding or processors edit it.
+//
+// Headers go out once, when the backend call opens, so proxy_sig_metadata_mode
+// says which messages the metadata covers:
+//
+//	first        (default) the first message each way: the backend call is
+//	             opened only once the client's first message is signed, and
+//	             the trailer carries the first response's signature
+//	per_message  one value per message, in the order they were forwarded; on
+//	             requests only for methods whose client does not stream,
+//	             since a header cannot follow later messages
+//
+// A stream whose client half-closes before sending anything opens the
+// backend call without the header. Unordered routes, which do not forward in
+// order, envelopes, response caches (a cached response has no trailer) and
+// stream attestation (which signs into proxy_sig_field) cannot be combined
+// with it. Shadow routes send no signatures.
+
+// Values of proxy_sig_metadata_mode
+const (
+	sigMetadataFirst      = "first"
+	sigMetadataPerMessage = "per_message"
+)
+
+// proxySigsKey carries a call's proxySigs from the pumps to the backend call
+// and the client's trailer
+type proxySigsKey struct{}
+
+// proxySigs holds the signatures of one call bound for metadata
+type proxySigs struct {
+	key        string
+	perMessage bool
+	request    bool // requests are signed, so the backend call waits for a signature
+	response   bool
+
+	mu        sync.Mutex
+	req, resp []string
+}
+
+// newProxySigs returns route's holder, or nil when its signatures go in the
+// envelope
+func (px *Proxy) newProxySigs(route *RouteConfig) *proxySigs {
+	key := route.Envelope.ProxySigMetadataKey
+	if key == "" || route.Mode != "inspect-verify-sign" || route.Shadow {
+		return nil
+	}
+	plan := px.cryptoPlanFor(route)
+	return &proxySigs{
+		key:        key,
+		perMessage: route.Envelope.ProxySigMetadataMode == sigMetadataPerMessage,
+		request:    plan.request.signs,
+		response:   plan.response.signs,
+	}
+}
+
+func proxySigsFrom(ctx context.Context) *proxySigs {
+	s, _ := ctx.Value(proxySigsKey{}).(*proxySigs)
+	return s
+}
+
+// add records the signature of a message; only the first each way is kept
+// unless the route sends one per message
+func (s *proxySigs) add(isReq bool, sig []byte) {
+	if s == nil {
+		return // a shadow route
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := &s.resp
+	if isReq {
+		list = &s.req
+	}
+	if len(*list) == 0 || s.perMessage {
+		*list = append(*list, base64.StdEncoding.EncodeToString(sig))
+	}
+}
+
+// outgoing returns ctx with the request signatures added to its headers
+func (s *proxySigs) outgoing(ctx context.Context) context.Context {
+	if s == nil {
+		return ctx
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sig := range s.req {
+		ctx = metadata.AppendToOutgoingContext(ctx, s.key, sig)
+	}
+	return ctx
+}
+
+// setTrailer adds the response signatures to the client's trailer
+func (s *proxySigs) setTrailer(stream grpc.ServerStream) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.resp) > 0 {
+		stream.SetTrailer(metadata.MD{s.key: s.resp})
+	}
+}
+
+// deferredUpstream opens the backend call when the request pump forwards its
+// first message, which by then has been signed, or when the client
+// half-closes without one. Until then the response side waits.
+type deferredUpstream struct {
+	ctx  context.Context
+	open func(ctx context.Context) (*upstream, error)
+	sigs *proxySigs
+
+	once  sync.Once
+	ready chan struct{}
+	up    *upstream
+	err   error
+}
+
+func (px *Proxy) deferUpstream(ctx context.Context, method string, policy *retryPolicy, sigs *proxySigs) *deferredUpstream {
+	return &deferredUpstream{
+		ctx: ctx,
+		open: func(ctx context.Context) (*upstream, error) {
+			return px.openUpstream(ctx, method, policy)
+		},
+		sigs:  sigs,
+		ready: make(chan struct{}),
+	}
+}
+
+func (d *deferredUpstream) connect() error {
+	d.once.Do(func() {
+		d.up, d.err = d.open(d.sigs.outgoing(d.ctx))
+		close(d.ready)
+	})
+	return d.err
+}
+
+// wait blocks until the call is open, or the handler is done with it
+func (d *deferredUpstream) wait() error {
+	select {
+	case <-d.ready:
+		return d.err
+	case <-d.ctx.Done():
+		return d.ctx.Err()
+	}
+}
+
+func (d *deferredUpstream) opened() bool {
+	select {
+	case <-d.ready:
+		return d.err == nil
+	default:
+		return false
+	}
+}
+
+func (d *deferredUpstream) close() {
+	if d.opened() {
+		d.up.close()
+	}
+}
+
+func (d *deferredUpstream) SendMsg(m interface{}) error {
+	if err := d.connect(); err != nil {
+		return err
+	}
+	return d.up.stream.SendMsg(m)
+}
+
+func (d *deferredUpstream) CloseSend() error {
+	if err := d.connect(); err != nil {
+		return err
+	}
+	return d.up.stream.CloseSend()
+}
+
+func (d *deferredUpstream) RecvMsg(m interface{}) error {
+	if err := d.wait(); err != nil {
+		return err
+	}
+	return d.up.stream.RecvMsg(m)
+}
+
+func (d *deferredUpstream) Header() (metadata.MD, error) {
+	if err := d.wait(); err != nil {
+		return nil, err
+	}
+	return d.up.stream.Header()
+}
+
+func (d *deferredUpstream) Trailer() metadata.MD {
+	if !d.opened() {
+		return nil
+	}
+	return d.up.stream.Trailer()
+}
+
+func (d *deferredUpstream) Context() context.Context {
+	if d.opened() {
+		return d.up.stream.Context()
+	}
+	return d.ctx
+}
+
+// loadProxySigMetadata checks the routes with proxy_sig_metadata_key
+func (px *Proxy) loadProxySigMetadata(diag *Diagnostics) {
+	methods := px.knownMethods()
+	for i := range px.cfg.Routes {
+		route := &px.cfg.Routes[i]
+		path := fmt.Sprintf("routes[%d].envelope", i)
+		key, mode := route.Envelope.ProxySigMetadataKey, route.Envelope.ProxySigMetadataMode
+		if key == "" {
+			if mode != "" {
+				diag.Warnf("routes", "ROUTE_PROXY_SIG_METADATA", path+".proxy_sig_metadata_mode", "has no effect without proxy_sig_metadata_key")
+			}
+			continue
+		}
+		if route.Mode != "inspect-verify-sign" {
+			diag.Warnf("routes", "ROUTE_PROXY_SIG_METADATA", path+".proxy_sig_metadata_key", "has no effect on %s routes", route.Mode)
+			continue
+		}
+		kpath := path + ".proxy_sig_metadata_key"
+		switch {
+		case key != strings.ToLower(key):
+			diag.Errorf("routes", "ROUTE_PROXY_SIG_METADATA", kpath, "metadata key %q is not lowercase", key)
+		case strings.HasPrefix(key, ":") || strings.HasPrefix(key, "grpc-"):
+			diag.Errorf("routes", "ROUTE_PROXY_SIG_METADATA", kpath, "metadata key %q is reserved by gRPC", key)
+		case strings.HasSuffix(key, "-bin"):
+			diag.Errorf("routes", "ROUTE_PROXY_SIG_METADATA", kpath, "the signature is sent as base64 text, so %q cannot be a binary key", key)
+		}
+		switch {
+		case route.Envelope.ProxySigField != "":
+			diag.Errorf("routes", "ROUTE_PROXY_SIG_METADATA", kpath, "set either proxy_sig_field or proxy_sig_metadata_key, not both")
+		case len(route.Envelopes) > 0:
+			diag.Errorf("routes", "ROUTE_PROXY_SIG_METADATA", kpath, "not supported with envelopes; use a single envelope")
+		case route.Unordered:
+			diag.Errorf("routes", "ROUTE_PROXY_SIG_METADATA", kpath, "signatures follow forwarding order, which unordered routes do not keep")
+		case route.Cache != nil && px.cryptoPlanFor(route).response.signs:
+			diag.Errorf("routes", "ROUTE_PROXY_SIG_METADATA", kpath, "a cached response has no trailer to carry its signature")
+		}
+		switch mode {
+		case "", sigMetadataFirst:
+		case sigMetadataPerMessage:
+			if !px.cryptoPlanFor(route).request.signs {
+				break
+			}
+			for _, name := range methods {
+				if md, ok := px.lookupMethod(name); ok && route.matches(name) && md.IsClientStreaming() {
+					diag.Errorf("routes", "ROUTE_PROXY_SIG_METADATA", path+".proxy_sig_metadata_mode", "per_message cannot sign the requests of %s into headers, which go out before its later messages; use first", name)
+					break
+				}
+			}
+		default:
+			diag.Errorf("routes", "ROUTE_PROXY_SIG_METADATA", path+".proxy_sig_metadata_mode", "unknown mode %q (expected first or per_message)", mode)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+)
+
+// --- Slow Consumers ---
+//
+// A client that stops reading a stream's responses stalls the proxy's
+// SendMsg toward it once HTTP/2 flow control runs out, and the backend-to-
+// client pump then holds up to its buffer depth of responses while the other
+// direction keeps going. With slow_consumer_timeout or max_unsent_responses
+// in a route's limits, the proxy watches every streaming call's responses:
+//
+//	slow_consumer_timeout  one response has been waiting to be sent longer
+//	max_unsent_responses   more responses received from the backend than
+//	                       this are waiting to be sent
+//
+// and when either trips ends the call: the client gets UNAVAILABLE with
+// reason SLOW_CONSUMER (once it reads again), the backend call is cancelled,
+// and both pumps stop with what they still hold dropped. Each such call is
+// logged with the client's address and counted in
+// proxy_slow_consumers_total by route and trigger (send_timeout or
+// unsent_limit).
+
+// consumerWatch tracks the responses of one call not yet sent to the client
+type consumerWatch struct {
+	limits streamLimits
+	route  string
+	peer   string
+
+	since  atomic.Int64 // UnixNano the pending SendMsg started; 0 when none is
+	unsent atomic.Int64
+
+	once  sync.Once
+	fired chan struct{} // closed once the client is a slow consumer
+	err   error
+}
+
+// newConsumerWatch arms the route's slow consumer limits for one streaming
+// call, until ctx ends; nil without limits
+func newConsumerWatch(ctx context.Context, limits streamLimits, route *RouteConfig) *consumerWatch {
+	if limits.slowSend <= 0 && limits.maxUnsent <= 0 {
+		return nil
+	}
+	w := &consumerWatch{limits: limits, route: route.Name, fired: make(chan struct{})}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		w.peer = p.Addr.String()
+	}
+	if limits.slowSend > 0 {
+		go w.run(ctx)
+	}
+	return w
+}
+
+// received counts a response the backend sent
+func (w *consumerWatch) received() {
+	if w == nil {
+		return
+	}
+	if n := w.unsent.Add(1); w.limits.maxUnsent > 0 && n > w.limits.maxUnsent {
+		w.trip("unsent_limit", fmt.Sprintf("more than %d responses waiting for the client on route %q", w.limits.maxUnsent, w.route))
+	}
+}
+
+// sending marks the start of a SendMsg toward the client
+func (w *consumerWatch) sending() {
+	if w != nil {
+		w.since.Store(time.Now().UnixNano())
+	}
+}
+
+// done marks a response sent, or dropped
+func (w *consumerWatch) done() {
+	if w != nil {
+		w.since.Store(0)
+		w.unsent.Add(-1)
+	}
+}
+
+// slow is closed once the client has been found slow; nil never is
+func (w *consumerWatch) slow() <-chan struct{} {
+	if w == nil {
+		return nil
+	}
+	return w.fired
+}
+
+func (w *consumerWatch) run(ctx context.Context) {
+	timeout := w.limits.slowSend
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.fired:
+			return
+		case <-timer.C:
+			next := timeout
+			if since := w.since.Load(); since != 0 {
+				blocked := time.Since(time.Unix(0, since))
+				if blocked >= timeout {
+					w.trip("send_timeout", fmt.Sprintf("a response waited more than %s for the client on route %q", timeout, w.route))
+					return
+				}
+				next = timeout - blocked
+			}
+			timer.Reset(next)
+		}
+	}
+}
+
+// trip ends the call as a slow consumer, once
+func (w *consumerWatch) trip(trigger, reason string) {
+	w.once.Do(func() {
+		w.err = rejectf(codes.Unavailable, reasonSlowConsumer, "proxy: slow consumer: %s", reason).with("trigger", trigger)
+		metrics.Inc("proxy_slow_consumers_total", Labels{"route": w.route, "trigger": trigger})
+		log.Printf("[Slow Consumer] Client %s: %s; ending the stream", w.peer, reason)
+		close(w.fired)
+	})
+}
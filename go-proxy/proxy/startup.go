@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+)
+
+// LoadConfig reads and parses the YAML config, with the files it includes and
+// its route templates merged in (configinclude.go); NewProxy should only be
+// called if it succeeds
+func LoadConfig(path string, diag *Diagnostics) (Config, bool) {
+	log.Printf("Loading configuration from %s", path)
+	cfg, _, ok := readConfig(path, false, diag)
+	return cfg, ok
+}
+
+func (px *Proxy) loadBackendTLS(diag *Diagnostics) {
+	if px.cfg.Backend.TLS == nil {
+		return
+	}
+	if px.cfg.Backend.Mode == backendModeMock {
+		diag.Warnf("tls", "BACKEND_TLS", "backend.tls", "backend TLS is not used in mock mode")
+		return
+	}
+	var err error
+	px.backendTLS, err = backendTLSConfig(*px.cfg.Backend.TLS)
+	if err != nil {
+		diag.Errorf("tls", "BACKEND_TLS", "backend.tls", "failed to configure backend TLS: %v", err)
+	}
+}
+
+func (px *Proxy) loadSchema(diag *Diagnostics) {
+	log.Printf("Schema descriptor method: %s", px.cfg.Schema.Method)
+	px.loadReflectLimits(diag)
+	if px.cfg.Schema.Lazy {
+		px.loadLazySchema(diag)
+		return
+	}
+	switch px.cfg.Schema.Method {
+	case "pb":
+		px.setDescriptors(loadFromPB(px.cfg.Schema.PBPath, diag))
+	case "reflect":
+		px.loadReflectedSchema(diag)
+	case "url":
+		px.loadRemoteSchema(diag)
+	case "both":
+		px.loadBothSchema(diag)
+	default:
+		diag.Errorf("schema", "SCHEMA_METHOD_UNKNOWN", "schema.method", "unknown method %q (expected pb, reflect, url or both)", px.cfg.Schema.Method)
+	}
+}
+
+// loadFromAnyBackend runs the reflection loader against each endpoint in turn
+// (healthy first) and keeps the first that succeeds
+func (px *Proxy) loadFromAnyBackend(diag *Diagnostics) map[string]*desc.MethodDescriptor {
+	if px.backends == nil {
+		return nil
+	}
+	var res map[string]*desc.MethodDescriptor
+	var last *Diagnostics
+	for _, addr := range px.backends.addresses() {
+		attempt := &Diagnostics{}
+		res = px.loadFromReflection(addr, attempt)
+		last = attempt
+		if !attempt.HasErrors() {
+			break
+		}
+		log.Printf("[Schema] Reflection via %s failed, trying next endpoint", addr)
+	}
+	if last != nil {
+		diag.Items = append(diag.Items, last.Items...)
+	}
+	return res
+}
+
+// loadLazySchema indexes the descriptor set and materializes only the methods
+// that routes name exactly, so a typo in a route still surfaces at startup
+func (px *Proxy) loadLazySchema(diag *Diagnostics) {
+	if px.cfg.Schema.Method != "pb" {
+		diag.Errorf("schema", "SCHEMA_LAZY_METHOD", "schema.lazy", "lazy descriptors require schema.method pb, got %q", px.cfg.Schema.Method)
+		return
+	}
+	var idle time.Duration
+	if px.cfg.Schema.IdleEviction != "" {
+		var err error
+		idle, err = time.ParseDuration(px.cfg.Schema.IdleEviction)
+		if err != nil || idle <= 0 {
+			diag.Errorf("schema", "SCHEMA_IDLE_EVICTION", "schema.idle_eviction", "invalid duration %q", px.cfg.Schema.IdleEviction)
+			return
+		}
+	}
+	px.lazySchema = loadLazyPB(px.cfg.Schema.PBPath, diag)
+	if px.lazySchema == nil {
+		return
+	}
+
+	for i, route := range px.cfg.Routes {
+		if route.Mode == "pass-thru" || strings.HasSuffix(route.Match, "*") {
+			continue
+		}
+		if _, ok := px.lazySchema.lookupMethod(route.Match); !ok {
+			diag.Warnf("schema", "SCHEMA_ROUTE_METHOD", fmt.Sprintf("routes[%d].match", i), "no descriptor for %s; it will be proxied without inspection", route.Match)
+		}
+	}
+	if idle > 0 {
+		px.lazySchema.startEviction(idle, px.stop)
+	}
+}
+
+// loadCMSMaterial loads the client trust store, proxy signing key, payload
+// encryption keys, backend trust store, and the upstream identity trust store
+func (px *Proxy) loadCMSMaterial(diag *Diagnostics) {
+	if px.cfg.CMS.ClientTrustStore != "" {
+		px.loadClientTrustStore(px.cfg.CMS.ClientTrustStore, diag)
+	}
+	if px.cfg.CMS.ProxyPrivateKey != "" {
+		px.loadProxyPrivateKey(px.cfg.CMS.ProxyPrivateKey, diag)
+	}
+	if px.cfg.CMS.PayloadKey != "" {
+		px.loadPayloadKey(px.cfg.CMS.PayloadKey, diag)
+	}
+	if px.cfg.CMS.BackendEncryptionCert != "" {
+		px.loadBackendEncryptionCert(px.cfg.CMS.BackendEncryptionCert, diag)
+	}
+	if px.cfg.CMS.BackendTrustStore != "" {
+		px.loadBackendTrustStore(px.cfg.CMS.BackendTrustStore, diag)
+	}
+	px.loadNamedKeys(diag)
+	if px.cfg.Identity.UpstreamTrustStore != "" {
+		var err error
+		px.upstreamIdentityKeys, err = px.readCertKeys(px.cfg.Identity.UpstreamTrustStore)
+		if err != nil {
+			diag.Errorf("cms", "IDENTITY_TRUST_STORE", "identity.upstream_trust_store", "failed to load upstream identity trust store: %v", err)
+		}
+	}
+}
+
+func (px *Proxy) loadClientTrustStore(path string, diag *Diagnostics) {
+	px.clientTrust = px.loadTrustAnchor("", path, "cms.client_trust_store", diag)
+}
+
+// loadTrustAnchor reads a client trust store from the secret uri, and swaps
+// in the new store whenever the secret changes
+func (px *Proxy) loadTrustAnchor(name, uri, diagPath string, diag *Diagnostics) *trustAnchor {
+	caBytes, p, err := px.readSecret(uri)
+	if err != nil {
+		diag.Errorf("cms", "CMS_TRUST_STORE_READ", diagPath, "failed to read trust store: %v", err)
+		return nil
+	}
+	m := parseTrustAnchor(caBytes, uri, diagPath, diag)
+	if m == nil {
+		return nil
+	}
+	anchor := &trustAnchor{name: name}
+	anchor.material.Store(m)
+	px.watchSecret(diagPath, p, caBytes, func(b []byte) error {
+		parsed := &Diagnostics{}
+		next := parseTrustAnchor(b, uri, diagPath, parsed)
+		if next == nil || len(next.keyPEMs) == 0 {
+			return fmt.Errorf("no certificate with a usable public key in %s", uri)
+		}
+		anchor.material.Store(next)
+		return nil
+	})
+	return anchor
+}
+
+// parseTrustAnchor parses a client trust store, keeping the SPKI public key
+// PEM of each of its certificates for the Rust engine
+func parseTrustAnchor(caBytes []byte, uri, diagPath string, diag *Diagnostics) *anchorMaterial {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBytes) {
+		diag.Errorf("cms", "CMS_TRUST_STORE_PARSE", diagPath, "failed to append certs from %s", uri)
+		return nil
+	}
+	anchor := &anchorMaterial{pool: pool}
+
+	// Extract SPKI Public Key PEMs for Rust FFI
+	for rest := caBytes; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		if pubKeyBytes, err := x509.MarshalPKIXPublicKey(cert.PublicKey); err == nil {
+			anchor.keyPEMs = append(anchor.keyPEMs, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubKeyBytes}))
+		}
+	}
+	if len(anchor.keyPEMs) == 0 {
+		diag.Warnf("cms", "CMS_TRUST_STORE_RUST", diagPath, "could not extract a public key for the Rust engine from %s", uri)
+	}
+	return anchor
+}
+
+func (px *Proxy) loadProxyPrivateKey(path string, diag *Diagnostics) {
+	key := px.loadSigningKey(verbProxyKey, path, "cms.proxy_private_key", diag)
+	if key == nil {
+		return
+	}
+	px.proxyKey = key
+}
+
+// loadTicketKeyRotation starts session ticket key rotation when an interval is configured
+func (px *Proxy) loadTicketKeyRotation(tlsCfg *tls.Config, cfg TLSConfig, path string, diag *Diagnostics) {
+	every, err := cfg.ticketKeyRotation()
+	if err != nil {
+		diag.Errorf("tls", "LISTENER_TICKET_ROTATION", path+".ticket_key_rotation", "%v", err)
+		return
+	}
+	if every == 0 {
+		return
+	}
+	if cfg.DisableSessionTickets {
+		diag.Warnf("tls", "LISTENER_TICKET_ROTATION", path+".ticket_key_rotation", "ticket_key_rotation has no effect with disable_session_tickets")
+		return
+	}
+	if err := startTicketKeyRotation(tlsCfg, every, px.stop); err != nil {
+		diag.Errorf("tls", "LISTENER_TICKET_ROTATION", path+".ticket_key_rotation", "%v", err)
+	}
+}
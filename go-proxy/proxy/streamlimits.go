@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// streamLimitTrailer names the limit that ended a stream, sent with the
+// RESOURCE_EXHAUSTED status
+const streamLimitTrailer = "x-proxy-stream-limit"
+
+type streamLimits struct {
+	maxMessages int64
+	maxBytes    int64
+	maxDuration time.Duration
+	slowSend    time.Duration // slow_consumer_timeout
+	maxUnsent   int64         // max_unsent_responses
+}
+
+// streamLimitExceeded ends a stream that outgrew one of its route's limits
+type streamLimitExceeded struct {
+	limit  string // max_messages_per_stream, max_total_bytes or max_stream_duration
+	reason string
+}
+
+func (e *streamLimitExceeded) Error() string { return "proxy: " + e.reason }
+
+func (e *streamLimitExceeded) GRPCStatus() *status.Status {
+	return e.rejection().GRPCStatus()
+}
+
+func (e *streamLimitExceeded) rejection() *rejection {
+	return rejectf(codes.ResourceExhausted, reasonStreamLimit, "%s", e.Error()).with("limit", e.limit)
+}
+
+// streamGuard counts one streaming call's messages and bytes against the
+// route's limits, and feeds the stream size histograms when the call ends.
+// A nil guard (unary calls) counts nothing.
+type streamGuard struct {
+	limits streamLimits
+	route  string
+	method string
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	messages [2]atomic.Int64 // by direction: c2s, s2c
+	bytes    atomic.Int64    // both directions
+
+	consumer *consumerWatch // nil without slow consumer limits
+}
+
+// guardStream arms the route's stream limits for a streaming call. The
+// returned context ends the call at max_stream_duration; for unary calls it
+// is parent and the guard is nil.
+func (px *Proxy) guardStream(parent context.Context, method string, route *RouteConfig, unary bool) (*streamGuard, context.Context) {
+	if unary {
+		return nil, parent
+	}
+	g := &streamGuard{limits: px.routeStreamLimits[route.Name], route: route.Name, method: method}
+	g.consumer = newConsumerWatch(parent, g.limits, route)
+	if d := g.limits.maxDuration; d > 0 {
+		g.ctx, g.cancel = context.WithTimeoutCause(parent, d, &streamLimitExceeded{
+			limit:  "max_stream_duration",
+			reason: fmt.Sprintf("stream open for more than %s on route %q", d, route.Name),
+		})
+		return g, g.ctx
+	}
+	return g, parent
+}
+
+// slowConsumer is the call's slow consumer watch, nil for unary calls and
+// routes without slow consumer limits
+func (g *streamGuard) slowConsumer() *consumerWatch {
+	if g == nil {
+		return nil
+	}
+	return g.consumer
+}
+
+// count charges one received message. The message that goes over a limit is
+// not forwarded.
+func (g *streamGuard) count(isReq bool, size int) error {
+	if g == nil {
+		return nil
+	}
+	dir, name := 1, "backend-to-client"
+	if isReq {
+		dir, name = 0, "client-to-backend"
+	}
+	n := g.messages[dir].Add(1)
+	total := g.bytes.Add(int64(size))
+	if max := g.limits.maxMessages; max > 0 && n > max {
+		return &streamLimitExceeded{limit: "max_messages_per_stream", reason: fmt.Sprintf("more than %d %s messages on route %q", max, name, g.route)}
+	}
+	if max := g.limits.maxBytes; max > 0 && total > max {
+		return &streamLimitExceeded{limit: "max_total_bytes", reason: fmt.Sprintf("stream carried more than %d bytes on route %q", max, g.route)}
+	}
+	return nil
+}
+
+// finish records the stream's size and replaces err with the limit that
+// ended the call, if one did. On a limit the trailer names it, and the
+// backend's trailer, which has not arrived, is not waited for.
+func (g *streamGuard) finish(serverStream grpc.ServerStream, err error, forwardTrailer *bool) error {
+	if g == nil {
+		return err
+	}
+	if g.cancel != nil {
+		defer g.cancel()
+	}
+	lbls := Labels{"method": g.method}
+	metrics.ObserveBuckets("proxy_stream_messages", Labels{"method": g.method, "direction": "c2s"}, countBuckets, float64(g.messages[0].Load()))
+	metrics.ObserveBuckets("proxy_stream_messages", Labels{"method": g.method, "direction": "s2c"}, countBuckets, float64(g.messages[1].Load()))
+	metrics.ObserveBuckets("proxy_stream_bytes", lbls, byteBuckets, float64(g.bytes.Load()))
+
+	var exceeded *streamLimitExceeded
+	if err == nil || serverStream.Context().Err() != nil {
+		return err
+	}
+	if !errors.As(err, &exceeded) {
+		if g.ctx == nil || !errors.As(context.Cause(g.ctx), &exceeded) {
+			return err
+		}
+	}
+	metrics.Inc("proxy_stream_limit_exceeded_total", Labels{"route": g.route, "limit": exceeded.limit})
+	serverStream.SetTrailer(metadata.Pairs(streamLimitTrailer, exceeded.limit))
+	*forwardTrailer = false
+	return exceeded
+}
+
+// loadStreamLimits parses each route's per-stream limits
+func (px *Proxy) loadStreamLimits(diag *Diagnostics) {
+	for i, route := range px.cfg.Routes {
+		lim := route.Limits
+		path := fmt.Sprintf("routes[%d].limits", i)
+		if lim.MaxMessagesPerStream < 0 || lim.MaxTotalBytes < 0 || lim.MaxUnsentResponses < 0 {
+			diag.Errorf("routes", "ROUTE_LIMITS_NEGATIVE", path, "limits for %q must not be negative", route.Match)
+			continue
+		}
+		l := streamLimits{maxMessages: lim.MaxMessagesPerStream, maxBytes: lim.MaxTotalBytes, maxUnsent: lim.MaxUnsentResponses}
+		if lim.MaxStreamDuration != "" {
+			d, err := time.ParseDuration(lim.MaxStreamDuration)
+			if err != nil || d <= 0 {
+				diag.Errorf("routes", "ROUTE_LIMITS_DURATION", path+".max_stream_duration", "invalid duration %q", lim.MaxStreamDuration)
+				continue
+			}
+			l.maxDuration = d
+		}
+		if lim.SlowConsumerTimeout != "" {
+			d, err := time.ParseDuration(lim.SlowConsumerTimeout)
+			if err != nil || d <= 0 {
+				diag.Errorf("routes", "ROUTE_LIMITS_DURATION", path+".slow_consumer_timeout", "invalid duration %q", lim.SlowConsumerTimeout)
+				continue
+			}
+			l.slowSend = d
+		}
+		if l == (streamLimits{}) {
+			continue
+		}
+		if route.Mode == "local-reply" {
+			diag.Warnf("routes", "ROUTE_LIMITS_STREAM", path, "stream limits have no effect on local-reply routes")
+			continue
+		}
+		if _, dup := px.routeStreamLimits[route.Name]; !dup {
+			px.routeStreamLimits[route.Name] = l
+		}
+	}
+}
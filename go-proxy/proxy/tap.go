@@ -0,0 +1,455 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/jhump/protoreflect/dynamic"
+)
+
+// --- Message Tap ---
+//
+// A route with a tap block exports the messages it receives, as JSON, to a
+// sink: the envelope in protobuf JSON form plus, when its type_url names a
+// loaded type, the decoded inner payload. Like capture, the data path only
+// samples and does a non-blocking send into the sink's bounded queue;
+// decoding, redaction and delivery happen on the sink's goroutine, and
+// records are dropped (and counted) when it falls behind or the sink is
+// down. Sinks are named in tap_sinks, as a webhook that batches are POSTed to
+// or a file (or named pipe) of JSON lines; an embedding program can register
+// others, e.g. a Kafka producer, with WithTapSink.
+
+// TapSinkConfig is a built-in sink and its delivery settings. Exactly one of
+// webhook and file is set.
+type TapSinkConfig struct {
+	Webhook       string `yaml:"webhook"`        // batches are POSTed as a JSON array
+	File          string `yaml:"file"`           // appended to as one JSON record per line
+	Queue         int    `yaml:"queue"`          // records buffered ahead of delivery; default 1024
+	Batch         int    `yaml:"batch"`          // records per delivery; default 100
+	FlushInterval string `yaml:"flush_interval"` // longest a record waits for its batch; default 1s
+	Timeout       string `yaml:"timeout"`        // per webhook POST; default 5s
+}
+
+// TapConfig exports a route's messages to one of the tap sinks
+type TapConfig struct {
+	Sink       string   `yaml:"sink"`
+	SampleRate float64  `yaml:"sample_rate"` // fraction of messages exported, in (0, 1]; default 1
+	Redact     []string `yaml:"redact"`      // field paths cleared on the envelope and the inner payload
+}
+
+// TapRecord is one exported message
+type TapRecord struct {
+	Time      time.Time       `json:"time"`
+	Route     string          `json:"route"`
+	Method    string          `json:"method"`
+	Direction string          `json:"direction"`          // client_to_backend or backend_to_client
+	Envelope  json.RawMessage `json:"envelope,omitempty"` // absent when the message does not decode
+	TypeURL   string          `json:"type_url,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"` // the inner payload, when its type is loaded
+	Raw       []byte          `json:"raw,omitempty"`     // undecodable messages on routes without redact or redact_fields
+	Redacted  bool            `json:"redacted,omitempty"`
+}
+
+// TapSink delivers batches of records. Write is called from a single
+// goroutine per sink; an error counts the batch as failed, and it is not
+// retried. Close is called once, at Shutdown, after the last Write.
+type TapSink interface {
+	Write(ctx context.Context, batch []TapRecord) error
+	Close() error
+}
+
+// WithTapSink registers sink under name for routes' tap.sink to reference,
+// alongside the tap_sinks in the config; a name in both fails NewProxy
+func WithTapSink(name string, sink TapSink) Option {
+	return func(px *Proxy) {
+		px.registeredSinks = append(px.registeredSinks, namedTapSink{name, sink})
+	}
+}
+
+type namedTapSink struct {
+	name string
+	sink TapSink
+}
+
+const (
+	defaultTapQueue   = 1024
+	defaultTapBatch   = 100
+	defaultTapFlush   = time.Second
+	defaultTapTimeout = 5 * time.Second
+)
+
+// tapQueue feeds one sink
+type tapQueue struct {
+	name     string
+	sink     TapSink
+	px       *Proxy
+	queue    chan *tapEvent
+	batch    int
+	interval time.Duration
+	timeout  time.Duration
+	done     chan struct{} // closed once the last batch is delivered and the sink closed
+}
+
+// routeTap is a route's tap block, parsed
+type routeTap struct {
+	route  *RouteConfig
+	q      *tapQueue
+	sample float64
+	redact []mutation
+}
+
+type tapEvent struct {
+	tap    *routeTap
+	at     time.Time
+	method string
+	isReq  bool
+	raw    []byte
+}
+
+// record samples one received message and queues it without ever blocking
+func (t *routeTap) record(method string, isReq bool, payload []byte) {
+	if t == nil || t.sample < 1 && rand.Float64() >= t.sample {
+		return
+	}
+	select {
+	case t.q.queue <- &tapEvent{tap: t, at: time.Now(), method: method, isReq: isReq, raw: payload}:
+	default:
+		metrics.Inc("proxy_tap_records_total", Labels{"sink": t.q.name, "result": "dropped"})
+	}
+}
+
+func (q *tapQueue) run(stop <-chan struct{}) {
+	defer close(q.done)
+	flush := time.NewTicker(q.interval)
+	defer flush.Stop()
+	var batch []TapRecord
+	deliver := func() {
+		if len(batch) > 0 {
+			q.deliver(batch)
+			batch = nil
+		}
+	}
+	for {
+		select {
+		case ev := <-q.queue:
+			batch = append(batch, q.px.tapRecord(ev))
+			if len(batch) >= q.batch {
+				deliver()
+			}
+		case <-flush.C:
+			deliver()
+		case <-stop:
+			for len(q.queue) > 0 {
+				batch = append(batch, q.px.tapRecord(<-q.queue))
+				if len(batch) >= q.batch {
+					deliver()
+				}
+			}
+			deliver()
+			if err := q.sink.Close(); err != nil {
+				log.Printf("[Tap] Closing sink %s: %v", q.name, err)
+			}
+			return
+		}
+	}
+}
+
+func (q *tapQueue) deliver(batch []TapRecord) {
+	ctx, cancel := context.WithTimeout(context.Background(), q.timeout)
+	defer cancel()
+	result := "sent"
+	if err := q.sink.Write(ctx, batch); err != nil {
+		log.Printf("[Tap] Sink %s failed a batch of %d: %v", q.name, len(batch), err)
+		result = "failed"
+	}
+	metrics.Add("proxy_tap_records_total", Labels{"sink": q.name, "result": result}, float64(len(batch)))
+	metrics.Inc("proxy_tap_batches_total", Labels{"sink": q.name, "result": result})
+}
+
+// tapRecord decodes and redacts one event. A message that cannot be decoded
+// cannot be redacted either, so its bytes are only kept on routes without
+// redact or redact_fields.
+func (px *Proxy) tapRecord(ev *tapEvent) TapRecord {
+	t := ev.tap
+	rec := TapRecord{Time: ev.at, Route: t.route.Name, Method: ev.method, Direction: directionOf(ev.isReq).String()}
+	md, ok := px.lookupMethod(ev.method)
+	if !ok {
+		if len(t.redact) == 0 && px.redactionFor(t.route) == nil {
+			rec.Raw = ev.raw
+		}
+		return rec
+	}
+	msgDesc := md.GetOutputType()
+	if ev.isReq {
+		msgDesc = md.GetInputType()
+	}
+	limits := px.decodeLimitsFor(t.route)
+	if ev.isReq && limits.check(msgDesc, ev.raw) != nil {
+		return rec // as undecodable, without the bytes decode_limits turned away
+	}
+	msg := dynamic.NewMessage(msgDesc)
+	if err := msg.Unmarshal(ev.raw); err != nil {
+		if len(t.redact) == 0 && px.redactionFor(t.route) == nil {
+			rec.Raw = ev.raw
+		}
+		return rec
+	}
+	rec.Redacted = redactMessage(msg, t.redact, ev.at)
+	rec.Envelope, _ = msg.MarshalJSON()
+	redact := px.redactionFor(t.route)
+	if js, ok := redact.redactJSON(rec.Envelope, msgDesc, false); ok {
+		rec.Envelope, rec.Redacted = js, true
+	}
+
+	route := t.route
+	if versions := px.routeEnvelopeVersions[route.Name]; versions != nil {
+		// Tapped messages carry no call context, so only version_field applies
+		if route, _ = versions.variant(context.Background(), msg); route == nil {
+			return rec
+		}
+	}
+	env := px.envelopeFor(route, ev.method, ev.isReq, msgDesc)
+	rec.TypeURL = getStringField(msg, env.typeURL)
+	payload := getBytesField(msg, env.payload)
+	if innerDesc := px.findDescByType(typeName(rec.TypeURL)); ev.isReq && rec.TypeURL != "" && innerDesc != nil && limits.check(innerDesc, payload) != nil {
+		return rec
+	}
+	inner, err := px.decodeInner(rec.TypeURL, payload)
+	if inner != nil && err == nil {
+		if redactMessage(inner, t.redact, ev.at) {
+			rec.Redacted = true
+		}
+		rec.Payload, _ = inner.MarshalJSON()
+		if js, ok := redact.redactJSON(rec.Payload, inner.GetMessageDescriptor(), false); ok {
+			rec.Payload, rec.Redacted = js, true
+		}
+	}
+	return rec
+}
+
+// redactMessage applies every redact path that exists on msg's type
+func redactMessage(msg *dynamic.Message, redact []mutation, at time.Time) bool {
+	redacted := false
+	for i := range redact {
+		m := &redact[i]
+		if _, err := m.resolve(msg.GetMessageDescriptor()); err != nil {
+			continue
+		}
+		if err := m.apply(msg, at); err == nil {
+			redacted = true
+		}
+	}
+	return redacted
+}
+
+// webhookSink POSTs each batch as a JSON array
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookSink) Write(ctx context.Context, batch []TapRecord) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *webhookSink) Close() error { return nil }
+
+// fileSink appends JSON lines to a file. It is opened on the first batch, on
+// the sink's goroutine, since opening a named pipe blocks until it has a
+// reader.
+type fileSink struct {
+	path string
+	f    *os.File
+}
+
+func (s *fileSink) Write(_ context.Context, batch []TapRecord) error {
+	if s.f == nil {
+		f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return err
+		}
+		s.f = f
+	}
+	w := bufio.NewWriter(s.f)
+	enc := json.NewEncoder(w)
+	for i := range batch {
+		if err := enc.Encode(&batch[i]); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func (s *fileSink) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
+
+// loadTaps builds the sinks and parses each route's tap block. Sinks start
+// delivering right away, and are only built when a route uses them.
+func (px *Proxy) loadTaps(diag *Diagnostics) {
+	sinks := make(map[string]*tapQueue)
+	for _, r := range px.registeredSinks {
+		if _, dup := sinks[r.name]; dup {
+			diag.Errorf("tap_sinks", "TAP_SINK", "tap_sinks."+r.name, "tap sink %q is registered twice", r.name)
+			continue
+		}
+		sinks[r.name] = &tapQueue{name: r.name, sink: r.sink, queue: make(chan *tapEvent, defaultTapQueue), batch: defaultTapBatch, interval: defaultTapFlush, timeout: defaultTapTimeout}
+	}
+	names := make([]string, 0, len(px.cfg.TapSinks))
+	for name := range px.cfg.TapSinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := "tap_sinks." + name
+		if _, dup := sinks[name]; dup {
+			diag.Errorf("tap_sinks", "TAP_SINK", path, "tap sink %q is also registered with WithTapSink", name)
+			continue
+		}
+		if q := px.tapQueue(name, px.cfg.TapSinks[name], path, diag); q != nil {
+			sinks[name] = q
+		}
+	}
+
+	used := make(map[string]bool)
+	for i, route := range px.cfg.Routes {
+		cfg := route.Tap
+		if cfg == nil {
+			continue
+		}
+		path := fmt.Sprintf("routes[%d].tap", i)
+		q, ok := sinks[cfg.Sink]
+		if !ok {
+			if _, configured := px.cfg.TapSinks[cfg.Sink]; !configured {
+				diag.Errorf("routes", "ROUTE_TAP", path+".sink", "unknown tap sink %q", cfg.Sink)
+			}
+			continue
+		}
+		used[cfg.Sink] = true
+		if route.Mode == "local-reply" {
+			diag.Warnf("routes", "ROUTE_TAP", path, "local-reply routes relay no messages; tap has no effect")
+			continue
+		}
+		rt := &routeTap{route: &px.cfg.Routes[i], q: q, sample: cfg.SampleRate}
+		valid := true
+		if rt.sample == 0 {
+			rt.sample = 1
+		}
+		if rt.sample < 0 || rt.sample > 1 {
+			diag.Errorf("routes", "ROUTE_TAP", path+".sample_rate", "must be in (0, 1], got %v", cfg.SampleRate)
+			valid = false
+		}
+		for j, field := range cfg.Redact {
+			m, err := parseMutation(MutationConfig{Op: "clear", Field: field, Direction: "both"})
+			if err != nil {
+				diag.Errorf("routes", "ROUTE_TAP", fmt.Sprintf("%s.redact[%d]", path, j), "%v", err)
+				valid = false
+				continue
+			}
+			rt.redact = append(rt.redact, m)
+		}
+		if _, dup := px.routeTaps[route.Name]; valid && !dup {
+			px.routeTaps[route.Name] = rt
+		}
+	}
+
+	for _, name := range names {
+		if !used[name] {
+			diag.Warnf("tap_sinks", "TAP_SINK", "tap_sinks."+name, "no route taps to %q", name)
+		}
+	}
+	if diag.HasErrors() {
+		return
+	}
+	for name, q := range sinks {
+		if !used[name] {
+			continue
+		}
+		q.px, q.done = px, make(chan struct{})
+		px.tapQueues = append(px.tapQueues, q)
+		go q.run(px.stop)
+	}
+}
+
+// tapQueue builds the sink described by cfg
+func (px *Proxy) tapQueue(name string, cfg TapSinkConfig, path string, diag *Diagnostics) *tapQueue {
+	q := &tapQueue{name: name, batch: cfg.Batch, interval: defaultTapFlush, timeout: defaultTapTimeout}
+	valid := true
+	if cfg.Queue < 0 || cfg.Batch < 0 {
+		diag.Errorf("tap_sinks", "TAP_SINK", path, "queue and batch must not be negative")
+		valid = false
+	}
+	for _, d := range []struct {
+		field string
+		raw   string
+		into  *time.Duration
+	}{{"flush_interval", cfg.FlushInterval, &q.interval}, {"timeout", cfg.Timeout, &q.timeout}} {
+		if d.raw == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.raw)
+		if err != nil || v <= 0 {
+			diag.Errorf("tap_sinks", "TAP_SINK", path+"."+d.field, "invalid duration %q", d.raw)
+			valid = false
+		}
+		*d.into = v
+	}
+	switch {
+	case cfg.Webhook != "" && cfg.File != "":
+		diag.Errorf("tap_sinks", "TAP_SINK", path, "set either webhook or file, not both")
+		valid = false
+	case cfg.Webhook != "":
+		if u, err := url.Parse(cfg.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			diag.Errorf("tap_sinks", "TAP_SINK", path+".webhook", "not an http(s) URL: %q", cfg.Webhook)
+			valid = false
+		}
+		q.sink = &webhookSink{url: cfg.Webhook, client: &http.Client{}}
+	case cfg.File != "":
+		q.sink = &fileSink{path: cfg.File}
+	default:
+		diag.Errorf("tap_sinks", "TAP_SINK", path, "needs a webhook or a file")
+		valid = false
+	}
+	if !valid {
+		return nil
+	}
+	size := cfg.Queue
+	if size == 0 {
+		size = defaultTapQueue
+	}
+	if q.batch == 0 {
+		q.batch = defaultTapBatch
+	}
+	q.queue = make(chan *tapEvent, size)
+	return q
+}
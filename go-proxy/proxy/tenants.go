@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// --- Multi-Tenant Trust ---
+//
+// Tenants whose clients sign with their own CA each get a named trust domain
+// in cms.trust_domains. A route with trust_domain_from picks the domain per
+// call, from a request header (metadata:x-tenant) or from the client
+// certificate (mtls-san: the domain whose sans list one of its SANs), and
+// verify-client checks the client signature against that domain's trust store
+// instead of cms.client_trust_store. A call that names no configured domain is
+// rejected with PERMISSION_DENIED before the backend is dialled; shadow routes
+// only count it. The tenant is recorded on audit records and on the client
+// signature verification metrics.
+
+// TrustDomainConfig is one tenant's client trust store
+type TrustDomainConfig struct {
+	TrustStore string   `yaml:"trust_store"`
+	SANs       []string `yaml:"sans"` // client certificate SANs (DNS, URI, email or IP) that select this domain under mtls-san
+}
+
+const tenantFromSAN = "mtls-san"
+
+// tenantSource is a route's trust_domain_from, parsed
+type tenantSource struct {
+	header string // the metadata key; empty selects by client certificate SAN
+}
+
+type tenantKey struct{}
+
+// tenantFromContext returns the call's trust domain; empty on routes without
+// trust_domain_from
+func tenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// trustAnchor is a client trust store, with the public key PEM of each of its
+// certificates for the Rust engine
+type trustAnchor struct {
+	name     string // the trust domain; empty for cms.client_trust_store
+	material atomic.Pointer[anchorMaterial]
+}
+
+type anchorMaterial struct {
+	pool    *x509.CertPool
+	keyPEMs [][]byte
+}
+
+func (a *trustAnchor) load() *anchorMaterial {
+	return a.material.Load()
+}
+
+// keyID names the anchor's first key, or "" for a nil anchor
+func (a *trustAnchor) keyID() string {
+	if a == nil {
+		return ""
+	}
+	pems := a.load().keyPEMs
+	if len(pems) == 0 {
+		return ""
+	}
+	return pemKeyID(pems[0])
+}
+
+// label names the anchor's config entry
+func (a *trustAnchor) label() string {
+	if a.name == "" {
+		return "cms.client_trust_store"
+	}
+	return "cms.trust_domains." + a.name
+}
+
+// rustVerify checks sig over a payload's digest against each of the anchor's
+// keys, returning the id of the key that verifies it, or "" if none does
+func (a *trustAnchor) rustVerify(digest payloadDigest, sig []byte) string {
+	for _, pemKey := range a.load().keyPEMs {
+		ok, err := RustVerifyDigest(digest[:], sig, pemKey)
+		if err != nil {
+			reportRustError(err)
+			continue
+		}
+		if ok {
+			return pemKeyID(pemKey)
+		}
+	}
+	return ""
+}
+
+// clientTrustFor is the trust store verifying client signatures on route for
+// the call in ctx. It is nil when the route selects a tenant and the call
+// has none, which only happens on shadow routes.
+func (px *Proxy) clientTrustFor(ctx context.Context, route *RouteConfig) *trustAnchor {
+	if _, ok := px.routeTenantSources[route.Name]; !ok {
+		return px.clientTrust
+	}
+	return px.trustDomains[tenantFromContext(ctx)]
+}
+
+// resolveTenant picks the call's trust domain on routes with
+// trust_domain_from, rejecting calls that name none
+func (px *Proxy) resolveTenant(ctx context.Context, route *RouteConfig, md metadata.MD) (string, error) {
+	src, ok := px.routeTenantSources[route.Name]
+	if !ok {
+		return "", nil
+	}
+	tenant := ""
+	if src.header != "" {
+		tenant = first(md, src.header)
+	} else if cert := peerCertificate(ctx); cert != nil {
+		for _, san := range certSANs(cert) {
+			if domain, ok := px.trustDomainSANs[san]; ok {
+				tenant = domain
+				break
+			}
+		}
+	}
+	if _, known := px.trustDomains[tenant]; known {
+		return tenant, nil
+	}
+	metrics.Inc("proxy_tenant_rejections_total", Labels{"route": route.Name, "shadow": shadowLabel(route)})
+	if route.Shadow {
+		log.Printf("[Shadow] Route %s would reject tenant %q: no trust domain", route.Name, tenant)
+		return "", nil
+	}
+	if tenant == "" {
+		return "", rejectf(codes.PermissionDenied, reasonTenantUnknown, "proxy: the call names no tenant")
+	}
+	return "", rejectf(codes.PermissionDenied, reasonTenantUnknown, "proxy: unknown tenant %q", tenant).with("tenant", tenant)
+}
+
+// peerCertificate is the verified client certificate, if any
+func peerCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.AuthInfo == nil {
+		return nil
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return nil
+	}
+	return tlsInfo.State.PeerCertificates[0]
+}
+
+// certSANs lists a certificate's subject alternative names
+func certSANs(cert *x509.Certificate) []string {
+	sans := append([]string{}, cert.DNSNames...)
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return sans
+}
+
+// loadTrustDomains reads each trust domain's store and parses every route's
+// trust_domain_from
+func (px *Proxy) loadTrustDomains(diag *Diagnostics) {
+	names := make([]string, 0, len(px.cfg.CMS.TrustDomains))
+	for name := range px.cfg.CMS.TrustDomains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cfg := px.cfg.CMS.TrustDomains[name]
+		path := "cms.trust_domains." + name
+		if name == "" {
+			diag.Errorf("cms", "CMS_TRUST_DOMAIN", path, "trust domains need a name")
+			continue
+		}
+		if cfg.TrustStore == "" {
+			diag.Errorf("cms", "CMS_TRUST_DOMAIN", path+".trust_store", "trust domain %q needs a trust_store", name)
+			continue
+		}
+		if anchor := px.loadTrustAnchor(name, cfg.TrustStore, path+".trust_store", diag); anchor != nil {
+			px.trustDomains[name] = anchor
+		}
+		for i, san := range cfg.SANs {
+			if other, dup := px.trustDomainSANs[san]; dup {
+				diag.Errorf("cms", "CMS_TRUST_DOMAIN", fmt.Sprintf("%s.sans[%d]", path, i), "SAN %q already selects trust domain %q", san, other)
+				continue
+			}
+			px.trustDomainSANs[san] = name
+		}
+	}
+
+	clientCerts := false
+	for _, l := range px.listeners {
+		clientCerts = clientCerts || (l.tls != nil && l.tls.ClientAuth != tls.NoClientCert)
+	}
+	for i, route := range px.cfg.Routes {
+		if route.TrustDomainFrom == "" {
+			continue
+		}
+		path := fmt.Sprintf("routes[%d].trust_domain_from", i)
+		var src tenantSource
+		switch {
+		case route.TrustDomainFrom == tenantFromSAN:
+			if len(px.trustDomainSANs) == 0 {
+				diag.Errorf("routes", "ROUTE_TRUST_DOMAIN", path, "mtls-san needs sans on at least one of cms.trust_domains")
+				continue
+			}
+			if !clientCerts {
+				diag.Warnf("routes", "ROUTE_TRUST_DOMAIN", path, "no listener asks for client certificates, so every call is rejected")
+			}
+		case strings.HasPrefix(route.TrustDomainFrom, "metadata:"):
+			src.header = strings.ToLower(strings.TrimPrefix(route.TrustDomainFrom, "metadata:"))
+			if src.header == "" {
+				diag.Errorf("routes", "ROUTE_TRUST_DOMAIN", path, "metadata: needs a header name")
+				continue
+			}
+		default:
+			diag.Errorf("routes", "ROUTE_TRUST_DOMAIN", path, "unknown source %q (expected metadata:<header> or mtls-san)", route.TrustDomainFrom)
+			continue
+		}
+		if len(px.cfg.CMS.TrustDomains) == 0 {
+			diag.Errorf("routes", "ROUTE_TRUST_DOMAIN", path, "trust_domain_from needs cms.trust_domains")
+			continue
+		}
+		if route.Mode != "inspect-verify-sign" && route.Mode != "session-token" {
+			diag.Warnf("routes", "ROUTE_TRUST_DOMAIN", path, "only inspect-verify-sign and session-token routes verify client signatures; %s calls are still rejected for unknown tenants", route.Mode)
+		}
+		if _, dup := px.routeTenantSources[route.Name]; !dup {
+			px.routeTenantSources[route.Name] = src
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// loadCertPool reads one or more PEM certificates into a pool
+func loadCertPool(file string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// serverTLSConfig builds the listener TLS config, including the SAN allowlist
+// for trusted upstream proxies when one is configured.
+func serverTLSConfig(cfg TLSConfig, upstreams TrustedUpstreamsConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load listener keypair: %w", err)
+	}
+	tlsCfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if err := applyTLSTuning(tlsCfg, cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.ClientCAFile != "" {
+		pool, err := loadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client CA: %w", err)
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if cfg.RequireClientCert {
+			tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	if len(upstreams.SANs) > 0 {
+		if tlsCfg.ClientCAs == nil {
+			return nil, fmt.Errorf("trusted_upstreams.sans requires server.tls.client_ca_file")
+		}
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsCfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("no client certificate from upstream")
+			}
+			leaf := cs.PeerCertificates[0]
+			if matchSANs(leaf, upstreams.SANs) {
+				return nil
+			}
+			log.Printf("[Security] Refused connection from untrusted upstream %q", certIdentity(leaf))
+			return fmt.Errorf("client certificate is not a trusted upstream")
+		}
+	}
+	return tlsCfg, nil
+}
+
+// matchSANs reports whether any URI/DNS SAN (or the CN) matches a glob pattern
+func matchSANs(cert *x509.Certificate, patterns []string) bool {
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	for _, p := range patterns {
+		for _, n := range names {
+			if ok, _ := path.Match(p, n); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// certIdentity prefers a SPIFFE/URI SAN and falls back to the subject CN
+func certIdentity(cert *x509.Certificate) string {
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+	return cert.Subject.CommonName
+}
+
+// cidrListener drops connections whose remote address is outside the allowlist
+// before any TLS or HTTP/2 work happens.
+type cidrListener struct {
+	net.Listener
+	nets []*net.IPNet
+}
+
+func (l *cidrListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.allowed(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		log.Printf("[Security] Refused connection from %s (not in trusted_upstreams cidrs)", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+func (l *cidrListener) allowed(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.nets {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// backendTransportOption selects plaintext or (m)TLS for the upstream dial
+func (px *Proxy) backendTransportOption() grpc.DialOption {
+	if px.backendTLS == nil {
+		return grpc.WithTransportCredentials(insecure.NewCredentials())
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(px.backendTLS))
+}
+
+// backendDialOptions are the transport and dialer for every upstream connection
+func (px *Proxy) backendDialOptions() []grpc.DialOption {
+	opts := []grpc.DialOption{px.backendTransportOption()}
+	if px.backendDialer != nil {
+		opts = append(opts, grpc.WithContextDialer(px.backendDialer))
+	}
+	return opts
+}
+
+func backendTLSConfig(cfg BackendTLSConfig) (*tls.Config, error) {
+	tlsCfg := &tls.Config{ServerName: cfg.ServerName}
+	if cfg.CAFile != "" {
+		pool, err := loadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("load backend CA: %w", err)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load backend client keypair: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
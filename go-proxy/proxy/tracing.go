@@ -0,0 +1,371 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// --- Tracing ---
+//
+// W3C trace context propagation with spans exported over OTLP/HTTP (JSON),
+// kept dependency-free in the same way as the metrics registry. Each RPC gets
+// a server span covering the proxy's whole involvement, with child spans for
+// signature verification, proxy signing, and the backend hop. The backend hop
+// span is what the backend sees as its parent via the injected traceparent.
+//
+// With no tracing block configured every entry point here is a no-op and
+// incoming traceparent headers are forwarded untouched.
+
+// TracingConfig enables tracing when OTLPEndpoint is set
+type TracingConfig struct {
+	OTLPEndpoint  string   `yaml:"otlp_endpoint"`  // e.g. "http://localhost:4318"; spans go to <endpoint>/v1/traces
+	SamplingRatio *float64 `yaml:"sampling_ratio"` // new root traces, default 1; incoming sampled flags are honoured
+	ServiceName   string   `yaml:"service_name"`   // default "grpc-proxy"
+}
+
+const (
+	traceparentHeader = "traceparent"
+
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	exportBatchSize = 256
+	exportInterval  = 2 * time.Second
+	exportQueueSize = 4096
+)
+
+type spanKey struct{}
+
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+
+	name  string
+	kind  int
+	start time.Time
+	attrs map[string]string
+	code  codes.Code
+	msg   string
+
+	exp *spanExporter // the RPC span's exporter, shared by its children
+}
+
+func randomID(b []byte) {
+	for {
+		rand.Read(b)
+		for _, c := range b {
+			if c != 0 {
+				return
+			}
+		}
+	}
+}
+
+// parseTraceparent accepts version 00 headers: 00-<trace-id>-<parent-id>-<flags>
+func parseTraceparent(h string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 || parts[0] == "ff" {
+		return
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == [8]byte{} {
+		return
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return
+	}
+	return traceID, parentID, flags&1 == 1, true
+}
+
+func (s *span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%x-%x-%s", s.traceID, s.spanID, flags)
+}
+
+// startRPCSpan begins the server span for an intercepted call, continuing the
+// client's trace when md carries a valid traceparent
+func (px *Proxy) startRPCSpan(method string, md metadata.MD) *span {
+	if px.tracer == nil {
+		return nil
+	}
+	s := &span{exp: px.tracer, name: method, kind: spanKindServer, start: time.Now(), attrs: map[string]string{
+		"rpc.system": "grpc",
+		"rpc.method": method,
+	}}
+	if traceID, parentID, sampled, ok := parseTraceparent(first(md, traceparentHeader)); ok {
+		s.traceID, s.parentID, s.sampled = traceID, parentID, sampled
+	} else {
+		randomID(s.traceID[:])
+		s.sampled = px.tracer.sampleRoot(s.traceID)
+	}
+	randomID(s.spanID[:])
+	return s
+}
+
+// startChildSpan begins a span under the RPC span carried by ctx
+func startChildSpan(ctx context.Context, name string, kind int) *span {
+	parent, _ := ctx.Value(spanKey{}).(*span)
+	if parent == nil {
+		return nil
+	}
+	s := &span{
+		traceID:  parent.traceID,
+		parentID: parent.spanID,
+		sampled:  parent.sampled,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+		attrs:    map[string]string{},
+		exp:      parent.exp,
+	}
+	randomID(s.spanID[:])
+	return s
+}
+
+func contextWithSpan(ctx context.Context, s *span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// inject replaces the outgoing traceparent so the backend parents onto s
+func (s *span) inject(md metadata.MD) {
+	if s != nil {
+		md.Set(traceparentHeader, s.traceparent())
+	}
+}
+
+func (s *span) set(key, value string) {
+	if s != nil {
+		s.attrs[key] = value
+	}
+}
+
+// ids returns the hex trace and span IDs for log correlation
+func (s *span) ids() (string, string) {
+	if s == nil {
+		return "", ""
+	}
+	return hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:])
+}
+
+// end finishes the span with the gRPC status of err and queues it for export
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	if err != nil {
+		st := status.Convert(err)
+		s.code, s.msg = st.Code(), st.Message()
+	}
+	s.attrs["rpc.grpc.status_code"] = strconv.Itoa(int(s.code))
+	if s.sampled {
+		s.exp.enqueue(s, time.Now())
+	}
+}
+
+// --- OTLP/HTTP JSON export ---
+
+type finishedSpan struct {
+	*span
+	end time.Time
+}
+
+type spanExporter struct {
+	url         string
+	service     string
+	ratioBound  uint64
+	queue       chan finishedSpan
+	client      *http.Client
+	sampleAll   bool
+	sampleNever bool
+	done        chan struct{} // closed once the exporter has sent its last batch
+}
+
+func newSpanExporter(cfg TracingConfig, stop <-chan struct{}) *spanExporter {
+	e := &spanExporter{
+		done:    make(chan struct{}),
+		url:     strings.TrimSuffix(cfg.OTLPEndpoint, "/") + "/v1/traces",
+		service: cfg.ServiceName,
+		queue:   make(chan finishedSpan, exportQueueSize),
+		client:  &http.Client{Timeout: 5 * time.Second},
+	}
+	if e.service == "" {
+		e.service = "grpc-proxy"
+	}
+	r := 1.0
+	if cfg.SamplingRatio != nil {
+		r = *cfg.SamplingRatio
+	}
+	switch {
+	case r >= 1:
+		e.sampleAll = true
+	case r <= 0:
+		e.sampleNever = true
+	default:
+		e.ratioBound = uint64(r * (1 << 63))
+	}
+	go e.run(stop)
+	return e
+}
+
+// sampleRoot makes the same decision as OpenTelemetry's TraceIDRatioBased
+// sampler, so every hop that samples by ratio agrees on a given trace
+func (e *spanExporter) sampleRoot(traceID [16]byte) bool {
+	switch {
+	case e.sampleAll:
+		return true
+	case e.sampleNever:
+		return false
+	}
+	return binary.BigEndian.Uint64(traceID[8:])>>1 < e.ratioBound
+}
+
+// enqueue never blocks the data path; spans are dropped when the queue is full
+func (e *spanExporter) enqueue(s *span, end time.Time) {
+	select {
+	case e.queue <- finishedSpan{span: s, end: end}:
+	default:
+		metrics.Inc("proxy_trace_spans_dropped_total", nil)
+	}
+}
+
+// run exports in batches until stop is closed, then sends what is still queued
+func (e *spanExporter) run(stop <-chan struct{}) {
+	defer close(e.done)
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	batch := make([]finishedSpan, 0, exportBatchSize)
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) < exportBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-stop:
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+			}
+			if len(batch) > 0 {
+				e.export(batch)
+			}
+			return
+		}
+		e.export(batch)
+		batch = batch[:0]
+	}
+}
+
+type otlpKeyValue struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID      string         `json:"traceId"`
+	SpanID       string         `json:"spanId"`
+	ParentSpanID string         `json:"parentSpanId,omitempty"`
+	Name         string         `json:"name"`
+	Kind         int            `json:"kind"`
+	Start        string         `json:"startTimeUnixNano"`
+	End          string         `json:"endTimeUnixNano"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	Status       map[string]any `json:"status"`
+}
+
+func (e *spanExporter) export(batch []finishedSpan) {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		o := otlpSpan{
+			TraceID: hex.EncodeToString(s.traceID[:]),
+			SpanID:  hex.EncodeToString(s.spanID[:]),
+			Name:    s.name,
+			Kind:    s.kind,
+			Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+			End:     strconv.FormatInt(s.end.UnixNano(), 10),
+			Status:  map[string]any{"code": 1},
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.code != codes.OK {
+			o.Status = map[string]any{"code": 2, "message": s.msg}
+		}
+		for k, v := range s.attrs {
+			o.Attributes = append(o.Attributes, otlpKeyValue{Key: k, Value: map[string]string{"stringValue": v}})
+		}
+		spans = append(spans, o)
+	}
+	body, _ := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": []otlpKeyValue{
+				{Key: "service.name", Value: map[string]string{"stringValue": e.service}},
+			}},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "grpc-proxy"},
+				"spans": spans,
+			}},
+		}},
+	})
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		metrics.Add("proxy_trace_spans_dropped_total", nil, float64(len(batch)))
+		log.Printf("[Tracing] Export to %s failed: %v", e.url, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		metrics.Add("proxy_trace_spans_dropped_total", nil, float64(len(batch)))
+		log.Printf("[Tracing] Export to %s rejected: %s", e.url, resp.Status)
+		return
+	}
+	metrics.Add("proxy_trace_spans_exported_total", nil, float64(len(batch)))
+}
+
+// loadTracing validates the tracing block and starts the exporter
+func (px *Proxy) loadTracing(diag *Diagnostics) {
+	cfg := px.cfg.Tracing
+	if cfg.OTLPEndpoint == "" {
+		return
+	}
+	if !strings.HasPrefix(cfg.OTLPEndpoint, "http://") && !strings.HasPrefix(cfg.OTLPEndpoint, "https://") {
+		diag.Errorf("tracing", "TRACING_ENDPOINT", "tracing.otlp_endpoint", "endpoint %q must be an http(s) URL", cfg.OTLPEndpoint)
+		return
+	}
+	if r := cfg.SamplingRatio; r != nil && (*r < 0 || *r > 1) {
+		diag.Errorf("tracing", "TRACING_SAMPLING", "tracing.sampling_ratio", "sampling_ratio must be between 0 and 1, got %v", *r)
+		return
+	}
+	px.tracer = newSpanExporter(cfg, px.stop)
+	log.Printf("[Tracing] Exporting spans to %s", px.tracer.url)
+}
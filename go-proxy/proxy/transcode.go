@@ -0,0 +1,687 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// --- HTTP/JSON Transcoding ---
+//
+// Unary methods can be called with a JSON body. Every method answers
+// POST /<package.Service>/<Method> with the whole request message as the body;
+// methods carrying a google.api.http option are also bound to its verb and
+// path template. The JSON is converted to and from protobuf with the loaded
+// descriptors, and the call itself goes through the gRPC server as usual.
+
+// google.api.http is extension 72295728 of MethodOptions. It is read from the
+// raw options so the annotations package need not be linked in.
+const httpRuleExtension = 72295728
+
+// httpRuleSpec is one binding as written in the google.api.http option
+type httpRuleSpec struct {
+	verb         string
+	path         string
+	body         string
+	responseBody string
+}
+
+// httpRule is a binding with its path template parsed and checked against
+// the method's messages
+type httpRule struct {
+	method       string
+	verb         string
+	segments     []templateSegment
+	customVerb   string // ":verb" suffix of the template
+	body         string // "*", a request field, or "" for no body
+	responseBody string // response field to return instead of the whole message
+}
+
+type templateSegment struct {
+	literal string // empty for wildcards
+	wild    int    // 0 literal, 1 "*", 2 "**"
+	field   string // variable this segment binds, if any
+}
+
+// httpRulesFromOptions extracts the google.api.http bindings of a method,
+// including additional_bindings
+func httpRulesFromOptions(md *desc.MethodDescriptor) ([]httpRuleSpec, error) {
+	opts := md.GetMethodOptions()
+	if opts == nil {
+		return nil, nil
+	}
+	var specs []httpRuleSpec
+	b := []byte(opts.ProtoReflect().GetUnknown())
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		if num == httpRuleExtension && typ == protowire.BytesType {
+			raw, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+			rules, err := parseHTTPRule(raw, true)
+			if err != nil {
+				return nil, err
+			}
+			specs = append(specs, rules...)
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return specs, nil
+}
+
+// parseHTTPRule decodes a google.api.HttpRule message
+func parseHTTPRule(b []byte, nested bool) ([]httpRuleSpec, error) {
+	var spec httpRuleSpec
+	var extra []httpRuleSpec
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ != protowire.BytesType {
+			if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch num {
+		case 2, 3, 4, 5, 6:
+			spec.verb = [...]string{"GET", "PUT", "POST", "DELETE", "PATCH"}[num-2]
+			spec.path = string(v)
+		case 8: // custom: CustomHttpPattern{kind = 1, path = 2}
+			for len(v) > 0 {
+				cnum, ctyp, cn := protowire.ConsumeTag(v)
+				if cn < 0 || ctyp != protowire.BytesType {
+					return nil, fmt.Errorf("malformed custom pattern")
+				}
+				s, sn := protowire.ConsumeString(v[cn:])
+				if sn < 0 {
+					return nil, protowire.ParseError(sn)
+				}
+				v = v[cn+sn:]
+				if cnum == 1 {
+					spec.verb = strings.ToUpper(s)
+				} else if cnum == 2 {
+					spec.path = s
+				}
+			}
+		case 7:
+			spec.body = string(v)
+		case 12:
+			spec.responseBody = string(v)
+		case 11:
+			if nested {
+				more, err := parseHTTPRule(v, false)
+				if err != nil {
+					return nil, err
+				}
+				extra = append(extra, more...)
+			}
+		}
+	}
+	if spec.verb == "" {
+		return extra, nil
+	}
+	return append([]httpRuleSpec{spec}, extra...), nil
+}
+
+// parseTemplate parses a path template such as
+// "/v1/{name=projects/*/books/*}:publish" into segments and a custom verb
+func parseTemplate(tmpl string) ([]templateSegment, string, error) {
+	if !strings.HasPrefix(tmpl, "/") {
+		return nil, "", fmt.Errorf("template %q must start with /", tmpl)
+	}
+	rest := tmpl[1:]
+	verb := ""
+	if i := strings.LastIndex(rest, ":"); i >= 0 && i > strings.LastIndex(rest, "}") && i > strings.LastIndex(rest, "/") {
+		rest, verb = rest[:i], rest[i+1:]
+	}
+
+	var segs []templateSegment
+	addLiteralOrWild := func(s, field string) error {
+		switch s {
+		case "":
+			return fmt.Errorf("empty segment in %q", tmpl)
+		case "*":
+			segs = append(segs, templateSegment{wild: 1, field: field})
+		case "**":
+			segs = append(segs, templateSegment{wild: 2, field: field})
+		default:
+			segs = append(segs, templateSegment{literal: s, field: field})
+		}
+		return nil
+	}
+	for rest != "" {
+		var seg string
+		if strings.HasPrefix(rest, "{") {
+			end := strings.Index(rest, "}")
+			if end < 0 {
+				return nil, "", fmt.Errorf("unterminated variable in %q", tmpl)
+			}
+			field, sub, hasSub := strings.Cut(rest[1:end], "=")
+			if field == "" {
+				return nil, "", fmt.Errorf("empty variable name in %q", tmpl)
+			}
+			if !hasSub {
+				sub = "*"
+			}
+			for _, s := range strings.Split(sub, "/") {
+				if err := addLiteralOrWild(s, field); err != nil {
+					return nil, "", err
+				}
+			}
+			rest = strings.TrimPrefix(rest[end+1:], "/")
+			continue
+		}
+		seg, rest, _ = strings.Cut(rest, "/")
+		if err := addLiteralOrWild(seg, ""); err != nil {
+			return nil, "", err
+		}
+	}
+	for i, s := range segs {
+		if s.wild == 2 && i != len(segs)-1 {
+			return nil, "", fmt.Errorf("** must be the last segment in %q", tmpl)
+		}
+	}
+	return segs, verb, nil
+}
+
+func newHTTPRule(method string, md *desc.MethodDescriptor, spec httpRuleSpec) (*httpRule, error) {
+	segs, verb, err := parseTemplate(spec.path)
+	if err != nil {
+		return nil, err
+	}
+	rule := &httpRule{method: method, verb: spec.verb, segments: segs, customVerb: verb, body: spec.body, responseBody: spec.responseBody}
+	for _, s := range segs {
+		if s.field == "" {
+			continue
+		}
+		if _, err := scalarFieldPath(md.GetInputType(), s.field); err != nil {
+			return nil, fmt.Errorf("path variable %s: %v", s.field, err)
+		}
+	}
+	if rule.body != "" && rule.body != "*" {
+		fd := md.GetInputType().FindFieldByName(rule.body)
+		if fd == nil || fd.GetMessageType() == nil || fd.IsRepeated() {
+			return nil, fmt.Errorf("body %q must name a singular message field of %s", rule.body, md.GetInputType().GetFullyQualifiedName())
+		}
+	}
+	if rule.responseBody != "" {
+		fd := md.GetOutputType().FindFieldByName(rule.responseBody)
+		if fd == nil || fd.GetMessageType() == nil || fd.IsRepeated() {
+			return nil, fmt.Errorf("response_body %q must name a singular message field of %s", rule.responseBody, md.GetOutputType().GetFullyQualifiedName())
+		}
+	}
+	return rule, nil
+}
+
+// match binds path against the rule's template, returning the variable values
+func (rule *httpRule) match(verb, path string) (map[string]string, bool) {
+	if verb != rule.verb {
+		return nil, false
+	}
+	path = strings.TrimPrefix(path, "/")
+	if rule.customVerb != "" {
+		var ok bool
+		if path, ok = strings.CutSuffix(path, ":"+rule.customVerb); !ok {
+			return nil, false
+		}
+	}
+	parts := strings.Split(path, "/")
+	vars := map[string][]string{}
+	j := 0
+	for i, s := range rule.segments {
+		take := 1
+		if s.wild == 2 {
+			take = len(parts) - j - (len(rule.segments) - i - 1)
+			if take < 0 {
+				return nil, false
+			}
+		}
+		if j+take > len(parts) {
+			return nil, false
+		}
+		matched := parts[j : j+take]
+		if s.wild == 0 && matched[0] != s.literal {
+			return nil, false
+		}
+		if s.wild == 1 && matched[0] == "" {
+			return nil, false
+		}
+		if s.field != "" {
+			for _, p := range matched {
+				if u, err := url.PathUnescape(p); err == nil {
+					p = u
+				}
+				vars[s.field] = append(vars[s.field], p)
+			}
+		}
+		j += take
+	}
+	if j != len(parts) {
+		return nil, false
+	}
+	bound := make(map[string]string, len(vars))
+	for f, v := range vars {
+		bound[f] = strings.Join(v, "/")
+	}
+	return bound, true
+}
+
+// scalarFieldPath resolves a dotted field path that ends in a non-map field
+func scalarFieldPath(md *desc.MessageDescriptor, path string) ([]*desc.FieldDescriptor, error) {
+	var fds []*desc.FieldDescriptor
+	names := strings.Split(path, ".")
+	for i, name := range names {
+		fd := md.FindFieldByName(name)
+		if fd == nil {
+			fd = md.FindFieldByJSONName(name)
+		}
+		if fd == nil {
+			return nil, fmt.Errorf("%s has no field %q", md.GetFullyQualifiedName(), name)
+		}
+		fds = append(fds, fd)
+		if i == len(names)-1 {
+			if fd.IsMap() || fd.GetMessageType() != nil {
+				return nil, fmt.Errorf("%s cannot be bound from a string", fd.GetFullyQualifiedName())
+			}
+			break
+		}
+		if fd.GetMessageType() == nil || fd.IsRepeated() {
+			return nil, fmt.Errorf("%s is not a singular message field", fd.GetFullyQualifiedName())
+		}
+		md = fd.GetMessageType()
+	}
+	return fds, nil
+}
+
+// setFromStrings assigns path variable or query parameter values to a field
+func setFromStrings(msg *dynamic.Message, path string, values []string) error {
+	fds, err := scalarFieldPath(msg.GetMessageDescriptor(), path)
+	if err != nil {
+		return err
+	}
+	target := msg
+	for _, fd := range fds[:len(fds)-1] {
+		sub, _ := target.GetField(fd).(*dynamic.Message)
+		if sub == nil {
+			sub = dynamic.NewMessage(fd.GetMessageType())
+			if err := target.TrySetField(fd, sub); err != nil {
+				return err
+			}
+		}
+		target = sub
+	}
+	fd := fds[len(fds)-1]
+	for _, s := range values {
+		v, err := scalarFromString(fd, s)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if fd.IsRepeated() {
+			err = target.TryAddRepeatedField(fd, v)
+		} else {
+			err = target.TrySetField(fd, v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scalarFromString(fd *desc.FieldDescriptor, s string) (interface{}, error) {
+	switch fd.GetType() {
+	case descriptorpb.FieldDescriptorProto_TYPE_STRING:
+		return s, nil
+	case descriptorpb.FieldDescriptorProto_TYPE_BYTES:
+		if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+			return b, nil
+		}
+		return base64.URLEncoding.DecodeString(s)
+	case descriptorpb.FieldDescriptorProto_TYPE_BOOL:
+		return strconv.ParseBool(s)
+	case descriptorpb.FieldDescriptorProto_TYPE_INT32, descriptorpb.FieldDescriptorProto_TYPE_SINT32, descriptorpb.FieldDescriptorProto_TYPE_SFIXED32:
+		v, err := strconv.ParseInt(s, 10, 32)
+		return int32(v), err
+	case descriptorpb.FieldDescriptorProto_TYPE_INT64, descriptorpb.FieldDescriptorProto_TYPE_SINT64, descriptorpb.FieldDescriptorProto_TYPE_SFIXED64:
+		return strconv.ParseInt(s, 10, 64)
+	case descriptorpb.FieldDescriptorProto_TYPE_UINT32, descriptorpb.FieldDescriptorProto_TYPE_FIXED32:
+		v, err := strconv.ParseUint(s, 10, 32)
+		return uint32(v), err
+	case descriptorpb.FieldDescriptorProto_TYPE_UINT64, descriptorpb.FieldDescriptorProto_TYPE_FIXED64:
+		return strconv.ParseUint(s, 10, 64)
+	case descriptorpb.FieldDescriptorProto_TYPE_FLOAT:
+		v, err := strconv.ParseFloat(s, 32)
+		return float32(v), err
+	case descriptorpb.FieldDescriptorProto_TYPE_DOUBLE:
+		return strconv.ParseFloat(s, 64)
+	case descriptorpb.FieldDescriptorProto_TYPE_ENUM:
+		if ev := fd.GetEnumType().FindValueByName(s); ev != nil {
+			return ev.GetNumber(), nil
+		}
+		v, err := strconv.ParseInt(s, 10, 32)
+		return int32(v), err
+	}
+	return nil, fmt.Errorf("unsupported field type %s", fd.GetType())
+}
+
+// bind builds the request message from the body, path variables and query
+func (rule *httpRule) bind(in *dynamic.Message, body []byte, vars map[string]string, query url.Values) error {
+	switch rule.body {
+	case "":
+	case "*":
+		if len(bytes.TrimSpace(body)) > 0 {
+			if err := in.UnmarshalJSON(body); err != nil {
+				return fmt.Errorf("request body: %v", err)
+			}
+		}
+	default:
+		fd := in.GetMessageDescriptor().FindFieldByName(rule.body)
+		sub := dynamic.NewMessage(fd.GetMessageType())
+		if len(bytes.TrimSpace(body)) > 0 {
+			if err := sub.UnmarshalJSON(body); err != nil {
+				return fmt.Errorf("request body: %v", err)
+			}
+		}
+		if err := in.TrySetField(fd, sub); err != nil {
+			return err
+		}
+	}
+	for field, v := range vars {
+		if err := setFromStrings(in, field, []string{v}); err != nil {
+			return err
+		}
+	}
+	if rule.body != "*" {
+		for k, vs := range query {
+			if err := setFromStrings(in, k, vs); err != nil {
+				return fmt.Errorf("query parameter %s: %v", k, err)
+			}
+		}
+	}
+	return nil
+}
+
+// matchRule finds the binding for an HTTP request: the default POST to the
+// gRPC path first, then the annotated templates in method order
+func (g *webGateway) matchRule(r *http.Request) (*httpRule, map[string]string) {
+	if r.Method == http.MethodPost {
+		if _, ok := g.lookup(r.URL.Path); ok {
+			return &httpRule{method: r.URL.Path, verb: http.MethodPost, body: "*"}, nil
+		}
+	}
+	for _, rule := range g.rules {
+		if vars, ok := rule.match(r.Method, r.URL.EscapedPath()); ok {
+			return rule, vars
+		}
+	}
+	return nil, nil
+}
+
+func (g *webGateway) serveJSON(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	defer func() {
+		metrics.Inc("proxy_web_requests_total", Labels{"protocol": "json"})
+		metrics.ObserveDuration("proxy_web_request_duration_seconds", Labels{"protocol": "json"}, time.Since(start))
+	}()
+
+	rule, vars := g.matchRule(r)
+	if rule == nil {
+		writeJSONError(w, status.Newf(codes.NotFound, "no method is bound to %s %s", r.Method, r.URL.Path))
+		return
+	}
+	md, ok := g.lookup(rule.method)
+	if !ok {
+		writeJSONError(w, status.Newf(codes.Unimplemented, "no descriptor loaded for %s", rule.method))
+		return
+	}
+	if md.IsClientStreaming() || md.IsServerStreaming() {
+		writeJSONError(w, status.Newf(codes.Unimplemented, "%s streams; only unary methods can be called as JSON", rule.method))
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebRequestBytes))
+	if err != nil {
+		writeJSONError(w, status.Newf(codes.InvalidArgument, "read request: %v", err))
+		return
+	}
+	in := dynamic.NewMessage(md.GetInputType())
+	if err := rule.bind(in, body, vars, r.URL.Query()); err != nil {
+		writeJSONError(w, status.New(codes.InvalidArgument, err.Error()))
+		return
+	}
+	payload, err := marshalDynamic(in)
+	if err != nil {
+		writeJSONError(w, status.Newf(codes.Internal, "encode request: %v", err))
+		return
+	}
+
+	reply := g.invoke(r, rule.method, payload)
+	reply.forwardMetadata(w.Header())
+	if reply.status.Code() != codes.OK {
+		writeJSONError(w, reply.status)
+		return
+	}
+	out := dynamic.NewMessage(md.GetOutputType())
+	if err := out.Unmarshal(reply.message); err != nil {
+		writeJSONError(w, status.Newf(codes.Internal, "decode response: %v", err))
+		return
+	}
+	if rule.responseBody != "" {
+		fd := out.GetMessageDescriptor().FindFieldByName(rule.responseBody)
+		sub, _ := out.GetField(fd).(*dynamic.Message)
+		if sub == nil {
+			sub = dynamic.NewMessage(fd.GetMessageType())
+		}
+		out = sub
+	}
+	js, err := out.MarshalJSON()
+	if err != nil {
+		writeJSONError(w, status.Newf(codes.Internal, "encode response: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// unaryReply is what the gRPC server answered to a transcoded call
+type unaryReply struct {
+	header  http.Header // response headers as sent, before the trailers
+	trailer http.Header
+	message []byte
+	status  *status.Status
+}
+
+// invoke runs one unary call through the gRPC server. As with grpc-gateway,
+// only Authorization and Grpc-Metadata-* request headers become metadata.
+func (g *webGateway) invoke(r *http.Request, method string, payload []byte) *unaryReply {
+	frame := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	req := grpcRequest(r, method, "application/grpc", append(frame, payload...))
+
+	md := http.Header{}
+	for k, vv := range r.Header {
+		if k == "Authorization" || k == "Grpc-Timeout" {
+			md[k] = vv
+		} else if name, ok := strings.CutPrefix(k, "Grpc-Metadata-"); ok {
+			md[name] = vv
+		}
+	}
+	md.Set("Content-Type", "application/grpc")
+	req.Header = md
+
+	rec := &grpcRecorder{header: http.Header{}}
+	g.grpc.ServeHTTP(rec, req)
+	return rec.reply()
+}
+
+// grpcRecorder captures a complete gRPC response in memory
+type grpcRecorder struct {
+	header http.Header
+	sent   http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (r *grpcRecorder) Header() http.Header { return r.header }
+
+func (r *grpcRecorder) WriteHeader(code int) {
+	if r.sent == nil {
+		r.sent, r.code = r.header.Clone(), code
+	}
+}
+
+func (r *grpcRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(b)
+}
+
+func (r *grpcRecorder) Flush() { r.WriteHeader(http.StatusOK) }
+
+func (r *grpcRecorder) reply() *unaryReply {
+	reply := &unaryReply{header: r.sent, trailer: http.Header{}}
+	if reply.header == nil {
+		reply.header = http.Header{}
+	}
+	for k, vv := range r.header {
+		if name, ok := strings.CutPrefix(k, http.TrailerPrefix); ok {
+			reply.trailer[name] = vv
+		}
+	}
+
+	code, err := strconv.Atoi(r.header.Get("Grpc-Status"))
+	if err != nil {
+		// The server refused the request before it became a gRPC call
+		reply.status = status.Newf(codes.Internal, "HTTP %d: %s", r.code, strings.TrimSpace(r.body.String()))
+		return reply
+	}
+	msg, _ := url.PathUnescape(r.header.Get("Grpc-Message"))
+	reply.status = status.New(codes.Code(code), msg)
+
+	if b := r.body.Bytes(); len(b) >= 5 && b[0] == 0 {
+		if n := int(binary.BigEndian.Uint32(b[1:5])); len(b) >= 5+n {
+			reply.message = b[5 : 5+n]
+		}
+	}
+	return reply
+}
+
+// forwardMetadata exposes response headers and trailers in grpc-gateway's
+// Grpc-Metadata-* and Grpc-Trailer-* form
+func (reply *unaryReply) forwardMetadata(dst http.Header) {
+	for k, vv := range reply.header {
+		if k == "Content-Type" || k == "Trailer" || k == "Date" || strings.HasPrefix(k, "Grpc-") {
+			continue
+		}
+		dst["Grpc-Metadata-"+k] = vv
+	}
+	for k, vv := range reply.trailer {
+		dst["Grpc-Trailer-"+http.CanonicalHeaderKey(k)] = vv
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, st *status.Status) {
+	body, _ := json.Marshal(map[string]interface{}{"code": int(st.Code()), "message": st.Message()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatusFromCode(st.Code()))
+	w.Write(body)
+}
+
+// httpStatusFromCode follows the mapping used by grpc-gateway
+func httpStatusFromCode(c codes.Code) int {
+	switch c {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// loadHTTPRules indexes the google.api.http bindings of every loaded unary
+// method. Bad bindings are skipped with a warning; they come from the schema,
+// not from our config.
+func (px *Proxy) loadHTTPRules(diag *Diagnostics) []*httpRule {
+	if px.lazySchema != nil {
+		diag.Warnf("web", "WEB_HTTP_RULE", "web.json", "google.api.http bindings are not indexed with schema.lazy; only POST /<service>/<method> is transcoded")
+		return nil
+	}
+	names := px.knownMethods()
+	sort.Strings(names)
+	var rules []*httpRule
+	for _, name := range names {
+		md, _ := px.lookupMethod(name)
+		if md == nil || md.IsClientStreaming() || md.IsServerStreaming() {
+			continue
+		}
+		specs, err := httpRulesFromOptions(md)
+		if err != nil {
+			diag.Warnf("web", "WEB_HTTP_RULE", name, "unreadable google.api.http option: %v", err)
+			continue
+		}
+		for _, spec := range specs {
+			rule, err := newHTTPRule(name, md, spec)
+			if err != nil {
+				diag.Warnf("web", "WEB_HTTP_RULE", name, "skipping binding %s %s: %v", spec.verb, spec.path, err)
+				continue
+			}
+			rules = append(rules, rule)
+		}
+	}
+	log.Printf("[Web] Indexed %d google.api.http binding(s)", len(rules))
+	return rules
+}
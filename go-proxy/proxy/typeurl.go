@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"google.golang.org/grpc/codes"
+)
+
+// --- Type URL Policy ---
+//
+// The inner payload is decoded as whatever message its type_url names, which
+// the client chooses. A route's type_url_policy checks it on every request
+// before anything is decoded:
+//
+//	normalize  the type URL must be at most maxTypeURLLen bytes of UTF-8
+//	           without whitespace or control characters, hold a "/", and end
+//	           in a well-formed fully-qualified message name; its host, up to
+//	           the first "/", is lowercased
+//	empty      a missing or empty type_url is rejected unless allow_empty
+//	prefixes   when set, the normalized URL must start with one of them,
+//	           e.g. "type.googleapis.com/"
+//	allow      when set, the message name must be one of these
+//	deny       the message name must not be one of these
+//
+// A normalized type URL that differs from the one the client sent is written
+// back into the envelope, so the backend sees what was checked. A violation is
+// counted in proxy_type_url_violations_total by route and rule (empty,
+// too_long, whitespace, malformed, prefix, denied, not_allowed) and then
+// follows the route's on_decode_failure, like a message that does not decode:
+// reject fails the call with INVALID_ARGUMENT (TYPE_NOT_ALLOWED), pass
+// forwards it byte for byte, uninspected. Routes with validate_inner rules and
+// encrypt-payload routes always reject. Responses are not checked.
+
+// TypeURLPolicyConfig constrains the type_url of a route's requests
+type TypeURLPolicyConfig struct {
+	Prefixes   []string `yaml:"prefixes"`    // e.g. "type.googleapis.com/"; empty allows any
+	Allow      []string `yaml:"allow"`       // fully-qualified message names; empty allows any
+	Deny       []string `yaml:"deny"`        // fully-qualified message names
+	AllowEmpty bool     `yaml:"allow_empty"` // forward requests without a type_url unchecked
+}
+
+// maxTypeURLLen bounds the type URLs NormalizeTypeURL accepts
+const maxTypeURLLen = 2048
+
+// TypeURLError is why NormalizeTypeURL refused a type URL
+type TypeURLError struct {
+	Rule    string // empty, too_long, whitespace or malformed
+	Message string
+}
+
+func (e *TypeURLError) Error() string { return e.Message }
+
+func typeURLErrorf(rule, format string, args ...interface{}) *TypeURLError {
+	return &TypeURLError{Rule: rule, Message: fmt.Sprintf(format, args...)}
+}
+
+// NormalizeTypeURL checks that raw is a well-formed type URL and returns it
+// with its host lowercased, along with the message name it ends in
+func NormalizeTypeURL(raw string) (url, name string, err error) {
+	switch {
+	case raw == "":
+		return "", "", typeURLErrorf("empty", "type_url is empty")
+	case len(raw) > maxTypeURLLen:
+		return "", "", typeURLErrorf("too_long", "type_url is %d bytes, over the %d byte limit", len(raw), maxTypeURLLen)
+	case !utf8.ValidString(raw):
+		return "", "", typeURLErrorf("malformed", "type_url is not valid UTF-8")
+	}
+	for _, r := range raw {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return "", "", typeURLErrorf("whitespace", "type_url %q contains whitespace or control characters", raw)
+		}
+	}
+	slash := strings.LastIndexByte(raw, '/')
+	if slash < 0 {
+		return "", "", typeURLErrorf("malformed", "type_url %q has no \"/\" before the message name", raw)
+	}
+	name = raw[slash+1:]
+	if !validFullName(name) {
+		return "", "", typeURLErrorf("malformed", "type_url %q does not end in a message name", raw)
+	}
+	host, rest, _ := strings.Cut(raw, "/")
+	return strings.ToLower(host) + "/" + rest, name, nil
+}
+
+// validFullName reports whether name is dot-separated proto identifiers
+func validFullName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, part := range strings.Split(name, ".") {
+		if part == "" {
+			return false
+		}
+		for i, r := range part {
+			letter := r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+			if !letter && (i == 0 || r < '0' || r > '9') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// typeURLPolicy is a route's type_url_policy, parsed at startup
+type typeURLPolicy struct {
+	prefixes    []string
+	allow, deny map[string]bool // message names; an empty allow admits any
+	allowEmpty  bool
+}
+
+// check returns the normalized form of a request's type URL, or the rule it
+// breaks
+func (p *typeURLPolicy) check(typeURL string) (string, *TypeURLError) {
+	if typeURL == "" && p.allowEmpty {
+		return "", nil
+	}
+	url, name, err := NormalizeTypeURL(typeURL)
+	if err != nil {
+		return "", err.(*TypeURLError)
+	}
+	if len(p.prefixes) > 0 {
+		ok := false
+		for _, prefix := range p.prefixes {
+			ok = ok || strings.HasPrefix(url, prefix)
+		}
+		if !ok {
+			return "", typeURLErrorf("prefix", "type_url %q does not start with an allowed prefix", url)
+		}
+	}
+	if p.deny[name] {
+		return "", typeURLErrorf("denied", "inner type %s is denied on this route", name)
+	}
+	if len(p.allow) > 0 && !p.allow[name] {
+		return "", typeURLErrorf("not_allowed", "inner type %s is not allowed on this route", name)
+	}
+	return url, nil
+}
+
+// checkTypeURL applies route's type_url_policy to a request's type URL. It
+// returns the URL to use, or, on a violation, what processEnvelope returns:
+// the payload untouched under the pass policy, or the rejection.
+func (px *Proxy) checkTypeURL(route *RouteConfig, method, typeURL string, payload []byte) (string, []byte, error) {
+	p := px.routeTypeURLs[route.Name]
+	if p == nil {
+		return typeURL, nil, nil
+	}
+	url, verr := p.check(typeURL)
+	if verr == nil {
+		return url, nil, nil
+	}
+	policy := decodeFailurePolicy(route)
+	if route.Mode == "encrypt-payload" || px.routeInnerRules[route.Name] != nil {
+		policy = decodeFailureReject
+	}
+	metrics.Inc("proxy_type_url_violations_total", Labels{"route": route.Name, "rule": verr.Rule, "policy": policy, "shadow": shadowLabel(route)})
+	px.decodeLogs.printf(route.Name+" "+method+" type_url "+verr.Rule, "[Request Type URL] %s (route %s, %s): %v (policy: %s)", method, route.Name, verr.Rule, verr, policy)
+	if policy == decodeFailurePass {
+		return "", payload, nil
+	}
+	return "", nil, rejectf(codes.InvalidArgument, reasonTypeNotAllowed, "proxy: %v", verr).with("rule", verr.Rule)
+}
+
+// loadTypeURLPolicies parses type_url_policy
+func (px *Proxy) loadTypeURLPolicies(diag *Diagnostics) {
+	for i := range px.cfg.Routes {
+		route := &px.cfg.Routes[i]
+		cfg := route.TypeURLPolicy
+		if cfg == nil {
+			continue
+		}
+		path := fmt.Sprintf("routes[%d].type_url_policy", i)
+		if route.Mode == "pass-thru" || route.Mode == "local-reply" {
+			diag.Warnf("routes", "ROUTE_TYPE_URL", path, "has no effect on %s routes", route.Mode)
+			continue
+		}
+		complete := true
+		for _, v := range envelopeVariants(route) {
+			complete = complete && v.Envelope.TypeURLField != ""
+		}
+		if !complete {
+			diag.Errorf("routes", "ROUTE_TYPE_URL", path, "needs envelope.type_url_field")
+			continue
+		}
+		p := &typeURLPolicy{allow: map[string]bool{}, deny: map[string]bool{}, allowEmpty: cfg.AllowEmpty}
+		valid := true
+		for j, prefix := range cfg.Prefixes {
+			host, _, _ := strings.Cut(prefix, "/")
+			if !strings.HasSuffix(prefix, "/") || host != strings.ToLower(host) || strings.ContainsFunc(prefix, unicode.IsSpace) {
+				diag.Errorf("routes", "ROUTE_TYPE_URL", fmt.Sprintf("%s.prefixes[%d]", path, j), "prefix %q must end in \"/\" and have a lowercase host, e.g. \"type.googleapis.com/\"", prefix)
+				valid = false
+			}
+			p.prefixes = append(p.prefixes, prefix)
+		}
+		for _, list := range []struct {
+			key   string
+			names []string
+			into  map[string]bool
+		}{{"allow", cfg.Allow, p.allow}, {"deny", cfg.Deny, p.deny}} {
+			for j, name := range list.names {
+				if !validFullName(name) {
+					diag.Errorf("routes", "ROUTE_TYPE_URL", fmt.Sprintf("%s.%s[%d]", path, list.key, j), "%q is not a fully-qualified message name, e.g. \"echo.EchoRequest\"", name)
+					valid = false
+				}
+				list.into[name] = true
+			}
+		}
+		for name := range p.allow {
+			if p.deny[name] {
+				diag.Warnf("routes", "ROUTE_TYPE_URL", path+".allow", "%s is both allowed and denied; deny wins", name)
+			}
+		}
+		if _, dup := px.routeTypeURLs[route.Name]; valid && !dup {
+			px.routeTypeURLs[route.Name] = p
+			log.Printf("[Type URL Policy] Route %q: %d prefixes, %d allowed and %d denied types", route.Name, len(p.prefixes), len(p.allow), len(p.deny))
+		}
+	}
+}
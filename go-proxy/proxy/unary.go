@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// --- Unary Calls ---
+//
+// A call whose method descriptor says neither side streams skips the pumps.
+// Its one request is read and processed, sent to the backend with a single
+// Invoke on the endpoint's shared connection (still through bytesCodec), and
+// the processed response is written back with the backend's headers and
+// trailer, all on the handler's goroutine. Holding the request until the
+// backend has answered is what the unary features build on:
+//
+//	cache         a cached response is sent before any backend is picked
+//	retry         with buffer_unary every attempt replays the held request,
+//	              and per_attempt_timeout bounds the whole attempt; without
+//	              it only attempts that never reached the backend (no
+//	              connection, or no stream opened on one) are retried, or
+//	              failed over to another endpoint
+//	local-reply   is answered before the call gets here
+//	GOAWAY        a request the backend's GOAWAY cut off is replayed on a new
+//	              connection; see goaway.go
+//	mirror        a picked request is copied to the mirror once, before any
+//	              retry
+//
+// Streaming methods, and methods the proxy has no descriptor for, still go
+// through the pumps.
+
+// proxyUnary handles one unary call from its request to its response
+func (px *Proxy) proxyUnary(ctx context.Context, method string, route *RouteConfig, policy *retryPolicy, timings *callTimings, serverStream grpc.ServerStream, tc *metadataContext) error {
+	reqPump := px.newPump(ctx, method, true, route, timings)
+	respPump := px.newPump(ctx, method, false, route, timings)
+	reqPump.capture = px.newCallCapture(method, route)
+	respPump.capture = reqPump.capture
+
+	var req []byte
+	if err := serverStream.RecvMsg(&req); err != nil {
+		if err == io.EOF {
+			return rejectf(codes.Internal, reasonMalformedCall, "proxy: unary call closed without a request")
+		}
+		return err
+	}
+	reqPump.received(req)
+	reqSize := len(req)
+	req, err := reqPump.process(req)
+	if err != nil {
+		return err
+	}
+	timings.markRequestComplete()
+
+	cache := px.routeCaches[route.Name]
+	var cacheKey string
+	if cache != nil {
+		cacheKey = responseCacheKey(ctx, method, req)
+		if hit, ok := cache.get(cacheKey, time.Now()); ok {
+			log.Printf("[Cache] Answered %s from the route %q cache", method, route.Name)
+			if err := serverStream.SendHeader(hit.header.Copy()); err != nil {
+				return err
+			}
+			resp := hit.resp
+			if err := serverStream.SendMsg(&resp); err != nil {
+				return err
+			}
+			respPump.sent(-1, len(resp)) // never received from the backend
+			return nil
+		}
+	}
+
+	px.routeMirrors[route.Name].unary(ctx, method, req)
+	res, err := px.invokeUnary(proxySigsFrom(ctx).outgoing(ctx), method, policy, req, timings)
+	if res != nil {
+		route.ResponseMetadata.apply(res.header, tc)
+		route.ResponseMetadata.apply(res.trailer, tc)
+		serverStream.SetTrailer(res.trailer)
+	}
+	if res != nil {
+		reqPump.sent(reqSize, len(req)) // the backend answered it
+	}
+	if err != nil {
+		if res != nil && len(res.header) > 0 {
+			// The backend's header goes out with its status, as it would
+			// have reached a client calling the backend directly
+			serverStream.SetHeader(res.header)
+		}
+		return err
+	}
+	respPump.received(res.resp)
+	respSize := len(res.resp)
+	resp, err := respPump.process(res.resp)
+	if err != nil {
+		return err
+	}
+	copiedHeadersFrom(ctx).mergeInto(res.header)
+	proxySigsFrom(ctx).setTrailer(serverStream)
+	// A response faults may have damaged is not kept
+	if cache != nil && callFaultsFrom(ctx) == nil {
+		cache.put(cacheKey, resp, res.header, time.Now())
+	}
+	if err := serverStream.SendHeader(res.header); err != nil {
+		return err
+	}
+	if err := serverStream.SendMsg(&resp); err != nil {
+		return err
+	}
+	respPump.sent(respSize, len(resp))
+	return nil
+}
+
+// invokeUnary sends the processed request to the backend under the route's
+// retry policy, failing over between endpoints within each attempt
+func (px *Proxy) invokeUnary(ctx context.Context, method string, policy *retryPolicy, req []byte, timings *callTimings) (*unaryResult, error) {
+	var timeout time.Duration
+	if policy.bufferUnary {
+		timeout = policy.perAttemptTimeout
+	}
+	// A backend that got the request may have acted on it, answered or not,
+	// so only a buffered call is sent again once it may have arrived
+	failover := func(err error) bool {
+		return isConnectionFailure(err) && (policy.bufferUnary || neverSent(err))
+	}
+	attempt, replays := 1, 0
+	for {
+		var res *unaryResult
+		err := px.withFailover(func(ep *endpoint) (err error) {
+			res, err = px.unaryAttempt(ctx, ep, method, timeout, req, timings)
+			return err
+		}, failover)
+		// One a GOAWAY cut off never reached the backend's handler
+		switch {
+		case err != nil && res == nil && px.replayAfterRestart(ctx, method, &replays, err):
+		case err != nil && (policy.bufferUnary || neverSent(err)) && policy.shouldRetry(ctx, method, attempt, err):
+			attempt++
+		default:
+			return res, err
+		}
+	}
+}
+
+// unsentError is a unary attempt that failed before its request could reach
+// the backend: no connection was had, or no stream opened on it
+type unsentError struct {
+	error
+}
+
+func (e *unsentError) Unwrap() error { return e.error }
+
+func (e *unsentError) GRPCStatus() *status.Status { return status.Convert(e.error) }
+
+// neverSent reports whether err is from an attempt whose request provably
+// never reached the backend
+func neverSent(err error) bool {
+	var unsent *unsentError
+	return errors.As(err, &unsent)
+}
+
+// unaryResult is what a finished unary attempt returned. It is also set on
+// failure once the backend answered, so its header and trailer reach the
+// client.
+type unaryResult struct {
+	resp    []byte
+	header  metadata.MD
+	trailer metadata.MD
+}
+
+// unaryAttempt runs one full request/response exchange. Here the per-attempt
+// timeout bounds the whole attempt, since nothing has reached the client yet.
+func (px *Proxy) unaryAttempt(ctx context.Context, ep *endpoint, method string, timeout time.Duration, req []byte, timings *callTimings) (*unaryResult, error) {
+	attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+	if timeout > 0 {
+		attemptCtx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+
+	res, err := px.exchangeUnary(attemptCtx, ep, method, req, timings)
+	if err != nil && timeout > 0 && ctx.Err() == nil && attemptCtx.Err() == context.DeadlineExceeded {
+		return nil, &attemptTimeoutError{timeout}
+	}
+	return res, err
+}
+
+// exchangeUnary invokes the method on the endpoint's shared connection. A
+// connection-level failure drops that connection, as dialUpstream does.
+func (px *Proxy) exchangeUnary(ctx context.Context, ep *endpoint, method string, req []byte, timings *callTimings) (*unaryResult, error) {
+	conn, err := px.conns.acquire(ep)
+	if err != nil {
+		return nil, &unsentError{err}
+	}
+
+	var resp []byte
+	var header, trailer metadata.MD
+	// grpc only fills in the peer once it has opened the call's stream
+	var sentTo peer.Peer
+	opts := append(px.upstreamCallOptions(ctx), grpc.Header(&header), grpc.Trailer(&trailer), grpc.Peer(&sentTo))
+	timings.markRequestSent()
+	err = conn.conn.Invoke(ctx, method, &req, &resp, opts...)
+	// Only a backend that answered sends headers or a trailer
+	answered := header != nil || len(trailer) > 0
+	px.conns.release(conn, err != nil && !answered && isConnectionFailure(err))
+	if s := status.Convert(err); s.Code() == codes.Internal && strings.HasPrefix(s.Message(), "cardinality violation") {
+		err = rejectf(codes.Internal, reasonBackendProtocol, "proxy: backend broke the unary call: %s", s.Message())
+	}
+	if err != nil && !answered {
+		if sentTo.Addr == nil {
+			return nil, &unsentError{err}
+		}
+		return nil, err
+	}
+	if header == nil {
+		header = metadata.MD{}
+	}
+	if trailer == nil {
+		trailer = metadata.MD{}
+	}
+	if err != nil {
+		resp = nil
+	}
+	return &unaryResult{resp: resp, header: header, trailer: trailer}, err
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/anthony/grpc-proxy/api/echo"
+	"google.golang.org/grpc"
+)
+
+// benchBackend answers UnaryEcho with the request's message, and
+// ServerStreamingEcho with it repeated
+type benchBackend struct {
+	echo.UnimplementedEchoServiceServer
+}
+
+func (benchBackend) UnaryEcho(_ context.Context, req *echo.EchoRequest) (*echo.EchoResponse, error) {
+	return &echo.EchoResponse{Message: req.Message}, nil
+}
+
+func (benchBackend) ServerStreamingEcho(req *echo.EchoRequest, stream echo.EchoService_ServerStreamingEchoServer) error {
+	for i := int32(0); i < max(req.Repeat, 1); i++ {
+		if err := stream.Send(&echo.EchoResponse{Message: req.Message}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BenchmarkUnaryPassThru makes whole unary calls through a pass-thru route,
+// which take the Invoke path rather than the pumps
+func BenchmarkUnaryPassThru(b *testing.B) {
+	conn := serveTestProxy(b, []RouteConfig{{Name: "pass-thru", Match: "/echo.EchoService/*", Mode: "pass-thru"}}, func(s *grpc.Server) {
+		echo.RegisterEchoServiceServer(s, benchBackend{})
+	}, 0)
+	client := echo.NewEchoServiceClient(conn)
+	ctx := context.Background()
+	req := &echo.EchoRequest{Message: "bench"}
+	// The first call dials the proxy and the backend
+	if _, err := client.UnaryEcho(ctx, req); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.UnaryEcho(ctx, req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
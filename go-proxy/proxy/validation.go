@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc/codes"
+)
+
+// innerRules is a route's inner payload policy, parsed at startup
+type innerRules struct {
+	decode  bool            // validate_inner: the payload must decode as its declared type
+	allowed map[string]bool // full type URLs and bare type names; empty allows any
+	require [][]string      // field paths that must be present in the decoded payload
+}
+
+// innerReasons is the ErrorInfo reason for each validation metric reason
+var innerReasons = map[string]string{
+	"envelope":         reasonEnvelopeUndecodable,
+	"type_not_allowed": reasonTypeNotAllowed,
+	"unknown_type":     reasonUnknownType,
+	"decode":           reasonPayloadUndecodable,
+	"missing_field":    reasonMissingField,
+}
+
+// innerRejection is returned to the client as INVALID_ARGUMENT
+func innerRejection(route *RouteConfig, reason, format string, args ...interface{}) error {
+	metrics.Inc("proxy_validation_rejections_total", Labels{"route": route.Name, "reason": reason, "shadow": shadowLabel(route)})
+	return rejectf(codes.InvalidArgument, innerReasons[reason], "proxy: "+format, args...)
+}
+
+// typeName is the part of a type URL after the last slash
+func typeName(typeURL string) string {
+	return typeURL[strings.LastIndex(typeURL, "/")+1:]
+}
+
+// typeNameMatches reports whether the message named fqn is the one a type URL
+// names: the full name, or a suffix of it starting at a package boundary. An
+// empty name (a type URL of just "/") matches nothing.
+func typeNameMatches(fqn, name string) bool {
+	return name != "" && (fqn == name || strings.HasSuffix(fqn, "."+name))
+}
+
+// checkEnvelope rejects requests whose outer envelope did not decode; without
+// it there is nothing to validate
+func (px *Proxy) checkEnvelope(route *RouteConfig, err error) error {
+	if px.routeInnerRules[route.Name] == nil {
+		return nil
+	}
+	return innerRejection(route, "envelope", "request envelope does not decode: %v", err)
+}
+
+// checkInner applies the route's inner payload rules to one request. inner is
+// nil when no descriptor matched the type URL; decodeErr is the unmarshal
+// error when one did.
+func (px *Proxy) checkInner(route *RouteConfig, typeURL string, inner *dynamic.Message, decodeErr error) error {
+	r := px.routeInnerRules[route.Name]
+	if r == nil {
+		return nil
+	}
+	if len(r.allowed) > 0 && !r.allowed[typeURL] && !r.allowed[typeName(typeURL)] {
+		if typeURL == "" {
+			return innerRejection(route, "type_not_allowed", "request carries no type_url")
+		}
+		return innerRejection(route, "type_not_allowed", "inner type %q is not allowed on this route", typeURL)
+	}
+	if !r.decode {
+		return nil
+	}
+	switch {
+	case typeURL == "":
+		return innerRejection(route, "unknown_type", "request carries no type_url")
+	case inner == nil:
+		return innerRejection(route, "unknown_type", "inner type %q is not in the loaded schema", typeURL)
+	case decodeErr != nil:
+		return innerRejection(route, "decode", "payload does not decode as %s: %v", typeURL, decodeErr)
+	}
+	for _, path := range r.require {
+		if !hasFieldPath(inner, path) {
+			return innerRejection(route, "missing_field", "%s is missing required field %s", typeURL, strings.Join(path, "."))
+		}
+	}
+	return nil
+}
+
+// hasFieldPath reports whether every field along path is present. Under
+// proto3 a scalar holding its zero value counts as absent, as on the wire.
+func hasFieldPath(msg *dynamic.Message, path []string) bool {
+	for i, name := range path {
+		fd := msg.GetMessageDescriptor().FindFieldByName(name)
+		if fd == nil || !msg.HasField(fd) {
+			return false
+		}
+		if i == len(path)-1 {
+			return true
+		}
+		sub, ok := msg.GetField(fd).(*dynamic.Message)
+		if !ok || sub == nil {
+			return false
+		}
+		msg = sub
+	}
+	return true
+}
+
+// loadInnerValidation parses validate_inner, allowed_types and require_fields
+func (px *Proxy) loadInnerValidation(diag *Diagnostics) {
+	for i, route := range px.cfg.Routes {
+		if !route.ValidateInner && len(route.AllowedTypes) == 0 && len(route.RequireFields) == 0 {
+			continue
+		}
+		path := fmt.Sprintf("routes[%d]", i)
+		if route.Mode == "pass-thru" {
+			diag.Warnf("routes", "ROUTE_VALIDATION", path+".mode", "validate_inner, allowed_types and require_fields have no effect on pass-thru routes")
+			continue
+		}
+		complete := true
+		for _, v := range envelopeVariants(&route) {
+			complete = complete && v.Envelope.TypeURLField != "" && v.Envelope.PayloadField != ""
+		}
+		if !complete {
+			diag.Errorf("routes", "ROUTE_VALIDATION", path+".envelope", "inner payload validation needs envelope.payload_field and envelope.type_url_field")
+			continue
+		}
+		if len(route.RequireFields) > 0 && !route.ValidateInner {
+			diag.Errorf("routes", "ROUTE_VALIDATION", path+".require_fields", "require_fields needs validate_inner: true")
+			continue
+		}
+
+		r := &innerRules{decode: route.ValidateInner, allowed: map[string]bool{}}
+		for _, t := range route.AllowedTypes {
+			r.allowed[t] = true
+		}
+		valid := true
+		for j, f := range route.RequireFields {
+			parts := strings.Split(f, ".")
+			for _, p := range parts {
+				if p == "" {
+					diag.Errorf("routes", "ROUTE_VALIDATION", fmt.Sprintf("%s.require_fields[%d]", path, j), "malformed field path %q", f)
+					valid = false
+					break
+				}
+			}
+			r.require = append(r.require, parts)
+		}
+		if _, dup := px.routeInnerRules[route.Name]; valid && !dup {
+			px.routeInnerRules[route.Name] = r
+		}
+	}
+}
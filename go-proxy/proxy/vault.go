@@ -0,0 +1,345 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Vault ---
+//
+// vault:// secrets (secrets.go) are read from HashiCorp Vault over its HTTP
+// API, as cms.vault says:
+//
+//	address         e.g. https://vault:8200; default $VAULT_ADDR
+//	namespace       sent as X-Vault-Namespace, for Vault Enterprise
+//	ca_file         CA bundle for Vault's certificate
+//	timeout         per request; default 10s
+//	token           a Vault token; default token_file, then $VAULT_TOKEN
+//	role_id         log in with AppRole instead, with the secret id read
+//	secret_id_file  from this file, or $VAULT_SECRET_ID
+//	auth_mount      where AppRole is mounted; default approle
+//
+// The proxy logs in when it reads its first vault:// secret, and failing to
+// log in fails startup like a missing key file. A token with a TTL is kept
+// alive: at two thirds of its TTL it is renewed while renewable, and with
+// AppRole, a token that cannot be renewed, or whose renewal fails, is
+// replaced by logging in again. A failed attempt is retried every 10s.
+// Attempts are counted in proxy_vault_token_renewals_total by result
+// (renewed, login, failed).
+
+// VaultConfig is how vault:// secrets reach Vault
+type VaultConfig struct {
+	Address      string `yaml:"address"`
+	Namespace    string `yaml:"namespace"`
+	CAFile       string `yaml:"ca_file"`
+	Timeout      string `yaml:"timeout"`
+	Token        string `yaml:"token"`
+	TokenFile    string `yaml:"token_file"`
+	RoleID       string `yaml:"role_id"`
+	SecretIDFile string `yaml:"secret_id_file"`
+	AuthMount    string `yaml:"auth_mount"`
+}
+
+const (
+	defaultVaultTimeout = 10 * time.Second
+	vaultRetryInterval  = 10 * time.Second
+)
+
+// vaultClient holds a Vault token and keeps it alive
+type vaultClient struct {
+	cfg     VaultConfig
+	address string
+	http    *http.Client
+	timeout time.Duration
+
+	mu        sync.Mutex
+	token     string
+	ttl       time.Duration // 0 for a token that does not expire
+	renewable bool
+}
+
+// vaultAuth is the auth block of a login or renewal, and lookup-self's data
+type vaultAuth struct {
+	ClientToken   string `json:"client_token"`
+	LeaseDuration int    `json:"lease_duration"`
+	TTL           int    `json:"ttl"`
+	Renewable     bool   `json:"renewable"`
+}
+
+type vaultResponse struct {
+	Auth   *vaultAuth             `json:"auth"`
+	Data   map[string]interface{} `json:"data"`
+	Errors []string               `json:"errors"`
+}
+
+// vaultClient logs in to Vault on first use, then shares the client
+func (px *Proxy) vaultClient() (*vaultClient, error) {
+	px.vaultOnce.Do(func() {
+		c, err := newVaultClient(px.cfg.CMS.Vault)
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+			err = c.login(ctx)
+			cancel()
+		}
+		if err != nil {
+			px.vaultErr = fmt.Errorf("vault: %v", err)
+			return
+		}
+		px.vault = c
+		go c.keepAlive(px.stop)
+	})
+	return px.vault, px.vaultErr
+}
+
+func newVaultClient(cfg *VaultConfig) (*vaultClient, error) {
+	if cfg == nil {
+		cfg = &VaultConfig{}
+	}
+	c := &vaultClient{cfg: *cfg, address: cfg.Address, timeout: defaultVaultTimeout}
+	if c.address == "" {
+		c.address = os.Getenv("VAULT_ADDR")
+	}
+	if c.address == "" {
+		return nil, errors.New("no cms.vault.address or VAULT_ADDR")
+	}
+	c.address = strings.TrimSuffix(c.address, "/")
+	if cfg.Timeout != "" {
+		d, err := time.ParseDuration(cfg.Timeout)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid cms.vault.timeout %q", cfg.Timeout)
+		}
+		c.timeout = d
+	}
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CAFile != "" {
+		pool, err := loadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+	c.http = &http.Client{Transport: transport}
+	return c, nil
+}
+
+// login gets a token: by AppRole, or the configured one, whose TTL and
+// renewability lookup-self tells
+func (c *vaultClient) login(ctx context.Context) error {
+	if c.cfg.RoleID != "" {
+		secretID := os.Getenv("VAULT_SECRET_ID")
+		if c.cfg.SecretIDFile != "" {
+			b, err := os.ReadFile(c.cfg.SecretIDFile)
+			if err != nil {
+				return err
+			}
+			secretID = strings.TrimSpace(string(b))
+		}
+		mount := c.cfg.AuthMount
+		if mount == "" {
+			mount = "approle"
+		}
+		var resp vaultResponse
+		if err := c.do(ctx, http.MethodPost, "auth/"+mount+"/login", "", map[string]string{"role_id": c.cfg.RoleID, "secret_id": secretID}, &resp); err != nil {
+			return fmt.Errorf("approle login: %v", err)
+		}
+		if resp.Auth == nil || resp.Auth.ClientToken == "" {
+			return errors.New("approle login returned no token")
+		}
+		c.setToken(resp.Auth.ClientToken, resp.Auth.LeaseDuration, resp.Auth.Renewable)
+		return nil
+	}
+	token := c.cfg.Token
+	if token == "" && c.cfg.TokenFile != "" {
+		b, err := os.ReadFile(c.cfg.TokenFile)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	if token == "" {
+		return errors.New("no cms.vault token, token_file, role_id or VAULT_TOKEN")
+	}
+	var resp vaultResponse
+	if err := c.do(ctx, http.MethodGet, "auth/token/lookup-self", token, nil, &resp); err != nil {
+		log.Printf("[Vault] Could not look up the token, so it is not renewed: %v", err)
+		c.setToken(token, 0, false)
+		return nil
+	}
+	ttl, _ := resp.Data["ttl"].(float64)
+	renewable, _ := resp.Data["renewable"].(bool)
+	c.setToken(token, int(ttl), renewable)
+	return nil
+}
+
+func (c *vaultClient) setToken(token string, ttl int, renewable bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token, c.ttl, c.renewable = token, time.Duration(ttl)*time.Second, renewable
+}
+
+func (c *vaultClient) renew(ctx context.Context) error {
+	c.mu.Lock()
+	token := c.token
+	c.mu.Unlock()
+	var resp vaultResponse
+	if err := c.do(ctx, http.MethodPost, "auth/token/renew-self", token, struct{}{}, &resp); err != nil {
+		return err
+	}
+	if resp.Auth == nil {
+		return errors.New("renewal returned no auth")
+	}
+	c.setToken(token, resp.Auth.LeaseDuration, resp.Auth.Renewable)
+	return nil
+}
+
+// keepAlive renews or replaces the token before it expires, until stop
+func (c *vaultClient) keepAlive(stop <-chan struct{}) {
+	for {
+		c.mu.Lock()
+		ttl, renewable := c.ttl, c.renewable
+		c.mu.Unlock()
+		approle := c.cfg.RoleID != ""
+		if ttl == 0 || (!renewable && !approle) {
+			return // does not expire, or nothing can be done when it does
+		}
+		wait := ttl * 2 / 3
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(wait):
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+			result, err := "renewed", errors.New("not renewable")
+			if renewable {
+				err = c.renew(ctx)
+			}
+			if err != nil && approle {
+				result, err = "login", c.login(ctx)
+			}
+			cancel()
+			if err != nil {
+				result = "failed"
+				log.Printf("[Vault] Could not renew the token, retrying in %s: %v", vaultRetryInterval, err)
+			}
+			metrics.Inc("proxy_vault_token_renewals_total", Labels{"result": result})
+			if err == nil {
+				break
+			}
+			wait = vaultRetryInterval
+		}
+	}
+}
+
+// read returns the data of the secret at path, logging in again once when
+// an AppRole token was refused
+func (c *vaultClient) read(ctx context.Context, path string) (map[string]interface{}, error) {
+	for attempt := 0; ; attempt++ {
+		c.mu.Lock()
+		token := c.token
+		c.mu.Unlock()
+		var resp vaultResponse
+		err := c.do(ctx, http.MethodGet, path, token, nil, &resp)
+		var status vaultStatusError
+		if err != nil && errors.As(err, &status) && status == http.StatusForbidden && c.cfg.RoleID != "" && attempt == 0 {
+			if err := c.login(ctx); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if resp.Data == nil {
+			return nil, fmt.Errorf("%s holds no data", path)
+		}
+		return resp.Data, nil
+	}
+}
+
+// vaultStatusError is a refusal by Vault, for read to tell a refused token
+type vaultStatusError int
+
+func (e vaultStatusError) Error() string { return fmt.Sprintf("HTTP %d", int(e)) }
+
+func (c *vaultClient) do(ctx context.Context, method, path, token string, body, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, c.address+"/v1/"+strings.TrimPrefix(path, "/"), r)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if c.cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.cfg.Namespace)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var v vaultResponse
+		if json.Unmarshal(b, &v) == nil && len(v.Errors) > 0 {
+			return fmt.Errorf("%s %s: %w: %s", method, path, vaultStatusError(resp.StatusCode), strings.Join(v.Errors, "; "))
+		}
+		return fmt.Errorf("%s %s: %w", method, path, vaultStatusError(resp.StatusCode))
+	}
+	return json.Unmarshal(b, out)
+}
+
+// vaultSecret is one field of a Vault secret, read again on every check
+type vaultSecret struct {
+	client      *vaultClient
+	path, field string
+}
+
+func (s *vaultSecret) Read(ctx context.Context) ([]byte, error) {
+	data, err := s.client.read(ctx, s.path)
+	if err != nil {
+		return nil, fmt.Errorf("vault: %v", err)
+	}
+	// KV version 2 nests the secret under data, beside its metadata
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	v, ok := data[s.field].(string)
+	if !ok {
+		return nil, fmt.Errorf("vault: %s has no string field %q", s.path, s.field)
+	}
+	return []byte(v), nil
+}
+
+func (s *vaultSecret) Changed(ctx context.Context) (bool, error) { return true, nil }
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// --- Verify Before Connect ---
+//
+// An inspect-verify-sign route opens the backend call as soon as the client
+// does, so the backend learns of a call, and its method, even when the first
+// message would not verify. verify_before_connect holds the backend back:
+//
+//	awaiting    the backend is not dialled; the client's first message is
+//	            read and held
+//	verifying   the message is decoded and its client signature checked with
+//	            the route's request verify verb, as a session-token route does
+//	connected   only now is the backend call opened; the held message goes
+//	            through the pump first, where it is signed like any other
+//
+// A client that half-closes before sending anything, and a first message that
+// is missing its signature, does not decode or does not verify, end the call
+// with UNAUTHENTICATED (INVALID_ARGUMENT when it does not decode) and no
+// backend connection is ever made. Unlike the route's usual verification,
+// which rejects a signature that does not verify but forwards one that is
+// missing, the first message must carry one that verifies; later messages are
+// verified as before. The pump does not verify the held message
+// a second time. Each outcome is counted in proxy_deferred_connects_total by
+// route and result: connected or rejected.
+//
+// A unary call is held until its request is processed anyway; with the flag
+// its request must verify in the same way.
+
+// verifyBeforeConnect reads and verifies the first message of a call on a
+// verify_before_connect route. It returns the context the pumps run with,
+// which marks the message verified, and the client stream with the message
+// put back in front.
+func (px *Proxy) verifyBeforeConnect(ctx context.Context, method string, route *RouteConfig, src grpc.ServerStream) (context.Context, grpc.ServerStream, error) {
+	var first []byte
+	if err := src.RecvMsg(&first); err != nil {
+		if err == io.EOF {
+			metrics.Inc("proxy_deferred_connects_total", Labels{"route": route.Name, "result": "rejected"})
+			return nil, nil, rejectf(codes.Unauthenticated, reasonSignatureMissing, "proxy: the stream ended before its first message")
+		}
+		return nil, nil, err
+	}
+	release, err := px.cpuClasses[route.CPUClass].acquire(ctx, route)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+	if _, err := px.verifyFirst(ctx, method, route, first); err != nil {
+		metrics.Inc("proxy_deferred_connects_total", Labels{"route": route.Name, "result": "rejected"})
+		px.audit(ctx, method, route, true, auditEvent{op: "reject", decision: status.Code(err).String(), reason: status.Convert(err).Message(), payload: first})
+		return nil, nil, err
+	}
+	metrics.Inc("proxy_deferred_connects_total", Labels{"route": route.Name, "result": "connected"})
+	log.Printf("[Verify Before Connect] %s: first message verified; opening the backend call", method)
+	ctx = context.WithValue(ctx, preverifiedKey{}, &preverified{wire: first})
+	return ctx, &replayFirstStream{ServerStream: src, first: first}, nil
+}
+
+// preverified is the first message verifyBeforeConnect checked, which the
+// pump's clientVerifier then skips once
+type preverified struct {
+	mu   sync.Mutex
+	wire []byte
+}
+
+type preverifiedKey struct{}
+
+// take reports whether wire is the verified message, the first time it is
+func (p *preverified) take(wire []byte) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.wire == nil || !bytes.Equal(p.wire, wire) {
+		return false
+	}
+	p.wire = nil
+	return true
+}
+
+func preverifiedFrom(ctx context.Context) *preverified {
+	p, _ := ctx.Value(preverifiedKey{}).(*preverified)
+	return p
+}
+
+// loadVerifyBeforeConnect checks the routes with verify_before_connect
+func (px *Proxy) loadVerifyBeforeConnect(diag *Diagnostics) {
+	for i, route := range px.cfg.Routes {
+		if !route.VerifyBeforeConnect {
+			continue
+		}
+		path := fmt.Sprintf("routes[%d].verify_before_connect", i)
+		switch {
+		case route.Mode == "session-token":
+			diag.Warnf("routes", "ROUTE_VERIFY_BEFORE_CONNECT", path, "session-token routes always verify before connecting")
+		case route.Mode != "inspect-verify-sign":
+			diag.Errorf("routes", "ROUTE_VERIFY_BEFORE_CONNECT", path, "only inspect-verify-sign routes verify client signatures")
+		case route.Shadow:
+			diag.Errorf("routes", "ROUTE_VERIFY_BEFORE_CONNECT", path, "shadow routes never reject, so cannot hold the backend back")
+		case px.cryptoPlanFor(&px.cfg.Routes[i]).request.verify == verbNone:
+			diag.Errorf("routes", "ROUTE_VERIFY_BEFORE_CONNECT", path, "needs requests verified; request.verify cannot be none")
+		case decodeFailurePolicy(&px.cfg.Routes[i]) != decodeFailureReject:
+			diag.Errorf("routes", "ROUTE_VERIFY_BEFORE_CONNECT", path, "a first message that cannot decode cannot verify; on_decode_failure must be reject")
+		}
+	}
+}
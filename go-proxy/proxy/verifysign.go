@@ -0,0 +1,277 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc/codes"
+)
+
+// --- Built-in Verify and Sign Processors ---
+//
+// inspect-verify-sign runs these around the route's mutations and processors;
+// see processors.go for the order. What each verifies and signs with comes
+// from the route's request and response verbs; see directions.go.
+
+// backendVerifier attests response envelopes that carry a backend signature.
+// A response that may not be countersigned is forwarded with the route's
+// mutations applied and without running anything after it.
+type backendVerifier struct{ px *Proxy }
+
+func (v backendVerifier) Process(ctx context.Context, info MethodInfo, dir Direction, msg *dynamic.Message) (Action, error) {
+	route := info.Route
+	if dir == ClientToBackend || route.Envelope.BackendSigField == "" || !v.px.cryptoPlanFor(route).response.verifies() {
+		return Continue(), nil
+	}
+	payloadBytes := getBytesField(msg, info.envelope.payload)
+	countersign, err := v.px.verifyBackendSig(ctx, msg, info, payloadBytes)
+	if err != nil || countersign {
+		return Continue(), err
+	}
+	var out []byte
+	if route.PreserveWireBytes {
+		out, err = spliceEnvelope(info.wire, msg, info.envelope)
+	} else {
+		v.px.mutateEnvelope(msg, route, false, dir.label(), info.Method)
+		out, err = marshalDynamic(msg)
+	}
+	if err != nil {
+		return Continue(), err
+	}
+	return ReplaceBytes(out), nil
+}
+
+// clientVerifier checks the client signature over the payload, or over each
+// item of a batch envelope. A signature that does not verify is audited and
+// rejects the message UNAUTHENTICATED (SIGNATURE_INVALID), so the proxy never
+// countersigns it; a shadow route counts the rejection and forwards.
+type clientVerifier struct{ px *Proxy }
+
+func (v clientVerifier) Process(ctx context.Context, info MethodInfo, dir Direction, msg *dynamic.Message) (Action, error) {
+	px, route := v.px, info.Route
+	plan := px.cryptoPlanFor(route).request
+	if plan.verify == verbNone || (plan.verifies() && dir == BackendToClient) {
+		return Continue(), nil // a named trust store checks requests only
+	}
+	if dir == ClientToBackend && preverifiedFrom(ctx).take(info.wire) {
+		return Continue(), nil // verified before the backend call was opened
+	}
+	if info.envelope.items != nil {
+		if dir == BackendToClient {
+			return Continue(), nil // batch items are verified on requests
+		}
+		return Continue(), px.verifyItems(ctx, info, msg)
+	}
+	verified, err := px.verifyClientSig(ctx, info, dir, getBytesField(msg, info.envelope.payload), info.envelope.clientSigOf(ctx, msg, dir == ClientToBackend))
+	if err != nil || verified == nil {
+		return Continue(), err
+	}
+	if err := px.audit(ctx, info.Method, route, dir == ClientToBackend, *verified); err != nil {
+		return Continue(), err
+	}
+	if verified.decision == "failed" {
+		return Continue(), rejectf(codes.Unauthenticated, reasonSignatureInvalid, "proxy: client signature does not verify")
+	}
+	return Continue(), nil
+}
+
+// verifyClientSig checks a client signature over payload as the route's
+// request plan says, returning the event to audit. A nil event means the
+// call ended before the check started, or the engine failed it.
+func (px *Proxy) verifyClientSig(ctx context.Context, info MethodInfo, dir Direction, payloadBytes, clientSig []byte) (*auditEvent, error) {
+	route, label := info.Route, dir.label()
+	plan := px.cryptoPlanFor(route).request
+	verifySpan := startChildSpan(ctx, "proxy.verify", spanKindInternal)
+	verifySpan.set("proxy.direction", strings.ToLower(label))
+	if plan.verifies() {
+		verified, err := px.verifyTrusted(ctx, route, plan.trust, label, payloadBytes, info.digests.of(payloadBytes), clientSig)
+		if err != nil {
+			verifySpan.end(err)
+			return nil, skipCancelled(ctx, route, dir == ClientToBackend, "verify")
+		}
+		if verified.decision == "failed" {
+			px.sigDebug.report(sigMismatch{
+				info: info, isReq: dir == ClientToBackend, signer: "client", engine: px.engineFor(route).name(),
+				payload: payloadBytes, digest: info.digests.of(payloadBytes), sig: clientSig,
+				sigSource: sigFieldSource(info.envelope, info.envelope.clientSigHeader, true),
+				store:     plan.trust.name, keyPEMs: plan.trust.load().pems,
+			})
+		}
+		metrics.Inc("proxy_signature_verifications_total", Labels{"signer": "client", "result": verified.decision, "tenant": info.Tenant, "shadow": shadowLabel(route)})
+		verifySpan.end(nil)
+		return &verified, nil
+	}
+	anchor := px.clientTrustFor(ctx, route)
+	verified := auditEvent{op: "verify", signer: "client", decision: "missing", payload: payloadBytes, clientSig: clientSig, keyID: anchor.keyID()}
+
+	if clientSig != nil && anchor != nil {
+		e := px.engineFor(route)
+		key, result, err := e.verifyClient(ctx, anchor, info.digests.of(payloadBytes), clientSig)
+		if err != nil {
+			verifySpan.end(err)
+			return nil, skipCancelled(ctx, route, dir == ClientToBackend, "verify")
+		}
+		verified.decision = result
+		switch result {
+		case "ok", "failed":
+			countCrypto(e, "verify")
+			metrics.Inc("proxy_signature_verifications_total", Labels{"signer": "client", "result": result, "tenant": info.Tenant, "shadow": shadowLabel(route)})
+			if key != "" {
+				verified.keyID = key
+				log.Printf("[%s Security] %s engine verified signature (len: %d) against payload (len: %d)", label, e.name(), len(clientSig), len(payloadBytes))
+			} else {
+				log.Printf("[%s Security Error] %s engine signature verification failed!", label, e.name())
+				store := "client_trust_store"
+				if anchor.name != "" {
+					store = "trust domain " + anchor.name
+				}
+				px.sigDebug.report(sigMismatch{
+					info: info, isReq: dir == ClientToBackend, signer: "client", engine: e.name(),
+					payload: payloadBytes, digest: info.digests.of(payloadBytes), sig: clientSig,
+					sigSource: sigFieldSource(info.envelope, info.envelope.clientSigHeader, true),
+					store:     store, keyPEMs: anchor.load().keyPEMs,
+				})
+			}
+		case "unverified":
+			log.Printf("[%s Security] Verifying signature (len: %d) against payload (len: %d)", label, len(clientSig), len(payloadBytes))
+		default:
+			log.Printf("[%s Security] NO client signature or trust store configured.", label)
+		}
+	} else {
+		log.Printf("[%s Security] NO client signature or trust store configured.", label)
+		if clientSig != nil {
+			verified.decision = "unconfigured"
+		}
+	}
+	verifySpan.end(nil)
+	return &verified, nil
+}
+
+// proxySigner signs the payload as it stands after every earlier step and
+// puts the signature in envelope.proxy_sig_field; batch envelopes are signed
+// as batch.go describes
+type proxySigner struct{ px *Proxy }
+
+func (s proxySigner) Process(ctx context.Context, info MethodInfo, dir Direction, msg *dynamic.Message) (Action, error) {
+	px, route, label := s.px, info.Route, dir.label()
+	plan := px.cryptoPlanFor(route).of(dir == ClientToBackend)
+	if !plan.signs {
+		return Continue(), nil
+	}
+	key := plan.key
+	if dir == BackendToClient {
+		var err error
+		if key, err = px.responseKey(ctx, route, plan.key); err != nil {
+			return Continue(), err
+		}
+		if err := px.stampKeyID(route, msg, key); err != nil {
+			log.Printf("[%s Security Error] Could not set the signing key id: %v", label, err)
+		}
+	}
+	payloadBytes := getBytesField(msg, info.envelope.payload)
+	if info.envelope.items != nil {
+		if perItemSigned(route.Envelope) {
+			return Continue(), px.signItems(ctx, info, dir, key, msg)
+		}
+		payloadBytes = batchDigest(msg, info.envelope)
+	}
+	att := attestationFromContext(ctx)
+	if dir == BackendToClient {
+		att = nil
+	}
+	if len(payloadBytes) == 0 && info.envelope.items == nil {
+		sign, err := px.emptyPayload(route, info, dir, msg)
+		if err != nil || (!sign && att == nil) {
+			return Continue(), err
+		}
+	}
+	if att != nil {
+		att.add(payloadBytes) // signed once, at the half-close
+		return Continue(), nil
+	}
+	signed := auditEvent{op: "sign", signer: "proxy", payload: payloadBytes}
+
+	signSpan := startChildSpan(ctx, "proxy.sign", spanKindInternal)
+	proxySigBytes, decision, err := px.signPayload(ctx, route, key, label, info.digests.of(payloadBytes))
+	signSpan.set("proxy.direction", strings.ToLower(label))
+	signSpan.end(err)
+	if err != nil {
+		return Continue(), skipCancelled(ctx, route, dir == ClientToBackend, "sign")
+	}
+	signed.decision, signed.keyID = decision, key.id()
+	if err := px.audit(ctx, info.Method, route, dir == ClientToBackend, signed); err != nil {
+		return Continue(), err
+	}
+	if decision != "signed" {
+		return Continue(), rejectf(codes.Internal, reasonSigningFailed, "proxy: could not sign the %s payload", strings.ToLower(label))
+	}
+
+	// The route may send it in metadata instead, leaving the envelope alone
+	if route.Envelope.ProxySigMetadataKey != "" {
+		proxySigsFrom(ctx).add(dir == ClientToBackend, proxySigBytes)
+		return Continue(), nil
+	}
+	// Or appends it to the list earlier proxies signed into
+	if info.envelope.proxySigList != nil {
+		if err := appendProxySig(msg, info.envelope.proxySigList, key.id(), proxySigBytes); err != nil {
+			log.Printf("[%s Security Error] Could not append to the proxy signature list: %v", label, err)
+		}
+		return Continue(), nil
+	}
+	// Inject the new Proxy Signature back into the dynamic message
+	if err := setEnvelopeField(msg, info.envelope.proxySig, proxySigBytes); err != nil {
+		log.Printf("[%s Security Error] Could not set proxy signature field: %v", label, err)
+	}
+	return Continue(), nil
+}
+
+// signPayload signs a payload, which may be empty, by its digest with key on
+// route's engine, returning the signature and the audit decision: signed or
+// failed. An error means the call ended before signing started.
+func (px *Proxy) signPayload(ctx context.Context, route *RouteConfig, key *signingKey, label string, digest payloadDigest) ([]byte, string, error) {
+	e := px.engineFor(route)
+	if key == nil {
+		log.Printf("[%s Security Error] No signing key loaded", label)
+		return nil, "failed", nil
+	}
+	log.Printf("[%s Security] Generating RSA-SHA256 signature with %s on the %s engine", label, key.name, e.name())
+	sig, err := e.sign(ctx, key, digest)
+	if ctxErr := ctx.Err(); ctxErr != nil && errors.Is(err, ctxErr) {
+		return nil, "", err
+	}
+	countCrypto(e, "sign")
+	if err != nil {
+		log.Printf("[%s Security Error] Failed to sign payload: %v", label, err)
+		return nil, "failed", nil
+	}
+	return sig, "signed", nil
+}
+
+// verifyTrusted checks a request's client signature over payload, whose
+// digest the caller has, against a named trust store, returning the audit
+// event: ok, failed or missing. An error means the call ended before the
+// check started.
+func (px *Proxy) verifyTrusted(ctx context.Context, route *RouteConfig, trust *trustKeys, label string, payload []byte, digest payloadDigest, sig []byte) (auditEvent, error) {
+	ev := auditEvent{op: "verify", signer: "client", decision: "missing", payload: payload, clientSig: sig}
+	if sig == nil {
+		log.Printf("[%s Security Error] No client signature to verify against %s", label, trust.name)
+		return ev, nil
+	}
+	e := px.engineFor(route)
+	keyID, err := e.verifyKeys(ctx, trust, digest, sig)
+	if err != nil {
+		return ev, err
+	}
+	countCrypto(e, "verify")
+	if ev.keyID = keyID; ev.keyID != "" {
+		ev.decision = "ok"
+		log.Printf("[%s Security] %s engine verified signature (len: %d) against %s", label, e.name(), len(sig), trust.name)
+	} else {
+		ev.decision = "failed"
+		log.Printf("[%s Security Error] %s engine found no key in %s that verifies the signature", label, e.name(), trust.name)
+	}
+	return ev, nil
+}
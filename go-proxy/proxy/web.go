@@ -0,0 +1,369 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+)
+
+// --- Browser Gateway ---
+//
+// A second listener for clients that cannot speak native gRPC. A gRPC-Web
+// request is rewritten into an ordinary gRPC request and handed to the proxy's
+// own grpc.Server through ServeHTTP, so it runs through transparentHandler
+// like any other call: routes, limits, inspection and signing all apply. With
+// json enabled, unary methods can also be called as plain HTTP/JSON (see
+// transcode.go).
+
+// WebConfig enables the gRPC-Web listener when ListenAddress is set. It
+// reuses the TLS settings of the first TCP listener, and
+// server.trusted_upstreams, when they are configured.
+type WebConfig struct {
+	ListenAddress string     `yaml:"listen_address"`
+	JSON          bool       `yaml:"json"` // HTTP/JSON transcoding for unary methods
+	CORS          CORSConfig `yaml:"cors"`
+}
+
+// CORSConfig controls which browser origins may call the web listener
+type CORSConfig struct {
+	AllowedOrigins   []string `yaml:"allowed_origins"` // exact origins, or "*" for any
+	AllowedHeaders   []string `yaml:"allowed_headers"` // in addition to the gRPC-Web request headers
+	ExposedHeaders   []string `yaml:"exposed_headers"` // in addition to grpc-status and grpc-message
+	AllowCredentials bool     `yaml:"allow_credentials"`
+	MaxAge           string   `yaml:"max_age"` // preflight cache lifetime, e.g. "10m"
+}
+
+const (
+	grpcWebContentType     = "application/grpc-web"
+	grpcWebTextContentType = "application/grpc-web-text"
+
+	maxWebRequestBytes = 4 << 20 // matches the gRPC server's default receive limit
+)
+
+var (
+	corsRequestHeaders = []string{"content-type", "x-grpc-web", "x-user-agent", "grpc-timeout", "authorization"}
+	corsExposedHeaders = []string{"grpc-status", "grpc-message", "grpc-status-details-bin"}
+
+	// Connection-level headers that must not turn into gRPC metadata
+	hopByHopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Transfer-Encoding", "Upgrade", "Content-Length"}
+)
+
+type corsPolicy struct {
+	anyOrigin     bool
+	origins       map[string]bool
+	allowHeaders  string
+	exposeHeaders string
+	credentials   bool
+	maxAge        string
+}
+
+// webGateway serves gRPC-Web and HTTP/JSON in front of the gRPC server
+type webGateway struct {
+	addr  string
+	json  bool
+	cors  corsPolicy
+	rules []*httpRule
+	grpc  http.Handler
+
+	lookup func(method string) (*desc.MethodDescriptor, bool)
+	srv    *http.Server
+}
+
+func (g *webGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+	if !g.cors.apply(w, r, preflight) && preflight {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	if preflight {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	switch ct := r.Header.Get("Content-Type"); {
+	case strings.HasPrefix(ct, grpcWebContentType):
+		g.serveGRPCWeb(w, r)
+	case g.json:
+		g.serveJSON(w, r)
+	default:
+		http.Error(w, "expected a gRPC-Web request", http.StatusUnsupportedMediaType)
+	}
+}
+
+// apply sets the CORS response headers for an allowed origin and reports
+// whether the origin is allowed. Requests without an Origin are not CORS.
+func (c *corsPolicy) apply(w http.ResponseWriter, r *http.Request, preflight bool) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if !c.anyOrigin && !c.origins[origin] {
+		return false
+	}
+	h := w.Header()
+	if c.anyOrigin && !c.credentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Add("Vary", "Origin")
+	}
+	if c.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if preflight {
+		h.Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		h.Set("Access-Control-Allow-Headers", c.allowHeaders)
+		if c.maxAge != "" {
+			h.Set("Access-Control-Max-Age", c.maxAge)
+		}
+	} else {
+		h.Set("Access-Control-Expose-Headers", c.exposeHeaders)
+	}
+	return true
+}
+
+// grpcRequest clones r as an HTTP/2 gRPC request for method carrying body,
+// which must already be in gRPC length-prefixed framing
+func grpcRequest(r *http.Request, method, contentType string, body []byte) *http.Request {
+	req := r.Clone(r.Context())
+	req.Method = http.MethodPost
+	req.URL.Path, req.URL.RawPath, req.URL.RawQuery = method, "", ""
+	req.ProtoMajor, req.ProtoMinor, req.Proto = 2, 0, "HTTP/2.0"
+	for _, h := range hopByHopHeaders {
+		req.Header.Del(h)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.ContentLength = int64(len(body))
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return req
+}
+
+func (g *webGateway) serveGRPCWeb(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	ct := r.Header.Get("Content-Type")
+	text := strings.HasPrefix(ct, grpcWebTextContentType)
+	protocol, subtype := "grpc-web", strings.TrimPrefix(ct, grpcWebContentType)
+	if text {
+		protocol, subtype = "grpc-web-text", strings.TrimPrefix(ct, grpcWebTextContentType)
+	}
+	defer func() {
+		metrics.Inc("proxy_web_requests_total", Labels{"protocol": protocol})
+		metrics.ObserveDuration("proxy_web_request_duration_seconds", Labels{"protocol": protocol}, time.Since(start))
+	}()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "gRPC-Web requests must be POST", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebRequestBytes))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("read request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if text {
+		if body, err = decodeBase64Chunks(body); err != nil {
+			http.Error(w, fmt.Sprintf("decode grpc-web-text body: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	rw := &grpcWebResponse{w: w, header: http.Header{}, contentType: ct, text: text}
+	g.grpc.ServeHTTP(rw, grpcRequest(r, r.URL.Path, "application/grpc"+subtype, body))
+	rw.finish()
+}
+
+// grpcWebResponse adapts the gRPC server's HTTP/2 response to gRPC-Web: the
+// trailers, which HTTP/1.1 cannot carry, are sent as a final frame flagged
+// 0x80, and grpc-web-text bodies are base64 encoded write by write.
+type grpcWebResponse struct {
+	w           http.ResponseWriter
+	header      http.Header // what the gRPC server writes; trailers land here after the headers
+	contentType string
+	text        bool
+	wroteHeader bool
+}
+
+func (r *grpcWebResponse) Header() http.Header { return r.header }
+
+func (r *grpcWebResponse) WriteHeader(code int) {
+	if r.wroteHeader {
+		return
+	}
+	r.wroteHeader = true
+	dst := r.w.Header()
+	for k, vv := range r.header {
+		if k == "Trailer" || strings.HasPrefix(k, http.TrailerPrefix) {
+			continue
+		}
+		dst[k] = vv
+	}
+	dst.Set("Content-Type", r.contentType)
+	dst.Del("Content-Length")
+	r.w.WriteHeader(code)
+}
+
+func (r *grpcWebResponse) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	if r.text {
+		if _, err := io.WriteString(r.w, base64.StdEncoding.EncodeToString(b)); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	return r.w.Write(b)
+}
+
+func (r *grpcWebResponse) Flush() {
+	r.WriteHeader(http.StatusOK)
+	if f, ok := r.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish writes the trailer frame once the gRPC server is done with the call.
+// Trailers are the declared keys (grpc-status and friends, set after the
+// headers went out) plus any sent under http.TrailerPrefix.
+func (r *grpcWebResponse) finish() {
+	declared := map[string]bool{}
+	for _, v := range r.header.Values("Trailer") {
+		for _, k := range strings.Split(v, ",") {
+			declared[http.CanonicalHeaderKey(strings.TrimSpace(k))] = true
+		}
+	}
+	var trailer bytes.Buffer
+	for k, vv := range r.header {
+		name, ok := strings.CutPrefix(k, http.TrailerPrefix)
+		if !ok && !declared[k] {
+			continue
+		}
+		for _, v := range vv {
+			fmt.Fprintf(&trailer, "%s: %s\r\n", strings.ToLower(name), v)
+		}
+	}
+	frame := make([]byte, 5, 5+trailer.Len())
+	frame[0] = 0x80
+	binary.BigEndian.PutUint32(frame[1:], uint32(trailer.Len()))
+	r.Write(append(frame, trailer.Bytes()...))
+	r.Flush()
+}
+
+// decodeBase64Chunks decodes a grpc-web-text body, which may be several
+// padded base64 strings back to back
+func decodeBase64Chunks(b []byte) ([]byte, error) {
+	b = bytes.Join(bytes.Fields(b), nil)
+	if len(b)%4 != 0 {
+		return nil, fmt.Errorf("length %d is not a multiple of 4", len(b))
+	}
+	out := make([]byte, 0, base64.StdEncoding.DecodedLen(len(b)))
+	var group [3]byte
+	for ; len(b) > 0; b = b[4:] {
+		n, err := base64.StdEncoding.Decode(group[:], b[:4])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, group[:n]...)
+	}
+	return out, nil
+}
+
+// webTLSConfig derives the web listener's TLS config from the gRPC listener's,
+// adding http/1.1 for browsers that do not negotiate h2
+func webTLSConfig(base *tls.Config) *tls.Config {
+	withHTTP1 := func(c *tls.Config) *tls.Config {
+		c = c.Clone()
+		if !slices.Contains(c.NextProtos, "http/1.1") {
+			c.NextProtos = append(slices.Clone(c.NextProtos), "http/1.1")
+		}
+		return c
+	}
+	cfg := withHTTP1(base)
+	if get := cfg.GetConfigForClient; get != nil {
+		// Ticket key rotation serves handshakes from a separate config
+		cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			c, err := get(hello)
+			if err != nil || c == nil {
+				return c, err
+			}
+			return withHTTP1(c), nil
+		}
+	}
+	return cfg
+}
+
+// start serves the gateway in front of handler, with the same TLS and CIDR
+// restrictions as the gRPC listener
+func (g *webGateway) start(handler http.Handler, listenerTLS *tls.Config, nets []*net.IPNet) error {
+	g.grpc = handler
+	lis, err := net.Listen("tcp", g.addr)
+	if err != nil {
+		return fmt.Errorf("failed listening for web clients: %w", err)
+	}
+	if len(nets) > 0 {
+		lis = &cidrListener{Listener: lis, nets: nets}
+	}
+	scheme := "http"
+	if listenerTLS != nil {
+		lis = tls.NewListener(lis, webTLSConfig(listenerTLS))
+		scheme = "https"
+	}
+
+	g.srv = &http.Server{Handler: g, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		log.Printf("Web gateway listening on %s://%s (json: %v)", scheme, lis.Addr(), g.json)
+		if err := g.srv.Serve(lis); err != nil && err != http.ErrServerClosed {
+			log.Printf("web gateway stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// loadWebGateway validates the web block and, for JSON transcoding, indexes
+// the HTTP rules of every loaded unary method
+func (px *Proxy) loadWebGateway(diag *Diagnostics) *webGateway {
+	cfg := px.cfg.Web
+	if cfg.ListenAddress == "" {
+		return nil
+	}
+	g := &webGateway{addr: cfg.ListenAddress, json: cfg.JSON, lookup: px.lookupMethod}
+
+	c := cfg.CORS
+	g.cors.credentials = c.AllowCredentials
+	g.cors.origins = map[string]bool{}
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			g.cors.anyOrigin = true
+			continue
+		}
+		g.cors.origins[strings.TrimSuffix(o, "/")] = true
+	}
+	g.cors.allowHeaders = strings.Join(append(slices.Clone(corsRequestHeaders), c.AllowedHeaders...), ", ")
+	g.cors.exposeHeaders = strings.Join(append(slices.Clone(corsExposedHeaders), c.ExposedHeaders...), ", ")
+	if c.MaxAge != "" {
+		d, err := time.ParseDuration(c.MaxAge)
+		if err != nil || d < 0 {
+			diag.Errorf("web", "WEB_CORS", "web.cors.max_age", "invalid duration %q", c.MaxAge)
+			return nil
+		}
+		g.cors.maxAge = strconv.Itoa(int(d.Seconds()))
+	}
+	if g.cors.anyOrigin && g.cors.credentials {
+		diag.Warnf("web", "WEB_CORS", "web.cors.allowed_origins", `"*" with allow_credentials echoes every origin back; list origins explicitly`)
+	}
+
+	if g.json {
+		g.rules = px.loadHTTPRules(diag)
+	}
+	return g
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"fmt"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// --- Wire-Preserving Envelopes ---
+//
+// An inspect-verify-sign route decodes each envelope into a dynamic message
+// and marshals it again to forward it. The payload and client signature
+// survive that byte for byte: they are bytes fields, which the dynamic
+// message holds as opaque slices and writes back as they came. What may
+// change is the rest of the encoding: field order, the order of map entries
+// such as metadata, where unknown fields land, and how repeated scalars are
+// packed. Signatures over the payload are unaffected, but a party that hashes
+// or signs the whole envelope sees different bytes.
+//
+// preserve_wire_bytes forwards the envelope exactly as it arrived instead,
+// except for the fields the proxy owns: every occurrence of the proxy
+// signature field (and of the backend signature field on responses) is cut
+// out, and the values the proxy settled on are appended at the end. A
+// message with nothing to re-sign is forwarded untouched. Since the route
+// may then not edit anything else, mutations, copy_grpc_metadata_to_envelope,
+// bind_transport_identity and processors are refused on it at startup.
+
+// spliceEnvelope returns wire, the encoding msg was decoded from, with the
+// proxy's fields of env replaced by their values in msg
+func spliceEnvelope(wire []byte, msg *dynamic.Message, env *resolvedEnvelope) ([]byte, error) {
+	owned := []*desc.FieldDescriptor{}
+	for _, fd := range []*desc.FieldDescriptor{env.proxySig, env.backendSig, env.proxySigList} {
+		if fd != nil {
+			owned = append(owned, fd)
+		}
+	}
+	drop := map[protowire.Number]bool{}
+	for _, fd := range owned {
+		drop[protowire.Number(fd.GetNumber())] = true
+	}
+
+	out := make([]byte, 0, len(wire)+512)
+	for b := wire; len(b) > 0; {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("proxy: splice envelope: %w", protowire.ParseError(n))
+		}
+		m := protowire.ConsumeFieldValue(num, typ, b[n:])
+		if m < 0 {
+			return nil, fmt.Errorf("proxy: splice envelope: %w", protowire.ParseError(m))
+		}
+		if !drop[num] {
+			out = append(out, b[:n+m]...)
+		}
+		b = b[n+m:]
+	}
+
+	// Encode the owned fields through a message of the same type, so they
+	// take the encoding a full marshal would give them
+	tail := dynamic.NewMessage(msg.GetMessageDescriptor())
+	for _, fd := range owned {
+		if msg.HasField(fd) {
+			if err := tail.TrySetField(fd, msg.GetField(fd)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	b, err := marshalDynamic(tail)
+	if err != nil {
+		return nil, err
+	}
+	return append(out, b...), nil
+}
+
+// loadWirePreservation checks the routes with preserve_wire_bytes, which
+// cannot forward edits to anything but the proxy's own fields
+func (px *Proxy) loadWirePreservation(diag *Diagnostics) {
+	for i, route := range px.cfg.Routes {
+		if !route.PreserveWireBytes {
+			continue
+		}
+		path := fmt.Sprintf("routes[%d].preserve_wire_bytes", i)
+		if route.Mode != "inspect-verify-sign" {
+			diag.Warnf("routes", "ROUTE_PRESERVE_WIRE_BYTES", path, "has no effect on %s routes", route.Mode)
+			continue
+		}
+		if len(route.Mutations) > 0 {
+			diag.Errorf("routes", "ROUTE_PRESERVE_WIRE_BYTES", path, "cannot be combined with mutations")
+		}
+		if len(route.CopyGRPCMetadataToEnvelope) > 0 {
+			diag.Errorf("routes", "ROUTE_PRESERVE_WIRE_BYTES", path, "cannot be combined with copy_grpc_metadata_to_envelope")
+		}
+		if route.BindTransportIdentity {
+			diag.Errorf("routes", "ROUTE_PRESERVE_WIRE_BYTES", path, "cannot be combined with bind_transport_identity")
+		}
+		if len(route.Processors) > 0 {
+			diag.Errorf("routes", "ROUTE_PRESERVE_WIRE_BYTES", path, "cannot be combined with processors, whose edits would not be forwarded")
+		}
+	}
+}
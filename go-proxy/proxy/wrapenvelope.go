@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/grpc/codes"
+)
+
+// --- Wrapped Envelopes ---
+//
+// While clients migrate to envelopes, a backend that already takes them can
+// go first behind a wrap-envelope route. The proxy's schema describes the
+// methods as the old clients call them, with bare messages; wrap says what
+// the backend takes instead:
+//
+//	envelope_type    the envelope the backend expects, e.g. echo.SecureEnvelope
+//	response_type    the envelope it answers with; default envelope_type
+//	type_url_prefix  default type.googleapis.com/
+//	sign             none (default), proxy_key or a cms.keys name
+//	strict           check each bare message parses as the method's type
+//
+// Each request, as it came, becomes envelope.payload_field of a new
+// envelope_type message, with envelope.type_url_field set to type_url_prefix
+// and the method's input type, and, when sign names a key, the proxy's
+// signature over it in envelope.proxy_sig_field. Responses are unwrapped,
+// the inverse: only the bytes of the backend envelope's payload_field reach
+// the client. It works message by message, so streams of any shape are
+// wrapped and unwrapped alike. With strict, a request that does not parse as
+// the method's input type fails with INVALID_ARGUMENT before it is wrapped,
+// and a response payload that does not parse as its output type, or whose
+// type URL names another type, fails the call with INTERNAL. Without it, the
+// bytes are moved as they are. A message whose envelope cannot be built or
+// read always fails with ENVELOPE_UNDECODABLE. Messages are counted in
+// proxy_wrapped_messages_total by route and op (wrap, unwrap).
+
+// WrapConfig is the envelope a wrap-envelope route puts bare messages into
+type WrapConfig struct {
+	EnvelopeType  string `yaml:"envelope_type"`
+	ResponseType  string `yaml:"response_type"`
+	TypeURLPrefix string `yaml:"type_url_prefix"`
+	Sign          string `yaml:"sign"`
+	Strict        bool   `yaml:"strict"`
+}
+
+const defaultTypeURLPrefix = "type.googleapis.com/"
+
+// envelopeWrapper is a WrapConfig resolved at startup
+type envelopeWrapper struct {
+	request, response *resolvedEnvelope
+	prefix            string
+	key               *signingKey // nil to forward unsigned
+	strict            bool
+}
+
+// wrapEnvelope wraps a request in the route's envelope, or unwraps a response
+func (px *Proxy) wrapEnvelope(ctx context.Context, method string, isReq bool, payload []byte, route *RouteConfig) ([]byte, error) {
+	w := px.routeWrappers[route.Name]
+	if w == nil {
+		return nil, rejectf(codes.Internal, reasonEnvelopeUndecodable, "proxy: route has no wrap envelope")
+	}
+	md, ok := px.lookupMethod(method)
+	if !ok && (w.strict || (isReq && w.request.typeURL != nil)) {
+		return px.decodeFailed(route, method, isReq, decodeNoDescriptor, payload, fmt.Errorf("no descriptor loaded for %s", method))
+	}
+	if !isReq {
+		return px.unwrapResponse(route, method, md, w, payload)
+	}
+
+	if w.strict {
+		in := md.GetInputType()
+		if err := px.guardDecode(route, method, "request", in, payload); err != nil {
+			return nil, err
+		}
+		if err := dynamic.NewMessage(in).Unmarshal(payload); err != nil {
+			return px.decodeFailed(route, method, true, decodeUnmarshalError, payload, fmt.Errorf("request is not a %s: %v", in.GetFullyQualifiedName(), err))
+		}
+	}
+	env := dynamic.NewMessage(w.request.msg)
+	err := setEnvelopeField(env, w.request.payload, payload)
+	if err == nil && w.request.typeURL != nil {
+		err = setEnvelopeField(env, w.request.typeURL, w.prefix+md.GetInputType().GetFullyQualifiedName())
+	}
+	if err != nil {
+		return px.decodeFailed(route, method, true, decodeWrongType, payload, fmt.Errorf("cannot wrap into %s: %v", w.request.msg.GetFullyQualifiedName(), err))
+	}
+	if w.key != nil {
+		sig, decision, err := px.signPayload(ctx, route, w.key, "Request", sha256.Sum256(payload))
+		if err != nil {
+			return nil, skipCancelled(ctx, route, true, "sign")
+		}
+		if err := px.audit(ctx, method, route, true, auditEvent{op: "sign", signer: "proxy", decision: decision, payload: payload, keyID: w.key.id()}); err != nil {
+			return nil, err
+		}
+		if decision != "signed" {
+			return nil, rejectf(codes.Internal, reasonSigningFailed, "proxy: could not sign the wrapped request")
+		}
+		if err := setEnvelopeField(env, w.request.proxySig, sig); err != nil {
+			return nil, rejectf(codes.Internal, reasonSigningFailed, "proxy: could not set the proxy signature: %v", err)
+		}
+	}
+	out, err := marshalDynamic(env)
+	if err != nil {
+		return nil, rejectf(codes.Internal, reasonEnvelopeUndecodable, "proxy: could not encode the wrapped request: %v", err)
+	}
+	log.Printf("[Request Wrapped] %s: %d bytes into a %s", method, len(payload), w.request.msg.GetFullyQualifiedName())
+	metrics.Inc("proxy_wrapped_messages_total", Labels{"route": route.Name, "op": "wrap", "shadow": shadowLabel(route)})
+	return out, nil
+}
+
+// unwrapResponse returns the payload of the backend's response envelope
+func (px *Proxy) unwrapResponse(route *RouteConfig, method string, md *desc.MethodDescriptor, w *envelopeWrapper, payload []byte) ([]byte, error) {
+	env := dynamic.NewMessage(w.response.msg)
+	if err := env.Unmarshal(payload); err != nil {
+		return px.decodeFailed(route, method, false, decodeUnmarshalError, payload, fmt.Errorf("response is not a %s: %v", w.response.msg.GetFullyQualifiedName(), err))
+	}
+	inner := getBytesField(env, w.response.payload)
+	if inner == nil {
+		inner = []byte{}
+	}
+	if w.strict {
+		out := md.GetOutputType()
+		if url := getStringField(env, w.response.typeURL); url != "" && !typeNameMatches(out.GetFullyQualifiedName(), typeName(url)) {
+			return nil, rejectf(codes.Internal, reasonBackendProtocol, "proxy: backend response carries %s, not a %s", url, out.GetFullyQualifiedName())
+		}
+		if err := dynamic.NewMessage(out).Unmarshal(inner); err != nil {
+			return px.decodeFailed(route, method, false, decodeUnmarshalError, payload, fmt.Errorf("response payload is not a %s: %v", out.GetFullyQualifiedName(), err))
+		}
+	}
+	log.Printf("[Response Unwrapped] %s: %d bytes out of a %s", method, len(inner), w.response.msg.GetFullyQualifiedName())
+	metrics.Inc("proxy_wrapped_messages_total", Labels{"route": route.Name, "op": "unwrap", "shadow": shadowLabel(route)})
+	return inner, nil
+}
+
+// loadWrapEnvelopes resolves each wrap-envelope route's envelope types and key
+func (px *Proxy) loadWrapEnvelopes(diag *Diagnostics) {
+	for i := range px.cfg.Routes {
+		route := &px.cfg.Routes[i]
+		path := fmt.Sprintf("routes[%d]", i)
+		if route.Mode != "wrap-envelope" {
+			if route.Wrap != nil {
+				diag.Warnf("routes", "ROUTE_WRAP", path+".wrap", "has no effect on %s routes", route.Mode)
+			}
+			continue
+		}
+		cfg := route.Wrap
+		if cfg == nil || cfg.EnvelopeType == "" {
+			diag.Errorf("routes", "ROUTE_WRAP", path+".wrap.envelope_type", "mode wrap-envelope needs the envelope type the backend takes")
+			continue
+		}
+		w := &envelopeWrapper{prefix: cfg.TypeURLPrefix, strict: cfg.Strict}
+		if w.prefix == "" {
+			w.prefix = defaultTypeURLPrefix
+		}
+		ok := true
+		e := route.Envelope
+		if e.PayloadField == "" {
+			diag.Errorf("routes", "ROUTE_WRAP", path+".envelope.payload_field", "mode wrap-envelope needs the envelope field the bare message goes into")
+			ok = false
+		}
+		responseType := cfg.ResponseType
+		if responseType == "" {
+			responseType = cfg.EnvelopeType
+		}
+		for _, t := range []struct {
+			key, name string
+			into      **resolvedEnvelope
+			fields    []envelopeField
+		}{
+			{"envelope_type", cfg.EnvelopeType, &w.request, []envelopeField{
+				{"payload_field", e.PayloadField, "bytes", false},
+				{"type_url_field", e.TypeURLField, "string", false},
+				{"proxy_sig_field", e.ProxySigField, "bytes", false},
+			}},
+			{"response_type", responseType, &w.response, []envelopeField{
+				{"payload_field", e.PayloadField, "bytes", false},
+				{"type_url_field", e.TypeURLField, "string", false},
+			}},
+		} {
+			md := px.findDescByType(t.name)
+			if md == nil {
+				diag.Errorf("routes", "ROUTE_WRAP", path+".wrap."+t.key, "no message type %q in the loaded schema", t.name)
+				ok = false
+				continue
+			}
+			for _, f := range t.fields {
+				if f.name == "" {
+					continue
+				}
+				if err := checkEnvelopeField(md, f.name, f.kind, e.AllowTypeCoercion); err != nil {
+					diag.Errorf("routes", "ROUTE_WRAP", path+".envelope."+f.key, "%q on %s: %v", f.name, md.GetFullyQualifiedName(), err)
+					ok = false
+				}
+			}
+			*t.into = resolveEnvelope(e, md)
+		}
+		switch cfg.Sign {
+		case "", verbNone:
+		case verbProxyKey:
+			if w.key = px.proxyKey; w.key == nil {
+				diag.Errorf("routes", "ROUTE_WRAP", path+".wrap.sign", "proxy_key needs cms.proxy_private_key")
+				ok = false
+			}
+		default:
+			if w.key = px.namedKeys[cfg.Sign]; w.key == nil {
+				diag.Errorf("routes", "ROUTE_WRAP", path+".wrap.sign", "no cms.keys entry named %q", cfg.Sign)
+				ok = false
+			}
+		}
+		if w.key != nil && e.ProxySigField == "" {
+			diag.Errorf("routes", "ROUTE_WRAP", path+".envelope.proxy_sig_field", "wrap.sign needs the envelope field the proxy signature goes into")
+			ok = false
+		}
+		for _, refused := range []struct {
+			set  bool
+			name string
+		}{
+			{len(route.Envelopes) > 0, "envelopes"},
+			{len(route.Mutations) > 0, "mutations"},
+			{len(route.Processors) > 0, "processors"},
+			{route.BindTransportIdentity, "bind_transport_identity"},
+			{len(route.CopyGRPCMetadataToEnvelope) > 0 || len(route.CopyEnvelopeMetadataToGRPC) > 0, "metadata copies"},
+			{route.ValidateInner || len(route.AllowedTypes) > 0 || len(route.RequireFields) > 0, "inner payload rules"},
+			{route.PreserveWireBytes, "preserve_wire_bytes"},
+			{route.Shadow, "shadow"},
+		} {
+			if refused.set {
+				diag.Errorf("routes", "ROUTE_WRAP", path, "wrap-envelope routes build their envelopes and cannot have %s", refused.name)
+				ok = false
+			}
+		}
+		if _, dup := px.routeWrappers[route.Name]; ok && !dup {
+			px.routeWrappers[route.Name] = w
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// Package sessiontoken mints and checks the short-lived tokens the proxy
+// sends a backend on session-token routes, in place of signing each message.
+//
+// Such a route verifies the client signature on the first message of each
+// stream and, when it verifies, opens the backend call with a token in the
+// x-proxy-attestation header (configurable) vouching for the stream; every
+// message is then forwarded untouched. The token is a JWT signed with RS256,
+// RSA PKCS#1 v1.5 over SHA-256, by the proxy's signing key: dot-separated
+// base64url header, claims and signature. A backend checks it with the
+// proxy's public key:
+//
+//	claims, err := sessiontoken.FromIncomingContext(ctx, sessiontoken.DefaultHeader, proxyKey)
+//	if err != nil {
+//		return status.Error(codes.Unauthenticated, err.Error())
+//	}
+//	if err := claims.CheckPayload(first.GetPayload()); err != nil { ... }
+package sessiontoken
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// DefaultHeader is the request header the proxy puts the token in
+const DefaultHeader = "x-proxy-attestation"
+
+// Issuer is the iss claim of every token the proxy mints
+const Issuer = "grpc-proxy"
+
+// Claims is what a token asserts about the stream it was minted for. The
+// issuer and times are always set; the rest only when the route's claims
+// list names them.
+type Claims struct {
+	Issuer        string `json:"iss"`
+	Subject       string `json:"sub,omitempty"`            // the client identity (identity)
+	Method        string `json:"method,omitempty"`         // the full gRPC method (method)
+	Route         string `json:"route,omitempty"`          // the proxy route's name (route)
+	Tenant        string `json:"tenant,omitempty"`         // the call's trust domain (tenant)
+	PayloadSHA256 string `json:"payload_sha256,omitempty"` // PayloadHash of the first message's payload (payload_hash)
+	IssuedAt      int64  `json:"iat"`                      // Unix seconds
+	ExpiresAt     int64  `json:"exp"`                      // Unix seconds
+}
+
+var (
+	// ErrMissing is returned by FromIncomingContext for a call without a token
+	ErrMissing = errors.New("sessiontoken: no token")
+	// ErrMalformed is returned for a token that does not parse
+	ErrMalformed = errors.New("sessiontoken: malformed token")
+	// ErrSignature is returned for a token the key did not sign
+	ErrSignature = errors.New("sessiontoken: signature does not verify")
+	// ErrExpired is returned for a token past its exp claim
+	ErrExpired = errors.New("sessiontoken: token expired")
+	// ErrPayload is returned by CheckPayload for a payload the token was not
+	// minted for
+	ErrPayload = errors.New("sessiontoken: payload does not match the token")
+)
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid,omitempty"`
+}
+
+var b64 = base64.RawURLEncoding
+
+// PayloadHash is the payload_sha256 claim for payload
+func PayloadHash(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return b64.EncodeToString(sum[:])
+}
+
+// Mint encodes c as a token naming keyID, signed by sign, which returns the
+// RSA PKCS#1 v1.5 SHA-256 signature of the bytes it is given
+func Mint(c Claims, keyID string, sign func(signingInput []byte) ([]byte, error)) (string, error) {
+	h, err := json.Marshal(header{Alg: "RS256", Typ: "JWT", Kid: keyID})
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	input := b64.EncodeToString(h) + "." + b64.EncodeToString(body)
+	sig, err := sign([]byte(input))
+	if err != nil {
+		return "", fmt.Errorf("sessiontoken: sign: %w", err)
+	}
+	return input + "." + b64.EncodeToString(sig), nil
+}
+
+// Verify checks token's signature against key and its expiry against now,
+// returning its claims
+func Verify(token string, key *rsa.PublicKey, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	var h header
+	if err := decodePart(parts[0], &h); err != nil {
+		return nil, err
+	}
+	if h.Alg != "RS256" {
+		return nil, fmt.Errorf("%w: alg %q, want RS256", ErrMalformed, h.Alg)
+	}
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sig); err != nil {
+		return nil, ErrSignature
+	}
+	var c Claims
+	if err := decodePart(parts[1], &c); err != nil {
+		return nil, err
+	}
+	if now.Unix() >= c.ExpiresAt {
+		return nil, fmt.Errorf("%w at %s", ErrExpired, time.Unix(c.ExpiresAt, 0).UTC().Format(time.RFC3339))
+	}
+	return &c, nil
+}
+
+// FromIncomingContext verifies the token in the named header of a server
+// call's incoming metadata, as of now
+func FromIncomingContext(ctx context.Context, header string, key *rsa.PublicKey) (*Claims, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	vals := md.Get(header)
+	if len(vals) == 0 {
+		return nil, ErrMissing
+	}
+	return Verify(vals[0], key, time.Now())
+}
+
+// CheckPayload reports whether the token was minted for a stream whose first
+// message carried payload. A token without the claim matches any payload.
+func (c *Claims) CheckPayload(payload []byte) error {
+	if c.PayloadSHA256 != "" && c.PayloadSHA256 != PayloadHash(payload) {
+		return ErrPayload
+	}
+	return nil
+}
+
+func decodePart(part string, v interface{}) error {
+	b, err := b64.DecodeString(part)
+	if err != nil {
+		return ErrMalformed
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return nil
+}
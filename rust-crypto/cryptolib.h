@@ -3,19 +3,94 @@
 #include <stdint.h>
 #include <stdlib.h>
 
-bool verify_signature(const uint8_t *payload_ptr,
-                      uintptr_t payload_len,
+#define RC_OK 0
+
+/**
+ * verify_signature and verify_digest only: the signature does not match the
+ * payload and key
+ */
+#define RC_INVALID_SIGNATURE 1
+
+#define RC_NULL_ARGUMENT 2
+
+/**
+ * The key is not UTF-8, so it cannot be PEM
+ */
+#define RC_KEY_ENCODING 3
+
+/**
+ * The PEM does not hold a usable RSA key (bad encoding, unsupported size)
+ */
+#define RC_KEY_PARSE 4
+
+#define RC_SIGN_FAILED 5
+
+/**
+ * The library panicked; the panic was caught before it crossed the boundary
+ */
+#define RC_PANIC 6
+
+/**
+ * sign_digest and verify_digest only: the digest is not DIGEST_LEN bytes
+ */
+#define RC_DIGEST_LENGTH 7
+
+/**
+ * The length of the SHA-256 digests sign_digest and verify_digest take
+ */
+#define DIGEST_LEN 32
+
+/**
+ * verify_signature hashes the payload itself; verify_digest, which takes the
+ * digest, saves copying a large payload across the boundary
+ */
+int32_t verify_signature(const uint8_t *payload_ptr,
+                         uintptr_t payload_len,
+                         const uint8_t *sig_ptr,
+                         uintptr_t sig_len,
+                         const uint8_t *pub_key_ptr,
+                         uintptr_t pub_key_len,
+                         char **out_err);
+
+/**
+ * verify_digest checks sig against the SHA-256 digest of a payload
+ */
+int32_t verify_digest(const uint8_t *digest_ptr,
+                      uintptr_t digest_len,
                       const uint8_t *sig_ptr,
                       uintptr_t sig_len,
                       const uint8_t *pub_key_ptr,
-                      uintptr_t pub_key_len);
+                      uintptr_t pub_key_len,
+                      char **out_err);
+
+/**
+ * sign_payload hashes the payload itself; see sign_digest
+ */
+int32_t sign_payload(const uint8_t *payload_ptr,
+                     uintptr_t payload_len,
+                     const uint8_t *priv_key_ptr,
+                     uintptr_t priv_key_len,
+                     uint8_t **out_sig_ptr,
+                     uintptr_t *out_sig_len,
+                     uintptr_t *out_sig_cap,
+                     char **out_err);
 
-bool sign_payload(const uint8_t *payload_ptr,
-                  uintptr_t payload_len,
-                  const uint8_t *priv_key_ptr,
-                  uintptr_t priv_key_len,
-                  uint8_t **out_sig_ptr,
-                  uintptr_t *out_sig_len,
-                  uintptr_t *out_sig_cap);
+/**
+ * sign_digest signs the SHA-256 digest of a payload. The signature is the
+ * one sign_payload makes over the payload.
+ */
+int32_t sign_digest(const uint8_t *digest_ptr,
+                    uintptr_t digest_len,
+                    const uint8_t *priv_key_ptr,
+                    uintptr_t priv_key_len,
+                    uint8_t **out_sig_ptr,
+                    uintptr_t *out_sig_len,
+                    uintptr_t *out_sig_cap,
+                    char **out_err);
 
 void free_signature(uint8_t *sig_ptr, uintptr_t sig_len, uintptr_t sig_cap);
+
+/**
+ * free_error releases a message set through out_err
+ */
+void free_error(char *message);
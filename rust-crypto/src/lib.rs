@@ -2,83 +2,125 @@ use rsa::pkcs1::DecodeRsaPrivateKey;
 use rsa::pkcs8::{DecodePrivateKey, DecodePublicKey};
 use rsa::{Pkcs1v15Sign, RsaPrivateKey, RsaPublicKey};
 use sha2::{Digest, Sha256};
+use std::any::Any;
+use std::ffi::CString;
+use std::os::raw::c_char;
+use std::panic::{self, AssertUnwindSafe};
 use std::slice;
 use std::str;
 
-#[no_mangle]
-pub extern "C" fn verify_signature(
-    payload_ptr: *const u8,
-    payload_len: usize,
-    sig_ptr: *const u8,
-    sig_len: usize,
-    pub_key_ptr: *const u8,
-    pub_key_len: usize,
-) -> bool {
-    if payload_ptr.is_null() || sig_ptr.is_null() || pub_key_ptr.is_null() {
-        return false;
-    }
+// Every entry point returns one of these. Anything but RC_OK and
+// RC_INVALID_SIGNATURE also sets *out_err, when out_err is not NULL, to a
+// NUL-terminated message the caller releases with free_error.
+pub const RC_OK: i32 = 0;
+/// verify_signature and verify_digest only: the signature does not match the
+/// payload and key
+pub const RC_INVALID_SIGNATURE: i32 = 1;
+pub const RC_NULL_ARGUMENT: i32 = 2;
+/// The key is not UTF-8, so it cannot be PEM
+pub const RC_KEY_ENCODING: i32 = 3;
+/// The PEM does not hold a usable RSA key (bad encoding, unsupported size)
+pub const RC_KEY_PARSE: i32 = 4;
+pub const RC_SIGN_FAILED: i32 = 5;
+/// The library panicked; the panic was caught before it crossed the boundary
+pub const RC_PANIC: i32 = 6;
+/// sign_digest and verify_digest only: the digest is not DIGEST_LEN bytes
+pub const RC_DIGEST_LENGTH: i32 = 7;
 
-    let payload = unsafe { slice::from_raw_parts(payload_ptr, payload_len) };
-    let sig = unsafe { slice::from_raw_parts(sig_ptr, sig_len) };
-    let pub_key_bytes = unsafe { slice::from_raw_parts(pub_key_ptr, pub_key_len) };
+/// The length of the SHA-256 digests sign_digest and verify_digest take
+pub const DIGEST_LEN: usize = 32;
 
-    let pub_key_str = match str::from_utf8(pub_key_bytes) {
-        Ok(s) => s,
-        Err(_) => return false,
-    };
+struct FfiError {
+    code: i32,
+    message: String,
+}
 
-    let public_key = match RsaPublicKey::from_public_key_pem(pub_key_str) {
-        Ok(k) => k,
-        Err(_) => return false,
-    };
+fn fail<T>(code: i32, message: impl Into<String>) -> Result<T, FfiError> {
+    Err(FfiError { code, message: message.into() })
+}
 
-    let mut hasher = Sha256::new();
-    hasher.update(payload);
-    let hashed = hasher.finalize();
+/// guarded runs f with panics caught, so none unwinds into the caller, and
+/// turns its outcome into a status code and error message
+fn guarded<F: FnOnce() -> Result<i32, FfiError>>(out_err: *mut *mut c_char, f: F) -> i32 {
+    let result = panic::catch_unwind(AssertUnwindSafe(f)).unwrap_or_else(|payload| {
+        fail(RC_PANIC, format!("panic: {}", panic_message(payload.as_ref())))
+    });
+    match result {
+        Ok(code) => code,
+        Err(e) => {
+            set_error(out_err, &e.message);
+            e.code
+        }
+    }
+}
 
-    let scheme = Pkcs1v15Sign::new::<Sha256>();
-    public_key.verify(scheme, &hashed, sig).is_ok()
+fn panic_message(payload: &(dyn Any + Send)) -> &str {
+    if let Some(s) = payload.downcast_ref::<&str>() {
+        s
+    } else if let Some(s) = payload.downcast_ref::<String>() {
+        s
+    } else {
+        "unknown cause"
+    }
 }
 
-#[no_mangle]
-pub extern "C" fn sign_payload(
-    payload_ptr: *const u8,
-    payload_len: usize,
-    priv_key_ptr: *const u8,
-    priv_key_len: usize,
-    out_sig_ptr: *mut *mut u8,
-    out_sig_len: *mut usize,
-    out_sig_cap: *mut usize,
-) -> bool {
-    if payload_ptr.is_null() || priv_key_ptr.is_null() || out_sig_ptr.is_null() || out_sig_len.is_null() || out_sig_cap.is_null() {
-        return false;
+fn set_error(out_err: *mut *mut c_char, message: &str) {
+    if out_err.is_null() {
+        return;
+    }
+    let message = CString::new(message.replace('\0', " ")).unwrap_or_default();
+    unsafe {
+        *out_err = message.into_raw();
     }
+}
 
-    let payload = unsafe { slice::from_raw_parts(payload_ptr, payload_len) };
-    let priv_key_bytes = unsafe { slice::from_raw_parts(priv_key_ptr, priv_key_len) };
+fn key_str(key: &[u8]) -> Result<&str, FfiError> {
+    str::from_utf8(key).or_else(|e| fail(RC_KEY_ENCODING, format!("key is not UTF-8 PEM: {}", e)))
+}
 
-    let priv_key_str = match str::from_utf8(priv_key_bytes) {
-        Ok(s) => s,
-        Err(_) => return false,
-    };
+fn public_key(key: &[u8]) -> Result<RsaPublicKey, FfiError> {
+    RsaPublicKey::from_public_key_pem(key_str(key)?).or_else(|e| fail(RC_KEY_PARSE, format!("public key: {}", e)))
+}
 
+fn private_key(key: &[u8]) -> Result<RsaPrivateKey, FfiError> {
+    let key = key_str(key)?;
     // Try PKCS8 first, then PKCS1
-    let private_key = match RsaPrivateKey::from_pkcs8_pem(priv_key_str) {
-        Ok(k) => k,
-        Err(_) => match RsaPrivateKey::from_pkcs1_pem(priv_key_str) {
-            Ok(k) => k,
-            Err(_) => return false,
+    match RsaPrivateKey::from_pkcs8_pem(key) {
+        Ok(k) => Ok(k),
+        Err(pkcs8_err) => match RsaPrivateKey::from_pkcs1_pem(key) {
+            Ok(k) => Ok(k),
+            Err(pkcs1_err) => fail(RC_KEY_PARSE, format!("private key: not PKCS#8 ({}) or PKCS#1 ({})", pkcs8_err, pkcs1_err)),
         },
-    };
+    }
+}
 
-    let mut hasher = Sha256::new();
-    hasher.update(payload);
-    let hashed = hasher.finalize();
+/// digest borrows a SHA-256 digest argument, refusing any other length
+fn digest<'a>(op: &str, digest_ptr: *const u8, digest_len: usize) -> Result<&'a [u8], FfiError> {
+    if digest_len != DIGEST_LEN {
+        return fail(RC_DIGEST_LENGTH, format!("{}: digest is {} bytes, not {}", op, digest_len, DIGEST_LEN));
+    }
+    Ok(unsafe { slice::from_raw_parts(digest_ptr, digest_len) })
+}
+
+fn verify_hashed(public_key: &RsaPublicKey, hashed: &[u8], sig: &[u8]) -> i32 {
+    match public_key.verify(Pkcs1v15Sign::new::<Sha256>(), hashed, sig) {
+        Ok(()) => RC_OK,
+        Err(_) => RC_INVALID_SIGNATURE,
+    }
+}
 
-    let scheme = Pkcs1v15Sign::new::<Sha256>();
-    let mut sig_vec = match private_key.sign(scheme, &hashed) {
+/// sign_hashed signs a SHA-256 digest and hands the signature to the caller,
+/// who releases it with free_signature
+fn sign_hashed(
+    private_key: &RsaPrivateKey,
+    hashed: &[u8],
+    out_sig_ptr: *mut *mut u8,
+    out_sig_len: *mut usize,
+    out_sig_cap: *mut usize,
+) -> Result<i32, FfiError> {
+    let mut sig_vec = match private_key.sign(Pkcs1v15Sign::new::<Sha256>(), hashed) {
         Ok(s) => s,
-        Err(_) => return false,
+        Err(e) => return fail(RC_SIGN_FAILED, format!("sign: {}", e)),
     };
 
     sig_vec.shrink_to_fit();
@@ -93,7 +135,105 @@ pub extern "C" fn sign_payload(
     }
 
     std::mem::forget(sig_vec);
-    true
+    Ok(RC_OK)
+}
+
+/// verify_signature hashes the payload itself; verify_digest, which takes the
+/// digest, saves copying a large payload across the boundary
+#[no_mangle]
+pub extern "C" fn verify_signature(
+    payload_ptr: *const u8,
+    payload_len: usize,
+    sig_ptr: *const u8,
+    sig_len: usize,
+    pub_key_ptr: *const u8,
+    pub_key_len: usize,
+    out_err: *mut *mut c_char,
+) -> i32 {
+    guarded(out_err, || {
+        if payload_ptr.is_null() || sig_ptr.is_null() || pub_key_ptr.is_null() {
+            return fail(RC_NULL_ARGUMENT, "verify_signature: NULL payload, signature or key");
+        }
+
+        let payload = unsafe { slice::from_raw_parts(payload_ptr, payload_len) };
+        let sig = unsafe { slice::from_raw_parts(sig_ptr, sig_len) };
+        let public_key = public_key(unsafe { slice::from_raw_parts(pub_key_ptr, pub_key_len) })?;
+
+        Ok(verify_hashed(&public_key, &Sha256::digest(payload), sig))
+    })
+}
+
+/// verify_digest checks sig against the SHA-256 digest of a payload
+#[no_mangle]
+pub extern "C" fn verify_digest(
+    digest_ptr: *const u8,
+    digest_len: usize,
+    sig_ptr: *const u8,
+    sig_len: usize,
+    pub_key_ptr: *const u8,
+    pub_key_len: usize,
+    out_err: *mut *mut c_char,
+) -> i32 {
+    guarded(out_err, || {
+        if digest_ptr.is_null() || sig_ptr.is_null() || pub_key_ptr.is_null() {
+            return fail(RC_NULL_ARGUMENT, "verify_digest: NULL digest, signature or key");
+        }
+
+        let hashed = digest("verify_digest", digest_ptr, digest_len)?;
+        let sig = unsafe { slice::from_raw_parts(sig_ptr, sig_len) };
+        let public_key = public_key(unsafe { slice::from_raw_parts(pub_key_ptr, pub_key_len) })?;
+
+        Ok(verify_hashed(&public_key, hashed, sig))
+    })
+}
+
+/// sign_payload hashes the payload itself; see sign_digest
+#[no_mangle]
+pub extern "C" fn sign_payload(
+    payload_ptr: *const u8,
+    payload_len: usize,
+    priv_key_ptr: *const u8,
+    priv_key_len: usize,
+    out_sig_ptr: *mut *mut u8,
+    out_sig_len: *mut usize,
+    out_sig_cap: *mut usize,
+    out_err: *mut *mut c_char,
+) -> i32 {
+    guarded(out_err, || {
+        if payload_ptr.is_null() || priv_key_ptr.is_null() || out_sig_ptr.is_null() || out_sig_len.is_null() || out_sig_cap.is_null() {
+            return fail(RC_NULL_ARGUMENT, "sign_payload: NULL payload, key or output");
+        }
+
+        let payload = unsafe { slice::from_raw_parts(payload_ptr, payload_len) };
+        let private_key = private_key(unsafe { slice::from_raw_parts(priv_key_ptr, priv_key_len) })?;
+
+        sign_hashed(&private_key, &Sha256::digest(payload), out_sig_ptr, out_sig_len, out_sig_cap)
+    })
+}
+
+/// sign_digest signs the SHA-256 digest of a payload. The signature is the
+/// one sign_payload makes over the payload.
+#[no_mangle]
+pub extern "C" fn sign_digest(
+    digest_ptr: *const u8,
+    digest_len: usize,
+    priv_key_ptr: *const u8,
+    priv_key_len: usize,
+    out_sig_ptr: *mut *mut u8,
+    out_sig_len: *mut usize,
+    out_sig_cap: *mut usize,
+    out_err: *mut *mut c_char,
+) -> i32 {
+    guarded(out_err, || {
+        if digest_ptr.is_null() || priv_key_ptr.is_null() || out_sig_ptr.is_null() || out_sig_len.is_null() || out_sig_cap.is_null() {
+            return fail(RC_NULL_ARGUMENT, "sign_digest: NULL digest, key or output");
+        }
+
+        let hashed = digest("sign_digest", digest_ptr, digest_len)?;
+        let private_key = private_key(unsafe { slice::from_raw_parts(priv_key_ptr, priv_key_len) })?;
+
+        sign_hashed(&private_key, hashed, out_sig_ptr, out_sig_len, out_sig_cap)
+    })
 }
 
 #[no_mangle]
@@ -104,3 +244,13 @@ pub extern "C" fn free_signature(sig_ptr: *mut u8, sig_len: usize, sig_cap: usiz
         }
     }
 }
+
+/// free_error releases a message set through out_err
+#[no_mangle]
+pub extern "C" fn free_error(message: *mut c_char) {
+    if !message.is_null() {
+        unsafe {
+            let _ = CString::from_raw(message);
+        }
+    }
+}